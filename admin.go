@@ -0,0 +1,244 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/stats"
+)
+
+const (
+	defaultAdminSessions = 100
+	maxAdminBodySize     = Mebi
+	maxAdminStateSize    = 64 * Mebi
+)
+
+// AdminConfigView is the current configuration of HTTPProxy returned by the admin API.
+type AdminConfigView struct {
+	UpstreamProxy      string `json:"upstream_proxy,omitempty"`
+	DenyDomains        string `json:"deny_domains,omitempty"`
+	DirectDomains      string `json:"direct_domains,omitempty"`
+	MITMDomains        string `json:"mitm_domains,omitempty"`
+	MITMExcludeDomains string `json:"mitm_exclude_domains,omitempty"`
+	LogHTTPMode        string `json:"log_http"`
+	Draining           bool   `json:"draining"`
+}
+
+// AdminSessionsView is the list of active sessions returned by the admin API.
+type AdminSessionsView struct {
+	Active   int             `json:"active"`
+	Sessions []stats.Session `json:"sessions"`
+}
+
+// NewAdminHandler returns a handler of the admin REST API for runtime control of the proxy.
+// It is meant to be served on a separate listener protected with its own authentication.
+//
+// The endpoints are:
+//
+//	GET  /sessions              active sessions, requires stats, the n query parameter limits the number of listed sessions
+//	GET  /config                current configuration
+//	PUT  /config/deny-domains   replace deny domains, the body contains one rule per line, empty body removes the rules
+//	PUT  /config/log-http       set HTTP log mode, the body contains the mode
+//	GET  /state                 snapshot of the runtime state, see ProxyState
+//	PUT  /state                 restore the runtime state from a snapshot
+//	POST /drain                 stop accepting new connections and close existing ones after the next response
+func NewAdminHandler(hp *HTTPProxy) http.Handler {
+	a := adminHandler{hp: hp}
+
+	m := http.NewServeMux()
+	m.HandleFunc("/sessions", a.sessions)
+	m.HandleFunc("/config", a.config)
+	m.HandleFunc("/config/deny-domains", a.denyDomains)
+	m.HandleFunc("/config/log-http", a.logHTTP)
+	m.HandleFunc("/state", a.state)
+	m.HandleFunc("/drain", a.drain)
+
+	return m
+}
+
+type adminHandler struct {
+	hp *HTTPProxy
+}
+
+func (a adminHandler) sessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	s := a.hp.config.Stats
+	if s == nil {
+		http.Error(w, "sessions are not available, stats are disabled", http.StatusNotFound)
+		return
+	}
+
+	n := defaultAdminSessions
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			http.Error(w, "n: invalid value "+strconv.Quote(v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var v AdminSessionsView
+	v.Active, v.Sessions = s.Active(n)
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (a adminHandler) config(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.configView())
+}
+
+func (a adminHandler) configView() AdminConfigView {
+	rc := a.hp.RuntimeConfig()
+
+	v := AdminConfigView{
+		LogHTTPMode: rc.LogHTTPMode.String(),
+		Draining:    a.hp.Draining(),
+	}
+	if rc.UpstreamProxy != nil {
+		v.UpstreamProxy = rc.UpstreamProxy.Redacted()
+	}
+	if rc.DenyDomains != nil {
+		v.DenyDomains = rc.DenyDomains.String()
+	}
+	if rc.DirectDomains != nil {
+		v.DirectDomains = rc.DirectDomains.String()
+	}
+	if rc.MITMDomains != nil {
+		v.MITMDomains = rc.MITMDomains.String()
+	}
+	if rc.MITMExcludeDomains != nil {
+		v.MITMExcludeDomains = rc.MITMExcludeDomains.String()
+	}
+
+	return v
+}
+
+func (a adminHandler) denyDomains(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	b, ok := readAdminBody(w, r)
+	if !ok {
+		return
+	}
+	dd, err := parseRegexpMatcherLines(b, a.hp.config.RegexpLimits)
+	if err != nil {
+		http.Error(w, "deny domains: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.hp.UpdateRuntimeConfig(func(rc *RuntimeConfig) {
+		rc.DenyDomains = dd
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.configView())
+}
+
+func (a adminHandler) logHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	b, ok := readAdminBody(w, r)
+	if !ok {
+		return
+	}
+	mode := httplog.Mode(strings.TrimSpace(b))
+	if !isHTTPLogMode(mode) {
+		http.Error(w, "log-http: invalid mode "+strconv.Quote(mode.String()), http.StatusBadRequest)
+		return
+	}
+	if err := a.hp.UpdateRuntimeConfig(func(rc *RuntimeConfig) {
+		rc.LogHTTPMode = mode
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.configView())
+}
+
+func (a adminHandler) state(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.hp.ExportState())
+	case http.MethodPut:
+		var s ProxyState
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(maxAdminStateSize))).Decode(&s); err != nil {
+			http.Error(w, "state: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.hp.ImportState(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.configView())
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a adminHandler) drain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	a.hp.Drain()
+
+	writeJSON(w, http.StatusAccepted, a.configView())
+}
+
+func isHTTPLogMode(mode httplog.Mode) bool {
+	for _, m := range httplog.Modes() {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func readAdminBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxAdminBodySize)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return string(b), true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v) //nolint:errcheck // best effort
+}
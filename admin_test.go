@@ -0,0 +1,192 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestAdminHandler(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.RegexpLimits = &ruleset.RegexpLimits{MaxLength: 32}
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	get := func(t *testing.T, u string) int {
+		t.Helper()
+		res, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	h := NewAdminHandler(p)
+	do := func(t *testing.T, method, path, body string) (int, AdminConfigView) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+		var v AdminConfigView
+		if rec.Header().Get("Content-Type") == "application/json" {
+			if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, v
+	}
+
+	t.Run("config", func(t *testing.T) {
+		code, v := do(t, http.MethodGet, "/config", "")
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if v.LogHTTPMode != cfg.LogHTTPMode.String() {
+			t.Fatalf("expected log mode %s, got %s", cfg.LogHTTPMode, v.LogHTTPMode)
+		}
+		if v.Draining {
+			t.Fatal("expected not draining")
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		if code, _ := do(t, http.MethodPost, "/config", ""); code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, code)
+		}
+	})
+
+	t.Run("sessions without stats", func(t *testing.T) {
+		if code, _ := do(t, http.MethodGet, "/sessions", ""); code != http.StatusNotFound {
+			t.Fatalf("expected status %d, got %d", http.StatusNotFound, code)
+		}
+	})
+
+	t.Run("deny domains", func(t *testing.T) {
+		if code := get(t, "http://denied.com/"); code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+
+		code, v := do(t, http.MethodPut, "/config/deny-domains", "^denied\\.com$\n")
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if v.DenyDomains != `^denied\.com$` {
+			t.Fatalf("expected deny domains %q, got %q", `^denied\.com$`, v.DenyDomains)
+		}
+
+		if code := get(t, "http://denied.com/"); code != http.StatusForbidden {
+			t.Fatalf("expected status %d, got %d", http.StatusForbidden, code)
+		}
+		if code := get(t, "http://allowed.com/"); code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+
+		if code, _ := do(t, http.MethodPut, "/config/deny-domains", "("); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("regexp limits", func(t *testing.T) {
+		if code, _ := do(t, http.MethodPut, "/config/deny-domains", strings.Repeat("a", 33)); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+		}
+		if dd := p.RuntimeConfig().DenyDomains; dd == nil || !dd.Match("denied.com") {
+			t.Fatal("expected deny domains unchanged")
+		}
+	})
+
+	t.Run("log http", func(t *testing.T) {
+		code, v := do(t, http.MethodPut, "/config/log-http", "none\n")
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if v.LogHTTPMode != httplog.None.String() {
+			t.Fatalf("expected log mode %s, got %s", httplog.None, v.LogHTTPMode)
+		}
+		if m := p.RuntimeConfig().LogHTTPMode; m != httplog.None {
+			t.Fatalf("expected log mode %s, got %s", httplog.None, m)
+		}
+
+		if code, _ := do(t, http.MethodPut, "/config/log-http", "foo"); code != http.StatusBadRequest {
+			t.Fatalf("expected status %d, got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("state", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", http.NoBody))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+		}
+		var s ProxyState
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.DenyDomains) != 1 {
+			t.Fatalf("expected 1 deny domain, got %v", s.DenyDomains)
+		}
+
+		s.DenyDomains = nil
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, v := do(t, http.MethodPut, "/state", string(b))
+		if code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if v.DenyDomains != "" {
+			t.Fatalf("expected no deny domains, got %q", v.DenyDomains)
+		}
+
+		if code, _ := do(t, http.MethodPut, "/state", `{"version":0}`); code != http.StatusConflict {
+			t.Fatalf("expected status %d, got %d", http.StatusConflict, code)
+		}
+		if code, _ := do(t, http.MethodPost, "/state", ""); code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected status %d, got %d", http.StatusMethodNotAllowed, code)
+		}
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		code, v := do(t, http.MethodPost, "/drain", "")
+		if code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d", http.StatusAccepted, code)
+		}
+		if !v.Draining || !p.Draining() {
+			t.Fatal("expected draining")
+		}
+	})
+}
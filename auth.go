@@ -0,0 +1,201 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// Authenticator authenticates proxy clients.
+type Authenticator interface {
+	// Authenticate returns the identity of the client, or an error if the request is not authenticated.
+	Authenticate(req *http.Request) (identity string, err error)
+}
+
+// GroupAuthenticator is implemented by authenticators that return the groups of the client,
+// the groups are used to select user policies.
+type GroupAuthenticator interface {
+	Authenticator
+	AuthenticateGroups(req *http.Request) (identity string, groups []string, err error)
+}
+
+// AuthChallenger is implemented by authenticators that add Proxy-Authenticate challenges
+// to 407 Proxy Authentication Required responses.
+type AuthChallenger interface {
+	Challenge(h http.Header, req *http.Request)
+}
+
+var errInvalidCredentials = errors.New("invalid credentials")
+
+type basicAuthenticator struct {
+	user, pass string
+	ba         *middleware.BasicAuth
+}
+
+// NewBasicAuthenticator returns an Authenticator that checks the basic auth credentials in the Proxy-Authorization header.
+func NewBasicAuthenticator(u *url.Userinfo) Authenticator {
+	pass, _ := u.Password()
+	return &basicAuthenticator{
+		user: u.Username(),
+		pass: pass,
+		ba:   middleware.NewProxyBasicAuth(),
+	}
+}
+
+func (a *basicAuthenticator) Authenticate(req *http.Request) (string, error) {
+	if !a.ba.AuthenticatedRequest(req, a.user, a.pass) {
+		return "", errInvalidCredentials
+	}
+	return a.user, nil
+}
+
+func (a *basicAuthenticator) Challenge(h http.Header, _ *http.Request) {
+	h.Add("Proxy-Authenticate", `Basic realm="`+proxyAuthRealm+`"`)
+}
+
+type digestAuthenticator struct {
+	user, pass string
+	da         *middleware.DigestAuth
+}
+
+// NewDigestAuthenticator returns an Authenticator that checks the digest auth credentials in the Proxy-Authorization header.
+func NewDigestAuthenticator(u *url.Userinfo) Authenticator {
+	pass, _ := u.Password()
+	return &digestAuthenticator{
+		user: u.Username(),
+		pass: pass,
+		da:   middleware.NewProxyDigestAuth(proxyAuthRealm),
+	}
+}
+
+func (a *digestAuthenticator) Authenticate(req *http.Request) (string, error) {
+	if !a.da.AuthenticatedRequest(req, a.user, a.pass) {
+		return "", errInvalidCredentials
+	}
+	return a.user, nil
+}
+
+func (a *digestAuthenticator) Challenge(h http.Header, req *http.Request) {
+	for _, c := range a.da.Challenges(req) {
+		h.Add("Proxy-Authenticate", c)
+	}
+}
+
+// IPAllowlistAuthenticator authenticates clients connecting from the allowed networks,
+// the identity is the client IP address.
+type IPAllowlistAuthenticator struct {
+	Networks []netip.Prefix
+}
+
+func (a *IPAllowlistAuthenticator) Authenticate(req *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return "", err
+	}
+	ip = ip.Unmap()
+	for _, n := range a.Networks {
+		if n.Contains(ip) {
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("client IP not allowed")
+}
+
+// authenticators returns the configured authenticators: client certificate, basic or digest, htpasswd, JWT bearer,
+// and custom ones in that order.
+func (hp *HTTPProxy) authenticators() []Authenticator {
+	var auths []Authenticator
+	if hp.clientCert != nil {
+		auths = append(auths, hp.clientCert)
+	}
+	if u := hp.config.BasicAuth; u != nil {
+		switch hp.config.AuthScheme {
+		case DigestAuthScheme:
+			auths = append(auths, NewDigestAuthenticator(u))
+		default:
+			auths = append(auths, NewBasicAuthenticator(u))
+		}
+	}
+	if hp.htpasswd != nil {
+		auths = append(auths, hp.htpasswd)
+	}
+	if hp.jwtAuth != nil {
+		auths = append(auths, hp.jwtAuth)
+	}
+	auths = append(auths, hp.config.Authenticators...)
+	return auths
+}
+
+// authRequired returns true if proxy clients must authenticate.
+func (hp *HTTPProxy) authRequired() bool {
+	return hp.clientCert != nil || hp.config.BasicAuth != nil || hp.htpasswd != nil || hp.jwtAuth != nil || len(hp.config.Authenticators) > 0
+}
+
+// proxyAuth requires the request to be authenticated by any of the configured authenticators.
+// The authenticated user is associated with the request, see middleware.User.
+func (hp *HTTPProxy) proxyAuth() martian.RequestModifier {
+	auths := hp.authenticators()
+	if hp.clientCert != nil {
+		hp.log.Infof("client certificate auth enabled identity=%s optional=%v", hp.clientCert.Identity, hp.config.ClientAuth.Optional)
+	}
+	if hp.config.BasicAuth != nil {
+		hp.log.Infof("%s auth enabled", hp.config.AuthScheme)
+	}
+	if hp.htpasswd != nil {
+		hp.log.Infof("htpasswd auth enabled users=%d", hp.htpasswd.Len())
+	}
+	if hp.jwtAuth != nil {
+		hp.log.Infof("JWT bearer auth enabled")
+	}
+	if n := len(hp.config.Authenticators); n > 0 {
+		hp.log.Infof("custom auth enabled authenticators=%d", n)
+	}
+
+	return hp.abortIf(func(req *http.Request) bool {
+		if isMITMCAHostRequest(req) {
+			return false
+		}
+		for _, a := range auths {
+			if ga, ok := a.(GroupAuthenticator); ok {
+				if user, groups, err := ga.AuthenticateGroups(req); err == nil {
+					middleware.SetUser(req, user, groups...)
+					return false
+				}
+				continue
+			}
+			if user, err := a.Authenticate(req); err == nil {
+				middleware.SetUser(req, user)
+				// Users are bounded by the htpasswd file, so it is safe to use them as metric labels.
+				if _, ok := a.(*HtpasswdAuthenticator); ok {
+					hp.metrics.userRequest(user)
+				}
+				return false
+			}
+		}
+		return true
+	}, func(req *http.Request) *http.Response {
+		resp := proxyutil.NewResponse(http.StatusProxyAuthRequired, nil, req)
+		for _, a := range auths {
+			if c, ok := a.(AuthChallenger); ok {
+				c.Challenge(resp.Header, req)
+			}
+		}
+		return resp
+	}, errors.New("proxy authentication required"))
+}
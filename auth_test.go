@@ -0,0 +1,122 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestIPAllowlistAuthenticator(t *testing.T) {
+	a := &IPAllowlistAuthenticator{Networks: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}}
+
+	tests := []struct {
+		addr string
+		user string
+	}{
+		{"10.1.2.3:1234", "10.1.2.3"},
+		{"[::ffff:10.1.2.3]:1234", "10.1.2.3"},
+		{"[2001:db8::1]:1234", "2001:db8::1"},
+		{"192.168.1.1:1234", ""},
+		{"pipe", ""},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.addr, func(t *testing.T) {
+			user, err := a.Authenticate(&http.Request{RemoteAddr: tc.addr})
+			if tc.user == "" {
+				if err == nil {
+					t.Fatalf("expected error, got user %q", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != tc.user {
+				t.Fatalf("expected user %q, got %q", tc.user, user)
+			}
+		})
+	}
+}
+
+type tokenAuthenticator map[string]string
+
+func (a tokenAuthenticator) Authenticate(req *http.Request) (string, error) {
+	if u, ok := a[req.Header.Get("X-Token")]; ok {
+		return u, nil
+	}
+	return "", errors.New("invalid token")
+}
+
+func TestProxyAuthCustomAuthenticator(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Authenticators = []Authenticator{tokenAuthenticator{"secret": "alice"}}
+
+	var user string
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			user = middleware.User(req)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	do := func(token string) int {
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Token", token)
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if s := do("wrong"); s != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status 407, got %d", s)
+	}
+	if s := do("secret"); s != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", s)
+	}
+	if user != "alice" {
+		t.Fatalf("expected user alice, got %q", user)
+	}
+}
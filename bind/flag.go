@@ -15,10 +15,15 @@ import (
 	"github.com/mmatczuk/anyflag"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/fileurl"
+	"github.com/saucelabs/forwarder/grpcapi"
 	"github.com/saucelabs/forwarder/header"
+	"github.com/saucelabs/forwarder/hsts"
 	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/journal"
 	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/remoteconfig"
 	"github.com/saucelabs/forwarder/ruleset"
+	"github.com/saucelabs/forwarder/stats"
 	"github.com/saucelabs/forwarder/utils/osdns"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -51,6 +56,23 @@ func DNSConfig(fs *pflag.FlagSet, cfg *osdns.Config) {
 			"passing this flag will enable round-robin selection. ")
 }
 
+func DNSClientSubnet(fs *pflag.FlagSet, cfg *netip.Prefix) {
+	fs.Var(anyflag.NewValue[netip.Prefix](*cfg, cfg, forwarder.ParseDNSClientSubnet),
+		"dns-client-subnet", "<off|ip/prefix>"+
+			"EDNS Client Subnet sent in DNS queries, DNS servers may use it to select the response e.g. for CDN geo-routing. "+
+			"The value off asks DNS servers not to use the client address, an IP prefix makes responses deterministic e.g. for testing. "+
+			"If not set, DNS queries are sent unchanged. ")
+}
+
+func DNSRoutes(fs *pflag.FlagSet, cfg *[]forwarder.DNSRouteItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.DNSRouteItem](*cfg, cfg, forwarder.ParseDNSRouteItem),
+		"dns-route", "<regexp>=<ip>[:<port>]|<regexp>=<https://url>"+
+			"Resolve host names matching the regexp with the specified DNS server or DNS over HTTPS server instead of the default resolver, "+
+			"e.g. to resolve internal zones with corporate DNS servers. "+
+			"The flag can be specified multiple times to add routes or more servers to a route, the servers are used in a round-robin fashion. "+
+			"The first matching route is used. ")
+}
+
 func PAC(fs *pflag.FlagSet, pac **url.URL) {
 	fs.VarP(anyflag.NewValue[*url.URL](*pac, pac, fileurl.ParseFilePathOrURL),
 		"pac", "p", "<path or URL>"+
@@ -87,19 +109,44 @@ func ResponseHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
 			"See the documentation for the -H, --header flag for more details on the format. ")
 }
 
+func ConnectResponseHeaders(fs *pflag.FlagSet, headers *[]header.Header) {
+	fs.Var(anyflag.NewSliceValueWithRedact[header.Header](*headers, headers, header.ParseHeader, RedactHeader),
+		"connect-response-header", "<header>"+
+			"Add or remove HTTP headers on responses to CONNECT requests, "+
+			"both 200 Connection Established and error responses. "+
+			"See the documentation for the -H, --header flag for more details on the format. ")
+}
+
 func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *log.Config) {
 	HTTPServerConfig(fs, &cfg.HTTPServerConfig, "", forwarder.HTTPScheme, forwarder.HTTPSScheme)
 	LogConfig(fs, lcfg)
+	UpstreamProxy(fs, &cfg.UpstreamProxy)
 
-	fs.VarP(anyflag.NewValueWithRedact[*url.URL](cfg.UpstreamProxy, &cfg.UpstreamProxy, forwarder.ParseProxyURL, RedactURL),
-		"proxy", "x", "[protocol://]host[:port]"+
-			"Upstream proxy to use. "+
-			"The supported protocols are: http, https, socks5. "+
-			"No protocol specified will be treated as HTTP proxy. "+
-			"If the port number is not specified, it is assumed to be 1080. "+
-			"The basic authentication username and password can be specified in the host string e.g. user:pass@host:port. "+
-			"Alternatively, you can use the -c, --credentials flag to specify the credentials. "+
-			"If both are specified, the proxy flag takes precedence. ")
+	fs.Var(anyflag.NewSliceValueWithRedact[*url.URL](cfg.UpstreamProxyFallback, &cfg.UpstreamProxyFallback, forwarder.ParseProxyURL, RedactURL),
+		"proxy-fallback", "[protocol://]host[:port]"+
+			"Fallback upstream proxy to use if connecting to the upstream proxy fails or times out. "+
+			"The flag can be specified multiple times, proxies are tried in order. "+
+			"The format is the same as for the -x, --proxy flag. "+
+			"Requests with a body are not retried. ")
+
+	fs.Var(anyflag.NewSliceValueWithRedact[*forwarder.UpstreamProxyRule](cfg.UpstreamProxyRules, &cfg.UpstreamProxyRules,
+		forwarder.ParseUpstreamProxyRule, forwarder.RedactUpstreamProxyRule),
+		"proxy-rule", "<pattern>=<[protocol://]host[:port]|DIRECT>"+
+			"Route requests to hosts matching the pattern via the upstream proxy, or directly if DIRECT is specified, "+
+			"e.g. '*.corp.example.com=http://10.0.0.1:3128' or '\\.internal$=DIRECT'. "+
+			"The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains. "+
+			"The proxy format is the same as for the -x, --proxy flag. "+
+			"The flag can be specified multiple times, the first matching rule is used, "+
+			"requests not matching any rule use the -x, --proxy flag or PAC. ")
+
+	fs.Var(anyflag.NewSliceValue[*forwarder.UpstreamAuthRule](cfg.UpstreamAuthRules, &cfg.UpstreamAuthRules, forwarder.ParseUpstreamAuthRule),
+		"proxy-auth-mode", "<pattern>=<preemptive|challenge>"+
+			"Set when credentials are sent to upstream proxies with host matching the pattern, e.g. '*.corp.example.com=challenge'. "+
+			"In the preemptive mode credentials are sent with every request. "+
+			"In the challenge mode credentials are sent only after the proxy responds with 407 Proxy Authentication Required, "+
+			"and the request is retried once, requests with a body that cannot be replayed are not retried. "+
+			"The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains. "+
+			"The flag can be specified multiple times, the first matching rule is used, by default credentials are sent preemptively. ")
 
 	proxyLocalhostValues := []forwarder.ProxyLocalhostMode{
 		forwarder.DenyProxyLocalhost,
@@ -112,6 +159,35 @@ func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *lo
 			"Setting this to direct sends requests to localhost directly without using the upstream proxy. "+
 			"By default, requests to localhost are denied. ")
 
+	fs.Var(anyflag.NewValue[forwarder.ClientCertIdentity](cfg.ClientCertIdentity, &cfg.ClientCertIdentity,
+		anyflag.EnumParser[forwarder.ClientCertIdentity](forwarder.ClientCertIdentities()...)),
+		"tls-client-cert-identity", "<cn|subject|email>"+
+			"Field of the client certificate verified with the --tls-client-cacert-file flag used as the client identity, "+
+			"the identity is used as the user in logs, user policies and metrics. "+
+			"Clients with a verified certificate are authenticated, "+
+			"with the --tls-client-cert-optional flag clients without a certificate must use other authentication methods. ")
+
+	authSchemeValues := []forwarder.AuthScheme{
+		forwarder.BasicAuthScheme,
+		forwarder.DigestAuthScheme,
+	}
+	fs.Var(anyflag.NewValue[forwarder.AuthScheme](cfg.AuthScheme, &cfg.AuthScheme, anyflag.EnumParser[forwarder.AuthScheme](authSchemeValues...)),
+		"auth-scheme", "<basic|digest>"+
+			"HTTP authentication scheme used to authenticate proxy clients with the --basic-auth credentials. "+
+			"Digest authentication (RFC 7616) does not send the password in cleartext, "+
+			"it is recommended when the proxy listens on plain HTTP. ")
+
+	fs.Var(anyflag.NewSliceValue[netip.Prefix](cfg.AllowClients, &cfg.AllowClients, netip.ParsePrefix),
+		"allow-clients", "<cidr>,..."+
+			"Accept connections only from clients in the networks, e.g. 10.0.0.0/8. "+
+			"It applies to the proxy, SOCKS5 and transparent listeners, and to the DNS forwarder. "+
+			"Connections are closed before reading requests, with --proxy-protocol the client address from the header is checked. "+
+			"Rejected connections are counted in the proxy_rejected_connections_total metric. ")
+
+	fs.Var(anyflag.NewSliceValue[netip.Prefix](cfg.DenyClients, &cfg.DenyClients, netip.ParsePrefix),
+		"deny-clients", "<cidr>,..."+
+			"Reject connections from clients in the networks, it takes precedence over --allow-clients. ")
+
 	fs.StringVar(&cfg.Name, "name", cfg.Name, "<string>"+
 		"Name of this proxy instance. This value is used in the Via header in requests. "+
 		"The name value in Via header is extended with a random string to avoid collisions when several proxies are chained. ")
@@ -121,6 +197,65 @@ func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *lo
 			"If the header is present in the request, "+
 			"the proxy will associate the value with the request in the logs. ")
 
+	fs.StringVar(&cfg.AnnotationsHeader, "annotations-header", cfg.AnnotationsHeader, "<name>"+
+		"Response header set to the diagnostics annotations attached to the request by modifiers, e.g. X-Forwarder-Annotations. "+
+		"Annotations are formatted as k=v pairs separated by commas, they are always included in logs and journal entries. ")
+
+	fs.StringVar(&cfg.DebugHost, "debug-host", cfg.DebugHost, "<host>"+
+		"Reserved host name e.g. proxy.debug, requests to http://<host>/ are answered by the proxy with a JSON document "+
+		"showing how the proxy saw the request: client IP, authenticated user, headers and TLS details. "+
+		"Use http://<host>/?url=<url> to also show the rules matching the URL and the selected upstream proxy. "+
+		"The requests require proxy authentication. ")
+
+	fs.BoolVar(&cfg.FTPGateway, "ftp-gateway", cfg.FTPGateway, ""+
+		"Enable handling of ftp:// URLs sent to the proxy. "+
+		"Files are downloaded using passive mode FTP and returned as HTTP responses, directories are rendered as HTML listings. "+
+		"FTP servers are always connected directly, without using the upstream proxy. "+
+		"Login credentials are taken from the -s, --credentials flag, if not specified anonymous login is used. ")
+
+	fs.BoolVar(&cfg.BlockedPlaceholders, "blocked-placeholders", cfg.BlockedPlaceholders, ""+
+		"Respond to denied requests for images, scripts and stylesheets with an empty placeholder "+
+		"(a transparent 1x1 PNG image, empty script or stylesheet), and to denied XHR requests with 204 No Content, "+
+		"instead of an error page, so that pages render cleanly. ")
+
+	fs.BoolVar(&cfg.ForwardInformational, "forward-informational-responses", cfg.ForwardInformational, ""+
+		"Forward 1xx informational responses e.g. 103 Early Hints or 102 Processing from upstream servers to clients "+
+		"before the final response, including MITMed requests. "+
+		"Informational responses are not sent to HTTP/1.0 clients. ")
+
+	fs.BoolVar(&cfg.ModifyEventStreams, "modify-event-streams", cfg.ModifyEventStreams, ""+
+		"Apply response modifiers e.g. --response-header to Server-Sent Events (text/event-stream) responses. "+
+		"By default they are skipped for event streams, so that events are forwarded as soon as they are received. ")
+
+	fs.IntVar(&cfg.SendProxyProtocol, "send-proxy-protocol", cfg.SendProxyProtocol, "<0|1|2>"+
+		"Send the PROXY protocol header of the given version to origin servers and upstream proxies, "+
+		"so that they can see the client address. "+
+		"Connections to upstream servers are not reused when enabled. "+
+		"The header is not sent on CONNECT-UDP and FTP gateway connections. "+
+		"Zero disables sending the header. ")
+
+	fs.IntVar(&cfg.MaxConnsPerClient, "max-conns-per-client", cfg.MaxConnsPerClient, "<int>"+
+		"Maximal number of concurrent connections, including CONNECT tunnels, per client. "+
+		"The client is the authenticated user, or the client IP if authentication is disabled. "+
+		"Requests on connections over the limit are rejected with 429 Too Many Requests. "+
+		"Zero means no limit. ")
+
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", cfg.MaxInFlight, "<int>"+
+		"Maximal number of requests sent upstream at the same time. "+
+		"Requests over the limit wait in a queue, CONNECT requests are not limited, but MITMed requests are. "+
+		"Zero means no limit. ")
+
+	fs.DurationVar(&cfg.InFlightQueueTimeout, "in-flight-queue-timeout", cfg.InFlightQueueTimeout, "<duration>"+
+		"Maximal time a request waits in the --max-in-flight queue, "+
+		"requests that time out are rejected with 503 Service Unavailable. "+
+		"Zero means requests wait until they can be sent. ")
+
+	fs.DurationVar(&cfg.DrainRetryAfter, "drain-retry-after", cfg.DrainRetryAfter, "<duration>"+
+		"Value of the Retry-After header of 503 Service Unavailable responses to CONNECT requests "+
+		"received while the proxy is draining or shutting down. "+
+		"Other requests are served with Connection: close. "+
+		"Zero means the header is not sent. ")
+
 	fs.Var(&cfg.ReadLimit, "read-limit", "<bandwidth>"+
 		"Global read rate limit in bytes per second i.e. how many bytes per second you can receive from a proxy. "+
 		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
@@ -128,6 +263,274 @@ func HTTPProxyConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPProxyConfig, lcfg *lo
 	fs.Var(&cfg.WriteLimit, "write-limit", "<bandwidth>"+
 		"Global write rate limit in bytes per second i.e. how many bytes per second you can send to proxy. "+
 		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
+
+	fs.Var(anyflag.NewSliceValue[*forwarder.HostBandwidthLimit](cfg.HostBandwidthLimits, &cfg.HostBandwidthLimits, forwarder.ParseHostBandwidthLimit),
+		"host-bandwidth-limit", "<pattern>=<bandwidth>"+
+			"Bandwidth limit in bytes per second of traffic to hosts matching the pattern, e.g. '*.cdn.example.com=1Mi'. "+
+			"The limit applies to each direction, and is shared by all requests and tunnels to the matching hosts. "+
+			"The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains. "+
+			"The flag can be specified multiple times, the first matching rule is used. "+
+			"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
+}
+
+func UpstreamProxy(fs *pflag.FlagSet, u **url.URL) {
+	fs.VarP(anyflag.NewValueWithRedact[*url.URL](*u, u, forwarder.ParseProxyURL, RedactURL),
+		"proxy", "x", "[protocol://]host[:port]"+
+			"Upstream proxy to use. "+
+			"The supported protocols are: http, https, socks5. "+
+			"No protocol specified will be treated as HTTP proxy. "+
+			"If the port number is not specified, it is assumed to be 1080. "+
+			"The basic authentication username and password can be specified in the host string e.g. user:pass@host:port. "+
+			"Alternatively, you can use the -c, --credentials flag to specify the credentials. "+
+			"If both are specified, the proxy flag takes precedence. ")
+}
+
+func DNSDiscoveryConfig(fs *pflag.FlagSet, cfg *forwarder.DNSDiscoveryConfig) {
+	fs.Var(anyflag.NewValue[forwarder.DNSDiscoveryRecord](cfg.Record, &cfg.Record, forwarder.ParseDNSDiscoveryRecord),
+		"proxy-dns-discovery", "<srv|txt>:<name>"+
+			"Discover upstream proxies using DNS records. "+
+			"In srv mode the SRV record targets with the lowest priority are used e.g. srv:_proxy._tcp.example.com, "+
+			"requests are distributed over them randomly in proportion to their weights. "+
+			"In txt mode each TXT record holds an upstream proxy URL e.g. txt:proxies.example.com, "+
+			"requests are distributed over them in a round-robin fashion. "+
+			"If a lookup fails, the previously discovered proxies are used. ")
+
+	fs.StringVar(&cfg.Scheme, "proxy-dns-discovery-scheme", cfg.Scheme, "<http|https|socks5>"+
+		"Upstream proxy protocol to use for proxies discovered with SRV records. ")
+
+	fs.DurationVar(&cfg.RefreshInterval, "proxy-dns-discovery-interval", cfg.RefreshInterval,
+		"Maximal time between DNS lookups. "+
+			"Records are re-resolved when the shortest TTL of the answers expires, but not later than this interval. "+
+			"Failed lookups are retried after this interval. ")
+}
+
+func LatencySelectorConfig(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.LatencySelectorConfig) {
+	fs.BoolVar(enabled, "proxy-latency-selection", *enabled, ""+
+		"Measure the latency and error rate of upstream proxies, and send requests via the fastest one "+
+		"when there are multiple candidates i.e. proxies returned by PAC or discovered with DNS or Kubernetes. "+
+		"Proxies that were not measured yet are preferred. ")
+
+	fs.DurationVar(&cfg.HalfLife, "proxy-latency-half-life", cfg.HalfLife,
+		"Time after which the score of an unused upstream proxy is halved, "+
+			"so that proxies that were slow or failing get traffic back. ")
+
+	fs.DurationVar(&cfg.ErrorPenalty, "proxy-latency-error-penalty", cfg.ErrorPenalty,
+		"Latency added to the score of an upstream proxy proportionally to its error rate. ")
+}
+
+func KubernetesDiscoveryConfig(fs *pflag.FlagSet, cfg *forwarder.KubernetesDiscoveryConfig) {
+	fs.StringVar(&cfg.Service, "proxy-k8s-service", cfg.Service, "<[namespace/]name>"+
+		"Use the ready endpoints of a Kubernetes Service as upstream proxies. "+
+		"The endpoints are watched using the pod service account, which needs permissions to list and watch endpointslices. "+
+		"If namespace is not specified, the namespace of the pod is used. "+
+		"Requests are distributed over the endpoints in a round-robin fashion. ")
+
+	fs.StringVar(&cfg.PortName, "proxy-k8s-port-name", cfg.PortName, "<name>"+
+		"Name of the Kubernetes Service port to use, if not specified the first port is used. ")
+
+	fs.StringVar(&cfg.Scheme, "proxy-k8s-scheme", cfg.Scheme, "<http|https|socks5>"+
+		"Upstream proxy protocol to use for the Kubernetes Service endpoints. ")
+}
+
+func XDSConfig(fs *pflag.FlagSet, cfg *forwarder.XDSConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.Server, &cfg.Server, url.Parse),
+		"xds-server", "<http[s]://host:port>"+
+			"Experimental: route requests to upstream proxies using clusters and routes from an xDS management server. "+
+			"The REST-JSON transport is used, clusters must specify endpoints inline in the load assignment. "+
+			"Virtual host domains select the cluster, requests to hosts that do not match any virtual host are sent directly. ")
+
+	fs.StringVar(&cfg.NodeID, "xds-node-id", cfg.NodeID, "<id>"+
+		"Node identifier sent to the xDS management server. ")
+
+	fs.StringVar(&cfg.NodeCluster, "xds-node-cluster", cfg.NodeCluster, "<name>"+
+		"Node cluster sent to the xDS management server. ")
+
+	fs.StringVar(&cfg.RouteConfigName, "xds-route-config", cfg.RouteConfigName, "<name>"+
+		"Name of the RouteConfiguration resource to use. ")
+
+	fs.DurationVar(&cfg.RefreshInterval, "xds-interval", cfg.RefreshInterval,
+		"Time between xDS discovery requests. ")
+}
+
+func MITMDecisionConfig(fs *pflag.FlagSet, u **url.URL, cfg *forwarder.MITMDecisionConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](*u, u, url.Parse),
+		"mitm-decision-url", "<http[s]://host:port/path|grpc://host:port>"+
+			"Ask an external service whether to MITM, tunnel or block every CONNECT request. "+
+			"The service gets the destination host and port, client IP, and the authenticated user and groups. "+
+			"Over HTTP the request is POSTed as JSON, the gRPC service definition is available in grpcapi/mitm_decision.proto. "+
+			"The decision takes precedence over the --mitm-domains flag. ")
+
+	fs.DurationVar(&cfg.Timeout, "mitm-decision-timeout", cfg.Timeout,
+		"Maximum time to wait for a decision. ")
+
+	fs.DurationVar(&cfg.CacheTTL, "mitm-decision-cache-ttl", cfg.CacheTTL,
+		"Time decisions are cached for, the service may override it per decision. Zero disables caching. ")
+
+	actions := []forwarder.MITMAction{
+		forwarder.MITMActionMITM,
+		forwarder.MITMActionTunnel,
+		forwarder.MITMActionBlock,
+	}
+	fs.Var(anyflag.NewValue[forwarder.MITMAction](cfg.OnError, &cfg.OnError, anyflag.EnumParser[forwarder.MITMAction](actions...)),
+		"mitm-decision-on-error", "<mitm|tunnel|block>"+
+			"Action taken if the decision service fails or times out. ")
+}
+
+func ConnectUDPConfig(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.ConnectUDPConfig) {
+	fs.BoolVar(enabled, "connect-udp", *enabled, ""+
+		"Experimental: proxy UDP over HTTP/1.1 with the CONNECT-UDP upgrade as specified in RFC 9298. "+
+		"Clients use the default URI template /.well-known/masque/udp/{target_host}/{target_port}/, "+
+		"targets are subject to deny domains, block list and localhost policy. ")
+
+	fs.DurationVar(&cfg.IdleTimeout, "connect-udp-idle-timeout", cfg.IdleTimeout, ""+
+		"Close UDP tunnels without traffic in either direction for the duration. ")
+}
+
+func RemoteConfig(fs *pflag.FlagSet, cfg *remoteconfig.Config) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.URL, &cfg.URL, url.Parse),
+		"config-provider", "<consul|etcd>[+https]://<host:port>/<prefix>"+
+			"Watch the configuration keys under prefix in Consul KV or etcd v3 and apply changes without restarting the proxy. "+
+			"Supported keys are: proxy, deny-domains, direct-domains, mitm-domains, mitm-exclude-domains and credentials, "+
+			"list values hold one item per line using the flag syntax. "+
+			"Keys that are not set in the store use the values from the command line. "+
+			"The Consul ACL token is read from the CONSUL_HTTP_TOKEN environment variable. ")
+
+	fs.DurationVar(&cfg.PollInterval, "config-provider-interval", cfg.PollInterval,
+		"Time between reads of the configuration keys, for Consul it is the maximal blocking query wait time. ")
+}
+
+func GRPCAPIConfig(fs *pflag.FlagSet, cfg *grpcapi.ServerConfig) {
+	fs.StringVar(&cfg.Addr, "grpc-api-address", cfg.Addr, "<host:port>"+
+		"Serve the gRPC admin API on the address, the API allows to read, update and watch the runtime configuration. "+
+		"The service definition is available in grpcapi/admin.proto. "+
+		"The API can change the upstream proxy and credentials, "+
+		"protect it with the --grpc-api-basic-auth flag and the https protocol, or listen on localhost. ")
+
+	fs.Var(anyflag.NewValue[forwarder.Scheme](cfg.Protocol, &cfg.Protocol,
+		anyflag.EnumParser[forwarder.Scheme](forwarder.HTTPScheme, forwarder.HTTPSScheme)),
+		"grpc-api-protocol", "<http|https>"+
+			"The gRPC admin API protocol, http is HTTP/2 without TLS. "+
+			"For https protocol, if TLS certificate is not specified, the server will use a self-signed certificate. ")
+
+	TLSServerConfig(fs, &cfg.TLSServerConfig, "grpc-api-")
+
+	fs.Var(anyflag.NewValueWithRedact[*url.Userinfo](cfg.BasicAuth, &cfg.BasicAuth, forwarder.ParseUserinfo, RedactUserinfo),
+		"grpc-api-basic-auth", "<username[:password]>"+
+			"Basic authentication credentials required in the authorization metadata of gRPC admin API calls. ")
+}
+
+func TransparentServerConfig(fs *pflag.FlagSet, cfg *forwarder.TransparentServerConfig) {
+	fs.StringVar(&cfg.Addr, "transparent-address", cfg.Addr, "<host:port>"+
+		"Linux only: accept TCP connections redirected by iptables REDIRECT or TPROXY targets on the address, "+
+		"and proxy them to the original destination via the HTTP proxy, so that the same rules and upstream proxies apply. "+
+		"The destination host name is read from the TLS server name or the HTTP Host header. "+
+		"Proxy authentication is not supported. ")
+
+	fs.BoolVar(&cfg.TPROXY, "transparent-tproxy", cfg.TPROXY, ""+
+		"Accept connections redirected with the iptables TPROXY target instead of REDIRECT. "+
+		"The listener requires the CAP_NET_ADMIN capability. ")
+
+	fs.DurationVar(&cfg.HandshakeTimeout, "transparent-handshake-timeout", cfg.HandshakeTimeout,
+		"Timeout for reading the host name sent by the client and establishing the connection. ")
+}
+
+func SOCKS5ServerConfig(fs *pflag.FlagSet, cfg *forwarder.SOCKS5ServerConfig) {
+	fs.StringVar(&cfg.Addr, "socks5-address", cfg.Addr, "<host:port>"+
+		"Serve SOCKS5 clients on the address. "+
+		"Connections are bridged to the HTTP proxy, so that the same credentials, rules and upstream proxies apply. "+
+		"Clients authenticate with username and password if the proxy requires basic auth. ")
+
+	fs.DurationVar(&cfg.HandshakeTimeout, "socks5-handshake-timeout", cfg.HandshakeTimeout,
+		"Timeout for the SOCKS5 handshake and establishing the connection. ")
+}
+
+func UpstreamProxyTLSConfig(fs *pflag.FlagSet, cfg *forwarder.UpstreamProxyTLSConfig) {
+	fs.StringVar(&cfg.ServerName, "proxy-tls-server-name", cfg.ServerName, "<name>"+
+		"Server name sent in SNI to https:// upstream proxies instead of the proxy host. "+
+		"Unless --proxy-tls-verify-name is set, the proxy certificate is verified for this name. ")
+
+	fs.StringSliceVar(&cfg.NextProtos, "proxy-tls-alpn", cfg.NextProtos, "<protocol>,..."+
+		"ALPN protocols sent to https:// upstream proxies, by default http/1.1. "+
+		"The connection uses HTTP/1.1 regardless of the negotiated protocol. ")
+
+	fs.StringVar(&cfg.VerifyName, "proxy-tls-verify-name", cfg.VerifyName, "<name>"+
+		"Name the certificate of https:// upstream proxies is verified for instead of the server name, "+
+		"e.g. for upstream proxies addressed by IP with certificates issued for a DNS name. ")
+}
+
+func DNSForwarderConfig(fs *pflag.FlagSet, cfg *forwarder.DNSForwarderConfig) {
+	fs.StringVar(&cfg.Addr, "dns-forwarder-address", cfg.Addr, "<host:port>"+
+		"Serve DNS queries over UDP on the address, so that clients can resolve names through the proxy. "+
+		"Queries for names denied by the deny domains, block list or localhost policy are answered with NXDOMAIN. "+
+		"Use --allow-clients to limit the clients, the forwarder must not be an open resolver. ")
+
+	fs.Var(anyflag.NewSliceValue[netip.AddrPort](nil, &cfg.Upstream, forwarder.ParseDNSAddress),
+		"dns-forwarder-upstream", "<ip>[:<port>]"+
+			"DNS server(s) to forward queries to, the first server is used as primary, the rest are used as fallbacks. "+
+			"If not specified, the --dns-server servers are used. ")
+
+	fs.DurationVar(&cfg.Timeout, "dns-forwarder-timeout", cfg.Timeout,
+		"Timeout for forwarding a query to an upstream DNS server. ")
+
+	fs.IntVar(&cfg.MaxConcurrentQueries, "dns-forwarder-max-concurrent-queries", cfg.MaxConcurrentQueries,
+		"Maximum number of queries served at the same time, further queries wait in the socket receive buffer. ")
+}
+
+func JournalConfig(fs *pflag.FlagSet, cfg *journal.Config) {
+	fs.StringVar(&cfg.File, "journal-file", cfg.File, "<path>"+
+		"Record a summary of every request in the file: time, duration, client, user, method, host, URL without query and status. "+
+		"Request and response bodies are not recorded. "+
+		"The journal can be queried with the /journal API endpoint "+
+		"using the from, to, host, user, status and limit query parameters. ")
+
+	fs.DurationVar(&cfg.Retention, "journal-retention", cfg.Retention,
+		"Time after which journal entries are removed. ")
+
+	fs.IntVar(&cfg.MaxEntries, "journal-max-entries", cfg.MaxEntries, "<n>"+
+		"Maximal number of journal entries, the oldest entries are removed first. ")
+}
+
+func HSTSConfig(fs *pflag.FlagSet, enabled *bool, cfg *hsts.Config) {
+	fs.BoolVar(enabled, "hsts", *enabled, ""+
+		"Track Strict-Transport-Security policies of hosts from responses received over HTTPS e.g. with MITM, "+
+		"and upgrade plain HTTP requests to these hosts to HTTPS. "+
+		"The policies are served by the /hsts API endpoint. "+
+		"HSTS is enabled by default when the --hsts-file flag is set. ")
+
+	fs.StringVar(&cfg.File, "hsts-file", cfg.File, "<path>"+
+		"Save the HSTS policies to the file, so that they survive restarts. ")
+
+	fs.IntVar(&cfg.MaxHosts, "hsts-max-hosts", cfg.MaxHosts, "<n>"+
+		"Maximal number of hosts with HSTS policies, the policies expiring first are removed first. ")
+}
+
+func StatsConfig(fs *pflag.FlagSet, cfg *stats.Config) {
+	fs.DurationVar(&cfg.Window, "stats-window", cfg.Window,
+		"Time window of the traffic aggregates served by the /top API endpoint: "+
+			"top destination hosts and clients, request and byte rates, and error rate. "+
+			"The /top/feed endpoint streams per second traffic and active sessions as server-sent events. "+
+			"Set to 0 to disable. ")
+
+	fs.IntVar(&cfg.MaxKeys, "stats-max-keys", cfg.MaxKeys, "<n>"+
+		"Maximal number of hosts and clients tracked per 10 seconds, the remaining traffic is aggregated as other. ")
+}
+
+func Metadata(fs *pflag.FlagSet, headers *[]forwarder.MetadataHeader, maxValues *int, trustChain *bool) {
+	fs.Var(anyflag.NewSliceValue[forwarder.MetadataHeader](*headers, headers, forwarder.ParseMetadataHeader),
+		"metadata-header", "<header>[:<key>]"+
+			"Attach the value of the request header to the request as metadata e.g. tunnel or job ID, for traffic attribution. "+
+			"Metadata is included in logs, error responses and the proxy_metadata_requests_total metric. "+
+			"The header is removed before the request is sent upstream. "+
+			"If the key is not specified, it is derived from the header name e.g. X-Tunnel-Id becomes tunnel_id. "+
+			"The flag can be specified multiple times. ")
+
+	fs.IntVar(maxValues, "metadata-max-values", *maxValues, "<n>"+
+		"Maximal number of distinct values of a metadata key in metrics, the remaining values are counted as other. ")
+
+	fs.BoolVar(trustChain, "trust-chain-metadata", *trustChain, ""+
+		"Attach metadata passed by the previous forwarder instance in a chain in the "+forwarder.ChainMetadataHeader+" header. "+
+		"Enable it only if all clients are trusted forwarder instances, "+
+		"metadata is always accepted from instances chained in the same process. ")
 }
 
 func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
@@ -137,6 +540,47 @@ func DenyDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"Prefix domains with '-' to exclude requests to certain domains from being denied.")
 }
 
+func UserPolicies(fs *pflag.FlagSet, cfg *[]forwarder.UserPolicyItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.UserPolicyItem](*cfg, cfg, forwarder.ParseUserPolicyItem),
+		"user-policy", "[@]<name>:<key>=<value>"+
+			"Policy applied to requests of an authenticated user, or of a group if the name is prefixed with '@'. "+
+			"Groups are read from the JWT groups claim. "+
+			"Supported keys are: deny-domains and direct-domains that extend the proxy domain lists, "+
+			"allow-domains that denies requests to domains not matching, "+
+			"proxy that replaces the upstream proxy, rate-limit that limits requests per second of a user, "+
+			"and bandwidth that limits bytes per second of all requests and tunnels of a user e.g. 1Mi. "+
+			"The user policy takes precedence over group policies. "+
+			"The flag can be specified multiple times, domain keys can be repeated to add multiple regexps. ")
+}
+
+func UserPolicyFile(fs *pflag.FlagSet, name *string) {
+	fs.StringVar(name, "user-policy-file", *name, "<path>"+
+		"YAML file with user and group policies, with the same keys as the --user-policy flag, e.g. "+
+		"'users: {alice: {allow-domains: [example.com$], bandwidth: 1Mi}}'. "+
+		"Policies from the --user-policy flag are merged with the file. ")
+}
+
+func SNIRoutes(fs *pflag.FlagSet, cfg *[]forwarder.SNIRouteItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.SNIRouteItem](*cfg, cfg, forwarder.ParseSNIRouteItem),
+		"sni-route", "<server-name>:<key>=<value>"+
+			"Select the certificate and policy by the TLS server name clients use to connect to the proxy, requires https protocol. "+
+			"The server name can be a wildcard e.g. *.example.com, exact names take precedence. "+
+			"Supported keys are: cert-file and key-file that set the certificate, "+
+			"and the --user-policy keys that set the policy for requests from the connection. "+
+			"User policies take precedence over the SNI route policy. "+
+			"The flag can be specified multiple times. ")
+}
+
+func BlockLists(fs *pflag.FlagSet, lists *[]*url.URL) {
+	fs.Var(anyflag.NewSliceValue[*url.URL](*lists, lists, fileurl.ParseFilePathOrURL),
+		"block-list", "<path or URL>"+
+			"Deny requests matching the filter list in Adblock Plus syntax, e.g. EasyList. "+
+			"Domain rules, URL rules with wildcards, separators and anchors, and exception rules are supported, "+
+			"element hiding rules and rules with options are skipped. "+
+			"URL rules apply to HTTPS requests only if they are MITMed, otherwise only the host is matched. "+
+			"The flag can be specified multiple times to use multiple lists. ")
+}
+
 func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
 		"direct-domains", "[-]<regexp>,..."+
@@ -145,10 +589,71 @@ func DirectDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"This flag takes precedence over the PAC script.")
 }
 
+func JWTAuthConfig(fs *pflag.FlagSet, cfg *forwarder.JWTAuthConfig) {
+	fs.Var(anyflag.NewValue[*url.URL](cfg.JWKSURL, &cfg.JWKSURL, url.Parse),
+		"jwt-jwks-url", "<http[s]://host:port/path>"+
+			"Authenticate proxy clients with JWT bearer tokens sent in the Proxy-Authorization header. "+
+			"Token signatures are verified with keys from the JSON Web Key Set at the URL. "+
+			"If --basic-auth is set, clients may use either of the methods. ")
+
+	fs.StringVar(&cfg.Issuer, "jwt-issuer", cfg.Issuer, "<issuer>"+
+		"Required value of the iss claim. ")
+
+	fs.StringVar(&cfg.Audience, "jwt-audience", cfg.Audience, "<audience>"+
+		"Value that must be present in the aud claim. ")
+
+	fs.DurationVar(&cfg.ClockSkew, "jwt-clock-skew", cfg.ClockSkew,
+		"Tolerance applied when validating the exp and nbf claims. ")
+
+	fs.StringVar(&cfg.UserClaim, "jwt-user-claim", cfg.UserClaim, "<claim>"+
+		"Claim used as the user identity in logs and user policies. ")
+
+	fs.StringVar(&cfg.GroupsClaim, "jwt-groups-claim", cfg.GroupsClaim, "<claim>"+
+		"Claim listing the groups of the user, used to select group policies. ")
+
+	fs.DurationVar(&cfg.JWKSRefreshInterval, "jwt-jwks-refresh-interval", cfg.JWKSRefreshInterval,
+		"Maximum age of the cached JSON Web Key Set. "+
+			"Tokens signed with an unknown key ID trigger an earlier refresh, at most every 30 seconds. ")
+}
+
+func AuthAllowIPs(fs *pflag.FlagSet, cfg *[]netip.Prefix) {
+	fs.Var(anyflag.NewSliceValue[netip.Prefix](*cfg, cfg, netip.ParsePrefix),
+		"auth-allow-ip", "<cidr>,..."+
+			"Authenticate proxy clients connecting from the networks, e.g. 10.0.0.0/8, without credentials. "+
+			"The client IP address is used as the user identity. "+
+			"If other authentication methods are enabled, clients may use either of the methods. ")
+}
+
+func BypassConfig(fs *pflag.FlagSet, cfg *forwarder.BypassConfig) {
+	fs.Var(anyflag.NewValueWithRedact[string](cfg.SecretFile, &cfg.SecretFile, func(val string) (string, error) { return val, nil }, RedactBase64),
+		"bypass-secret-file", "<path or base64>"+
+			"HMAC key shared with trusted clients, it enables the signed "+forwarder.BypassHeader+" header. "+
+			"The header allows to skip MITM of a CONNECT request or body logging of a request, "+
+			"e.g. for requests uploading credentials in tests. "+
+			"Granted and rejected headers are logged. "+
+			"The key must be at least 16 bytes long. ")
+
+	fs.DurationVar(&cfg.MaxAge, "bypass-max-age", cfg.MaxAge,
+		"Maximal age of the timestamp signed in the bypass header. ")
+}
+
+func TimeoutHeaderConfig(fs *pflag.FlagSet, cfg *forwarder.TimeoutHeaderConfig) {
+	fs.Var(anyflag.NewSliceValue[netip.Prefix](cfg.TrustedNetworks, &cfg.TrustedNetworks, netip.ParsePrefix),
+		"timeout-header-trusted-network", "<cidr>,..."+
+			"Networks of trusted clients allowed to set the deadline of a request with the "+forwarder.TimeoutHeader+" header, "+
+			"e.g. to enforce per-request SLAs in tests. "+
+			"The header value is a duration e.g. 1.5s, or a number of seconds. "+
+			"Requests that time out are answered with 504 Gateway Timeout. "+
+			"The header is removed from requests, and ignored if sent by other clients. ")
+
+	fs.DurationVar(&cfg.MaxTimeout, "timeout-header-max", cfg.MaxTimeout,
+		"Maximal deadline that can be set with the "+forwarder.TimeoutHeader+" header, longer values are truncated. ")
+}
+
 func MITMConfig(fs *pflag.FlagSet, mitm *bool, cfg *forwarder.MITMConfig) {
 	fs.BoolVar(mitm, "mitm", *mitm, ""+
 		"Enable Man-in-the-Middle (MITM) mode. "+
-		"It only works with HTTPS requests, HTTP/2 is not supported. "+
+		"It only works with HTTPS requests, HTTP/2 requires the --mitm-http2 flag. "+
 		"MITM is enabled by default when the --mitm-cacert-file flag is set. "+
 		"If the CA certificate is not provided MITM uses a generated CA certificate. "+
 		"The CA certificate used can be retrieved from the API server .")
@@ -163,11 +668,110 @@ func MITMConfig(fs *pflag.FlagSet, mitm *bool, cfg *forwarder.MITMConfig) {
 		"mitm-cakey-file", "<path or base64>"+
 			"CA key file to use for generating MITM certificates. ")
 
+	fs.Var(anyflag.NewValueWithRedact[string](cfg.SecondaryCACertFile, &cfg.SecondaryCACertFile, func(val string) (string, error) { return val, nil }, RedactBase64),
+		"mitm-secondary-cacert-file", "<path or base64>"+
+			"Additional CA certificate published with the MITM CA certificate, but not used for signing. "+
+			"It allows rotating the CA without a flag day: clients are provisioned with both certificates, "+
+			"then the signing CA is switched and the previous one becomes secondary. "+
+			"Requires the --mitm-cacert-file flag. ")
+
 	fs.StringVar(&cfg.Organization, "mitm-org", cfg.Organization, "<name>"+
 		"Organization name to use in the generated MITM certificates. ")
 
 	fs.DurationVar(&cfg.Validity, "mitm-validity", cfg.Validity, ""+
 		"Validity period of the generated MITM certificates. ")
+
+	fs.DurationVar(&cfg.ClockOffset, "mitm-clock-offset", cfg.ClockOffset, ""+
+		"Shift the time used for the generated MITM certificates and the certificate probes by the offset, "+
+		"e.g. -48h with the default validity generates expired certificates and 48h generates not yet valid ones. "+
+		"It is intended for testing how clients handle certificate validity errors. ")
+
+	keyTypeValues := []forwarder.MITMKeyType{
+		forwarder.RSAKeyType,
+		forwarder.ECDSAKeyType,
+	}
+	fs.Var(anyflag.NewValue[forwarder.MITMKeyType](cfg.KeyType, &cfg.KeyType, anyflag.EnumParser[forwarder.MITMKeyType](keyTypeValues...)),
+		"mitm-key-type", "<rsa|ecdsa>"+
+			"Key type of the generated MITM certificates, RSA 2048 bit or ECDSA P-256. ")
+
+	fs.StringSliceVar(&cfg.NameConstraints, "mitm-name-constraints", cfg.NameConstraints, "<domain>,..."+
+		"Limit the generated CA certificate to the domains and their subdomains, a leading period matches subdomains only. "+
+		"Hosts outside of the name constraints are not MITMed. "+
+		"It cannot be used with the --mitm-cacert-file flag, name constraints of the CA certificate file are respected. ")
+
+	fs.BoolVar(&cfg.SkipEV, "mitm-skip-ev", cfg.SkipEV, ""+
+		"Do not MITM hosts presenting Extended Validation certificates. "+
+		"The proxy connects to the host to check the certificate, the result is cached for an hour. "+
+		"Only hosts connected directly, without an upstream proxy, are checked. ")
+
+	fs.StringSliceVar(&cfg.SkipPins, "mitm-skip-pins", cfg.SkipPins, "<sha256/base64>,..."+
+		"Do not MITM hosts presenting a certificate chain with one of the public key pins i.e. base64 encoded SHA-256 hashes of the Subject Public Key Info. "+
+		"The hosts are checked as with the --mitm-skip-ev flag. ")
+
+	fs.DurationVar(&cfg.HandshakeFailureBypass, "mitm-handshake-failure-bypass", cfg.HandshakeFailureBypass, ""+
+		"Do not MITM a host for the duration after a client rejected the MITM certificate for it, "+
+		"e.g. because the application pins the certificate of the host. "+
+		"The first connection fails, subsequent connections to the host are tunneled. "+
+		"Set to 0 to disable. ")
+
+	fs.BoolVar(&cfg.HTTP2, "mitm-http2", cfg.HTTP2, ""+
+		"Negotiate HTTP/2 with clients of MITMed connections, it is required by gRPC clients. "+
+		"The requests are passed through the modifiers, request and response bodies are streamed in both directions. ")
+
+	fs.StringVar(&cfg.CAHost, "mitm-ca-host", cfg.CAHost, "<host>"+
+		"Serve the CA certificate to clients of the proxy at a host name intercepted by the proxy e.g. forwarder.mitm, "+
+		"at http://<host>/ca.crt in PEM and http://<host>/ca.der in DER format, "+
+		"so that devices can install it from a browser configured to use the proxy. "+
+		"The requests do not require proxy authentication. ")
+
+	fs.IntVar(&cfg.CacheSize, "mitm-cache-size", cfg.CacheSize, "<num>"+
+		"Maximal number of generated MITM certificates kept in memory, the least recently used certificates are evicted. "+
+		"Set to 0 to keep all certificates. ")
+
+	fs.StringVar(&cfg.CacheDir, "mitm-cache-dir", cfg.CacheDir, "<path>"+
+		"Directory where generated MITM certificates are stored, so that they are reused after a restart. "+
+		"Certificates are stored per CA certificate fingerprint, certificates signed by a different CA are not used. ")
+
+	fs.Var(&cfg.MaxInspectedRequestBody, "mitm-max-inspected-request-body", "<size>"+
+		"Maximal number of body bytes of MITMed requests read into memory for inspection e.g. body logging, "+
+		"the rest of the body is streamed without buffering. "+
+		"It is independent of the --read-limit and --write-limit flags. "+
+		"Set to 0 to use the --log-http-body-limit value. "+
+		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
+
+	fs.Var(&cfg.MaxResponseSnapshot, "mitm-max-response-snapshot", "<size>"+
+		"Maximal number of body bytes of responses to MITMed requests read into memory for inspection. "+
+		"See the documentation for the --mitm-max-inspected-request-body flag for more details. ")
+}
+
+func OriginTLSRules(fs *pflag.FlagSet, cfg *[]*forwarder.OriginTLSRule) {
+	fs.Var(anyflag.NewSliceValue[*forwarder.OriginTLSRule](*cfg, cfg, forwarder.ParseOriginTLSRule),
+		"mitm-origin-tls", "<pattern>;<option>;..."+
+			"Override the TLS configuration of connections to origin servers of MITMed requests with host matching the pattern, "+
+			"e.g. 'legacy.example.com;min=1.0;max=1.1' or '*.example.com;sni=example.com'. "+
+			"The options are min=<version> and max=<version> with versions 1.0, 1.1, 1.2 and 1.3, "+
+			"ciphers=<name>:<name>... with TLS 1.0-1.2 cipher suite names e.g. TLS_RSA_WITH_AES_128_CBC_SHA, "+
+			"sni=<name> to send and verify the name instead of the request host, "+
+			"cert=<path or base64> with key=<path or base64> to present a client certificate to origin servers requiring mutual TLS, "+
+			"and fingerprint=<chrome|firefox|safari|edge|ios|android|randomized> to mimic the TLS ClientHello of a browser "+
+			"for origins blocking the default fingerprint, it cannot be combined with min, max and ciphers, "+
+			"and it does not apply to connections via an upstream proxy. "+
+			"The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains. "+
+			"The first matching rule is used. ")
+}
+
+func SyntheticEndpoints(fs *pflag.FlagSet, cfg *[]*forwarder.SyntheticEndpoint) {
+	fs.Var(anyflag.NewSliceValue[*forwarder.SyntheticEndpoint](*cfg, cfg, forwarder.ParseSyntheticEndpoint),
+		"synthetic-endpoint", "<host><path>;<option>;..."+
+			"Serve an endpoint at a pseudo-host directly from the proxy, without contacting a server, "+
+			"e.g. 'forwarder.internal/healthz;preset=healthz' or 'forwarder.internal/whoami;preset=whoami', "+
+			"this is useful for debugging clients behind the proxy. "+
+			"The options are status=<code>, type=<content-type>, preset=<healthz|whoami> with predefined responses, "+
+			"and body=<template> with a Go text/template rendered with the request fields "+
+			".ClientIP, .User, .Method, .URL, .Proto and .Header, and the json function, e.g. 'body=hello {{.User}}'. "+
+			"The body option must be the last option. "+
+			"Requests to other paths of the host get 404 Not Found. "+
+			"The requests require proxy authentication. ")
 }
 
 func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
@@ -177,11 +781,162 @@ func MITMDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
 			"Prefix domains with '-' to exclude requests to certain domains from being MITMed.")
 }
 
+func MITMExcludeDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
+		"mitm-exclude-domains", "[-]<regexp>,..."+
+			"Never MITM the specified domains e.g. banking sites or hosts with certificate pinning. "+
+			"The rules are evaluated after the --mitm-domains flag and the MITM decision service. ")
+}
+
+func RegexpLimits(fs *pflag.FlagSet, cfg *ruleset.RegexpLimits) {
+	fs.IntVar(&cfg.MaxLength, "regexp-max-length", cfg.MaxLength, "<n>"+
+		"Maximal length of a regexp rule in the domain lists e.g. --deny-domains and --mitm-domains, "+
+		"longer rules are rejected at startup and when set at runtime with the admin API or remote config. "+
+		"Set to 0 to disable the limit. ")
+
+	fs.IntVar(&cfg.MaxNesting, "regexp-max-nesting", cfg.MaxNesting, "<n>"+
+		"Maximal nesting depth of groups and repetitions in a regexp rule, deeper nested rules are rejected. "+
+		"Set to 0 to disable the limit. ")
+
+	fs.BoolVar(&cfg.Anchor, "regexp-anchor", cfg.Anchor, ""+
+		"Anchor regexp rules in the domain lists, so that they match the whole host instead of any substring, "+
+		"e.g. 'example\\.com' matches 'example.com', but not 'example.com.evil.net'. ")
+}
+
+func SecurityHeaders(fs *pflag.FlagSet, cfg *[]forwarder.SecurityHeaderItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.SecurityHeaderItem](*cfg, cfg, forwarder.ParseSecurityHeaderItem),
+		"security-header", "<regexp>=<header>"+
+			"Inject or strip security headers of MITMed responses from hosts matching the regexp, "+
+			"e.g. 'example\\.com$=Content-Security-Policy-Report-Only: default-src https:; report-uri /csp', "+
+			"'.*=X-Frame-Options: DENY' or '.*=-Referrer-Policy'. "+
+			"The header syntax is the same as for --response-header, added headers replace the headers sent by the server. "+
+			"The flag can be specified multiple times, all rules matching the host are applied. "+
+			"Requires MITM to be enabled. ")
+}
+
+func ResponseValidation(fs *pflag.FlagSet, cfg *[]forwarder.ResponseValidationItem) {
+	fs.Var(anyflag.NewSliceValue[forwarder.ResponseValidationItem](*cfg, cfg, forwarder.ParseResponseValidationItem),
+		"response-validation", "<regexp>:<key>=<value>"+
+			"Validate upstream responses to requests whose host and path match the regexp, e.g. 'api\\.example\\.com/v1/:status=2xx'. "+
+			"Supported keys are: "+
+			"content-type - allowed media type, type/* matches any subtype, "+
+			"max-size - maximal body size e.g. 512B or 10Mi, a number without suffix is in KiB, "+
+			"status - allowed status code or class e.g. 200 or 2xx, "+
+			"action - log to only log violations (default) or reject to replace the responses with 502 Bad Gateway. "+
+			"The flag can be specified multiple times to set multiple keys or allow multiple values, the first matching rule is used. ")
+}
+
+func IntegrityDomains(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
+		"integrity-domains", "[-]<regexp>,..."+
+			"Verify Content-Length and Content-Digest of request and response bodies for the specified domains, "+
+			"and log SHA-256 digests of the bodies. "+
+			"Chunked responses without a digest get a Content-Digest trailer. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being verified.")
+}
+
+func PriorityConfig(fs *pflag.FlagSet, cfg *forwarder.PriorityConfig) {
+	fs.Var(anyflag.NewSliceValue[*forwarder.PriorityRule](cfg.Rules, &cfg.Rules, forwarder.ParsePriorityRule),
+		"priority", "<class>:<regexp>"+
+			"Assign the priority class to requests to hosts matching the regexp, e.g. 'interactive:^app\\.example\\.com$' or 'bulk:\\.cdn\\.net$'. "+
+			"Supported classes are: interactive, default and bulk, requests not matching any rule are in the default class. "+
+			"When the proxy is saturated, waiting requests are admitted in the order of their class. "+
+			"The flag can be specified multiple times, the first matching rule is used. "+
+			"Requires --priority-max-concurrent. ")
+
+	fs.IntVar(&cfg.MaxConcurrent, "priority-max-concurrent", cfg.MaxConcurrent, ""+
+		"Maximal number of requests proxied at the same time, requests over the limit wait for a free slot. "+
+		"HTTP requests hold a slot until the response body is read, CONNECT requests until the tunnel is established. "+
+		"Zero disables request prioritization. ")
+
+	fs.Var(&cfg.BulkBandwidth, "priority-bulk-bandwidth", "<bandwidth>"+
+		"Bandwidth in bytes per second shared by responses to bulk requests while the proxy is saturated. "+
+		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
+}
+
+func HedgingConfig(fs *pflag.FlagSet, cfg *forwarder.HedgingConfig) {
+	fs.DurationVar(&cfg.Delay, "hedge-delay", cfg.Delay, ""+
+		"Send a second attempt of idempotent GET and HEAD requests that do not get a response within the delay, "+
+		"or the --hedge-percentile latency of the host if greater, and use the response that arrives first. "+
+		"Zero disables hedged requests. ")
+
+	fs.Float64Var(&cfg.Percentile, "hedge-percentile", cfg.Percentile, "<0-100>"+
+		"Percentile of the observed response latency of the host after which a hedged request is sent. ")
+
+	fs.Float64Var(&cfg.Budget, "hedge-budget", cfg.Budget, "<0-1>"+
+		"Maximum ratio of hedged requests to all eligible requests. ")
+}
+
+func SlowClientConfig(fs *pflag.FlagSet, cfg *forwarder.SlowClientConfig) {
+	fs.Var(&cfg.MinRate, "slow-client-min-rate", "<bandwidth>"+
+		"Abort writing responses to clients that read slower than the rate in bytes per second on average, "+
+		"or block a single write for longer than --slow-client-grace. "+
+		"The rate is enforced after writing to the client for --slow-client-grace. "+
+		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). "+
+		"Zero disables slow client detection. ")
+
+	fs.DurationVar(&cfg.Grace, "slow-client-grace", cfg.Grace, ""+
+		"Time spent writing a response to the client before the minimal rate is enforced. ")
+}
+
+func LoadSheddingConfig(fs *pflag.FlagSet, enabled *bool, cfg *forwarder.LoadSheddingConfig) {
+	fs.BoolVar(enabled, "load-shedding", *enabled, ""+
+		"Progressively shed load when the utilization of CPU, memory or file descriptors is high: "+
+		"disable HTTP body logging, reject CONNECT requests, and finally reject all new requests with 503 Service Unavailable. "+
+		"The utilization is the highest of the resources measured, see the thresholds flags. ")
+
+	fs.DurationVar(&cfg.Interval, "load-shedding-interval", cfg.Interval, ""+
+		"Time between resource utilization samples. ")
+
+	fs.Var(&cfg.MemoryLimit, "load-shedding-memory-limit", "<size>"+
+		"Memory used by the process that counts as full utilization. "+
+		"Accepts binary format (e.g. 512Mi, 2Gi). "+
+		"If not set, the GOMEMLIMIT environment variable is used if set, otherwise memory is not measured. ")
+
+	fs.IntVar(&cfg.MaxOpenFiles, "load-shedding-max-open-files", cfg.MaxOpenFiles, ""+
+		"Number of open file descriptors that counts as full utilization. "+
+		"If not set, the limit of open files of the process is used. ")
+
+	fs.Float64Var(&cfg.Thresholds[0], "load-shedding-no-body-logging-threshold", cfg.Thresholds[0], "<0-1>"+
+		"Utilization at which HTTP body logging is disabled, the headers are logged instead. ")
+
+	fs.Float64Var(&cfg.Thresholds[1], "load-shedding-reject-connect-threshold", cfg.Thresholds[1], "<0-1>"+
+		"Utilization at which new CONNECT requests are rejected. ")
+
+	fs.Float64Var(&cfg.Thresholds[2], "load-shedding-reject-requests-threshold", cfg.Thresholds[2], "<0-1>"+
+		"Utilization at which all new requests are rejected. ")
+}
+
+func PrivacyConfig(fs *pflag.FlagSet, domains *[]ruleset.RegexpListItem, cfg *forwarder.PrivacyConfig) {
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*domains, domains, ruleset.ParseRegexpListItem),
+		"privacy-domains", "[-]<regexp>,..."+
+			"Remove tracking cookies and query parameters, and cross-origin Referer headers from requests to the specified domains. "+
+			"HTTPS requests are filtered only if they are MITMed. "+
+			"Prefix domains with '-' to exclude requests to certain domains from being filtered.")
+
+	fs.StringSliceVar(&cfg.Cookies, "privacy-cookies", cfg.Cookies, "<name>,..."+
+		"Names of tracking cookies removed from Cookie and Set-Cookie headers, a name ending with '*' matches cookies by prefix. ")
+
+	fs.StringSliceVar(&cfg.QueryParams, "privacy-query-params", cfg.QueryParams, "<name>,..."+
+		"Names of tracking query parameters removed from request URLs, a name ending with '*' matches parameters by prefix. ")
+
+	fs.BoolVar(&cfg.StripReferer, "privacy-strip-referer", cfg.StripReferer, ""+
+		"Remove the Referer header if it points to a different origin than the request. ")
+
+	fs.BoolVar(&cfg.StripETag, "privacy-strip-etag", cfg.StripETag, ""+
+		"Remove ETag and If-None-Match headers, so that entity tags cannot be used to track clients. "+
+		"This disables revalidation of cached responses with entity tags. ")
+}
+
 func Credentials(fs *pflag.FlagSet, credentials *[]*forwarder.HostPortUser) {
 	fs.VarP(anyflag.NewSliceValueWithRedact[*forwarder.HostPortUser](*credentials, credentials, forwarder.ParseHostPortUser, forwarder.RedactHostPortUser),
 		"credentials", "s", "<username[:password]@host:port,...>"+
 			"Site or upstream proxy basic authentication credentials. "+
 			"The host and port can be set to \"*\" to match all hosts and ports respectively. "+
+			"The host and port can be followed by options separated by \";\": "+
+			"scope=proxy|origin restricts the credentials to upstream proxies or origin servers, "+
+			"priority=<int> orders overlapping entries, entries with higher priority are matched first. "+
+			"Entries with equal priority are matched in order: host and port, port, host, global wildcard. "+
 			"The flag can be specified multiple times to add multiple credentials. ")
 }
 
@@ -211,7 +966,13 @@ func DialConfig(fs *pflag.FlagSet, cfg *forwarder.DialConfig, prefix string) {
 	fs.DurationVar(&cfg.DialTimeout,
 		namePrefix+"dial-timeout", cfg.DialTimeout,
 		"The maximum amount of time a dial will wait for a connect to complete. "+
-			"With or without a timeout, the operating system may impose its own earlier timeout. For instance, TCP timeouts are often around 3 minutes. ")
+			"With or without a timeout, the operating system may impose its own earlier timeout. For instance, TCP timeouts are often around 3 minutes. "+
+			"If the host resolves to multiple addresses, the addresses are tried in order within the timeout until one connects. ")
+
+	fs.DurationVar(&cfg.DNSCacheTTL,
+		namePrefix+"dns-cache-ttl", cfg.DNSCacheTTL,
+		"Cache the resolved addresses of host names for the duration, failed lookups are not cached. "+
+			"Zero disables the cache. ")
 }
 
 func TLSClientConfig(fs *pflag.FlagSet, cfg *forwarder.TLSClientConfig) {
@@ -270,30 +1031,41 @@ func HTTPServerConfig(fs *pflag.FlagSet, cfg *forwarder.HTTPServerConfig, prefix
 				"the server will use a self-signed certificate. ")
 
 		TLSServerConfig(fs, &cfg.TLSServerConfig, namePrefix)
+		TLSClientAuthConfig(fs, &cfg.ClientAuth, namePrefix)
 	}
 
 	fs.DurationVar(&cfg.ReadHeaderTimeout,
 		namePrefix+"read-header-timeout", cfg.ReadHeaderTimeout,
 		"The amount of time allowed to read request headers.")
 
+	fs.BoolVar(&cfg.ProxyProtocol, namePrefix+"proxy-protocol", cfg.ProxyProtocol, ""+
+		"Require connections to start with the PROXY protocol v1 or v2 header, "+
+		"and use the client address from the header, e.g. when the server is behind an L4 load balancer. "+
+		"Connections without the header are rejected. ")
+
 	fs.VarP(anyflag.NewValueWithRedact[*url.Userinfo](cfg.BasicAuth, &cfg.BasicAuth, forwarder.ParseUserinfo, RedactUserinfo),
 		namePrefix+"basic-auth", "", "<username[:password]>"+
 			"Basic authentication credentials to protect the server. ")
 
-	httpLogModes := []httplog.Mode{
-		httplog.None,
-		httplog.ShortURL,
-		httplog.URL,
-		httplog.Headers,
-		httplog.Body,
-		httplog.Errors,
-	}
-	fs.Var(anyflag.NewValue[httplog.Mode](cfg.LogHTTPMode, &cfg.LogHTTPMode, anyflag.EnumParser[httplog.Mode](httpLogModes...)),
-		namePrefix+"log-http", "<none|short-url|url|headers|body|errors>"+
+	fs.StringVar(&cfg.HtpasswdFile, namePrefix+"htpasswd-file", cfg.HtpasswdFile, "<path>"+
+		"Path to an htpasswd file with basic authentication users to protect the server, alternative to --"+namePrefix+"basic-auth. "+
+		"Passwords must be hashed with bcrypt or SHA1 e.g. htpasswd -B. "+
+		"The file is reloaded when it changes, if the new file is invalid the previous users are kept. ")
+
+	fs.Var(anyflag.NewValue[httplog.Mode](cfg.LogHTTPMode, &cfg.LogHTTPMode, anyflag.EnumParser[httplog.Mode](httplog.Modes()...)),
+		namePrefix+"log-http", "<none|short-url|url|headers|body|errors|ws|json>"+
 			"HTTP request and response logging mode. "+
 			"Setting this to none disables logging. "+
 			"The short-url mode logs [scheme://]host[/path] instead of the full URL. "+
-			"The error mode logs request line and headers if status code is greater than or equal to 500. ")
+			"The error mode logs request line and headers if status code is greater than or equal to 500. "+
+			"The ws mode logs like the headers mode, and the proxy also logs WebSocket frames of ws:// and MITMed wss:// connections. "+
+			"The json mode logs one JSON object per request with the method, URL, status, duration, bytes in and out, "+
+			"client IP, trace ID and upstream proxy. ")
+
+	fs.Var(&cfg.LogHTTPBodyLimit, namePrefix+"log-http-body-limit", "<size>"+
+		"Maximal number of body bytes logged in the body mode, the rest of the body is streamed without buffering. "+
+		"Set to 0 to log full bodies. "+
+		"Accepts binary format (e.g. 1.5Ki, 1Mi, 3.6Gi). ")
 }
 
 func TLSServerConfig(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePrefix string) {
@@ -308,6 +1080,18 @@ func TLSServerConfig(fs *pflag.FlagSet, cfg *forwarder.TLSServerConfig, namePref
 			"Can be a path to a file or \"data:\" followed by base64 encoded key. ")
 }
 
+func TLSClientAuthConfig(fs *pflag.FlagSet, cfg *forwarder.TLSClientAuthConfig, namePrefix string) {
+	fs.Var(anyflag.NewSliceValueWithRedact[string](cfg.CACertFiles, &cfg.CACertFiles, func(val string) (string, error) { return val, nil }, RedactBase64),
+		namePrefix+"tls-client-cacert-file", "<path or base64>"+
+			"Require clients to present a TLS certificate signed by one of the CA certificates, if the server protocol is https or h2. "+
+			"Can be a path to a file or \"data:\" followed by base64 encoded certificate. "+
+			"Use this flag multiple times to specify multiple CA certificate files. ")
+
+	fs.BoolVar(&cfg.Optional, namePrefix+"tls-client-cert-optional", cfg.Optional, ""+
+		"Allow clients without a TLS certificate, certificates that are presented are still verified. "+
+		"Requires the --"+namePrefix+"tls-client-cacert-file flag. ")
+}
+
 func PromNamespace(fs *pflag.FlagSet, promNamespace *string) {
 	fs.StringVar(promNamespace, "prom-namespace", *promNamespace, "<string>"+
 		"Prometheus namespace to use for metrics. "+
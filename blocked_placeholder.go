@@ -0,0 +1,121 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+)
+
+// transparentPNG is a 1x1 transparent PNG image.
+var transparentPNG = func() []byte { //nolint:gochecknoglobals // immutable image
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+type placeholderKind int
+
+const (
+	noPlaceholder placeholderKind = iota
+	imagePlaceholder
+	scriptPlaceholder
+	stylePlaceholder
+	xhrPlaceholder
+)
+
+// placeholderKindOf guesses the kind of asset requested from Sec-Fetch-Dest, X-Requested-With and Accept headers,
+// and the URL path extension.
+func placeholderKindOf(req *http.Request) placeholderKind {
+	switch req.Header.Get("Sec-Fetch-Dest") {
+	case "image":
+		return imagePlaceholder
+	case "script", "worker", "sharedworker", "serviceworker":
+		return scriptPlaceholder
+	case "style":
+		return stylePlaceholder
+	case "empty":
+		return xhrPlaceholder
+	case "":
+	default:
+		return noPlaceholder
+	}
+
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return xhrPlaceholder
+	}
+
+	switch strings.ToLower(path.Ext(req.URL.Path)) {
+	case ".png", ".gif", ".jpg", ".jpeg", ".webp", ".avif", ".svg", ".ico":
+		return imagePlaceholder
+	case ".js", ".mjs":
+		return scriptPlaceholder
+	case ".css":
+		return stylePlaceholder
+	}
+
+	accept := req.Header.Get("Accept")
+	switch {
+	case strings.HasPrefix(accept, "image/"):
+		return imagePlaceholder
+	case strings.HasPrefix(accept, "text/css"):
+		return stylePlaceholder
+	case strings.HasPrefix(accept, "application/json"):
+		return xhrPlaceholder
+	}
+
+	return noPlaceholder
+}
+
+// blockedPlaceholder returns a placeholder response for assets denied by the proxy policy,
+// so that pages render cleanly, or nil if the error page should be returned.
+func blockedPlaceholder(req *http.Request, err error) *http.Response {
+	var denyErr denyError
+	if req.Method == http.MethodConnect || !errors.As(err, &denyErr) {
+		return nil
+	}
+
+	var (
+		code        = http.StatusOK
+		contentType string
+		body        []byte
+	)
+	switch placeholderKindOf(req) {
+	case imagePlaceholder:
+		contentType = "image/png"
+		body = transparentPNG
+	case scriptPlaceholder:
+		contentType = "application/javascript"
+	case stylePlaceholder:
+		contentType = "text/css"
+	case xhrPlaceholder:
+		code = http.StatusNoContent
+	default:
+		return nil
+	}
+
+	resp := proxyutil.NewResponse(code, bytes.NewReader(body), req)
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.ContentLength = int64(len(body))
+	}
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set(DeniedByHeader, denyErr.rule)
+
+	return resp
+}
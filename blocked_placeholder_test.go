@@ -0,0 +1,96 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlockedPlaceholder(t *testing.T) {
+	tests := []struct {
+		name        string
+		url         string
+		header      http.Header
+		code        int
+		contentType string
+	}{
+		{"image dest", "http://ads.example.com/x", http.Header{"Sec-Fetch-Dest": {"image"}}, http.StatusOK, "image/png"},
+		{"image ext", "http://ads.example.com/banner.GIF", nil, http.StatusOK, "image/png"},
+		{"image accept", "http://ads.example.com/x", http.Header{"Accept": {"image/webp,*/*"}}, http.StatusOK, "image/png"},
+		{"script", "http://ads.example.com/ads.js?v=1", nil, http.StatusOK, "application/javascript"},
+		{"style", "http://ads.example.com/x", http.Header{"Sec-Fetch-Dest": {"style"}}, http.StatusOK, "text/css"},
+		{"xhr", "http://ads.example.com/api", http.Header{"X-Requested-With": {"XMLHttpRequest"}}, http.StatusNoContent, ""},
+		{"fetch", "http://ads.example.com/api", http.Header{"Sec-Fetch-Dest": {"empty"}}, http.StatusNoContent, ""},
+		{"document", "http://ads.example.com/x.js", http.Header{"Sec-Fetch-Dest": {"document"}}, 0, ""},
+		{"page", "http://ads.example.com/", http.Header{"Accept": {"text/html"}}, 0, ""},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.url, http.NoBody)
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+
+			resp := blockedPlaceholder(req, ErrProxyDenied)
+			if tc.code == 0 {
+				if resp != nil {
+					t.Fatalf("expected no placeholder, got %d", resp.StatusCode)
+				}
+				return
+			}
+			if resp == nil {
+				t.Fatal("expected placeholder")
+			}
+			if resp.StatusCode != tc.code {
+				t.Fatalf("expected status %d, got %d", tc.code, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tc.contentType {
+				t.Fatalf("expected content type %q, got %q", tc.contentType, ct)
+			}
+			if resp.Header.Get(DeniedByHeader) != ErrProxyDenied.rule {
+				t.Fatalf("expected %s header", DeniedByHeader)
+			}
+
+			if tc.contentType == "image/png" {
+				b, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				img, err := png.Decode(bytes.NewReader(b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b := img.Bounds(); b.Dx() != 1 || b.Dy() != 1 {
+					t.Fatalf("unexpected image size %v", b)
+				}
+				if _, _, _, a := img.At(0, 0).RGBA(); a != 0 {
+					t.Fatal("expected transparent image")
+				}
+			}
+		})
+	}
+}
+
+func TestBlockedPlaceholderNotDenied(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/x.png", http.NoBody)
+	if resp := blockedPlaceholder(req, errors.New("dial failed")); resp != nil {
+		t.Fatal("expected no placeholder for errors other than deny errors")
+	}
+
+	req = httptest.NewRequest(http.MethodConnect, "http://example.com:443", http.NoBody)
+	if resp := blockedPlaceholder(req, ErrProxyDenied); resp != nil {
+		t.Fatal("expected no placeholder for CONNECT requests")
+	}
+}
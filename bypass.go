@@ -0,0 +1,191 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// BypassHeader is sent by trusted clients to skip MITM or body logging of a single request,
+// e.g. a test uploading credentials.
+// The value is "<actions>; ts=<unix time>; sig=<signature>", actions is a comma separated list of BypassAction,
+// and the signature is the hex encoded HMAC-SHA256 of "<actions>\n<ts>\n<method>\n<host>" keyed with the shared secret,
+// see SignBypass.
+// The header is removed from the request before it is forwarded.
+const BypassHeader = "X-Forwarder-Bypass"
+
+// BypassAction is a feature skipped for a request with a valid BypassHeader.
+type BypassAction string
+
+const (
+	// BypassMITM tunnels the CONNECT request instead of MITMing it.
+	BypassMITM BypassAction = "mitm"
+	// BypassLogBody logs the request without bodies.
+	BypassLogBody BypassAction = "log-body"
+)
+
+func (a BypassAction) isValid() bool {
+	switch a {
+	case BypassMITM, BypassLogBody:
+		return true
+	default:
+		return false
+	}
+}
+
+type BypassConfig struct {
+	// SecretFile is a path or base64 encoded HMAC key shared with the trusted clients.
+	SecretFile string
+
+	// MaxAge is the maximal age of the signed timestamp, it limits replays of captured headers.
+	MaxAge time.Duration
+}
+
+func DefaultBypassConfig() *BypassConfig {
+	return &BypassConfig{
+		MaxAge: 5 * time.Minute,
+	}
+}
+
+func (c *BypassConfig) Validate() error {
+	if c.SecretFile == "" {
+		return errors.New("secret file is required")
+	}
+	if c.MaxAge <= 0 {
+		return errors.New("max age must be positive")
+	}
+	return nil
+}
+
+const minBypassSecretSize = 16
+
+func (c *BypassConfig) loadSecret() ([]byte, error) {
+	b, err := ReadFileOrBase64(c.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < minBypassSecretSize {
+		return nil, fmt.Errorf("secret must be at least %d bytes", minBypassSecretSize)
+	}
+	return b, nil
+}
+
+// SignBypass returns the BypassHeader value allowing the actions for the request at time t.
+func SignBypass(secret []byte, req *http.Request, t time.Time, actions ...BypassAction) string {
+	a := make([]string, len(actions))
+	for i := range actions {
+		a[i] = string(actions[i])
+	}
+	s := strings.Join(a, ",")
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return s + "; ts=" + ts + "; sig=" + bypassSignature(secret, s, ts, req)
+}
+
+func bypassSignature(secret []byte, actions, ts string, req *http.Request) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(actions + "\n" + ts + "\n" + req.Method + "\n" + req.URL.Hostname()))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// verifyBypass parses and verifies the BypassHeader value, the error describes why the header is rejected.
+func verifyBypass(secret []byte, maxAge time.Duration, req *http.Request, val string, now time.Time) ([]BypassAction, error) {
+	parts := strings.Split(val, ";")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed")
+	}
+	actions := strings.TrimSpace(parts[0])
+	ts, ok := strings.CutPrefix(strings.TrimSpace(parts[1]), "ts=")
+	if !ok {
+		return nil, errors.New("malformed")
+	}
+	sig, ok := strings.CutPrefix(strings.TrimSpace(parts[2]), "sig=")
+	if !ok {
+		return nil, errors.New("malformed")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(bypassSignature(secret, actions, ts, req))) {
+		return nil, errors.New("invalid signature")
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("malformed")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > maxAge || d < -maxAge {
+		return nil, errors.New("expired")
+	}
+
+	var res []BypassAction
+	for _, a := range strings.Split(actions, ",") {
+		a := BypassAction(strings.TrimSpace(a))
+		if !a.isValid() {
+			return nil, fmt.Errorf("unknown action %q", a)
+		}
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+const bypassKey = "forwarder.bypass"
+
+// bypass validates BypassHeader and stores the allowed actions in the request context.
+// Granted and rejected headers are logged with the client and user for auditing.
+func (hp *HTTPProxy) bypass() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		val := req.Header.Get(BypassHeader)
+		if val == "" {
+			return nil
+		}
+		req.Header.Del(BypassHeader)
+
+		actions, err := verifyBypass(hp.bypassSecret, hp.config.Bypass.MaxAge, req, val, time.Now())
+		if err != nil {
+			hp.log.Errorf("bypass rejected: %s client=%s user=%s method=%s host=%s",
+				err, req.RemoteAddr, middleware.User(req), req.Method, req.URL.Host)
+			hp.metrics.bypass("rejected")
+			return nil
+		}
+
+		hp.log.Infof("bypass granted: actions=%s client=%s user=%s method=%s host=%s",
+			actions, req.RemoteAddr, middleware.User(req), req.Method, req.URL.Host)
+		hp.metrics.bypass("granted")
+
+		if ctx := martian.NewContext(req); ctx != nil {
+			ctx.Set(bypassKey, actions)
+		}
+		return nil
+	})
+}
+
+// hasBypass returns true if the request has a valid BypassHeader allowing the action.
+func hasBypass(req *http.Request, action BypassAction) bool {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return false
+	}
+	v, ok := ctx.Get(bypassKey)
+	if !ok {
+		return false
+	}
+	for _, a := range v.([]BypassAction) { //nolint:forcetypeassert // we know the type
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
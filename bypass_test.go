@@ -0,0 +1,121 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestVerifyBypass(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/login", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := SignBypass(secret, req, now, BypassLogBody)
+
+	tests := []struct {
+		name string
+		val  string
+		now  time.Time
+		err  string
+	}{
+		{"valid", valid, now, ""},
+		{"other key", SignBypass([]byte("fedcba9876543210"), req, now, BypassLogBody), now, "invalid signature"},
+		{"tampered actions", strings.Replace(valid, "log-body", "mitm", 1), now, "invalid signature"},
+		{"expired", valid, now.Add(10 * time.Minute), "expired"},
+		{"unknown action", SignBypass(secret, req, now, "cache"), now, `unknown action "cache"`},
+		{"malformed", "log-body", now, "malformed"},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			actions, err := verifyBypass(secret, 5*time.Minute, req, tc.val, tc.now)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(actions) != 1 || actions[0] != BypassLogBody {
+				t.Fatalf("unexpected actions %v", actions)
+			}
+		})
+	}
+}
+
+func TestBypassHeaderRemoved(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Bypass = DefaultBypassConfig()
+	cfg.Bypass.SecretFile = "data:base64," + base64.StdEncoding.EncodeToString(secret)
+
+	var bypassed, forwarded bool
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			bypassed = hasBypass(req, BypassLogBody)
+			forwarded = req.Header.Get(BypassHeader) != ""
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/login", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(BypassHeader, SignBypass(secret, req, time.Now(), BypassLogBody))
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if !bypassed {
+		t.Fatal("expected bypass to be granted")
+	}
+	if forwarded {
+		t.Fatalf("expected %s header to be removed", BypassHeader)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ClientCertIdentity specifies the field of the client certificate subject used as the client identity.
+type ClientCertIdentity string
+
+const (
+	// CommonNameClientCertIdentity uses the subject common name, it is the default.
+	CommonNameClientCertIdentity ClientCertIdentity = "cn"
+	// SubjectClientCertIdentity uses the subject distinguished name e.g. "CN=alice,O=Example".
+	SubjectClientCertIdentity ClientCertIdentity = "subject"
+	// EmailClientCertIdentity uses the first email address of the subject alternative names.
+	EmailClientCertIdentity ClientCertIdentity = "email"
+)
+
+func ClientCertIdentities() []ClientCertIdentity {
+	return []ClientCertIdentity{
+		CommonNameClientCertIdentity,
+		SubjectClientCertIdentity,
+		EmailClientCertIdentity,
+	}
+}
+
+func (i ClientCertIdentity) String() string {
+	return string(i)
+}
+
+func (i ClientCertIdentity) isValid() bool {
+	switch i {
+	case CommonNameClientCertIdentity, SubjectClientCertIdentity, EmailClientCertIdentity:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i ClientCertIdentity) identity(cert *x509.Certificate) string {
+	switch i {
+	case SubjectClientCertIdentity:
+		return cert.Subject.String()
+	case EmailClientCertIdentity:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		return ""
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// ClientCertAuthenticator authenticates clients presenting a TLS certificate verified by the server,
+// the identity is taken from the certificate subject.
+// It requires the server to verify client certificates, see TLSClientAuthConfig.
+type ClientCertAuthenticator struct {
+	Identity ClientCertIdentity
+}
+
+func (a *ClientCertAuthenticator) Authenticate(req *http.Request) (string, error) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+
+	cert := req.TLS.VerifiedChains[0][0]
+	id := a.Identity.identity(cert)
+	if id == "" {
+		return "", fmt.Errorf("client certificate %q has no %s identity", cert.Subject, a.Identity)
+	}
+
+	return id, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestClientCertIdentity(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   "alice",
+			Organization: []string{"Example"},
+		},
+		EmailAddresses: []string{"alice@example.com"},
+	}
+
+	tests := []struct {
+		identity ClientCertIdentity
+		want     string
+	}{
+		{CommonNameClientCertIdentity, "alice"},
+		{SubjectClientCertIdentity, "CN=alice,O=Example"},
+		{EmailClientCertIdentity, "alice@example.com"},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.identity.String(), func(t *testing.T) {
+			if got := tc.identity.identity(cert); got != tc.want {
+				t.Fatalf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClientCertAuthenticatorErrors(t *testing.T) {
+	a := &ClientCertAuthenticator{Identity: EmailClientCertIdentity}
+
+	if _, err := a.Authenticate(&http.Request{}); err == nil {
+		t.Fatal("expected error for request without TLS")
+	}
+	if _, err := a.Authenticate(&http.Request{TLS: &tls.ConnectionState{}}); err == nil {
+		t.Fatal("expected error for request without verified certificate")
+	}
+
+	cs := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "alice"}}}}}
+	if _, err := a.Authenticate(&http.Request{TLS: cs}); err == nil {
+		t.Fatal("expected error for certificate without email")
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProxyClientCertAuth(t *testing.T) {
+	ca := newTestCA(t)
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Protocol = HTTPSScheme
+	cfg.ClientAuth.CACertFiles = []string{ca.writePEM(t)}
+
+	var user string
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			user = middleware.User(req)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Use TCP connections, the server TLS alert would block on an in-memory pipe.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.ServeConn(c)
+		}
+	}()
+
+	do := func(certs ...tls.Certificate) (int, error) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := tls.Client(c, &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // self-signed proxy certificate
+			Certificates:       certs,
+		})
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			return 0, err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	if _, err := do(); err == nil {
+		t.Fatal("expected handshake error without client certificate")
+	}
+	if _, err := do(newTestCA(t).issue(t, "mallory")); err == nil {
+		t.Fatal("expected handshake error with certificate signed by unknown CA")
+	}
+
+	s, err := do(ca.issue(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", s)
+	}
+	if user != "alice" {
+		t.Fatalf("expected user alice, got %q", user)
+	}
+}
+
+func TestHTTPProxyConfigValidateClientAuth(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ClientAuth.CACertFiles = []string{"ca.pem"}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for http protocol")
+	}
+
+	cfg.Protocol = HTTPSScheme
+	cfg.ClientAuth.Optional = true
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for optional client auth without other authentication methods")
+	}
+
+	cfg.HtpasswdFile = "htpasswd"
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
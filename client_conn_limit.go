@@ -0,0 +1,95 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+const clientConnKey = "forwarder.clientConn"
+
+// clientConnLimiter counts connections per client, a client is the authenticated user or the client IP.
+type clientConnLimiter struct {
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newClientConnLimiter(maxConns int) *clientConnLimiter {
+	return &clientConnLimiter{
+		max:   maxConns,
+		conns: make(map[string]int),
+	}
+}
+
+func (l *clientConnLimiter) acquire(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[client] >= l.max {
+		return false
+	}
+	l.conns[client]++
+	return true
+}
+
+func (l *clientConnLimiter) release(client string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[client] <= 1 {
+		delete(l.conns, client)
+	} else {
+		l.conns[client]--
+	}
+}
+
+// clientConnLimit rejects requests with 429 Too Many Requests if the client has MaxConnsPerClient other connections open.
+// A connection is counted from its first authenticated request until it is closed, tunnels count as the connection they use.
+func (hp *HTTPProxy) clientConnLimit() martian.RequestModifier {
+	return hp.abortIf(func(req *http.Request) bool {
+		ctx := martian.NewContext(req)
+		if ctx == nil {
+			return false
+		}
+		s := ctx.Session()
+		if _, ok := s.Get(clientConnKey); ok {
+			return false
+		}
+
+		client := clientConnID(req)
+		if !hp.connLimiter.acquire(client) {
+			return true
+		}
+		s.Set(clientConnKey, client)
+		s.OnClose(func() {
+			hp.connLimiter.release(client)
+		})
+		return false
+	}, func(req *http.Request) *http.Response {
+		return proxyutil.NewResponse(http.StatusTooManyRequests, http.NoBody, req)
+	}, errors.New("client connection limit exceeded"))
+}
+
+func clientConnID(req *http.Request) string {
+	if u := middleware.User(req); u != "" {
+		return "user/" + u
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return "ip/" + host
+}
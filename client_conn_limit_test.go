@@ -0,0 +1,100 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestClientConnLimit(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MaxConnsPerClient = 2
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	dial := func(t *testing.T) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	status := func(t *testing.T, conn net.Conn, br *bufio.Reader) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	c1, br1 := dial(t)
+	defer c1.Close()
+	c2, br2 := dial(t)
+	defer c2.Close()
+
+	for i := 0; i < 2; i++ {
+		if s := status(t, c1, br1); s != http.StatusOK {
+			t.Fatalf("conn 1: expected status 200, got %d", s)
+		}
+		if s := status(t, c2, br2); s != http.StatusOK {
+			t.Fatalf("conn 2: expected status 200, got %d", s)
+		}
+	}
+
+	c3, br3 := dial(t)
+	defer c3.Close()
+	if s := status(t, c3, br3); s != http.StatusTooManyRequests {
+		t.Fatalf("conn 3: expected status 429, got %d", s)
+	}
+
+	// The connection is released asynchronously when the proxy notices it is closed.
+	c1.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c4, br4 := dial(t)
+		s := status(t, c4, br4)
+		c4.Close()
+		if s == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("conn 4: expected status 200 after closing conn 1, got %d", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
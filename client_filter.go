@@ -0,0 +1,139 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/saucelabs/forwarder/proxyproto"
+)
+
+// clientFilter checks client addresses against AllowClients and DenyClients.
+type clientFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// check returns the reason the client is rejected, or an empty string if it is allowed.
+func (f *clientFilter) check(addr net.Addr) string {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return "invalid_address"
+	}
+	for _, p := range f.deny {
+		if p.Contains(ip) {
+			return "deny"
+		}
+	}
+	if len(f.allow) == 0 {
+		return ""
+	}
+	for _, p := range f.allow {
+		if p.Contains(ip) {
+			return ""
+		}
+	}
+	return "not_allowed"
+}
+
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(ta.IP)
+		return ip.Unmap(), ok
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// filterClients wraps the listener to reject clients not allowed by AllowClients and DenyClients,
+// it must be applied to every listener accepting proxy clients.
+func (hp *HTTPProxy) filterClients(l net.Listener) net.Listener {
+	if hp.clients == nil {
+		return l
+	}
+	return &clientFilterListener{
+		Listener: l,
+		hp:       hp,
+		filter:   hp.clients,
+	}
+}
+
+// rejectClient reports whether the client is not allowed by AllowClients and DenyClients,
+// it is used for connectionless protocols where there is no listener to wrap.
+func (hp *HTTPProxy) rejectClient(addr net.Addr) bool {
+	if hp.clients == nil {
+		return false
+	}
+	reason := hp.clients.check(addr)
+	if reason == "" {
+		return false
+	}
+	hp.log.Debugf("rejected client %s reason=%s", addr, reason)
+	hp.metrics.rejectedConn(reason)
+	return true
+}
+
+// clientFilterListener closes connections from rejected clients before any data is read.
+type clientFilterListener struct {
+	net.Listener
+	hp     *HTTPProxy
+	filter *clientFilter
+}
+
+func (l *clientFilterListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// The client address is in the PROXY protocol header, reading it here would block accepting other connections.
+		if pc, ok := c.(*proxyproto.Conn); ok {
+			return &clientFilterConn{Conn: pc, l: l}, nil
+		}
+
+		if reason := l.filter.check(c.RemoteAddr()); reason != "" {
+			l.reject(c, reason)
+			continue
+		}
+		return c, nil
+	}
+}
+
+func (l *clientFilterListener) reject(c net.Conn, reason string) {
+	l.hp.log.Debugf("rejected connection from %s reason=%s", c.RemoteAddr(), reason)
+	l.hp.metrics.rejectedConn(reason)
+	c.Close()
+}
+
+// clientFilterConn checks the client address from the PROXY protocol header on the first read.
+type clientFilterConn struct {
+	net.Conn
+	l *clientFilterListener
+
+	once sync.Once
+	err  error
+}
+
+func (c *clientFilterConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		if reason := c.l.filter.check(c.Conn.RemoteAddr()); reason != "" {
+			c.err = fmt.Errorf("client %s rejected: %s", c.Conn.RemoteAddr(), reason)
+			c.l.reject(c.Conn, reason)
+		}
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,204 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/proxyproto"
+)
+
+func TestClientFilterCheck(t *testing.T) {
+	f := &clientFilter{
+		allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")},
+		deny:  []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+	}
+
+	tests := []struct {
+		addr   net.Addr
+		reason string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1234}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.2.3.4"), Port: 1234}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, ""},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.3.4"), Port: 1234}, "deny"},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, "not_allowed"},
+		{&net.UnixAddr{Name: "pipe", Net: "unix"}, "invalid_address"},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.addr.String(), func(t *testing.T) {
+			if got := f.check(tc.addr); got != tc.reason {
+				t.Fatalf("expected reason %q, got %q", tc.reason, got)
+			}
+		})
+	}
+
+	if got := (&clientFilter{deny: f.deny}).check(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}); got != "" {
+		t.Fatalf("expected client allowed without allow list, got %q", got)
+	}
+}
+
+func TestClientFilterListener(t *testing.T) {
+	hp := &HTTPProxy{
+		log:     stdlog.Default(),
+		metrics: newMetrics(nil, "", 1),
+	}
+
+	newListener := func(t *testing.T, proxyProtocol bool, deny string) net.Listener {
+		t.Helper()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+
+		if proxyProtocol {
+			l = proxyproto.NewListener(l, time.Second)
+		}
+		return &clientFilterListener{
+			Listener: l,
+			hp:       hp,
+			filter:   &clientFilter{deny: []netip.Prefix{netip.MustParsePrefix(deny)}},
+		}
+	}
+
+	// serve echoes the first byte read from accepted connections.
+	serve := func(l net.Listener) {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 1)
+				if _, err := c.Read(b); err == nil {
+					c.Write(b) //nolint:errcheck // test server
+				}
+			}()
+		}
+	}
+
+	echo := func(t *testing.T, l net.Listener, header string) bool {
+		t.Helper()
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck // test client
+
+		if _, err := io.WriteString(c, header+"x"); err != nil {
+			return false
+		}
+		b := make([]byte, 1)
+		_, err = io.ReadFull(c, b)
+		return err == nil && b[0] == 'x'
+	}
+
+	t.Run("direct", func(t *testing.T) {
+		l := newListener(t, false, "192.168.0.0/16")
+		go serve(l)
+		if !echo(t, l, "") {
+			t.Fatal("expected allowed connection")
+		}
+
+		l = newListener(t, false, "127.0.0.0/8")
+		go serve(l)
+		if echo(t, l, "") {
+			t.Fatal("expected rejected connection")
+		}
+	})
+
+	t.Run("proxy protocol", func(t *testing.T) {
+		l := newListener(t, true, "127.0.0.0/8")
+		go serve(l)
+		if !echo(t, l, "PROXY TCP4 192.168.1.1 127.0.0.1 1234 80\r\n") {
+			t.Fatal("expected allowed connection")
+		}
+		if echo(t, l, "PROXY TCP4 127.0.0.2 127.0.0.1 1234 80\r\n") {
+			t.Fatal("expected rejected connection")
+		}
+	})
+}
+
+func TestClientFilterInboundListeners(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DenyClients = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("socks5", func(t *testing.T) {
+		scfg := DefaultSOCKS5ServerConfig()
+		scfg.Addr = "127.0.0.1:0"
+		s, err := NewSOCKS5Server(scfg, p, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		go s.Run(ctx) //nolint:errcheck // closed by the test
+
+		c, err := net.Dial("tcp", s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck // test client
+
+		io.WriteString(c, "\x05\x01\x00") //nolint:errcheck // the connection may be closed
+		if _, err := io.ReadFull(c, make([]byte, 2)); err == nil {
+			t.Fatal("expected rejected connection")
+		}
+	})
+
+	t.Run("dns", func(t *testing.T) {
+		fcfg := DefaultDNSForwarderConfig()
+		fcfg.Addr = "127.0.0.1:0"
+		fcfg.Upstream = []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:1")}
+		f, err := NewDNSForwarder(fcfg, p, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		go f.Run(ctx) //nolint:errcheck // closed by the test
+
+		c, err := net.Dial("udp", f.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(500 * time.Millisecond)) //nolint:errcheck // test client
+
+		if _, err := c.Write(dnsQuery(false)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Read(make([]byte, dnsMaxUDPSize)); err == nil {
+			t.Fatal("expected no response to rejected client")
+		}
+	})
+
+	if v := testutil.ToFloat64(p.metrics.rejected.WithLabelValues("deny")); v != 2 {
+		t.Fatalf("expected 2 rejected clients, got %v", v)
+	}
+}
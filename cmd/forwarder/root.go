@@ -11,6 +11,7 @@ import (
 	"github.com/saucelabs/forwarder/cmd/forwarder/httpbin"
 	"github.com/saucelabs/forwarder/cmd/forwarder/pac"
 	"github.com/saucelabs/forwarder/cmd/forwarder/ready"
+	"github.com/saucelabs/forwarder/cmd/forwarder/ruleset"
 	"github.com/saucelabs/forwarder/cmd/forwarder/run"
 	"github.com/saucelabs/forwarder/cmd/forwarder/version"
 	"github.com/saucelabs/forwarder/utils/cobrautil"
@@ -36,6 +37,7 @@ func rootCommand() *cobra.Command {
 			Commands: []*cobra.Command{
 				run.Command(),
 				pac.Command(),
+				ruleset.Command(),
 				ready.Command(),
 			},
 		},
@@ -84,6 +86,10 @@ func rootCommand() *cobra.Command {
 				"prom",
 			},
 		},
+		{
+			Name:   "Admin server options",
+			Prefix: []string{"admin"},
+		},
 		{
 			Name:   "Logging options",
 			Prefix: []string{"log"},
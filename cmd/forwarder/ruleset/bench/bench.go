@@ -0,0 +1,98 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/mmatczuk/anyflag"
+	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/ruleset"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/multierr"
+)
+
+type command struct {
+	rules      []ruleset.RegexpListItem
+	limits     *ruleset.RegexpLimits
+	iterations int
+}
+
+func (c *command) runE(cmd *cobra.Command, args []string) error {
+	if len(c.rules) == 0 {
+		return errors.New("no rules specified")
+	}
+	if c.iterations <= 0 {
+		return errors.New("iterations must be positive")
+	}
+	if err := c.limits.Validate(); err != nil {
+		return err
+	}
+
+	// Report all rules exceeding the limits, and benchmark the rules as they would be loaded.
+	var errs error
+	for i := range c.rules {
+		errs = multierr.Append(errs, c.limits.Check(c.rules[i].Regexp))
+	}
+	if errs != nil {
+		return errs
+	}
+	rules, err := c.limits.Apply(c.rules)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COST\tRULE")
+	for _, rc := range ruleset.BenchmarkRegexpList(rules, args, c.iterations) {
+		fmt.Fprintf(w, "%s\t%s\n", rc.Cost, rc.Rule)
+	}
+	return w.Flush()
+}
+
+func Command() *cobra.Command {
+	c := command{
+		limits:     ruleset.DefaultRegexpLimits(),
+		iterations: 1000,
+	}
+
+	cmd := &cobra.Command{
+		Use:     "bench --rule <regexp> [flags] <host>...",
+		Short:   "Report the match cost of regexp rules for given hosts",
+		Long:    long,
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    c.runE,
+		Example: example,
+	}
+
+	fs := cmd.Flags()
+	bindRules(fs, &c.rules)
+	bind.RegexpLimits(fs, c.limits)
+	fs.IntVar(&c.iterations, "iterations", c.iterations, "<n>"+
+		"Number of times every rule is matched against every host. ")
+
+	return cmd
+}
+
+func bindRules(fs *pflag.FlagSet, cfg *[]ruleset.RegexpListItem) {
+	fs.Var(anyflag.NewSliceValue[ruleset.RegexpListItem](*cfg, cfg, ruleset.ParseRegexpListItem),
+		"rule", "[-]<regexp>,..."+
+			"Rules in the format of the --deny-domains, --direct-domains and --mitm-domains flags. ")
+}
+
+const long = `Report the match cost of regexp rules for given hosts.
+Every rule is matched against every host, and the average time of a single match is reported,
+the most expensive rules first.
+Rules exceeding the limits are reported as errors, as they would be rejected by the run command.
+`
+
+const example = `  # Find the most expensive rules of a deny list
+  forwarder ruleset bench --rule '.*\.example\.com' --rule '(a+)+\.net' www.example.com a.net
+`
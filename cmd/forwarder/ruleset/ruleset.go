@@ -0,0 +1,23 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"github.com/saucelabs/forwarder/cmd/forwarder/ruleset/bench"
+	"github.com/spf13/cobra"
+)
+
+func Command() (cmd *cobra.Command) {
+	cmd = &cobra.Command{
+		Use:   "ruleset",
+		Short: "Tools for working with domain rule lists",
+	}
+	cmd.AddCommand(
+		bench.Command(),
+	)
+	return cmd
+}
@@ -7,29 +7,41 @@
 package run
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/saucelabs/forwarder"
 	"github.com/saucelabs/forwarder/bind"
+	"github.com/saucelabs/forwarder/grpcapi"
 	"github.com/saucelabs/forwarder/header"
+	"github.com/saucelabs/forwarder/hsts"
 	martianlog "github.com/saucelabs/forwarder/internal/martian/log"
 	"github.com/saucelabs/forwarder/internal/version"
+	"github.com/saucelabs/forwarder/journal"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/log/stdlog"
 	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/remoteconfig"
 	"github.com/saucelabs/forwarder/ruleset"
 	"github.com/saucelabs/forwarder/runctx"
+	"github.com/saucelabs/forwarder/stats"
 	"github.com/saucelabs/forwarder/utils/cobrautil"
 	"github.com/saucelabs/forwarder/utils/httphandler"
 	"github.com/saucelabs/forwarder/utils/osdns"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/goleak"
 	"go.uber.org/multierr"
 )
@@ -39,17 +51,58 @@ type command struct {
 	dnsConfig           *osdns.Config
 	httpTransportConfig *forwarder.HTTPTransportConfig
 	pac                 *url.URL
+	dnsDiscoveryConfig  *forwarder.DNSDiscoveryConfig
+	k8sDiscoveryConfig  *forwarder.KubernetesDiscoveryConfig
+	xdsConfig           *forwarder.XDSConfig
+	remoteConfig        *remoteconfig.Config
+	grpcAPIConfig       *grpcapi.ServerConfig
+	journalConfig       *journal.Config
+	hsts                bool
+	latencySelection    bool
+	latencyConfig       *forwarder.LatencySelectorConfig
+	hstsConfig          *hsts.Config
+	socks5Config        *forwarder.SOCKS5ServerConfig
+	dnsForwarderConfig  *forwarder.DNSForwarderConfig
+	upstreamTLSConfig   *forwarder.UpstreamProxyTLSConfig
+	transparentConfig   *forwarder.TransparentServerConfig
+	statsConfig         *stats.Config
 	credentials         []*forwarder.HostPortUser
 	denyDomains         []ruleset.RegexpListItem
+	blockLists          []*url.URL
 	directDomains       []ruleset.RegexpListItem
+	userPolicies        []forwarder.UserPolicyItem
+	userPolicyFile      string
+	sniRoutes           []forwarder.SNIRouteItem
 	proxyHeaders        []header.Header
 	requestHeaders      []header.Header
 	responseHeaders     []header.Header
+	securityHeaders     []forwarder.SecurityHeaderItem
+	responseValidation  []forwarder.ResponseValidationItem
 	httpProxyConfig     *forwarder.HTTPProxyConfig
+	jwtAuthConfig       *forwarder.JWTAuthConfig
+	bypassConfig        *forwarder.BypassConfig
+	timeoutHeaderConfig *forwarder.TimeoutHeaderConfig
+	authAllowIPs        []netip.Prefix
+	hedgingConfig       *forwarder.HedgingConfig
+	priorityConfig      *forwarder.PriorityConfig
 	mitm                bool
 	mitmConfig          *forwarder.MITMConfig
+	mitmDecisionURL     *url.URL
+	connectUDP          bool
+	connectUDPConfig    *forwarder.ConnectUDPConfig
+	slowClientConfig    *forwarder.SlowClientConfig
+	loadShedding        bool
+	loadSheddingConfig  *forwarder.LoadSheddingConfig
+	mitmDecisionConfig  *forwarder.MITMDecisionConfig
 	mitmDomains         []ruleset.RegexpListItem
+	mitmExcludeDomains  []ruleset.RegexpListItem
+	dnsRoutes           []forwarder.DNSRouteItem
+	integrityDomains    []ruleset.RegexpListItem
+	privacyDomains      []ruleset.RegexpListItem
+	regexpLimits        *ruleset.RegexpLimits
+	privacyConfig       *forwarder.PrivacyConfig
 	apiServerConfig     *forwarder.HTTPServerConfig
+	adminServerConfig   *forwarder.HTTPServerConfig
 	logConfig           *log.Config
 	goleak              bool
 }
@@ -123,6 +176,14 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		rt http.RoundTripper
 	)
 
+	if len(c.dnsRoutes) > 0 {
+		routes, err := forwarder.NewDNSRoutes(c.dnsRoutes)
+		if err != nil {
+			return fmt.Errorf("dns routes: %w", err)
+		}
+		c.httpTransportConfig.DNSRoutes = routes
+	}
+
 	{
 		var err error
 		rt, err = forwarder.NewHTTPTransport(c.httpTransportConfig)
@@ -159,22 +220,136 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		return fmt.Errorf("credentials: %w", err)
 	}
 
+	g := runctx.NewGroup()
+
+	var ls *forwarder.LatencySelector
+	if c.latencySelection {
+		ls, err = forwarder.NewLatencySelector(c.latencyConfig)
+		if err != nil {
+			return fmt.Errorf("latency selection: %w", err)
+		}
+		c.httpProxyConfig.LatencySelector = ls
+	}
+	poolProxyFunc := func(pool *forwarder.UpstreamPool) forwarder.ProxyFunc {
+		if ls != nil {
+			return pool.LatencyProxyFunc(ls)
+		}
+		return pool.ProxyFunc()
+	}
+
+	var upstream forwarder.ProxyFunc
+
+	if c.dnsDiscoveryConfig.Record.Mode != "" {
+		pool := new(forwarder.UpstreamPool)
+		d, err := forwarder.NewDNSDiscovery(c.dnsDiscoveryConfig, pool, logger.Named("dns-discovery"))
+		if err != nil {
+			return fmt.Errorf("proxy dns discovery: %w", err)
+		}
+		if err := d.Refresh(context.Background()); err != nil {
+			return fmt.Errorf("proxy dns discovery: %w", err)
+		}
+		g.Add(d.Run)
+		upstream = poolProxyFunc(pool)
+	}
+
+	if c.k8sDiscoveryConfig.Service != "" {
+		pool := new(forwarder.UpstreamPool)
+		d, err := forwarder.NewKubernetesDiscovery(c.k8sDiscoveryConfig, pool, logger.Named("k8s-discovery"))
+		if err != nil {
+			return fmt.Errorf("proxy k8s discovery: %w", err)
+		}
+		if _, err := d.Refresh(context.Background()); err != nil {
+			return fmt.Errorf("proxy k8s discovery: %w", err)
+		}
+		g.Add(d.Run)
+		upstream = poolProxyFunc(pool)
+	}
+
+	if c.xdsConfig.Server != nil {
+		d, err := forwarder.NewXDSDiscovery(c.xdsConfig, logger.Named("xds"))
+		if err != nil {
+			return fmt.Errorf("xds: %w", err)
+		}
+		if err := d.Refresh(context.Background()); err != nil {
+			return fmt.Errorf("xds: %w", err)
+		}
+		g.Add(d.Run)
+		upstream = d.ProxyFunc()
+	}
+
+	if upstream != nil {
+		c.httpProxyConfig.UpstreamProxyFunc = func(req *http.Request) (*url.URL, error) {
+			u, err := upstream(req)
+			if err == nil && u != nil && u.User == nil {
+				u.User = cm.MatchURLScope(u, forwarder.ProxyCredentialsScope)
+			}
+			return u, err
+		}
+	}
+
+	if err := c.regexpLimits.Validate(); err != nil {
+		return fmt.Errorf("regexp limits: %w", err)
+	}
+	c.httpProxyConfig.RegexpLimits = c.regexpLimits
+
 	if len(c.denyDomains) > 0 {
-		dd, err := ruleset.NewRegexpMatcherFromList(c.denyDomains)
+		dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.denyDomains)
 		if err != nil {
 			return fmt.Errorf("deny domains: %w", err)
 		}
 		c.httpProxyConfig.DenyDomains = dd
 	}
 
+	if len(c.blockLists) > 0 {
+		lists := make([]io.Reader, 0, len(c.blockLists))
+		for _, u := range c.blockLists {
+			b, err := forwarder.ReadURL(u, rt)
+			if err != nil {
+				return fmt.Errorf("read block list: %w", err)
+			}
+			lists = append(lists, bytes.NewReader(b))
+		}
+		bl, err := ruleset.NewAdblockMatcher(lists...)
+		if err != nil {
+			return fmt.Errorf("block lists: %w", err)
+		}
+		added, skipped := bl.Rules()
+		logger.Infof("loaded %d block list rules, skipped %d unsupported rules", added, skipped)
+		c.httpProxyConfig.BlockList = bl
+	}
+
 	if len(c.directDomains) > 0 {
-		dd, err := ruleset.NewRegexpMatcherFromList(c.directDomains)
+		dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.directDomains)
 		if err != nil {
 			return fmt.Errorf("direct domains: %w", err)
 		}
 		c.httpProxyConfig.DirectDomains = dd
 	}
 
+	if c.userPolicyFile != "" {
+		items, err := forwarder.ReadUserPolicyFile(c.userPolicyFile)
+		if err != nil {
+			return fmt.Errorf("user policy file: %w", err)
+		}
+		c.userPolicies = append(items, c.userPolicies...)
+	}
+
+	if len(c.userPolicies) > 0 {
+		up, err := forwarder.NewUserPolicies(c.userPolicies, c.regexpLimits)
+		if err != nil {
+			return fmt.Errorf("user policies: %w", err)
+		}
+		c.httpProxyConfig.UserPolicies = up
+	}
+
+	if len(c.sniRoutes) > 0 {
+		routes, err := forwarder.NewSNIRoutes(c.sniRoutes, c.regexpLimits)
+		if err != nil {
+			return fmt.Errorf("sni routes: %w", err)
+		}
+		c.httpProxyConfig.SNIRoutes = routes
+	}
+
 	if len(c.proxyHeaders) > 0 {
 		c.httpProxyConfig.ConnectRequestModifier = func(req *http.Request) error {
 			if req.Header == nil {
@@ -194,19 +369,159 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		c.httpProxyConfig.ResponseModifiers = append(c.httpProxyConfig.ResponseModifiers, header.Headers(c.responseHeaders))
 	}
 
+	if len(c.responseValidation) > 0 {
+		rules, err := forwarder.NewResponseValidationRules(c.responseValidation)
+		if err != nil {
+			return fmt.Errorf("response validation: %w", err)
+		}
+		c.httpProxyConfig.ResponseValidation = rules
+	}
+
+	if len(c.securityHeaders) > 0 {
+		rules, err := forwarder.NewSecurityHeaderRules(c.securityHeaders)
+		if err != nil {
+			return fmt.Errorf("security headers: %w", err)
+		}
+		c.httpProxyConfig.SecurityHeaders = rules
+	}
+
+	if c.jwtAuthConfig.JWKSURL != nil {
+		c.httpProxyConfig.JWTAuth = c.jwtAuthConfig
+	}
+	if len(c.authAllowIPs) > 0 {
+		c.httpProxyConfig.Authenticators = append(c.httpProxyConfig.Authenticators,
+			&forwarder.IPAllowlistAuthenticator{Networks: c.authAllowIPs})
+	}
+	if c.bypassConfig.SecretFile != "" {
+		c.httpProxyConfig.Bypass = c.bypassConfig
+	}
+	if len(c.timeoutHeaderConfig.TrustedNetworks) > 0 {
+		c.httpProxyConfig.TimeoutHeader = c.timeoutHeaderConfig
+	}
+
+	if c.journalConfig.File != "" {
+		j, err := journal.New(c.journalConfig, logger.Named("journal"))
+		if err != nil {
+			return fmt.Errorf("journal: %w", err)
+		}
+		g.Add(j.Run)
+		c.httpProxyConfig.Journal = j
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:    "/journal",
+			Handler: j.Handler(),
+		})
+	}
+
+	if c.hsts || c.hstsConfig.File != "" {
+		h, err := hsts.New(c.hstsConfig, logger.Named("hsts"))
+		if err != nil {
+			return fmt.Errorf("hsts: %w", err)
+		}
+		g.Add(h.Run)
+		c.httpProxyConfig.HSTS = h
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:    "/hsts",
+			Handler: h.Handler(),
+		})
+	}
+
+	if c.statsConfig.Window > 0 {
+		s, err := stats.New(c.statsConfig)
+		if err != nil {
+			return fmt.Errorf("stats: %w", err)
+		}
+		c.httpProxyConfig.Stats = s
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:    "/top",
+			Handler: s.Handler(),
+		}, forwarder.APIEndpoint{
+			Path:    "/top/feed",
+			Handler: s.FeedHandler(),
+		})
+	}
+
 	if c.mitm || c.mitmConfig.CACertFile != "" || len(c.mitmDomains) > 0 {
 		c.httpProxyConfig.MITM = c.mitmConfig
 
 		if len(c.mitmDomains) > 0 {
-			dd, err := ruleset.NewRegexpMatcherFromList(c.mitmDomains)
+			dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.mitmDomains)
 			if err != nil {
 				return fmt.Errorf("mitm domains: %w", err)
 			}
 			c.httpProxyConfig.MITMDomains = dd
 		}
+		if len(c.mitmExcludeDomains) > 0 {
+			dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.mitmExcludeDomains)
+			if err != nil {
+				return fmt.Errorf("mitm exclude domains: %w", err)
+			}
+			c.httpProxyConfig.MITMExcludeDomains = dd
+		}
+	}
+
+	if u := c.mitmDecisionURL; u != nil {
+		switch u.Scheme {
+		case "http", "https":
+			c.mitmDecisionConfig.Decider = forwarder.NewHTTPMITMDecider(u, nil)
+		case "grpc":
+			d, err := grpcapi.DialMITMDecider(u.Host)
+			if err != nil {
+				return fmt.Errorf("mitm decision: %w", err)
+			}
+			defer d.Close()
+			c.mitmDecisionConfig.Decider = d
+		default:
+			return fmt.Errorf("mitm decision: unsupported scheme %q, supported schemes are: http, https, grpc", u.Scheme)
+		}
+		c.httpProxyConfig.MITMDecision = c.mitmDecisionConfig
+	}
+
+	if !c.upstreamTLSConfig.IsZero() {
+		c.httpProxyConfig.UpstreamProxyTLS = c.upstreamTLSConfig
+	}
+
+	if c.connectUDP {
+		c.httpProxyConfig.ConnectUDP = c.connectUDPConfig
+	}
+
+	if c.loadShedding {
+		c.httpProxyConfig.LoadShedding = c.loadSheddingConfig
+	}
+
+	if c.slowClientConfig.MinRate > 0 {
+		c.httpProxyConfig.SlowClient = c.slowClientConfig
+	}
+
+	if c.hedgingConfig.Delay > 0 {
+		c.httpProxyConfig.Hedging = c.hedgingConfig
+	}
+
+	if c.priorityConfig.MaxConcurrent > 0 {
+		c.httpProxyConfig.Priority = c.priorityConfig
+	} else if len(c.priorityConfig.Rules) > 0 {
+		return fmt.Errorf("priority: requires --priority-max-concurrent")
+	}
+
+	if len(c.integrityDomains) > 0 {
+		dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.integrityDomains)
+		if err != nil {
+			return fmt.Errorf("integrity domains: %w", err)
+		}
+		c.httpProxyConfig.IntegrityDomains = dd
+	}
+
+	if len(c.privacyDomains) > 0 {
+		dd, err := c.regexpLimits.NewRegexpMatcherFromList(c.privacyDomains)
+		if err != nil {
+			return fmt.Errorf("privacy domains: %w", err)
+		}
+		c.privacyConfig.Domains = dd
+		c.httpProxyConfig.Privacy = c.privacyConfig
 	}
 
-	g := runctx.NewGroup()
 	{
 		p, err := forwarder.NewHTTPProxy(c.httpProxyConfig, pr, cm, rt, logger.Named("proxy"))
 		if err != nil {
@@ -215,10 +530,99 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 		defer p.Close()
 		g.Add(p.Run)
 
-		if ca := p.MITMCACert(); ca != nil {
+		if c.remoteConfig.URL != nil {
+			rlog := logger.Named("remote-config")
+			rcp, err := remoteconfig.New(c.remoteConfig, rlog)
+			if err != nil {
+				return fmt.Errorf("config provider: %w", err)
+			}
+			base := p.RuntimeConfig()
+			g.Add(func(ctx context.Context) error {
+				return rcp.Watch(ctx, func(kv map[string]string) {
+					rc, err := forwarder.ParseRuntimeConfigValues(base, kv, c.regexpLimits, logger.Named("credentials"))
+					if err == nil {
+						err = p.SetRuntimeConfig(rc)
+					}
+					if err != nil {
+						rlog.Errorf("failed to apply remote configuration, keeping previous: %s", err)
+					}
+				})
+			})
+		}
+
+		g.Add(func(ctx context.Context) error {
+			return c.reloadOnSIGHUP(ctx, cmd, p, logger)
+		})
+
+		if c.socks5Config.Addr != "" {
+			s, err := forwarder.NewSOCKS5Server(c.socks5Config, p, logger.Named("socks5"))
+			if err != nil {
+				return fmt.Errorf("socks5: %w", err)
+			}
+			defer s.Close()
+			g.Add(s.Run)
+		}
+
+		if c.dnsForwarderConfig.Addr != "" {
+			if len(c.dnsForwarderConfig.Upstream) == 0 {
+				c.dnsForwarderConfig.Upstream = c.dnsConfig.Servers
+			}
+			f, err := forwarder.NewDNSForwarder(c.dnsForwarderConfig, p, logger.Named("dns-forwarder"))
+			if err != nil {
+				return fmt.Errorf("dns forwarder: %w", err)
+			}
+			defer f.Close()
+			g.Add(f.Run)
+		}
+
+		if c.transparentConfig.Addr != "" {
+			s, err := forwarder.NewTransparentServer(c.transparentConfig, p, logger.Named("transparent"))
+			if err != nil {
+				return fmt.Errorf("transparent: %w", err)
+			}
+			defer s.Close()
+			g.Add(s.Run)
+		}
+
+		if c.grpcAPIConfig.Addr != "" {
+			glog := logger.Named("grpc-api")
+			if c.grpcAPIConfig.BasicAuth == nil {
+				glog.Infof("gRPC admin API is not protected with basic auth, use --grpc-api-basic-auth to enable it")
+			}
+			srv := grpcapi.NewServer(p, c.regexpLimits, glog)
+			g.Add(func(ctx context.Context) error {
+				return grpcapi.Serve(ctx, c.grpcAPIConfig, srv, glog)
+			})
+		}
+
+		ep = append(ep, forwarder.APIEndpoint{
+			Path:    "/explain",
+			Handler: p.ExplainHandler(),
+		}, forwarder.APIEndpoint{
+			Path:    "/capabilities",
+			Handler: p.CapabilitiesHandler(),
+		})
+
+		if c.adminServerConfig.Addr != "" {
+			alog := logger.Named("admin")
+			if c.adminServerConfig.BasicAuth == nil {
+				alog.Infof("admin server is not protected with basic auth, use --admin-basic-auth to enable it")
+			}
+			a, err := forwarder.NewHTTPServer(c.adminServerConfig, forwarder.NewAdminHandler(p), alog)
+			if err != nil {
+				return fmt.Errorf("admin server: %w", err)
+			}
+			defer a.Close()
+			g.Add(a.Run)
+		}
+
+		if ca := p.MITMCACerts(); len(ca) > 0 {
 			ep = append(ep, forwarder.APIEndpoint{
 				Path:    "/cacert",
-				Handler: httphandler.SendCACert(ca),
+				Handler: httphandler.SendCACert(ca...),
+			}, forwarder.APIEndpoint{
+				Path:    "/cacert.der",
+				Handler: httphandler.SendCACertDER(ca[0]),
 			})
 		}
 	}
@@ -255,6 +659,116 @@ func (c *command) runE(cmd *cobra.Command, _ []string) (cmdErr error) {
 	return g.Run()
 }
 
+// reloadOnSIGHUP reloads the configuration from the environment variables and config file on SIGHUP.
+func (c *command) reloadOnSIGHUP(ctx context.Context, cmd *cobra.Command, p *forwarder.HTTPProxy, logger stdlog.Logger) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	rlog := logger.Named("reload")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ch:
+			rlog.Infof("received SIGHUP, reloading configuration")
+			if err := c.reload(cmd, p, logger); err != nil {
+				rlog.Errorf("failed to reload configuration, keeping previous: %s", err)
+			}
+		}
+	}
+}
+
+// reload applies the deny, direct and MITM domains, credentials, upstream proxy and HTTP log mode
+// from the environment variables and config file to the proxy.
+// Values set from the command line take precedence, and are not changed.
+func (c *command) reload(cmd *cobra.Command, p *forwarder.HTTPProxy, logger stdlog.Logger) error {
+	var (
+		sc                 = forwarder.DefaultHTTPProxyConfig().HTTPServerConfig
+		proxy              *url.URL
+		credentials        []*forwarder.HostPortUser
+		denyDomains        []ruleset.RegexpListItem
+		directDomains      []ruleset.RegexpListItem
+		mitmDomains        []ruleset.RegexpListItem
+		mitmExcludeDomains []ruleset.RegexpListItem
+	)
+
+	fs := pflag.NewFlagSet(cmd.Name(), pflag.ContinueOnError)
+	bind.HTTPServerConfig(fs, &sc, "", forwarder.HTTPScheme, forwarder.HTTPSScheme)
+	bind.UpstreamProxy(fs, &proxy)
+	bind.Credentials(fs, &credentials)
+	bind.DenyDomains(fs, &denyDomains)
+	bind.DirectDomains(fs, &directDomains)
+	bind.MITMDomains(fs, &mitmDomains)
+	bind.MITMExcludeDomains(fs, &mitmExcludeDomains)
+	if err := cobrautil.ReloadFlags(cmd, fs); err != nil {
+		return err
+	}
+
+	fromCommandLine := func(name string) bool {
+		return cobrautil.FromCommandLine(cmd.Flag(name))
+	}
+	if fromCommandLine("log-http") {
+		sc.LogHTTPMode = c.httpProxyConfig.LogHTTPMode
+	}
+	if fromCommandLine("proxy") {
+		proxy = c.httpProxyConfig.UpstreamProxy
+	}
+	if fromCommandLine("credentials") {
+		credentials = c.credentials
+	}
+	if fromCommandLine("deny-domains") {
+		denyDomains = c.denyDomains
+	}
+	if fromCommandLine("direct-domains") {
+		directDomains = c.directDomains
+	}
+	if fromCommandLine("mitm-domains") {
+		mitmDomains = c.mitmDomains
+	}
+	if fromCommandLine("mitm-exclude-domains") {
+		mitmExcludeDomains = c.mitmExcludeDomains
+	}
+
+	cfg := *c.httpProxyConfig
+	cfg.LogHTTPMode = sc.LogHTTPMode
+	cfg.UpstreamProxy = proxy
+
+	var err error
+	if cfg.DenyDomains, err = c.regexpMatcher(denyDomains); err != nil {
+		return fmt.Errorf("deny domains: %w", err)
+	}
+	if cfg.DirectDomains, err = c.regexpMatcher(directDomains); err != nil {
+		return fmt.Errorf("direct domains: %w", err)
+	}
+	if cfg.MITMDomains, err = c.regexpMatcher(mitmDomains); err != nil {
+		return fmt.Errorf("mitm domains: %w", err)
+	}
+	if cfg.MITMExcludeDomains, err = c.regexpMatcher(mitmExcludeDomains); err != nil {
+		return fmt.Errorf("mitm exclude domains: %w", err)
+	}
+
+	cm, err := forwarder.NewCredentialsMatcher(credentials, logger.Named("credentials"))
+	if err != nil {
+		return fmt.Errorf("credentials: %w", err)
+	}
+
+	if err := p.Reload(&cfg); err != nil {
+		return err
+	}
+
+	return p.UpdateRuntimeConfig(func(rc *forwarder.RuntimeConfig) {
+		rc.Credentials = cm
+	})
+}
+
+func (c *command) regexpMatcher(items []ruleset.RegexpListItem) (*ruleset.RegexpMatcher, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return c.regexpLimits.NewRegexpMatcherFromList(items)
+}
+
 func (c *command) registerProcMetrics() error {
 	return multierr.Combine(
 		// Note that ProcessCollector is only available in Linux and Windows.
@@ -269,13 +783,39 @@ func Command() *cobra.Command {
 		promReg:             prometheus.NewRegistry(),
 		dnsConfig:           osdns.DefaultConfig(),
 		httpTransportConfig: forwarder.DefaultHTTPTransportConfig(),
+		dnsDiscoveryConfig:  forwarder.DefaultDNSDiscoveryConfig(),
+		k8sDiscoveryConfig:  forwarder.DefaultKubernetesDiscoveryConfig(),
+		xdsConfig:           forwarder.DefaultXDSConfig(),
+		remoteConfig:        remoteconfig.DefaultConfig(),
+		journalConfig:       journal.DefaultConfig(),
+		hstsConfig:          hsts.DefaultConfig(),
+		latencyConfig:       forwarder.DefaultLatencySelectorConfig(),
+		socks5Config:        forwarder.DefaultSOCKS5ServerConfig(),
+		dnsForwarderConfig:  forwarder.DefaultDNSForwarderConfig(),
+		upstreamTLSConfig:   forwarder.DefaultUpstreamProxyTLSConfig(),
+		transparentConfig:   forwarder.DefaultTransparentServerConfig(),
+		statsConfig:         stats.DefaultConfig(),
 		httpProxyConfig:     forwarder.DefaultHTTPProxyConfig(),
+		jwtAuthConfig:       forwarder.DefaultJWTAuthConfig(),
+		bypassConfig:        forwarder.DefaultBypassConfig(),
+		timeoutHeaderConfig: forwarder.DefaultTimeoutHeaderConfig(),
+		hedgingConfig:       forwarder.DefaultHedgingConfig(),
+		priorityConfig:      forwarder.DefaultPriorityConfig(),
+		privacyConfig:       forwarder.DefaultPrivacyConfig(),
+		regexpLimits:        ruleset.DefaultRegexpLimits(),
 		mitmConfig:          forwarder.DefaultMITMConfig(),
+		mitmDecisionConfig:  forwarder.DefaultMITMDecisionConfig(),
+		connectUDPConfig:    forwarder.DefaultConnectUDPConfig(),
+		slowClientConfig:    forwarder.DefaultSlowClientConfig(),
+		loadSheddingConfig:  forwarder.DefaultLoadSheddingConfig(),
 		apiServerConfig:     forwarder.DefaultHTTPServerConfig(),
+		adminServerConfig:   forwarder.DefaultHTTPServerConfig(),
+		grpcAPIConfig:       grpcapi.DefaultServerConfig(),
 		logConfig:           log.DefaultConfig(),
 	}
 	c.httpProxyConfig.PromRegistry = c.promReg
 	c.apiServerConfig.Addr = "localhost:10000"
+	c.adminServerConfig.Addr = ""
 
 	cmd := &cobra.Command{
 		Use:     "run [--address <host:port>] [--pac <path or url>] [--credentials <username:password@host:port>]...",
@@ -287,21 +827,61 @@ func Command() *cobra.Command {
 
 	fs := cmd.Flags()
 	bind.DNSConfig(fs, c.dnsConfig)
+	bind.DNSRoutes(fs, &c.dnsRoutes)
+	bind.DNSClientSubnet(fs, &c.httpTransportConfig.DNSClientSubnet)
 	bind.HTTPTransportConfig(fs, c.httpTransportConfig)
 	bind.PAC(fs, &c.pac)
+	bind.DNSDiscoveryConfig(fs, c.dnsDiscoveryConfig)
+	bind.KubernetesDiscoveryConfig(fs, c.k8sDiscoveryConfig)
+	bind.LatencySelectorConfig(fs, &c.latencySelection, c.latencyConfig)
+	bind.XDSConfig(fs, c.xdsConfig)
+	bind.RemoteConfig(fs, c.remoteConfig)
+	bind.GRPCAPIConfig(fs, c.grpcAPIConfig)
+	bind.SOCKS5ServerConfig(fs, c.socks5Config)
+	bind.DNSForwarderConfig(fs, c.dnsForwarderConfig)
+	bind.TransparentServerConfig(fs, c.transparentConfig)
+	bind.JournalConfig(fs, c.journalConfig)
+	bind.HSTSConfig(fs, &c.hsts, c.hstsConfig)
+	bind.StatsConfig(fs, c.statsConfig)
+	bind.Metadata(fs, &c.httpProxyConfig.MetadataHeaders, &c.httpProxyConfig.MetadataMaxValues, &c.httpProxyConfig.TrustChainMetadata)
 	bind.Credentials(fs, &c.credentials)
 	bind.DenyDomains(fs, &c.denyDomains)
+	bind.BlockLists(fs, &c.blockLists)
 	bind.DirectDomains(fs, &c.directDomains)
+	bind.UserPolicies(fs, &c.userPolicies)
+	bind.UserPolicyFile(fs, &c.userPolicyFile)
+	bind.SNIRoutes(fs, &c.sniRoutes)
 	bind.ProxyHeaders(fs, &c.proxyHeaders)
 	bind.RequestHeaders(fs, &c.requestHeaders)
 	bind.ResponseHeaders(fs, &c.responseHeaders)
+	bind.ConnectResponseHeaders(fs, &c.httpProxyConfig.ConnectResponseHeaders)
 	bind.HTTPProxyConfig(fs, c.httpProxyConfig, c.logConfig)
+	bind.UpstreamProxyTLSConfig(fs, c.upstreamTLSConfig)
+	bind.JWTAuthConfig(fs, c.jwtAuthConfig)
+	bind.AuthAllowIPs(fs, &c.authAllowIPs)
+	bind.BypassConfig(fs, c.bypassConfig)
+	bind.TimeoutHeaderConfig(fs, c.timeoutHeaderConfig)
 	bind.MITMConfig(fs, &c.mitm, c.mitmConfig)
 	bind.MITMDomains(fs, &c.mitmDomains)
+	bind.MITMExcludeDomains(fs, &c.mitmExcludeDomains)
+	bind.OriginTLSRules(fs, &c.httpProxyConfig.OriginTLSRules)
+	bind.SyntheticEndpoints(fs, &c.httpProxyConfig.SyntheticEndpoints)
+	bind.MITMDecisionConfig(fs, &c.mitmDecisionURL, c.mitmDecisionConfig)
+	bind.ConnectUDPConfig(fs, &c.connectUDP, c.connectUDPConfig)
+	bind.SecurityHeaders(fs, &c.securityHeaders)
+	bind.ResponseValidation(fs, &c.responseValidation)
+	bind.IntegrityDomains(fs, &c.integrityDomains)
+	bind.PrivacyConfig(fs, &c.privacyDomains, c.privacyConfig)
+	bind.RegexpLimits(fs, c.regexpLimits)
+	bind.HedgingConfig(fs, c.hedgingConfig)
+	bind.SlowClientConfig(fs, c.slowClientConfig)
+	bind.LoadSheddingConfig(fs, &c.loadShedding, c.loadSheddingConfig)
+	bind.PriorityConfig(fs, c.priorityConfig)
 	bind.HTTPServerConfig(fs, c.apiServerConfig, "api", forwarder.HTTPScheme)
+	bind.HTTPServerConfig(fs, c.adminServerConfig, "admin", forwarder.HTTPScheme, forwarder.HTTPSScheme)
 	bind.PromNamespace(fs, &c.httpProxyConfig.PromNamespace)
 	bind.AutoMarkFlagFilename(cmd)
-	cmd.MarkFlagsMutuallyExclusive("proxy", "pac")
+	cmd.MarkFlagsMutuallyExclusive("proxy", "pac", "proxy-dns-discovery", "proxy-k8s-service", "xds-server")
 
 	fs.BoolVar(&c.goleak, "goleak", false, "enable goleak")
 	bind.MarkFlagHidden(cmd, "goleak")
@@ -313,6 +893,9 @@ const long = `Start HTTP (forward) proxy server.
 You can start HTTP or HTTPS server.
 If you start an HTTPS server and you don't provide a certificate, the server will generate a self-signed certificate on startup.
 The server may be protected by basic authentication.
+On SIGHUP, the deny, direct and MITM domains, credentials, upstream proxy and HTTP log mode are reloaded
+from the environment variables and config file, values set with command line flags are not changed.
+Established CONNECT tunnels are not affected by the reload.
 `
 
 const example = `  # HTTP proxy with upstream proxy
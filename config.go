@@ -78,6 +78,8 @@ func ParseHostPortUser(val string) (*HostPortUser, error) {
 		return nil, err
 	}
 
+	hp, opts, _ := strings.Cut(hp, ";")
+
 	u, err := url.Parse("http://" + wildcardPortTo0(hp))
 	if err != nil {
 		return nil, err
@@ -88,6 +90,9 @@ func ParseHostPortUser(val string) (*HostPortUser, error) {
 		Port:     u.Port(),
 		Userinfo: ui,
 	}
+	if err := parseHostPortUserOptions(hpi, opts); err != nil {
+		return nil, err
+	}
 	if err := hpi.Validate(); err != nil {
 		return nil, err
 	}
@@ -95,6 +100,32 @@ func ParseHostPortUser(val string) (*HostPortUser, error) {
 	return hpi, nil
 }
 
+// parseHostPortUserOptions parses semicolon separated options: priority=<int> and scope=proxy|origin.
+func parseHostPortUserOptions(hpu *HostPortUser, opts string) error {
+	if opts == "" {
+		return nil
+	}
+	for _, opt := range strings.Split(opts, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(opt), "=")
+		if !ok {
+			return fmt.Errorf("invalid option %q, expected key=value", opt)
+		}
+		switch k {
+		case "priority":
+			p, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid priority %q: %w", v, err)
+			}
+			hpu.Priority = p
+		case "scope":
+			hpu.Scope = CredentialsScope(v)
+		default:
+			return fmt.Errorf("unknown option %q", k)
+		}
+	}
+	return nil
+}
+
 func ParseProxyURL(val string) (*url.URL, error) {
 	scheme, hpu, ok := strings.Cut(val, "://")
 	if !ok {
@@ -0,0 +1,30 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+
+	"github.com/saucelabs/forwarder/header"
+)
+
+// connectResponseHeaders applies headers to responses to CONNECT requests,
+// both 200 Connection Established and error responses.
+type connectResponseHeaders []header.Header
+
+func (h connectResponseHeaders) ModifyResponse(res *http.Response) error {
+	if res.Request == nil || res.Request.Method != http.MethodConnect {
+		return nil
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	for i := range h {
+		h[i].Apply(res.Header)
+	}
+	return nil
+}
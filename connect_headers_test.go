@@ -0,0 +1,88 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/saucelabs/forwarder/header"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestConnectResponseHeaders(t *testing.T) {
+	deny, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^denied\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := header.ParseHeader("X-Route: direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DenyDomains = deny
+	cfg.ConnectResponseHeaders = []header.Header{h}
+	cfg.TestHooks = &TestHooks{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			c, s := net.Pipe()
+			t.Cleanup(func() { s.Close() })
+			return c, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"example.com:443", http.StatusOK},
+		{"denied.com:443", http.StatusForbidden},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.host, func(t *testing.T) {
+			conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req, err := http.NewRequest(http.MethodConnect, "http://"+tc.host, http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = tc.host
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, res.StatusCode)
+			}
+			if v := res.Header.Get("X-Route"); v != "direct" {
+				t.Fatalf("expected X-Route direct, got %q", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+)
+
+// ConnectUDPConfig enables CONNECT-UDP over HTTP/1.1, proxying UDP with the upgrade specified in RFC 9298.
+// Datagrams are sent in DATAGRAM capsules (RFC 9297).
+type ConnectUDPConfig struct {
+	// IdleTimeout is the time after which a tunnel without traffic in either direction is closed.
+	IdleTimeout time.Duration
+}
+
+func DefaultConnectUDPConfig() *ConnectUDPConfig {
+	return &ConnectUDPConfig{
+		IdleTimeout: 2 * time.Minute,
+	}
+}
+
+func (c *ConnectUDPConfig) Validate() error {
+	if c.IdleTimeout <= 0 {
+		return fmt.Errorf("idle timeout must be positive")
+	}
+	return nil
+}
+
+const (
+	connectUDPUpgrade = "connect-udp"
+	connectUDPPrefix  = "/.well-known/masque/udp/"
+
+	capsuleDatagram = 0x00
+
+	// maxUDPPayload is the maximal size of UDP payload over IPv4 and IPv6.
+	maxUDPPayload = 65527
+)
+
+// connectUDPTarget returns the target of a CONNECT-UDP request using the default URI template
+// https://$PROXY_HOST:$PROXY_PORT/.well-known/masque/udp/{target_host}/{target_port}/.
+// It returns false if the request is not a CONNECT-UDP request, and an error if the request is malformed.
+func connectUDPTarget(req *http.Request) (string, bool, error) {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), connectUDPUpgrade) {
+		return "", false, nil
+	}
+	if req.Method != http.MethodGet {
+		return "", true, fmt.Errorf("unsupported method %s", req.Method)
+	}
+
+	p, ok := strings.CutPrefix(req.URL.EscapedPath(), connectUDPPrefix)
+	if !ok {
+		return "", true, fmt.Errorf("unsupported path %s", req.URL.EscapedPath())
+	}
+	parts := strings.Split(strings.TrimSuffix(p, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", true, fmt.Errorf("unsupported path %s", req.URL.EscapedPath())
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", true, fmt.Errorf("target host: %w", err)
+	}
+	port, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return "", true, fmt.Errorf("target port: %w", err)
+	}
+
+	return net.JoinHostPort(host, port), true, nil
+}
+
+// connectUDP handles CONNECT-UDP requests, the connection is hijacked for the lifetime of the tunnel.
+// The target is checked against deny domains and localhost policy.
+func (hp *HTTPProxy) connectUDP() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		target, ok, err := connectUDPTarget(req)
+		if !ok {
+			return nil
+		}
+		if err != nil {
+			hp.abort(req, proxyutil.NewResponse(http.StatusBadRequest, http.NoBody, req))
+			return fmt.Errorf("connect-udp: %w", err)
+		}
+
+		treq := req.Clone(req.Context())
+		treq.URL = &url.URL{Scheme: "https", Host: target}
+		if err := hp.hostDenied(treq); err != nil {
+			hp.abort(req, hp.errorResponse(treq, err))
+			return fmt.Errorf("connect-udp: %w", err)
+		}
+
+		uc, err := hp.dialUDP(req.Context(), target)
+		if err != nil {
+			hp.abort(req, hp.errorResponse(treq, err))
+			return fmt.Errorf("connect-udp: %w", err)
+		}
+		defer uc.Close()
+
+		conn, brw, err := martian.NewContext(req).Session().Hijack()
+		if err != nil {
+			return fmt.Errorf("connect-udp: %w", err)
+		}
+		conn.SetDeadline(time.Time{}) //nolint:errcheck // the connection is closed on error
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Upgrade: " + connectUDPUpgrade + "\r\n" +
+			"Capsule-Protocol: ?1\r\n\r\n")
+		if err := brw.Flush(); err != nil {
+			return fmt.Errorf("connect-udp: %w", err)
+		}
+
+		hp.log.Debugf("connect-udp tunnel to %s for %s established", target, req.RemoteAddr)
+		err = relayConnectUDP(conn, brw, uc, hp.config.ConnectUDP.IdleTimeout)
+		hp.log.Debugf("connect-udp tunnel to %s for %s closed: %v", target, req.RemoteAddr, err)
+
+		return nil
+	})
+}
+
+func (hp *HTTPProxy) dialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if tr, ok := hp.transport.(*http.Transport); ok && tr.DialContext != nil {
+		return tr.DialContext(ctx, "udp", addr)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "udp", addr)
+}
+
+// relayConnectUDP copies datagrams between the capsule stream and the UDP socket until either side fails,
+// or there is no traffic for the idle timeout.
+func relayConnectUDP(conn net.Conn, brw *bufio.ReadWriter, uc net.Conn, idle time.Duration) error {
+	var last atomic.Int64
+	touch := func() {
+		last.Store(time.Now().UnixNano())
+	}
+	touch()
+
+	errc := make(chan error, 2)
+
+	// Client to target.
+	go func() {
+		for {
+			typ, payload, err := readCapsule(brw.Reader)
+			if err != nil {
+				errc <- err
+				return
+			}
+			touch()
+			if typ != capsuleDatagram {
+				continue // Unknown capsules are ignored.
+			}
+			data, ok := datagramPayload(payload)
+			if !ok {
+				continue // Datagrams with unknown context IDs are dropped.
+			}
+			if _, err := uc.Write(data); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	// Target to client.
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			uc.SetReadDeadline(time.Now().Add(idle)) //nolint:errcheck // read fails if the deadline cannot be set
+			n, err := uc.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Since(time.Unix(0, last.Load())) < idle {
+					continue
+				}
+				err = fmt.Errorf("idle timeout")
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			touch()
+
+			err = writeDatagramCapsule(brw.Writer, buf[:n])
+			if err == nil {
+				err = brw.Flush()
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	err := <-errc
+	// Unblock the other direction.
+	conn.SetReadDeadline(time.Now()) //nolint:errcheck // best effort
+	uc.Close()
+	<-errc
+
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+// readCapsule reads a capsule (RFC 9297): type and length as QUIC variable-length integers followed by the value.
+func readCapsule(r *bufio.Reader) (typ uint64, value []byte, err error) {
+	typ, err = readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > maxUDPPayload+8 {
+		return 0, nil, fmt.Errorf("capsule too large: %d bytes", n)
+	}
+	value = make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return typ, value, nil
+}
+
+// datagramPayload returns the UDP payload of HTTP datagram with context ID 0.
+func datagramPayload(b []byte) ([]byte, bool) {
+	id, err := readVarint(bytes.NewReader(b))
+	if err != nil || id != 0 {
+		return nil, false
+	}
+	return b[varintLen(id):], true
+}
+
+func writeDatagramCapsule(w io.Writer, data []byte) error {
+	b := make([]byte, 0, len(data)+16)
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(data)+1))
+	b = appendVarint(b, 0) // Context ID.
+	b = append(b, data...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000, Section 16).
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (b >> 6)
+	v := uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func varintLen(v uint64) int {
+	switch {
+	case v <= 63:
+		return 1
+	case v <= 16383:
+		return 2
+	case v <= 1073741823:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch varintLen(v) {
+	case 1:
+		return append(b, byte(v))
+	case 2:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case 4:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
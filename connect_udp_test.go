@@ -0,0 +1,186 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint64{0, 37, 63, 64, 15293, 16383, 16384, 494878333, 1073741823, 1073741824, 151288809941952652} {
+		b := appendVarint(nil, v)
+		if len(b) != varintLen(v) {
+			t.Fatalf("%d: expected %d bytes, got %d", v, varintLen(v), len(b))
+		}
+		got, err := readVarint(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v {
+			t.Fatalf("expected %d, got %d", v, got)
+		}
+	}
+
+	// Examples from RFC 9000, Appendix A.1.
+	if v, _ := readVarint(bytes.NewReader([]byte{0x7b, 0xbd})); v != 15293 {
+		t.Fatalf("expected 15293, got %d", v)
+	}
+	if v, _ := readVarint(bytes.NewReader([]byte{0x9d, 0x7f, 0x3e, 0x7d})); v != 494878333 {
+		t.Fatalf("expected 494878333, got %d", v)
+	}
+}
+
+func TestConnectUDPTarget(t *testing.T) {
+	tests := []struct {
+		method, path, upgrade string
+		target                string
+		ok, err               bool
+	}{
+		{http.MethodGet, "/.well-known/masque/udp/example.com/53/", "connect-udp", "example.com:53", true, false},
+		{http.MethodGet, "/.well-known/masque/udp/2001%3Adb8%3A%3A1/443/", "connect-udp", "[2001:db8::1]:443", true, false},
+		{http.MethodGet, "/.well-known/masque/udp/example.com/53/", "websocket", "", false, false},
+		{http.MethodGet, "/.well-known/masque/udp/example.com/", "connect-udp", "", true, true},
+		{http.MethodGet, "/foo/example.com/53/", "connect-udp", "", true, true},
+		{http.MethodPost, "/.well-known/masque/udp/example.com/53/", "connect-udp", "", true, true},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, "http://proxy"+tc.path, http.NoBody)
+		req.Header.Set("Upgrade", tc.upgrade)
+		target, ok, err := connectUDPTarget(req)
+		if ok != tc.ok || (err != nil) != tc.err || target != tc.target {
+			t.Errorf("%s %s %s: got %q %v %v", tc.method, tc.path, tc.upgrade, target, ok, err)
+		}
+	}
+}
+
+func TestConnectUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr) //nolint:errcheck // test
+		}
+	}()
+	port := strconv.Itoa(echo.LocalAddr().(*net.UDPAddr).Port) //nolint:forcetypeassert // UDP listener
+
+	newProxy := func(t *testing.T, localhost ProxyLocalhostMode, blockList ...string) *HTTPProxy {
+		t.Helper()
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ConnectUDP = DefaultConnectUDPConfig()
+		cfg.ProxyLocalhost = localhost
+		if len(blockList) > 0 {
+			m, err := ruleset.NewAdblockMatcher(strings.NewReader(strings.Join(blockList, "\n")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.BlockList = m
+		}
+		p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	connect := func(t *testing.T, p *HTTPProxy) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://in-memory/.well-known/masque/udp/127.0.0.1/"+port+"/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "connect-udp")
+		req.Header.Set("Capsule-Protocol", "?1")
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, res
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		p := newProxy(t, AllowProxyLocalhost)
+		defer p.Close()
+
+		conn, br, res := connect(t, p)
+		defer conn.Close()
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("expected status %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+		}
+
+		for _, msg := range []string{"hello", "world"} {
+			if err := writeDatagramCapsule(conn, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+			typ, payload, err := readCapsule(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != capsuleDatagram {
+				t.Fatalf("expected datagram capsule, got %d", typ)
+			}
+			data, ok := datagramPayload(payload)
+			if !ok || string(data) != msg {
+				t.Fatalf("expected %q, got %q", msg, data)
+			}
+		}
+	})
+
+	t.Run("localhost denied", func(t *testing.T) {
+		p := newProxy(t, DenyProxyLocalhost)
+		defer p.Close()
+
+		conn, _, res := connect(t, p)
+		defer conn.Close()
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			t.Fatal("expected tunnel to be denied")
+		}
+		if v := res.Header.Get(DeniedByHeader); v != "proxy-localhost" {
+			t.Fatalf("expected %s header proxy-localhost, got %q", DeniedByHeader, v)
+		}
+	})
+	t.Run("block list", func(t *testing.T) {
+		p := newProxy(t, AllowProxyLocalhost, "||127.0.0.1^")
+		defer p.Close()
+
+		conn, _, res := connect(t, p)
+		defer conn.Close()
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			t.Fatal("expected tunnel to be blocked")
+		}
+		if v := res.Header.Get(DeniedByHeader); v != "block-list" {
+			t.Fatalf("expected %s header block-list, got %q", DeniedByHeader, v)
+		}
+	})
+}
@@ -10,14 +10,48 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
+	"strconv"
 
 	"github.com/saucelabs/forwarder/log"
 )
 
+// CredentialsScope restricts credentials to authentication with upstream proxies or origin servers.
+type CredentialsScope string
+
+const (
+	// AnyCredentialsScope credentials are used for both upstream proxies and origin servers.
+	AnyCredentialsScope    CredentialsScope = ""
+	ProxyCredentialsScope  CredentialsScope = "proxy"
+	OriginCredentialsScope CredentialsScope = "origin"
+)
+
+func (s CredentialsScope) isValid() bool {
+	switch s {
+	case AnyCredentialsScope, ProxyCredentialsScope, OriginCredentialsScope:
+		return true
+	default:
+		return false
+	}
+}
+
+// allows returns true if credentials with scope s can be used for scope q,
+// AnyCredentialsScope query matches credentials of all scopes.
+func (s CredentialsScope) allows(q CredentialsScope) bool {
+	return s == AnyCredentialsScope || q == AnyCredentialsScope || s == q
+}
+
 type HostPortUser struct {
 	Host string
 	Port string
 	*url.Userinfo
+
+	// Priority orders overlapping entries, entries with higher priority are matched first.
+	// Entries with equal priority are ordered by specificity: host and port, port, host, global wildcard.
+	Priority int
+
+	// Scope restricts the entry to upstream proxies or origin servers, by default it applies to both.
+	Scope CredentialsScope
 }
 
 func (hpu *HostPortUser) Validate() error {
@@ -30,6 +64,9 @@ func (hpu *HostPortUser) Validate() error {
 	if hpu.Userinfo == nil {
 		return fmt.Errorf("missing user")
 	}
+	if !hpu.Scope.isValid() {
+		return fmt.Errorf("unsupported scope: %s", hpu.Scope)
+	}
 	return validatedUserInfo(hpu.Userinfo)
 }
 
@@ -45,10 +82,21 @@ func (hpu *HostPortUser) String() string {
 
 	p, ok := hpu.Password()
 	if !ok {
-		return fmt.Sprintf("%s@%s:%s", hpu.Username(), hpu.Host, port)
+		return fmt.Sprintf("%s@%s:%s", hpu.Username(), hpu.Host, port) + hpu.options()
 	}
 
-	return fmt.Sprintf("%s:%s@%s:%s", hpu.Username(), p, hpu.Host, port)
+	return fmt.Sprintf("%s:%s@%s:%s", hpu.Username(), p, hpu.Host, port) + hpu.options()
+}
+
+func (hpu *HostPortUser) options() string {
+	var s string
+	if hpu.Scope != AnyCredentialsScope {
+		s += ";scope=" + string(hpu.Scope)
+	}
+	if hpu.Priority != 0 {
+		s += ";priority=" + strconv.Itoa(hpu.Priority)
+	}
+	return s
 }
 
 func RedactHostPortUser(hpu *HostPortUser) string {
@@ -62,18 +110,35 @@ func RedactHostPortUser(hpu *HostPortUser) string {
 	}
 
 	if _, ok := hpu.Password(); !ok {
-		return fmt.Sprintf("%s@%s:%s", hpu.Username(), hpu.Host, port)
+		return fmt.Sprintf("%s@%s:%s", hpu.Username(), hpu.Host, port) + hpu.options()
+	}
+
+	return fmt.Sprintf("%s:xxxxx@%s:%s", hpu.Username(), hpu.Host, port) + hpu.options()
+}
+
+// specificity returns the default precedence of the entry: host and port, port, host, global wildcard.
+func (hpu *HostPortUser) specificity() int {
+	switch {
+	case hpu.Host == "*" && hpu.Port == "0":
+		return 0
+	case hpu.Port == "0":
+		return 1
+	case hpu.Host == "*":
+		return 2
+	default:
+		return 3
 	}
+}
 
-	return fmt.Sprintf("%s:xxxxx@%s:%s", hpu.Username(), hpu.Host, port)
+func (hpu *HostPortUser) match(host, port string) bool {
+	return (hpu.Host == "*" || hpu.Host == host) && (hpu.Port == "0" || hpu.Port == port)
 }
 
+// CredentialsMatcher selects credentials for upstream proxies and origin servers by host and port.
 type CredentialsMatcher struct {
-	hostport map[string]*url.Userinfo
-	host     map[string]*url.Userinfo
-	port     map[string]*url.Userinfo
-	global   *url.Userinfo
-	log      log.Logger
+	// entries are sorted by priority and specificity, the first matching entry is used.
+	entries []*HostPortUser
+	log     log.Logger
 }
 
 func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*CredentialsMatcher, error) {
@@ -82,11 +147,16 @@ func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*Creden
 	}
 
 	m := &CredentialsMatcher{
-		hostport: make(map[string]*url.Userinfo),
-		host:     make(map[string]*url.Userinfo),
-		port:     make(map[string]*url.Userinfo),
-		log:      log,
+		entries: make([]*HostPortUser, 0, len(credentials)),
+		log:     log,
+	}
+
+	type key struct {
+		host, port string
+		scope      CredentialsScope
+		priority   int
 	}
+	seen := make(map[key]struct{}, len(credentials))
 
 	for i, hpu := range credentials {
 		withRowInfo := func(err error) error {
@@ -97,41 +167,30 @@ func NewCredentialsMatcher(credentials []*HostPortUser, log log.Logger) (*Creden
 			return nil, withRowInfo(err)
 		}
 
-		switch {
-		case hpu.Host == "*" && hpu.Port == "0":
-			if m.global != nil {
-				return nil, withRowInfo(fmt.Errorf("duplicate global input"))
-			}
-			m.global = hpu.Userinfo
-		case hpu.Host == "*":
-			if _, ok := m.port[hpu.Port]; ok {
-				return nil, withRowInfo(fmt.Errorf("duplicate wildcard host with port %s credentis", hpu.Port))
-			}
-			m.port[hpu.Port] = hpu.Userinfo
-		case hpu.Port == "0":
-			if _, ok := m.host[hpu.Host]; ok {
-				return nil, withRowInfo(fmt.Errorf("duplicate wildcard port with host %s credentis", hpu.Host))
-			}
-			m.host[hpu.Host] = hpu.Userinfo
-		default:
-			hostport := net.JoinHostPort(hpu.Host, hpu.Port)
-			if _, ok := m.hostport[hostport]; ok {
-				return nil, fmt.Errorf("duplicate input")
-			}
-			m.hostport[hostport] = hpu.Userinfo
+		k := key{hpu.Host, hpu.Port, hpu.Scope, hpu.Priority}
+		if _, ok := seen[k]; ok {
+			return nil, withRowInfo(fmt.Errorf("duplicate credentials for %s", RedactHostPortUser(hpu)))
 		}
+		seen[k] = struct{}{}
+
+		m.entries = append(m.entries, hpu)
 	}
 
+	sort.SliceStable(m.entries, func(i, j int) bool {
+		a, b := m.entries[i], m.entries[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.specificity() > b.specificity()
+	})
+
 	return m, nil
 }
 
-// MatchURL adds standard http and https ports if they are missing in URL and calls Match function.
-func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
-	if m == nil || u == nil {
-		return nil
-	}
-
+// urlHostPort adds standard http, https and ftp ports if they are missing in URL.
+func (m *CredentialsMatcher) urlHostPort(u *url.URL) (string, bool) {
 	const (
+		ftpPort   = 21
 		httpPort  = 80
 		httpsPort = 443
 	)
@@ -143,51 +202,110 @@ func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
 			hostport = fmt.Sprintf("%s:%d", u.Host, httpPort)
 		case "https":
 			hostport = fmt.Sprintf("%s:%d", u.Host, httpsPort)
+		case "ftp":
+			hostport = fmt.Sprintf("%s:%d", u.Host, ftpPort)
 		default:
 			m.log.Errorf("cannot to determine port for %s", u.Redacted())
-			return nil
+			return "", false
 		}
 	}
 
-	return m.Match(hostport)
+	return hostport, true
+}
+
+// MatchURL adds standard http and https ports if they are missing in URL and calls Match function.
+// Entries of all scopes are considered, see MatchURLScope.
+func (m *CredentialsMatcher) MatchURL(u *url.URL) *url.Userinfo {
+	return m.MatchURLScope(u, AnyCredentialsScope)
+}
+
+// MatchURLScope is like MatchURL but only entries allowed for the scope are considered.
+func (m *CredentialsMatcher) MatchURLScope(u *url.URL, scope CredentialsScope) *url.Userinfo {
+	if m == nil || u == nil {
+		return nil
+	}
+
+	hostport, ok := m.urlHostPort(u)
+	if !ok {
+		return nil
+	}
+
+	return m.MatchScope(hostport, scope)
 }
 
 // Match `hostport` to one of the configured input.
-// Priority is exact Match, then host, then port, then global wildcard.
+// Priority is explicit entry priority, then exact Match, then host wildcard, then port wildcard, then global wildcard.
 func (m *CredentialsMatcher) Match(hostport string) *url.Userinfo {
+	return m.MatchScope(hostport, AnyCredentialsScope)
+}
+
+// MatchScope is like Match but only entries allowed for the scope are considered.
+func (m *CredentialsMatcher) MatchScope(hostport string, scope CredentialsScope) *url.Userinfo {
 	if m == nil {
 		return nil
 	}
 
-	if u, ok := m.hostport[hostport]; ok {
-		m.log.Debugf(hostport)
-		return u
-	}
-
 	host, port, err := net.SplitHostPort(hostport)
 	if err != nil {
 		m.log.Infof("invalid hostport %s", hostport)
 		return nil
 	}
 
-	// Host wildcard - check the port only.
-	if u, ok := m.port[port]; ok {
-		m.log.Debugf("host=* port=%s", port)
-		return u
+	for _, e := range m.entries {
+		if e.Scope.allows(scope) && e.match(host, port) {
+			m.log.Debugf("%s matched %s", hostport, RedactHostPortUser(e))
+			return e.Userinfo
+		}
+	}
+
+	return nil
+}
+
+// CredentialsMatch describes which credentials entry supplies credentials for a URL.
+// It is intended for debugging overlapping entries.
+type CredentialsMatch struct {
+	// Entry is the matching entry with the password redacted.
+	Entry string `json:"entry"`
+
+	// Shadowed are the entries that also match the URL, but are not used due to lower priority or specificity.
+	Shadowed []string `json:"shadowed,omitempty"`
+
+	// Skipped are the entries matching the host and port that are not allowed for the scope.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Trace returns the entries matching the URL for the scope, or nil if no entry matches.
+func (m *CredentialsMatcher) Trace(u *url.URL, scope CredentialsScope) *CredentialsMatch {
+	if m == nil || u == nil {
+		return nil
 	}
 
-	// Port wildcard - check the host only.
-	if u, ok := m.host[host]; ok {
-		m.log.Debugf("host=%s port=*", host)
-		return u
+	hostport, ok := m.urlHostPort(u)
+	if !ok {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil
 	}
 
-	// Log whether the global wildcard is set.
-	// This is a very esoteric use case. It's only added to support a legacy implementation.
-	if m.global != nil {
-		m.log.Debugf("global wildcard")
-		return m.global
+	var cm CredentialsMatch
+	for _, e := range m.entries {
+		if !e.match(host, port) {
+			continue
+		}
+		switch {
+		case !e.Scope.allows(scope):
+			cm.Skipped = append(cm.Skipped, RedactHostPortUser(e))
+		case cm.Entry == "":
+			cm.Entry = RedactHostPortUser(e)
+		default:
+			cm.Shadowed = append(cm.Shadowed, RedactHostPortUser(e))
+		}
+	}
+	if cm.Entry == "" {
+		return nil
 	}
 
-	return nil
+	return &cm
 }
@@ -82,3 +82,85 @@ func TestUserInfoMatcherMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestCredentialsMatcherPriorityScope(t *testing.T) {
+	input := []string{
+		"proxy:pass@abc:80;scope=proxy",
+		"origin:pass@abc:80;scope=origin",
+		"any:pass@*:80",
+		"prio:pass@*:0;priority=10;scope=origin",
+	}
+
+	credentials := make([]*HostPortUser, len(input))
+	for i := range input {
+		var err error
+		credentials[i], err = ParseHostPortUser(input[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := NewCredentialsMatcher(credentials, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		scope    CredentialsScope
+		expected string
+	}{
+		{name: "proxy scope", url: "http://abc", scope: ProxyCredentialsScope, expected: "proxy"},
+		{name: "origin scope priority", url: "http://abc", scope: OriginCredentialsScope, expected: "prio"},
+		{name: "proxy scope wildcard", url: "http://xxx", scope: ProxyCredentialsScope, expected: "any"},
+		{name: "origin scope wildcard", url: "https://xxx", scope: OriginCredentialsScope, expected: "prio"},
+		{name: "no match", url: "https://xxx", scope: ProxyCredentialsScope},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.MatchURLScope(u, tc.scope).Username(); got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("trace", func(t *testing.T) {
+		tr := m.Trace(&url.URL{Scheme: "http", Host: "abc"}, OriginCredentialsScope)
+		if tr == nil {
+			t.Fatal("expected match")
+		}
+		if tr.Entry != "prio:xxxxx@*:*;scope=origin;priority=10" {
+			t.Fatalf("unexpected entry: %s", tr.Entry)
+		}
+		if len(tr.Shadowed) != 2 || len(tr.Skipped) != 1 {
+			t.Fatalf("unexpected trace: %+v", tr)
+		}
+	})
+}
+
+func TestParseHostPortUserOptions(t *testing.T) {
+	for _, val := range []string{
+		"user:pass@abc:80;scope=foo",
+		"user:pass@abc:80;priority=x",
+		"user:pass@abc:80;foo=bar",
+		"user:pass@abc:80;scope",
+	} {
+		if _, err := ParseHostPortUser(val); err == nil {
+			t.Errorf("%s: expected error", val)
+		}
+	}
+
+	hpu, err := ParseHostPortUser("user:pass@abc:*;priority=-1;scope=proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hpu.Priority != -1 || hpu.Scope != ProxyCredentialsScope || hpu.Port != "0" {
+		t.Fatalf("unexpected result: %+v", hpu)
+	}
+}
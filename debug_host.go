@@ -0,0 +1,189 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+const debugHostKey = "debug-host"
+
+// DebugInfo is the diagnostic response served at the HTTPProxyConfig.DebugHost,
+// it shows how the proxy saw the request.
+type DebugInfo struct {
+	Time     time.Time     `json:"time"`
+	Proxy    string        `json:"proxy"`
+	ClientIP string        `json:"client_ip"`
+	User     string        `json:"user,omitempty"`
+	Groups   []string      `json:"groups,omitempty"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Proto    string        `json:"proto"`
+	Header   http.Header   `json:"headers"`
+	TLS      *DebugTLSInfo `json:"tls,omitempty"`
+	Target   *DebugTarget  `json:"target,omitempty"`
+}
+
+// DebugTLSInfo describes the TLS connection between the client and the proxy,
+// i.e. the connection to an https proxy, or the MITMed connection.
+type DebugTLSInfo struct {
+	Version           string `json:"version"`
+	CipherSuite       string `json:"cipher_suite"`
+	ServerName        string `json:"server_name,omitempty"`
+	ALPN              string `json:"alpn,omitempty"`
+	ClientCertSubject string `json:"client_cert_subject,omitempty"`
+}
+
+// DebugTarget shows how the proxy would handle a request to the URL passed in the url query parameter.
+type DebugTarget struct {
+	URL string `json:"url"`
+
+	// Rules are the names of the matched rules e.g. deny-domains or direct-domains.
+	Rules []string `json:"rules,omitempty"`
+
+	// Upstream is the selected upstream proxy, or DIRECT.
+	Upstream string `json:"upstream"`
+	Error    string `json:"error,omitempty"`
+}
+
+// debugHost serves DebugInfo to requests to the HTTPProxyConfig.DebugHost without contacting the server,
+// so that end users can troubleshoot their proxy configuration.
+type debugHost struct {
+	hp *HTTPProxy
+}
+
+func (d debugHost) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || !strings.EqualFold(req.URL.Hostname(), d.hp.config.DebugHost) {
+		return nil
+	}
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+	ctx.SkipRoundTrip()
+	ctx.Set(debugHostKey, true)
+	return nil
+}
+
+func (d debugHost) ModifyResponse(res *http.Response) error {
+	if res.Request == nil {
+		return nil
+	}
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	if _, ok := ctx.Get(debugHostKey); !ok {
+		return nil
+	}
+
+	body, err := json.MarshalIndent(d.hp.debugInfo(res.Request), "", "  ")
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+
+	setLocalResponse(res, http.StatusOK, "application/json", body)
+	res.Header.Set("Cache-Control", "no-store")
+
+	return nil
+}
+
+func (hp *HTTPProxy) debugInfo(req *http.Request) *DebugInfo {
+	r := newSyntheticRequest(req)
+	v := &DebugInfo{
+		Time:     time.Now(),
+		Proxy:    hp.config.Name,
+		ClientIP: r.ClientIP,
+		User:     r.User,
+		Groups:   middleware.Groups(req),
+		Method:   r.Method,
+		URL:      r.URL,
+		Proto:    r.Proto,
+		Header:   r.Header,
+	}
+	if cs := req.TLS; cs != nil {
+		v.TLS = &DebugTLSInfo{
+			Version:     tls.VersionName(cs.Version),
+			CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+			ServerName:  cs.ServerName,
+			ALPN:        cs.NegotiatedProtocol,
+		}
+		if len(cs.PeerCertificates) > 0 {
+			v.TLS.ClientCertSubject = cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	if t := req.URL.Query().Get("url"); t != "" {
+		v.Target = hp.debugTarget(req, t)
+	}
+
+	return v
+}
+
+// debugTarget evaluates the rules for a request to the target URL with the identity of the debug request.
+func (hp *HTTPProxy) debugTarget(req *http.Request, target string) *DebugTarget {
+	t := &DebugTarget{URL: target}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		t.Error = "invalid url, expected absolute URL e.g. https://example.com/"
+		return t
+	}
+	t.URL = u.Redacted()
+
+	treq := req.Clone(req.Context())
+	treq.URL = u
+	treq.Host = u.Host
+	host := u.Hostname()
+
+	rc := hp.runtime.Load()
+	if rc.DenyDomains != nil && rc.DenyDomains.Match(host) {
+		t.Rules = append(t.Rules, "deny-domains")
+	}
+	if hp.config.BlockList != nil && hp.config.BlockList.Match(host, u.String()) {
+		t.Rules = append(t.Rules, "block-list")
+	}
+	if hp.hasPolicies() && hp.userPolicy(treq).deniedDomain(host) {
+		t.Rules = append(t.Rules, "user-policy-deny-domains")
+	}
+	if rc.DirectDomains != nil && rc.DirectDomains.Match(host) {
+		t.Rules = append(t.Rules, "direct-domains")
+	}
+	for _, r := range hp.config.UpstreamProxyRules {
+		if r.Domain.MatchString(host) {
+			t.Rules = append(t.Rules, "upstream-proxy-rule "+r.Domain.String())
+			break
+		}
+	}
+	if hp.config.MITM != nil {
+		if rc.MITMDomains != nil && rc.MITMDomains.Match(host) {
+			t.Rules = append(t.Rules, "mitm-domains")
+		}
+		if rc.MITMExcludeDomains != nil && rc.MITMExcludeDomains.Match(host) {
+			t.Rules = append(t.Rules, "mitm-exclude-domains")
+		}
+	}
+
+	t.Upstream = proxyString(nil)
+	if hp.proxyFunc != nil {
+		p, err := hp.proxyFunc(treq)
+		if err != nil {
+			t.Error = err.Error()
+		}
+		t.Upstream = proxyString(p)
+	}
+
+	return t
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestDebugHost(t *testing.T) {
+	deny, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^denied\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^direct\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Name = "test-proxy"
+	cfg.DebugHost = "proxy.debug"
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.UpstreamProxy = &url.URL{Scheme: "http", Host: "upstream:3128"}
+	cfg.DenyDomains = deny
+	cfg.DirectDomains = direct
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected round trip to %s", req.URL)
+			return nil, io.EOF
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(u string) *DebugInfo {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, u, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		var v DebugInfo
+		if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		return &v
+	}
+
+	v := get("http://proxy.debug/")
+	if v.Proxy != "test-proxy" || v.User != "user" || v.ClientIP == "" || v.Method != http.MethodGet {
+		t.Fatalf("unexpected debug info %+v", v)
+	}
+	if v.Header.Get("Proxy-Authorization") != "" {
+		t.Fatal("expected Proxy-Authorization header to be removed")
+	}
+	if v.TLS != nil || v.Target != nil {
+		t.Fatalf("unexpected TLS or target %+v", v)
+	}
+
+	tests := []struct {
+		url      string
+		rules    []string
+		upstream string
+	}{
+		{"https://example.com/", nil, "http://upstream:3128"},
+		{"https://denied.com/", []string{"deny-domains"}, "http://upstream:3128"},
+		{"https://direct.com/", []string{"direct-domains"}, "DIRECT"},
+	}
+	for _, tc := range tests {
+		v := get("http://proxy.debug/?url=" + url.QueryEscape(tc.url))
+		if v.Target == nil {
+			t.Fatalf("%s: expected target", tc.url)
+		}
+		if v.Target.URL != tc.url || !slices.Equal(v.Target.Rules, tc.rules) || v.Target.Upstream != tc.upstream {
+			t.Errorf("%s: unexpected target %+v", tc.url, v.Target)
+		}
+	}
+
+	if v := get("http://proxy.debug/?url=example.com"); v.Target == nil || v.Target.Error == "" {
+		t.Fatalf("expected target error, got %+v", v.Target)
+	}
+}
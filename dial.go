@@ -9,6 +9,8 @@ package forwarder
 import (
 	"context"
 	"net"
+	"net/netip"
+	"strings"
 	"time"
 )
 
@@ -29,6 +31,17 @@ type DialConfig struct {
 	// not support keep-alives ignore this field.
 	// If negative, keep-alive probes are disabled.
 	KeepAlive time.Duration
+
+	// DNSClientSubnet, if set, is sent as EDNS Client Subnet (RFC 7871) in DNS queries.
+	// Prefix 0.0.0.0/0 asks DNS servers not to use the client address for the response e.g. for CDN geo-routing.
+	DNSClientSubnet netip.Prefix
+
+	// DNSRoutes resolve matching host names with alternate DNS servers, the first matching route is used.
+	DNSRoutes []*DNSRoute
+
+	// DNSCacheTTL, if non-zero, caches the resolved addresses of host names for the duration.
+	// The cache is shared by all connections of the dialer e.g. of a transport shared by multiple proxies.
+	DNSCacheTTL time.Duration
 }
 
 func DefaultDialConfig() *DialConfig {
@@ -39,8 +52,10 @@ func DefaultDialConfig() *DialConfig {
 }
 
 type Dialer struct {
-	cfg DialConfig
-	nd  *net.Dialer
+	cfg    DialConfig
+	nd     *net.Dialer
+	routes []*net.Dialer
+	cache  *dnsCache
 }
 
 func NewDialer(cfg *DialConfig) (*Dialer, error) {
@@ -52,12 +67,167 @@ func NewDialer(cfg *DialConfig) (*Dialer, error) {
 		},
 	}
 
+	if cfg.DNSClientSubnet.IsValid() {
+		nd.Resolver.Dial = ecsDial(new(net.Dialer).DialContext, cfg.DNSClientSubnet)
+	}
+
+	routes := make([]*net.Dialer, len(cfg.DNSRoutes))
+	for i, r := range cfg.DNSRoutes {
+		rd := *nd
+		rd.Resolver = r.resolver(nd)
+		if cfg.DNSClientSubnet.IsValid() {
+			rd.Resolver.Dial = ecsDial(rd.Resolver.Dial, cfg.DNSClientSubnet)
+		}
+		routes[i] = &rd
+	}
+
+	var cache *dnsCache
+	if cfg.DNSCacheTTL > 0 {
+		cache = newDNSCache(cfg.DNSCacheTTL)
+	}
+
 	return &Dialer{
-		cfg: *cfg,
-		nd:  nd,
+		cfg:    *cfg,
+		nd:     nd,
+		routes: routes,
+		cache:  cache,
 	}, nil
 }
 
+// DialContext connects to the address, if the host resolves to multiple addresses they are tried in order
+// until one succeeds, the dial timeout is split between the remaining addresses.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
-	return d.nd.DialContext(ctx, network, address)
+	nd := d.dialer(address)
+	if d.cache != nil {
+		return d.cache.dialCached(ctx, nd, network, address)
+	}
+	return dialSerial(ctx, nd, network, address, func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return nd.Resolver.LookupNetIP(ctx, "ip", host)
+	})
+}
+
+// dialer returns the dialer of the first DNS route matching the host, or the default dialer.
+func (d *Dialer) dialer(address string) *net.Dialer {
+	if len(d.routes) == 0 {
+		return d.nd
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.nd
+	}
+	host = strings.TrimSuffix(host, ".")
+	for i, r := range d.cfg.DNSRoutes {
+		if r.Domain.MatchString(host) {
+			return d.routes[i]
+		}
+	}
+
+	return d.nd
+}
+
+// minDialAttemptTimeout is the minimal timeout of dialing a single address, if the budget allows it.
+const minDialAttemptTimeout = 2 * time.Second
+
+// dialSerial resolves the host with lookup, and dials the addresses in order until one succeeds.
+// The dial timeout is a budget for the lookup and all the attempts, each attempt gets an equal share of the remaining time.
+// Addresses are dialed directly, and non-TCP networks are dialed with d.
+func dialSerial(ctx context.Context, d *net.Dialer, network, address string,
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error),
+) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil || !strings.HasPrefix(network, "tcp") {
+		return d.DialContext(ctx, network, address)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs = filterNetworkAddrs(network, addrs)
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address found", Name: host}
+	}
+
+	var (
+		firstErr error
+		attempts int
+	)
+	for i, a := range addrs {
+		attempts++
+		actx, cancel := dialAttemptContext(ctx, len(addrs)-i)
+		conn, err := d.DialContext(actx, network, net.JoinHostPort(a.String(), port))
+		cancel()
+		if err == nil {
+			if i > 0 {
+				reportDialRetry(ctx, "success")
+			}
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if attempts > 1 {
+		reportDialRetry(ctx, "failure")
+	}
+
+	return nil, firstErr
+}
+
+func filterNetworkAddrs(network string, addrs []netip.Addr) []netip.Addr {
+	res := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		a = a.Unmap()
+		if network == "tcp4" && !a.Is4() || network == "tcp6" && a.Is4() {
+			continue
+		}
+		res = append(res, a)
+	}
+	return res
+}
+
+// dialAttemptContext returns a context with a deadline that leaves time for the remaining attempts,
+// it returns ctx if it has no deadline.
+func dialAttemptContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining <= 1 {
+		return ctx, func() {}
+	}
+
+	timeout := time.Until(deadline) / time.Duration(remaining)
+	if timeout < minDialAttemptTimeout {
+		timeout = min(minDialAttemptTimeout, time.Until(deadline))
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+type dialRetryReporterKey struct{}
+
+// withDialRetryReporter returns a context that reports the outcome of dials retried with alternate addresses,
+// after the first resolved address failed.
+func withDialRetryReporter(ctx context.Context, report func(outcome string)) context.Context {
+	return context.WithValue(ctx, dialRetryReporterKey{}, report)
+}
+
+func reportDialRetry(ctx context.Context, outcome string) {
+	if report, ok := ctx.Value(dialRetryReporterKey{}).(func(outcome string)); ok {
+		report(outcome)
+	}
+}
+
+// dialRetryMetrics returns a dial function that reports dial retries of Dialer to the proxy metrics.
+func (hp *HTTPProxy) dialRetryMetrics(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(withDialRetryReporter(ctx, hp.metrics.dialRetry), network, addr)
+	}
 }
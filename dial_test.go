@@ -0,0 +1,105 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDialSerial(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	var outcomes []string
+	ctx := withDialRetryReporter(context.Background(), func(outcome string) {
+		outcomes = append(outcomes, outcome)
+	})
+	d := &net.Dialer{Timeout: 5 * time.Second}
+
+	dial := func(addrs ...string) error {
+		outcomes = nil
+		conn, err := dialSerial(ctx, d, "tcp", net.JoinHostPort("forwarder.test", port),
+			func(ctx context.Context, host string) ([]netip.Addr, error) {
+				res := make([]netip.Addr, len(addrs))
+				for i, a := range addrs {
+					res[i] = netip.MustParseAddr(a)
+				}
+				return res, nil
+			})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// The listener only accepts IPv4 connections, dialing ::1 fails.
+	t.Run("first address", func(t *testing.T) {
+		if err := dial("127.0.0.1", "::1"); err != nil {
+			t.Fatal(err)
+		}
+		if len(outcomes) != 0 {
+			t.Fatalf("expected no retries, got %v", outcomes)
+		}
+	})
+
+	t.Run("alternate address", func(t *testing.T) {
+		if err := dial("::1", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if len(outcomes) != 1 || outcomes[0] != "success" {
+			t.Fatalf("expected successful retry, got %v", outcomes)
+		}
+	})
+
+	t.Run("all addresses fail", func(t *testing.T) {
+		if err := dial("::1", "::1"); err == nil {
+			t.Fatal("expected error")
+		}
+		if len(outcomes) != 1 || outcomes[0] != "failure" {
+			t.Fatalf("expected failed retry, got %v", outcomes)
+		}
+	})
+}
+
+func TestDialAttemptContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		remaining int
+		timeout   time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 5 * time.Second},
+		{10, minDialAttemptTimeout},
+	}
+	for _, tc := range tests {
+		actx, cancel := dialAttemptContext(ctx, tc.remaining)
+		dl, _ := actx.Deadline()
+		cancel()
+		if d := time.Until(dl); d > tc.timeout || d < tc.timeout-time.Second {
+			t.Errorf("remaining=%d: expected timeout %s, got %s", tc.remaining, tc.timeout, d)
+		}
+	}
+}
@@ -43,6 +43,8 @@ func HTTPProxy(dial ContextDialerFunc, proxyURL *url.URL) *HTTPProxyDialer {
 	}
 }
 
+// HTTPSProxy returns a dialer that connects to the proxy over TLS.
+// If not set in the TLS config, the server name is the proxy host and the ALPN protocol is http/1.1.
 func HTTPSProxy(dial ContextDialerFunc, proxyURL *url.URL, tlsConfig *tls.Config) *HTTPProxyDialer {
 	if dial == nil {
 		panic("dial is required")
@@ -57,8 +59,12 @@ func HTTPSProxy(dial ContextDialerFunc, proxyURL *url.URL, tlsConfig *tls.Config
 		panic("TLS config is required")
 	}
 
-	tlsConfig.ServerName = proxyURL.Hostname()
-	tlsConfig.NextProtos = []string{"http/1.1"}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = proxyURL.Hostname()
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
 
 	return &HTTPProxyDialer{
 		dial:      dial,
@@ -0,0 +1,83 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// dnsCacheMaxHosts limits the number of hosts in the DNS cache, expired entries are removed when it is reached.
+const dnsCacheMaxHosts = 10000
+
+// dnsCache caches the addresses of host names for the TTL, failed lookups are not cached.
+type dnsCache struct {
+	ttl     time.Duration
+	nowFunc func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		nowFunc: time.Now,
+		entries: make(map[string]dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) lookup(ctx context.Context, r *net.Resolver, host string) ([]netip.Addr, error) {
+	now := c.nowFunc()
+
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= dnsCacheMaxHosts {
+		c.evictLocked(now)
+	}
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: now.Add(c.ttl)}
+	c.mu.Unlock()
+
+	return addrs, nil
+}
+
+func (c *dnsCache) evictLocked(now time.Time) {
+	for h, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, h)
+		}
+	}
+	if len(c.entries) >= dnsCacheMaxHosts {
+		c.entries = make(map[string]dnsCacheEntry)
+	}
+}
+
+// dialCached dials the addresses of the host from the cache in order until one succeeds.
+func (c *dnsCache) dialCached(ctx context.Context, d *net.Dialer, network, address string) (net.Conn, error) {
+	return dialSerial(ctx, d, network, address, func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return c.lookup(ctx, d.Resolver, host)
+	})
+}
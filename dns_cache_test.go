@@ -0,0 +1,78 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheDial(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	now := time.Now()
+	c := newDNSCache(time.Minute)
+	c.nowFunc = func() time.Time { return now }
+
+	// Seed the cache with an address that the resolver would not return.
+	c.entries["forwarder.test"] = dnsCacheEntry{
+		addrs:   []netip.Addr{netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.1")},
+		expires: now.Add(time.Minute),
+	}
+	d := &net.Dialer{Resolver: nopResolver()}
+
+	conn, err := c.dialCached(context.Background(), d, "tcp4", net.JoinHostPort("forwarder.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Expired entries are resolved again.
+	now = now.Add(time.Minute)
+	if _, err := c.dialCached(context.Background(), d, "tcp4", net.JoinHostPort("forwarder.test", port)); err == nil {
+		t.Fatal("expected lookup error")
+	}
+
+	// Failed lookups are not cached, addresses are dialed directly.
+	conn, err = c.dialCached(context.Background(), d, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDNSCacheEvict(t *testing.T) {
+	now := time.Now()
+	c := newDNSCache(time.Minute)
+	c.entries["expired"] = dnsCacheEntry{expires: now}
+	c.entries["valid"] = dnsCacheEntry{expires: now.Add(time.Second)}
+
+	c.evictLocked(now)
+	if _, ok := c.entries["expired"]; ok {
+		t.Fatal("expected expired entry to be removed")
+	}
+	if _, ok := c.entries["valid"]; !ok {
+		t.Fatal("expected valid entry to be kept")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// ParseDNSClientSubnet parses the EDNS Client Subnet (RFC 7871) sent in DNS queries.
+// The value "off" is an alias for 0.0.0.0/0, which asks DNS servers not to use the client address.
+func ParseDNSClientSubnet(val string) (netip.Prefix, error) {
+	if val == "off" {
+		return netip.PrefixFrom(netip.IPv4Unspecified(), 0), nil
+	}
+	p, err := netip.ParsePrefix(val)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+const (
+	dnsHeaderLen  = 12
+	dnsTypeOPT    = 41
+	ednsOptionECS = 8
+)
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// ecsOption returns the EDNS Client Subnet option for the prefix.
+func ecsOption(p netip.Prefix) []byte {
+	family := uint16(1)
+	if p.Addr().Is6() {
+		family = 2
+	}
+	addr := p.Addr().AsSlice()[:(p.Bits()+7)/8]
+
+	b := make([]byte, 8, 8+len(addr))
+	binary.BigEndian.PutUint16(b[0:], ednsOptionECS)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(addr)))
+	binary.BigEndian.PutUint16(b[4:], family)
+	b[6] = byte(p.Bits())
+	b[7] = 0 // scope prefix length
+	return append(b, addr...)
+}
+
+// skipDNSName returns the offset after the domain name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMessage
+		}
+		switch l := int(msg[off]); {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += l + 1
+		}
+	}
+}
+
+// withClientSubnet returns the DNS query with the EDNS Client Subnet option added to the OPT record.
+// If the query does not have an OPT record, one is added.
+func withClientSubnet(msg []byte, opt []byte) ([]byte, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSMessage
+	}
+
+	off := dnsHeaderLen
+	for i := binary.BigEndian.Uint16(msg[4:]); i > 0; i-- {
+		n, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+
+	rrs := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < rrs; i++ {
+		n, err := skipDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if n+10 > len(msg) {
+			return nil, errDNSMessage
+		}
+		typ := binary.BigEndian.Uint16(msg[n:])
+		rdlen := int(binary.BigEndian.Uint16(msg[n+8:]))
+		end := n + 10 + rdlen
+		if end > len(msg) {
+			return nil, errDNSMessage
+		}
+		if typ == dnsTypeOPT {
+			out := make([]byte, 0, len(msg)+len(opt))
+			out = append(out, msg[:n+8]...)
+			out = binary.BigEndian.AppendUint16(out, uint16(rdlen+len(opt)))
+			out = append(out, msg[n+10:end]...)
+			out = append(out, opt...)
+			return append(out, msg[end:]...), nil
+		}
+		off = end
+	}
+
+	out := make([]byte, 0, len(msg)+11+len(opt))
+	out = append(out, msg...)
+	binary.BigEndian.PutUint16(out[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	out = append(out, 0)                                       // root name
+	out = binary.BigEndian.AppendUint16(out, dnsTypeOPT)       // type
+	out = binary.BigEndian.AppendUint16(out, 1232)             // UDP payload size
+	out = append(out, 0, 0, 0, 0)                              // extended rcode and flags
+	out = binary.BigEndian.AppendUint16(out, uint16(len(opt))) // rdlen
+	return append(out, opt...), nil
+}
+
+// ecsDial wraps the resolver dial function so that queries carry the EDNS Client Subnet option for the prefix.
+func ecsDial(dial func(ctx context.Context, network, address string) (net.Conn, error), p netip.Prefix) func(ctx context.Context, network, address string) (net.Conn, error) {
+	opt := ecsOption(p)
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		// The resolver uses message framing of net.PacketConn connections, the type must be preserved.
+		if uc, ok := c.(*net.UDPConn); ok {
+			return &ecsPacketConn{UDPConn: uc, opt: opt}, nil
+		}
+		if _, ok := c.(net.PacketConn); ok {
+			return c, nil
+		}
+		return &ecsStreamConn{Conn: c, opt: opt}, nil
+	}
+}
+
+type ecsPacketConn struct {
+	*net.UDPConn
+	opt []byte
+}
+
+func (c *ecsPacketConn) Write(b []byte) (int, error) {
+	msg, err := withClientSubnet(b, c.opt)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ecsStreamConn rewrites DNS messages prefixed with their length.
+type ecsStreamConn struct {
+	net.Conn
+	opt  []byte
+	wbuf bytes.Buffer
+}
+
+func (c *ecsStreamConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		msg, err := withClientSubnet(c.wbuf.Next(2 + n)[2:], c.opt)
+		if err != nil {
+			return 0, err
+		}
+		out := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+		if _, err := c.Conn.Write(append(out, msg...)); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
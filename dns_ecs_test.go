@@ -0,0 +1,142 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestParseDNSClientSubnet(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"off", "0.0.0.0/0"},
+		{"192.0.2.77/24", "192.0.2.0/24"},
+		{"2001:db8::1/56", "2001:db8::/56"},
+	}
+	for _, tc := range tests {
+		p, err := ParseDNSClientSubnet(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.String() != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.input, tc.expected, p)
+		}
+	}
+
+	if _, err := ParseDNSClientSubnet("192.0.2.1"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestECSOption(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected []byte
+	}{
+		{"0.0.0.0/0", []byte{0, 8, 0, 4, 0, 1, 0, 0}},
+		{"192.0.2.0/24", []byte{0, 8, 0, 7, 0, 1, 24, 0, 192, 0, 2}},
+		{"2001:db8::/32", []byte{0, 8, 0, 8, 0, 2, 32, 0, 0x20, 0x01, 0x0d, 0xb8}},
+	}
+	for _, tc := range tests {
+		if opt := ecsOption(netip.MustParsePrefix(tc.prefix)); !bytes.Equal(opt, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.prefix, tc.expected, opt)
+		}
+	}
+}
+
+// dnsQuery returns an A query for example.com, with an OPT record if edns is true.
+func dnsQuery(edns bool) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	q = append(q, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1)
+	if edns {
+		q[11] = 1
+		q = append(q, 0, 0, dnsTypeOPT, 0x04, 0xd0, 0, 0, 0, 0, 0, 0)
+	}
+	return q
+}
+
+// findECS returns the EDNS Client Subnet option of the OPT record, the OPT record must be the last record.
+func findECS(t *testing.T, msg []byte) []byte {
+	t.Helper()
+
+	if binary.BigEndian.Uint16(msg[10:]) != 1 {
+		t.Fatalf("expected 1 additional record, got %d", binary.BigEndian.Uint16(msg[10:]))
+	}
+	q := dnsQuery(false)
+	rr := msg[len(q):]
+	if rr[0] != 0 || binary.BigEndian.Uint16(rr[1:]) != dnsTypeOPT {
+		t.Fatalf("expected OPT record, got %v", rr)
+	}
+	rdata := rr[11:]
+	if int(binary.BigEndian.Uint16(rr[9:])) != len(rdata) {
+		t.Fatalf("unexpected rdlen %d, rdata %v", binary.BigEndian.Uint16(rr[9:]), rdata)
+	}
+	return rdata
+}
+
+func TestWithClientSubnet(t *testing.T) {
+	opt := ecsOption(netip.MustParsePrefix("192.0.2.0/24"))
+
+	for _, edns := range []bool{true, false} {
+		msg, err := withClientSubnet(dnsQuery(edns), opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ecs := findECS(t, msg); !bytes.Equal(ecs, opt) {
+			t.Fatalf("edns=%v: expected %v, got %v", edns, opt, ecs)
+		}
+	}
+
+	if _, err := withClientSubnet(dnsQuery(true)[:20], opt); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestECSDialResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	want := netip.MustParseAddr("10.1.2.3")
+	opt := ecsOption(netip.MustParsePrefix("0.0.0.0/0"))
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if !bytes.Contains(b[:n], opt) {
+				t.Errorf("query without ECS option: %v", b[:n])
+			}
+			pc.WriteTo(dohAnswer(t, b[:n], want), addr)
+		}
+	}()
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: ecsDial(func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "udp", pc.LocalAddr().String())
+		}, netip.MustParsePrefix("0.0.0.0/0")),
+	}
+	addrs, err := r.LookupNetIP(context.Background(), "ip4", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != want {
+		t.Fatalf("expected %s, got %v", want, addrs)
+	}
+}
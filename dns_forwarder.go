@@ -0,0 +1,313 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+type DNSForwarderConfig struct {
+	Addr     string
+	Upstream []netip.AddrPort
+	Timeout  time.Duration
+
+	// MaxConcurrentQueries limits the number of queries served at the same time,
+	// when the limit is reached new packets are not read until a query completes.
+	MaxConcurrentQueries int
+}
+
+func DefaultDNSForwarderConfig() *DNSForwarderConfig {
+	return &DNSForwarderConfig{
+		Timeout:              5 * time.Second,
+		MaxConcurrentQueries: 256,
+	}
+}
+
+func (c *DNSForwarderConfig) Validate() error {
+	if c.Addr == "" {
+		return errors.New("address is required")
+	}
+	if len(c.Upstream) == 0 {
+		return errors.New("upstream DNS server is required")
+	}
+	if c.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	if c.MaxConcurrentQueries <= 0 {
+		return errors.New("max concurrent queries must be positive")
+	}
+	return nil
+}
+
+// DNSForwarder serves DNS queries over UDP by forwarding them to the upstream DNS servers,
+// so that clients in a sandbox can resolve names through the proxy.
+// Queries for names denied by the proxy localhost policy, deny domains, block list or user policy
+// are answered with NXDOMAIN, making the proxy a single egress control point.
+//
+// The upstream servers are tried in order, the next server is used if the previous one fails or times out.
+// The forwarder is an open resolver for the clients allowed by the proxy AllowClients and DenyClients,
+// it should not be exposed to untrusted networks.
+type DNSForwarder struct {
+	config DNSForwarderConfig
+	hp     *HTTPProxy
+	log    log.Logger
+	conn   net.PacketConn
+}
+
+// NewDNSForwarder creates a new DNS forwarder that applies the deny rules of the HTTP proxy.
+// It is the caller's responsibility to call Close on the returned forwarder.
+func NewDNSForwarder(cfg *DNSForwarderConfig, hp *HTTPProxy, log log.Logger) (*DNSForwarder, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open listener on address %s: %w", cfg.Addr, err)
+	}
+
+	f := &DNSForwarder{
+		config: *cfg,
+		hp:     hp,
+		log:    log,
+		conn:   conn,
+	}
+	f.log.Infof("DNS forwarder listen address=%s upstream=%s", conn.LocalAddr(), cfg.Upstream)
+
+	return f, nil
+}
+
+func (f *DNSForwarder) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		f.conn.Close()
+	}()
+
+	sem := make(chan struct{}, f.config.MaxConcurrentQueries)
+	for {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+
+		bufp := dnsBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
+		release := func() {
+			dnsBufPool.Put(bufp)
+			<-sem
+		}
+
+		n, addr, err := f.conn.ReadFrom(*bufp)
+		if err != nil {
+			release()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if f.hp.rejectClient(addr) {
+			release()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer release()
+			f.serve(ctx, (*bufp)[:n], addr)
+		}()
+	}
+}
+
+// Addr returns the address the forwarder is listening on.
+func (f *DNSForwarder) Addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *DNSForwarder) Close() error {
+	return f.conn.Close()
+}
+
+const dnsMaxUDPSize = 65535
+
+var dnsBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, dnsMaxUDPSize)
+		return &b
+	},
+}
+
+// DNS response codes, see RFC 1035.
+const (
+	dnsRcodeFormErr  = 1
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+func (f *DNSForwarder) serve(ctx context.Context, query []byte, addr net.Addr) {
+	name, err := dnsQuestionName(query)
+	if err != nil {
+		f.log.Debugf("DNS query from %s: %s", addr, err)
+		if len(query) >= dnsHeaderLen {
+			f.conn.WriteTo(dnsErrorResponse(query, dnsRcodeFormErr), addr)
+		}
+		return
+	}
+
+	if err := f.hp.hostDenied(dnsRequest(ctx, name, addr)); err != nil {
+		f.log.Infof("DNS query from %s for %s denied: %s", addr, name, err)
+		f.conn.WriteTo(dnsErrorResponse(query, dnsRcodeNXDomain), addr)
+		return
+	}
+
+	bufp := dnsBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
+	defer dnsBufPool.Put(bufp)
+
+	res, err := f.exchange(ctx, query, *bufp)
+	if err != nil {
+		f.log.Errorf("DNS query from %s for %s failed: %s", addr, name, err)
+		res = dnsErrorResponse(query, dnsRcodeServFail)
+	}
+	f.conn.WriteTo(res, addr)
+}
+
+// dnsRequest returns the request the deny rules are evaluated for, as if the client connected to the name.
+// DNS clients are not authenticated, only policies not bound to a user apply.
+func dnsRequest(ctx context.Context, name string, addr net.Addr) *http.Request {
+	return (&http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: "https", Host: name},
+		Host:       name,
+		Header:     make(http.Header),
+		RemoteAddr: addr.String(),
+	}).WithContext(ctx)
+}
+
+// exchange sends the query to the upstream servers in order, and returns the first response read into buf.
+func (f *DNSForwarder) exchange(ctx context.Context, query, buf []byte) ([]byte, error) {
+	var errs []error
+	for _, s := range f.config.Upstream {
+		res, err := f.exchangeWith(ctx, s.String(), query, buf)
+		if err == nil {
+			return res, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (f *DNSForwarder) exchangeWith(ctx context.Context, server string, query, buf []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.config.Timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore responses that do not match the query ID.
+		if n >= dnsHeaderLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// dnsQuestionName returns the lowercase name without trailing dot of the single question in a standard query.
+func dnsQuestionName(msg []byte) (string, error) {
+	if len(msg) < dnsHeaderLen {
+		return "", errDNSMessage
+	}
+	if msg[2]&0x80 != 0 {
+		return "", errors.New("not a query")
+	}
+	if opcode := (msg[2] >> 3) & 0x0f; opcode != 0 {
+		return "", fmt.Errorf("unsupported opcode %d", opcode)
+	}
+	if n := binary.BigEndian.Uint16(msg[4:]); n != 1 {
+		return "", fmt.Errorf("expected 1 question, got %d", n)
+	}
+
+	var (
+		sb  strings.Builder
+		off = dnsHeaderLen
+	)
+	for {
+		if off >= len(msg) {
+			return "", errDNSMessage
+		}
+		l := int(msg[off])
+		if l == 0 {
+			break
+		}
+		// Compression pointers are not expected in the first name of a message.
+		if l&0xc0 != 0 || off+1+l > len(msg) {
+			return "", errDNSMessage
+		}
+		if sb.Len() > 0 {
+			sb.WriteByte('.')
+		}
+		sb.Write(msg[off+1 : off+1+l])
+		off += 1 + l
+	}
+	if off+5 > len(msg) {
+		return "", errDNSMessage
+	}
+
+	return strings.ToLower(sb.String()), nil
+}
+
+// dnsErrorResponse returns a response to the query with the rcode, and the question if the query is well-formed.
+func dnsErrorResponse(query []byte, rcode byte) []byte {
+	res := make([]byte, dnsHeaderLen, len(query))
+	copy(res, query[:dnsHeaderLen])
+	res[2] = res[2]&0x79 | 0x80 // QR set, AA and TC cleared, opcode and RD preserved
+	res[3] = 0x80 | rcode       // RA set
+	binary.BigEndian.PutUint16(res[6:], 0)
+	binary.BigEndian.PutUint16(res[8:], 0)
+	binary.BigEndian.PutUint16(res[10:], 0)
+
+	if rcode == dnsRcodeFormErr {
+		binary.BigEndian.PutUint16(res[4:], 0)
+		return res
+	}
+
+	end, err := skipDNSName(query, dnsHeaderLen)
+	if err != nil || end+4 > len(query) {
+		binary.BigEndian.PutUint16(res[4:], 0)
+		return res
+	}
+	return append(res, query[dnsHeaderLen:end+4]...)
+}
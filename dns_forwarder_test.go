@@ -0,0 +1,182 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestDNSQuestionName(t *testing.T) {
+	q := dnsQuery(true)
+	q[13] = 'E'
+	name, err := dnsQuestionName(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "example.com" {
+		t.Fatalf("expected example.com, got %q", name)
+	}
+
+	res := dnsQuery(false)
+	res[2] |= 0x80
+	truncated := dnsQuery(false)
+	for _, msg := range [][]byte{res, truncated[:20], {0x12, 0x34}} {
+		if _, err := dnsQuestionName(msg); err == nil {
+			t.Errorf("%v: expected error", msg)
+		}
+	}
+}
+
+func TestDNSErrorResponse(t *testing.T) {
+	q := dnsQuery(true)
+	res := dnsErrorResponse(q, dnsRcodeNXDomain)
+
+	expected := dnsQuery(false)
+	expected[2] = 0x81
+	expected[3] = 0x83
+	if !bytes.Equal(res, expected) {
+		t.Fatalf("expected %v, got %v", expected, res)
+	}
+}
+
+func TestDNSForwarder(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, dnsMaxUDPSize)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			res := append([]byte(nil), buf[:n]...)
+			res[2] |= 0x80
+			upstream.WriteTo(res, addr)
+		}
+	}()
+
+	cfg := DefaultHTTPProxyConfig()
+	dd, err := parseRegexpMatcherLines(`^example\.com$`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DenyDomains = dd
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	fcfg := DefaultDNSForwarderConfig()
+	fcfg.Addr = "127.0.0.1:0"
+	fcfg.Upstream = []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:1"),
+		netip.MustParseAddrPort(upstream.LocalAddr().String()),
+	}
+	fcfg.Timeout = time.Second
+	f, err := NewDNSForwarder(fcfg, p, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-errCh; err != nil {
+			t.Errorf("Run() = %v", err)
+		}
+	}()
+
+	query := func(t *testing.T) []byte {
+		t.Helper()
+
+		conn, err := net.Dial("udp", f.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		if _, err := conn.Write(dnsQuery(false)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, dnsMaxUDPSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	t.Run("denied", func(t *testing.T) {
+		res := query(t)
+		if rcode := res[3] & 0x0f; rcode != dnsRcodeNXDomain {
+			t.Fatalf("expected NXDOMAIN, got rcode %d", rcode)
+		}
+	})
+
+	t.Run("forwarded", func(t *testing.T) {
+		if err := p.UpdateRuntimeConfig(func(rc *RuntimeConfig) {
+			rc.DenyDomains = nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		res := query(t)
+		expected := dnsQuery(false)
+		expected[2] |= 0x80
+		if !bytes.Equal(res, expected) {
+			t.Fatalf("expected %v, got %v", expected, res)
+		}
+	})
+}
+
+func TestDNSRequestDenied(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = DenyProxyLocalhost
+	bl, err := ruleset.NewAdblockMatcher(strings.NewReader("||blocked.example.com^"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BlockList = bl
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 1234}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"blocked.example.com", ErrProxyBlocked},
+		{"localhost", ErrProxyLocalhost},
+		{"example.com", nil},
+	}
+	for _, tc := range tests {
+		if err := p.hostDenied(dnsRequest(context.Background(), tc.name, addr)); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
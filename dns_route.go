@@ -0,0 +1,248 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DNSRoute resolves names matching the domain with the route DNS servers or DNS over HTTPS server,
+// instead of the default resolver.
+type DNSRoute struct {
+	// Domain matches host names resolved with the route.
+	Domain *regexp.Regexp
+
+	// Servers are DNS servers, they are used in a round-robin fashion,
+	// so that queries retried by the resolver are sent to the next server.
+	Servers []netip.AddrPort
+
+	// DoHURL is the URL of the DNS over HTTPS (RFC 8484) server, it is mutually exclusive with Servers.
+	DoHURL *url.URL
+}
+
+// DNSRouteItem adds a server to the DNS route for the domain.
+type DNSRouteItem struct {
+	Domain string
+	Server string
+}
+
+// ParseDNSRouteItem parses a <regexp>=<ip>[:<port>] or <regexp>=<https://url> string into DNSRouteItem.
+func ParseDNSRouteItem(val string) (DNSRouteItem, error) {
+	domain, server, ok := strings.Cut(val, "=")
+	if !ok || domain == "" || server == "" {
+		return DNSRouteItem{}, errors.New("expected <regexp>=<ip>[:<port>] or <regexp>=<https://url>")
+	}
+	if _, err := regexp.Compile(domain); err != nil {
+		return DNSRouteItem{}, err
+	}
+	if strings.HasPrefix(server, "https://") {
+		if _, err := url.Parse(server); err != nil {
+			return DNSRouteItem{}, err
+		}
+	} else if _, err := ParseDNSAddress(server); err != nil {
+		return DNSRouteItem{}, err
+	}
+
+	return DNSRouteItem{Domain: domain, Server: server}, nil
+}
+
+// NewDNSRoutes builds routes from items, routes are returned in order of the first item for the domain.
+func NewDNSRoutes(items []DNSRouteItem) ([]*DNSRoute, error) {
+	var (
+		routes   []*DNSRoute
+		byDomain = make(map[string]*DNSRoute)
+	)
+
+	for _, item := range items {
+		r, ok := byDomain[item.Domain]
+		if !ok {
+			re, err := regexp.Compile(item.Domain)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.Domain, err)
+			}
+			r = &DNSRoute{Domain: re}
+			byDomain[item.Domain] = r
+			routes = append(routes, r)
+		}
+
+		if strings.HasPrefix(item.Server, "https://") {
+			if r.DoHURL != nil {
+				return nil, fmt.Errorf("%s: multiple DNS over HTTPS servers", item.Domain)
+			}
+			u, err := url.Parse(item.Server)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.Domain, err)
+			}
+			r.DoHURL = u
+		} else {
+			a, err := ParseDNSAddress(item.Server)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.Domain, err)
+			}
+			r.Servers = append(r.Servers, a)
+		}
+
+		if r.DoHURL != nil && len(r.Servers) > 0 {
+			return nil, fmt.Errorf("%s: cannot mix DNS servers and DNS over HTTPS server", item.Domain)
+		}
+	}
+
+	return routes, nil
+}
+
+// resolver returns a resolver that sends queries to the route servers, the connections are dialed with nd.
+func (r *DNSRoute) resolver(nd *net.Dialer) *net.Resolver {
+	if r.DoHURL != nil {
+		c := &http.Client{
+			Transport: &http.Transport{
+				DialContext:       nd.DialContext,
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+		u := r.DoHURL.String()
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: c, url: u}, nil
+			},
+		}
+	}
+
+	var next atomic.Uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			i := next.Add(1) - 1
+			return nd.DialContext(ctx, network, r.Servers[int(i%uint32(len(r.Servers)))].String())
+		},
+	}
+}
+
+// dohConn sends DNS messages written to the connection to a DNS over HTTPS server.
+// It does not implement net.PacketConn, so the resolver uses TCP framing i.e. messages are prefixed with their length.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	deadline time.Time
+
+	wbuf bytes.Buffer
+	rbuf bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		msg := c.wbuf.Next(2 + n)[2:]
+		res, err := c.query(msg)
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&c.rbuf, binary.BigEndian, uint16(len(res))) //nolint:errcheck // bytes.Buffer does not fail
+		c.rbuf.Write(res)
+	}
+
+	return len(b), nil
+}
+
+func (c *dohConn) query(msg []byte) ([]byte, error) {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS: unexpected status %s", res.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 1<<16 {
+		return nil, errors.New("DNS over HTTPS: message too long")
+	}
+
+	return b, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"testing"
+)
+
+func TestNewDNSRoutes(t *testing.T) {
+	var items []DNSRouteItem
+	for _, v := range []string{
+		`\.corp$=10.0.0.1`,
+		`.*=https://dns.example.com/dns-query`,
+		`\.corp$=10.0.0.2:5353`,
+	} {
+		item, err := ParseDNSRouteItem(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	routes, err := NewDNSRoutes(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(routes))
+	}
+	if routes[0].Domain.String() != `\.corp$` || len(routes[0].Servers) != 2 || routes[0].Servers[1].Port() != 5353 {
+		t.Fatalf("unexpected route %+v", routes[0])
+	}
+	if routes[1].DoHURL.Host != "dns.example.com" {
+		t.Fatalf("unexpected route %+v", routes[1])
+	}
+
+	items = append(items, DNSRouteItem{Domain: `.*`, Server: "10.0.0.3"})
+	if _, err := NewDNSRoutes(items); err == nil {
+		t.Fatal("expected error when mixing servers and DNS over HTTPS")
+	}
+}
+
+func TestParseDNSRouteItemError(t *testing.T) {
+	for _, v := range []string{"", "example.com", "=10.0.0.1", "(=10.0.0.1", "example.com=foo"} {
+		if _, err := ParseDNSRouteItem(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+// dohAnswer returns a response to a DNS query with a single A record for A queries, and no records otherwise.
+func dohAnswer(t *testing.T, q []byte, ip netip.Addr) []byte {
+	t.Helper()
+
+	// Find the end of the question name.
+	i := 12
+	for q[i] != 0 {
+		i += int(q[i]) + 1
+	}
+	qtype := binary.BigEndian.Uint16(q[i+1:])
+	question := q[12 : i+5]
+
+	res := make([]byte, 12, 512)
+	copy(res, q[:2])
+	binary.BigEndian.PutUint16(res[2:], 0x8180)
+	binary.BigEndian.PutUint16(res[4:], 1)
+	res = append(res, question...)
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(res[6:], 1)
+		res = append(res, 0xc0, 0x0c, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		res = append(res, ip.AsSlice()...)
+	}
+	return res
+}
+
+func TestDNSRouteDoH(t *testing.T) {
+	want := netip.MustParseAddr("10.1.2.3")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		q, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dohAnswer(t, q, want))
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &DNSRoute{
+		Domain: regexp.MustCompile(`\.corp$`),
+		DoHURL: u,
+	}
+
+	addrs, err := r.resolver(&net.Dialer{}).LookupNetIP(context.Background(), "ip4", "host.corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != want {
+		t.Fatalf("expected %s, got %v", want, addrs)
+	}
+}
+
+func TestDialerDNSRoutes(t *testing.T) {
+	cfg := DefaultDialConfig()
+	cfg.DNSRoutes = []*DNSRoute{
+		{
+			Domain:  regexp.MustCompile(`\.corp$`),
+			Servers: []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:53")},
+		},
+	}
+	d, err := NewDialer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		routed  bool
+	}{
+		{"host.corp:443", true},
+		{"host.corp.:443", true},
+		{"example.com:443", false},
+		{"10.0.0.2:443", false},
+	}
+	for _, tc := range tests {
+		if routed := d.dialer(tc.address) != d.nd; routed != tc.routed {
+			t.Errorf("%s: expected routed=%v", tc.address, tc.routed)
+		}
+	}
+}
@@ -11,16 +11,23 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/saucelabs/forwarder/e2e/setup"
 )
 
 var args = struct {
-	setup *string
-	debug *bool
+	setup           *string
+	debug           *bool
+	soak            *time.Duration
+	soakInterval    *time.Duration
+	soakErrorBudget *float64
 }{
-	setup: flag.String("setup", "", "Only run setups matching this regexp"),
-	debug: flag.Bool("debug", false, "Enables debug logs and preserves containers after running, this will run only the first matching setup"),
+	setup:           flag.String("setup", "", "Only run setups matching this regexp"),
+	debug:           flag.Bool("debug", false, "Enables debug logs and preserves containers after running, this will run only the first matching setup"),
+	soak:            flag.Duration("soak", 0, "Run the soak setups for the duration, generating traffic while applying chaos actions"),
+	soakInterval:    flag.Duration("soak-interval", setup.DefaultSoak().Interval, "Interval between chaos actions in the soak mode"),
+	soakErrorBudget: flag.Float64("soak-error-budget", setup.DefaultSoak().ErrorBudget, "Maximal ratio of failed requests in the soak mode"),
 }
 
 func setupRegexp() (*regexp.Regexp, error) {
@@ -40,8 +47,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	setups := AllSetups()
+	var soak *setup.Soak
+	if *args.soak > 0 {
+		setups = SoakSetups()
+		soak = &setup.Soak{
+			Duration:    *args.soak,
+			Interval:    *args.soakInterval,
+			ErrorBudget: *args.soakErrorBudget,
+		}
+	}
+
 	runner := setup.Runner{
-		Setups:      AllSetups(),
+		Setups:      setups,
 		SetupRegexp: r,
 		Decorate: func(s *setup.Setup) {
 			fmt.Println("running setup", s.Name)
@@ -54,6 +72,7 @@ func main() {
 			}
 		},
 		Debug: *args.debug,
+		Soak:  soak,
 	}
 
 	if err := runner.Run(); err != nil {
@@ -0,0 +1,218 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package setup
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// MetricSample is a single sample of a metric family.
+// Histograms and summaries are represented by the _count and _sum samples.
+type MetricSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Metrics is a snapshot of samples scraped from a Prometheus metrics endpoint.
+type Metrics []MetricSample
+
+// ScrapeMetrics fetches and parses the metrics in the Prometheus text format from the given URL.
+func ScrapeMetrics(c *http.Client, metricsURL string) (Metrics, error) {
+	res, err := c.Get(metricsURL) //nolint:noctx // The client timeout is used.
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	var parser expfmt.TextParser
+	mfs, err := parser.TextToMetricFamilies(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Metrics
+	for name, mf := range mfs {
+		for _, metric := range mf.GetMetric() {
+			labels := make(map[string]string, len(metric.GetLabel()))
+			for _, l := range metric.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			add := func(name string, v float64) {
+				m = append(m, MetricSample{Name: name, Labels: labels, Value: v})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				add(name+"_count", float64(metric.GetHistogram().GetSampleCount()))
+				add(name+"_sum", metric.GetHistogram().GetSampleSum())
+			case dto.MetricType_SUMMARY:
+				add(name+"_count", float64(metric.GetSummary().GetSampleCount()))
+				add(name+"_sum", metric.GetSummary().GetSampleSum())
+			}
+		}
+	}
+
+	return m, nil
+}
+
+var selectorRegexp = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(?:\{(.*)\})?$`)
+
+// Value returns the sum of samples matching the selector.
+// The selector is a metric name optionally followed by label matchers
+// ex. `proxy_errors_total{reason="denied"}`, samples with additional labels match as well.
+func (m Metrics) Value(selector string) (float64, error) {
+	name, labels, err := parseSelector(selector)
+	if err != nil {
+		return 0, err
+	}
+
+	var v float64
+	for _, s := range m {
+		if s.Name == name && matchLabels(s.Labels, labels) {
+			v += s.Value
+		}
+	}
+	return v, nil
+}
+
+func parseSelector(selector string) (name string, labels map[string]string, err error) {
+	sm := selectorRegexp.FindStringSubmatch(strings.TrimSpace(selector))
+	if sm == nil {
+		return "", nil, fmt.Errorf("invalid selector %q", selector)
+	}
+	name = sm[1]
+
+	labels = make(map[string]string)
+	if sm[2] == "" {
+		return name, labels, nil
+	}
+	for _, kv := range strings.Split(sm[2], ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid selector %q: invalid label matcher %q", selector, kv)
+		}
+		uv, err := strconv.Unquote(strings.TrimSpace(v))
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid selector %q: label %s: %w", selector, k, err)
+		}
+		labels[strings.TrimSpace(k)] = uv
+	}
+
+	return name, labels, nil
+}
+
+func matchLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricsDelta asserts changes of metrics relative to a baseline scraped when it is created.
+// It is meant to be created before scenario steps, and checked after them.
+type MetricsDelta struct {
+	tb   testing.TB
+	c    *http.Client
+	url  string
+	base Metrics
+}
+
+// NewMetricsDelta scrapes the baseline metrics from the given URL.
+// If the client is nil, a client without proxy is used.
+func NewMetricsDelta(tb testing.TB, c *http.Client, metricsURL string) *MetricsDelta {
+	tb.Helper()
+
+	if c == nil {
+		c = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	d := &MetricsDelta{
+		tb:  tb,
+		c:   c,
+		url: metricsURL,
+	}
+	d.Reset()
+
+	return d
+}
+
+// Reset scrapes a new baseline.
+func (d *MetricsDelta) Reset() {
+	d.tb.Helper()
+
+	m, err := ScrapeMetrics(d.c, d.url)
+	if err != nil {
+		d.tb.Fatalf("scrape metrics: %s", err)
+	}
+	d.base = m
+}
+
+// Expect asserts that the value of the selector increased by delta since the baseline.
+// See Metrics.Value for the selector syntax.
+func (d *MetricsDelta) Expect(selector string, delta float64) *MetricsDelta {
+	d.tb.Helper()
+
+	got := d.delta(selector)
+	if got != delta {
+		d.tb.Errorf("metric %s: expected delta %g, got %g", selector, delta, got)
+	}
+	return d
+}
+
+// ExpectAtLeast asserts that the value of the selector increased by at least delta since the baseline.
+// It is useful for metrics that may be affected by concurrent tests.
+func (d *MetricsDelta) ExpectAtLeast(selector string, delta float64) *MetricsDelta {
+	d.tb.Helper()
+
+	got := d.delta(selector)
+	if got < delta {
+		d.tb.Errorf("metric %s: expected delta at least %g, got %g", selector, delta, got)
+	}
+	return d
+}
+
+func (d *MetricsDelta) delta(selector string) float64 {
+	d.tb.Helper()
+
+	m, err := ScrapeMetrics(d.c, d.url)
+	if err != nil {
+		d.tb.Fatalf("scrape metrics: %s", err)
+	}
+
+	before, err := d.base.Value(selector)
+	if err != nil {
+		d.tb.Fatal(err)
+	}
+	after, err := m.Value(selector)
+	if err != nil {
+		d.tb.Fatal(err)
+	}
+
+	return after - before
+}
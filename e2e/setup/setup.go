@@ -16,6 +16,9 @@ type Setup struct {
 	Name    string
 	Compose *compose.Compose
 	Run     string
+
+	// Chaos actions are applied in order in the soak mode.
+	Chaos []ChaosAction
 }
 
 type Runner struct {
@@ -23,6 +26,9 @@ type Runner struct {
 	SetupRegexp *regexp.Regexp
 	Decorate    func(*Setup)
 	Debug       bool
+
+	// Soak enables the long-running mode, see Soak.
+	Soak *Soak
 }
 
 func (r *Runner) Run() error {
@@ -35,7 +41,11 @@ func (r *Runner) Run() error {
 		if r.Decorate != nil {
 			r.Decorate(s)
 		}
-		if err := s.Compose.Run(makeTestCallback(s.Run, r.Debug), r.Debug); err != nil {
+		callback := makeTestCallback(s.Run, r.Debug)
+		if r.Soak != nil {
+			callback = makeSoakCallback(s.Run, r.Soak, s.Chaos, r.Debug)
+		}
+		if err := s.Compose.Run(callback, r.Debug); err != nil {
 			return err
 		}
 		if r.Debug {
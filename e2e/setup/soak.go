@@ -0,0 +1,160 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package setup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// composeProject is the docker compose project name, it is the name of the e2e directory.
+const composeProject = "forwarder-e2e"
+
+// Soak configures the long-running mode.
+// The test runs for Duration while generating traffic, and chaos actions are applied to the services every Interval.
+// The test fails if the error rate exceeds ErrorBudget, or the proxy does not recover after the chaos stops.
+type Soak struct {
+	Duration    time.Duration
+	Interval    time.Duration
+	ErrorBudget float64
+}
+
+func DefaultSoak() *Soak {
+	return &Soak{
+		Duration:    30 * time.Minute,
+		Interval:    time.Minute,
+		ErrorBudget: 0.05,
+	}
+}
+
+func (s *Soak) args() string {
+	return fmt.Sprintf("-soak.duration=%s -soak.error-budget=%g", s.Duration, s.ErrorBudget)
+}
+
+// ChaosAction disturbs the environment, it returns when the environment is restored.
+type ChaosAction struct {
+	Name string
+	Run  func() error
+}
+
+func containerName(service string) string {
+	return composeProject + "-" + service + "-1"
+}
+
+// Restart restarts the service container.
+func Restart(service string) ChaosAction {
+	return ChaosAction{
+		Name: "restart " + service,
+		Run: func() error {
+			return docker("restart", containerName(service))
+		},
+	}
+}
+
+// Flap stops the service container for the duration and starts it again.
+func Flap(service string, d time.Duration) ChaosAction {
+	return ChaosAction{
+		Name: fmt.Sprintf("flap %s for %s", service, d),
+		Run: func() error {
+			if err := docker("stop", containerName(service)); err != nil {
+				return err
+			}
+			time.Sleep(d)
+			return docker("start", containerName(service))
+		},
+	}
+}
+
+// Partition drops all packets of the service container for the duration using tc netem.
+func Partition(service string, d time.Duration) ChaosAction {
+	return Netem(service, d, "loss", "100%")
+}
+
+// Netem applies the tc netem options e.g. "delay", "200ms" to the service container for the duration.
+// The tc command runs in a helper container sharing the network namespace of the service container.
+func Netem(service string, d time.Duration, opts ...string) ChaosAction {
+	tc := func(args ...string) error {
+		return docker(append([]string{
+			"run", "--rm", "--network", "container:" + containerName(service), "--cap-add", "NET_ADMIN",
+			"nicolaka/netshoot", "tc", "qdisc",
+		}, args...)...)
+	}
+
+	return ChaosAction{
+		Name: fmt.Sprintf("netem %v on %s for %s", opts, service, d),
+		Run: func() error {
+			if err := tc(append([]string{"add", "dev", "eth0", "root", "netem"}, opts...)...); err != nil {
+				return err
+			}
+			time.Sleep(d)
+			return tc("del", "dev", "eth0", "root")
+		},
+	}
+}
+
+func docker(args ...string) error {
+	cmd := exec.Command("docker", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("docker %v: %w: %s", args, err, stderr.String())
+	}
+	return nil
+}
+
+// makeSoakCallback runs the test in the background, and applies the chaos actions in order until the test finishes.
+func makeSoakCallback(run string, soak *Soak, actions []ChaosAction, debug bool) func() error {
+	return func() error {
+		cmd := exec.Command("make", "test")
+		cmd.Env = append(os.Environ(), "ARGS="+soak.args())
+		if run != "" {
+			cmd.Env = append(cmd.Env, "RUN="+run)
+		}
+		var out bytes.Buffer
+		if debug {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		} else {
+			cmd.Stdout = &out
+			cmd.Stderr = &out
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+
+		t := time.NewTicker(soak.Interval)
+		defer t.Stop()
+
+		for i := 0; ; {
+			select {
+			case err := <-done:
+				if err != nil {
+					out.WriteTo(os.Stdout)
+				}
+				return err
+			case <-t.C:
+				if len(actions) == 0 {
+					continue
+				}
+				a := actions[i%len(actions)]
+				i++
+				fmt.Println("chaos:", a.Name)
+				if err := a.Run(); err != nil {
+					fmt.Println("chaos:", a.Name, "failed:", err)
+				}
+			}
+		}
+	}
+}
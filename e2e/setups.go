@@ -12,6 +12,7 @@ import (
 	"github.com/saucelabs/forwarder/e2e/dns"
 	"github.com/saucelabs/forwarder/e2e/forwarder"
 	"github.com/saucelabs/forwarder/e2e/setup"
+	"github.com/saucelabs/forwarder/e2e/upstream"
 	"github.com/saucelabs/forwarder/utils/compose"
 )
 
@@ -45,6 +46,16 @@ func AllSetups() []setup.Setup {
 	SetupFlagDirectDomains(l)
 	SetupFlagRateLimit(l)
 	SetupSC2450(l)
+	SetupUpstreamInterop(l)
+
+	return l.Build()
+}
+
+// SoakSetups returns the setups run in the soak mode.
+func SoakSetups() []setup.Setup {
+	l := &setupList{}
+
+	SetupSoak(l)
 
 	return l.Build()
 }
@@ -456,3 +467,97 @@ func SetupSC2450(l *setupList) {
 		Run: "^TestSC2450$",
 	})
 }
+
+func SetupUpstreamInterop(l *setupList) {
+	const run = "^TestUpstreamInterop$"
+
+	for _, httpbinScheme := range forwarder.HttpbinSchemes {
+		l.Add(
+			setup.Setup{
+				Name: "upstream-squid-ntlm-" + httpbinScheme,
+				Compose: compose.NewBuilder().
+					AddService(
+						forwarder.HttpbinService().
+							WithProtocol(httpbinScheme)).
+					AddService(
+						forwarder.ProxyService().
+							WithUpstream(upstream.SquidServiceName, "http").
+							WithCredentials("u1:p1", upstream.SquidServiceName+":3128")).
+					AddService(
+						upstream.SquidService()).
+					MustBuild(),
+				Run: run,
+			},
+			setup.Setup{
+				Name: "upstream-tinyproxy-" + httpbinScheme,
+				Compose: compose.NewBuilder().
+					AddService(
+						forwarder.HttpbinService().
+							WithProtocol(httpbinScheme)).
+					AddService(
+						forwarder.ProxyService().
+							WithUpstream(upstream.TinyproxyServiceName, "http")).
+					AddService(
+						upstream.TinyproxyService()).
+					MustBuild(),
+				Run: run,
+			},
+			setup.Setup{
+				Name: "upstream-socks5-" + httpbinScheme,
+				Compose: compose.NewBuilder().
+					AddService(
+						forwarder.HttpbinService().
+							WithProtocol(httpbinScheme)).
+					AddService(
+						forwarder.ProxyService().
+							WithUpstream(upstream.SOCKS5ServiceName, "socks5").
+							WithCredentials("u1:p1", upstream.SOCKS5ServiceName+":3128")).
+					AddService(
+						upstream.SOCKS5Service().
+							WithBasicAuth("u1", "p1")).
+					MustBuild(),
+				Run: run,
+			},
+		)
+	}
+
+	for _, proxyScheme := range forwarder.ProxySchemes {
+		l.Add(setup.Setup{
+			Name: "upstream-h2-" + proxyScheme,
+			Compose: compose.NewBuilder().
+				AddService(
+					forwarder.HttpbinService()).
+				AddService(
+					forwarder.ProxyService().
+						WithProtocol(proxyScheme)).
+				AddService(
+					upstream.H2Service()).
+				MustBuild(),
+			Run: "^TestUpstreamH2$",
+		})
+	}
+}
+
+func SetupSoak(l *setupList) {
+	l.Add(setup.Setup{
+		Name: "soak-upstream",
+		Compose: compose.NewBuilder().
+			AddService(
+				forwarder.HttpbinService()).
+			AddService(
+				forwarder.ProxyService().
+					WithUpstream(forwarder.UpstreamProxyServiceName, "http").
+					WithHTTPDialTimeout(5 * time.Second)).
+			AddService(
+				forwarder.UpstreamProxyService()).
+			MustBuild(),
+		Run: "^TestSoak$",
+		Chaos: []setup.ChaosAction{
+			setup.Restart(forwarder.UpstreamProxyServiceName),
+			setup.Partition(forwarder.UpstreamProxyServiceName, 10*time.Second),
+			setup.Flap(forwarder.HttpbinServiceName, 10*time.Second),
+			setup.Netem(forwarder.UpstreamProxyServiceName, 30*time.Second, "delay", "200ms", "50ms"),
+			setup.Restart(forwarder.HttpbinServiceName),
+		},
+	})
+}
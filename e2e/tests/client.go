@@ -13,7 +13,9 @@ import (
 	"net/http"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/saucelabs/forwarder/e2e/setup"
 	"github.com/saucelabs/forwarder/utils/httpexpect"
 )
 
@@ -87,3 +89,13 @@ func newClient(t *testing.T, baseURL string, opts ...func(tr *http.Transport)) *
 	// c.Trace(true)
 	return c
 }
+
+// newMetricsDelta returns a MetricsDelta with the baseline scraped from the proxy API metrics endpoint.
+func newMetricsDelta(t *testing.T) *setup.MetricsDelta {
+	t.Helper()
+
+	tr := newTransport(t)
+	tr.Proxy = nil
+
+	return setup.NewMetricsDelta(t, &http.Client{Transport: tr, Timeout: 30 * time.Second}, proxyAPI+"/metrics")
+}
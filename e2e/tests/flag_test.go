@@ -141,8 +141,10 @@ func TestFlagMITMDomains(t *testing.T) {
 
 func TestFlagDenyDomains(t *testing.T) {
 	t.Run("include(google)", func(t *testing.T) {
+		m := newMetricsDelta(t)
 		newClient(t, "https://www.google.com").GET("/").
 			ExpectStatus(http.StatusForbidden)
+		m.Expect(`proxy_errors_total{reason="denied"}`, 1)
 	})
 
 	t.Run("exclude(httpbin)", func(t *testing.T) {
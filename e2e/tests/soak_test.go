@@ -0,0 +1,119 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build e2e
+
+package tests
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/e2e/setup"
+)
+
+var soakArgs = struct {
+	duration           *time.Duration
+	errorBudget        *float64
+	workers            *int
+	maxGoroutineGrowth *float64
+}{
+	duration:           flag.Duration("soak.duration", 0, "Duration of the soak test, zero skips the test"),
+	errorBudget:        flag.Float64("soak.error-budget", 0.05, "Maximal ratio of failed requests"),
+	workers:            flag.Int("soak.workers", 8, "Number of concurrent clients"),
+	maxGoroutineGrowth: flag.Float64("soak.max-goroutine-growth", 100, "Maximal increase of the proxy goroutines after the test"),
+}
+
+func TestSoak(t *testing.T) {
+	if *soakArgs.duration <= 0 {
+		t.Skip("soak duration not set")
+	}
+
+	tr := newTransport(t)
+	apiTr := newTransport(t)
+	apiTr.Proxy = nil
+	api := &http.Client{Transport: apiTr, Timeout: 30 * time.Second}
+	c := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+
+	get := func() bool {
+		res, err := c.Get(httpbin + "/stream-bytes/4096") //nolint:noctx // The client timeout is used.
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		_, err = io.Copy(io.Discard, res.Body)
+		return err == nil && res.StatusCode == http.StatusOK
+	}
+
+	// Warm up connection pools before taking the baseline.
+	for i := 0; i < *soakArgs.workers; i++ {
+		get()
+	}
+	baseGoroutines := proxyGoroutines(t, api)
+
+	var total, failed atomic.Int64
+	deadline := time.Now().Add(*soakArgs.duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < *soakArgs.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				total.Add(1)
+				if !get() {
+					failed.Add(1)
+					time.Sleep(100 * time.Millisecond)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	ratio := float64(failed.Load()) / float64(total.Load())
+	t.Logf("requests=%d failed=%d ratio=%.4f", total.Load(), failed.Load(), ratio)
+	if ratio > *soakArgs.errorBudget {
+		t.Errorf("error budget exceeded: %.4f > %.4f", ratio, *soakArgs.errorBudget)
+	}
+
+	// The proxy must recover after the chaos actions.
+	recovered := false
+	for end := time.Now().Add(time.Minute); time.Now().Before(end); time.Sleep(time.Second) {
+		if get() {
+			recovered = true
+			break
+		}
+	}
+	if !recovered {
+		t.Fatal("proxy did not recover")
+	}
+
+	// Let idle connections and tunnels close before checking for leaks.
+	tr.CloseIdleConnections()
+	time.Sleep(10 * time.Second)
+	if g := proxyGoroutines(t, api); g-baseGoroutines > *soakArgs.maxGoroutineGrowth {
+		t.Errorf("goroutine leak: %.0f goroutines before, %.0f after", baseGoroutines, g)
+	}
+}
+
+func proxyGoroutines(t *testing.T, c *http.Client) float64 {
+	t.Helper()
+
+	m, err := setup.ScrapeMetrics(c, proxyAPI+"/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := m.Value("go_goroutines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
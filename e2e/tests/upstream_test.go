@@ -0,0 +1,30 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build e2e
+
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/saucelabs/forwarder/e2e/upstream"
+)
+
+func TestUpstreamInterop(t *testing.T) {
+	c := newClient(t, httpbin)
+	c.GET("/status/200").ExpectStatus(http.StatusOK)
+	c.GET("/stream-bytes/1048576").ExpectStatus(http.StatusOK).ExpectBodySize(1048576)
+}
+
+func TestUpstreamH2(t *testing.T) {
+	newClient(t, "https://"+upstream.H2ServiceName+":"+upstream.H2ServicePort, func(tr *http.Transport) {
+		tr.ForceAttemptHTTP2 = true
+	}).GET("/").
+		ExpectStatus(http.StatusOK).
+		ExpectHeader("X-Protocol", "HTTP/2.0")
+}
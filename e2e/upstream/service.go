@@ -0,0 +1,107 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package upstream provides third-party services used as upstream proxies and origin servers,
+// they are used to catch interoperability regressions with other implementations.
+package upstream
+
+import (
+	"time"
+
+	"github.com/saucelabs/forwarder/utils/compose"
+)
+
+type service compose.Service
+
+const (
+	SquidImage     = "ubuntu/squid:latest"
+	TinyproxyImage = "vimagick/tinyproxy:latest"
+	SOCKS5Image    = "serjs/go-socks5-proxy:latest"
+	H2Image        = "nginx:alpine"
+
+	// Proxy services listen on the same port as forwarder, so that they can replace the upstream-proxy service.
+	SquidServiceName     = "squid"
+	TinyproxyServiceName = "tinyproxy"
+	SOCKS5ServiceName    = "socks5"
+
+	H2ServiceName = "h2-upstream"
+	H2ServicePort = "8443"
+)
+
+// SquidService returns Squid that requires proxy authentication, it offers NTLM and Basic schemes.
+// Any credentials are accepted.
+func SquidService() *service { //nolint:revive,golint // Unexported by design.
+	return &service{
+		Name:        SquidServiceName,
+		Image:       SquidImage,
+		Environment: map[string]string{},
+		Volumes: []string{
+			"./upstream/squid.conf:/etc/squid/squid.conf:ro",
+		},
+		HealthCheck: healthCheck(),
+	}
+}
+
+// TinyproxyService returns tinyproxy without authentication.
+func TinyproxyService() *service { //nolint:revive,golint // Unexported by design.
+	return &service{
+		Name:        TinyproxyServiceName,
+		Image:       TinyproxyImage,
+		Environment: map[string]string{},
+		Volumes: []string{
+			"./upstream/tinyproxy.conf:/etc/tinyproxy/tinyproxy.conf:ro",
+		},
+		HealthCheck: healthCheck(),
+	}
+}
+
+// SOCKS5Service returns a SOCKS5 server, use WithBasicAuth to require authentication.
+func SOCKS5Service() *service { //nolint:revive,golint // Unexported by design.
+	return &service{
+		Name:  SOCKS5ServiceName,
+		Image: SOCKS5Image,
+		Environment: map[string]string{
+			"PROXY_PORT": "3128",
+		},
+		HealthCheck: healthCheck(),
+	}
+}
+
+// H2Service returns an HTTPS origin server that supports HTTP/2.
+// It responds with 200 OK to any request, the X-Protocol header contains the protocol used.
+func H2Service() *service { //nolint:revive,golint // Unexported by design.
+	return &service{
+		Name:        H2ServiceName,
+		Image:       H2Image,
+		Environment: map[string]string{},
+		Volumes: []string{
+			"./upstream/nginx.conf:/etc/nginx/conf.d/default.conf:ro",
+			"./certs/" + H2ServiceName + ".crt:/etc/nginx/certs/" + H2ServiceName + ".crt:ro",
+			"./certs/" + H2ServiceName + ".key:/etc/nginx/private/" + H2ServiceName + ".key:ro",
+		},
+		HealthCheck: healthCheck(),
+	}
+}
+
+// WithBasicAuth sets the SOCKS5 server username and password.
+func (s *service) WithBasicAuth(user, password string) *service {
+	s.Environment["PROXY_USER"] = user
+	s.Environment["PROXY_PASSWORD"] = password
+	return s
+}
+
+func (s *service) Service() *compose.Service {
+	return (*compose.Service)(s)
+}
+
+// healthCheck only waits for the service to start, the images do not share a common probe tool.
+func healthCheck() *compose.HealthCheck {
+	return &compose.HealthCheck{
+		StartPeriod: 5 * time.Second,
+		Retries:     1,
+		Test:        []string{"CMD", "true"},
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+func isEventStream(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// skipEventStreams returns a response modifier that does not modify Server-Sent Events responses,
+// unless HTTPProxyConfig.ModifyEventStreams is set.
+// Modifiers may buffer the body e.g. BodyReplaceModifier, which would delay events until the buffer is full.
+func (hp *HTTPProxy) skipEventStreams(m ResponseModifier) ResponseModifier {
+	if hp.config.ModifyEventStreams {
+		return m
+	}
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		if isEventStream(res.Header) {
+			return nil
+		}
+		return m.ModifyResponse(res)
+	})
+}
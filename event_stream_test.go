@@ -0,0 +1,102 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestEventStream(t *testing.T) {
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		if r.URL.Query().Has("wait") {
+			<-release
+		}
+	}))
+	defer origin.Close()
+
+	newProxy := func(t *testing.T, modify bool) *HTTPProxy {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.ProxyLocalhost = AllowProxyLocalhost
+		cfg.ModifyEventStreams = modify
+		cfg.Modifiers = []Modifier{
+			&BodyReplaceModifier{
+				Response:    true,
+				Pattern:     regexp.MustCompile("hello"),
+				Replacement: []byte("bye"),
+				MaxBodySize: Mebi,
+			},
+		}
+		p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+
+	get := func(t *testing.T, p *HTTPProxy, url string) *bufio.Reader {
+		t.Helper()
+
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go req.WriteProxy(conn) //nolint:errcheck // the response is checked
+
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bufio.NewReader(res.Body)
+	}
+
+	t.Run("streamed", func(t *testing.T) {
+		r := get(t, newProxy(t, false), origin.URL+"/?wait")
+		line, err := r.ReadString('\n')
+		close(release)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "data: hello\n" {
+			t.Fatalf("expected unmodified event, got %q", line)
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		r := get(t, newProxy(t, true), origin.URL)
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "data: bye\n\n" {
+			t.Fatalf("expected modified event, got %q", b)
+		}
+	})
+}
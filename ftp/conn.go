@@ -0,0 +1,279 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package ftp provides a minimal FTP client and an http.RoundTripper
+// that serves ftp:// URLs as HTTP responses.
+package ftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Reply codes used by the client, see RFC 959.
+const (
+	statusReady         = 220
+	statusLoggedIn      = 230
+	statusUserOK        = 331
+	statusExtendedPasv  = 229
+	statusPasv          = 227
+	statusFileStatus    = 213
+	statusFileUnavail   = 550
+	statusNotLoggedIn   = 530
+	statusAboutToSend   = 150
+	statusAlreadyOpen   = 125
+	statusClosingData   = 226
+	statusRequestedFile = 250
+	statusCommandOK     = 200
+)
+
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Conn is an FTP control connection.
+// It supports passive mode data transfers only.
+type Conn struct {
+	conn net.Conn
+	tp   *textproto.Conn
+	dial DialContextFunc
+	host string
+}
+
+// Dial connects to the FTP server at addr and reads the server greeting.
+func Dial(ctx context.Context, dial DialContextFunc, addr string) (*Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d) //nolint:errcheck // best effort
+	}
+
+	c := &Conn{
+		conn: conn,
+		tp:   textproto.NewConn(conn),
+		dial: dial,
+		host: host,
+	}
+	if _, _, err := c.tp.ReadResponse(statusReady); err != nil {
+		c.tp.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ErrInvalidArgument is returned when a command argument contains CR, LF or NUL,
+// which would allow injecting commands into the control connection.
+var ErrInvalidArgument = errors.New("ftp: invalid character in command argument")
+
+// ValidArgument reports whether s can be safely sent as a command argument.
+func ValidArgument(s string) bool {
+	return !strings.ContainsAny(s, "\r\n\x00")
+}
+
+func (c *Conn) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	for _, a := range args {
+		if s, ok := a.(string); ok && !ValidArgument(s) {
+			return 0, "", ErrInvalidArgument
+		}
+	}
+	if _, err := c.tp.Cmd(format, args...); err != nil {
+		return 0, "", err
+	}
+	return c.tp.ReadResponse(expectCode)
+}
+
+// Login authenticates the connection, the password is sent only if requested by the server.
+func (c *Conn) Login(user, pass string) error {
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case statusLoggedIn:
+		return nil
+	case statusUserOK:
+		_, _, err = c.cmd(statusLoggedIn, "PASS %s", pass)
+		return err
+	default:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+}
+
+// Type sets the transfer type, use "I" for binary and "A" for ASCII.
+func (c *Conn) Type(t string) error {
+	_, _, err := c.cmd(statusCommandOK, "TYPE %s", t)
+	return err
+}
+
+// Size returns the size of the file at path.
+func (c *Conn) Size(path string) (int64, error) {
+	_, msg, err := c.cmd(statusFileStatus, "SIZE %s", path)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+}
+
+// Cwd changes the working directory.
+func (c *Conn) Cwd(path string) error {
+	_, _, err := c.cmd(statusRequestedFile, "CWD %s", path)
+	return err
+}
+
+// Retr returns a reader for the file at path.
+// The reader must be closed before issuing another command.
+func (c *Conn) Retr(ctx context.Context, path string) (io.ReadCloser, error) {
+	return c.transfer(ctx, "RETR %s", path)
+}
+
+// NameList returns a reader for the names of the files in the directory at path.
+// The reader must be closed before issuing another command.
+func (c *Conn) NameList(ctx context.Context, path string) (io.ReadCloser, error) {
+	return c.transfer(ctx, "NLST %s", path)
+}
+
+func (c *Conn) transfer(ctx context.Context, format string, args ...any) (io.ReadCloser, error) {
+	dc, err := c.openDataConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	code, msg, err := c.cmd(1, format, args...)
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	if code != statusAboutToSend && code != statusAlreadyOpen {
+		dc.Close()
+		return nil, &textproto.Error{Code: code, Msg: msg}
+	}
+
+	return &dataReader{Conn: dc, c: c}, nil
+}
+
+// openDataConn enters passive mode and dials the data connection.
+// The address returned by the server is ignored in favor of the control connection host
+// to avoid problems with servers behind NAT and FTP bounce attacks.
+func (c *Conn) openDataConn(ctx context.Context) (net.Conn, error) {
+	port, err := c.epsv()
+	if err != nil {
+		if port, err = c.pasv(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.dial(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+}
+
+func (c *Conn) epsv() (int, error) {
+	_, msg, err := c.cmd(statusExtendedPasv, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+	return parseEPSV(msg)
+}
+
+func (c *Conn) pasv() (int, error) {
+	_, msg, err := c.cmd(statusPasv, "PASV")
+	if err != nil {
+		return 0, err
+	}
+	return parsePASV(msg)
+}
+
+// parseEPSV parses the port from the EPSV reply e.g. "Entering Extended Passive Mode (|||6446|)".
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start == -1 || end <= start {
+		return 0, fmt.Errorf("invalid EPSV response: %q", msg)
+	}
+
+	s := msg[start+1 : end]
+	if len(s) < 5 {
+		return 0, fmt.Errorf("invalid EPSV response: %q", msg)
+	}
+	d := s[0:1]
+	f := strings.Split(s, d)
+	if len(f) != 5 {
+		return 0, fmt.Errorf("invalid EPSV response: %q", msg)
+	}
+
+	return parsePort(f[3])
+}
+
+// parsePASV parses the port from the PASV reply e.g. "Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+func parsePASV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start == -1 || end <= start {
+		return 0, fmt.Errorf("invalid PASV response: %q", msg)
+	}
+
+	f := strings.Split(msg[start+1:end], ",")
+	if len(f) != 6 {
+		return 0, fmt.Errorf("invalid PASV response: %q", msg)
+	}
+	p1, err := strconv.ParseUint(f[4], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PASV response: %q", msg)
+	}
+	p2, err := strconv.ParseUint(f[5], 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid PASV response: %q", msg)
+	}
+
+	return parsePort(strconv.FormatUint(p1<<8|p2, 10))
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("port: %w", err)
+	}
+	if p == 0 {
+		return 0, fmt.Errorf("port cannot be 0")
+	}
+	return int(p), nil
+}
+
+// Quit ends the session and closes the connection.
+func (c *Conn) Quit() error {
+	c.tp.Cmd("QUIT") //nolint:errcheck // closing anyway
+	return c.tp.Close()
+}
+
+// dataReader reads from the data connection and reads the transfer completion reply on Close.
+type dataReader struct {
+	net.Conn
+	c *Conn
+}
+
+func (r *dataReader) Close() error {
+	if err := r.Conn.Close(); err != nil {
+		return err
+	}
+	code, msg, err := r.c.tp.ReadResponse(2)
+	if err != nil {
+		return err
+	}
+	if code != statusClosingData && code != statusRequestedFile {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	return nil
+}
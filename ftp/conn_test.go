@@ -0,0 +1,119 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ftp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/ftp/ftptest"
+)
+
+func TestParsePassiveReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(string) (int, error)
+		msg   string
+		port  int
+		err   bool
+	}{
+		{
+			name:  "epsv",
+			parse: parseEPSV,
+			msg:   "Entering Extended Passive Mode (|||6446|)",
+			port:  6446,
+		},
+		{
+			name:  "epsv custom delimiter",
+			parse: parseEPSV,
+			msg:   "Entering Extended Passive Mode (!!!6446!)",
+			port:  6446,
+		},
+		{
+			name:  "epsv missing port",
+			parse: parseEPSV,
+			msg:   "Entering Extended Passive Mode (||||)",
+			err:   true,
+		},
+		{
+			name:  "epsv no parens",
+			parse: parseEPSV,
+			msg:   "Entering Extended Passive Mode",
+			err:   true,
+		},
+		{
+			name:  "pasv",
+			parse: parsePASV,
+			msg:   "Entering Passive Mode (192,168,1,2,25,46)",
+			port:  25<<8 | 46,
+		},
+		{
+			name:  "pasv invalid port byte",
+			parse: parsePASV,
+			msg:   "Entering Passive Mode (192,168,1,2,256,46)",
+			err:   true,
+		},
+		{
+			name:  "pasv zero port",
+			parse: parsePASV,
+			msg:   "Entering Passive Mode (192,168,1,2,0,0)",
+			err:   true,
+		},
+		{
+			name:  "pasv short",
+			parse: parsePASV,
+			msg:   "Entering Passive Mode (192,168,1,2)",
+			err:   true,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			port, err := tc.parse(tc.msg)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got port %d", port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != tc.port {
+				t.Fatalf("expected port %d, got %d", tc.port, port)
+			}
+		})
+	}
+}
+
+func TestConnRejectsInvalidArgument(t *testing.T) {
+	s := ftptest.NewServer("", "", nil)
+	defer s.Close()
+
+	var d net.Dialer
+	c, err := Dial(context.Background(), d.DialContext, s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	if err := c.Login("anonymous\r\nDELE x", "pass"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	if err := c.Cwd("/\nDELE x"); !errors.Is(err, ErrInvalidArgument) {
+		t.Fatalf("expected ErrInvalidArgument, got %v", err)
+	}
+	for _, cmd := range s.Commands() {
+		if strings.HasPrefix(cmd, "DELE") {
+			t.Fatalf("injected command reached the server: %q", cmd)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package ftptest provides an in-process FTP server for testing.
+package ftptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a minimal FTP server serving files from memory.
+// It supports passive mode (EPSV) data transfers only.
+type Server struct {
+	// Addr is the address of the server in the form host:port.
+	Addr string
+
+	user  string
+	pass  string
+	files map[string]string
+
+	l  net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// NewServer starts a server serving files, the keys are absolute file paths.
+// If user is empty, any user is logged in without a password.
+func NewServer(user, pass string, files map[string]string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("ftptest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		Addr:  l.Addr().String(),
+		user:  user,
+		pass:  pass,
+		files: files,
+		l:     l,
+	}
+	s.wg.Add(1)
+	go s.serve()
+
+	return s
+}
+
+// Close stops the server and waits for active sessions to finish.
+func (s *Server) Close() {
+	s.l.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Commands returns the commands received by the server in order.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// isDir reports whether p is a directory, i.e. a prefix of a file path.
+func (s *Server) isDir(p string) bool {
+	if p == "/" {
+		return true
+	}
+	for f := range s.files {
+		if strings.HasPrefix(f, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the sorted names of the directory entries.
+func (s *Server) list(dir string) []string {
+	seen := make(map[string]bool)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for f := range s.files {
+		if rest, ok := strings.CutPrefix(f, prefix); ok {
+			name, _, _ := strings.Cut(rest, "/")
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type session struct {
+	w        *bufio.Writer
+	user     string
+	loggedIn bool
+	cwd      string
+	data     net.Listener
+}
+
+func (ss *session) reply(code int, msg string) {
+	fmt.Fprintf(ss.w, "%d %s\r\n", code, msg)
+	ss.w.Flush()
+}
+
+func (ss *session) abs(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(ss.cwd, p)
+	}
+	return path.Clean(p)
+}
+
+// transfer accepts the data connection and writes data to it.
+func (ss *session) transfer(data string) {
+	defer func() {
+		ss.data.Close()
+		ss.data = nil
+	}()
+
+	ss.reply(150, "Opening data connection")
+	dc, err := ss.data.Accept()
+	if err != nil {
+		ss.reply(425, "Can't open data connection")
+		return
+	}
+	_, err = dc.Write([]byte(data))
+	dc.Close()
+	if err != nil {
+		ss.reply(426, "Connection closed, transfer aborted")
+		return
+	}
+	ss.reply(226, "Transfer complete")
+}
+
+func (s *Server) handle(conn net.Conn) {
+	ss := &session{
+		w:   bufio.NewWriter(conn),
+		cwd: "/",
+	}
+	defer func() {
+		if ss.data != nil {
+			ss.data.Close()
+		}
+	}()
+
+	ss.reply(220, "ftptest ready")
+
+	r := bufio.NewScanner(conn)
+	for r.Scan() {
+		line := strings.TrimSpace(r.Text())
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+
+		switch cmd {
+		case "USER":
+			ss.user = arg
+			if s.user == "" {
+				ss.loggedIn = true
+				ss.reply(230, "Logged in")
+			} else {
+				ss.reply(331, "Password required")
+			}
+			continue
+		case "PASS":
+			if ss.user == s.user && arg == s.pass {
+				ss.loggedIn = true
+				ss.reply(230, "Logged in")
+			} else {
+				ss.reply(530, "Login incorrect")
+			}
+			continue
+		case "QUIT":
+			ss.reply(221, "Bye")
+			return
+		}
+
+		if !ss.loggedIn {
+			ss.reply(530, "Not logged in")
+			continue
+		}
+
+		switch cmd {
+		case "TYPE":
+			ss.reply(200, "Type set to "+arg)
+		case "CWD":
+			if p := ss.abs(arg); s.isDir(p) {
+				ss.cwd = p
+				ss.reply(250, "Directory changed")
+			} else {
+				ss.reply(550, "No such directory")
+			}
+		case "SIZE":
+			if f, ok := s.files[ss.abs(arg)]; ok {
+				ss.reply(213, strconv.Itoa(len(f)))
+			} else {
+				ss.reply(550, "No such file")
+			}
+		case "EPSV":
+			if ss.data != nil {
+				ss.data.Close()
+			}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				ss.reply(425, "Can't open data connection")
+				continue
+			}
+			ss.data = l
+			ss.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", l.Addr().(*net.TCPAddr).Port)) //nolint:forcetypeassert // TCP listener
+		case "RETR", "NLST":
+			if ss.data == nil {
+				ss.reply(425, "Use EPSV first")
+				continue
+			}
+			var (
+				data string
+				ok   bool
+			)
+			if cmd == "RETR" {
+				data, ok = s.files[ss.abs(arg)]
+			} else if p := ss.abs(arg); s.isDir(p) {
+				data, ok = strings.Join(s.list(p), "\r\n"), true
+			}
+			if !ok {
+				ss.data.Close()
+				ss.data = nil
+				ss.reply(550, "No such file or directory")
+				continue
+			}
+			ss.transfer(data)
+		default:
+			ss.reply(502, "Command not implemented")
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ftp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strings"
+	"time"
+)
+
+// Transport is an http.RoundTripper that handles ftp:// URLs.
+// Files are returned as is, directories are rendered as HTML listings.
+// Only GET and HEAD requests are supported.
+//
+// Basic authentication credentials from the request are used to log in,
+// if not set, the URL user info is used, and finally anonymous login is attempted.
+type Transport struct {
+	// DialContext specifies the dial function for creating control and data connections.
+	DialContext DialContextFunc
+
+	// Timeout is the maximum amount of time for establishing the session,
+	// it does not include the time to read the response body.
+	Timeout time.Duration
+}
+
+const (
+	anonymousUser = "anonymous"
+	anonymousPass = "forwarder@"
+	defaultPort   = "21"
+)
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return textResponse(req, http.StatusMethodNotAllowed, "Only GET and HEAD methods are supported for FTP"), nil
+	}
+
+	if user, pass := credentials(req); !ValidArgument(req.URL.Path) || !ValidArgument(user) || !ValidArgument(pass) {
+		return textResponse(req, http.StatusBadRequest, "Invalid character in FTP path or credentials"), nil
+	}
+
+	ctx := req.Context()
+	if t.Timeout > 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), defaultPort)
+	}
+	c, err := Dial(ctx, t.DialContext, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.roundTrip(ctx, req, c)
+	if err != nil {
+		c.Quit()
+		return nil, err
+	}
+	if _, ok := res.Body.(*sessionBody); ok {
+		// The deadline set for the session must not apply to the body.
+		c.conn.SetDeadline(time.Time{}) //nolint:errcheck // best effort
+	} else {
+		c.Quit()
+	}
+
+	return res, nil
+}
+
+func (t *Transport) roundTrip(ctx context.Context, req *http.Request, c *Conn) (*http.Response, error) {
+	user, pass := credentials(req)
+	if err := c.Login(user, pass); err != nil {
+		if isCode(err, statusNotLoggedIn) {
+			res := textResponse(req, http.StatusUnauthorized, "FTP login failed")
+			res.Header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", "FTP "+req.URL.Host))
+			return res, nil
+		}
+		return nil, err
+	}
+	if err := c.Type("I"); err != nil {
+		return nil, err
+	}
+
+	p := req.URL.Path
+	if p == "" {
+		p = "/"
+	}
+	if strings.HasSuffix(p, "/") {
+		return t.list(ctx, req, c, p)
+	}
+
+	size, err := c.Size(p)
+	if err != nil {
+		size = -1
+	}
+	if req.Method == http.MethodHead {
+		res := newResponse(req, http.StatusOK, http.NoBody)
+		res.ContentLength = size
+		res.Header.Set("Content-Type", contentType(p))
+		return res, nil
+	}
+
+	r, err := c.Retr(ctx, p)
+	if err != nil {
+		if !isCode(err, statusFileUnavail) {
+			return nil, err
+		}
+		// The path may be a directory, redirect to the canonical directory URL.
+		if c.Cwd(p) == nil {
+			u := *req.URL
+			u.Path += "/"
+			u.User = nil
+			res := textResponse(req, http.StatusMovedPermanently, "Moved Permanently")
+			res.Header.Set("Location", u.String())
+			return res, nil
+		}
+		return textResponse(req, http.StatusNotFound, "File not found"), nil
+	}
+
+	res := newResponse(req, http.StatusOK, &sessionBody{ReadCloser: r, c: c})
+	res.ContentLength = size
+	res.Header.Set("Content-Type", contentType(p))
+	return res, nil
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Index of {{.Path}}</title>
+</head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<ul>
+{{if ne .Path "/"}}<li><a href="../">../</a></li>
+{{end}}{{range .Names}}<li><a href="{{.}}">{{.}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+func (t *Transport) list(ctx context.Context, req *http.Request, c *Conn, p string) (*http.Response, error) {
+	if err := c.Cwd(p); err != nil {
+		if isCode(err, statusFileUnavail) {
+			return textResponse(req, http.StatusNotFound, "Directory not found"), nil
+		}
+		return nil, err
+	}
+
+	r, err := c.NameList(ctx, "")
+	if err != nil {
+		// Empty directories are reported as errors by some servers.
+		if !isCode(err, statusFileUnavail) {
+			return nil, err
+		}
+		r = io.NopCloser(strings.NewReader(""))
+	}
+
+	var names []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if n := path.Base(strings.TrimSpace(s.Text())); n != "" && n != "." && n != ".." {
+			names = append(names, n)
+		}
+	}
+	if err := errors.Join(s.Err(), r.Close()); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := listingTemplate.Execute(&buf, struct {
+		Path  string
+		Names []string
+	}{
+		Path:  p,
+		Names: names,
+	}); err != nil {
+		return nil, err
+	}
+
+	res := newResponse(req, http.StatusOK, io.NopCloser(&buf))
+	res.ContentLength = int64(buf.Len())
+	res.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return res, nil
+}
+
+func credentials(req *http.Request) (user, pass string) {
+	if u, p, ok := req.BasicAuth(); ok {
+		return u, p
+	}
+	if u := req.URL.User; u != nil {
+		p, _ := u.Password()
+		return u.Username(), p
+	}
+	return anonymousUser, anonymousPass
+}
+
+func contentType(p string) string {
+	if ct := mime.TypeByExtension(path.Ext(p)); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
+func isCode(err error, code int) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code == code
+}
+
+func newResponse(req *http.Request, code int, body io.ReadCloser) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       body,
+		Request:    req,
+	}
+}
+
+func textResponse(req *http.Request, code int, msg string) *http.Response {
+	res := newResponse(req, code, io.NopCloser(strings.NewReader(msg+"\n")))
+	res.ContentLength = int64(len(msg) + 1)
+	res.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return res
+}
+
+// sessionBody ends the FTP session when the body is closed.
+type sessionBody struct {
+	io.ReadCloser
+	c *Conn
+}
+
+func (b *sessionBody) Close() error {
+	return errors.Join(b.ReadCloser.Close(), b.c.Quit())
+}
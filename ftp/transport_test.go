@@ -0,0 +1,208 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ftp
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/ftp/ftptest"
+)
+
+func TestTransport(t *testing.T) {
+	s := ftptest.NewServer("user", "pass", map[string]string{
+		"/readme.txt":        "hello world\n",
+		"/pub/data.bin":      "\x00\x01\x02",
+		"/pub/docs/a.html":   "<p>a</p>",
+		"/pub/docs/b.html":   "<p>b</p>",
+		"/pub/empty/.hidden": "",
+	})
+	defer s.Close()
+
+	var d net.Dialer
+	tr := &Transport{
+		DialContext: d.DialContext,
+		Timeout:     5 * time.Second,
+	}
+
+	do := func(t *testing.T, method, u string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, u, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	base := "ftp://user:pass@" + s.Addr
+
+	t.Run("login failed", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, "ftp://user:wrong@"+s.Addr+"/readme.txt")
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", res.StatusCode)
+		}
+		if v := res.Header.Get("WWW-Authenticate"); !strings.HasPrefix(v, "Basic ") {
+			t.Fatalf("expected basic auth challenge, got %q", v)
+		}
+	})
+
+	t.Run("anonymous login failed", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, "ftp://"+s.Addr+"/readme.txt")
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "ftp://"+s.Addr+"/readme.txt", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "pass")
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("retr", func(t *testing.T) {
+		res, body := do(t, http.MethodGet, base+"/readme.txt")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		if body != "hello world\n" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		if res.ContentLength != int64(len(body)) {
+			t.Fatalf("expected content length %d, got %d", len(body), res.ContentLength)
+		}
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+	})
+
+	t.Run("head", func(t *testing.T) {
+		res, body := do(t, http.MethodHead, base+"/pub/data.bin")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		if body != "" {
+			t.Fatalf("unexpected body %q", body)
+		}
+		if res.ContentLength != 3 {
+			t.Fatalf("expected content length 3, got %d", res.ContentLength)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/octet-stream" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, base+"/missing.txt")
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("directory redirect", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, base+"/pub/docs")
+		if res.StatusCode != http.StatusMovedPermanently {
+			t.Fatalf("expected status 301, got %d", res.StatusCode)
+		}
+		if loc, want := res.Header.Get("Location"), "ftp://"+s.Addr+"/pub/docs/"; loc != want {
+			t.Fatalf("expected location %q, got %q", want, loc)
+		}
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		res, body := do(t, http.MethodGet, base+"/pub/")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Fatalf("unexpected content type %q", ct)
+		}
+		for _, s := range []string{
+			"<title>Index of /pub/</title>",
+			`<li><a href="../">../</a></li>`,
+			`<li><a href="data.bin">data.bin</a></li>`,
+			`<li><a href="docs">docs</a></li>`,
+			`<li><a href="empty">empty</a></li>`,
+		} {
+			if !strings.Contains(body, s) {
+				t.Errorf("expected listing to contain %q, got:\n%s", s, body)
+			}
+		}
+	})
+
+	t.Run("root listing", func(t *testing.T) {
+		res, body := do(t, http.MethodGet, base)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.StatusCode)
+		}
+		if strings.Contains(body, `href="../"`) {
+			t.Errorf("unexpected parent link in root listing:\n%s", body)
+		}
+		if !strings.Contains(body, `<li><a href="readme.txt">readme.txt</a></li>`) {
+			t.Errorf("expected readme.txt in listing, got:\n%s", body)
+		}
+	})
+
+	t.Run("directory not found", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, base+"/missing/")
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		res, _ := do(t, http.MethodPost, base+"/readme.txt")
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("expected status 405, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("command injection", func(t *testing.T) {
+		before := len(s.Commands())
+		for _, u := range []string{
+			base + "/a%0D%0ADELE%20readme.txt",
+			base + "/a%0ADELE%20readme.txt",
+			base + "/a%00",
+			"ftp://user:pass%0D%0ADELE%20readme.txt@" + s.Addr + "/readme.txt",
+		} {
+			res, _ := do(t, http.MethodGet, u)
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", u, res.StatusCode)
+			}
+		}
+		for _, c := range s.Commands()[before:] {
+			if strings.HasPrefix(c, "DELE") {
+				t.Fatalf("injected command reached the server: %q", c)
+			}
+		}
+		if n := len(s.Commands()) - before; n != 0 {
+			t.Fatalf("expected no commands, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// basicAuth checks the basic authentication credentials in the authorization metadata of calls.
+type basicAuth struct {
+	want []byte
+}
+
+func newBasicAuth(u *url.Userinfo) *basicAuth {
+	pass, _ := u.Password()
+	return &basicAuth{
+		want: []byte("Basic " + base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass))),
+	}
+}
+
+func (a *basicAuth) check(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(v), a.want) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing basic auth credentials")
+}
+
+func (a *basicAuth) unary(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if err := a.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *basicAuth) stream(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := a.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package grpcapi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/saucelabs/forwarder"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// MITMDecider implements forwarder.MITMDecider using the MITMDecision gRPC service.
+type MITMDecider struct {
+	client MITMDecisionClient
+	conn   *grpc.ClientConn
+}
+
+var _ forwarder.MITMDecider = (*MITMDecider)(nil)
+
+// NewMITMDecider returns a decider that uses cc to call the service.
+func NewMITMDecider(cc grpc.ClientConnInterface) *MITMDecider {
+	return &MITMDecider{client: NewMITMDecisionClient(cc)}
+}
+
+// DialMITMDecider connects to the service at target without transport security.
+// The connection is closed by Close.
+func DialMITMDecider(target string) (*MITMDecider, error) {
+	conn, err := grpc.Dial(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	d := NewMITMDecider(conn)
+	d.conn = conn
+	return d, nil
+}
+
+func (d *MITMDecider) DecideMITM(ctx context.Context, req *forwarder.MITMDecisionRequest) (*forwarder.MITMDecision, error) {
+	groups := make([]any, len(req.Groups))
+	for i, g := range req.Groups {
+		groups[i] = g
+	}
+	in, err := structpb.NewStruct(map[string]any{
+		"host":      req.Host,
+		"port":      req.Port,
+		"client_ip": req.ClientIP,
+		"user":      req.User,
+		"groups":    groups,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := d.client.Decide(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+
+	f := out.GetFields()
+	action, ok := f["action"].GetKind().(*structpb.Value_StringValue)
+	if !ok {
+		return nil, fmt.Errorf("action: expected string value")
+	}
+	v := &forwarder.MITMDecision{
+		Action: forwarder.MITMAction(action.StringValue),
+	}
+	if ttl, ok := f["ttl"]; ok {
+		n, ok := ttl.GetKind().(*structpb.Value_NumberValue)
+		if !ok {
+			return nil, fmt.Errorf("ttl: expected number value")
+		}
+		v.TTL = int(n.NumberValue)
+	}
+
+	return v, nil
+}
+
+func (d *MITMDecider) Close() error {
+	if d.conn == nil {
+		return nil
+	}
+	return d.conn.Close()
+}
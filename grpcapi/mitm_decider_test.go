@@ -0,0 +1,58 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package grpcapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/saucelabs/forwarder"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type testMITMDecisionClient struct {
+	in  *structpb.Struct
+	out map[string]any
+}
+
+func (c *testMITMDecisionClient) Decide(_ context.Context, in *structpb.Struct, _ ...grpc.CallOption) (*structpb.Struct, error) {
+	c.in = in
+	return structpb.NewStruct(c.out)
+}
+
+func TestMITMDecider(t *testing.T) {
+	c := &testMITMDecisionClient{out: map[string]any{"action": "block", "ttl": 30}}
+	d := &MITMDecider{client: c}
+
+	v, err := d.DecideMITM(context.Background(), &forwarder.MITMDecisionRequest{
+		Host:     "example.com",
+		Port:     "443",
+		ClientIP: "10.0.0.1",
+		User:     "user",
+		Groups:   []string{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Action != forwarder.MITMActionBlock || v.TTL != 30 {
+		t.Fatalf("unexpected decision %+v", v)
+	}
+
+	f := c.in.GetFields()
+	if f["host"].GetStringValue() != "example.com" || f["port"].GetStringValue() != "443" || f["client_ip"].GetStringValue() != "10.0.0.1" {
+		t.Fatalf("unexpected request %v", c.in)
+	}
+	if g := f["groups"].GetListValue().GetValues(); len(g) != 2 || g[1].GetStringValue() != "b" {
+		t.Fatalf("unexpected groups %v", g)
+	}
+
+	c.out = map[string]any{"ttl": 30}
+	if _, err := d.DecideMITM(context.Background(), &forwarder.MITMDecisionRequest{Host: "example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
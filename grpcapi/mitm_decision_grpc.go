@@ -0,0 +1,92 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// This file follows the layout of protoc-gen-go-grpc output for mitm_decision.proto.
+// The service uses only well-known types, so there are no message types to generate.
+
+const (
+	MITMDecision_Decide_FullMethodName = "/forwarder.mitm.v1.MITMDecision/Decide" //nolint:revive,stylecheck // generated code style
+)
+
+// MITMDecisionClient is the client API for MITMDecision service.
+type MITMDecisionClient interface {
+	Decide(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error)
+}
+
+type mITMDecisionClient struct { //nolint:revive,stylecheck // generated code style
+	cc grpc.ClientConnInterface
+}
+
+func NewMITMDecisionClient(cc grpc.ClientConnInterface) MITMDecisionClient {
+	return &mITMDecisionClient{cc}
+}
+
+func (c *mITMDecisionClient) Decide(ctx context.Context, in *structpb.Struct, opts ...grpc.CallOption) (*structpb.Struct, error) {
+	out := new(structpb.Struct)
+	if err := c.cc.Invoke(ctx, MITMDecision_Decide_FullMethodName, in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MITMDecisionServer is the server API for MITMDecision service.
+type MITMDecisionServer interface {
+	Decide(context.Context, *structpb.Struct) (*structpb.Struct, error)
+}
+
+// UnimplementedMITMDecisionServer can be embedded to have forward compatible implementations.
+type UnimplementedMITMDecisionServer struct{}
+
+func (UnimplementedMITMDecisionServer) Decide(context.Context, *structpb.Struct) (*structpb.Struct, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Decide not implemented")
+}
+
+func RegisterMITMDecisionServer(s grpc.ServiceRegistrar, srv MITMDecisionServer) {
+	s.RegisterService(&MITMDecision_ServiceDesc, srv)
+}
+
+func _MITMDecision_Decide_Handler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) { //nolint:revive,stylecheck // generated code style
+	in := new(structpb.Struct)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MITMDecisionServer).Decide(ctx, in) //nolint:forcetypeassert // registered with MITMDecisionServer
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MITMDecision_Decide_FullMethodName,
+	}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return srv.(MITMDecisionServer).Decide(ctx, req.(*structpb.Struct)) //nolint:forcetypeassert // registered with MITMDecisionServer
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MITMDecision_ServiceDesc is the grpc.ServiceDesc for MITMDecision service.
+var MITMDecision_ServiceDesc = grpc.ServiceDesc{ //nolint:revive,stylecheck // generated code style
+	ServiceName: "forwarder.mitm.v1.MITMDecision",
+	HandlerType: (*MITMDecisionServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Decide",
+			Handler:    _MITMDecision_Decide_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "mitm_decision.proto",
+}
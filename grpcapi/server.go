@@ -0,0 +1,227 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package grpcapi provides a gRPC admin service for managing forwarder instances.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// RuntimeConfigurer is implemented by forwarder.HTTPProxy.
+type RuntimeConfigurer interface {
+	RuntimeConfig() forwarder.RuntimeConfig
+	SetRuntimeConfig(rc forwarder.RuntimeConfig) error
+}
+
+// Server implements AdminServer.
+// Values are applied on top of the runtime configuration the server was created with.
+type Server struct {
+	UnimplementedAdminServer
+
+	proxy  RuntimeConfigurer
+	base   forwarder.RuntimeConfig
+	limits *ruleset.RegexpLimits
+	log    log.Logger
+
+	mu      sync.Mutex
+	values  map[string]string
+	changed chan struct{}
+}
+
+// NewServer creates a new admin server, regexp rules set with the API are checked against the limits, if not nil.
+func NewServer(proxy RuntimeConfigurer, limits *ruleset.RegexpLimits, log log.Logger) *Server {
+	return &Server{
+		proxy:   proxy,
+		base:    proxy.RuntimeConfig(),
+		limits:  limits,
+		log:     log,
+		values:  make(map[string]string),
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *Server) snapshot() (*structpb.Struct, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fields := make(map[string]*structpb.Value, len(s.values))
+	for k, v := range s.values {
+		if k == forwarder.RuntimeConfigCredentials {
+			v = redactCredentials(v)
+		}
+		fields[k] = structpb.NewStringValue(v)
+	}
+
+	return &structpb.Struct{Fields: fields}, s.changed
+}
+
+func (s *Server) GetRuntimeConfig(context.Context, *emptypb.Empty) (*structpb.Struct, error) {
+	v, _ := s.snapshot()
+	return v, nil
+}
+
+func (s *Server) UpdateRuntimeConfig(ctx context.Context, in *structpb.Struct) (*structpb.Struct, error) {
+	if err := s.update(in); err != nil {
+		return nil, err
+	}
+	return s.GetRuntimeConfig(ctx, nil)
+}
+
+func (s *Server) update(in *structpb.Struct) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		values[k] = v
+	}
+	for k, v := range in.GetFields() {
+		switch x := v.GetKind().(type) {
+		case *structpb.Value_StringValue:
+			values[k] = x.StringValue
+		case *structpb.Value_NullValue:
+			delete(values, k)
+		default:
+			return status.Errorf(codes.InvalidArgument, "%s: expected string or null value", k)
+		}
+	}
+
+	rc, err := forwarder.ParseRuntimeConfigValues(s.base, values, s.limits, s.log)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.proxy.SetRuntimeConfig(rc); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	s.values = values
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+func (s *Server) Watch(_ *emptypb.Empty, stream Admin_WatchServer) error {
+	for {
+		v, changed := s.snapshot()
+		if err := stream.Send(v); err != nil {
+			return err
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+func redactCredentials(v string) string {
+	lines := strings.Split(v, "\n")
+	for i, l := range lines {
+		up, hp, ok := strings.Cut(strings.TrimSpace(l), "@")
+		if !ok {
+			continue
+		}
+		if u, _, ok := strings.Cut(up, ":"); ok {
+			lines[i] = u + ":xxxxx@" + hp
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ServerConfig is the configuration of the gRPC admin API server.
+type ServerConfig struct {
+	Addr string
+
+	// Protocol is http for plaintext HTTP/2, or https for TLS.
+	Protocol forwarder.Scheme
+	forwarder.TLSServerConfig
+
+	// BasicAuth, if set, is required in the authorization metadata of every call.
+	BasicAuth *url.Userinfo
+}
+
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Protocol: forwarder.HTTPScheme,
+	}
+}
+
+func (c *ServerConfig) Validate() error {
+	if c.Protocol != forwarder.HTTPScheme && c.Protocol != forwarder.HTTPSScheme {
+		return fmt.Errorf("protocol: unsupported protocol %q", c.Protocol)
+	}
+	if c.BasicAuth != nil && c.BasicAuth.Username() == "" {
+		return fmt.Errorf("basic_auth: username cannot be empty")
+	}
+	return nil
+}
+
+func newGRPCServer(cfg *ServerConfig, srv AdminServer) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if cfg.Protocol == forwarder.HTTPSScheme {
+		tlsCfg := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+		if err := cfg.ConfigureTLSConfig(tlsCfg); err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+	if cfg.BasicAuth != nil {
+		a := newBasicAuth(cfg.BasicAuth)
+		opts = append(opts, grpc.UnaryInterceptor(a.unary), grpc.StreamInterceptor(a.stream))
+	}
+
+	gs := grpc.NewServer(opts...)
+	RegisterAdminServer(gs, srv)
+	return gs, nil
+}
+
+// Serve serves the admin service until the context is canceled.
+func Serve(ctx context.Context, cfg *ServerConfig, srv AdminServer, log log.Logger) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	gs, err := newGRPCServer(cfg, srv)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to open listener on address %s: %w", cfg.Addr, err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		// Stop instead of GracefulStop, Watch streams never end.
+		gs.Stop()
+	}()
+
+	log.Infof("gRPC admin API listening on %s protocol=%s", l.Addr(), cfg.Protocol)
+	return gs.Serve(l)
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type testProxy struct {
+	rc forwarder.RuntimeConfig
+}
+
+func (p *testProxy) RuntimeConfig() forwarder.RuntimeConfig {
+	return p.rc
+}
+
+func (p *testProxy) SetRuntimeConfig(rc forwarder.RuntimeConfig) error {
+	p.rc = rc
+	return nil
+}
+
+func TestServerUpdateRuntimeConfig(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "base:3128"}
+	p := &testProxy{rc: forwarder.RuntimeConfig{UpstreamProxy: base}}
+	s := NewServer(p, nil, stdlog.Default())
+	ctx := context.Background()
+
+	in, err := structpb.NewStruct(map[string]any{
+		"proxy":        "http://upstream:3128",
+		"deny-domains": "example.com",
+		"credentials":  "user:pass@*:*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.UpdateRuntimeConfig(ctx, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.rc.UpstreamProxy.Host != "upstream:3128" {
+		t.Fatalf("expected upstream:3128, got %s", p.rc.UpstreamProxy.Host)
+	}
+	if p.rc.DenyDomains == nil || !p.rc.DenyDomains.Match("example.com") {
+		t.Fatal("expected example.com to be denied")
+	}
+	if v := out.GetFields()["credentials"].GetStringValue(); v != "user:xxxxx@*:*" {
+		t.Fatalf("expected redacted credentials, got %s", v)
+	}
+
+	// Null value resets proxy to the base value.
+	in, err = structpb.NewStruct(map[string]any{"proxy": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateRuntimeConfig(ctx, in); err != nil {
+		t.Fatal(err)
+	}
+	if p.rc.UpstreamProxy != base {
+		t.Fatalf("expected base proxy, got %s", p.rc.UpstreamProxy)
+	}
+	if p.rc.DenyDomains == nil {
+		t.Fatal("expected deny domains to be kept")
+	}
+
+	in, err = structpb.NewStruct(map[string]any{"deny-domains": "("})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateRuntimeConfig(ctx, in); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected invalid argument, got %v", err)
+	}
+}
+
+type basicAuthCreds struct {
+	user, pass string
+}
+
+func (c basicAuthCreds) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user+":"+c.pass)),
+	}, nil
+}
+
+func (c basicAuthCreds) RequireTransportSecurity() bool {
+	return true
+}
+
+func TestServerBasicAuthTLS(t *testing.T) {
+	cfg := DefaultServerConfig()
+	cfg.Protocol = forwarder.HTTPSScheme
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+
+	gs, err := newGRPCServer(cfg, NewServer(&testProxy{}, nil, stdlog.Default()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(l) //nolint:errcheck // stopped in cleanup
+	t.Cleanup(gs.Stop)
+
+	tlsCreds := credentials.NewTLS(&tls.Config{InsecureSkipVerify: true}) //nolint:gosec // self-signed certificate
+	call := func(opts ...grpc.DialOption) error {
+		t.Helper()
+		cc, err := grpc.Dial(l.Addr().String(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		_, err = NewAdminClient(cc).GetRuntimeConfig(context.Background(), &emptypb.Empty{})
+		return err
+	}
+
+	if err := call(grpc.WithTransportCredentials(insecure.NewCredentials())); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable without TLS, got %v", err)
+	}
+	if err := call(grpc.WithTransportCredentials(tlsCreds)); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated without credentials, got %v", err)
+	}
+	if err := call(grpc.WithTransportCredentials(tlsCreds),
+		grpc.WithPerRPCCredentials(basicAuthCreds{"user", "bad"})); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected unauthenticated with invalid credentials, got %v", err)
+	}
+	if err := call(grpc.WithTransportCredentials(tlsCreds),
+		grpc.WithPerRPCCredentials(basicAuthCreds{"user", "pass"})); err != nil {
+		t.Fatal(err)
+	}
+}
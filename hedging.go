@@ -0,0 +1,275 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgingConfig configures hedged requests.
+// If a response to an idempotent GET or HEAD request does not arrive within the latency threshold of the host,
+// a second attempt is sent and the first response is used.
+type HedgingConfig struct {
+	// Delay is the minimum time to wait for a response before sending a hedged request.
+	// It is used as the threshold until enough latency samples are collected for the host.
+	Delay time.Duration
+
+	// Percentile of the observed response latency of the host, after which a hedged request is sent.
+	Percentile float64
+
+	// Budget is the maximum ratio of hedged requests to all eligible requests.
+	Budget float64
+}
+
+func DefaultHedgingConfig() *HedgingConfig {
+	return &HedgingConfig{
+		Percentile: 95,
+		Budget:     0.1,
+	}
+}
+
+func (c *HedgingConfig) Validate() error {
+	if c.Delay <= 0 {
+		return errors.New("delay must be positive")
+	}
+	if c.Percentile <= 0 || c.Percentile >= 100 {
+		return errors.New("percentile must be between 0 and 100")
+	}
+	if c.Budget <= 0 || c.Budget > 1 {
+		return errors.New("budget must be between 0 and 1")
+	}
+	return nil
+}
+
+const (
+	hedgeSamples    = 100
+	hedgeMinSamples = 20
+	hedgeMaxHosts   = 1000
+	hedgeMaxTokens  = 10
+)
+
+// latencyWindow holds the most recent response latencies of a host.
+type latencyWindow struct {
+	samples [hedgeSamples]time.Duration
+	n       int
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % hedgeSamples
+	if w.n < hedgeSamples {
+		w.n++
+	}
+}
+
+func (w *latencyWindow) percentile(p float64) time.Duration {
+	s := make([]time.Duration, w.n)
+	copy(s, w.samples[:w.n])
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[int(float64(w.n-1)*p/100)]
+}
+
+type hedger struct {
+	config HedgingConfig
+	report func(outcome string)
+
+	mu     sync.Mutex
+	hosts  map[string]*latencyWindow
+	tokens float64
+}
+
+// newHedger returns a hedger, report is called with won, lost or throttled for every request that exceeds the threshold.
+func newHedger(cfg *HedgingConfig, report func(outcome string)) *hedger {
+	return &hedger{
+		config: *cfg,
+		report: report,
+		hosts:  make(map[string]*latencyWindow),
+		tokens: hedgeMaxTokens,
+	}
+}
+
+func (h *hedger) eligible(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	return req.Header.Get("Upgrade") == ""
+}
+
+// threshold returns the time to wait before sending a hedged request to the host,
+// and adds the budget of the request to the hedging tokens.
+func (h *hedger) threshold(host string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tokens += h.config.Budget
+	if h.tokens > hedgeMaxTokens {
+		h.tokens = hedgeMaxTokens
+	}
+
+	w := h.hosts[host]
+	if w == nil || w.n < hedgeMinSamples {
+		return h.config.Delay
+	}
+	if d := w.percentile(h.config.Percentile); d > h.config.Delay {
+		return d
+	}
+	return h.config.Delay
+}
+
+func (h *hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *hedger) observe(host string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	w := h.hosts[host]
+	if w == nil {
+		if len(h.hosts) >= hedgeMaxHosts {
+			for k := range h.hosts {
+				delete(h.hosts, k)
+				break
+			}
+		}
+		w = new(latencyWindow)
+		h.hosts[host] = w
+	}
+	w.add(d)
+}
+
+type hedgeResult struct {
+	res   *http.Response
+	err   error
+	hedge bool
+}
+
+// RoundTrip sends the request with rt, and sends a second attempt if the response does not arrive within the threshold.
+// The response that arrives first is returned, the other attempt is canceled.
+func (h *hedger) RoundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if !h.eligible(req) {
+		return rt.RoundTrip(req)
+	}
+
+	host := req.URL.Host
+	timer := time.NewTimer(h.threshold(host))
+	defer timer.Stop()
+
+	var (
+		start   = time.Now()
+		results = make(chan hedgeResult, 2)
+		cancels [2]context.CancelFunc
+		pending int
+	)
+	send := func(hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[pending] = cancel
+		pending++
+		go func() {
+			res, err := rt.RoundTrip(req.Clone(ctx))
+			results <- hedgeResult{res: res, err: err, hedge: hedge}
+		}()
+	}
+	send(false)
+
+	var (
+		timerC = timer.C
+		hedged bool
+		err    error
+	)
+	for {
+		select {
+		case <-timerC:
+			timerC = nil
+			if !h.spend() {
+				h.report("throttled")
+				continue
+			}
+			hedged = true
+			send(true)
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				err = r.err
+				if pending == 0 {
+					if hedged {
+						h.report("lost")
+					}
+					for _, cancel := range cancels {
+						if cancel != nil {
+							cancel()
+						}
+					}
+					return nil, err
+				}
+				continue
+			}
+
+			h.observe(host, time.Since(start))
+			if hedged {
+				if r.hedge {
+					h.report("won")
+				} else {
+					h.report("lost")
+				}
+			}
+
+			winner := 0
+			if r.hedge {
+				winner = 1
+			}
+			for i, cancel := range cancels {
+				if i != winner && cancel != nil {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go drainHedgeResults(results, pending)
+			}
+
+			r.res.Body = &cancelBody{ReadCloser: r.res.Body, cancel: cancels[winner]}
+			return r.res, nil
+		}
+	}
+}
+
+func drainHedgeResults(results <-chan hedgeResult, n int) {
+	for ; n > 0; n-- {
+		if r := <-results; r.res != nil {
+			r.res.Body.Close()
+		}
+	}
+}
+
+// cancelBody cancels the request context when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowFirstTransport delays the first request until its context is canceled.
+type slowFirstTransport struct {
+	calls    atomic.Int32
+	canceled chan struct{}
+}
+
+func (t *slowFirstTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := t.calls.Add(1)
+	if n == 1 {
+		<-req.Context().Done()
+		close(t.canceled)
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("hedge")),
+		Request:    req,
+	}, nil
+}
+
+type outcomes struct {
+	mu sync.Mutex
+	v  []string
+}
+
+func (o *outcomes) report(outcome string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.v = append(o.v, outcome)
+}
+
+func (o *outcomes) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.v, ",")
+}
+
+func hedgingTestConfig() *HedgingConfig {
+	cfg := DefaultHedgingConfig()
+	cfg.Delay = 10 * time.Millisecond
+	return cfg
+}
+
+func TestHedgerHedgeWins(t *testing.T) {
+	var o outcomes
+	h := newHedger(hedgingTestConfig(), o.report)
+	rt := &slowFirstTransport{canceled: make(chan struct{})}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	res, err := h.RoundTrip(rt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(b) != "hedge" {
+		t.Fatalf("expected hedged response, got %q", b)
+	}
+	select {
+	case <-rt.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the first attempt to be canceled")
+	}
+	if o.String() != "won" {
+		t.Fatalf("expected won, got %q", o.String())
+	}
+}
+
+func TestHedgerNotEligible(t *testing.T) {
+	var o outcomes
+	h := newHedger(hedgingTestConfig(), o.report)
+
+	for _, m := range []string{http.MethodPost, http.MethodPut} {
+		rt := &slowFirstTransport{canceled: make(chan struct{})}
+		req, _ := http.NewRequest(m, "http://example.com/", strings.NewReader("body"))
+		if _, err := h.RoundTrip(&timeoutTransport{rt, 50 * time.Millisecond}, req); err == nil {
+			t.Fatalf("%s: expected error", m)
+		}
+		if n := rt.calls.Load(); n != 1 {
+			t.Fatalf("%s: expected 1 attempt, got %d", m, n)
+		}
+	}
+	if o.String() != "" {
+		t.Fatalf("expected no outcomes, got %q", o.String())
+	}
+}
+
+// timeoutTransport cancels requests after the timeout.
+type timeoutTransport struct {
+	rt      http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	defer cancel()
+	return t.rt.RoundTrip(req.WithContext(ctx))
+}
+
+func TestHedgerBudget(t *testing.T) {
+	var o outcomes
+	h := newHedger(hedgingTestConfig(), o.report)
+	h.tokens = 0
+
+	rt := &slowFirstTransport{canceled: make(chan struct{})}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if _, err := h.RoundTrip(&timeoutTransport{rt, 50 * time.Millisecond}, req); err == nil {
+		t.Fatal("expected error")
+	}
+	if n := rt.calls.Load(); n != 1 {
+		t.Fatalf("expected 1 attempt, got %d", n)
+	}
+	if o.String() != "throttled" {
+		t.Fatalf("expected throttled, got %q", o.String())
+	}
+}
+
+func TestHedgerThreshold(t *testing.T) {
+	h := newHedger(hedgingTestConfig(), func(string) {})
+
+	for i := 1; i <= hedgeMinSamples-1; i++ {
+		h.observe("example.com", time.Duration(i)*time.Second)
+	}
+	if d := h.threshold("example.com"); d != 10*time.Millisecond {
+		t.Fatalf("expected delay before min samples, got %s", d)
+	}
+
+	for i := 1; i <= hedgeSamples; i++ {
+		h.observe("example.com", time.Duration(i)*time.Millisecond*100)
+	}
+	if d := h.threshold("example.com"); d != 9500*time.Millisecond {
+		t.Fatalf("expected p95 threshold, got %s", d)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/saucelabs/forwarder/ratelimit"
+)
+
+// HostBandwidthLimit limits the bandwidth of traffic to hosts matching the regexp.
+// The limit applies separately to each direction, and is shared by all requests and tunnels to the matching hosts.
+type HostBandwidthLimit struct {
+	Host      *regexp.Regexp
+	Bandwidth SizeSuffix
+}
+
+// ParseHostBandwidthLimit parses a <pattern>=<bandwidth> string into HostBandwidthLimit.
+// The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains.
+func ParseHostBandwidthLimit(val string) (*HostBandwidthLimit, error) {
+	pattern, bw, ok := strings.Cut(val, "=")
+	if !ok || pattern == "" || bw == "" {
+		return nil, errors.New("expected <pattern>=<bandwidth>")
+	}
+
+	re, err := compileDomainPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &HostBandwidthLimit{Host: re}
+	if err := l.Bandwidth.Set(bw); err != nil {
+		return nil, fmt.Errorf("bandwidth: %w", err)
+	}
+	if l.Bandwidth <= 0 {
+		return nil, errors.New("bandwidth must be positive")
+	}
+
+	return l, nil
+}
+
+func (l *HostBandwidthLimit) String() string {
+	return l.Host.String() + "=" + l.Bandwidth.String()
+}
+
+func newHostLimiter(limits []*HostBandwidthLimit) *ratelimit.HostLimiter {
+	rules := make([]ratelimit.HostRule, 0, len(limits))
+	for _, l := range limits {
+		rules = append(rules, ratelimit.HostRule{
+			Host:        l.Host,
+			RxBandwidth: int64(l.Bandwidth),
+			TxBandwidth: int64(l.Bandwidth),
+		})
+	}
+	return ratelimit.NewHostLimiter(rules)
+}
+
+// configureHostBandwidthLimits limits CONNECT tunnels to the matching hosts.
+// HTTP requests are limited by the hostBandwidthLimiter modifier.
+func (hp *HTTPProxy) configureHostBandwidthLimits() {
+	for _, l := range hp.config.HostBandwidthLimits {
+		hp.log.Infof("using host bandwidth limit: %s", l)
+	}
+	hp.hostLimiter = newHostLimiter(hp.config.HostBandwidthLimits)
+
+	nextConnect := hp.proxy.ConnectFunc
+	hp.proxy.ConnectFunc = func(connect func(*http.Request) (*http.Response, net.Conn, error), req *http.Request) (*http.Response, net.Conn, error) {
+		var (
+			res  *http.Response
+			conn net.Conn
+			err  error
+		)
+		if nextConnect != nil {
+			res, conn, err = nextConnect(connect, req)
+		} else {
+			res, conn, err = connect(req)
+		}
+		if conn != nil {
+			conn = hp.hostLimiter.Conn(req.URL.Hostname(), conn)
+		}
+		return res, conn, err
+	}
+}
+
+// hostBandwidthLimiter throttles request and response bodies of requests to hosts with a bandwidth limit.
+type hostBandwidthLimiter struct {
+	limiter *ratelimit.HostLimiter
+}
+
+func (h hostBandwidthLimiter) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if _, tx := h.limiter.Limiters(req.URL.Hostname()); tx != nil {
+		req.Body = ratelimit.NewReadCloser(req.Body, tx)
+	}
+	return nil
+}
+
+func (h hostBandwidthLimiter) ModifyResponse(res *http.Response) error {
+	if res.Request.Method == http.MethodConnect || res.Body == nil || res.Body == http.NoBody {
+		return nil
+	}
+	// Upgraded connections need the body to be io.ReadWriteCloser.
+	if _, ok := res.Body.(io.ReadWriteCloser); ok {
+		return nil
+	}
+	if rx, _ := h.limiter.Limiters(res.Request.URL.Hostname()); rx != nil {
+		res.Body = ratelimit.NewReadCloser(res.Body, rx)
+	}
+	return nil
+}
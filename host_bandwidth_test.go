@@ -0,0 +1,76 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"testing"
+)
+
+func TestParseHostBandwidthLimit(t *testing.T) {
+	tests := []struct {
+		input     string
+		host      string
+		bandwidth SizeSuffix
+	}{
+		{"*.cdn.example.com=1Mi", `(^|\.)cdn\.example\.com$`, Mebi},
+		{`\.net$=512Ki`, `\.net$`, 512 * Kibi},
+	}
+	for _, tc := range tests {
+		l, err := ParseHostBandwidthLimit(tc.input)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.input, err)
+		}
+		if l.Host.String() != tc.host {
+			t.Errorf("%s: expected host %s, got %s", tc.input, tc.host, l.Host)
+		}
+		if l.Bandwidth != tc.bandwidth {
+			t.Errorf("%s: expected bandwidth %s, got %s", tc.input, tc.bandwidth, l.Bandwidth)
+		}
+	}
+
+	for _, input := range []string{"", "example.com", "=1Mi", "example.com=", "example.com=0", "example.com=fast", "*.=1Mi"} {
+		if _, err := ParseHostBandwidthLimit(input); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	var limits []*HostBandwidthLimit
+	for _, s := range []string{"*.cdn.example.com=1Mi", "*.example.com=2Mi"} {
+		l, err := ParseHostBandwidthLimit(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits = append(limits, l)
+	}
+	hl := newHostLimiter(limits)
+
+	tests := []struct {
+		host      string
+		bandwidth float64
+	}{
+		{"img.cdn.example.com", float64(Mebi)},
+		{"www.example.com", float64(2 * Mebi)},
+		{"example.org", 0},
+	}
+	for _, tc := range tests {
+		rx, tx := hl.Limiters(tc.host)
+		if tc.bandwidth == 0 {
+			if rx != nil || tx != nil {
+				t.Errorf("%s: expected no limit", tc.host)
+			}
+			continue
+		}
+		if rx == nil || tx == nil {
+			t.Fatalf("%s: expected limit", tc.host)
+		}
+		if float64(rx.Limit()) != tc.bandwidth || float64(tx.Limit()) != tc.bandwidth {
+			t.Errorf("%s: expected bandwidth %v, got rx=%v tx=%v", tc.host, tc.bandwidth, rx.Limit(), tx.Limit())
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package hsts
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Handler returns a handler that serves the policies as JSON.
+// The host query parameter selects the policies of hosts with the suffix.
+func (c *Cache) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := c.Policies()
+		if host := canonicalHost(r.URL.Query().Get("host")); host != "" {
+			n := 0
+			for _, p := range res {
+				if p.Host == host || strings.HasSuffix(p.Host, "."+host) {
+					res[n] = p
+					n++
+				}
+			}
+			res = res[:n]
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(res) //nolint:errcheck // best effort
+	})
+}
@@ -0,0 +1,321 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package hsts provides a cache of HTTP Strict Transport Security (RFC 6797) policies seen in responses.
+package hsts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Policy is the HSTS policy of a host.
+type Policy struct {
+	Host              string    `json:"host"`
+	Expires           time.Time `json:"expires"`
+	IncludeSubDomains bool      `json:"include_subdomains,omitempty"`
+}
+
+type Config struct {
+	// File is the path of the cache file, if empty policies are kept in memory only.
+	File string
+
+	// MaxHosts is the maximal number of hosts kept, the policies expiring first are removed first.
+	MaxHosts int
+
+	// SaveInterval is the time between saves of the changed policies to the file.
+	SaveInterval time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MaxHosts:     10000,
+		SaveInterval: time.Minute,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.MaxHosts <= 0 {
+		return errors.New("max hosts must be positive")
+	}
+	if c.SaveInterval <= 0 {
+		return errors.New("save interval must be positive")
+	}
+	return nil
+}
+
+// Cache keeps HSTS policies of hosts, and saves them to a file, so that they survive restarts.
+type Cache struct {
+	config  Config
+	log     log.Logger
+	nowFunc func() time.Time
+
+	mu       sync.Mutex
+	policies map[string]Policy
+	dirty    bool
+}
+
+// New returns a cache with the unexpired policies loaded from the file.
+func New(cfg *Config, log log.Logger) (*Cache, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		config:   *cfg,
+		log:      log,
+		nowFunc:  time.Now,
+		policies: make(map[string]Policy),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Cache) load() error {
+	if c.config.File == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(c.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var policies []Policy
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.addLocked(policies)
+	c.mu.Unlock()
+	c.log.Infof("loaded %d policies from %s", len(c.policies), c.config.File)
+
+	return nil
+}
+
+// Import adds the unexpired policies, replacing the policies of the same hosts.
+// It is used to restore policies exported with Policies from another instance.
+func (c *Cache) Import(policies []Policy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.addLocked(policies) > 0 {
+		c.dirty = true
+	}
+}
+
+func (c *Cache) addLocked(policies []Policy) int {
+	now := c.nowFunc()
+
+	var n int
+	for _, p := range policies {
+		p.Host = canonicalHost(p.Host)
+		if p.Host == "" || !p.Expires.After(now) {
+			continue
+		}
+		if _, ok := c.policies[p.Host]; !ok && len(c.policies) >= c.config.MaxHosts {
+			c.evictLocked()
+		}
+		c.policies[p.Host] = p
+		n++
+	}
+	return n
+}
+
+// Observe updates the policy of the host from the Strict-Transport-Security header value.
+// The header must be received over a secure connection, max-age=0 removes the policy.
+func (c *Cache) Observe(host, header string) {
+	host = canonicalHost(host)
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+	maxAge, includeSubDomains, ok := parseHeader(header)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.dirty = true
+	if maxAge == 0 {
+		delete(c.policies, host)
+		return
+	}
+	if _, ok := c.policies[host]; !ok && len(c.policies) >= c.config.MaxHosts {
+		c.evictLocked()
+	}
+	c.policies[host] = Policy{
+		Host:              host,
+		Expires:           c.nowFunc().Add(maxAge),
+		IncludeSubDomains: includeSubDomains,
+	}
+}
+
+// evictLocked removes the policy expiring first.
+func (c *Cache) evictLocked() {
+	var first Policy
+	for _, p := range c.policies {
+		if first.Host == "" || p.Expires.Before(first.Expires) {
+			first = p
+		}
+	}
+	delete(c.policies, first.Host)
+}
+
+// Match returns true if the host is a known HSTS host,
+// either it has a policy or a parent domain has a policy including subdomains.
+func (c *Cache) Match(host string) bool {
+	host = canonicalHost(host)
+	now := c.nowFunc()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.policies) == 0 {
+		return false
+	}
+	if p, ok := c.policies[host]; ok && p.Expires.After(now) {
+		return true
+	}
+	for d := host; ; {
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			return false
+		}
+		d = d[i+1:]
+		if p, ok := c.policies[d]; ok && p.IncludeSubDomains && p.Expires.After(now) {
+			return true
+		}
+	}
+}
+
+// Policies returns the unexpired policies sorted by host.
+func (c *Cache) Policies() []Policy {
+	now := c.nowFunc()
+
+	c.mu.Lock()
+	res := make([]Policy, 0, len(c.policies))
+	for _, p := range c.policies {
+		if p.Expires.After(now) {
+			res = append(res, p)
+		}
+	}
+	c.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+	return res
+}
+
+// Run saves the policies to the file every save interval if they changed, until the context is canceled.
+func (c *Cache) Run(ctx context.Context) error {
+	if c.config.File == "" {
+		<-ctx.Done()
+		return nil
+	}
+
+	t := time.NewTicker(c.config.SaveInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return c.Save()
+		case <-t.C:
+			if err := c.Save(); err != nil {
+				c.log.Errorf("save: %s", err)
+			}
+		}
+	}
+}
+
+// Save atomically replaces the file with the unexpired policies, if they changed since the last save.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	dirty := c.dirty
+	c.dirty = false
+	c.mu.Unlock()
+
+	if !dirty || c.config.File == "" {
+		return nil
+	}
+
+	if err := c.write(); err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *Cache) write() error {
+	b, err := json.MarshalIndent(c.Policies(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.config.File + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.config.File)
+}
+
+func canonicalHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// parseHeader parses the Strict-Transport-Security header value, see RFC 6797 section 6.1.
+func parseHeader(v string) (maxAge time.Duration, includeSubDomains, ok bool) {
+	seen := make(map[string]bool)
+	for _, d := range strings.Split(v, ";") {
+		name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		// Directives must not appear more than once.
+		if seen[name] {
+			return 0, false, false
+		}
+		seen[name] = true
+
+		switch name {
+		case "max-age":
+			n, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(val), `"`), 10, 64)
+			if err != nil || n < 0 {
+				return 0, false, false
+			}
+			if n > int64(time.Duration(1<<63-1)/time.Second) {
+				n = int64(time.Duration(1<<63-1) / time.Second)
+			}
+			maxAge = time.Duration(n) * time.Second
+			ok = true
+		case "includesubdomains":
+			includeSubDomains = true
+		}
+	}
+	return maxAge, includeSubDomains, ok
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package hsts
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		header            string
+		maxAge            time.Duration
+		includeSubDomains bool
+		ok                bool
+	}{
+		{"max-age=31536000", 365 * 24 * time.Hour, false, true},
+		{`max-age="60"; includeSubDomains; preload`, time.Minute, true, true},
+		{"MAX-AGE=0", 0, false, true},
+		{"includeSubDomains", 0, true, false},
+		{"max-age=-1", 0, false, false},
+		{"max-age=abc", 0, false, false},
+		{"max-age=1; max-age=2", 0, false, false},
+	}
+	for _, tc := range tests {
+		maxAge, includeSubDomains, ok := parseHeader(tc.header)
+		if ok != tc.ok || (ok && (maxAge != tc.maxAge || includeSubDomains != tc.includeSubDomains)) {
+			t.Errorf("%q: got %v %v %v", tc.header, maxAge, includeSubDomains, ok)
+		}
+	}
+}
+
+func newTestCache(t *testing.T, cfg *Config, now *time.Time) *Cache {
+	t.Helper()
+	c, err := New(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.nowFunc = func() time.Time { return *now }
+	return c
+}
+
+func TestCacheMatch(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(t, DefaultConfig(), &now)
+
+	c.Observe("example.com:443", "max-age=60; includeSubDomains")
+	c.Observe("foo.org", "max-age=60")
+	c.Observe("127.0.0.1", "max-age=60")
+
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{"example.com", true},
+		{"www.EXAMPLE.com:80", true},
+		{"a.b.example.com", true},
+		{"foo.org", true},
+		{"www.foo.org", false},
+		{"127.0.0.1", false},
+		{"example.org", false},
+	}
+	for _, tc := range tests {
+		if m := c.Match(tc.host); m != tc.match {
+			t.Errorf("%s: expected %v, got %v", tc.host, tc.match, m)
+		}
+	}
+
+	c.Observe("foo.org", "max-age=0")
+	if c.Match("foo.org") {
+		t.Error("expected max-age=0 to remove policy")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if c.Match("example.com") {
+		t.Error("expected policy to expire")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	now := time.Now()
+	cfg := DefaultConfig()
+	cfg.MaxHosts = 2
+	c := newTestCache(t, cfg, &now)
+
+	c.Observe("a.com", "max-age=10")
+	c.Observe("b.com", "max-age=100")
+	c.Observe("c.com", "max-age=50")
+
+	if c.Match("a.com") || !c.Match("b.com") || !c.Match("c.com") {
+		t.Fatalf("unexpected policies %v", c.Policies())
+	}
+}
+
+func TestCacheSaveLoad(t *testing.T) {
+	now := time.Now()
+	cfg := DefaultConfig()
+	cfg.File = filepath.Join(t.TempDir(), "hsts.json")
+
+	c := newTestCache(t, cfg, &now)
+	c.Observe("example.com", "max-age=3600; includeSubDomains")
+	c.Observe("short.com", "max-age=1")
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute)
+	c2, err := New(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Policies are filtered on load with the real clock.
+	c2.nowFunc = func() time.Time { return now }
+	if !c2.Match("www.example.com") {
+		t.Fatal("expected policy to be loaded")
+	}
+	if c2.Match("short.com") {
+		t.Fatal("expected policy to expire")
+	}
+}
+
+func TestCacheImport(t *testing.T) {
+	now := time.Now()
+	c := newTestCache(t, DefaultConfig(), &now)
+
+	c.Import([]Policy{
+		{Host: "Example.com.", Expires: now.Add(time.Hour), IncludeSubDomains: true},
+		{Host: "expired.com", Expires: now.Add(-time.Second)},
+	})
+
+	if !c.Match("www.example.com") {
+		t.Fatal("expected policy to be imported")
+	}
+	if c.Match("expired.com") {
+		t.Fatal("expected expired policy to be skipped")
+	}
+	if !c.dirty {
+		t.Fatal("expected cache to be dirty")
+	}
+}
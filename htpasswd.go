@@ -0,0 +1,196 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // required by the htpasswd {SHA} format
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/middleware"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdCheckInterval is the minimal interval between checks if the htpasswd file changed.
+const htpasswdCheckInterval = 5 * time.Second
+
+// HtpasswdAuthenticator authenticates clients with basic auth credentials stored in an htpasswd file.
+// Passwords must be hashed with bcrypt or SHA1 ({SHA}), e.g. htpasswd -B or htpasswd -s.
+// The file is reloaded when its modification time or size changes,
+// if the new file is invalid the previous users are kept.
+type HtpasswdAuthenticator struct {
+	path string
+	ba   *middleware.BasicAuth
+	log  log.Logger
+
+	mu        sync.RWMutex
+	users     map[string]string
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+// NewHtpasswdAuthenticator returns an authenticator that checks the Proxy-Authorization header against the htpasswd file.
+func NewHtpasswdAuthenticator(path string, log log.Logger) (*HtpasswdAuthenticator, error) {
+	return newHtpasswdAuthenticator(path, middleware.NewProxyBasicAuth(), log)
+}
+
+func newHtpasswdAuthenticator(path string, ba *middleware.BasicAuth, log log.Logger) (*HtpasswdAuthenticator, error) {
+	a := &HtpasswdAuthenticator{
+		path: path,
+		ba:   ba,
+		log:  log,
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.load(fi); err != nil {
+		return nil, err
+	}
+	a.log.Infof("loaded htpasswd file %s users=%d", path, len(a.users))
+	return a, nil
+}
+
+func (a *HtpasswdAuthenticator) load(fi os.FileInfo) error {
+	b, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseHtpasswd(b)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.modTime = fi.ModTime()
+	a.size = fi.Size()
+	a.mu.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged reloads the file if it changed since the last load, the file is checked at most once per htpasswdCheckInterval.
+func (a *HtpasswdAuthenticator) reloadIfChanged(now time.Time) {
+	a.mu.Lock()
+	if now.Sub(a.lastCheck) < htpasswdCheckInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.lastCheck = now
+	modTime, size := a.modTime, a.size
+	a.mu.Unlock()
+
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		a.log.Errorf("failed to check htpasswd file %s, keeping previous users: %s", a.path, err)
+		return
+	}
+	if fi.ModTime().Equal(modTime) && fi.Size() == size {
+		return
+	}
+
+	if err := a.load(fi); err != nil {
+		a.log.Errorf("failed to reload htpasswd file %s, keeping previous users: %s", a.path, err)
+		return
+	}
+	a.log.Infof("reloaded htpasswd file %s users=%d", a.path, a.Len())
+}
+
+// Len returns the number of users.
+func (a *HtpasswdAuthenticator) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.users)
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(req *http.Request) (string, error) {
+	user, pass, ok := a.ba.BasicAuth(req)
+	if !ok || !a.Verify(user, pass) {
+		return "", errInvalidCredentials
+	}
+	return user, nil
+}
+
+// Verify returns true if the password matches the hash of the user.
+func (a *HtpasswdAuthenticator) Verify(user, pass string) bool {
+	a.reloadIfChanged(time.Now())
+
+	a.mu.RLock()
+	hash, ok := a.users[user]
+	a.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	return verifyHtpasswdHash(hash, pass)
+}
+
+func (a *HtpasswdAuthenticator) Challenge(h http.Header, _ *http.Request) {
+	h.Add("Proxy-Authenticate", `Basic realm="`+proxyAuthRealm+`"`)
+}
+
+func parseHtpasswd(b []byte) (map[string]string, error) {
+	users := make(map[string]string)
+
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", n)
+		}
+		if !isSupportedHtpasswdHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported hash for user %s, use bcrypt or SHA1", n, user)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %s", n, user)
+		}
+		users[user] = hash
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+const htpasswdSHAPrefix = "{SHA}"
+
+func isSupportedHtpasswdHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, htpasswdSHAPrefix):
+		return true
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	default:
+		return false
+	}
+}
+
+func verifyHtpasswdHash(hash, pass string) bool {
+	if s, ok := strings.CutPrefix(hash, htpasswdSHAPrefix); ok {
+		sum := sha1.Sum([]byte(pass)) //nolint:gosec // required by the htpasswd {SHA} format
+		return subtle.ConstantTimeCompare([]byte(s), []byte(base64.StdEncoding.EncodeToString(sum[:]))) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
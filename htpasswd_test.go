@@ -0,0 +1,110 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	bc, err := bcrypt.GenerateFromPassword([]byte("bpass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	writeHtpasswd(t, path, ""+
+		"# comment\n"+
+		"alice:"+string(bc)+"\n"+
+		"bob:{SHA}qZk+NkcGgWq6PiVxeFDCbJzQ2J0=\n", // "abc"
+		time.Now().Add(-time.Hour))
+
+	a, err := NewHtpasswdAuthenticator(path, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := func(user, pass string) (string, error) {
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(user, pass)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		return a.Authenticate(req)
+	}
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "bpass", true},
+		{"alice", "abc", false},
+		{"bob", "abc", true},
+		{"bob", "bpass", false},
+		{"carol", "abc", false},
+	}
+	for i := range tests {
+		tc := &tests[i]
+		user, err := auth(tc.user, tc.pass)
+		if tc.ok != (err == nil) {
+			t.Fatalf("%s:%s: unexpected result user=%q err=%v", tc.user, tc.pass, user, err)
+		}
+		if tc.ok && user != tc.user {
+			t.Fatalf("expected user %q, got %q", tc.user, user)
+		}
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		writeHtpasswd(t, path, "carol:{SHA}qZk+NkcGgWq6PiVxeFDCbJzQ2J0=\n", time.Now())
+		a.lastCheck = time.Time{}
+
+		if _, err := auth("carol", "abc"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := auth("bob", "abc"); err == nil {
+			t.Fatal("expected removed user to be rejected")
+		}
+	})
+
+	t.Run("invalid reload", func(t *testing.T) {
+		writeHtpasswd(t, path, "dave:$apr1$xxx\n", time.Now().Add(time.Minute))
+		a.lastCheck = time.Time{}
+
+		if _, err := auth("carol", "abc"); err != nil {
+			t.Fatalf("expected previous users to be kept: %s", err)
+		}
+	})
+}
+
+func TestParseHtpasswdErrors(t *testing.T) {
+	for _, s := range []string{
+		"alice\n",
+		":{SHA}qZk+NkcGgWq6PiVxeFDCbJzQ2J0=\n",
+		"alice:plain\n",
+		"alice:$apr1$abc$def\n",
+		"alice:{SHA}x\nalice:{SHA}y\n",
+	} {
+		if _, err := parseHtpasswd([]byte(s)); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
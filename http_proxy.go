@@ -16,19 +16,30 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/saucelabs/forwarder/ftp"
+	"github.com/saucelabs/forwarder/header"
+	"github.com/saucelabs/forwarder/hsts"
 	"github.com/saucelabs/forwarder/httplog"
 	"github.com/saucelabs/forwarder/internal/martian"
 	"github.com/saucelabs/forwarder/internal/martian/fifo"
 	"github.com/saucelabs/forwarder/internal/martian/httpspec"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"github.com/saucelabs/forwarder/journal"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/middleware"
 	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/proxyproto"
 	"github.com/saucelabs/forwarder/ratelimit"
 	"github.com/saucelabs/forwarder/ruleset"
+	"github.com/saucelabs/forwarder/stats"
 )
 
 type ProxyLocalhostMode string
@@ -62,6 +73,37 @@ func (m ProxyLocalhostMode) isValid() bool {
 	}
 }
 
+// AuthScheme is the HTTP authentication scheme used to authenticate proxy clients.
+type AuthScheme string
+
+const (
+	BasicAuthScheme  AuthScheme = "basic"
+	DigestAuthScheme AuthScheme = "digest"
+)
+
+func (s *AuthScheme) UnmarshalText(text []byte) error {
+	switch AuthScheme(text) {
+	case BasicAuthScheme, DigestAuthScheme:
+		*s = AuthScheme(text)
+		return nil
+	default:
+		return fmt.Errorf("invalid auth scheme: %s", text)
+	}
+}
+
+func (s AuthScheme) String() string {
+	return string(s)
+}
+
+func (s AuthScheme) isValid() bool {
+	switch s {
+	case BasicAuthScheme, DigestAuthScheme:
+		return true
+	default:
+		return false
+	}
+}
+
 type ProxyFunc func(*http.Request) (*url.URL, error)
 
 // Alias all martian types to avoid exposing them.
@@ -76,21 +118,142 @@ type (
 type HTTPProxyConfig struct {
 	HTTPServerConfig
 	Name                   string
+	AuthScheme             AuthScheme
+	JWTAuth                *JWTAuthConfig
+	Bypass                 *BypassConfig
+	TimeoutHeader          *TimeoutHeaderConfig
 	MITM                   *MITMConfig
 	MITMDomains            *ruleset.RegexpMatcher
+	MITMExcludeDomains     *ruleset.RegexpMatcher
+	MITMDecision           *MITMDecisionConfig
 	ProxyLocalhost         ProxyLocalhostMode
 	UpstreamProxy          *url.URL
+	UpstreamProxyFallback  []*url.URL
+	UpstreamProxyRules     []*UpstreamProxyRule
 	UpstreamProxyFunc      ProxyFunc
 	DenyDomains            *ruleset.RegexpMatcher
+	BlockList              *ruleset.AdblockMatcher
 	DirectDomains          *ruleset.RegexpMatcher
+	UserPolicies           *UserPolicies
+	SNIRoutes              []*SNIRoute
+	Journal                *journal.Journal
+	Stats                  *stats.Stats
+	MetadataHeaders        []MetadataHeader
+	IntegrityDomains       *ruleset.RegexpMatcher
+	Hedging                *HedgingConfig
+	HSTS                   *hsts.Cache
+	SecurityHeaders        []*SecurityHeaderRule
+	Privacy                *PrivacyConfig
+	ResponseValidation     []*ResponseValidationRule
+	RetryStaleConns        bool
+	OriginAuthAffinity     bool
+	BlockedPlaceholders    bool
+	TestHooks              *TestHooks
+	Chain                  *HTTPProxy
+	TrustChainMetadata     bool
+	LatencySelector        *LatencySelector
+	Priority               *PriorityConfig
+	MetadataMaxValues      int
 	RequestIDHeader        string
 	RequestModifiers       []RequestModifier
 	ResponseModifiers      []ResponseModifier
+	Modifiers              []Modifier
 	ConnectRequestModifier func(*http.Request) error
+	WebSocketModifiers     []WebSocketModifier
 	ConnectPassthrough     bool
+	ConnectUDP             *ConnectUDPConfig
+	SlowClient             *SlowClientConfig
+	LoadShedding           *LoadSheddingConfig
+	FTPGateway             bool
 	CloseAfterReply        bool
+	ForwardInformational   bool
+	ModifyEventStreams     bool
 	ReadLimit              SizeSuffix
 	WriteLimit             SizeSuffix
+	HostBandwidthLimits    []*HostBandwidthLimit
+
+	// MaxConnsPerClient is the maximal number of concurrent connections per client,
+	// the client is the authenticated user, or the client IP if authentication is disabled.
+	// Requests on connections over the limit are rejected with 429 Too Many Requests.
+	// Zero means no limit.
+	MaxConnsPerClient int
+
+	// ClientCertIdentity is the field of the verified client certificate used as the client identity,
+	// if the proxy verifies client certificates, see HTTPServerConfig.ClientAuth.
+	ClientCertIdentity ClientCertIdentity
+
+	// AnnotationsHeader is the response header set to the request annotations, see middleware.Annotate.
+	// If empty, annotations are not sent to clients.
+	AnnotationsHeader string
+
+	// DebugHost is a reserved host name e.g. proxy.debug, requests to it are answered by the proxy with DebugInfo
+	// showing how the proxy saw the request, the url query parameter shows how a request to the URL would be handled.
+	// The requests require proxy authentication.
+	DebugHost string
+
+	// AllowClients limits client connections to the networks, if empty all clients are allowed.
+	// DenyClients rejects client connections from the networks, it takes precedence over AllowClients.
+	// Connections are checked when accepted, before reading requests,
+	// with the PROXY protocol the client address from the header is checked.
+	// The SOCKS5 and transparent servers and the DNS forwarder created for the proxy check their clients too.
+	// Connections served with ServeConn are not checked.
+	AllowClients []netip.Prefix
+	DenyClients  []netip.Prefix
+
+	// ConnectResponseHeaders are applied to responses to CONNECT requests,
+	// including 200 Connection Established and error responses.
+	ConnectResponseHeaders []header.Header
+
+	// Authenticators are tried after the basic or digest auth and JWT bearer auth,
+	// a request is authenticated if any of the authenticators accepts it.
+	Authenticators []Authenticator
+
+	// UpstreamAuthRules set when credentials are sent to upstream proxies, the first rule matching the proxy host is used.
+	// Proxies not matching any rule receive credentials preemptively.
+	UpstreamAuthRules []*UpstreamAuthRule
+
+	// UpstreamProxyTLS overrides the TLS configuration of connections to https:// upstream proxies.
+	UpstreamProxyTLS *UpstreamProxyTLSConfig
+
+	// OriginTLSRules override the TLS configuration of HTTPS connections to origin servers,
+	// the first rule matching the request host is used.
+	OriginTLSRules []*OriginTLSRule
+
+	// SyntheticEndpoints are served by the proxy to requests to pseudo-hosts without contacting a server,
+	// e.g. http://forwarder.internal/whoami, the requests require proxy authentication.
+	SyntheticEndpoints []*SyntheticEndpoint
+
+	// ErrorClassifiers map errors to custom error responses, e.g. to translate upstream specific errors.
+	// They are tried in order before the built-in classifiers.
+	ErrorClassifiers []ErrorClassifier
+
+	// MaxInFlight is the maximal number of requests sent upstream at the same time.
+	// Requests over the limit wait in a queue for up to InFlightQueueTimeout,
+	// and are rejected with 503 Service Unavailable if the timeout expires.
+	// CONNECT requests are not limited, MITMed requests are.
+	// Zero means no limit.
+	MaxInFlight          int
+	InFlightQueueTimeout time.Duration
+
+	// DrainRetryAfter is the Retry-After of 503 Service Unavailable responses to CONNECT requests
+	// received while the proxy is draining or shutting down, so that clients open new tunnels via another instance
+	// instead of having them cut when the proxy closes. Zero means the header is not sent.
+	DrainRetryAfter time.Duration
+
+	// SendProxyProtocol is the version of the PROXY protocol header, 1 or 2,
+	// sent on TCP connections to origin servers and upstream proxies with the client address.
+	// It is not sent on CONNECT-UDP sockets and FTP gateway connections.
+	// Keep-alives to origin servers and upstream proxies are disabled, as the header is sent once per connection.
+	// Zero disables sending the header.
+	SendProxyProtocol int
+
+	// RegexpLimits are applied to regexp rules set at runtime with the admin API and ImportState.
+	// If nil, the rules are not checked.
+	RegexpLimits *ruleset.RegexpLimits
+
+	// Shared are resources shared with other proxies in the process,
+	// a copy of the shared transport is used if the proxy is created with a nil round tripper.
+	Shared *SharedResources
 
 	// TestingHTTPHandler uses Martian's [http.Handler] implementation
 	// over [http.Server] instead of the default TCP server.
@@ -104,10 +267,17 @@ func DefaultHTTPProxyConfig() *HTTPProxyConfig {
 			Addr:              ":3128",
 			ReadHeaderTimeout: 1 * time.Minute,
 			LogHTTPMode:       httplog.Errors,
+			LogHTTPBodyLimit:  Mebi,
 		},
-		Name:            "forwarder",
-		ProxyLocalhost:  DenyProxyLocalhost,
-		RequestIDHeader: "X-Request-Id",
+		Name:               "forwarder",
+		AuthScheme:         BasicAuthScheme,
+		ProxyLocalhost:     DenyProxyLocalhost,
+		RequestIDHeader:    "X-Request-Id",
+		MetadataMaxValues:  100,
+		RetryStaleConns:    true,
+		OriginAuthAffinity: true,
+		ClientCertIdentity: CommonNameClientCertIdentity,
+		DrainRetryAfter:    5 * time.Second,
 	}
 }
 
@@ -118,27 +288,193 @@ func (c *HTTPProxyConfig) Validate() error {
 	if c.Protocol != HTTPScheme && c.Protocol != HTTPSScheme {
 		return fmt.Errorf("unsupported protocol: %s", c.Protocol)
 	}
+	if !c.AuthScheme.isValid() {
+		return fmt.Errorf("unsupported auth_scheme: %s", c.AuthScheme)
+	}
+	if c.HtpasswdFile != "" && c.AuthScheme != BasicAuthScheme {
+		return fmt.Errorf("htpasswd_file requires %s auth_scheme", BasicAuthScheme)
+	}
+	if c.ClientAuth.enabled() {
+		if !c.ClientCertIdentity.isValid() {
+			return fmt.Errorf("unsupported client_cert_identity: %s", c.ClientCertIdentity)
+		}
+		if c.ClientAuth.Optional && c.BasicAuth == nil && c.HtpasswdFile == "" && c.JWTAuth == nil && len(c.Authenticators) == 0 {
+			return errors.New("optional client_auth requires another authentication method")
+		}
+	}
+	if c.JWTAuth != nil {
+		if err := c.JWTAuth.Validate(); err != nil {
+			return fmt.Errorf("jwt_auth: %w", err)
+		}
+	}
+	if c.Bypass != nil {
+		if err := c.Bypass.Validate(); err != nil {
+			return fmt.Errorf("bypass: %w", err)
+		}
+	}
+	if c.TimeoutHeader != nil {
+		if err := c.TimeoutHeader.Validate(); err != nil {
+			return fmt.Errorf("timeout_header: %w", err)
+		}
+	}
+	for i, r := range c.UpstreamAuthRules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("upstream_auth_rules[%d]: %w", i, err)
+		}
+	}
+	for i, r := range c.OriginTLSRules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("origin_tls_rules[%d]: %w", i, err)
+		}
+	}
+	if c.DebugHost != "" && (strings.ContainsAny(c.DebugHost, ":/") || net.ParseIP(c.DebugHost) != nil) {
+		return fmt.Errorf("debug_host: must be a host name without port, got %q", c.DebugHost)
+	}
+	for i, e := range c.SyntheticEndpoints {
+		if err := e.Validate(); err != nil {
+			return fmt.Errorf("synthetic_endpoints[%d]: %w", i, err)
+		}
+	}
+	if c.UpstreamProxyTLS != nil {
+		if err := c.UpstreamProxyTLS.Validate(); err != nil {
+			return fmt.Errorf("upstream_proxy_tls: %w", err)
+		}
+	}
+	if c.MITM != nil {
+		if err := c.MITM.Validate(); err != nil {
+			return fmt.Errorf("mitm: %w", err)
+		}
+	}
+	if c.MITMDecision != nil {
+		if err := c.MITMDecision.Validate(); err != nil {
+			return fmt.Errorf("mitm_decision: %w", err)
+		}
+	}
+	if c.ConnectUDP != nil {
+		if err := c.ConnectUDP.Validate(); err != nil {
+			return fmt.Errorf("connect_udp: %w", err)
+		}
+	}
+	if c.SlowClient != nil {
+		if err := c.SlowClient.Validate(); err != nil {
+			return fmt.Errorf("slow_client: %w", err)
+		}
+	}
+	if c.LoadShedding != nil {
+		if err := c.LoadShedding.Validate(); err != nil {
+			return fmt.Errorf("load_shedding: %w", err)
+		}
+	}
+	if c.Hedging != nil {
+		if err := c.Hedging.Validate(); err != nil {
+			return fmt.Errorf("hedging: %w", err)
+		}
+	}
+	if c.Privacy != nil {
+		if err := c.Privacy.Validate(); err != nil {
+			return fmt.Errorf("privacy: %w", err)
+		}
+	}
+	if c.Priority != nil {
+		if err := c.Priority.Validate(); err != nil {
+			return fmt.Errorf("priority: %w", err)
+		}
+	}
+	if c.MaxConnsPerClient < 0 {
+		return errors.New("max_conns_per_client must be non-negative")
+	}
+	if c.MaxInFlight < 0 {
+		return errors.New("max_in_flight must be non-negative")
+	}
+	if c.InFlightQueueTimeout < 0 {
+		return errors.New("in_flight_queue_timeout must be non-negative")
+	}
+	if c.DrainRetryAfter < 0 {
+		return errors.New("drain_retry_after must be non-negative")
+	}
 	if !c.ProxyLocalhost.isValid() {
 		return fmt.Errorf("unsupported proxy_localhost: %s", c.ProxyLocalhost)
 	}
 	if err := validateProxyURL(c.UpstreamProxy); err != nil {
 		return fmt.Errorf("upstream_proxy_uri: %w", err)
 	}
+	if len(c.UpstreamProxyFallback) > 0 && c.UpstreamProxy == nil {
+		return fmt.Errorf("upstream_proxy_fallback: requires upstream proxy")
+	}
+	for _, u := range c.UpstreamProxyFallback {
+		if err := validateProxyURL(u); err != nil {
+			return fmt.Errorf("upstream_proxy_fallback: %w", err)
+		}
+	}
+	if c.SendProxyProtocol < 0 || c.SendProxyProtocol > 2 {
+		return fmt.Errorf("send_proxy_protocol: unsupported version %d", c.SendProxyProtocol)
+	}
+	if c.AnnotationsHeader != "" {
+		if err := validateHeaderName(c.AnnotationsHeader); err != nil {
+			return fmt.Errorf("annotations_header: %w", err)
+		}
+	}
+	if c.MetadataMaxValues <= 0 {
+		return fmt.Errorf("metadata_max_values must be positive")
+	}
+	if len(c.SecurityHeaders) > 0 && c.MITM == nil {
+		return fmt.Errorf("security_headers: require MITM")
+	}
+	if c.Chain != nil && (c.UpstreamProxy != nil || c.UpstreamProxyFunc != nil) {
+		return fmt.Errorf("chain: cannot be used with upstream proxy")
+	}
+	if len(c.SNIRoutes) > 0 {
+		if c.Protocol != HTTPSScheme {
+			return fmt.Errorf("sni_routes: require %s protocol", HTTPSScheme)
+		}
+		if err := validateSNIRoutes(c.SNIRoutes); err != nil {
+			return fmt.Errorf("sni_routes: %w", err)
+		}
+	}
+	for i, m := range c.Modifiers {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("modifiers[%d]: %w", i, err)
+		}
+	}
 
 	return nil
 }
 
 type HTTPProxy struct {
-	config     HTTPProxyConfig
-	pac        PACResolver
-	creds      *CredentialsMatcher
-	transport  http.RoundTripper
-	log        log.Logger
-	metrics    *httpProxyMetrics
-	proxy      *martian.Proxy
-	mitmCACert *x509.Certificate
-	proxyFunc  ProxyFunc
-	listener   net.Listener
+	config        HTTPProxyConfig
+	pac           PACResolver
+	runtime       atomic.Pointer[RuntimeConfig]
+	transport     http.RoundTripper
+	log           log.Logger
+	metrics       *httpProxyMetrics
+	proxy         *martian.Proxy
+	mitmCACert    *x509.Certificate
+	mitmCACerts   []*x509.Certificate
+	mitmProbe     *mitmProbe
+	mitmBypass    *mitmBypass
+	mitmDecisions *mitmDecisions
+	jwtAuth       *JWTAuth
+	htpasswd      *HtpasswdAuthenticator
+	clientCert    *ClientCertAuthenticator
+	bypassSecret  []byte
+	proxyFunc     ProxyFunc
+	observers     []martian.ResponseModifier
+	listener      net.Listener
+
+	mw          middlewareSwitch
+	reloadMu    sync.Mutex
+	priority    *priorityLimiter
+	shedder     *loadShedder
+	prometheus  *middleware.Prometheus
+	rateLimiter userRateLimiter
+	userLimiter ratelimit.KeyLimiter
+	hostLimiter *ratelimit.HostLimiter
+	connLimiter *clientConnLimiter
+	clients     *clientFilter
+
+	clientHellos *clientHelloRecorder
+
+	lc lifecycle
 
 	TLSConfig *tls.Config
 }
@@ -164,6 +500,28 @@ func NewHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 	hp.listener = l
 
 	hp.log.Infof("PROXY server listen address=%s protocol=%s", l.Addr(), hp.config.Protocol)
+	hp.logCapabilities()
+
+	return hp, nil
+}
+
+// NewInMemoryHTTPProxy creates a new HTTP proxy that does not listen on a network address.
+// Connections are served with ServeConn or DialContext, the Addr config field is ignored.
+// It is the caller's responsibility to call Close on the returned server.
+func NewInMemoryHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher, rt http.RoundTripper, log log.Logger) (*HTTPProxy, error) {
+	hp, err := newHTTPProxy(cfg, pr, cm, rt, log)
+	if err != nil {
+		return nil, err
+	}
+
+	if hp.config.Protocol == HTTPSScheme {
+		if err := hp.configureHTTPS(); err != nil {
+			return nil, err
+		}
+	}
+
+	hp.log.Infof("PROXY server in-memory protocol=%s", hp.config.Protocol)
+	hp.logCapabilities()
 
 	return hp, nil
 }
@@ -185,9 +543,15 @@ func newHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 	if cfg.UpstreamProxy != nil && pr != nil {
 		return nil, fmt.Errorf("cannot use both upstream proxy and PAC")
 	}
+	if cfg.Chain != nil && pr != nil {
+		return nil, fmt.Errorf("cannot use both chain and PAC")
+	}
 
-	// If not set, use http.DefaultTransport.
-	if rt == nil {
+	// If not set, use the shared transport or http.DefaultTransport.
+	if rt == nil && cfg.Shared != nil {
+		log.Infof("using shared HTTP transport dialer")
+		rt = cfg.Shared.Transport()
+	} else if rt == nil {
 		log.Infof("HTTP transport not configured, using standard library default")
 		rt = http.DefaultTransport.(*http.Transport).Clone()
 	} else if tr, ok := rt.(*http.Transport); !ok {
@@ -195,13 +559,48 @@ func newHTTPProxy(cfg *HTTPProxyConfig, pr PACResolver, cm *CredentialsMatcher,
 	} else if tr.TLSClientConfig != nil && tr.TLSClientConfig.RootCAs != nil {
 		log.Infof("using custom root CA certificates")
 	}
+	if cfg.Chain != nil {
+		var err error
+		if rt, err = chainTransport(rt, cfg.Chain); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TestHooks != nil {
+		log.Infof("using test hooks")
+		var err error
+		if rt, err = cfg.TestHooks.transport(rt); err != nil {
+			return nil, fmt.Errorf("test hooks: %w", err)
+		}
+	}
 	hp := &HTTPProxy{
 		config:    *cfg,
 		pac:       pr,
-		creds:     cm,
 		transport: rt,
 		log:       log,
-		metrics:   newMetrics(cfg.PromRegistry, cfg.PromNamespace),
+	}
+	hp.config.PromRegistry = promRegisterer(cfg.PromRegistry, cfg.PromInstance, log)
+	hp.metrics = newMetrics(hp.config.PromRegistry, cfg.PromNamespace, cfg.MetadataMaxValues)
+	if len(cfg.AllowClients) > 0 || len(cfg.DenyClients) > 0 {
+		hp.log.Infof("filtering client connections allow=%d deny=%d", len(cfg.AllowClients), len(cfg.DenyClients))
+		hp.clients = &clientFilter{allow: cfg.AllowClients, deny: cfg.DenyClients}
+	}
+	rc := &RuntimeConfig{
+		UpstreamProxy:      cfg.UpstreamProxy,
+		DenyDomains:        cfg.DenyDomains,
+		DirectDomains:      cfg.DirectDomains,
+		MITMDomains:        cfg.MITMDomains,
+		MITMExcludeDomains: cfg.MITMExcludeDomains,
+		Credentials:        cm,
+		LogHTTPMode:        cfg.LogHTTPMode,
+	}
+	hp.observeRuntimeConfig(rc)
+	hp.runtime.Store(rc)
+	hp.observeRulesets()
+
+	if h := cfg.TestHooks; h != nil && h.Clock != nil && cfg.MITM != nil && cfg.MITM.Clock == nil {
+		mc := *cfg.MITM
+		mc.Clock = h.Clock
+		hp.config.MITM = &mc
 	}
 
 	if err := hp.configureProxy(); err != nil {
@@ -220,7 +619,19 @@ func (hp *HTTPProxy) configureHTTPS() error {
 
 	hp.TLSConfig = httpsTLSConfigTemplate()
 
-	return hp.config.ConfigureTLSConfig(hp.TLSConfig)
+	if err := hp.config.ConfigureTLSConfig(hp.TLSConfig); err != nil {
+		return err
+	}
+	if err := hp.config.ClientAuth.configureTLSConfig(hp.TLSConfig); err != nil {
+		return err
+	}
+
+	if err := hp.configureSNIRoutes(); err != nil {
+		return err
+	}
+	hp.configureClientHelloCapture()
+
+	return nil
 }
 
 func (hp *HTTPProxy) configureProxy() error {
@@ -232,14 +643,58 @@ func (hp *HTTPProxy) configureProxy() error {
 		if err != nil {
 			return fmt.Errorf("mitm: %w", err)
 		}
+		if hp.config.Shared != nil {
+			mc.SetCertCache(hp.config.Shared.mitmCerts)
+		}
+		mc.SetHandshakeCallback(hp.mitmHandshake)
+		mc.SetHandshakeErrorCallback(hp.mitmHandshakeError)
 		hp.proxy.SetMITM(mc)
 		hp.mitmCACert = mc.CACert()
+		hp.mitmCACerts = []*x509.Certificate{hp.mitmCACert}
 
-		if hp.config.MITMDomains != nil {
-			hp.proxy.MITMFilter = func(req *http.Request) bool {
-				return hp.config.MITMDomains.Match(req.URL.Hostname())
-			}
+		sca, err := hp.config.MITM.loadSecondaryCACertificate()
+		if err != nil {
+			return fmt.Errorf("mitm: %w", err)
+		}
+		if sca != nil {
+			hp.log.Infof("MITM signing with CA %s, publishing secondary CA %s", caFingerprint(hp.mitmCACert), caFingerprint(sca))
+			hp.mitmCACerts = append(hp.mitmCACerts, sca)
+		}
+
+		if d := hp.config.MITM.HandshakeFailureBypass; d > 0 {
+			hp.mitmBypass = newMITMBypass(d, hp.now)
+		}
+
+		hp.proxy.MITMFilter = hp.mitmFilter
+	}
+
+	if hp.config.JWTAuth != nil {
+		ja, err := NewJWTAuth(hp.config.JWTAuth, hp.log)
+		if err != nil {
+			return fmt.Errorf("jwt auth: %w", err)
+		}
+		hp.jwtAuth = ja
+	}
+
+	if hp.config.HtpasswdFile != "" {
+		a, err := NewHtpasswdAuthenticator(hp.config.HtpasswdFile, hp.log)
+		if err != nil {
+			return fmt.Errorf("htpasswd_file: %w", err)
+		}
+		hp.htpasswd = a
+	}
+
+	if hp.config.ClientAuth.enabled() {
+		hp.clientCert = &ClientCertAuthenticator{Identity: hp.config.ClientCertIdentity}
+	}
+
+	if hp.config.Bypass != nil {
+		hp.log.Infof("using signed bypass header %s", BypassHeader)
+		b, err := hp.config.Bypass.loadSecret()
+		if err != nil {
+			return fmt.Errorf("bypass: %w", err)
 		}
+		hp.bypassSecret = b
 	}
 
 	hp.proxy.AllowHTTP = true
@@ -249,59 +704,218 @@ func (hp *HTTPProxy) configureProxy() error {
 	hp.proxy.WithoutWarning = true
 	hp.proxy.ErrorResponse = hp.errorResponse
 	hp.proxy.CloseAfterReply = hp.config.CloseAfterReply
+	hp.proxy.ForwardInformational = hp.config.ForwardInformational
 	hp.proxy.ReadTimeout = hp.config.ReadTimeout
 	hp.proxy.ReadHeaderTimeout = hp.config.ReadHeaderTimeout
 	hp.proxy.WriteTimeout = hp.config.WriteTimeout
+	hp.proxy.MaxInFlight = hp.config.MaxInFlight
+	hp.proxy.InFlightQueueTimeout = hp.config.InFlightQueueTimeout
+	if hp.config.TimeoutHeader != nil {
+		hp.log.Infof("using %s header max=%s", TimeoutHeader, hp.config.TimeoutHeader.MaxTimeout)
+		hp.proxy.RequestTimeout = requestTimeout
+	}
 	// Martian has an intertwined logic for setting http.Transport and the dialer.
 	// The dialer is wrapped, so that additional syscalls are made to the dialed connections.
 	// As a result the dialer needs to be reset.
 	if tr, ok := hp.transport.(*http.Transport); ok {
 		// Note: The order matters. DialContext needs to be set first.
 		// SetRoundTripper overwrites tr.DialContext with hp.proxy.dial.
-		hp.proxy.SetDialContext(tr.DialContext)
+		dial := hp.dialRetryMetrics(tr.DialContext)
+		if hp.config.SendProxyProtocol != 0 {
+			dial = hp.proxyProtocolDial(dial)
+			// The PROXY protocol header is sent once per connection, connections cannot be reused by other clients.
+			// The transport is cloned, so that keep-alives are not disabled for other users of the transport.
+			tr = tr.Clone()
+			tr.DisableKeepAlives = true
+			hp.transport = tr
+			hp.log.Infof("sending PROXY protocol v%d header, keep-alives to upstream servers are disabled", hp.config.SendProxyProtocol)
+		}
+		hp.proxy.SetDialContext(dial)
 		hp.proxy.SetRoundTripper(tr)
 	} else {
 		hp.proxy.SetRoundTripper(hp.transport)
 	}
 
+	if hp.config.MITM != nil && (hp.config.MITM.SkipEV || len(hp.config.MITM.SkipPins) > 0) {
+		if err := hp.configureMITMProbe(); err != nil {
+			return fmt.Errorf("mitm: %w", err)
+		}
+	}
+
+	if hp.config.MITMDecision != nil {
+		hp.configureMITMDecisions()
+	}
+
+	if hp.config.Hedging != nil {
+		hp.log.Infof("using hedged requests after %s or p%g latency", hp.config.Hedging.Delay, hp.config.Hedging.Percentile)
+		hp.proxy.RoundTripFunc = newHedger(hp.config.Hedging, hp.metrics.hedge).RoundTrip
+	}
+
+	if hp.config.RetryStaleConns {
+		next := hp.proxy.RoundTripFunc
+		hp.proxy.RoundTripFunc = func(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+			rt = staleConnRetrier{rt: rt, report: hp.metrics.staleConnRetry}
+			if next != nil {
+				return next(rt, req)
+			}
+			return rt.RoundTrip(req)
+		}
+	}
+
+	// Added after the stale connection retrier, so that it receives the transport selected by the rules.
+	if hp.config.OriginAuthAffinity {
+		hp.configureOriginAuthAffinity()
+	}
+
+	if hp.config.LatencySelector != nil {
+		hp.log.Infof("using latency-aware upstream proxy selection")
+		hp.configureLatencySelector()
+	}
+
+	if len(hp.config.UpstreamProxyFallback) > 0 || hp.pac != nil {
+		hp.configureUpstreamFallback()
+	}
+
+	if len(hp.config.HostBandwidthLimits) > 0 {
+		hp.configureHostBandwidthLimits()
+	}
+	if hp.hasPolicies() {
+		hp.configureUserBandwidthLimits()
+	}
+
+	// Must be the last round trip function, so that the others use the transport selected by the rules.
+	if len(hp.config.OriginTLSRules) > 0 {
+		if err := hp.configureOriginTLSRules(); err != nil {
+			return err
+		}
+	}
+
+	if hp.config.FTPGateway {
+		tr, ok := hp.transport.(*http.Transport)
+		if !ok {
+			return fmt.Errorf("ftp gateway requires *http.Transport, got %T", hp.transport)
+		}
+		hp.log.Infof("using FTP gateway")
+		tr.RegisterProtocol("ftp", &ftp.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tr.DialContext(withoutProxyProtocol(ctx), network, addr)
+			},
+			Timeout: tr.ResponseHeaderTimeout,
+		})
+	}
+
 	switch {
+	case hp.config.Chain != nil:
+		hp.log.Infof("using chained proxy")
+		hp.proxyFunc = func(*http.Request) (*url.URL, error) {
+			return chainProxyURL, nil
+		}
 	case hp.config.UpstreamProxyFunc != nil:
 		hp.log.Infof("using external proxy function")
 		hp.proxyFunc = hp.config.UpstreamProxyFunc
-	case hp.config.UpstreamProxy != nil:
-		u := hp.upstreamProxyURL()
-		hp.log.Infof("using upstream proxy: %s", u.Redacted())
-		hp.proxyFunc = http.ProxyURL(u)
 	case hp.pac != nil:
 		hp.log.Infof("using PAC proxy")
 		hp.proxyFunc = hp.pacProxy
 	default:
-		hp.log.Infof("no upstream proxy specified")
+		if u := hp.upstreamProxyURL(); u != nil {
+			hp.log.Infof("using upstream proxy: %s", u.Redacted())
+			for _, fu := range hp.config.UpstreamProxyFallback {
+				hp.log.Infof("using fallback upstream proxy: %s", fu.Redacted())
+			}
+		} else {
+			hp.log.Infof("no upstream proxy specified")
+		}
+		hp.proxyFunc = hp.upstreamProxy
 	}
 
-	if hp.config.DirectDomains != nil {
-		hp.proxyFunc = hp.directDomains(hp.proxyFunc)
+	for _, r := range hp.config.UpstreamProxyRules {
+		hp.log.Infof("using upstream proxy rule: %s => %s", r.Domain, proxyString(r.Proxy))
 	}
+	hp.proxyFunc = hp.directDomains(hp.userPolicyProxy(hp.upstreamProxyRules(hp.proxyFunc)))
 
 	hp.log.Infof("localhost proxying mode=%s", hp.config.ProxyLocalhost)
 	if hp.config.ProxyLocalhost == DirectProxyLocalhost {
 		hp.proxyFunc = hp.directLocalhost(hp.proxyFunc)
 	}
-	hp.proxy.SetUpstreamProxyFunc(hp.proxyFunc)
+	hp.proxy.SetUpstreamProxyFunc(recordUpstream(hp.proxyFunc))
 
-	mw := hp.middlewareStack()
-	hp.proxy.SetRequestModifier(mw)
-	hp.proxy.SetResponseModifier(mw)
+	for _, r := range hp.config.UpstreamAuthRules {
+		hp.log.Infof("using upstream proxy auth rule: %s", r)
+	}
+	if len(hp.config.UpstreamAuthRules) > 0 {
+		hp.proxy.UpstreamAuthChallenge = hp.upstreamAuthChallenge
+	}
+	if c := hp.config.UpstreamProxyTLS; c != nil {
+		hp.log.Infof("using upstream proxy TLS config: %s", c)
+		hp.proxy.UpstreamTLSConfig = c.tlsConfig(hp.transportTLSConfig())
+	}
+	hp.proxy.UpgradeFilter = hp.webSocketFilter
+
+	// Stateful modifiers are shared by all middleware stacks, so that their state survives reloads.
+	if hp.config.Protocol == HTTPSScheme {
+		hp.clientHellos = new(clientHelloRecorder)
+	}
+	if hp.config.Priority != nil {
+		hp.priority = newPriorityLimiter(hp.config.Priority)
+	}
+	if hp.config.MaxConnsPerClient > 0 {
+		hp.connLimiter = newClientConnLimiter(hp.config.MaxConnsPerClient)
+	}
+	if hp.config.LoadShedding != nil {
+		hp.shedder = &loadShedder{
+			cfg:    hp.config.LoadShedding,
+			sample: newSystemLoad(hp.config.LoadShedding).sample,
+		}
+	}
+	if hp.config.PromRegistry != nil {
+		hp.prometheus = middleware.NewPrometheus(hp.config.PromRegistry, hp.config.PromNamespace)
+	}
+	hp.observers = hp.responseObservers()
+
+	hp.mw.store(hp.middlewareStack())
+	hp.proxy.SetRequestModifier(&hp.mw)
+	hp.proxy.SetResponseModifier(&hp.mw)
 
 	return nil
 }
 
+// upstreamProxy returns the upstream proxy followed by the fallback proxies.
+// The proxies are selected once per request, the fallback proxies are used when dialing fails.
+func (hp *HTTPProxy) upstreamProxy(req *http.Request) (*url.URL, error) {
+	if f := upstreamFallbackFrom(req); f != nil {
+		return f.current(), nil
+	}
+
+	u := hp.upstreamProxyURL()
+	if u == nil || len(hp.config.UpstreamProxyFallback) == 0 {
+		return u, nil
+	}
+
+	cm := hp.runtime.Load().Credentials
+	proxies := make([]*url.URL, 0, 1+len(hp.config.UpstreamProxyFallback))
+	proxies = append(proxies, u)
+	for _, fu := range hp.config.UpstreamProxyFallback {
+		proxies = append(proxies, proxyURLWithCredentials(fu, cm))
+	}
+	return selectUpstreamFallback(req, proxies), nil
+}
+
 func (hp *HTTPProxy) upstreamProxyURL() *url.URL {
+	rc := hp.runtime.Load()
+	if rc.UpstreamProxy == nil {
+		return nil
+	}
+
+	return proxyURLWithCredentials(rc.UpstreamProxy, rc.Credentials)
+}
+
+// proxyURLWithCredentials returns a copy of the proxy URL, credentials are added if not set.
+func proxyURLWithCredentials(u *url.URL, cm *CredentialsMatcher) *url.URL {
 	proxyURL := new(url.URL)
-	*proxyURL = *hp.config.UpstreamProxy
+	*proxyURL = *u
 
 	if proxyURL.User == nil {
-		if u := hp.creds.MatchURL(proxyURL); u != nil {
+		if u := cm.MatchURLScope(proxyURL, ProxyCredentialsScope); u != nil {
 			proxyURL.User = u
 		}
 	}
@@ -309,63 +923,217 @@ func (hp *HTTPProxy) upstreamProxyURL() *url.URL {
 	return proxyURL
 }
 
+// pacProxy returns the first proxy from the PAC result, the rest is used when dialing fails.
 func (hp *HTTPProxy) pacProxy(r *http.Request) (*url.URL, error) {
+	if f := upstreamFallbackFrom(r); f != nil {
+		return f.current(), nil
+	}
+
 	s, err := hp.pac.FindProxyForURL(r.URL, "")
 	if err != nil {
 		return nil, err
 	}
 
-	p, err := pac.Proxies(s).First()
+	cm := hp.runtime.Load().Credentials
+
+	if ls := hp.config.LatencySelector; ls != nil {
+		proxyURL, err := selectPACProxy(r, pac.Proxies(s), ls)
+		if err != nil {
+			return nil, err
+		}
+		if u := cm.MatchURLScope(proxyURL, ProxyCredentialsScope); u != nil {
+			proxyURL.User = u
+		}
+		return proxyURL, nil
+	}
+
+	proxies, err := pacFallbackProxies(pac.Proxies(s))
 	if err != nil {
 		return nil, err
 	}
-
-	proxyURL := p.URL()
-	if u := hp.creds.MatchURL(proxyURL); u != nil {
-		proxyURL.User = u
+	for _, p := range proxies {
+		if u := cm.MatchURLScope(p, ProxyCredentialsScope); u != nil {
+			p.User = u
+		}
 	}
 
-	return proxyURL, nil
+	return selectUpstreamFallback(r, proxies), nil
 }
 
 func (hp *HTTPProxy) middlewareStack() martian.RequestResponseModifier {
 	// Wrap stack in a group so that we can run security checks before the httpspec modifiers.
 	topg := fifo.NewGroup()
-	if hp.config.BasicAuth != nil {
-		hp.log.Infof("basic auth enabled")
-		topg.AddRequestModifier(hp.basicAuth(hp.config.BasicAuth))
+	if hp.clientHellos != nil {
+		topg.AddRequestModifier(hp.tlsClientHello())
+	}
+	if hp.config.Journal != nil {
+		topg.AddRequestModifier(journalRecorder{hp.config.Journal})
+	}
+	if hp.config.Stats != nil {
+		topg.AddRequestModifier(statsRecorder{hp.config.Stats})
+	}
+	topg.AddRequestModifier(hp.drainRejectConnect())
+	if hp.shedder != nil {
+		topg.AddRequestModifier(hp.loadShedding())
+	}
+	if hp.config.SendProxyProtocol != 0 {
+		topg.AddRequestModifier(hp.recordProxyProtocolSource())
+	}
+	topg.AddRequestModifier(hp.chainMetadataFromHeader())
+	if len(hp.config.MetadataHeaders) > 0 {
+		topg.AddRequestModifier(hp.metadataFromHeaders())
+	}
+	if hp.config.MITM != nil && hp.config.MITM.CAHost != "" {
+		// Added before authentication, the CA certificate is not a secret and clients may not be able to authenticate yet.
+		m := hp.mitmCAHost()
+		topg.AddRequestModifier(m)
+		topg.AddResponseModifier(m)
+	}
+	if hp.authRequired() {
+		topg.AddRequestModifier(hp.proxyAuth())
+	}
+	if hp.connLimiter != nil {
+		topg.AddRequestModifier(hp.clientConnLimit())
+	}
+	if hp.config.DebugHost != "" {
+		d := debugHost{hp}
+		topg.AddRequestModifier(d)
+		topg.AddResponseModifier(d)
+	}
+	if len(hp.config.SyntheticEndpoints) > 0 {
+		// Added before the localhost and domain checks, they are skipped for the pseudo-hosts, see skipServedLocally.
+		s := hp.syntheticEndpoints()
+		topg.AddRequestModifier(s)
+		topg.AddResponseModifier(s)
+	}
+	if hp.bypassSecret != nil {
+		topg.AddRequestModifier(hp.bypass())
+	}
+	if hp.config.TimeoutHeader != nil {
+		topg.AddRequestModifier(hp.timeoutHeader())
+	}
+	if hp.config.ConnectUDP != nil {
+		topg.AddRequestModifier(hp.connectUDP())
 	}
 	if hp.config.ProxyLocalhost == DenyProxyLocalhost {
-		topg.AddRequestModifier(hp.denyLocalhost())
+		topg.AddRequestModifier(skipServedLocally(hp.denyLocalhost()))
+	}
+	topg.AddRequestModifier(skipServedLocally(hp.denyDomains()))
+	if hp.config.BlockList != nil {
+		topg.AddRequestModifier(skipServedLocally(hp.blockList()))
 	}
-	if hp.config.DenyDomains != nil {
-		topg.AddRequestModifier(hp.denyDomains(hp.config.DenyDomains))
+	if hp.hasPolicies() {
+		topg.AddRequestModifier(skipServedLocally(hp.denyUserPolicyDomains()))
+		topg.AddRequestModifier(skipServedLocally(hp.userRateLimit()))
+	}
+	if hp.mitmDecisions != nil {
+		topg.AddRequestModifier(hp.mitmDecision())
+	}
+	if hp.interceptWebSocket() {
+		// Added before the stack, the upgrade headers are removed as hop-by-hop headers.
+		topg.AddRequestModifier(stripWebSocketExtensions())
 	}
 
 	// stack contains the request/response modifiers in the order they are applied.
 	// fg is the inner stack that is executed after the core request modifiers and before the core response modifiers.
-	stack, fg := httpspec.NewStack(hp.config.Name)
+	var stack, fg *fifo.Group
+	if h := hp.config.TestHooks; h != nil && h.Seed != 0 {
+		stack, fg = httpspec.NewStackWithViaBoundary(hp.config.Name, h.viaBoundary())
+	} else {
+		stack, fg = httpspec.NewStack(hp.config.Name)
+	}
+	if hp.priority != nil {
+		topg.AddRequestModifier(hp.priority)
+		topg.AddResponseModifier(hp.priority)
+	}
 	topg.AddRequestModifier(stack)
 	topg.AddResponseModifier(stack)
+	if len(hp.config.ConnectResponseHeaders) > 0 {
+		// Added after the stack, so that the headers are not removed as hop-by-hop headers.
+		topg.AddResponseModifier(connectResponseHeaders(hp.config.ConnectResponseHeaders))
+	}
+	if hp.config.AnnotationsHeader != "" {
+		topg.AddResponseModifier(hp.annotationsHeader())
+	}
+	for _, m := range hp.observers {
+		topg.AddResponseModifier(m)
+	}
+	topg.AddResponseModifier(hp.responseStreamTimer())
 
 	for _, m := range hp.config.RequestModifiers {
 		fg.AddRequestModifier(m)
 	}
 
 	for _, m := range hp.config.ResponseModifiers {
-		fg.AddResponseModifier(m)
+		fg.AddResponseModifier(hp.skipEventStreams(m))
+	}
+
+	for _, m := range hp.config.Modifiers {
+		reqmod, resmod := m.modifiers()
+		if reqmod != nil {
+			fg.AddRequestModifier(reqmod)
+		}
+		if resmod != nil {
+			fg.AddResponseModifier(hp.skipEventStreams(resmod))
+		}
 	}
 
-	if hp.config.LogHTTPMode != httplog.None {
-		lf := httplog.NewLogger(hp.log.Infof, hp.config.LogHTTPMode).LogFunc()
+	if hp.runtime.Load().LogHTTPMode != httplog.None {
+		lf := hp.httpLogger().LogFunc()
 		fg.AddRequestModifier(lf)
 		fg.AddResponseModifier(lf)
 	}
 
-	if hp.config.PromRegistry != nil {
-		p := middleware.NewPrometheus(hp.config.PromRegistry, hp.config.PromNamespace)
-		stack.AddRequestModifier(p)
-		stack.AddResponseModifier(p)
+	if hp.prometheus != nil {
+		stack.AddRequestModifier(hp.prometheus)
+		stack.AddResponseModifier(hp.prometheus)
+	}
+
+	if hp.config.HSTS != nil {
+		he := hstsEnforcer{hp: hp, cache: hp.config.HSTS}
+		fg.AddRequestModifier(he)
+		fg.AddResponseModifier(he)
+	}
+
+	if len(hp.config.ResponseValidation) > 0 {
+		fg.AddResponseModifier(responseValidator{hp: hp, rules: hp.config.ResponseValidation})
+	}
+
+	if hp.config.Privacy != nil {
+		pf := hp.privacyFilter()
+		fg.AddRequestModifier(pf)
+		fg.AddResponseModifier(pf)
+	}
+
+	if len(hp.config.SecurityHeaders) > 0 {
+		fg.AddResponseModifier(securityHeaders{hp: hp, rules: hp.config.SecurityHeaders})
+	}
+
+	if hp.config.IntegrityDomains != nil {
+		ic := hp.integrityCheck()
+		fg.AddRequestModifier(ic)
+		fg.AddResponseModifier(ic)
+	}
+
+	if hp.config.MITM != nil {
+		if m := hp.upstreamDowngrades(); m != nil {
+			fg.AddResponseModifier(m)
+		}
+	}
+
+	if hp.config.Chain != nil {
+		fg.AddRequestModifier(hp.chainMetadataToHeader())
+	}
+
+	if hp.hostLimiter != nil {
+		hl := hostBandwidthLimiter{hp.hostLimiter}
+		fg.AddRequestModifier(hl)
+		fg.AddResponseModifier(hl)
+	}
+	if hp.hasPolicies() {
+		ul := userBandwidthLimiter{hp}
+		fg.AddRequestModifier(ul)
+		fg.AddResponseModifier(ul)
 	}
 
 	fg.AddRequestModifier(martian.RequestModifierFunc(hp.setBasicAuth))
@@ -374,46 +1142,125 @@ func (hp *HTTPProxy) middlewareStack() martian.RequestResponseModifier {
 	return topg.ToImmutable()
 }
 
+// responseObservers returns response modifiers that record responses,
+// they are also called for responses to requests aborted by the proxy.
+func (hp *HTTPProxy) responseObservers() []martian.ResponseModifier {
+	var obs []martian.ResponseModifier
+	if hp.config.Journal != nil {
+		obs = append(obs, journalRecorder{hp.config.Journal})
+	}
+	if hp.config.Stats != nil {
+		obs = append(obs, statsRecorder{hp.config.Stats})
+	}
+	obs = append(obs, hp.metadataMetrics())
+	return obs
+}
+
+// httpLogger returns a logger for proxied requests using the current HTTP log mode.
+func (hp *HTTPProxy) httpLogger() *httplog.Logger {
+	cfg := hp.config.HTTPServerConfig
+	cfg.LogHTTPMode = hp.runtime.Load().LogHTTPMode
+	if cfg.LogHTTPMode == httplog.Body && hp.shedder != nil && hp.shedder.Level() >= loadSheddingNoBodyLogging {
+		cfg.LogHTTPMode = httplog.Headers
+	}
+	l := newHTTPLogger(&cfg, hp.log.Infof)
+	if hp.config.MITM != nil && hp.config.MITM.hasInspectionLimits() {
+		l.SetBodyLimitFunc(hp.mitmBodyLimits)
+	}
+	if hp.bypassSecret != nil {
+		l.SetSkipBodyFunc(func(req *http.Request) bool {
+			return hasBypass(req, BypassLogBody)
+		})
+	}
+	return l
+}
+
+// mitmBodyLimits returns the MITM inspection limits for MITMed requests, and the HTTP log body limit otherwise.
+func (hp *HTTPProxy) mitmBodyLimits(req *http.Request) (reqLimit, resLimit int64) {
+	reqLimit = int64(hp.config.LogHTTPBodyLimit)
+	resLimit = reqLimit
+
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return
+	}
+	if _, ok := ctx.Session().Get(mitmClientHelloKey); !ok {
+		return
+	}
+	if l := hp.config.MITM.MaxInspectedRequestBody; l > 0 {
+		reqLimit = int64(l)
+	}
+	if l := hp.config.MITM.MaxResponseSnapshot; l > 0 {
+		resLimit = int64(l)
+	}
+	return
+}
+
+// skipServedLocally skips m for requests served by the proxy without a round trip,
+// i.e. to the debug host, MITM CA host and synthetic endpoints pseudo-hosts, that are not resolved.
+func skipServedLocally(m martian.RequestModifier) martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if ctx := martian.NewContext(req); ctx != nil && ctx.SkippingRoundTrip() {
+			return nil
+		}
+		return m.ModifyRequest(req)
+	})
+}
+
 func (hp *HTTPProxy) abortIf(condition func(r *http.Request) bool, response func(*http.Request) *http.Response, returnErr error) martian.RequestModifier {
 	return martian.RequestModifierFunc(func(req *http.Request) error {
 		if !condition(req) {
 			return nil
 		}
 
-		lf := httplog.NewLogger(hp.log.Infof, hp.config.LogHTTPMode).LogFunc()
-		if err := lf.ModifyRequest(req); err != nil {
-			hp.log.Errorf("got error while logging request: %s", err)
-		}
+		hp.abort(req, response(req))
+
+		return returnErr
+	})
+}
 
-		res := response(req)
-		defer res.Body.Close()
-		res.Close = true // hijacked connection is closed by Martian in handleLoop()
+// abort writes the response to the client and hijacks the session, the connection is closed.
+func (hp *HTTPProxy) abort(req *http.Request, res *http.Response) {
+	lf := hp.httpLogger().LogFunc()
+	if err := lf.ModifyRequest(req); err != nil {
+		hp.log.Errorf("got error while logging request: %s", err)
+	}
 
-		if err := lf.ModifyResponse(res); err != nil {
-			hp.log.Errorf("got error while logging response: %s", err)
-		}
+	defer res.Body.Close()
+	res.Close = true // hijacked connection is closed by Martian in handleLoop()
 
-		session := martian.NewContext(req).Session()
-		var (
-			brw *bufio.ReadWriter
-			rw  http.ResponseWriter
-			err error
-		)
-		_, brw, err = session.Hijack()
+	if len(hp.config.ConnectResponseHeaders) > 0 {
+		connectResponseHeaders(hp.config.ConnectResponseHeaders).ModifyResponse(res) //nolint:errcheck // never fails
+	}
+	if hp.config.AnnotationsHeader != "" {
+		hp.annotationsHeader().ModifyResponse(res) //nolint:errcheck // never fails
+	}
+
+	if err := lf.ModifyResponse(res); err != nil {
+		hp.log.Errorf("got error while logging response: %s", err)
+	}
+	for _, m := range hp.observers {
+		m.ModifyResponse(res) //nolint:errcheck // observers do not fail
+	}
+
+	session := martian.NewContext(req).Session()
+	var (
+		brw *bufio.ReadWriter
+		rw  http.ResponseWriter
+		err error
+	)
+	_, brw, err = session.Hijack()
+	if err == nil {
+		hp.writeErrorResponseToBuffer(res, brw)
+	} else if errors.Is(err, http.ErrNotSupported) {
+		rw, err = session.HijackResponseWriter()
 		if err == nil {
-			hp.writeErrorResponseToBuffer(res, brw)
-		} else if errors.Is(err, http.ErrNotSupported) {
-			rw, err = session.HijackResponseWriter()
-			if err == nil {
-				hp.writeErrorResponseToResponseWriter(res, rw)
-			}
+			hp.writeErrorResponseToResponseWriter(res, rw)
 		}
-		if err != nil {
-			panic(err)
-		}
-
-		return returnErr
-	})
+	}
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (hp *HTTPProxy) writeErrorResponseToBuffer(res *http.Response, brw *bufio.ReadWriter) {
@@ -440,37 +1287,66 @@ func (hp *HTTPProxy) writeErrorResponseToResponseWriter(res *http.Response, rw h
 	}
 }
 
-func (hp *HTTPProxy) basicAuth(u *url.Userinfo) martian.RequestModifier {
-	user := u.Username()
-	pass, _ := u.Password()
-	ba := middleware.NewProxyBasicAuth()
-
-	return hp.abortIf(func(req *http.Request) bool {
-		return !ba.AuthenticatedRequest(req, user, pass)
-	}, unauthorizedResponse, errors.New("basic auth required"))
-}
-
 func (hp *HTTPProxy) denyLocalhost() martian.RequestModifier {
 	return hp.abortIf(hp.isLocalhost, func(req *http.Request) *http.Response {
 		return hp.errorResponse(req, ErrProxyLocalhost)
 	}, errors.New("localhost access denied"))
 }
 
-func (hp *HTTPProxy) denyDomains(r *ruleset.RegexpMatcher) martian.RequestModifier {
+func (hp *HTTPProxy) denyDomains() martian.RequestModifier {
 	return hp.abortIf(func(req *http.Request) bool {
-		return r.Match(req.URL.Hostname())
+		r := hp.runtime.Load().DenyDomains
+		return r != nil && r.Match(req.URL.Hostname())
 	}, func(req *http.Request) *http.Response {
 		return hp.errorResponse(req, ErrProxyDenied)
 	}, errors.New("domain access denied"))
 }
 
+func (hp *HTTPProxy) blockList() martian.RequestModifier {
+	return hp.abortIf(func(req *http.Request) bool {
+		return hp.config.BlockList.Match(req.URL.Hostname(), blockListURL(req))
+	}, func(req *http.Request) *http.Response {
+		return hp.errorResponse(req, ErrProxyBlocked)
+	}, errors.New("blocked by filter list"))
+}
+
+// hostDenied returns the error for requests to hosts denied by the localhost policy, deny domains,
+// block list or user policy, and nil if the host is allowed.
+// It is used by the paths that do not go through the request modifiers, where only the host is known,
+// i.e. CONNECT-UDP and the DNS forwarder.
+func (hp *HTTPProxy) hostDenied(req *http.Request) error {
+	host := req.URL.Hostname()
+	if hp.config.ProxyLocalhost == DenyProxyLocalhost && hp.isLocalhost(req) {
+		return ErrProxyLocalhost
+	}
+	if r := hp.runtime.Load().DenyDomains; r != nil && r.Match(host) {
+		return ErrProxyDenied
+	}
+	if hp.config.BlockList != nil && hp.config.BlockList.Match(host, "https://"+req.URL.Host+"/") {
+		return ErrProxyBlocked
+	}
+	if hp.userPolicy(req).deniedDomain(host) {
+		return ErrProxyDeniedByUserPolicy
+	}
+	return nil
+}
+
+// blockListURL returns the URL matched against the block list,
+// for CONNECT requests only the host is known.
+func blockListURL(req *http.Request) string {
+	if req.Method == http.MethodConnect {
+		return "https://" + req.URL.Host + "/"
+	}
+	return req.URL.String()
+}
+
 func (hp *HTTPProxy) directDomains(fn ProxyFunc) ProxyFunc {
 	if fn == nil {
 		return nil
 	}
 
 	return func(req *http.Request) (*url.URL, error) {
-		if hp.config.DirectDomains.Match(req.URL.Hostname()) {
+		if r := hp.runtime.Load().DirectDomains; r != nil && r.Match(req.URL.Hostname()) {
 			return nil, nil
 		}
 		return fn(req)
@@ -490,6 +1366,21 @@ func (hp *HTTPProxy) directLocalhost(fn ProxyFunc) ProxyFunc {
 	}
 }
 
+// recordUpstream associates the upstream proxy returned by fn with the request, see middleware.Upstream.
+func recordUpstream(fn ProxyFunc) ProxyFunc {
+	if fn == nil {
+		return nil
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fn(req)
+		if err == nil {
+			middleware.SetUpstream(req, u)
+		}
+		return u, err
+	}
+}
+
 // nopResolver is a dns resolver that does not ever dial.
 // It uses only the local resolver.
 // It will look for the address in the /etc/hosts file.
@@ -503,7 +1394,7 @@ func (hp *HTTPProxy) isLocalhost(req *http.Request) bool {
 		return true
 	}
 
-	if addrs, err := localhostResolver.LookupHost(context.Background(), h); err == nil {
+	if addrs, err := hp.lookupHost(context.Background(), h); err == nil {
 		if ip := net.ParseIP(addrs[0]); ip != nil {
 			return ip.IsLoopback()
 		}
@@ -514,7 +1405,7 @@ func (hp *HTTPProxy) isLocalhost(req *http.Request) bool {
 
 func (hp *HTTPProxy) setBasicAuth(req *http.Request) error {
 	if req.Header.Get("Authorization") == "" {
-		if u := hp.creds.MatchURL(req.URL); u != nil {
+		if u := hp.runtime.Load().Credentials.MatchURLScope(req.URL, OriginCredentialsScope); u != nil {
 			p, _ := u.Password()
 			req.SetBasicAuth(u.Username(), p)
 		}
@@ -536,6 +1427,12 @@ func (hp *HTTPProxy) MITMCACert() *x509.Certificate {
 	return hp.mitmCACert
 }
 
+// MITMCACerts returns the CA certificates clients should trust,
+// the signing CA certificate followed by the secondary CA certificate if configured.
+func (hp *HTTPProxy) MITMCACerts() []*x509.Certificate {
+	return hp.mitmCACerts
+}
+
 func (hp *HTTPProxy) ProxyFunc() ProxyFunc {
 	return hp.proxyFunc
 }
@@ -544,47 +1441,83 @@ func (hp *HTTPProxy) handler() http.Handler {
 	return hp.proxy.Handler()
 }
 
+// Run starts the proxy and waits until it stops, the proxy is shut down when ctx is canceled.
 func (hp *HTTPProxy) Run(ctx context.Context) error {
-	var srv *http.Server
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		defer wg.Done()
+	if err := hp.Start(ctx); err != nil {
+		return err
+	}
+	return hp.Wait()
+}
 
-		<-ctx.Done()
-		if srv != nil {
-			if err := srv.Shutdown(context.Background()); err != nil {
-				hp.log.Errorf("failed to shutdown server error=%s", err)
-			}
-		} else {
-			hp.Close()
-		}
-	}()
+// Start starts serving in the background, it returns ErrServerStarted if the proxy was already started.
+// Canceling ctx shuts down the proxy as Shutdown without a deadline.
+func (hp *HTTPProxy) Start(ctx context.Context) error {
+	if hp.listener == nil {
+		return hp.lc.start(ctx, func(ctx context.Context) error {
+			hp.runBackground(ctx)
+			<-ctx.Done()
+			return nil
+		}, hp.closeAndLog)
+	}
 
-	var srvErr error
 	if hp.config.TestingHTTPHandler {
 		hp.log.Infof("using http handler")
-		srv = &http.Server{
+		srv := &http.Server{
 			Handler:           hp.handler(),
 			ReadTimeout:       hp.config.ReadTimeout,
 			ReadHeaderTimeout: hp.config.ReadHeaderTimeout,
 			WriteTimeout:      hp.config.WriteTimeout,
 		}
-		srvErr = srv.Serve(hp.listener)
-	} else {
-		srvErr = hp.proxy.Serve(hp.listener)
+		return hp.lc.start(ctx, func(ctx context.Context) error {
+			hp.runBackground(ctx)
+			if err := srv.Serve(hp.listener); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		}, func() {
+			if err := srv.Shutdown(context.Background()); err != nil {
+				hp.log.Errorf("failed to shutdown server error=%s", err)
+			}
+		})
 	}
-	if srvErr != nil {
-		if errors.Is(srvErr, net.ErrClosed) {
-			srvErr = nil
+
+	return hp.lc.start(ctx, func(ctx context.Context) error {
+		hp.runBackground(ctx)
+		if err := hp.proxy.Serve(hp.listener); !errors.Is(err, net.ErrClosed) {
+			return err
 		}
-		return srvErr
+		return nil
+	}, hp.closeAndLog)
+}
+
+func (hp *HTTPProxy) runBackground(ctx context.Context) {
+	if hp.shedder != nil {
+		go hp.runLoadShedding(ctx)
 	}
+}
 
-	wg.Wait()
-	return nil
+func (hp *HTTPProxy) closeAndLog() {
+	if err := hp.Close(); err != nil {
+		hp.log.Errorf("failed to close proxy error=%s", err)
+	}
+}
+
+// Shutdown gracefully stops the proxy started with Start, it stops accepting connections,
+// and waits until all connections are closed or ctx is done, in which case ctx error is returned.
+// It returns nil if the proxy stopped on its own, use Wait to get the serve error.
+func (hp *HTTPProxy) Shutdown(ctx context.Context) error {
+	return hp.lc.shutdown(ctx, nil)
+}
+
+// Wait blocks until the proxy started with Start stops,
+// it returns the error that stopped serving or nil if the proxy was shut down.
+func (hp *HTTPProxy) Wait() error {
+	return hp.lc.wait()
+}
+
+// State returns the lifecycle state of the proxy.
+func (hp *HTTPProxy) State() ServerState {
+	return hp.lc.current()
 }
 
 func (hp *HTTPProxy) listen() (net.Listener, error) {
@@ -593,12 +1526,21 @@ func (hp *HTTPProxy) listen() (net.Listener, error) {
 		return nil, fmt.Errorf("failed to open listener on address %s: %w", hp.config.Addr, err)
 	}
 
+	if hp.config.ProxyProtocol {
+		listener = proxyproto.NewListener(listener, hp.config.ReadHeaderTimeout)
+	}
+
+	listener = hp.filterClients(listener)
+
 	if rl, wl := int64(hp.config.ReadLimit), int64(hp.config.WriteLimit); rl > 0 || wl > 0 {
 		// Notice that the ReadLimit stands for the read limit *from* a proxy, and the WriteLimit
 		// stands for the write limit *to* a proxy, thus the ReadLimit is in fact
 		// a txBandwidth and the WriteLimit is a rxBandwidth.
 		listener = ratelimit.NewListener(listener, wl, rl)
 	}
+	if hp.config.Shared != nil {
+		listener = hp.config.Shared.listener(listener)
+	}
 
 	switch hp.config.Protocol {
 	case HTTPScheme:
@@ -611,13 +1553,81 @@ func (hp *HTTPProxy) listen() (net.Listener, error) {
 	}
 }
 
-// Addr returns the address the server is listening on.
+// ServeConn handles the proxy requests from the connection, it blocks until the connection is closed.
+// If the protocol is HTTPS the TLS handshake is performed on the connection.
+// Bandwidth limits apply only to connections accepted from the listener.
+func (hp *HTTPProxy) ServeConn(conn net.Conn) {
+	switch hp.config.Protocol {
+	case HTTPSScheme, HTTP2Scheme:
+		conn = tls.Server(conn, hp.TLSConfig)
+	}
+	hp.proxy.ServeConn(conn)
+}
+
+// DialContext returns the client side of an in-memory pipe served by the proxy, network and address are ignored.
+// It can be used as the dial function of a client transport to use the proxy in-process,
+// or to chain proxies without TCP listeners.
+func (hp *HTTPProxy) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	c, s := net.Pipe()
+	go hp.ServeConn(s)
+	return c, nil
+}
+
+// Addr returns the address the server is listening on, or empty string for in-memory proxies.
 func (hp *HTTPProxy) Addr() string {
+	if hp.listener == nil {
+		return ""
+	}
 	return hp.listener.Addr().String()
 }
 
+// Drain stops accepting new connections, and closes existing connections after the next response is sent.
+// New CONNECT requests are rejected with 503 Service Unavailable and Retry-After set to DrainRetryAfter.
+// Established CONNECT tunnels are not affected, use Close to close them.
+func (hp *HTTPProxy) Drain() {
+	hp.proxy.Drain()
+	if hp.listener != nil {
+		if err := hp.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			hp.log.Errorf("failed to close listener error=%s", err)
+		}
+	}
+}
+
+// Draining returns true if Drain was called.
+func (hp *HTTPProxy) Draining() bool {
+	return hp.proxy.Draining()
+}
+
+// drainRejectConnect rejects CONNECT requests while the proxy is draining or shutting down.
+// Other requests are served, and the connection is closed after the response.
+func (hp *HTTPProxy) drainRejectConnect() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method != http.MethodConnect || !(hp.proxy.Draining() || hp.proxy.Closing()) {
+			return nil
+		}
+
+		res := proxyutil.NewResponse(http.StatusServiceUnavailable, http.NoBody, req)
+		if d := hp.config.DrainRetryAfter; d > 0 {
+			res.Header.Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+		}
+		res.Header.Set("Proxy-Connection", "close")
+		hp.abort(req, res)
+
+		return errors.New("proxy is draining")
+	})
+}
+
 func (hp *HTTPProxy) Close() error {
-	err := hp.listener.Close()
+	var err error
+	if hp.listener != nil {
+		if err = hp.listener.Close(); errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+	}
 	hp.proxy.Close()
 	return err
 }
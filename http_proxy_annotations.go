@@ -0,0 +1,54 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// annotationsHeader sets the AnnotationsHeader response header to the request annotations.
+func (hp *HTTPProxy) annotationsHeader() martian.ResponseModifier {
+	h := http.CanonicalHeaderKey(hp.config.AnnotationsHeader)
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request == nil {
+			return nil
+		}
+		if a := middleware.Annotations(res.Request); len(a) > 0 {
+			res.Header.Set(h, annotationsString(a))
+		}
+		return nil
+	})
+}
+
+// annotationsString formats request annotations as k=v pairs separated by commas.
+func annotationsString(a []middleware.Annotation) string {
+	var sb strings.Builder
+	for i, v := range a {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(v.Key)
+		sb.WriteByte('=')
+		sb.WriteString(v.Value)
+	}
+	return sb.String()
+}
+
+func annotationsMap(a []middleware.Annotation) map[string]string {
+	if len(a) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(a))
+	for _, v := range a {
+		m[v.Key] = v.Value
+	}
+	return m
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestAnnotationsHeader(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.AnnotationsHeader = "X-Forwarder-Annotations"
+	cfg.RequestModifiers = []RequestModifier{
+		RequestModifierFunc(func(req *http.Request) error {
+			middleware.Annotate(req, "cache", "miss")
+			return nil
+		}),
+	}
+	cfg.ResponseModifiers = []ResponseModifier{
+		ResponseModifierFunc(func(res *http.Response) error {
+			middleware.Annotate(res.Request, "backend", "b1")
+			return nil
+		}),
+	}
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got, want := res.Header.Get("X-Forwarder-Annotations"), "cache=miss, backend=b1"; got != want {
+		t.Fatalf("expected header %q, got %q", want, got)
+	}
+}
+
+func TestHTTPProxyConfigValidateAnnotationsHeader(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.AnnotationsHeader = "invalid header"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error")
+	}
+}
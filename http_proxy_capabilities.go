@@ -0,0 +1,162 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CapabilitiesSchemaVersion is the version of the Capabilities JSON schema.
+// Fields may be added without changing the version, it is incremented when fields are removed or change meaning.
+const CapabilitiesSchemaVersion = 1
+
+// Capabilities describes the features enabled in the proxy.
+// It allows client tooling to adapt to the proxy configuration.
+type Capabilities struct {
+	SchemaVersion int `json:"schema_version"`
+
+	// Name is the name of the proxy instance.
+	Name string `json:"name"`
+
+	// Protocol is the protocol of the proxy listener, http or https.
+	Protocol string `json:"protocol"`
+
+	// Protocols are the proxied protocols: http, connect, and optionally connect-udp and ftp.
+	Protocols []string `json:"protocols"`
+
+	// AuthSchemes are the schemes accepted for proxy authentication, empty if authentication is disabled.
+	AuthSchemes []string `json:"auth_schemes"`
+
+	MITM   MITMCapabilities   `json:"mitm"`
+	Limits LimitsCapabilities `json:"limits"`
+
+	// Upstream is the upstream proxy mode: direct, proxy, pac or chain.
+	Upstream string `json:"upstream"`
+
+	// ProxyProtocol is true if the listener requires the PROXY protocol header.
+	ProxyProtocol bool `json:"proxy_protocol"`
+
+	// SendProxyProtocol is the version of the PROXY protocol header sent to origin servers, zero if disabled.
+	SendProxyProtocol int `json:"send_proxy_protocol"`
+}
+
+// MITMCapabilities describes the TLS interception settings.
+type MITMCapabilities struct {
+	Enabled bool `json:"enabled"`
+
+	// Domains is true if only the matching domains are intercepted.
+	Domains bool `json:"domains"`
+
+	// Decision is true if the remote MITM decision service is used.
+	Decision bool `json:"decision"`
+}
+
+// LimitsCapabilities describes the resource limits, zero values mean no limit.
+type LimitsCapabilities struct {
+	// MaxConcurrentRequests is the maximal number of requests proxied at the same time.
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// MaxInFlight is the maximal number of requests sent upstream at the same time, requests over the limit are queued.
+	MaxInFlight int `json:"max_in_flight"`
+
+	// MaxConnsPerClient is the maximal number of concurrent connections per client.
+	MaxConnsPerClient int `json:"max_conns_per_client"`
+
+	// ReadBandwidth and WriteBandwidth are the connection bandwidth limits in bytes per second.
+	ReadBandwidth  int64 `json:"read_bandwidth"`
+	WriteBandwidth int64 `json:"write_bandwidth"`
+
+	// LoadShedding is true if requests are rejected under system pressure.
+	LoadShedding bool `json:"load_shedding"`
+}
+
+// Capabilities returns the features enabled in the proxy.
+func (hp *HTTPProxy) Capabilities() *Capabilities {
+	c := &Capabilities{
+		SchemaVersion:     CapabilitiesSchemaVersion,
+		Name:              hp.config.Name,
+		Protocol:          string(hp.config.Protocol),
+		Protocols:         []string{"http", "connect"},
+		AuthSchemes:       []string{},
+		Upstream:          "direct",
+		ProxyProtocol:     hp.config.ProxyProtocol,
+		SendProxyProtocol: hp.config.SendProxyProtocol,
+	}
+
+	if hp.config.ConnectUDP != nil {
+		c.Protocols = append(c.Protocols, "connect-udp")
+	}
+	if hp.config.FTPGateway {
+		c.Protocols = append(c.Protocols, "ftp")
+	}
+
+	if hp.clientCert != nil {
+		c.AuthSchemes = append(c.AuthSchemes, "client-cert")
+	}
+	if hp.config.BasicAuth != nil || hp.htpasswd != nil {
+		c.AuthSchemes = append(c.AuthSchemes, hp.config.AuthScheme.String())
+	}
+	if hp.jwtAuth != nil {
+		c.AuthSchemes = append(c.AuthSchemes, "bearer")
+	}
+	for _, a := range hp.config.Authenticators {
+		if _, ok := a.(*IPAllowlistAuthenticator); ok {
+			c.AuthSchemes = append(c.AuthSchemes, "ip-allowlist")
+		} else {
+			c.AuthSchemes = append(c.AuthSchemes, "custom")
+		}
+	}
+
+	c.MITM = MITMCapabilities{
+		Enabled:  hp.config.MITM != nil,
+		Domains:  hp.runtime.Load().MITMDomains != nil,
+		Decision: hp.config.MITMDecision != nil,
+	}
+
+	c.Limits = LimitsCapabilities{
+		MaxInFlight:       hp.config.MaxInFlight,
+		MaxConnsPerClient: hp.config.MaxConnsPerClient,
+		ReadBandwidth:     int64(hp.config.ReadLimit),
+		WriteBandwidth:    int64(hp.config.WriteLimit),
+		LoadShedding:      hp.config.LoadShedding != nil,
+	}
+	if hp.config.Priority != nil {
+		c.Limits.MaxConcurrentRequests = hp.config.Priority.MaxConcurrent
+	}
+
+	switch {
+	case hp.config.Chain != nil:
+		c.Upstream = "chain"
+	case hp.pac != nil:
+		c.Upstream = "pac"
+	case hp.config.UpstreamProxyFunc != nil || hp.runtime.Load().UpstreamProxy != nil:
+		c.Upstream = "proxy"
+	}
+
+	return c
+}
+
+// CapabilitiesHandler returns a handler that serves Capabilities as JSON.
+func (hp *HTTPProxy) CapabilitiesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, hp.Capabilities())
+	})
+}
+
+func (hp *HTTPProxy) logCapabilities() {
+	c := hp.Capabilities()
+	auth := "none"
+	if len(c.AuthSchemes) > 0 {
+		auth = strings.Join(c.AuthSchemes, ",")
+	}
+	hp.log.Infof("PROXY server capabilities protocols=%s auth=%s mitm=%t upstream=%s",
+		strings.Join(c.Protocols, ","), auth, c.MITM.Enabled, c.Upstream)
+}
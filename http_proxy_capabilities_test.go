@@ -0,0 +1,68 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestCapabilitiesHandler(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.Addr = "localhost:0"
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.AuthScheme = DigestAuthScheme
+	cfg.UpstreamProxy = &url.URL{Scheme: "http", Host: "upstream:3128"}
+	cfg.ConnectUDP = DefaultConnectUDPConfig()
+	cfg.Priority = &PriorityConfig{MaxConcurrent: 10}
+	cfg.WriteLimit = Mebi
+
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	rec := httptest.NewRecorder()
+	p.CapabilitiesHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", http.NoBody))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var got Capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Capabilities{
+		SchemaVersion: CapabilitiesSchemaVersion,
+		Name:          "forwarder",
+		Protocol:      "http",
+		Protocols:     []string{"http", "connect", "connect-udp"},
+		AuthSchemes:   []string{"digest"},
+		Limits: LimitsCapabilities{
+			MaxConcurrentRequests: 10,
+			WriteBandwidth:        int64(Mebi),
+		},
+		Upstream: "proxy",
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("unexpected capabilities (-want +got):\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	p.CapabilitiesHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/capabilities", http.NoBody))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected status 405, got %d", rec.Code)
+	}
+}
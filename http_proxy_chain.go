@@ -0,0 +1,101 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// ChainMetadataHeader passes request metadata to the next forwarder instance in a chain.
+// The value is URL query encoded e.g. "job_id=1&tunnel_id=abc".
+const ChainMetadataHeader = "X-Forwarder-Chain-Metadata"
+
+// chainProxyURL is the upstream proxy URL of chained proxies, connections to it are handed off in-memory.
+var chainProxyURL = &url.URL{Scheme: "http", Host: "chain.forwarder.internal:80"}
+
+// chainTransport returns a copy of the transport that dials the next proxy in-memory.
+func chainTransport(rt http.RoundTripper, next *HTTPProxy) (http.RoundTripper, error) {
+	tr, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("chain requires *http.Transport, got %T", rt)
+	}
+
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	tr = tr.Clone()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == chainProxyURL.Host {
+			return next.DialContext(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+	return tr, nil
+}
+
+// chainMetadataToHeader passes request metadata to the next proxy in the chain.
+func (hp *HTTPProxy) chainMetadataToHeader() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		md := middleware.Metadata(req)
+		if len(md) == 0 {
+			return nil
+		}
+		if u, err := hp.proxyFunc(req); err != nil || u != chainProxyURL {
+			return nil
+		}
+
+		v := make(url.Values, len(md))
+		for _, m := range md {
+			v.Set(m.Key, m.Value)
+		}
+		req.Header.Set(ChainMetadataHeader, v.Encode())
+
+		return nil
+	})
+}
+
+// chainMetadataFromHeader attaches metadata passed by the previous proxy in the chain.
+// Metadata is accepted from in-memory connections, and from any client if TrustChainMetadata is set.
+// The header is always removed, so that it is not sent upstream.
+func (hp *HTTPProxy) chainMetadataFromHeader() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		h := req.Header.Get(ChainMetadataHeader)
+		if h == "" {
+			return nil
+		}
+		req.Header.Del(ChainMetadataHeader)
+
+		if !hp.config.TrustChainMetadata && !isPipeAddr(req.RemoteAddr) {
+			return nil
+		}
+
+		v, err := url.ParseQuery(h)
+		if err != nil {
+			hp.log.Errorf("invalid %s header: %s", ChainMetadataHeader, err)
+			return nil
+		}
+		for k := range v {
+			middleware.SetMetadata(req, k, v.Get(k))
+		}
+
+		return nil
+	})
+}
+
+// isPipeAddr returns true if the address is of an in-memory connection created with net.Pipe.
+func isPipeAddr(addr string) bool {
+	return addr == "pipe"
+}
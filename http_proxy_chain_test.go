@@ -0,0 +1,152 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestChainMetadataFromHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		trust      bool
+		want       string
+	}{
+		{"pipe", "pipe", false, "1"},
+		{"tcp", "127.0.0.1:1234", false, ""},
+		{"tcp trusted", "127.0.0.1:1234", true, "1"},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			hp := &HTTPProxy{log: log.NopLogger}
+			hp.config.TrustChainMetadata = tc.trust
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set(ChainMetadataHeader, "job_id=1")
+			martian.TestContext(req, nil, nil)
+
+			if err := hp.chainMetadataFromHeader().ModifyRequest(req); err != nil {
+				t.Fatal(err)
+			}
+			if req.Header.Get(ChainMetadataHeader) != "" {
+				t.Fatalf("expected %s header to be removed", ChainMetadataHeader)
+			}
+
+			var got string
+			for _, md := range middleware.Metadata(req) {
+				if md.Key == "job_id" {
+					got = md.Value
+				}
+			}
+			if got != tc.want {
+				t.Fatalf("expected job_id %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestChainMetadataToHeader(t *testing.T) {
+	hp := &HTTPProxy{
+		proxyFunc: func(*http.Request) (*url.URL, error) {
+			return chainProxyURL, nil
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	martian.TestContext(req, nil, nil)
+	middleware.SetMetadata(req, "tunnel_id", "a b")
+	middleware.SetMetadata(req, "job_id", "1")
+
+	if err := hp.chainMetadataToHeader().ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if h := req.Header.Get(ChainMetadataHeader); h != "job_id=1&tunnel_id=a+b" {
+		t.Fatalf("unexpected %s header %q", ChainMetadataHeader, h)
+	}
+
+	hp.proxyFunc = func(*http.Request) (*url.URL, error) {
+		return nil, nil
+	}
+	req.Header.Del(ChainMetadataHeader)
+	if err := hp.chainMetadataToHeader().ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if h := req.Header.Get(ChainMetadataHeader); h != "" {
+		t.Fatalf("expected no %s header for direct requests, got %q", ChainMetadataHeader, h)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var jobID string
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.RequestModifiers = []RequestModifier{
+		martian.RequestModifierFunc(func(req *http.Request) error {
+			for _, md := range middleware.Metadata(req) {
+				if md.Key == "job_id" {
+					jobID = md.Value
+				}
+			}
+			return nil
+		}),
+	}
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+		},
+	}
+	next, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+
+	cfg = DefaultHTTPProxyConfig()
+	cfg.MetadataHeaders = []MetadataHeader{{Header: "X-Job-Id", Key: "job_id"}}
+	cfg.Chain = next
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Job-Id", "42")
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if jobID != "42" {
+		t.Fatalf("expected job_id to be passed to the next proxy, got %q", jobID)
+	}
+}
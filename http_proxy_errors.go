@@ -9,34 +9,72 @@ package forwarder
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 
+	"github.com/saucelabs/forwarder/internal/martian"
 	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"github.com/saucelabs/forwarder/middleware"
 )
 
+// denyError is returned when a request is denied by the proxy policy.
+// The rule identifies the policy that denied the request.
 type denyError struct {
 	error
+	rule string
 }
 
-// ErrorHeader is the header that is set on error responses with the error message.
-const ErrorHeader = "X-Forwarder-Error"
+const (
+	// ErrorHeader is the header that is set on error responses with the error message.
+	ErrorHeader = "X-Forwarder-Error"
+
+	// DeniedByHeader is the header that is set on responses to denied requests with the id of the rule that denied the request.
+	// It allows clients to distinguish proxy policy failures from origin errors.
+	DeniedByHeader = "X-Forwarder-Denied-By"
+
+	// ErrorMetadataHeader is the header that is set on error responses with the request metadata, see middleware.SetMetadata.
+	ErrorMetadataHeader = "X-Forwarder-Metadata"
+)
 
 var (
-	ErrProxyLocalhost = denyError{errors.New("localhost proxying is disabled")}
-	ErrProxyDenied    = denyError{errors.New("proxying denied")}
+	ErrProxyLocalhost = denyError{errors.New("localhost proxying is disabled"), "proxy-localhost"}
+	ErrProxyDenied    = denyError{errors.New("proxying denied"), "deny-domains"}
+	ErrProxyBlocked   = denyError{errors.New("blocked by filter list"), "block-list"}
 )
 
+// deniedResponse is the JSON body of responses to denied requests,
+// it is sent if the client accepts application/json.
+type deniedResponse struct {
+	Error    string            `json:"error"`
+	DeniedBy string            `json:"denied_by"`
+	Host     string            `json:"host"`
+	Message  string            `json:"message"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
 func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response {
-	handlers := []errorHandler{
+	if hp.config.BlockedPlaceholders {
+		if resp := blockedPlaceholder(req, err); resp != nil {
+			return resp
+		}
+	}
+
+	handlers := make([]ErrorClassifier, 0, len(hp.config.ErrorClassifiers)+8)
+	handlers = append(handlers, hp.config.ErrorClassifiers...)
+	handlers = append(handlers,
+		handleRequestTimeout,
 		handleNetError,
 		handleTLSRecordHeader,
 		handleTLSCertificateError,
 		handleDenyError,
+		handleResponseValidationError,
+		handleQueueTimeout,
 		handleStatusText,
-	}
+	)
 
 	var (
 		code       int
@@ -48,6 +86,9 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 			break
 		}
 	}
+	if code != 0 && label == "" {
+		label = "custom"
+	}
 	if code == 0 {
 		code = http.StatusInternalServerError
 		msg = "An unexpected error occurred"
@@ -56,14 +97,62 @@ func (hp *HTTPProxy) errorResponse(req *http.Request, err error) *http.Response
 
 	hp.metrics.error(label)
 
-	resp := proxyutil.NewResponse(code, bytes.NewBufferString(msg+"\n"), req)
+	var denyErr denyError
+	denied := errors.As(err, &denyErr)
+	md := middleware.Metadata(req)
+
+	var resp *http.Response
+	if denied && acceptsJSON(req) {
+		resp = deniedJSONResponse(req, code, msg, err, denyErr.rule, md)
+	} else {
+		resp = proxyutil.NewResponse(code, bytes.NewBufferString(msg+"\n"), req)
+		resp.Header.Set(ErrorHeader, err.Error())
+		if denied {
+			resp.Header.Set(DeniedByHeader, denyErr.rule)
+		}
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.ContentLength = int64(len(msg) + 1)
+	}
+	if len(md) > 0 {
+		resp.Header.Set(ErrorMetadataHeader, metadataString(md))
+	}
+	return resp
+}
+
+func acceptsJSON(req *http.Request) bool {
+	for _, v := range req.Header.Values("Accept") {
+		for _, mt := range strings.Split(v, ",") {
+			mt, _, _ = strings.Cut(mt, ";")
+			if strings.TrimSpace(mt) == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func deniedJSONResponse(req *http.Request, code int, msg string, err error, rule string, md []middleware.MetadataItem) *http.Response {
+	b, _ := json.Marshal(deniedResponse{ //nolint:errchkjson // no error possible
+		Error:    "denied",
+		DeniedBy: rule,
+		Host:     req.Host,
+		Message:  msg,
+		Metadata: metadataMap(md),
+	})
+	b = append(b, '\n')
+
+	resp := proxyutil.NewResponse(code, bytes.NewReader(b), req)
 	resp.Header.Set(ErrorHeader, err.Error())
-	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
-	resp.ContentLength = int64(len(msg) + 1)
+	resp.Header.Set(DeniedByHeader, rule)
+	resp.Header.Set("Content-Type", "application/json")
+	resp.ContentLength = int64(len(b))
 	return resp
 }
 
-type errorHandler func(*http.Request, error) (int, string, string)
+// ErrorClassifier maps a proxying error to the status code and message of the error response, and the label of the error metric.
+// It returns zero code if it does not recognize the error, then the next classifier is tried.
+// The message is sent as the response body, if the label is empty "custom" is used.
+type ErrorClassifier func(req *http.Request, err error) (code int, msg, label string)
 
 func handleNetError(_ *http.Request, err error) (code int, msg, label string) {
 	var netErr *net.OpError
@@ -114,6 +203,27 @@ func handleDenyError(req *http.Request, err error) (code int, msg, label string)
 	return
 }
 
+func handleResponseValidationError(req *http.Request, err error) (code int, msg, label string) {
+	var verr responseValidationError
+	if errors.As(err, &verr) {
+		code = http.StatusBadGateway
+		msg = fmt.Sprintf("upstream response from host %q failed validation: %s", req.URL.Host, verr.reason)
+		label = "response_validation"
+	}
+
+	return
+}
+
+func handleQueueTimeout(_ *http.Request, err error) (code int, msg, label string) {
+	if errors.Is(err, martian.ErrQueueTimeout) {
+		code = http.StatusServiceUnavailable
+		msg = "Proxy is overloaded, try again later"
+		label = "queue_timeout"
+	}
+
+	return
+}
+
 // There is a difference between sending HTTP and HTTPS requests in the presence of an upstream proxy.
 // For HTTPS client issues a CONNECT request to the proxy and then sends the original request.
 // In case the proxy responds with status code 4XX or 5XX to the CONNECT request, the client interprets it as URL error.
@@ -129,8 +239,4 @@ func handleStatusText(req *http.Request, err error) (code int, msg, label string
 	return
 }
 
-func unauthorizedResponse(req *http.Request) *http.Response {
-	resp := proxyutil.NewResponse(http.StatusProxyAuthRequired, nil, req)
-	resp.Header.Set("Proxy-Authenticate", `Basic realm="Sauce Labs Forwarder"`)
-	return resp
-}
+const proxyAuthRealm = "Sauce Labs Forwarder"
@@ -0,0 +1,125 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestErrorResponseDenied(t *testing.T) {
+	p, err := NewHTTPProxy(DefaultHTTPProxyConfig(), nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	newRequest := func(accept string) *http.Request {
+		req := &http.Request{
+			Method: http.MethodGet,
+			URL:    &url.URL{Scheme: "http", Host: "denied.com"},
+			Host:   "denied.com",
+			Header: make(http.Header),
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		return req
+	}
+
+	t.Run("text", func(t *testing.T) {
+		res := p.errorResponse(newRequest(""), ErrProxyDenied)
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status %d, got %d", http.StatusForbidden, res.StatusCode)
+		}
+		if h := res.Header.Get(DeniedByHeader); h != "deny-domains" {
+			t.Fatalf("expected %s deny-domains, got %q", DeniedByHeader, h)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Fatalf("expected text/plain, got %s", ct)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		res := p.errorResponse(newRequest("text/html, application/json;q=0.9"), ErrProxyLocalhost)
+		if h := res.Header.Get(DeniedByHeader); h != "proxy-localhost" {
+			t.Fatalf("expected %s proxy-localhost, got %q", DeniedByHeader, h)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("expected application/json, got %s", ct)
+		}
+
+		var body deniedResponse
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.DeniedBy != "proxy-localhost" || body.Host != "denied.com" {
+			t.Fatalf("unexpected body %+v", body)
+		}
+	})
+
+	t.Run("not denied", func(t *testing.T) {
+		res := p.errorResponse(newRequest("application/json"), errors.New("boom"))
+		if h := res.Header.Get(DeniedByHeader); h != "" {
+			t.Fatalf("expected no %s, got %q", DeniedByHeader, h)
+		}
+	})
+}
+
+func TestErrorResponseClassifiers(t *testing.T) {
+	errTenant := errors.New("tenant quota exceeded")
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ErrorClassifiers = []ErrorClassifier{
+		func(_ *http.Request, err error) (int, string, string) {
+			if errors.Is(err, errTenant) {
+				return http.StatusTooManyRequests, "Tenant quota exceeded", ""
+			}
+			return 0, "", ""
+		},
+	}
+	p, err := NewHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	req := &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "http", Host: "example.com"},
+		Host:   "example.com",
+		Header: make(http.Header),
+	}
+
+	t.Run("custom", func(t *testing.T) {
+		res := p.errorResponse(req, fmt.Errorf("upstream: %w", errTenant))
+		if res.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, res.StatusCode)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "Tenant quota exceeded\n" {
+			t.Fatalf("unexpected body %q", b)
+		}
+	})
+
+	t.Run("built-in", func(t *testing.T) {
+		res := p.errorResponse(req, ErrProxyDenied)
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected status %d, got %d", http.StatusForbidden, res.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Explanation describes how the proxy would handle a request.
+type Explanation struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+
+	// Localhost is true if the host resolves to a loopback address.
+	Localhost bool `json:"localhost"`
+
+	// DeniedBy is the rule that denies the request, empty if the request is allowed.
+	DeniedBy string `json:"denied_by,omitempty"`
+
+	// MITM is true if the TLS connection would be intercepted.
+	MITM bool `json:"mitm"`
+
+	// DirectBy is the rule that makes the request bypass the upstream proxy.
+	DirectBy string `json:"direct_by,omitempty"`
+
+	// UpstreamProxy is the upstream proxy URL with the password redacted, empty if the request is sent directly.
+	UpstreamProxy string `json:"upstream_proxy,omitempty"`
+
+	// UpstreamProxyError is the error returned by the upstream proxy function.
+	UpstreamProxyError string `json:"upstream_proxy_error,omitempty"`
+
+	// CredentialsUser is the username of the credentials entry that would be used for the origin server.
+	CredentialsUser string `json:"credentials_user,omitempty"`
+
+	// Credentials describes which credentials entry is used for the origin server and which entries it shadows.
+	Credentials *CredentialsMatch `json:"credentials,omitempty"`
+}
+
+// Explain dry-runs the proxy policy for the request, client authentication is not evaluated.
+// Note that the upstream proxy function is called, for pools this advances the round-robin.
+func (hp *HTTPProxy) Explain(req *http.Request) *Explanation {
+	rc := hp.runtime.Load()
+	h := req.URL.Hostname()
+
+	e := &Explanation{
+		Method:    req.Method,
+		URL:       req.URL.Redacted(),
+		Localhost: hp.isLocalhost(req),
+	}
+
+	switch {
+	case e.Localhost && hp.config.ProxyLocalhost == DenyProxyLocalhost:
+		e.DeniedBy = ErrProxyLocalhost.rule
+	case rc.DenyDomains != nil && rc.DenyDomains.Match(h):
+		e.DeniedBy = ErrProxyDenied.rule
+	case hp.config.BlockList != nil && hp.config.BlockList.Match(h, blockListURL(req)):
+		e.DeniedBy = ErrProxyBlocked.rule
+	}
+	if e.DeniedBy != "" {
+		return e
+	}
+
+	if hp.config.MITM != nil && (req.Method == http.MethodConnect || req.URL.Scheme == "https") {
+		e.MITM = hp.proxy.MITMFilter == nil || hp.proxy.MITMFilter(req)
+	}
+
+	switch {
+	case e.Localhost && hp.config.ProxyLocalhost == DirectProxyLocalhost:
+		e.DirectBy = "proxy-localhost"
+	case rc.DirectDomains != nil && rc.DirectDomains.Match(h):
+		e.DirectBy = "direct-domains"
+	}
+
+	if hp.proxyFunc != nil {
+		u, err := hp.proxyFunc(req)
+		if err != nil {
+			e.UpstreamProxyError = err.Error()
+		} else if u != nil {
+			e.UpstreamProxy = u.Redacted()
+		}
+	}
+
+	if u := rc.Credentials.MatchURLScope(req.URL, OriginCredentialsScope); u != nil {
+		e.CredentialsUser = u.Username()
+		e.Credentials = rc.Credentials.Trace(req.URL, OriginCredentialsScope)
+	}
+
+	return e
+}
+
+// ExplainHandler returns a handler that serves Explain results as JSON.
+// The request is specified with the url and method query parameters, the method defaults to GET.
+// For CONNECT requests the url is host:port.
+func (hp *HTTPProxy) ExplainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := strings.ToUpper(r.URL.Query().Get("method"))
+		if method == "" {
+			method = http.MethodGet
+		}
+
+		req, err := explainRequest(method, r.URL.Query().Get("url"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(hp.Explain(req)) //nolint:errcheck // best effort
+	})
+}
+
+func explainRequest(method, rawURL string) (*http.Request, error) {
+	if rawURL == "" {
+		return nil, fmt.Errorf("url query parameter is required")
+	}
+
+	var (
+		u   *url.URL
+		err error
+	)
+	if method == http.MethodConnect {
+		u = &url.URL{Scheme: "https", Host: rawURL}
+	} else {
+		u, err = url.Parse(rawURL)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q, expected absolute URL", rawURL)
+	}
+
+	return &http.Request{
+		Method: method,
+		URL:    u,
+		Host:   u.Host,
+		Header: make(http.Header),
+	}, nil
+}
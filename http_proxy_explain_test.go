@@ -0,0 +1,100 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestExplainHandler(t *testing.T) {
+	deny, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^denied\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^direct\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := NewCredentialsMatcher([]*HostPortUser{
+		{Host: "auth.com", Port: "443", Userinfo: url.UserPassword("user", "pass")},
+	}, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.UpstreamProxy = &url.URL{Scheme: "http", Host: "upstream:3128"}
+	cfg.DenyDomains = deny
+	cfg.DirectDomains = direct
+
+	p, err := NewHTTPProxy(cfg, nil, cm, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		query    string
+		expected Explanation
+	}{
+		{
+			query:    "url=http://denied.com/",
+			expected: Explanation{Method: "GET", URL: "http://denied.com/", DeniedBy: "deny-domains"},
+		},
+		{
+			query:    "url=http://direct.com/",
+			expected: Explanation{Method: "GET", URL: "http://direct.com/", DirectBy: "direct-domains"},
+		},
+		{
+			query: "url=auth.com:443&method=connect",
+			expected: Explanation{
+				Method:          "CONNECT",
+				URL:             "https://auth.com:443",
+				UpstreamProxy:   "http://upstream:3128",
+				CredentialsUser: "user",
+				Credentials:     &CredentialsMatch{Entry: "user:xxxxx@auth.com:443"},
+			},
+		},
+	}
+
+	h := p.ExplainHandler()
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.query, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explain?"+tc.query, http.NoBody))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+			}
+
+			var e Explanation
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.expected, e); diff != "" {
+				t.Fatalf("unexpected explanation (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("missing url", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explain", http.NoBody))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/saucelabs/forwarder/hsts"
+)
+
+// hstsEnforcer records Strict-Transport-Security policies of hosts from responses received over TLS,
+// and upgrades plain HTTP requests to these hosts to HTTPS.
+type hstsEnforcer struct {
+	hp    *HTTPProxy
+	cache *hsts.Cache
+}
+
+func (e hstsEnforcer) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || req.URL.Scheme != "http" {
+		return nil
+	}
+	if !e.cache.Match(req.URL.Host) {
+		return nil
+	}
+
+	req.URL.Scheme = "https"
+	if host, port, err := net.SplitHostPort(req.URL.Host); err == nil && port == "80" {
+		req.URL.Host = host
+	}
+	e.hp.metrics.hstsUpgrade()
+	e.hp.log.Debugf("HSTS upgrade of request to %s", req.URL.Redacted())
+
+	return nil
+}
+
+func (e hstsEnforcer) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil || req.URL.Scheme != "https" {
+		return nil
+	}
+	if v := res.Header.Get("Strict-Transport-Security"); v != "" {
+		e.cache.Observe(req.URL.Host, v)
+	}
+	return nil
+}
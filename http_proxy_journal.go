@@ -0,0 +1,66 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/journal"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+const journalStartKey = "journal-start"
+
+// journalRecorder records request summaries in the journal.
+type journalRecorder struct {
+	j *journal.Journal
+}
+
+func (r journalRecorder) ModifyRequest(req *http.Request) error {
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Set(journalStartKey, time.Now())
+	}
+	return nil
+}
+
+func (r journalRecorder) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil {
+		return nil
+	}
+
+	now := time.Now()
+	start := now
+	if ctx := martian.NewContext(req); ctx != nil {
+		if v, ok := ctx.Get(journalStartKey); ok {
+			start = v.(time.Time) //nolint:forcetypeassert // we know the type
+		}
+	}
+
+	// Drop the query and user info, they may contain secrets.
+	u := *req.URL
+	u.User = nil
+	u.RawQuery = ""
+	u.ForceQuery = false
+
+	r.j.Record(journal.Entry{
+		Time:     start,
+		Duration: now.Sub(start),
+		Client:   req.RemoteAddr,
+		User:     middleware.User(req),
+		Method:   req.Method,
+		Host:     req.URL.Hostname(),
+		URL:      u.String(),
+		Status:   res.StatusCode,
+
+		Annotations: annotationsMap(middleware.Annotations(req)),
+	})
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// MetadataHeader maps a request header to a metadata key.
+// Request modifiers can attach metadata directly with middleware.SetMetadata.
+type MetadataHeader struct {
+	Header string
+	Key    string
+}
+
+// ParseMetadataHeader parses a <header>[:<key>] string into MetadataHeader.
+// If the key is not specified, it is the lower case header name without the X- prefix and with dashes replaced by underscores,
+// e.g. X-Tunnel-Id becomes tunnel_id.
+func ParseMetadataHeader(val string) (MetadataHeader, error) {
+	h, k, _ := strings.Cut(val, ":")
+	h = strings.TrimSpace(h)
+	k = strings.TrimSpace(k)
+	if h == "" {
+		return MetadataHeader{}, errors.New("expected <header>[:<key>]")
+	}
+	if k == "" {
+		k = strings.ToLower(h)
+		k = strings.TrimPrefix(k, "x-")
+		k = strings.ReplaceAll(k, "-", "_")
+	}
+	return MetadataHeader{Header: http.CanonicalHeaderKey(h), Key: k}, nil
+}
+
+// metadataFromHeaders attaches the values of metadata headers to the request.
+// The headers are removed, so that they are not sent upstream.
+func (hp *HTTPProxy) metadataFromHeaders() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		for _, mh := range hp.config.MetadataHeaders {
+			if v := req.Header.Get(mh.Header); v != "" {
+				middleware.SetMetadata(req, mh.Key, v)
+				req.Header.Del(mh.Header)
+			}
+		}
+		return nil
+	})
+}
+
+// metadataMetrics counts responses by metadata key and value.
+func (hp *HTTPProxy) metadataMetrics() martian.ResponseModifier {
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request == nil {
+			return nil
+		}
+		for _, md := range middleware.Metadata(res.Request) {
+			hp.metrics.metadata(md.Key, md.Value)
+		}
+		return nil
+	})
+}
+
+// metadataString formats request metadata as k=v pairs separated by commas.
+func metadataString(md []middleware.MetadataItem) string {
+	var sb strings.Builder
+	for i, v := range md {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(v.Key)
+		sb.WriteByte('=')
+		sb.WriteString(v.Value)
+	}
+	return sb.String()
+}
+
+func metadataMap(md []middleware.MetadataItem) map[string]string {
+	if len(md) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(md))
+	for _, v := range md {
+		m[v.Key] = v.Value
+	}
+	return m
+}
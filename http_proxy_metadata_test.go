@@ -0,0 +1,71 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseMetadataHeader(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected MetadataHeader
+		err      bool
+	}{
+		{
+			input:    "X-Tunnel-Id",
+			expected: MetadataHeader{Header: "X-Tunnel-Id", Key: "tunnel_id"},
+		},
+		{
+			input:    "x-sl-job:job",
+			expected: MetadataHeader{Header: "X-Sl-Job", Key: "job"},
+		},
+		{
+			input: ":job",
+			err:   true,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			mh, err := ParseMetadataHeader(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", mh)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mh != tc.expected {
+				t.Fatalf("expected %+v, got %+v", tc.expected, mh)
+			}
+		})
+	}
+}
+
+func TestMetadataMetricsBounded(t *testing.T) {
+	m := newMetrics(prometheus.NewRegistry(), "test", 2)
+
+	for _, v := range []string{"a", "b", "c", "a", "d"} {
+		m.metadata("tunnel_id", v)
+	}
+
+	for v, n := range map[string]float64{"a": 2, "b": 1, metadataOther: 2} {
+		if got := testutil.ToFloat64(m.metadataRequests.WithLabelValues("tunnel_id", v)); got != n {
+			t.Fatalf("expected %v requests for %s, got %v", n, v, got)
+		}
+	}
+	if n := testutil.CollectAndCount(m.metadataRequests); n != 3 {
+		t.Fatalf("expected 3 series, got %d", n)
+	}
+}
@@ -7,15 +7,47 @@
 package forwarder
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type httpProxyMetrics struct {
-	errors *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	downgrades  *prometheus.CounterVec
+	integrity   *prometheus.CounterVec
+	hedges      *prometheus.CounterVec
+	staleConns  *prometheus.CounterVec
+	dialRetries *prometheus.CounterVec
+	hsts        prometheus.Counter
+	validation  *prometheus.CounterVec
+	mitm        *prometheus.CounterVec
+	decisions   *prometheus.CounterVec
+	probes      *prometheus.CounterVec
+	streams     *prometheus.HistogramVec
+	slow        prometheus.Counter
+	shedLevel   prometheus.Gauge
+	shedUtil    *prometheus.GaugeVec
+	shed        *prometheus.CounterVec
+	bypasses    *prometheus.CounterVec
+	users       *prometheus.CounterVec
+	rejected    *prometheus.CounterVec
+	lookups     *prometheus.CounterVec
+	ruleHits    *prometheus.CounterVec
+	ruleEval    *prometheus.HistogramVec
+
+	metadataRequests  *prometheus.CounterVec
+	metadataMaxValues int
+	metadataMu        sync.Mutex
+	metadataValues    map[string]map[string]struct{}
 }
 
-func newMetrics(r prometheus.Registerer, namespace string) *httpProxyMetrics {
+// metadataOther is the label value of metadata values above the limit of distinct values per key.
+const metadataOther = "other"
+
+func newMetrics(r prometheus.Registerer, namespace string, metadataMaxValues int) *httpProxyMetrics {
 	if r == nil {
 		r = prometheus.NewRegistry() // This registry will be discarded.
 	}
@@ -27,9 +59,227 @@ func newMetrics(r prometheus.Registerer, namespace string) *httpProxyMetrics {
 			Namespace: namespace,
 			Help:      "Number of proxy errors",
 		}, []string{"reason"}),
+		downgrades: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_protocol_downgrades_total",
+			Namespace: namespace,
+			Help:      "Number of connections that used an older protocol than the client supports",
+		}, []string{"leg", "kind", "from", "to"}),
+		integrity: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_integrity_errors_total",
+			Namespace: namespace,
+			Help:      "Number of request and response bodies that failed Content-Length or Content-Digest verification",
+		}, []string{"direction"}),
+		hedges: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_hedged_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests that exceeded the hedging threshold by outcome, throttled requests were not hedged due to the budget",
+		}, []string{"outcome"}),
+		staleConns: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_stale_conn_retries_total",
+			Namespace: namespace,
+			Help:      "Number of requests retried after failing on a reused upstream connection by outcome of the retry",
+		}, []string{"outcome"}),
+		dialRetries: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_dial_retries_total",
+			Namespace: namespace,
+			Help:      "Number of dials retried with alternate resolved addresses after the first address failed by outcome",
+		}, []string{"outcome"}),
+		hsts: f.NewCounter(prometheus.CounterOpts{
+			Name:      "proxy_hsts_upgrades_total",
+			Namespace: namespace,
+			Help:      "Number of plain HTTP requests upgraded to HTTPS due to HSTS policy of the host",
+		}),
+		validation: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_response_validation_failures_total",
+			Namespace: namespace,
+			Help:      "Number of upstream responses that failed validation by the failed check",
+		}, []string{"check"}),
+		mitm: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_mitm_handshakes_total",
+			Namespace: namespace,
+			Help:      "Number of MITM handshakes with clients by signing CA fingerprint and result, untrusted handshakes were rejected by the client",
+		}, []string{"ca", "result"}),
+		decisions: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_mitm_decisions_total",
+			Namespace: namespace,
+			Help:      "Number of CONNECT requests by action of the MITM decision service and source of the decision: cache, service or error",
+		}, []string{"action", "source"}),
+		probes: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_mitm_probes_total",
+			Namespace: namespace,
+			Help:      "Number of certificate probes of origin servers by result: mitm, skip or error, cached results are not counted",
+		}, []string{"result"}),
+		streams: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:      "proxy_response_stream_duration_seconds",
+			Namespace: namespace,
+			Help:      "Time spent streaming response bodies by leg: reading from upstream or writing to the client",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"leg"}),
+		slow: f.NewCounter(prometheus.CounterOpts{
+			Name:      "proxy_slow_client_aborts_total",
+			Namespace: namespace,
+			Help:      "Number of responses aborted because the client read slower than the minimal rate",
+		}),
+		shedLevel: f.NewGauge(prometheus.GaugeOpts{
+			Name:      "proxy_load_shedding_level",
+			Namespace: namespace,
+			Help:      "Current load shedding level: 0 none, 1 no body logging, 2 reject CONNECT requests, 3 reject all requests",
+		}),
+		shedUtil: f.NewGaugeVec(prometheus.GaugeOpts{
+			Name:      "proxy_load_shedding_utilization_ratio",
+			Namespace: namespace,
+			Help:      "Last sampled utilization of the resource used for load shedding, negative if the resource is not measured",
+		}, []string{"resource"}),
+		shed: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_load_shed_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests rejected by load shedding by action",
+		}, []string{"action"}),
+		bypasses: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_bypass_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests with the bypass header by result: granted or rejected",
+		}, []string{"result"}),
+		users: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_user_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests authenticated with the htpasswd file by user",
+		}, []string{"user"}),
+		rejected: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_rejected_connections_total",
+			Namespace: namespace,
+			Help:      "Number of client connections rejected by the client allow and deny lists by reason",
+		}, []string{"reason"}),
+		lookups: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_ruleset_lookups_total",
+			Namespace: namespace,
+			Help:      "Number of rule set lookups by rule set and result: hit or miss",
+		}, []string{"set", "result"}),
+		ruleHits: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_ruleset_rule_hits_total",
+			Namespace: namespace,
+			Help:      "Number of rule set lookups decided by the rule, rules without hits are not used",
+		}, []string{"set", "rule"}),
+		ruleEval: f.NewHistogramVec(prometheus.HistogramOpts{
+			Name:      "proxy_ruleset_evaluation_duration_seconds",
+			Namespace: namespace,
+			Help:      "Time spent evaluating the rules of a rule set per lookup",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 8),
+		}, []string{"set"}),
+		metadataRequests: f.NewCounterVec(prometheus.CounterOpts{
+			Name:      "proxy_metadata_requests_total",
+			Namespace: namespace,
+			Help:      "Number of requests by metadata key and value",
+		}, []string{"key", "value"}),
+		metadataMaxValues: metadataMaxValues,
+		metadataValues:    make(map[string]map[string]struct{}),
 	}
 }
 
 func (m *httpProxyMetrics) error(reason string) {
 	m.errors.WithLabelValues(reason).Inc()
 }
+
+func (m *httpProxyMetrics) downgrade(leg, kind, from, to string) {
+	m.downgrades.WithLabelValues(leg, kind, from, to).Inc()
+}
+
+func (m *httpProxyMetrics) integrityError(direction string) {
+	m.integrity.WithLabelValues(direction).Inc()
+}
+
+func (m *httpProxyMetrics) hedge(outcome string) {
+	m.hedges.WithLabelValues(outcome).Inc()
+}
+
+func (m *httpProxyMetrics) staleConnRetry(outcome string) {
+	m.staleConns.WithLabelValues(outcome).Inc()
+}
+
+func (m *httpProxyMetrics) dialRetry(outcome string) {
+	m.dialRetries.WithLabelValues(outcome).Inc()
+}
+
+func (m *httpProxyMetrics) hstsUpgrade() {
+	m.hsts.Inc()
+}
+
+func (m *httpProxyMetrics) responseValidation(check string) {
+	m.validation.WithLabelValues(check).Inc()
+}
+
+func (m *httpProxyMetrics) mitmHandshake(ca, result string) {
+	m.mitm.WithLabelValues(ca, result).Inc()
+}
+
+func (m *httpProxyMetrics) mitmDecision(action, source string) {
+	m.decisions.WithLabelValues(action, source).Inc()
+}
+
+func (m *httpProxyMetrics) mitmProbe(result string) {
+	m.probes.WithLabelValues(result).Inc()
+}
+
+func (m *httpProxyMetrics) responseStream(leg string, d time.Duration) {
+	m.streams.WithLabelValues(leg).Observe(d.Seconds())
+}
+
+func (m *httpProxyMetrics) slowClientAbort() {
+	m.slow.Inc()
+}
+
+func (m *httpProxyMetrics) loadSample(ls loadSample, level loadSheddingLevel) {
+	m.shedLevel.Set(float64(level))
+	m.shedUtil.WithLabelValues("cpu").Set(ls.CPU)
+	m.shedUtil.WithLabelValues("memory").Set(ls.Memory)
+	m.shedUtil.WithLabelValues("files").Set(ls.Files)
+}
+
+func (m *httpProxyMetrics) loadShed(action string) {
+	m.shed.WithLabelValues(action).Inc()
+}
+
+func (m *httpProxyMetrics) bypass(result string) {
+	m.bypasses.WithLabelValues(result).Inc()
+}
+
+func (m *httpProxyMetrics) userRequest(user string) {
+	m.users.WithLabelValues(user).Inc()
+}
+
+func (m *httpProxyMetrics) rejectedConn(reason string) {
+	m.rejected.WithLabelValues(reason).Inc()
+}
+
+// ObserveMatch implements ruleset.Observer.
+// The rule label is bounded by the configured rules, see observeRuleset.
+func (m *httpProxyMetrics) ObserveMatch(set, rule string, d time.Duration) {
+	m.ruleEval.WithLabelValues(set).Observe(d.Seconds())
+	if rule == "" {
+		m.lookups.WithLabelValues(set, "miss").Inc()
+		return
+	}
+	m.lookups.WithLabelValues(set, "hit").Inc()
+	m.ruleHits.WithLabelValues(set, rule).Inc()
+}
+
+// metadata counts a request with the metadata value.
+// The number of distinct values per key is bounded, values above the limit are counted as other.
+func (m *httpProxyMetrics) metadata(key, value string) {
+	m.metadataMu.Lock()
+	vals, ok := m.metadataValues[key]
+	if !ok {
+		vals = make(map[string]struct{})
+		m.metadataValues[key] = vals
+	}
+	if _, ok := vals[value]; !ok {
+		if len(vals) >= m.metadataMaxValues {
+			value = metadataOther
+		} else {
+			vals[value] = struct{}{}
+		}
+	}
+	m.metadataMu.Unlock()
+
+	m.metadataRequests.WithLabelValues(key, value).Inc()
+}
@@ -0,0 +1,51 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// Rule set names used in metrics, they match the corresponding command line flags.
+const (
+	integrityDomainsRuleset = "integrity-domains"
+	privacyDomainsRuleset   = "privacy-domains"
+	blockListRuleset        = "block-list"
+)
+
+// observeRegexpMatcher returns the matcher reporting lookups to the metrics, if metrics are collected.
+// User policy rule sets are not observed, as the number of users is not bounded.
+func (hp *HTTPProxy) observeRegexpMatcher(name string, m *ruleset.RegexpMatcher) *ruleset.RegexpMatcher {
+	if m == nil || hp.config.PromRegistry == nil {
+		return m
+	}
+	return m.WithObserver(name, hp.metrics)
+}
+
+func (hp *HTTPProxy) observeRuntimeConfig(rc *RuntimeConfig) {
+	rc.DenyDomains = hp.observeRegexpMatcher(RuntimeConfigDenyDomains, rc.DenyDomains)
+	rc.DirectDomains = hp.observeRegexpMatcher(RuntimeConfigDirectDomains, rc.DirectDomains)
+	rc.MITMDomains = hp.observeRegexpMatcher(RuntimeConfigMITMDomains, rc.MITMDomains)
+	rc.MITMExcludeDomains = hp.observeRegexpMatcher(RuntimeConfigMITMExcludeDomains, rc.MITMExcludeDomains)
+}
+
+// observeRulesets reports lookups in the static rule sets to the metrics.
+func (hp *HTTPProxy) observeRulesets() {
+	if hp.config.PromRegistry == nil {
+		return
+	}
+
+	hp.config.IntegrityDomains = hp.observeRegexpMatcher(integrityDomainsRuleset, hp.config.IntegrityDomains)
+	if hp.config.Privacy != nil && hp.config.Privacy.Domains != nil {
+		pc := *hp.config.Privacy
+		pc.Domains = hp.observeRegexpMatcher(privacyDomainsRuleset, pc.Domains)
+		hp.config.Privacy = &pc
+	}
+	if hp.config.BlockList != nil {
+		hp.config.BlockList = hp.config.BlockList.WithObserver(blockListRuleset, hp.metrics)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+	"github.com/saucelabs/forwarder/stats"
+)
+
+// statsRecorder records active sessions, requests and transferred bytes in stats.
+// Clients are identified by the authenticated user, or by the IP address.
+// Responses with 5xx status codes are counted as errors.
+type statsRecorder struct {
+	s *stats.Stats
+}
+
+func statsClient(req *http.Request) string {
+	if u := middleware.User(req); u != "" {
+		return u
+	}
+	if h, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return h
+	}
+	return req.RemoteAddr
+}
+
+func (r statsRecorder) ModifyRequest(req *http.Request) error {
+	if ctx := martian.NewContext(req); ctx != nil {
+		r.s.Begin(stats.Session{
+			ID:     ctx.ID(),
+			Method: req.Method,
+			Host:   req.URL.Hostname(),
+			Client: statsClient(req),
+			Start:  time.Now(),
+			TLS:    sessionClientHello(req),
+		})
+	}
+	return nil
+}
+
+func (r statsRecorder) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil {
+		return nil
+	}
+	if ctx := martian.NewContext(req); ctx != nil {
+		r.s.End(ctx.ID())
+	}
+
+	host := req.URL.Hostname()
+	client := statsClient(req)
+
+	r.s.Request(host, client, res.StatusCode >= http.StatusInternalServerError)
+	if req.ContentLength > 0 {
+		r.s.Bytes(host, client, req.ContentLength)
+	}
+	// Upgraded connections need the body to be io.ReadWriteCloser, they are not counted.
+	if _, upgrade := res.Body.(io.ReadWriteCloser); res.Body != nil && res.Body != http.NoBody && !upgrade {
+		res.Body = &countingBody{
+			ReadCloser: res.Body,
+			done: func(n int64) {
+				r.s.Bytes(host, client, n)
+			},
+		}
+	}
+
+	return nil
+}
+
+// countingBody calls done with the number of bytes read when the body is closed.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	if b.done != nil {
+		b.done(b.n)
+		b.done = nil
+	}
+	return b.ReadCloser.Close()
+}
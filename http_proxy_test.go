@@ -7,15 +7,20 @@
 package forwarder
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/saucelabs/forwarder/ftp/ftptest"
 	"github.com/saucelabs/forwarder/log/stdlog"
 	"golang.org/x/net/http2"
 )
@@ -110,3 +115,181 @@ func TestNopDialer(t *testing.T) {
 		t.Fatalf("expected %v, got %v", nopDialerErr, err)
 	}
 }
+
+func TestInMemoryHTTPProxy(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Upstream-Host": {req.URL.Host}},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if p.Addr() != "" {
+		t.Fatalf("expected no address, got %q", p.Addr())
+	}
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	for i := 0; i < 2; i++ {
+		res, err := c.Get("http://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if h := res.Header.Get("X-Upstream-Host"); h != "example.com" {
+			t.Fatalf("unexpected upstream host %q", h)
+		}
+	}
+}
+
+func TestFTPGateway(t *testing.T) {
+	s := ftptest.NewServer("user", "pass", map[string]string{
+		"/pub/readme.txt": "hello world\n",
+	})
+	defer s.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.FTPGateway = true
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The URL user info is not sent to the proxy, clients send credentials in the Authorization header.
+	get := func(t *testing.T, u, pass string) (*http.Response, string) {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, u, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", pass)
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	base := "ftp://" + s.Addr
+
+	if res, body := get(t, base+"/pub/readme.txt", "pass"); res.StatusCode != http.StatusOK || body != "hello world\n" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, body)
+	}
+	if res, body := get(t, base+"/pub/", "pass"); res.StatusCode != http.StatusOK || !strings.Contains(body, `href="readme.txt"`) {
+		t.Fatalf("unexpected listing %d %q", res.StatusCode, body)
+	}
+	if res, _ := get(t, base+"/pub", "pass"); res.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("expected status 301, got %d", res.StatusCode)
+	}
+	if res, _ := get(t, base+"/pub/readme.txt", "wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d", res.StatusCode)
+	}
+}
+
+func TestDrainRejectConnect(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.DrainRetryAfter = 1500 * time.Millisecond
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.Drain()
+
+	do := func(t *testing.T, req *http.Request) *http.Response {
+		t.Helper()
+
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		go req.WriteProxy(conn) //nolint:errcheck // the response is checked
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("connect", func(t *testing.T) {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Host: "example.com:443"},
+			Host:   "example.com:443",
+			Header: make(http.Header),
+		}
+		res := do(t, req)
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, res.StatusCode)
+		}
+		if h := res.Header.Get("Retry-After"); h != "2" {
+			t.Fatalf("expected Retry-After 2, got %q", h)
+		}
+		if !res.Close {
+			t.Fatal("expected connection to be closed")
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := do(t, req)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if !res.Close || res.Header.Get("Proxy-Connection") != "close" {
+			t.Fatalf("expected connection to be closed, got headers %v", res.Header)
+		}
+	})
+}
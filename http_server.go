@@ -14,13 +14,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/saucelabs/forwarder/httplog"
 	"github.com/saucelabs/forwarder/log"
 	"github.com/saucelabs/forwarder/middleware"
+	"github.com/saucelabs/forwarder/proxyproto"
 	"go.uber.org/multierr"
 )
 
@@ -81,10 +81,27 @@ type HTTPServerConfig struct {
 	ReadHeaderTimeout time.Duration
 	WriteTimeout      time.Duration
 	LogHTTPMode       httplog.Mode
+	LogHTTPBodyLimit  SizeSuffix
+
+	// ProxyProtocol requires connections to start with the PROXY protocol v1 or v2 header,
+	// the client address from the header is used as the remote address of the connection.
+	// It is used when the server is behind an L4 load balancer.
+	ProxyProtocol bool
 
 	PromNamespace string
 	PromRegistry  prometheus.Registerer
 	BasicAuth     *url.Userinfo
+
+	// PromInstance is added as the forwarder_instance label to all metrics,
+	// it allows multiple servers or proxies in one process to share the PromRegistry.
+	PromInstance string
+
+	// HtpasswdFile is a path to an htpasswd file with basic auth users, it is an alternative to BasicAuth.
+	// Passwords must be hashed with bcrypt or SHA1, the file is reloaded when it changes.
+	HtpasswdFile string
+
+	// ClientAuth enables verification of client certificates, it requires the https or h2 protocol.
+	ClientAuth TLSClientAuthConfig
 }
 
 func DefaultHTTPServerConfig() *HTTPServerConfig {
@@ -93,6 +110,7 @@ func DefaultHTTPServerConfig() *HTTPServerConfig {
 		Addr:              ":8080",
 		ReadHeaderTimeout: 1 * time.Minute,
 		LogHTTPMode:       httplog.Errors,
+		LogHTTPBodyLimit:  Mebi,
 	}
 }
 
@@ -100,6 +118,12 @@ func (c *HTTPServerConfig) Validate() error {
 	if err := validatedUserInfo(c.BasicAuth); err != nil {
 		return fmt.Errorf("basic_auth: %w", err)
 	}
+	if c.BasicAuth != nil && c.HtpasswdFile != "" {
+		return fmt.Errorf("basic_auth and htpasswd_file are mutually exclusive")
+	}
+	if c.ClientAuth.enabled() && c.Protocol == HTTPScheme {
+		return fmt.Errorf("client_auth requires %s or %s protocol", HTTPSScheme, HTTP2Scheme)
+	}
 	return nil
 }
 
@@ -108,6 +132,7 @@ type HTTPServer struct {
 	log      log.Logger
 	srv      *http.Server
 	listener net.Listener
+	lc       lifecycle
 }
 
 // NewHTTPServer creates a new HTTP server.
@@ -117,12 +142,17 @@ func NewHTTPServer(cfg *HTTPServerConfig, h http.Handler, log log.Logger) (*HTTP
 		return nil, err
 	}
 
+	h, err := withMiddleware(cfg, log, h)
+	if err != nil {
+		return nil, err
+	}
+
 	hs := &HTTPServer{
 		config: *cfg,
 		log:    log,
 		srv: &http.Server{
 			Addr:              cfg.Addr,
-			Handler:           withMiddleware(cfg, log, h),
+			Handler:           h,
 			ReadTimeout:       cfg.ReadTimeout,
 			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
 			WriteTimeout:      cfg.WriteTimeout,
@@ -153,22 +183,39 @@ func NewHTTPServer(cfg *HTTPServerConfig, h http.Handler, log log.Logger) (*HTTP
 	return hs, nil
 }
 
-func withMiddleware(cfg *HTTPServerConfig, log log.Logger, h http.Handler) http.Handler {
+func newHTTPLogger(cfg *HTTPServerConfig, logFunc func(format string, args ...any)) *httplog.Logger {
+	l := httplog.NewLogger(logFunc, cfg.LogHTTPMode)
+	l.SetBodyLimit(int64(cfg.LogHTTPBodyLimit))
+	return l
+}
+
+func withMiddleware(cfg *HTTPServerConfig, log log.Logger, h http.Handler) (http.Handler, error) {
 	// Note that the order of execution is reversed.
 	if cfg.BasicAuth != nil {
 		p, _ := cfg.BasicAuth.Password()
 		h = middleware.NewBasicAuth().Wrap(h, cfg.BasicAuth.Username(), p)
 	}
+	if cfg.HtpasswdFile != "" {
+		ba := middleware.NewBasicAuth()
+		a, err := newHtpasswdAuthenticator(cfg.HtpasswdFile, ba, log)
+		if err != nil {
+			return nil, fmt.Errorf("htpasswd_file: %w", err)
+		}
+		h = ba.WrapFunc(h, func(r *http.Request) bool {
+			_, err := a.Authenticate(r)
+			return err == nil
+		})
+	}
 
 	// Logger middleware must immediately follow the Prometheus middleware because it uses the Prometheus delegator.
 	if cfg.LogHTTPMode != httplog.None {
-		h = httplog.NewLogger(log.Infof, cfg.LogHTTPMode).LogFunc().Wrap(h)
+		h = newHTTPLogger(cfg, log.Infof).LogFunc().Wrap(h)
 	}
 
 	// Prometheus middleware must be the first one to be executed to collect metrics for all other middlewares.
-	h = middleware.NewPrometheus(cfg.PromRegistry, cfg.PromNamespace).Wrap(h)
+	h = middleware.NewPrometheus(promRegisterer(cfg.PromRegistry, cfg.PromInstance, log), cfg.PromNamespace).Wrap(h)
 
-	return h
+	return h, nil
 }
 
 func (hs *HTTPServer) configureHTTPS() error {
@@ -181,7 +228,11 @@ func (hs *HTTPServer) configureHTTPS() error {
 	hs.srv.TLSConfig = httpsTLSConfigTemplate()
 	hs.srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 
-	return hs.config.ConfigureTLSConfig(hs.srv.TLSConfig)
+	if err := hs.config.ConfigureTLSConfig(hs.srv.TLSConfig); err != nil {
+		return err
+	}
+
+	return hs.config.ClientAuth.configureTLSConfig(hs.srv.TLSConfig)
 }
 
 func (hs *HTTPServer) configureHTTP2() error {
@@ -193,41 +244,67 @@ func (hs *HTTPServer) configureHTTP2() error {
 
 	hs.srv.TLSConfig = h2TLSConfigTemplate()
 
-	return hs.config.ConfigureTLSConfig(hs.srv.TLSConfig)
+	if err := hs.config.ConfigureTLSConfig(hs.srv.TLSConfig); err != nil {
+		return err
+	}
+
+	return hs.config.ClientAuth.configureTLSConfig(hs.srv.TLSConfig)
 }
 
+// Run starts the server and waits until it stops, the server is shut down when ctx is canceled.
 func (hs *HTTPServer) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
-	wg.Add(1)
-
-	go func() {
-		defer wg.Done()
-
-		<-ctx.Done()
-		if err := hs.srv.Shutdown(context.Background()); err != nil {
-			hs.log.Errorf("failed to shutdown server error=%s", err)
-		}
-	}()
+	if err := hs.Start(ctx); err != nil {
+		return err
+	}
+	return hs.Wait()
+}
 
-	var srvErr error
+// Start starts serving in the background, it returns ErrServerStarted if the server was already started.
+// Canceling ctx shuts down the server as Shutdown without a deadline.
+func (hs *HTTPServer) Start(ctx context.Context) error {
+	var serve func() error
 	switch hs.config.Protocol {
 	case HTTPScheme:
-		srvErr = hs.srv.Serve(hs.listener)
+		serve = func() error { return hs.srv.Serve(hs.listener) }
 	case HTTP2Scheme, HTTPSScheme:
-		srvErr = hs.srv.ServeTLS(hs.listener, "", "")
+		serve = func() error { return hs.srv.ServeTLS(hs.listener, "", "") }
 	default:
 		return fmt.Errorf("invalid protocol %q", hs.config.Protocol)
 	}
-	if srvErr != nil {
-		if errors.Is(srvErr, http.ErrServerClosed) {
-			hs.log.Debugf("server was shutdown gracefully")
-			srvErr = nil
+
+	return hs.lc.start(ctx, func(context.Context) error {
+		if err := serve(); !errors.Is(err, http.ErrServerClosed) {
+			return err
 		}
-		return srvErr
-	}
+		hs.log.Debugf("server was shutdown gracefully")
+		return nil
+	}, func() {
+		if err := hs.srv.Shutdown(context.Background()); err != nil {
+			hs.log.Errorf("failed to shutdown server error=%s", err)
+		}
+	})
+}
 
-	wg.Wait()
-	return nil
+// Shutdown gracefully stops the server started with Start, it stops accepting connections,
+// and waits until all connections are idle and closed or ctx is done.
+// If ctx is done first, the remaining connections are closed and ctx error is returned.
+func (hs *HTTPServer) Shutdown(ctx context.Context) error {
+	return hs.lc.shutdown(ctx, func() {
+		if err := hs.srv.Close(); err != nil {
+			hs.log.Errorf("failed to close server error=%s", err)
+		}
+	})
+}
+
+// Wait blocks until the server started with Start stops,
+// it returns the error that stopped serving or nil if the server was shut down.
+func (hs *HTTPServer) Wait() error {
+	return hs.lc.wait()
+}
+
+// State returns the lifecycle state of the server.
+func (hs *HTTPServer) State() ServerState {
+	return hs.lc.current()
 }
 
 func (hs *HTTPServer) listen() (net.Listener, error) {
@@ -237,6 +314,9 @@ func (hs *HTTPServer) listen() (net.Listener, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to open listener on address %s: %w", hs.srv.Addr, err)
 		}
+		if hs.config.ProxyProtocol {
+			listener = proxyproto.NewListener(listener, hs.config.ReadHeaderTimeout)
+		}
 		return listener, nil
 	default:
 		return nil, fmt.Errorf("invalid protocol %q", hs.config.Protocol)
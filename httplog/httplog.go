@@ -8,9 +8,12 @@ package httplog
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/log"
 	"github.com/saucelabs/forwarder/internal/martian/messageview"
@@ -26,15 +29,30 @@ const (
 	Headers  Mode = "headers"
 	Body     Mode = "body"
 	Errors   Mode = "errors"
+
+	// WebSocket logs request line and headers like Headers,
+	// and the proxy additionally logs WebSocket frames of intercepted connections.
+	WebSocket Mode = "ws"
+
+	// JSON logs one JSON object per request with the request summary, see JSONEntry.
+	JSON Mode = "json"
 )
 
 func (m Mode) String() string {
 	return string(m)
 }
 
+// Modes returns all supported log modes.
+func Modes() []Mode {
+	return []Mode{None, ShortURL, URL, Headers, Body, Errors, WebSocket, JSON}
+}
+
 type Logger struct {
-	log  func(format string, args ...any)
-	mode Mode
+	log           func(format string, args ...any)
+	mode          Mode
+	bodyLimit     int64
+	bodyLimitFunc func(req *http.Request) (reqLimit, resLimit int64)
+	skipBodyFunc  func(req *http.Request) bool
 }
 
 // NewLogger returns a logger that logs HTTP requests and responses.
@@ -45,6 +63,30 @@ func NewLogger(logFunc func(format string, args ...any), mode Mode) *Logger {
 	}
 }
 
+// SetBodyLimit limits the number of body bytes logged in the body mode, zero means no limit.
+// Bodies are streamed after the first n bytes, so logging does not buffer large bodies in memory.
+func (l *Logger) SetBodyLimit(n int64) {
+	l.bodyLimit = n
+}
+
+// SetBodyLimitFunc sets a function returning the request and response body limits for a request,
+// it allows different limits e.g. for MITMed requests. It takes precedence over SetBodyLimit.
+func (l *Logger) SetBodyLimitFunc(f func(req *http.Request) (reqLimit, resLimit int64)) {
+	l.bodyLimitFunc = f
+}
+
+// SetSkipBodyFunc sets a function that disables logging of bodies for a request in the body mode.
+func (l *Logger) SetSkipBodyFunc(f func(req *http.Request) bool) {
+	l.skipBodyFunc = f
+}
+
+func (l *Logger) bodyLimits(req *http.Request) (reqLimit, resLimit int64) {
+	if l.bodyLimitFunc != nil {
+		return l.bodyLimitFunc(req)
+	}
+	return l.bodyLimit, l.bodyLimit
+}
+
 func (l *Logger) LogFunc() middleware.Logger {
 	switch l.mode {
 	case "", None:
@@ -61,7 +103,7 @@ func (l *Logger) LogFunc() middleware.Logger {
 			w.URLLine(e)
 			l.log("%s", w.String())
 		}
-	case Headers:
+	case Headers, WebSocket:
 		return func(e middleware.LogEntry) {
 			var w logWriter
 			w.ShortURLLine(e)
@@ -70,7 +112,8 @@ func (l *Logger) LogFunc() middleware.Logger {
 		}
 	case Body:
 		return func(e middleware.LogEntry) {
-			w := logWriter{body: true}
+			w := logWriter{body: l.skipBodyFunc == nil || !l.skipBodyFunc(e.Request)}
+			w.reqBodyLimit, w.resBodyLimit = l.bodyLimits(e.Request)
 			w.ShortURLLine(e)
 			w.Dump(e)
 			l.log("%s", w.String())
@@ -86,14 +129,96 @@ func (l *Logger) LogFunc() middleware.Logger {
 			w.Dump(e)
 			l.log("%s", w.String())
 		}
+	case JSON:
+		return func(e middleware.LogEntry) {
+			b, err := json.Marshal(newJSONEntry(e))
+			if err != nil {
+				l.log("logger error: %s", err)
+				return
+			}
+			l.log("%s", b)
+		}
 	default:
 		panic(fmt.Sprintf("unknown log mode %s", l.mode))
 	}
 }
 
+// JSONEntry is the request summary logged in the JSON mode.
+// Byte counts are omitted if unknown, e.g. for chunked bodies.
+type JSONEntry struct {
+	Time     time.Time     `json:"time"`
+	TraceID  string        `json:"trace_id,omitempty"`
+	ClientIP string        `json:"client_ip,omitempty"`
+	User     string        `json:"user,omitempty"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+	Duration time.Duration `json:"duration"`
+	BytesIn  *int64        `json:"bytes_in,omitempty"`
+	BytesOut *int64        `json:"bytes_out,omitempty"`
+	Upstream string        `json:"upstream,omitempty"`
+
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// newJSONEntry returns the request summary of the log entry.
+func newJSONEntry(e middleware.LogEntry) JSONEntry {
+	req := e.Request
+	je := JSONEntry{
+		Time:     time.Now().Add(-e.Duration),
+		User:     middleware.User(req),
+		Method:   req.Method,
+		URL:      req.URL.Redacted(),
+		Status:   e.Status,
+		Duration: e.Duration,
+		Upstream: middleware.Upstream(req),
+	}
+	if trace := req.Context().Value(log.TraceContextKey); trace != nil {
+		je.TraceID = fmt.Sprint(trace)
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		je.ClientIP = host
+	} else {
+		je.ClientIP = req.RemoteAddr
+	}
+
+	if req.ContentLength >= 0 {
+		n := req.ContentLength
+		je.BytesIn = &n
+	}
+	switch {
+	case e.Response != nil:
+		if e.Response.ContentLength >= 0 {
+			n := e.Response.ContentLength
+			je.BytesOut = &n
+		}
+	case e.Written > 0:
+		n := e.Written
+		je.BytesOut = &n
+	}
+
+	if md := middleware.Metadata(req); len(md) > 0 {
+		je.Metadata = make(map[string]string, len(md))
+		for _, m := range md {
+			je.Metadata[m.Key] = m.Value
+		}
+	}
+	if as := middleware.Annotations(req); len(as) > 0 {
+		je.Annotations = make(map[string]string, len(as))
+		for _, a := range as {
+			je.Annotations[a.Key] = a.Value
+		}
+	}
+
+	return je
+}
+
 type logWriter struct {
-	b    bytes.Buffer
-	body bool
+	b            bytes.Buffer
+	body         bool
+	reqBodyLimit int64
+	resBodyLimit int64
 }
 
 func (w *logWriter) String() string {
@@ -102,12 +227,9 @@ func (w *logWriter) String() string {
 
 func (w *logWriter) URLLine(e middleware.LogEntry) {
 	w.trace(e)
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
-		e.Request.Method,
-		e.Request.URL.Redacted(),
-		e.Status,
-		e.Duration,
-	)
+	fmt.Fprintf(&w.b, "%s %s ", e.Request.Method, e.Request.URL.Redacted())
+	w.user(e)
+	fmt.Fprintf(&w.b, "status=%v duration=%s\n", e.Status, e.Duration)
 }
 
 func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
@@ -122,12 +244,9 @@ func (w *logWriter) ShortURLLine(e middleware.LogEntry) {
 		path = "/" + path
 	}
 
-	fmt.Fprintf(&w.b, "%s %s status=%v duration=%s\n",
-		e.Request.Method,
-		scheme+host+path,
-		e.Status,
-		e.Duration,
-	)
+	fmt.Fprintf(&w.b, "%s %s ", e.Request.Method, scheme+host+path)
+	w.user(e)
+	fmt.Fprintf(&w.b, "status=%v duration=%s\n", e.Status, e.Duration)
 }
 
 func (w *logWriter) trace(e middleware.LogEntry) {
@@ -136,6 +255,18 @@ func (w *logWriter) trace(e middleware.LogEntry) {
 	}
 }
 
+func (w *logWriter) user(e middleware.LogEntry) {
+	if user := middleware.User(e.Request); user != "" {
+		fmt.Fprintf(&w.b, "user=%s ", user)
+	}
+	for _, md := range middleware.Metadata(e.Request) {
+		fmt.Fprintf(&w.b, "%s=%s ", md.Key, md.Value)
+	}
+	for _, a := range middleware.Annotations(e.Request) {
+		fmt.Fprintf(&w.b, "%s=%s ", a.Key, a.Value)
+	}
+}
+
 func (w *logWriter) Dump(e middleware.LogEntry) {
 	if err := w.dump(e); err != nil {
 		w.error(err)
@@ -149,6 +280,7 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 
 	// Dump request.
 	{
+		mv.SetBodyLimit(w.reqBodyLimit)
 		if err := mv.SnapshotRequest(e.Request); err != nil {
 			return err
 		}
@@ -159,6 +291,7 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 		if _, err := io.Copy(&w.b, r); err != nil {
 			return err
 		}
+		w.truncated(mv, w.reqBodyLimit)
 	}
 
 	// Dump response.
@@ -166,6 +299,7 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 		if e.Response == nil {
 			return nil
 		}
+		mv.SetBodyLimit(w.resBodyLimit)
 		if err := mv.SnapshotResponse(e.Response); err != nil {
 			return err
 		}
@@ -176,11 +310,23 @@ func (w *logWriter) dump(e middleware.LogEntry) error {
 		if _, err := io.Copy(&w.b, r); err != nil {
 			return err
 		}
+		w.truncated(mv, w.resBodyLimit)
 	}
 
 	return nil
 }
 
+func (w *logWriter) truncated(mv *messageview.MessageView, limit int64) {
+	if !mv.BodyTruncated() {
+		return
+	}
+	if n := mv.BodyLength(); n >= 0 {
+		fmt.Fprintf(&w.b, "\n[body truncated to %d of %d bytes]\n", limit, n)
+	} else {
+		fmt.Fprintf(&w.b, "\n[body truncated to %d bytes]\n", limit)
+	}
+}
+
 func (w *logWriter) error(err error) {
 	fmt.Fprintf(&w.b, "\nlogger error: %s\n", err)
 }
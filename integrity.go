@@ -0,0 +1,175 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// ContentDigestHeader is the RFC 9530 header used to verify and attach SHA-256 digests of response bodies.
+// For chunked responses the proxy sends the digest in a trailer if the origin server did not send one.
+const ContentDigestHeader = "Content-Digest"
+
+// errBodyLength is returned when the number of body bytes does not match the Content-Length.
+var errBodyLength = errors.New("body length does not match Content-Length")
+
+// errBodyDigest is returned when the body digest does not match the Content-Digest header.
+var errBodyDigest = errors.New("body digest does not match Content-Digest")
+
+// integrityBody hashes the body and checks the number of bytes read against the expected length.
+// The done function is called once, when the body is read to the end or fails.
+// It is not called if the body is closed before the end, as the client may abort the transfer.
+type integrityBody struct {
+	io.ReadCloser
+	h        hash.Hash
+	n        int64
+	expected int64
+	done     func(n int64, sum []byte, err error)
+}
+
+func newIntegrityBody(rc io.ReadCloser, expected int64, done func(n int64, sum []byte, err error)) *integrityBody {
+	return &integrityBody{
+		ReadCloser: rc,
+		h:          sha256.New(),
+		expected:   expected,
+		done:       done,
+	}
+}
+
+func (b *integrityBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	b.n += int64(n)
+
+	switch {
+	case err == nil:
+	case errors.Is(err, io.EOF):
+		var verr error
+		if b.expected >= 0 && b.n != b.expected {
+			verr = fmt.Errorf("%w: read %d of %d bytes", errBodyLength, b.n, b.expected)
+		}
+		b.finish(verr)
+	default:
+		b.finish(err)
+	}
+
+	return n, err
+}
+
+func (b *integrityBody) finish(err error) {
+	if b.done != nil {
+		b.done(b.n, b.h.Sum(nil), err)
+		b.done = nil
+	}
+}
+
+// parseContentDigest returns the sha-256 digest from the Content-Digest header value.
+func parseContentDigest(v string) ([]byte, bool) {
+	for _, d := range strings.Split(v, ",") {
+		alg, val, ok := strings.Cut(strings.TrimSpace(d), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		val = strings.Trim(val, ":")
+		sum, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, false
+		}
+		return sum, true
+	}
+	return nil, false
+}
+
+func formatContentDigest(sum []byte) string {
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+func (hp *HTTPProxy) integrityMatch(req *http.Request) bool {
+	return hp.config.IntegrityDomains != nil && hp.config.IntegrityDomains.Match(req.URL.Hostname())
+}
+
+// integrityCheck verifies Content-Length of request and response bodies and Content-Digest of responses,
+// and logs the SHA-256 digests of bodies for hosts matching the integrity domains.
+func (hp *HTTPProxy) integrityCheck() martian.RequestResponseModifier {
+	return integrityModifier{hp}
+}
+
+type integrityModifier struct {
+	hp *HTTPProxy
+}
+
+func (m integrityModifier) ModifyRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || !m.hp.integrityMatch(req) {
+		return nil
+	}
+
+	req.Body = newIntegrityBody(req.Body, req.ContentLength, func(n int64, sum []byte, err error) {
+		m.report(req, "request", n, sum, err)
+	})
+	return nil
+}
+
+func (m integrityModifier) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil || res.Body == nil || res.Body == http.NoBody || !m.hp.integrityMatch(req) {
+		return nil
+	}
+	if _, upgrade := res.Body.(io.ReadWriteCloser); upgrade {
+		return nil
+	}
+
+	// Digests of partial content cover the whole representation, and transparently decoded bodies differ from the original.
+	want, verify := parseContentDigest(res.Header.Get(ContentDigestHeader))
+	if res.StatusCode == http.StatusPartialContent || res.Uncompressed {
+		verify = false
+	}
+
+	// Attach the digest in a trailer of chunked responses, unless the origin server sends it.
+	te := res.TransferEncoding
+	trailer := len(te) > 0 && te[len(te)-1] == "chunked" && req.Method != http.MethodHead &&
+		res.Header.Get(ContentDigestHeader) == "" && res.Trailer.Get(ContentDigestHeader) == ""
+	if trailer {
+		if res.Trailer == nil {
+			res.Trailer = make(http.Header)
+		}
+		res.Trailer[ContentDigestHeader] = nil
+	}
+
+	res.Body = newIntegrityBody(res.Body, res.ContentLength, func(n int64, sum []byte, err error) {
+		if err == nil && verify && !bytes.Equal(sum, want) {
+			err = errBodyDigest
+		}
+		if err == nil && trailer {
+			res.Trailer.Set(ContentDigestHeader, formatContentDigest(sum))
+		}
+		m.report(req, "response", n, sum, err)
+	})
+	return nil
+}
+
+func (m integrityModifier) report(req *http.Request, direction string, n int64, sum []byte, err error) {
+	if err != nil {
+		if errors.Is(err, errBodyLength) || errors.Is(err, errBodyDigest) || errors.Is(err, io.ErrUnexpectedEOF) {
+			m.hp.metrics.integrityError(direction)
+			m.hp.log.Errorf("integrity: %s %s %s body: %s", req.Method, req.URL.Redacted(), direction, err)
+		} else {
+			m.hp.log.Debugf("integrity: %s %s %s body: %s", req.Method, req.URL.Redacted(), direction, err)
+		}
+		return
+	}
+	m.hp.log.Infof("integrity: %s %s %s body bytes=%d %s", req.Method, req.URL.Redacted(), direction, n, formatContentDigest(sum))
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestIntegrityBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected int64
+		err      error
+	}{
+		{
+			name:     "match",
+			body:     "hello",
+			expected: 5,
+		},
+		{
+			name:     "unknown length",
+			body:     "hello",
+			expected: -1,
+		},
+		{
+			name:     "short",
+			body:     "hell",
+			expected: 5,
+			err:      errBodyLength,
+		},
+		{
+			name:     "long",
+			body:     "hello!",
+			expected: 5,
+			err:      errBodyLength,
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				calls int
+				gotN  int64
+				sum   []byte
+				err   error
+			)
+			b := newIntegrityBody(io.NopCloser(strings.NewReader(tc.body)), tc.expected, func(n int64, s []byte, e error) {
+				calls++
+				gotN, sum, err = n, s, e
+			})
+			if _, rerr := io.ReadAll(b); rerr != nil {
+				t.Fatal(rerr)
+			}
+			b.Read(make([]byte, 1))
+
+			if calls != 1 {
+				t.Fatalf("expected done to be called once, got %d", calls)
+			}
+			if gotN != int64(len(tc.body)) {
+				t.Fatalf("expected %d bytes, got %d", len(tc.body), gotN)
+			}
+			if want := sha256.Sum256([]byte(tc.body)); !bytes.Equal(sum, want[:]) {
+				t.Fatalf("unexpected digest %x", sum)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected error %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestContentDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	v := formatContentDigest(sum[:])
+	if v != "sha-256=:LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=:" {
+		t.Fatalf("unexpected Content-Digest %q", v)
+	}
+
+	for _, h := range []string{v, "sha-512=:abc=:, " + v, "SHA-256=" + strings.TrimPrefix(v, "sha-256=")} {
+		got, ok := parseContentDigest(h)
+		if !ok || !bytes.Equal(got, sum[:]) {
+			t.Fatalf("parse %q: got %x, %v", h, got, ok)
+		}
+	}
+
+	for _, h := range []string{"", "sha-512=:abc=:", "sha-256=:not base64:"} {
+		if _, ok := parseContentDigest(h); ok {
+			t.Fatalf("parse %q: expected failure", h)
+		}
+	}
+}
@@ -37,9 +37,16 @@ type Context struct {
 
 	mu            sync.RWMutex
 	vals          map[string]any
+	annotations   []Annotation
 	skipRoundTrip bool
 }
 
+// Annotation is a key value pair attached to a request for diagnostics, see Context.Annotate.
+type Annotation struct {
+	Key   string
+	Value string
+}
+
 // Session provides information and storage about a connection.
 type Session struct {
 	mu       sync.RWMutex
@@ -49,6 +56,7 @@ type Session struct {
 	brw      *bufio.ReadWriter
 	rw       http.ResponseWriter
 	vals     map[string]any
+	onClose  []func()
 }
 
 type contextKey string
@@ -149,6 +157,21 @@ func (s *Session) HijackResponseWriter() (http.ResponseWriter, error) {
 	return nil, fmt.Errorf("session has no response writer")
 }
 
+// SetWriteDeadline sets the write deadline of the connection, a zero value means writes will not time out.
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.conn != nil {
+		return s.conn.SetWriteDeadline(t)
+	}
+	if s.rw != nil {
+		return http.NewResponseController(s.rw).SetWriteDeadline(t)
+	}
+
+	return fmt.Errorf("session has no connection or response writer")
+}
+
 // Hijacked returns whether the connection has been hijacked.
 func (s *Session) Hijacked() bool {
 	s.mu.RLock()
@@ -180,6 +203,26 @@ func (s *Session) Set(key string, val any) {
 	s.vals[key] = val
 }
 
+// OnClose registers f to be called when the session ends i.e. the connection is closed.
+func (s *Session) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onClose = append(s.onClose, f)
+}
+
+// close calls the functions registered with OnClose.
+func (s *Session) close() {
+	s.mu.Lock()
+	fns := s.onClose
+	s.onClose = nil
+	s.mu.Unlock()
+
+	for _, f := range fns {
+		f()
+	}
+}
+
 // addToContext returns context.Context with the current context to the passed context.
 func (ctx *Context) addToContext(rctx context.Context) context.Context {
 	if rctx == nil {
@@ -223,6 +266,34 @@ func (ctx *Context) Set(key string, val any) {
 	ctx.vals[key] = val
 }
 
+// Annotate attaches the key value pair to the request for diagnostics, it replaces the previous value of the key.
+// Annotations are kept in the order they were first added.
+func (ctx *Context) Annotate(key, value string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for i := range ctx.annotations {
+		if ctx.annotations[i].Key == key {
+			ctx.annotations[i].Value = value
+			return
+		}
+	}
+	ctx.annotations = append(ctx.annotations, Annotation{Key: key, Value: value})
+}
+
+// Annotations returns a copy of the annotations of the request.
+func (ctx *Context) Annotations() []Annotation {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	if len(ctx.annotations) == 0 {
+		return nil
+	}
+	a := make([]Annotation, len(ctx.annotations))
+	copy(a, ctx.annotations)
+	return a
+}
+
 // SkipRoundTrip skips the round trip for the current request.
 func (ctx *Context) SkipRoundTrip() {
 	ctx.mu.Lock()
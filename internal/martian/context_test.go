@@ -65,6 +65,38 @@ func TestContexts(t *testing.T) {
 	}
 }
 
+func TestContextAnnotations(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+
+	ctx := TestContext(req, nil, nil)
+	if got := ctx.Annotations(); got != nil {
+		t.Errorf("ctx.Annotations(): got %v, want nil", got)
+	}
+
+	ctx.Annotate("b", "1")
+	ctx.Annotate("a", "2")
+	ctx.Annotate("b", "3")
+
+	got := ctx.Annotations()
+	want := []Annotation{{Key: "b", Value: "3"}, {Key: "a", Value: "2"}}
+	if len(got) != len(want) {
+		t.Fatalf("ctx.Annotations(): got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ctx.Annotations()[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	got[0].Value = "changed"
+	if v := ctx.Annotations()[0].Value; v != "3" {
+		t.Errorf("ctx.Annotations()[0].Value: got %q, want %q", v, "3")
+	}
+}
+
 func TestContextHijack(t *testing.T) {
 	rc, wc := net.Pipe()
 	req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
@@ -18,6 +18,7 @@ package martian
 
 import (
 	"bufio"
+	"io"
 	"mime"
 	"net/http"
 )
@@ -40,16 +41,23 @@ func isTextEventStream(res *http.Response) bool {
 	return baseCT == "text/event-stream"
 }
 
-// flushAfterChunkWriter works with net/http/internal.chunkedWriter and forces a flush after each chunk is written.
-// There is also net/http/internal.FlushAfterChunkWriter that does the same thing nicer, but it is not available.
-type flushAfterChunkWriter struct {
-	*bufio.Writer
+// flushBeforeReadBody flushes the writer before each read from the body,
+// so that the data read previously is sent to the client before waiting for more data.
+// It works with any transfer encoding, including close-delimited and Content-Length bodies.
+type flushBeforeReadBody struct {
+	io.ReadCloser
+	w *bufio.Writer
 }
 
-func (w flushAfterChunkWriter) WriteString(s string) (n int, err error) {
-	n, err = w.Writer.WriteString(s)
-	if s == "\r\n" && err == nil {
-		err = w.Flush()
+func (b flushBeforeReadBody) Read(p []byte) (int, error) {
+	if err := b.w.Flush(); err != nil {
+		return 0, err
 	}
-	return
+	return b.ReadCloser.Read(p)
+}
+
+// writerOnly hides io.ReaderFrom of the writer.
+// It must be used with flushBeforeReadBody, bufio.Writer.ReadFrom reads into the buffer that is flushed.
+type writerOnly struct {
+	io.Writer
 }
@@ -0,0 +1,60 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestFlushBeforeReadBody(t *testing.T) {
+	pr, pw := io.Pipe()
+	writes := make(chanWriter, 10)
+	bw := bufio.NewWriter(writes)
+
+	res := &http.Response{
+		StatusCode:    http.StatusOK,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/event-stream"}},
+		ContentLength: 26,
+		Body:          flushBeforeReadBody{pr, bw},
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- res.Write(writerOnly{bw})
+	}()
+
+	// Headers are flushed before waiting for the body.
+	if h := <-writes; !strings.HasPrefix(h, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(h, "\r\n\r\n") {
+		t.Fatalf("unexpected headers %q", h)
+	}
+
+	for _, e := range []string{"data: hello\n\n", "data: world\n\n"} {
+		if _, err := pw.Write([]byte(e)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-writes; got != e {
+			t.Fatalf("expected %q, got %q", e, got)
+		}
+	}
+	pw.Close()
+
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
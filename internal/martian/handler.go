@@ -72,6 +72,7 @@ func copyBody(w io.Writer, body io.ReadCloser) error {
 // Known limitations:
 //   - MITM is not supported
 //   - HTTP status code 100 is not supported, see [issue 2184]
+//   - ForwardInformational is not supported
 //
 // [issue 2184]: https://github.com/golang/go/issues/2184
 type proxyHandler struct {
@@ -85,6 +86,7 @@ func (p *Proxy) Handler() http.Handler {
 
 func (p proxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	session := newSessionWithResponseWriter(rw)
+	defer session.close()
 	if req.TLS != nil {
 		session.MarkSecure()
 	}
@@ -187,7 +189,7 @@ func (p proxyHandler) handleConnectRequest(ctx *Context, rw http.ResponseWriter,
 		res.ContentLength = -1
 	}
 
-	if err := p.tunnel("CONNECT", rw, req, res, cw, cr); err != nil {
+	if err := p.tunnel("CONNECT", rw, req, res, cw, cr, nil); err != nil {
 		log.Errorf(req.Context(), "CONNECT tunnel: %v", err)
 		panic(http.ErrAbortHandler)
 	}
@@ -204,16 +206,19 @@ func (p proxyHandler) handleUpgradeResponse(rw http.ResponseWriter, req *http.Re
 
 	res.Body = nil
 
-	if err := p.tunnel(resUpType, rw, req, res, uconn, uconn); err != nil {
+	if err := p.tunnel(resUpType, rw, req, res, uconn, uconn, p.upgradeFilter(res)); err != nil {
 		log.Errorf(req.Context(), "%s tunnel: %w", resUpType, err)
 		panic(http.ErrAbortHandler)
 	}
 }
 
-func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Request, res *http.Response, cw io.WriteCloser, cr io.Reader) error {
+func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Request, res *http.Response,
+	cw io.WriteCloser, cr io.Reader, filter tunnelFilter,
+) error {
 	var (
-		rc    = http.NewResponseController(rw)
-		donec = make(chan bool, 2)
+		rc          = http.NewResponseController(rw)
+		donec       = make(chan copyResult, 2)
+		closeClient func()
 	)
 	switch req.ProtoMajor {
 	case 1:
@@ -222,6 +227,7 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 			return err
 		}
 		defer conn.Close()
+		closeClient = func() { conn.Close() }
 
 		if err := res.Write(brw); err != nil {
 			return fmt.Errorf("got error while writing response back to client: %w", err)
@@ -229,12 +235,16 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 		if err := brw.Flush(); err != nil {
 			return fmt.Errorf("got error while flushing response back to client: %w", err)
 		}
-		if err := drainBuffer(cw, brw.Reader); err != nil {
+
+		var or io.Reader = conn
+		if filter != nil {
+			or, cr = filter(brw.Reader, cr)
+		} else if err := drainBuffer(cw, brw.Reader); err != nil {
 			return fmt.Errorf("got error while draining buffer: %w", err)
 		}
 
-		go copySync(req.Context(), "outbound "+name, cw, conn, donec)
-		go copySync(req.Context(), "inbound "+name, conn, cr, donec)
+		go copySync(req.Context(), "outbound "+name, cw, or, true, donec)
+		go copySync(req.Context(), "inbound "+name, conn, cr, false, donec)
 	case 2:
 		copyHeader(rw.Header(), res.Header)
 		rw.WriteHeader(res.StatusCode)
@@ -242,17 +252,26 @@ func (p proxyHandler) tunnel(name string, rw http.ResponseWriter, req *http.Requ
 		if err := rc.Flush(); err != nil {
 			return fmt.Errorf("got error while flushing response back to client: %w", err)
 		}
+		closeClient = func() { req.Body.Close() }
+
+		var or io.Reader = req.Body
+		if filter != nil {
+			or, cr = filter(or, cr)
+		}
 
-		go copySync(req.Context(), "outbound "+name, cw, req.Body, donec)
-		go copySync(req.Context(), "inbound "+name, writeFlusher{rw, rc}, cr, donec)
+		go copySync(req.Context(), "outbound "+name, cw, or, true, donec)
+		go copySync(req.Context(), "inbound "+name, writeFlusher{rw, rc}, cr, false, donec)
 	default:
 		return fmt.Errorf("unsupported protocol version: %d", req.ProtoMajor)
 	}
 
 	log.Debugf(req.Context(), "established %s tunnel, proxying traffic", name)
-	<-donec
-	<-donec
-	log.Debugf(req.Context(), "closed %s tunnel", name)
+	reason := waitTunnel(donec, p.closing, func() {
+		// The filter may wrap cr, close the client side and the original upstream writer instead.
+		closeClient()
+		cw.Close()
+	})
+	logTunnelClose(req.Context(), name, reason)
 
 	return nil
 }
@@ -288,6 +307,7 @@ func (p proxyHandler) handleRequest(ctx *Context, rw http.ResponseWriter, req *h
 	if reqUpType != "" {
 		log.Debugf(req.Context(), "upgrade request: %s", reqUpType)
 	}
+	reqTrailers := acceptsTrailers(req.Header)
 	if err := p.reqmod.ModifyRequest(req); err != nil {
 		log.Errorf(req.Context(), "error modifying request: %v", err)
 		p.warning(req.Header, err)
@@ -298,14 +318,22 @@ func (p proxyHandler) handleRequest(ctx *Context, rw http.ResponseWriter, req *h
 	}
 
 	// After stripping all the hop-by-hop connection headers above, add back any
-	// necessary for protocol upgrades, such as for websockets.
+	// necessary for protocol upgrades, such as for websockets, and for trailers.
 	if reqUpType != "" {
 		req.Header.Set("Connection", "Upgrade")
 		req.Header.Set("Upgrade", reqUpType)
 	}
+	if reqTrailers {
+		req.Header.Set("Te", "trailers")
+	}
 
 	// perform the HTTP roundtrip
-	res, err := p.roundTrip(ctx, req)
+	release, err := p.waitInFlight(req)
+	defer release()
+	var res *http.Response
+	if err == nil {
+		res, err = p.roundTrip(ctx, req)
+	}
 	if err != nil {
 		log.Errorf(req.Context(), "failed to round trip: %v", err)
 		res = p.errorResponse(req, err)
@@ -337,7 +365,7 @@ func (p proxyHandler) handleRequest(ctx *Context, rw http.ResponseWriter, req *h
 		res.Header.Set("Upgrade", resUpType)
 	}
 
-	if !req.ProtoAtLeast(1, 1) || req.Close || res.Close || p.Closing() {
+	if !req.ProtoAtLeast(1, 1) || req.Close || res.Close || p.Closing() || p.Draining() {
 		log.Debugf(req.Context(), "received close request: %v", req.RemoteAddr)
 		res.Close = true
 	}
@@ -386,7 +414,7 @@ func (w writeFlusher) CloseWrite() error {
 func writeResponse(rw http.ResponseWriter, res *http.Response) {
 	copyHeader(rw.Header(), res.Header)
 	if res.Close {
-		res.Header.Set("Connection", "close")
+		rw.Header().Set("Connection", "close")
 	}
 	announcedTrailers := addTrailerHeader(rw, res.Trailer)
 	rw.WriteHeader(res.StatusCode)
@@ -27,6 +27,18 @@ import (
 // behavior, in addition to a fifo.Group that can be used to add additional
 // modifiers within the stack.
 func NewStack(via string) (outer, inner *fifo.Group) {
+	return newStack(header.NewViaModifier(via))
+}
+
+// NewStackWithViaBoundary is like NewStack, but the Via header boundary is set
+// instead of a random one. This should only be used for testing.
+func NewStackWithViaBoundary(via, boundary string) (outer, inner *fifo.Group) {
+	vm := header.NewViaModifier(via)
+	vm.SetBoundary(boundary)
+	return newStack(vm)
+}
+
+func newStack(vm *header.ViaModifier) (outer, inner *fifo.Group) {
 	outer = fifo.NewGroup()
 
 	hbhm := header.NewHopByHopModifier()
@@ -34,7 +46,6 @@ func NewStack(via string) (outer, inner *fifo.Group) {
 	outer.AddRequestModifier(header.NewForwardedModifier())
 	outer.AddRequestModifier(header.NewBadFramingModifier())
 
-	vm := header.NewViaModifier(via)
 	outer.AddRequestModifier(vm)
 
 	inner = fifo.NewGroup()
@@ -0,0 +1,58 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrQueueTimeout is returned when a request waits for an in-flight slot longer than InFlightQueueTimeout.
+var ErrQueueTimeout = errors.New("timed out waiting for in-flight request slot")
+
+func noopRelease() {}
+
+// waitInFlight blocks until the number of requests in flight is below MaxInFlight.
+// Waiting requests are served approximately in arrival order, the returned function must be called when the response is written.
+// It returns ErrQueueTimeout if the request waits longer than InFlightQueueTimeout,
+// or the request context error if the request is canceled while waiting.
+func (p *Proxy) waitInFlight(req *http.Request) (release func(), err error) {
+	if p.MaxInFlight <= 0 {
+		return noopRelease, nil
+	}
+
+	p.inFlightOnce.Do(func() {
+		p.inFlight = make(chan struct{}, p.MaxInFlight)
+	})
+
+	release = func() {
+		<-p.inFlight
+	}
+
+	select {
+	case p.inFlight <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if p.InFlightQueueTimeout > 0 {
+		t := time.NewTimer(p.InFlightQueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p.inFlight <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return noopRelease, ErrQueueTimeout
+	case <-req.Context().Done():
+		return noopRelease, req.Context().Err()
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// informationalWriter writes 1xx informational responses received from upstream to the client,
+// until the final response is received.
+// 100 Continue is not forwarded, it is handled by the transport.
+type informationalWriter struct {
+	mu   sync.Mutex
+	w    *bufio.Writer
+	done bool
+}
+
+func (iw *informationalWriter) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		Got1xxResponse: iw.got1xxResponse,
+	}
+}
+
+func (iw *informationalWriter) got1xxResponse(code int, header textproto.MIMEHeader) error {
+	if code == http.StatusContinue {
+		return nil
+	}
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	if iw.done {
+		return nil
+	}
+
+	text := http.StatusText(code)
+	if text == "" {
+		text = "status code " + strconv.Itoa(code)
+	}
+	if _, err := fmt.Fprintf(iw.w, "HTTP/1.1 %03d %s\r\n", code, text); err != nil {
+		return err
+	}
+	if err := http.Header(header).Write(iw.w); err != nil {
+		return err
+	}
+	if _, err := iw.w.WriteString("\r\n"); err != nil {
+		return err
+	}
+	return iw.w.Flush()
+}
+
+// stop prevents writing informational responses after the final response is received.
+// It is safe to call on nil writer.
+func (iw *informationalWriter) stop() {
+	if iw == nil {
+		return
+	}
+
+	iw.mu.Lock()
+	iw.done = true
+	iw.mu.Unlock()
+}
@@ -36,6 +36,10 @@ type MessageView struct {
 	compress      string
 	bodyoffset    int64
 	traileroffset int64
+
+	bodyLimit     int64
+	bodyTruncated bool
+	bodyLength    int64
 }
 
 type config struct {
@@ -63,6 +67,26 @@ func (mv *MessageView) SkipBody(skipBody bool) {
 	mv.skipBody = skipBody
 }
 
+// SetBodyLimit limits the number of body bytes read into memory when the view
+// is loaded with a request or response, zero means no limit. If the body is
+// longer, the view holds the first n bytes and the rest of the body is streamed
+// from the original reader.
+func (mv *MessageView) SetBodyLimit(n int64) {
+	mv.bodyLimit = n
+}
+
+// BodyTruncated returns true if the body in the view is truncated due to the
+// body limit.
+func (mv *MessageView) BodyTruncated() bool {
+	return mv.bodyTruncated
+}
+
+// BodyLength returns the total length of the body, or -1 if the body is
+// truncated and the length is unknown.
+func (mv *MessageView) BodyLength() int64 {
+	return mv.bodyLength
+}
+
 // SkipBodyUnlessContentType will skip reading the body unless the
 // Content-Type matches one in cts.
 func (mv *MessageView) SkipBodyUnlessContentType(cts ...string) {
@@ -110,27 +134,18 @@ func (mv *MessageView) SnapshotRequest(req *http.Request) error {
 		return nil
 	}
 
-	data, err := io.ReadAll(req.Body)
+	body, err := mv.snapshotBody(buf, req.Body, req.ContentLength)
 	if err != nil {
 		return err
 	}
-	req.Body.Close()
+	req.Body = body
 
-	if mv.chunked {
-		cw := httputil.NewChunkedWriter(buf)
-		cw.Write(data)
-		cw.Close()
-	} else {
-		buf.Write(data)
-	}
-
-	mv.traileroffset = int64(buf.Len())
-
-	req.Body = io.NopCloser(bytes.NewReader(data))
-
-	if req.Trailer != nil {
+	switch {
+	case mv.bodyTruncated:
+		// Trailers are not read yet.
+	case req.Trailer != nil:
 		req.Trailer.Write(buf)
-	} else if mv.chunked {
+	case mv.chunked:
 		fmt.Fprint(buf, "\r\n")
 	}
 
@@ -177,11 +192,61 @@ func (mv *MessageView) SnapshotResponse(res *http.Response) error {
 		return nil
 	}
 
-	data, err := io.ReadAll(res.Body)
+	body, err := mv.snapshotBody(buf, res.Body, res.ContentLength)
 	if err != nil {
 		return err
 	}
-	res.Body.Close()
+	res.Body = body
+
+	switch {
+	case mv.bodyTruncated:
+		// Trailers are not read yet.
+	case res.Trailer != nil:
+		res.Trailer.Write(buf)
+	case mv.chunked:
+		fmt.Fprint(buf, "\r\n")
+	}
+
+	mv.message = buf.Bytes()
+
+	return nil
+}
+
+// snapshotBody writes the body, or the first bodyLimit bytes of it, to buf and
+// returns the replacement body.
+func (mv *MessageView) snapshotBody(buf *bytes.Buffer, body io.ReadCloser, contentLength int64) (io.ReadCloser, error) {
+	r := io.Reader(body)
+	if mv.bodyLimit > 0 {
+		r = io.LimitReader(body, mv.bodyLimit+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mv.bodyTruncated = mv.bodyLimit > 0 && int64(len(data)) > mv.bodyLimit
+	if mv.bodyTruncated {
+		mv.bodyLength = -1
+		if contentLength >= 0 {
+			mv.bodyLength = contentLength
+		}
+
+		// Partial data is not chunk encoded as the chunked writer would terminate the body.
+		mv.chunked = false
+		buf.Write(data[:mv.bodyLimit])
+		mv.traileroffset = int64(buf.Len())
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(data), body),
+			Closer: body,
+		}, nil
+	}
+
+	mv.bodyLength = int64(len(data))
+	body.Close()
 
 	if mv.chunked {
 		cw := httputil.NewChunkedWriter(buf)
@@ -193,17 +258,7 @@ func (mv *MessageView) SnapshotResponse(res *http.Response) error {
 
 	mv.traileroffset = int64(buf.Len())
 
-	res.Body = io.NopCloser(bytes.NewReader(data))
-
-	if res.Trailer != nil {
-		res.Trailer.Write(buf)
-	} else if mv.chunked {
-		fmt.Fprint(buf, "\r\n")
-	}
-
-	mv.message = buf.Bytes()
-
-	return nil
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
 // Reader returns the an io.ReadCloser that reads the full HTTP message.
@@ -765,3 +765,58 @@ func TestResponseViewDecodeDeflateContentEncoding(t *testing.T) {
 		t.Fatalf("mv.Read(): got %q, want %q", got, want)
 	}
 }
+
+func TestResponseViewBodyLimit(t *testing.T) {
+	body := strings.Repeat("x", 100)
+
+	for _, cl := range []int64{100, -1} {
+		res := proxyutil.NewResponse(200, strings.NewReader(body), nil)
+		res.ContentLength = cl
+
+		mv := New()
+		mv.SetBodyLimit(10)
+		if err := mv.SnapshotResponse(res); err != nil {
+			t.Fatalf("SnapshotResponse(): got %v, want no error", err)
+		}
+
+		if !mv.BodyTruncated() {
+			t.Fatal("mv.BodyTruncated(): got false, want true")
+		}
+		if got := mv.BodyLength(); got != cl {
+			t.Errorf("mv.BodyLength(): got %d, want %d", got, cl)
+		}
+
+		br, err := mv.BodyReader()
+		if err != nil {
+			t.Fatalf("mv.BodyReader(): got %v, want no error", err)
+		}
+		got, err := io.ReadAll(br)
+		if err != nil {
+			t.Fatalf("io.ReadAll(mv.BodyReader()): got %v, want no error", err)
+		}
+		if want := body[:10]; string(got) != want {
+			t.Fatalf("io.ReadAll(mv.BodyReader()): got %q, want %q", got, want)
+		}
+
+		got, err = io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("io.ReadAll(res.Body): got %v, want no error", err)
+		}
+		if string(got) != body {
+			t.Fatalf("io.ReadAll(res.Body): got %q, want %q", got, body)
+		}
+	}
+
+	res := proxyutil.NewResponse(200, strings.NewReader(bodyContent), nil)
+	mv := New()
+	mv.SetBodyLimit(int64(len(bodyContent)))
+	if err := mv.SnapshotResponse(res); err != nil {
+		t.Fatalf("SnapshotResponse(): got %v, want no error", err)
+	}
+	if mv.BodyTruncated() {
+		t.Fatal("mv.BodyTruncated(): got true, want false")
+	}
+	if got, want := mv.BodyLength(), int64(len(bodyContent)); got != want {
+		t.Errorf("mv.BodyLength(): got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package mitm
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+)
+
+// CertStorage persists generated certificates, so that they can be reused after a restart.
+// Load returns nil certificate and nil error if there is no certificate for the hostname.
+type CertStorage interface {
+	Load(hostname string) (*tls.Certificate, error)
+	Store(hostname string, cert *tls.Certificate) error
+}
+
+// CertCache is an in-memory cache of generated certificates,
+// if size is positive the least recently used certificates are evicted.
+// It can be shared by multiple configs, certificates are cached per CA.
+type CertCache struct {
+	mu    sync.Mutex
+	size  int
+	certs map[string]*list.Element
+	lru   *list.List
+}
+
+type certCacheEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+// NewCertCache returns a cache of at most size certificates, zero means no limit.
+func NewCertCache(size int) *CertCache {
+	return &CertCache{
+		size:  size,
+		certs: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+func (c *CertCache) get(key string) (*tls.Certificate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.certs[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*certCacheEntry).cert, true //nolint:forcetypeassert // only entries are stored
+}
+
+func (c *CertCache) add(key string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.certs[key]; ok {
+		e.Value.(*certCacheEntry).cert = cert //nolint:forcetypeassert // only entries are stored
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.certs[key] = c.lru.PushFront(&certCacheEntry{key: key, cert: cert})
+	c.evictLocked()
+}
+
+func (c *CertCache) setSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	c.evictLocked()
+}
+
+func (c *CertCache) evictLocked() {
+	for c.size > 0 && c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.certs, e.Value.(*certCacheEntry).key) //nolint:forcetypeassert // only entries are stored
+	}
+}
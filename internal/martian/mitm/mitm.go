@@ -20,17 +20,18 @@ package mitm
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"errors"
 	"math/big"
 	"net"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/h2"
@@ -47,17 +48,21 @@ var MaxSerialNumber = big.NewInt(0).SetBytes(bytes.Repeat([]byte{255}, 20))
 type Config struct {
 	ca                     *x509.Certificate
 	capriv                 any
-	priv                   *rsa.PrivateKey
+	priv                   crypto.Signer
 	keyID                  []byte
 	validity               time.Duration
+	clock                  func() time.Time
 	org                    string
 	h2Config               *h2.Config
+	http2                  bool
 	roots                  *x509.CertPool
 	skipVerify             bool
 	handshakeErrorCallback func(*http.Request, error)
+	handshakeCallback      func(*http.Request, *tls.ClientHelloInfo, tls.ConnectionState)
 
-	certmu sync.RWMutex
-	certs  map[string]*tls.Certificate
+	caID    string
+	certs   *CertCache
+	storage CertStorage
 }
 
 // NewAuthority creates a new CA certificate and associated
@@ -138,24 +143,67 @@ func NewConfig(ca *x509.Certificate, privateKey any) (*Config, error) {
 	h.Write(pkixpub)
 	keyID := h.Sum(nil)
 
+	caSum := sha1.Sum(ca.Raw)
+
 	return &Config{
 		ca:       ca,
+		caID:     hex.EncodeToString(caSum[:]),
 		capriv:   privateKey,
 		priv:     priv,
 		keyID:    keyID,
 		validity: time.Hour,
+		clock:    time.Now,
 		org:      "Martian Proxy",
-		certs:    make(map[string]*tls.Certificate),
+		certs:    NewCertCache(0),
 		roots:    roots,
 	}, nil
 }
 
+// SetLeafKey sets the private key of the on-the-fly certificates.
+// By default, a 2048 bit RSA key is used.
+func (c *Config) SetLeafKey(priv crypto.Signer) error {
+	pkixpub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return err
+	}
+	h := sha1.New()
+	h.Write(pkixpub)
+
+	c.priv = priv
+	c.keyID = h.Sum(nil)
+
+	return nil
+}
+
 // SetValidity sets the validity window around the current time that the
 // certificate is valid for.
 func (c *Config) SetValidity(validity time.Duration) {
 	c.validity = validity
 }
 
+// SetClock sets the function returning the current time, it is used for the validity window of the certificates
+// and in the TLS configs. By default, time.Now is used.
+func (c *Config) SetClock(now func() time.Time) {
+	c.clock = now
+}
+
+// SetCacheSize limits the number of certificates kept in memory, the least recently used certificates are evicted.
+// By default, or if size is not positive, the number of certificates is not limited.
+func (c *Config) SetCacheSize(size int) {
+	c.certs.setSize(size)
+}
+
+// SetCertCache replaces the in-memory cache of certificates, it allows sharing the cache between configs.
+func (c *Config) SetCertCache(cc *CertCache) {
+	c.certs = cc
+}
+
+// SetCertStorage sets the storage of generated certificates,
+// it is consulted on cache miss before generating a new certificate.
+func (c *Config) SetCertStorage(s CertStorage) {
+	c.storage = s
+}
+
 // SkipTLSVerify skips the TLS certification verification check.
 func (c *Config) SkipTLSVerify(skip bool) {
 	c.skipVerify = skip
@@ -171,6 +219,12 @@ func (c *Config) SetH2Config(h2Config *h2.Config) {
 	c.h2Config = h2Config
 }
 
+// SetHTTP2 enables negotiation of HTTP/2 with clients of MITMed connections.
+// The requests are handled by the proxy like HTTP/1 requests, unless the HTTP/2 configuration is set.
+func (c *Config) SetHTTP2(enabled bool) {
+	c.http2 = enabled
+}
+
 // H2Config returns the current HTTP/2 configuration.
 func (c *Config) H2Config() *h2.Config {
 	return c.h2Config
@@ -190,6 +244,21 @@ func (c *Config) HandshakeErrorCallback(r *http.Request, err error) {
 	}
 }
 
+// SetHandshakeCallback sets the handshakeCallback function.
+func (c *Config) SetHandshakeCallback(cb func(*http.Request, *tls.ClientHelloInfo, tls.ConnectionState)) {
+	c.handshakeCallback = cb
+}
+
+// HandshakeCallback calls the handshakeCallback function in this Config,
+// if it is non-nil. Request is the connect request that this handshake
+// is being executed through, hello is the ClientHello sent by the client,
+// and cs is the state of the established connection.
+func (c *Config) HandshakeCallback(r *http.Request, hello *tls.ClientHelloInfo, cs tls.ConnectionState) {
+	if c.handshakeCallback != nil {
+		c.handshakeCallback(r, hello, cs)
+	}
+}
+
 // CACert returns the CA certificate used to sign the on-the-fly certificates.
 func (c *Config) CACert() *x509.Certificate {
 	return c.ca
@@ -200,6 +269,7 @@ func (c *Config) CACert() *x509.Certificate {
 func (c *Config) TLS() *tls.Config {
 	return &tls.Config{
 		InsecureSkipVerify: c.skipVerify,
+		Time:               c.clock,
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			if clientHello.ServerName == "" {
 				return nil, errors.New("mitm: SNI not provided, failed to build certificate")
@@ -215,11 +285,12 @@ func (c *Config) TLS() *tls.Config {
 // using SNI from the connection, or fall back to the provided hostname.
 func (c *Config) TLSForHost(hostname string) *tls.Config {
 	nextProtos := []string{"http/1.1"}
-	if c.h2AllowedHost(hostname) {
+	if c.http2 || c.h2AllowedHost(hostname) {
 		nextProtos = []string{"h2", "http/1.1"}
 	}
 	return &tls.Config{
 		InsecureSkipVerify: c.skipVerify,
+		Time:               c.clock,
 		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			host := clientHello.ServerName
 			if host == "" {
@@ -245,19 +316,13 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 		hostname = host
 	}
 
-	c.certmu.RLock()
-	tlsc, ok := c.certs[hostname]
-	c.certmu.RUnlock()
-
-	if ok {
+	key := c.cacheKey(hostname)
+	if tlsc, ok := c.certs.get(key); ok {
 		log.Debugf(context.TODO(), "mitm: cache hit for %s", hostname)
 
 		// Check validity of the certificate for hostname match, expiry, etc. In
 		// particular, if the cached certificate has expired, create a new one.
-		if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{
-			DNSName: hostname,
-			Roots:   c.roots,
-		}); err == nil {
+		if c.valid(hostname, tlsc) {
 			return tlsc, nil
 		}
 
@@ -266,11 +331,58 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 
 	log.Debugf(context.TODO(), "mitm: cache miss for %s", hostname)
 
+	if c.storage != nil {
+		tlsc, err := c.storage.Load(hostname)
+		if err != nil {
+			log.Errorf(context.TODO(), "mitm: failed to load certificate for %s: %v", hostname, err)
+		}
+		if tlsc != nil && c.valid(hostname, tlsc) {
+			log.Debugf(context.TODO(), "mitm: loaded certificate for %s from storage", hostname)
+			c.certs.add(key, tlsc)
+			return tlsc, nil
+		}
+	}
+
+	tlsc, err := c.newCert(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	c.certs.add(key, tlsc)
+
+	if c.storage != nil {
+		if err := c.storage.Store(hostname, tlsc); err != nil {
+			log.Errorf(context.TODO(), "mitm: failed to store certificate for %s: %v", hostname, err)
+		}
+	}
+
+	return tlsc, nil
+}
+
+// cacheKey returns the key of the certificate in the cache, the cache may be shared by configs with different CAs.
+func (c *Config) cacheKey(hostname string) string {
+	return c.caID + "/" + hostname
+}
+
+func (c *Config) valid(hostname string, tlsc *tls.Certificate) bool {
+	if tlsc.Leaf == nil {
+		return false
+	}
+	_, err := tlsc.Leaf.Verify(x509.VerifyOptions{
+		DNSName:     hostname,
+		Roots:       c.roots,
+		CurrentTime: c.clock(),
+	})
+	return err == nil
+}
+
+func (c *Config) newCert(hostname string) (*tls.Certificate, error) {
 	serial, err := rand.Int(rand.Reader, MaxSerialNumber)
 	if err != nil {
 		return nil, err
 	}
 
+	now := c.clock()
 	tmpl := &x509.Certificate{
 		SerialNumber: serial,
 		Subject: pkix.Name{
@@ -278,11 +390,16 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 			Organization: []string{c.org},
 		},
 		SubjectKeyId:          c.keyID,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		NotBefore:             time.Now().Add(-c.validity),
-		NotAfter:              time.Now().Add(c.validity),
+		NotBefore:             now.Add(-c.validity),
+		NotAfter:              now.Add(c.validity),
+	}
+
+	// Only RSA keys are used for key encipherment.
+	if _, ok := c.priv.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
 
 	if ip := net.ParseIP(hostname); ip != nil {
@@ -302,15 +419,9 @@ func (c *Config) cert(hostname string) (*tls.Certificate, error) {
 		return nil, err
 	}
 
-	tlsc = &tls.Certificate{
+	return &tls.Certificate{
 		Certificate: [][]byte{raw, c.ca.Raw},
 		PrivateKey:  c.priv,
 		Leaf:        x509c,
-	}
-
-	c.certmu.Lock()
-	c.certs[hostname] = tlsc
-	c.certmu.Unlock()
-
-	return tlsc, nil
+	}, nil
 }
@@ -207,3 +207,104 @@ func TestCert(t *testing.T) {
 		t.Fatalf("x509c.IPAddresses: got %v, want %v", got, want)
 	}
 }
+
+func TestCertClock(t *testing.T) {
+	const exampleHostname = "example.com"
+
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+
+	now := time.Now().Add(-10 * time.Hour)
+	c.SetClock(func() time.Time { return now })
+
+	tlsc, err := c.cert(exampleHostname)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", exampleHostname, err)
+	}
+	if got, want := tlsc.Leaf.NotAfter, now.Add(time.Hour).Truncate(time.Second); !got.Equal(want) {
+		t.Errorf("x509c.NotAfter: got %v, want %v", got, want)
+	}
+	if _, err := tlsc.Leaf.Verify(x509.VerifyOptions{DNSName: exampleHostname, Roots: c.roots}); err == nil {
+		t.Error("x509c.Verify(): got no error, want expired certificate")
+	}
+
+	// Retrieve cached certificate.
+	tlsc2, err := c.cert(exampleHostname)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", exampleHostname, err)
+	}
+	if tlsc != tlsc2 {
+		t.Error("tlsc2: got new certificate, want cached certificate")
+	}
+
+	// Certificate expired according to the clock is regenerated.
+	now = now.Add(2 * time.Hour)
+	tlsc3, err := c.cert(exampleHostname)
+	if err != nil {
+		t.Fatalf("c.cert(%q): got %v, want no error", exampleHostname, err)
+	}
+	if tlsc3 == tlsc {
+		t.Error("tlsc3: got cached certificate, want new certificate")
+	}
+
+	if c.TLS().Time().Sub(now) != 0 {
+		t.Error("c.TLS().Time(): got system time, want clock time")
+	}
+}
+
+type memCertStorage map[string]*tls.Certificate
+
+func (s memCertStorage) Load(hostname string) (*tls.Certificate, error) {
+	return s[hostname], nil
+}
+
+func (s memCertStorage) Store(hostname string, cert *tls.Certificate) error {
+	s[hostname] = cert
+	return nil
+}
+
+func TestCertCache(t *testing.T) {
+	ca, priv, err := NewAuthority("martian.proxy", "Martian Authority", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewAuthority(): got %v, want no error", err)
+	}
+
+	c, err := NewConfig(ca, priv)
+	if err != nil {
+		t.Fatalf("NewConfig(): got %v, want no error", err)
+	}
+	c.SetCacheSize(1)
+	s := memCertStorage{}
+	c.SetCertStorage(s)
+
+	tlsc, err := c.cert("a.example.com")
+	if err != nil {
+		t.Fatalf("c.cert(): got %v, want no error", err)
+	}
+	if s["a.example.com"] != tlsc {
+		t.Error("storage: got no certificate, want stored certificate")
+	}
+	if _, err := c.cert("b.example.com"); err != nil {
+		t.Fatalf("c.cert(): got %v, want no error", err)
+	}
+	if _, ok := c.certs.get(c.cacheKey("a.example.com")); ok {
+		t.Error("c.certs: got a.example.com, want evicted")
+	}
+
+	// Evicted certificate is loaded from storage.
+	tlsc2, err := c.cert("a.example.com")
+	if err != nil {
+		t.Fatalf("c.cert(): got %v, want no error", err)
+	}
+	if tlsc != tlsc2 {
+		t.Error("tlsc2: got new certificate, want stored certificate")
+	}
+
+}
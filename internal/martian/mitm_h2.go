@@ -0,0 +1,78 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian/log"
+	"golang.org/x/net/http2"
+)
+
+type mitmH2Key struct{}
+
+// isMITMH2 returns true if the request context is from an HTTP/2 MITMed connection.
+func isMITMH2(ctx context.Context) bool {
+	v, _ := ctx.Value(mitmH2Key{}).(bool)
+	return v
+}
+
+// serveMITMH2 serves HTTP/2 requests from the MITMed connection.
+// Every stream is handled as a separate request, that goes through the modifiers and the round tripper.
+// Request and response bodies are streamed concurrently, and trailers are forwarded,
+// which is required by gRPC bidirectional streaming.
+//
+// The requests share the session of the CONNECT request,
+// they are sent upstream with HTTP/2 if the origin server supports it.
+func (p *Proxy) serveMITMH2(ctx *Context, req *http.Request, tlsconn *tls.Conn) error {
+	session := ctx.Session()
+	session.MarkSecure()
+
+	donec := make(chan struct{})
+	defer close(donec)
+	go func() {
+		select {
+		case <-p.closing:
+			tlsconn.Close()
+		case <-donec:
+		}
+	}()
+
+	h := proxyHandler{p}
+	srv := &http2.Server{}
+	srv.ServeConn(tlsconn, &http2.ServeConnOpts{
+		Context: context.WithValue(context.WithoutCancel(req.Context()), mitmH2Key{}, true),
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			h.serveMITM(withSession(session), rw, r, req.Host)
+		}),
+	})
+	log.Debugf(req.Context(), "mitm: h2 connection closed: %s", req.Host)
+
+	return errClose
+}
+
+func (p proxyHandler) serveMITM(ctx *Context, rw http.ResponseWriter, req *http.Request, host string) {
+	outreq := req.Clone(p.requestContext(ctx, req))
+	if req.ContentLength == 0 {
+		outreq.Body = http.NoBody
+	}
+	if outreq.Body != nil {
+		defer outreq.Body.Close()
+	}
+	outreq.Close = false
+
+	if outreq.URL.Host == "" {
+		outreq.URL.Host = req.Host
+	}
+	if outreq.URL.Host == "" {
+		outreq.URL.Host = host
+	}
+
+	p.handleRequest(ctx, rw, outreq)
+}
@@ -24,6 +24,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"reflect"
@@ -31,6 +32,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -122,6 +124,22 @@ type Proxy struct {
 	// If ConnectPassthrough is enabled, this is ignored.
 	ConnectRequestModifier func(*http.Request) error
 
+	// UpstreamAuthChallenge specifies a function to determine whether credentials of the upstream proxy
+	// are sent only after the proxy responds with 407 Proxy Authentication Required.
+	// In that case the request is retried once with the credentials.
+	// By default, credentials are sent preemptively.
+	UpstreamAuthChallenge func(proxyURL *url.URL) bool
+
+	// UpstreamTLSConfig specifies the TLS config used for connections to https upstream proxies.
+	// It allows to override SNI, ALPN and certificate verification of upstream proxies.
+	// By default, the round tripper TLS config is used with the proxy host as server name and http/1.1 as ALPN.
+	UpstreamTLSConfig *tls.Config
+
+	// UpgradeFilter, if set, is called for protocol upgrade tunnels e.g. WebSocket.
+	// It returns the readers used instead of the client (outbound) and upstream (inbound) streams,
+	// so that the tunneled traffic can be inspected and modified.
+	UpgradeFilter func(res *http.Response, outbound, inbound io.Reader) (io.Reader, io.Reader)
+
 	// MITMFilter specifies a function to determine whether a CONNECT request should be MITMed.
 	MITMFilter func(*http.Request) bool
 
@@ -159,6 +177,36 @@ type Proxy struct {
 	// CloseAfterReply closes the connection after the response has been sent.
 	CloseAfterReply bool
 
+	// ForwardInformational forwards 1xx informational responses e.g. 103 Early Hints
+	// received from upstream to HTTP/1.1 clients before the final response.
+	// 100 Continue and 101 Switching Protocols are not affected.
+	ForwardInformational bool
+
+	// RoundTripFunc, if set, is used to send requests with the proxy RoundTripper.
+	// It allows to send a request multiple times, for example to hedge slow requests.
+	RoundTripFunc func(rt http.RoundTripper, req *http.Request) (*http.Response, error)
+
+	// ConnectFunc, if set, is used to establish connections for CONNECT requests with the connect function.
+	// It allows to observe or retry connection attempts.
+	// If ConnectPassthrough is enabled, this is ignored.
+	ConnectFunc func(connect func(*http.Request) (*http.Response, net.Conn, error), req *http.Request) (*http.Response, net.Conn, error)
+
+	// RequestTimeout, if set, returns the timeout of sending the request upstream and reading the response, zero means no timeout.
+	// It is called after the request modifiers, requests that time out are answered with the ErrorResponse for context.DeadlineExceeded.
+	// CONNECT and upgrade requests are not limited.
+	RequestTimeout func(req *http.Request) time.Duration
+
+	// MaxInFlight is the maximum number of requests sent upstream at the same time.
+	// Requests above the limit wait in a queue until a request in flight finishes writing its response.
+	// CONNECT requests are not limited, requests in MITMed tunnels are.
+	// Zero means no limit.
+	MaxInFlight int
+
+	// InFlightQueueTimeout is the maximum duration a request waits in the MaxInFlight queue.
+	// Requests that time out are answered with the ErrorResponse for ErrQueueTimeout.
+	// Zero means requests wait until a slot is available or the request is canceled.
+	InFlightQueueTimeout time.Duration
+
 	roundTripper http.RoundTripper
 	dial         func(context.Context, string, string) (net.Conn, error)
 	mitm         *mitm.Config
@@ -167,6 +215,12 @@ type Proxy struct {
 	connsMu      sync.Mutex // protects conns.Add/Wait from concurrent access
 	closing      chan bool
 	closeOnce    sync.Once
+	draining     atomic.Bool
+	inFlight     chan struct{}
+	inFlightOnce sync.Once
+
+	// h2RoundTripper is a copy of roundTripper with HTTP/2 enabled, used for requests from HTTP/2 MITMed connections.
+	h2RoundTripper http.RoundTripper
 
 	reqmod RequestModifier
 	resmod ResponseModifier
@@ -205,8 +259,16 @@ func (p *Proxy) SetRoundTripper(rt http.RoundTripper) {
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
 		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
-		tr.Proxy = p.proxyURL
-		tr.DialContext = p.dial
+		tr.Proxy = p.transportProxy
+		tr.OnProxyConnectResponse = onProxyConnectResponse
+		tr.DialContext = p.transportDial
+
+		h2 := tr.Clone()
+		h2.TLSNextProto = nil
+		h2.ForceAttemptHTTP2 = true
+		p.h2RoundTripper = h2
+	} else {
+		p.h2RoundTripper = nil
 	}
 }
 
@@ -220,7 +282,7 @@ func (p *Proxy) SetUpstreamProxyFunc(f func(*http.Request) (*url.URL, error)) {
 	p.proxyURL = f
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.Proxy = f
+		tr.Proxy = p.transportProxy
 	}
 }
 
@@ -238,7 +300,7 @@ func (p *Proxy) SetDialContext(dial func(context.Context, string, string) (net.C
 	}
 
 	if tr, ok := p.roundTripper.(*http.Transport); ok {
-		tr.DialContext = p.dial
+		tr.DialContext = p.transportDial
 	}
 }
 
@@ -269,6 +331,19 @@ func (p *Proxy) Closing() bool {
 	}
 }
 
+// Drain sets the proxy to the draining state, connections are closed after the next response is sent.
+// Unlike Close, it does not wait for connections to close, and established tunnels are not closed.
+func (p *Proxy) Drain() {
+	if !p.draining.Swap(true) {
+		log.Infof(context.TODO(), "draining proxy")
+	}
+}
+
+// Draining returns whether the proxy is in the draining state.
+func (p *Proxy) Draining() bool {
+	return p.draining.Load()
+}
+
 // SetRequestModifier sets the request modifier.
 func (p *Proxy) SetRequestModifier(reqmod RequestModifier) {
 	if reqmod == nil {
@@ -325,7 +400,6 @@ func (p *Proxy) Serve(l net.Listener) error {
 			return err
 		}
 		delay = 0
-		log.Debugf(context.TODO(), "accepted connection from %s", conn.RemoteAddr())
 
 		if tconn, ok := conn.(*net.TCPConn); ok {
 			tconn.SetKeepAlive(true)
@@ -336,6 +410,13 @@ func (p *Proxy) Serve(l net.Listener) error {
 	}
 }
 
+// ServeConn handles the requests from the connection, it blocks until the connection is closed.
+// It allows serving connections that do not come from a listener, e.g. in-memory pipes.
+func (p *Proxy) ServeConn(conn net.Conn) {
+	nosigpipe.IgnoreSIGPIPE(conn)
+	p.handleLoop(conn)
+}
+
 func (p *Proxy) handleLoop(conn net.Conn) {
 	p.connsMu.Lock()
 	p.conns.Add(1)
@@ -346,11 +427,15 @@ func (p *Proxy) handleLoop(conn net.Conn) {
 		return
 	}
 
+	// Remote address may block, e.g. when it is read from the PROXY protocol header, so it is not logged on accept.
+	log.Debugf(context.TODO(), "accepted connection from %s", conn.RemoteAddr())
+
 	var (
 		brw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 		s   = newSession(conn, brw)
 		ctx = withSession(s)
 	)
+	defer s.close()
 
 	const maxConsecutiveErrors = 5
 	errorsN := 0
@@ -498,11 +583,21 @@ func (p *Proxy) handleMITM(ctx *Context, req *http.Request, session *Session, br
 	// 22 is the TLS handshake.
 	// https://tools.ietf.org/html/rfc5246#section-6.2.1
 	if len(b) > 0 && b[0] == 22 {
+		tlsCfg := p.mitm.TLSForHost(req.Host)
+
+		// Keep the ClientHello to report it with the negotiated connection state.
+		var hello *tls.ClientHelloInfo
+		getCertificate := tlsCfg.GetCertificate
+		tlsCfg.GetCertificate = func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			hello = chi
+			return getCertificate(chi)
+		}
+
 		// Prepend the previously read data to be read again by http.ReadRequest.
 		tlsconn := tls.Server(&peekedConn{
 			conn,
 			io.MultiReader(bytes.NewReader(buf), conn),
-		}, p.mitm.TLSForHost(req.Host))
+		}, tlsCfg)
 
 		if err := tlsconn.Handshake(); err != nil {
 			p.mitm.HandshakeErrorCallback(req, err)
@@ -516,9 +611,15 @@ func (p *Proxy) handleMITM(ctx *Context, req *http.Request, session *Session, br
 
 		cs := tlsconn.ConnectionState()
 		log.Debugf(req.Context(), "mitm: negotiated %s for connection: %s", cs.NegotiatedProtocol, req.Host)
+		if hello != nil {
+			p.mitm.HandshakeCallback(req, hello, cs)
+		}
 
 		if cs.NegotiatedProtocol == "h2" {
-			return p.mitm.H2Config().Proxy(p.closing, tlsconn, req.URL)
+			if h2c := p.mitm.H2Config(); h2c != nil {
+				return h2c.Proxy(p.closing, tlsconn, req.URL)
+			}
+			return p.serveMITMH2(ctx, req, tlsconn)
 		}
 
 		brw.Writer.Reset(tlsconn)
@@ -569,7 +670,11 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 		}
 	} else {
 		var cconn net.Conn
-		res, cconn, cerr = p.connect(req)
+		if p.ConnectFunc != nil {
+			res, cconn, cerr = p.ConnectFunc(p.connect, req)
+		} else {
+			res, cconn, cerr = p.connect(req)
+		}
 
 		if cconn != nil {
 			defer cconn.Close()
@@ -622,7 +727,7 @@ func (p *Proxy) handleConnectRequest(ctx *Context, req *http.Request, session *S
 
 	res.ContentLength = -1
 
-	if err := p.tunnel("CONNECT", res, brw, conn, cw, cr); err != nil {
+	if err := p.tunnel("CONNECT", res, brw, conn, cw, cr, nil); err != nil {
 		log.Errorf(req.Context(), "CONNECT tunnel: %w", err)
 	}
 
@@ -640,37 +745,66 @@ func (p *Proxy) handleUpgradeResponse(res *http.Response, brw *bufio.ReadWriter,
 
 	res.Body = nil
 
-	if err := p.tunnel(resUpType, res, brw, conn, uconn, uconn); err != nil {
+	if err := p.tunnel(resUpType, res, brw, conn, uconn, uconn, p.upgradeFilter(res)); err != nil {
 		log.Errorf(res.Request.Context(), "%s tunnel: %w", resUpType, err)
 	}
 
 	return errClose
 }
 
-func (p *Proxy) tunnel(name string, res *http.Response, brw *bufio.ReadWriter, conn net.Conn, cw io.Writer, cr io.Reader) error {
+type tunnelFilter func(outbound, inbound io.Reader) (io.Reader, io.Reader)
+
+func (p *Proxy) upgradeFilter(res *http.Response) tunnelFilter {
+	if p.UpgradeFilter == nil {
+		return nil
+	}
+	return func(outbound, inbound io.Reader) (io.Reader, io.Reader) {
+		return p.UpgradeFilter(res, outbound, inbound)
+	}
+}
+
+func (p *Proxy) tunnel(name string, res *http.Response, brw *bufio.ReadWriter, conn net.Conn, cw io.Writer, cr io.Reader, filter tunnelFilter) error {
 	if err := res.Write(brw); err != nil {
 		return fmt.Errorf("got error while writing response back to client: %w", err)
 	}
 	if err := brw.Flush(); err != nil {
 		return fmt.Errorf("got error while flushing response back to client: %w", err)
 	}
-	if err := drainBuffer(cw, brw.Reader); err != nil {
+
+	var or io.Reader = conn
+	if filter != nil {
+		// The buffered data must go through the filter, read it from the buffered reader.
+		or, cr = filter(brw.Reader, cr)
+	} else if err := drainBuffer(cw, brw.Reader); err != nil {
 		return fmt.Errorf("got error while draining read buffer: %w", err)
 	}
 
 	ctx := res.Request.Context()
-	donec := make(chan bool, 2)
-	go copySync(ctx, "outbound "+name, cw, conn, donec)
-	go copySync(ctx, "inbound "+name, conn, cr, donec)
+	donec := make(chan copyResult, 2)
+	go copySync(ctx, "outbound "+name, cw, or, true, donec)
+	go copySync(ctx, "inbound "+name, conn, cr, false, donec)
 
 	log.Debugf(ctx, "switched protocols, proxying %s traffic", name)
-	<-donec
-	<-donec
-	log.Debugf(ctx, "closed %s tunnel", name)
+	reason := waitTunnel(donec, p.closing, func() {
+		conn.Close()
+		// Other readers e.g. pipes are closed gracefully when the outbound copy finishes.
+		if c, ok := cr.(net.Conn); ok {
+			c.Close()
+		}
+	})
+	logTunnelClose(ctx, name, reason)
 
 	return nil
 }
 
+func logTunnelClose(ctx context.Context, name string, reason tunnelCloseReason) {
+	if reason.isEOF() {
+		log.Debugf(ctx, "closed %s tunnel: %s", name, reason)
+	} else {
+		log.Infof(ctx, "closed %s tunnel: %s", name, reason)
+	}
+}
+
 func drainBuffer(w io.Writer, r *bufio.Reader) error {
 	if n := r.Buffered(); n > 0 {
 		rbuf, err := r.Peek(n)
@@ -689,12 +823,15 @@ var copyBufPool = sync.Pool{
 	},
 }
 
-func copySync(ctx context.Context, name string, w io.Writer, r io.Reader, donec chan<- bool) {
+// copySync copies data from r to w and closes the write side of w, so that half-close is propagated to the peer.
+// Reading from the other direction continues until it is finished.
+func copySync(ctx context.Context, name string, w io.Writer, r io.Reader, outbound bool, donec chan<- copyResult) {
 	bufp := copyBufPool.Get().(*[]byte) //nolint:forcetypeassert // It's *[]byte.
 	buf := *bufp
 	defer copyBufPool.Put(bufp)
 
-	if _, err := io.CopyBuffer(w, r, buf); err != nil && !isClosedConnError(err) {
+	_, err := io.CopyBuffer(w, r, buf)
+	if err != nil && !isClosedConnError(err) && !errors.Is(err, net.ErrClosed) {
 		log.Errorf(ctx, "failed to copy %s tunnel: %v", name, err)
 	}
 	if cw, ok := asCloseWriter(w); ok {
@@ -706,7 +843,7 @@ func copySync(ctx context.Context, name string, w io.Writer, r io.Reader, donec
 	}
 
 	log.Debugf(ctx, "%s tunnel finished copying", name)
-	donec <- true
+	donec <- copyResult{outbound: outbound, err: err}
 }
 
 func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error {
@@ -758,10 +895,17 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		}
 	}
 
+	var iw *informationalWriter
+	if p.ForwardInformational && req.ProtoAtLeast(1, 1) {
+		iw = &informationalWriter{w: brw.Writer}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), iw.clientTrace()))
+	}
+
 	reqUpType := upgradeType(req.Header)
 	if reqUpType != "" {
 		log.Debugf(req.Context(), "upgrade request: %s", reqUpType)
 	}
+	reqTrailers := acceptsTrailers(req.Header)
 	if err := p.reqmod.ModifyRequest(req); err != nil {
 		log.Errorf(req.Context(), "error modifying request: %v", err)
 		p.warning(req.Header, err)
@@ -772,14 +916,23 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	}
 
 	// after stripping all the hop-by-hop connection headers above, add back any
-	// necessary for protocol upgrades, such as for websockets.
+	// necessary for protocol upgrades, such as for websockets, and for trailers.
 	if reqUpType != "" {
 		req.Header.Set("Connection", "Upgrade")
 		req.Header.Set("Upgrade", reqUpType)
 	}
+	if reqTrailers {
+		req.Header.Set("Te", "trailers")
+	}
 
 	// perform the HTTP roundtrip
-	res, err := p.roundTrip(ctx, req)
+	release, err := p.waitInFlight(req)
+	defer release()
+	var res *http.Response
+	if err == nil {
+		res, err = p.roundTrip(ctx, req)
+	}
+	iw.stop()
 	if err != nil {
 		log.Errorf(req.Context(), "failed to round trip: %v", err)
 		res = p.errorResponse(req, err)
@@ -812,11 +965,18 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 	}
 
 	var closing error
-	if !req.ProtoAtLeast(1, 1) || req.Close || res.Close || p.Closing() {
+	if !req.ProtoAtLeast(1, 1) || req.Close || res.Close || p.Closing() || p.Draining() {
 		log.Debugf(req.Context(), "received close request: %v", req.RemoteAddr)
 		res.Close = true
 		closing = errClose
 	}
+	if p.Closing() || p.Draining() {
+		// Some clients of HTTP/1.0 proxies only look at the non-standard Proxy-Connection header.
+		if res.Header == nil {
+			res.Header = make(http.Header)
+		}
+		res.Header.Set("Proxy-Connection", "close")
+	}
 
 	// deal with 101 Switching Protocols responses: (WebSocket, h2c, etc)
 	if res.StatusCode == http.StatusSwitchingProtocols {
@@ -835,20 +995,19 @@ func (p *Proxy) handle(ctx *Context, conn net.Conn, brw *bufio.ReadWriter) error
 		// This works around the issue by writing the response manually.
 		err = writeHeadResponse(brw.Writer, res)
 	} else {
-		// Add support for Server Sent Events - relay HTTP chunks and flush after each chunk.
-		// This is safe for events that are smaller than the buffer io.Copy uses (32KB).
-		// If the event is larger than the buffer, the event will be split into multiple chunks.
-		if shouldFlush(res) {
-			err = res.Write(flushAfterChunkWriter{brw.Writer})
+		// Add support for Server Sent Events and other streaming responses - relay data as soon as it is read.
+		// The buffer is flushed before waiting for more data, so that latency does not depend on the buffer size.
+		if shouldFlush(res) && res.Body != nil && res.Body != http.NoBody {
+			res.Body = flushBeforeReadBody{res.Body, brw.Writer}
+			err = res.Write(writerOnly{brw})
 		} else {
 			err = res.Write(brw)
 		}
 	}
 	if err != nil {
 		log.Errorf(req.Context(), "got error while writing response back to client: %v", err)
-		if errors.Is(err, io.ErrUnexpectedEOF) {
-			closing = errClose
-		}
+		// The response may be partially written, the connection cannot be reused.
+		closing = errClose
 	}
 	err = brw.Flush()
 	if err != nil {
@@ -879,7 +1038,22 @@ func (p *Proxy) roundTrip(ctx *Context, req *http.Request) (*http.Response, erro
 		return proxyutil.NewResponse(200, http.NoBody, req), nil
 	}
 
-	return p.roundTripper.RoundTrip(req)
+	return p.roundTripTimeout(req, func(req *http.Request) (*http.Response, error) {
+		return p.roundTripUpstreamAuth(req, func(req *http.Request) (*http.Response, error) {
+			return p.roundTripUpstreamTLS(req, func(req *http.Request) (*http.Response, error) {
+				rt := p.roundTripper
+				if p.h2RoundTripper != nil && isMITMH2(req.Context()) {
+					rt = p.h2RoundTripper
+				}
+
+				if p.RoundTripFunc != nil {
+					return p.RoundTripFunc(rt, req)
+				}
+
+				return rt.RoundTrip(req)
+			})
+		})
+	})
 }
 
 func (p *Proxy) warning(h http.Header, err error) {
@@ -930,14 +1104,28 @@ func (p *Proxy) connect(req *http.Request) (*http.Response, net.Conn, error) {
 func (p *Proxy) connectHTTP(req *http.Request, proxyURL *url.URL) (res *http.Response, conn net.Conn, err error) {
 	log.Debugf(req.Context(), "CONNECT with upstream HTTP proxy: %s", proxyURL.Host)
 
-	var d *dialvia.HTTPProxyDialer
-	if proxyURL.Scheme == "https" {
-		d = dialvia.HTTPSProxy(p.dial, proxyURL, p.clientTLSConfig())
+	dial := func(proxyURL *url.URL) (*http.Response, net.Conn, error) {
+		var d *dialvia.HTTPProxyDialer
+		if proxyURL.Scheme == "https" {
+			d = dialvia.HTTPSProxy(p.dial, proxyURL, p.upstreamTLSConfig())
+		} else {
+			d = dialvia.HTTPProxy(p.dial, proxyURL)
+		}
+		d.ConnectRequestModifier = p.ConnectRequestModifier
+		return d.DialContextR(req.Context(), "tcp", req.URL.Host)
+	}
+
+	if p.upstreamAuthChallenge(proxyURL) {
+		res, conn, err = dial(withoutUser(proxyURL))
+		if res != nil && res.StatusCode == http.StatusProxyAuthRequired {
+			log.Debugf(req.Context(), "upstream proxy %s requires authentication, retrying with credentials", proxyURL.Redacted())
+			res.Body.Close()
+			conn.Close()
+			res, conn, err = dial(proxyURL)
+		}
 	} else {
-		d = dialvia.HTTPProxy(p.dial, proxyURL)
+		res, conn, err = dial(proxyURL)
 	}
-	d.ConnectRequestModifier = p.ConnectRequestModifier
-	res, conn, err = d.DialContextR(req.Context(), "tcp", req.URL.Host)
 
 	if res != nil {
 		if res.StatusCode/100 == 2 {
@@ -980,3 +1168,8 @@ func upgradeType(h http.Header) string {
 	}
 	return h.Get("Upgrade")
 }
+
+// acceptsTrailers returns true if the TE header contains the "trailers" token, it is required by gRPC.
+func acceptsTrailers(h http.Header) bool {
+	return httpguts.HeaderValuesContainsToken(h["Te"], "trailers")
+}
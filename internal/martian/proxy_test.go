@@ -26,9 +26,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -1920,3 +1922,552 @@ func TestConnectRequestModifier(t *testing.T) {
 		t.Errorf("res.StatusCode: got %d, want %d", got, want)
 	}
 }
+
+func TestIntegrationServeConn(t *testing.T) {
+	t.Parallel()
+
+	p := NewProxy()
+	defer p.Close()
+
+	tr := martiantest.NewTransport()
+	p.SetRoundTripper(tr)
+	p.SetTimeout(200 * time.Millisecond)
+
+	conn, pconn := net.Pipe()
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		p.ServeConn(pconn)
+		close(done)
+	}()
+
+	br := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		res.Body.Close()
+
+		if got, want := res.StatusCode, 200; got != want {
+			t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+		}
+	}
+
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ServeConn(): did not return after connection was closed")
+	}
+}
+
+func TestIntegrationForwardInformational(t *testing.T) {
+	t.Parallel()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+
+	for _, forward := range []bool{true, false} {
+		t.Run(fmt.Sprintf("forward=%t", forward), func(t *testing.T) {
+			p := NewProxy()
+			defer p.Close()
+			p.ForwardInformational = forward
+
+			conn, pconn := net.Pipe()
+			defer conn.Close()
+			go p.ServeConn(pconn)
+
+			req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+			if err != nil {
+				t.Fatalf("http.NewRequest(): got %v, want no error", err)
+			}
+			if err := req.WriteProxy(conn); err != nil {
+				t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+			}
+
+			br := bufio.NewReader(conn)
+			if forward {
+				res, err := http.ReadResponse(br, req)
+				if err != nil {
+					t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+				}
+				res.Body.Close()
+				if got, want := res.StatusCode, http.StatusEarlyHints; got != want {
+					t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+				}
+				if got, want := res.Header.Get("Link"), "</style.css>; rel=preload; as=style"; got != want {
+					t.Fatalf("res.Header.Get(%q): got %q, want %q", "Link", got, want)
+				}
+			}
+
+			res, err := http.ReadResponse(br, req)
+			if err != nil {
+				t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+			}
+			defer res.Body.Close()
+			if got, want := res.StatusCode, http.StatusOK; got != want {
+				t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+			}
+			if got := res.Header.Get("Link"); got != "" {
+				t.Fatalf("res.Header.Get(%q): got %q, want empty", "Link", got)
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("io.ReadAll(): got %v, want no error", err)
+			}
+			if got, want := string(b), "ok"; got != want {
+				t.Fatalf("res.Body: got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestIntegrationConnectHalfClose(t *testing.T) {
+	t.Parallel()
+
+	l := newListener(t)
+	p := NewProxy()
+	defer p.Close()
+
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ol.Close()
+
+	// Origin replies after the client finished sending.
+	go func() {
+		conn, err := ol.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		conn.Write(append([]byte("echo:"), b...))
+	}()
+
+	go serve(p, l)
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+	cw, ok := asCloseWriter(conn)
+	if !ok {
+		t.Skipf("%T does not support half-close", conn)
+	}
+
+	req, err := http.NewRequest(http.MethodConnect, "//"+ol.Addr().String(), http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("conn.Write(): got %v, want no error", err)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("conn.CloseWrite(): got %v, want no error", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(br)
+	if err != nil {
+		t.Fatalf("io.ReadAll(): got %v, want no error", err)
+	}
+	if got, want := string(b), "echo:hello"; got != want {
+		t.Fatalf("tunnel response: got %q, want %q", got, want)
+	}
+}
+
+func TestIntegrationConnectForcedClose(t *testing.T) {
+	t.Parallel()
+
+	l := newListener(t)
+	p := NewProxy()
+
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ol.Close()
+
+	// Origin keeps the connection open.
+	go func() {
+		conn, err := ol.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	}()
+
+	go serve(p, l)
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "//"+ol.Addr().String(), http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("req.Write(): got %v, want no error", err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 200; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("p.Close(): did not return with open tunnel")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(br); err != nil && !isClosedConnError(err) {
+		t.Fatalf("io.ReadAll(): got %v, want connection closed", err)
+	}
+}
+
+func TestIntegrationHandlerUpgradeForcedClose(t *testing.T) {
+	t.Parallel()
+
+	l := newListener(t)
+	p := NewProxy()
+	if *withTLS {
+		p.AllowHTTP = true
+	}
+	// Wrap the readers so that the upstream reader is no longer a net.Conn.
+	p.UpgradeFilter = func(_ *http.Response, outbound, inbound io.Reader) (io.Reader, io.Reader) {
+		return struct{ io.Reader }{outbound}, struct{ io.Reader }{inbound}
+	}
+
+	ol, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen(): got %v, want no error", err)
+	}
+	defer ol.Close()
+
+	// Origin switches protocols and keeps the connection open.
+	originClosed := make(chan struct{})
+	go func() {
+		defer close(originClosed)
+		conn, err := ol.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		res := proxyutil.NewResponse(101, nil, req)
+		res.Header.Set("Connection", "upgrade")
+		res.Header.Set("Upgrade", upgradeType(req.Header))
+		res.Write(conn)
+		io.Copy(io.Discard, conn)
+	}()
+
+	s := http.Server{
+		Handler: p.Handler(),
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+ol.Addr().String(), http.NoBody)
+	if err != nil {
+		t.Fatalf("http.NewRequest(): got %v, want no error", err)
+	}
+	req.Header.Set("Connection", "upgrade")
+	req.Header.Set("Upgrade", "binary")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+	}
+	if got, want := res.StatusCode, 101; got != want {
+		t.Fatalf("res.StatusCode: got %d, want %d", got, want)
+	}
+
+	p.Close()
+
+	select {
+	case <-originClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("p.Close(): upstream connection not closed")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(br); err != nil && !isClosedConnError(err) {
+		t.Fatalf("io.ReadAll(): got %v, want connection closed", err)
+	}
+}
+
+func TestIntegrationDrain(t *testing.T) {
+	t.Parallel()
+
+	l := newListener(t)
+	p := NewProxy()
+	defer p.Close()
+
+	tr := martiantest.NewTransport()
+	p.SetRoundTripper(tr)
+	p.SetTimeout(200 * time.Millisecond)
+
+	go serve(p, l)
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("net.Dial(): got %v, want no error", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	get := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		if err != nil {
+			t.Fatalf("http.NewRequest(): got %v, want no error", err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatalf("req.WriteProxy(): got %v, want no error", err)
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatalf("http.ReadResponse(): got %v, want no error", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res
+	}
+
+	if res := get(); res.Close {
+		t.Fatal("res.Close: got true, want false")
+	}
+
+	p.Drain()
+	if !p.Draining() {
+		t.Fatal("p.Draining(): got false, want true")
+	}
+
+	if res := get(); !res.Close {
+		t.Fatal("res.Close: got false, want true")
+	} else if got := res.Header.Get("Proxy-Connection"); got != "close" {
+		t.Fatalf("res.Header.Get(Proxy-Connection): got %q, want close", got)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := br.ReadByte(); !errors.Is(err, io.EOF) && !isClosedConnError(err) {
+		t.Fatalf("br.ReadByte(): got %v, want connection closed", err)
+	}
+}
+
+func TestIntegrationMaxInFlight(t *testing.T) {
+	t.Parallel()
+
+	p := NewProxy()
+	defer p.Close()
+	p.MaxInFlight = 1
+	p.InFlightQueueTimeout = 100 * time.Millisecond
+	p.ErrorResponse = func(req *http.Request, err error) *http.Response {
+		if errors.Is(err, ErrQueueTimeout) {
+			return proxyutil.NewResponse(http.StatusServiceUnavailable, http.NoBody, req)
+		}
+		return proxyutil.NewResponse(http.StatusBadGateway, http.NoBody, req)
+	}
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	p.RoundTripFunc = func(_ http.RoundTripper, req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/block" {
+			close(started)
+			<-unblock
+		}
+		return proxyutil.NewResponse(http.StatusOK, http.NoBody, req), nil
+	}
+
+	do := func(path string) (int, error) {
+		conn, pconn := net.Pipe()
+		defer conn.Close()
+		go p.ServeConn(pconn)
+
+		req, err := http.NewRequest(http.MethodGet, "http://example.com"+path, http.NoBody)
+		if err != nil {
+			return 0, err
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			return 0, err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	type result struct {
+		code int
+		err  error
+	}
+	blocked := make(chan result, 1)
+	go func() {
+		code, err := do("/block")
+		blocked <- result{code, err}
+	}()
+	<-started
+
+	code, err := do("/")
+	if err != nil {
+		t.Fatalf("queued request: got %v, want no error", err)
+	}
+	if want := http.StatusServiceUnavailable; code != want {
+		t.Fatalf("queued request: got status %d, want %d", code, want)
+	}
+
+	close(unblock)
+	r := <-blocked
+	if r.err != nil {
+		t.Fatalf("blocked request: got %v, want no error", r.err)
+	}
+	if want := http.StatusOK; r.code != want {
+		t.Fatalf("blocked request: got status %d, want %d", r.code, want)
+	}
+
+	code, err = do("/")
+	if err != nil {
+		t.Fatalf("request after release: got %v, want no error", err)
+	}
+	if want := http.StatusOK; code != want {
+		t.Fatalf("request after release: got status %d, want %d", code, want)
+	}
+}
+
+func TestIntegrationUpstreamAuthChallenge(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Proxy-Authorization")
+		mu.Lock()
+		seen = append(seen, req.Method+" "+auth)
+		mu.Unlock()
+		if auth == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	for _, challenge := range []bool{false, true} {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+
+		p := NewProxy()
+		p.SetUpstreamProxy(&url.URL{
+			Scheme: "http",
+			Host:   upstream.Listener.Addr().String(),
+			User:   url.UserPassword("user", "pass"),
+		})
+		p.UpstreamAuthChallenge = func(*url.URL) bool {
+			return challenge
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodConnect} {
+			conn, pconn := net.Pipe()
+			go p.ServeConn(pconn)
+
+			req, err := http.NewRequest(method, "http://example.com:80/", http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := req.WriteProxy(conn); err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			conn.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("challenge=%t %s: got status %d, want %d", challenge, method, res.StatusCode, http.StatusOK)
+			}
+		}
+		p.Close()
+
+		auth := "Basic dXNlcjpwYXNz"
+		want := []string{"GET " + auth, "CONNECT " + auth}
+		if challenge {
+			want = []string{"GET ", "GET " + auth, "CONNECT ", "CONNECT " + auth}
+		}
+		mu.Lock()
+		got := strings.Join(seen, ",")
+		mu.Unlock()
+		if got != strings.Join(want, ",") {
+			t.Fatalf("challenge=%t: got upstream requests %q, want %q", challenge, got, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"context"
+	"io"
+	"net/http"
+)
+
+// cancelBody cancels the request context when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// roundTripTimeout sends the request with the RequestTimeout deadline.
+// The deadline applies until the response body is closed, upgrade requests are not limited.
+func (p *Proxy) roundTripTimeout(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p.RequestTimeout == nil || req.Method == http.MethodConnect || upgradeType(req.Header) != "" {
+		return rt(req)
+	}
+	d := p.RequestTimeout(req)
+	if d <= 0 {
+		return rt(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), d)
+	res, err := rt(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return fixResponseRequest(res, req), err
+	}
+	res.Body = &cancelBody{res.Body, cancel}
+	return fixResponseRequest(res, req), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// tunnelCloseReason describes which event initiated closing of a tunnel.
+type tunnelCloseReason string
+
+const (
+	tunnelClientEOF tunnelCloseReason = "client EOF"
+	tunnelOriginEOF tunnelCloseReason = "origin EOF"
+	tunnelTimeout   tunnelCloseReason = "timeout"
+	tunnelForced    tunnelCloseReason = "forced"
+	tunnelError     tunnelCloseReason = "error"
+)
+
+// isEOF returns true if the tunnel was closed gracefully by one of the peers.
+func (r tunnelCloseReason) isEOF() bool {
+	return r == tunnelClientEOF || r == tunnelOriginEOF
+}
+
+// copyResult is the result of copying one direction of a tunnel.
+// Outbound direction copies data from the client to the origin.
+type copyResult struct {
+	outbound bool
+	err      error
+}
+
+func (r copyResult) closeReason() tunnelCloseReason {
+	if r.err == nil {
+		if r.outbound {
+			return tunnelClientEOF
+		}
+		return tunnelOriginEOF
+	}
+
+	var ne net.Error
+	if errors.As(r.err, &ne) && ne.Timeout() {
+		return tunnelTimeout
+	}
+	if errors.Is(r.err, net.ErrClosed) || errors.Is(r.err, io.ErrClosedPipe) {
+		return tunnelForced
+	}
+	return tunnelError
+}
+
+// waitTunnel waits for both directions of the tunnel to finish and returns the reason of the close.
+// If closing is closed before the tunnel finishes, force is called to close the connections.
+func waitTunnel(donec <-chan copyResult, closing <-chan bool, force func()) tunnelCloseReason {
+	var reason tunnelCloseReason
+	for n := 0; n < 2; {
+		select {
+		case r := <-donec:
+			n++
+			if reason == "" {
+				reason = r.closeReason()
+			}
+		case <-closing:
+			closing = nil
+			if reason == "" {
+				reason = tunnelForced
+			}
+			force()
+		}
+	}
+	return reason
+}
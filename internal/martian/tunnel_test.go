@@ -0,0 +1,71 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestCopyResultCloseReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		result copyResult
+		want   tunnelCloseReason
+	}{
+		{name: "client EOF", result: copyResult{outbound: true}, want: tunnelClientEOF},
+		{name: "origin EOF", result: copyResult{outbound: false}, want: tunnelOriginEOF},
+		{name: "timeout", result: copyResult{err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}}, want: tunnelTimeout},
+		{name: "closed", result: copyResult{err: fmt.Errorf("read: %w", net.ErrClosed)}, want: tunnelForced},
+		{name: "closed pipe", result: copyResult{err: io.ErrClosedPipe}, want: tunnelForced},
+		{name: "error", result: copyResult{err: errors.New("connection reset by peer")}, want: tunnelError},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.result.closeReason(); got != tc.want {
+				t.Fatalf("closeReason(): got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWaitTunnel(t *testing.T) {
+	t.Run("first result wins", func(t *testing.T) {
+		donec := make(chan copyResult, 2)
+		donec <- copyResult{outbound: false}
+		donec <- copyResult{outbound: true, err: net.ErrClosed}
+
+		if got := waitTunnel(donec, nil, func() { t.Fatal("unexpected force") }); got != tunnelOriginEOF {
+			t.Fatalf("waitTunnel(): got %q, want %q", got, tunnelOriginEOF)
+		}
+	})
+
+	t.Run("forced", func(t *testing.T) {
+		donec := make(chan copyResult, 2)
+		closing := make(chan bool)
+		close(closing)
+
+		var forced int
+		got := waitTunnel(donec, closing, func() {
+			forced++
+			donec <- copyResult{outbound: true, err: net.ErrClosed}
+			donec <- copyResult{outbound: false, err: net.ErrClosed}
+		})
+		if got != tunnelForced {
+			t.Fatalf("waitTunnel(): got %q, want %q", got, tunnelForced)
+		}
+		if forced != 1 {
+			t.Fatalf("force called %d times, want 1", forced)
+		}
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/internal/martian/log"
+)
+
+type upstreamAuthKey struct{}
+
+// upstreamAuthState tracks a request sent to an upstream proxy that requires the authentication challenge.
+type upstreamAuthState struct {
+	// proxyURL is the upstream proxy URL with credentials, it is set if the credentials were withheld.
+	proxyURL *url.URL
+	// challenged is set if the upstream proxy responded to CONNECT with 407 Proxy Authentication Required.
+	challenged bool
+	// retry is set when the request is resent with credentials.
+	retry bool
+}
+
+func upstreamAuthFromContext(ctx context.Context) *upstreamAuthState {
+	s, _ := ctx.Value(upstreamAuthKey{}).(*upstreamAuthState)
+	return s
+}
+
+func (p *Proxy) upstreamAuthChallenge(proxyURL *url.URL) bool {
+	return proxyURL != nil && proxyURL.User != nil && p.UpstreamAuthChallenge != nil && p.UpstreamAuthChallenge(proxyURL)
+}
+
+func withoutUser(u *url.URL) *url.URL {
+	uu := *u
+	uu.User = nil
+	return &uu
+}
+
+// transportProxy is the http.Transport proxy function, it withholds credentials of upstream proxies
+// that require the authentication challenge until the request is retried.
+func (p *Proxy) transportProxy(req *http.Request) (*url.URL, error) {
+	if p.proxyURL == nil {
+		return nil, nil //nolint:nilnil // nil means no proxy
+	}
+
+	s := upstreamAuthFromContext(req.Context())
+	if s != nil && s.retry {
+		return p.transportUpstreamTLS(req, s.proxyURL), nil
+	}
+
+	u, err := p.proxyURL(req)
+	if err != nil || s == nil || !p.upstreamAuthChallenge(u) {
+		return p.transportUpstreamTLS(req, u), err
+	}
+
+	s.proxyURL = u
+	return p.transportUpstreamTLS(req, withoutUser(u)), nil
+}
+
+// onProxyConnectResponse records 407 responses to CONNECT requests sent by http.Transport for HTTPS requests,
+// in that case the transport returns an error instead of the response.
+func onProxyConnectResponse(ctx context.Context, _ *url.URL, _ *http.Request, res *http.Response) error {
+	if s := upstreamAuthFromContext(ctx); s != nil && res.StatusCode == http.StatusProxyAuthRequired {
+		s.challenged = true
+	}
+	return nil
+}
+
+// roundTripUpstreamAuth sends the request, if the upstream proxy requires the authentication challenge
+// and responds with 407 Proxy Authentication Required, the request is retried once with credentials.
+// Requests with a body that cannot be replayed are not retried, the 407 response is returned.
+func (p *Proxy) roundTripUpstreamAuth(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p.UpstreamAuthChallenge == nil {
+		return rt(req)
+	}
+
+	s := new(upstreamAuthState)
+	r := req.WithContext(context.WithValue(req.Context(), upstreamAuthKey{}, s))
+
+	res, err := rt(r)
+	if s.proxyURL == nil {
+		return fixResponseRequest(res, req), err
+	}
+	if !s.challenged && (err != nil || res.StatusCode != http.StatusProxyAuthRequired) {
+		return fixResponseRequest(res, req), err
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.GetBody == nil {
+			log.Debugf(req.Context(), "upstream proxy %s requires authentication, cannot retry request with body", s.proxyURL.Redacted())
+			return fixResponseRequest(res, req), err
+		}
+		body, berr := r.GetBody()
+		if berr != nil {
+			return fixResponseRequest(res, req), err
+		}
+		r.Body = body
+	}
+	if res != nil {
+		res.Body.Close()
+	}
+
+	log.Debugf(req.Context(), "upstream proxy %s requires authentication, retrying with credentials", s.proxyURL.Redacted())
+	s.retry = true
+	res, err = rt(r)
+	return fixResponseRequest(res, req), err
+}
+
+func fixResponseRequest(res *http.Response, req *http.Request) *http.Response {
+	if res != nil {
+		res.Request = req
+	}
+	return res
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package martian
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// upstreamTLSConfig returns the TLS config for CONNECT requests to https upstream proxies.
+func (p *Proxy) upstreamTLSConfig() *tls.Config {
+	if p.UpstreamTLSConfig != nil {
+		return p.UpstreamTLSConfig.Clone()
+	}
+
+	cfg := p.clientTLSConfig()
+	// http.Transport adds h2 to the config on first use.
+	cfg.NextProtos = nil
+	return cfg
+}
+
+type upstreamTLSKey struct{}
+
+// upstreamTLSState holds the addresses of https upstream proxies rewritten by transportUpstreamTLS for a request.
+// The transport dials with a context carrying the values of the request context,
+// so that transportDial wraps connections to these proxies only, and not direct connections to the same address.
+type upstreamTLSState struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func upstreamTLSFromContext(ctx context.Context) *upstreamTLSState {
+	s, _ := ctx.Value(upstreamTLSKey{}).(*upstreamTLSState)
+	return s
+}
+
+func (s *upstreamTLSState) add(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.addrs, addr) {
+		s.addrs = append(s.addrs, addr)
+	}
+}
+
+func (s *upstreamTLSState) has(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Contains(s.addrs, addr)
+}
+
+// roundTripUpstreamTLS adds the upstreamTLSState to the request context, if UpstreamTLSConfig is set.
+func (p *Proxy) roundTripUpstreamTLS(req *http.Request, rt func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if p.UpstreamTLSConfig == nil {
+		return rt(req)
+	}
+
+	r := req.WithContext(context.WithValue(req.Context(), upstreamTLSKey{}, new(upstreamTLSState)))
+	res, err := rt(r)
+	return fixResponseRequest(res, req), err
+}
+
+// transportUpstreamTLS makes http.Transport use UpstreamTLSConfig for https upstream proxies.
+// The transport establishes TLS connections to https proxies with its own TLS config,
+// so the proxy URL is rewritten to http, and the TLS connection is established by transportDial.
+func (p *Proxy) transportUpstreamTLS(req *http.Request, u *url.URL) *url.URL {
+	if p.UpstreamTLSConfig == nil || u == nil || u.Scheme != "https" {
+		return u
+	}
+	s := upstreamTLSFromContext(req.Context())
+	if s == nil {
+		return u
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	uu := *u
+	uu.Scheme = "http"
+	uu.Host = net.JoinHostPort(u.Hostname(), port)
+	s.add(uu.Host)
+
+	return &uu
+}
+
+// transportDial is the http.Transport dial function, it establishes TLS connections to https upstream proxies
+// rewritten by transportUpstreamTLS for the request.
+func (p *Proxy) transportDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil || p.UpstreamTLSConfig == nil {
+		return conn, err
+	}
+	if s := upstreamTLSFromContext(ctx); s == nil || !s.has(addr) {
+		return conn, nil
+	}
+
+	cfg := p.UpstreamTLSConfig.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultQueryLimit = 100
+
+// Handler returns a handler that serves Query results as JSON.
+// The query parameters are:
+//   - from and to: RFC 3339 time or duration before now e.g. 15m,
+//   - host: host name,
+//   - user: authenticated user,
+//   - status: status code e.g. 404, or class e.g. 5xx,
+//   - limit: maximal number of entries, defaults to 100.
+func (j *Journal) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := j.Query(q)
+		if res == nil {
+			res = []Entry{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(res) //nolint:errcheck // best effort
+	})
+}
+
+func parseQuery(v url.Values, now time.Time) (Query, error) {
+	q := Query{
+		Host:  v.Get("host"),
+		User:  v.Get("user"),
+		Limit: defaultQueryLimit,
+	}
+
+	var err error
+	if q.From, err = parseTime(v.Get("from"), now); err != nil {
+		return q, fmt.Errorf("from: %w", err)
+	}
+	if q.To, err = parseTime(v.Get("to"), now); err != nil {
+		return q, fmt.Errorf("to: %w", err)
+	}
+
+	if s := v.Get("status"); s != "" {
+		if q.MinStatus, q.MaxStatus, err = parseStatus(s); err != nil {
+			return q, fmt.Errorf("status: %w", err)
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, fmt.Errorf("limit: invalid value %q", s)
+		}
+	}
+
+	return q, nil
+}
+
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseStatus(s string) (minStatus, maxStatus int, err error) {
+	if c, ok := strings.CutSuffix(strings.ToLower(s), "xx"); ok {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 || n > 5 {
+			return 0, 0, fmt.Errorf("invalid status class %q", s)
+		}
+		return n * 100, n*100 + 99, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 100 || n > 599 {
+		return 0, 0, fmt.Errorf("invalid status %q", s)
+	}
+	return n, n, nil
+}
@@ -0,0 +1,315 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package journal provides a persistent store of request summaries.
+package journal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Entry is a summary of a proxied request, request and response bodies are not recorded.
+type Entry struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Client   string        `json:"client,omitempty"`
+	User     string        `json:"user,omitempty"`
+	Method   string        `json:"method"`
+	Host     string        `json:"host"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+
+	// Annotations are the diagnostics attached to the request, see middleware.Annotate.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Config struct {
+	// File is the path of the journal file, entries are stored one JSON object per line.
+	File string
+
+	// Retention is the time after which entries are removed.
+	Retention time.Duration
+
+	// MaxEntries is the maximal number of entries kept, the oldest entries are removed first.
+	MaxEntries int
+
+	// CompactInterval is the time between removals of expired entries from the file.
+	CompactInterval time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Retention:       24 * time.Hour,
+		MaxEntries:      100000,
+		CompactInterval: time.Minute,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.File == "" {
+		return errors.New("file is required")
+	}
+	if c.Retention <= 0 {
+		return errors.New("retention must be positive")
+	}
+	if c.MaxEntries <= 0 {
+		return errors.New("max entries must be positive")
+	}
+	if c.CompactInterval <= 0 {
+		return errors.New("compact interval must be positive")
+	}
+	return nil
+}
+
+// Journal keeps request summaries in memory for querying and appends them to a file,
+// so that they survive restarts.
+type Journal struct {
+	config Config
+	log    log.Logger
+
+	mu      sync.Mutex
+	entries []Entry
+	f       *os.File
+	// stale is the number of entries in the file that were removed from memory.
+	stale int
+}
+
+// New opens the journal file and loads the entries within the retention period.
+func New(cfg *Config, log log.Logger) (*Journal, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		config: *cfg,
+		log:    log,
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.compactLocked(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	f, err := os.Open(j.config.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var invalid int
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			invalid++
+			continue
+		}
+		j.entries = append(j.entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", j.config.File, err)
+	}
+	if invalid > 0 {
+		j.log.Infof("skipped %d invalid entries in %s", invalid, j.config.File)
+	}
+	j.stale = invalid
+	j.log.Infof("loaded %d entries from %s", len(j.entries), j.config.File)
+
+	return nil
+}
+
+// Record adds the entry to the journal.
+func (j *Journal) Record(e Entry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		j.log.Errorf("marshal entry: %s", err)
+		return
+	}
+	b = append(b, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = append(j.entries, e)
+	if len(j.entries) > j.config.MaxEntries {
+		j.entries = j.entries[1:]
+		j.stale++
+	}
+	if j.f == nil {
+		return
+	}
+	if _, err := j.f.Write(b); err != nil {
+		j.log.Errorf("write entry: %s", err)
+	}
+}
+
+// Run removes expired entries from the file every compact interval until the context is canceled,
+// then closes the file.
+func (j *Journal) Run(ctx context.Context) error {
+	t := time.NewTicker(j.config.CompactInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return j.Close()
+		case now := <-t.C:
+			j.mu.Lock()
+			err := j.compactLocked(now)
+			j.mu.Unlock()
+			if err != nil {
+				j.log.Errorf("compact: %s", err)
+			}
+		}
+	}
+}
+
+// compactLocked removes expired entries and rewrites the file if it contains removed entries.
+func (j *Journal) compactLocked(now time.Time) error {
+	deadline := now.Add(-j.config.Retention)
+	n := 0
+	for n < len(j.entries) && j.entries[n].Time.Before(deadline) {
+		n++
+	}
+	if over := len(j.entries) - n - j.config.MaxEntries; over > 0 {
+		n += over
+	}
+	if n > 0 {
+		j.entries = append([]Entry(nil), j.entries[n:]...)
+		j.stale += n
+	}
+
+	if j.f != nil && j.stale == 0 {
+		return nil
+	}
+
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	if err := j.rewrite(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.stale = 0
+
+	return nil
+}
+
+// rewrite atomically replaces the file with the entries in memory.
+func (j *Journal) rewrite() error {
+	tmp := j.config.File + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range j.entries {
+		if err := enc.Encode(&j.entries[i]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, j.config.File)
+}
+
+// Close closes the journal file, entries recorded after Close are kept only in memory.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// Query selects journal entries, zero values match all entries.
+type Query struct {
+	From, To time.Time
+
+	// Host matches the host name without port, case-insensitive.
+	Host string
+
+	User string
+
+	// MinStatus and MaxStatus select a range of status codes, MaxStatus zero means no upper limit.
+	MinStatus, MaxStatus int
+
+	// Limit is the maximal number of entries returned, zero means no limit.
+	Limit int
+}
+
+func (q *Query) match(e *Entry) bool {
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	if q.Host != "" && !strings.EqualFold(q.Host, e.Host) {
+		return false
+	}
+	if q.User != "" && q.User != e.User {
+		return false
+	}
+	if e.Status < q.MinStatus || (q.MaxStatus != 0 && e.Status > q.MaxStatus) {
+		return false
+	}
+	return true
+}
+
+// Query returns the matching entries, most recent first.
+func (j *Journal) Query(q Query) []Entry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var res []Entry
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(res) >= q.Limit {
+			break
+		}
+		if q.match(&j.entries[i]) {
+			res = append(res, j.entries[i])
+		}
+	}
+	return res
+}
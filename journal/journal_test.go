@@ -0,0 +1,150 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package journal
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestJournalQuery(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.File = filepath.Join(t.TempDir(), "journal")
+
+	j, err := New(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	j.Record(Entry{Time: now.Add(-48 * time.Hour), Host: "old.example.com", Status: 200})
+	j.Record(Entry{Time: now.Add(-time.Hour), Host: "example.com", User: "alice", Status: 200})
+	j.Record(Entry{Time: now.Add(-time.Minute), Host: "example.com", User: "bob", Status: 503})
+	j.Record(Entry{Time: now, Host: "saucelabs.com", User: "alice", Status: 404})
+
+	tests := []struct {
+		name  string
+		query Query
+		hosts []string
+	}{
+		{
+			name:  "all",
+			hosts: []string{"saucelabs.com", "example.com", "example.com", "old.example.com"},
+		},
+		{
+			name:  "host",
+			query: Query{Host: "EXAMPLE.com"},
+			hosts: []string{"example.com", "example.com"},
+		},
+		{
+			name:  "user",
+			query: Query{User: "alice"},
+			hosts: []string{"saucelabs.com", "example.com"},
+		},
+		{
+			name:  "status",
+			query: Query{MinStatus: 400, MaxStatus: 499},
+			hosts: []string{"saucelabs.com"},
+		},
+		{
+			name:  "time",
+			query: Query{From: now.Add(-2 * time.Hour), To: now},
+			hosts: []string{"example.com", "example.com"},
+		},
+		{
+			name:  "limit",
+			query: Query{Limit: 1},
+			hosts: []string{"saucelabs.com"},
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			res := j.Query(tc.query)
+			if len(res) != len(tc.hosts) {
+				t.Fatalf("expected %d entries, got %+v", len(tc.hosts), res)
+			}
+			for i := range res {
+				if res[i].Host != tc.hosts[i] {
+					t.Fatalf("expected host %s at %d, got %s", tc.hosts[i], i, res[i].Host)
+				}
+			}
+		})
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the journal, the expired entry is removed.
+	j, err = New(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if res := j.Query(Query{}); len(res) != 3 {
+		t.Fatalf("expected 3 entries after reopen, got %+v", res)
+	}
+}
+
+func TestJournalMaxEntries(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.File = filepath.Join(t.TempDir(), "journal")
+	cfg.MaxEntries = 2
+
+	j, err := New(cfg, log.NopLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	for _, h := range []string{"a", "b", "c"} {
+		j.Record(Entry{Time: time.Now(), Host: h})
+	}
+
+	res := j.Query(Query{})
+	if len(res) != 2 || res[0].Host != "c" || res[1].Host != "b" {
+		t.Fatalf("expected [c b], got %+v", res)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	q, err := parseQuery(url.Values{
+		"from":   {"1h"},
+		"to":     {"2023-10-01T11:30:00Z"},
+		"status": {"5xx"},
+		"limit":  {"10"},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !q.From.Equal(now.Add(-time.Hour)) || !q.To.Equal(now.Add(-30*time.Minute)) {
+		t.Fatalf("unexpected time range %s - %s", q.From, q.To)
+	}
+	if q.MinStatus != 500 || q.MaxStatus != 599 || q.Limit != 10 {
+		t.Fatalf("unexpected query %+v", q)
+	}
+
+	for _, v := range []url.Values{
+		{"from": {"yesterday"}},
+		{"status": {"6xx"}},
+		{"status": {"abc"}},
+		{"limit": {"0"}},
+	} {
+		if _, err := parseQuery(v, now); err == nil {
+			t.Fatalf("expected error for %v", v)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hash functions used by JWT algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/middleware"
+	"golang.org/x/sync/singleflight"
+)
+
+// JWTAuthConfig configures authentication of proxy clients with JWT bearer tokens
+// sent in the Proxy-Authorization header.
+type JWTAuthConfig struct {
+	// JWKSURL is the URL of the JSON Web Key Set used to verify token signatures.
+	JWKSURL *url.URL
+
+	// Issuer is the expected iss claim, if empty the issuer is not checked.
+	Issuer string
+
+	// Audience is the value that must be present in the aud claim, if empty the audience is not checked.
+	Audience string
+
+	// ClockSkew is the tolerance applied when validating exp and nbf claims.
+	ClockSkew time.Duration
+
+	// UserClaim is the claim used as the user identity.
+	UserClaim string
+
+	// GroupsClaim is the claim listing the groups the user belongs to,
+	// the value can be an array of strings or a space separated string.
+	GroupsClaim string
+
+	// JWKSRefreshInterval is the maximum age of the cached JWKS.
+	JWKSRefreshInterval time.Duration
+}
+
+func DefaultJWTAuthConfig() *JWTAuthConfig {
+	return &JWTAuthConfig{
+		ClockSkew:           1 * time.Minute,
+		UserClaim:           "sub",
+		GroupsClaim:         "groups",
+		JWKSRefreshInterval: 1 * time.Hour,
+	}
+}
+
+func (c *JWTAuthConfig) Validate() error {
+	if c.JWKSURL == nil {
+		return errors.New("jwks url is required")
+	}
+	if c.JWKSURL.Scheme != "http" && c.JWKSURL.Scheme != "https" {
+		return fmt.Errorf("unsupported jwks url scheme %q", c.JWKSURL.Scheme)
+	}
+	if c.UserClaim == "" {
+		return errors.New("user claim is required")
+	}
+	if c.ClockSkew < 0 {
+		return errors.New("clock skew must be non-negative")
+	}
+	if c.JWKSRefreshInterval <= 0 {
+		return errors.New("jwks refresh interval must be positive")
+	}
+	return nil
+}
+
+const (
+	// jwksMinRefreshInterval limits how often JWKS is fetched when tokens carry unknown key IDs.
+	jwksMinRefreshInterval = 30 * time.Second
+
+	// jwksFetchTimeout limits the time of a single JWKS fetch.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// JWTAuth validates JWT bearer tokens against keys from a JWKS endpoint.
+// Supported algorithms are RS256, RS384, RS512, PS256, PS384, PS512, ES256, ES384 and ES512.
+type JWTAuth struct {
+	config JWTAuthConfig
+	client *http.Client
+	log    log.Logger
+	now    func() time.Time
+
+	fetch     singleflight.Group
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+	attempted time.Time
+	fetching  bool
+}
+
+func NewJWTAuth(cfg *JWTAuthConfig, log log.Logger) (*JWTAuth, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &JWTAuth{
+		config: *cfg,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+		log:    log,
+		now:    time.Now,
+	}, nil
+}
+
+// AuthenticatedRequest validates the bearer token from the Proxy-Authorization header
+// and returns the user identity and groups from the configured claims.
+func (a *JWTAuth) AuthenticatedRequest(req *http.Request) (user string, groups []string, err error) {
+	token, ok := bearerToken(req.Header.Get(middleware.ProxyAuthorizationHeader))
+	if !ok {
+		return "", nil, errors.New("bearer token required")
+	}
+	return a.Verify(req.Context(), token)
+}
+
+// Authenticate implements Authenticator.
+func (a *JWTAuth) Authenticate(req *http.Request) (string, error) {
+	user, _, err := a.AuthenticateGroups(req)
+	return user, err
+}
+
+// AuthenticateGroups implements GroupAuthenticator.
+func (a *JWTAuth) AuthenticateGroups(req *http.Request) (user string, groups []string, err error) {
+	if _, ok := bearerToken(req.Header.Get(middleware.ProxyAuthorizationHeader)); !ok {
+		return "", nil, errors.New("bearer token required")
+	}
+	user, groups, err = a.AuthenticatedRequest(req)
+	if err != nil {
+		a.log.Debugf("bearer token rejected for %s: %s", req.URL.Redacted(), err)
+	}
+	return user, groups, err
+}
+
+// Challenge implements AuthChallenger.
+func (a *JWTAuth) Challenge(h http.Header, req *http.Request) {
+	c := `Bearer realm="` + proxyAuthRealm + `"`
+	if _, ok := bearerToken(req.Header.Get(middleware.ProxyAuthorizationHeader)); ok {
+		c += `, error="invalid_token"`
+	}
+	h.Add("Proxy-Authenticate", c)
+}
+
+func bearerToken(auth string) (string, bool) {
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	ExpiresAt *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+// jwtAudience is the aud claim, it can be a string or an array of strings.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = jwtAudience{s}
+		return nil
+	}
+	var v []string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+func (a jwtAudience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify validates the token signature and claims, and returns the user identity and groups.
+func (a *JWTAuth) Verify(ctx context.Context, token string) (user string, groups []string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errors.New("malformed token")
+	}
+
+	var h jwtHeader
+	if err := decodeJWTPart(parts[0], &h); err != nil {
+		return "", nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("signature: %w", err)
+	}
+
+	key, err := a.key(ctx, h.Kid)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := verifyJWTSignature(h.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", nil, err
+	}
+
+	var (
+		c   jwtClaims
+		raw map[string]any
+	)
+	if err := decodeJWTPart(parts[1], &c); err != nil {
+		return "", nil, fmt.Errorf("claims: %w", err)
+	}
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return "", nil, fmt.Errorf("claims: %w", err)
+	}
+
+	now := a.now()
+	if c.ExpiresAt == nil {
+		return "", nil, errors.New("missing exp claim")
+	}
+	if now.Add(-a.config.ClockSkew).After(jwtTime(*c.ExpiresAt)) {
+		return "", nil, errors.New("token expired")
+	}
+	if c.NotBefore != nil && now.Add(a.config.ClockSkew).Before(jwtTime(*c.NotBefore)) {
+		return "", nil, errors.New("token not valid yet")
+	}
+	if a.config.Issuer != "" && c.Issuer != a.config.Issuer {
+		return "", nil, fmt.Errorf("unexpected issuer %q", c.Issuer)
+	}
+	if a.config.Audience != "" && !c.Audience.contains(a.config.Audience) {
+		return "", nil, fmt.Errorf("audience %q not allowed", c.Audience)
+	}
+
+	user, _ = raw[a.config.UserClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("missing %s claim", a.config.UserClaim)
+	}
+
+	if a.config.GroupsClaim != "" {
+		switch v := raw[a.config.GroupsClaim].(type) {
+		case string:
+			groups = strings.Fields(v)
+		case []any:
+			for _, g := range v {
+				if g, ok := g.(string); ok {
+					groups = append(groups, g)
+				}
+			}
+		}
+	}
+
+	return user, groups, nil
+}
+
+func decodeJWTPart(s string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func jwtTime(v float64) time.Time {
+	return time.Unix(int64(v), 0)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[0] {
+		case 'R':
+			return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+		case 'P':
+			return rsa.VerifyPSS(k, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		if alg[0] != 'E' {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %q does not match key type %T", alg, key)
+}
+
+// key returns the key for the key ID, JWKS is fetched if the cache is stale or the key is unknown.
+// If fetching fails, the cached keys are used.
+// Concurrent callers wait for a single fetch that runs without holding the lock,
+// it is not bound to the request context so that a canceled request does not fail other waiters.
+func (a *JWTAuth) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.mu.Lock()
+	now := a.now()
+	k, ok := a.lookup(kid)
+	stale := now.Sub(a.fetched) > a.config.JWKSRefreshInterval
+	if (ok && !stale) || (!a.fetching && now.Sub(a.attempted) < jwksMinRefreshInterval) {
+		a.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return k, nil
+	}
+	if !a.fetching {
+		a.attempted, a.fetching = now, true
+	}
+	a.mu.Unlock()
+
+	var err error
+	select {
+	case r := <-a.fetch.DoChan("jwks", a.refreshJWKS):
+		err = r.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if !ok {
+			return nil, fmt.Errorf("fetch JWKS: %w", err)
+		}
+		return k, nil
+	}
+
+	a.mu.Lock()
+	k, ok = a.lookup(kid)
+	a.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return k, nil
+}
+
+// refreshJWKS fetches JWKS and replaces the cached keys.
+func (a *JWTAuth) refreshJWKS() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+
+	now := a.now()
+	keys, err := a.fetchJWKS(ctx)
+
+	a.mu.Lock()
+	a.fetching = false
+	if err == nil {
+		a.keys, a.fetched = keys, now
+	}
+	a.mu.Unlock()
+
+	if err != nil {
+		a.log.Errorf("failed to fetch JWKS: %s", err)
+		return nil, err
+	}
+
+	return nil, nil //nolint:nilnil // the result is stored in a.keys
+}
+
+func (a *JWTAuth) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(a.keys) == 1 {
+		for _, k := range a.keys {
+			return k, true
+		}
+	}
+	k, ok := a.keys[kid]
+	return k, ok
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (a *JWTAuth) fetchJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.config.JWKSURL.String(), http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i := range set.Keys {
+		k := &set.Keys[i]
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			a.log.Debugf("skipping JWKS key %q: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	a.log.Debugf("fetched %d JWKS keys", len(keys))
+
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	dec := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
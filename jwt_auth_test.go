@@ -0,0 +1,249 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signTestJWT(t *testing.T, key crypto.Signer, alg, kid string, claims map[string]any) string {
+	t.Helper()
+
+	h, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(h) + "." + b64(c)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, serr := ecdsa.Sign(rand.Reader, k, digest[:])
+		sig, err = make([]byte, 64), serr
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func TestJWTAuthVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetches := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck // test
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+				{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+				{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+			},
+		})
+	}))
+	defer s.Close()
+
+	cfg := DefaultJWTAuthConfig()
+	cfg.JWKSURL, _ = url.Parse(s.URL)
+	cfg.Issuer = "https://issuer.example.com"
+	cfg.Audience = "forwarder"
+
+	a, err := NewJWTAuth(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(mod func(c map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss": cfg.Issuer,
+			"aud": []string{"other", "forwarder"},
+			"sub": "ci-job-1",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		user  string
+	}{
+		{
+			name:  "rsa",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(nil)),
+			user:  "ci-job-1",
+		},
+		{
+			name:  "ecdsa",
+			token: signTestJWT(t, ecKey, "ES256", "ec", claims(func(c map[string]any) { c["aud"] = "forwarder" })),
+			user:  "ci-job-1",
+		},
+		{
+			name:  "expired within skew",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() })),
+			user:  "ci-job-1",
+		},
+		{
+			name:  "expired",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() })),
+		},
+		{
+			name:  "not before",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["nbf"] = now.Add(2 * time.Minute).Unix() })),
+		},
+		{
+			name:  "wrong issuer",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })),
+		},
+		{
+			name:  "wrong audience",
+			token: signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["aud"] = "other" })),
+		},
+		{
+			name:  "key mismatch",
+			token: signTestJWT(t, rsaKey, "RS256", "ec", claims(nil)),
+		},
+		{
+			name:  "unknown key",
+			token: signTestJWT(t, rsaKey, "RS256", "unknown", claims(nil)),
+		},
+		{
+			name:  "alg none",
+			token: b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + b64([]byte(`{"sub":"x"}`)) + ".",
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			user, _, err := a.Verify(context.Background(), tc.token)
+			if tc.user == "" {
+				if err == nil {
+					t.Fatalf("expected error, got user %q", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user != tc.user {
+				t.Fatalf("expected user %q, got %q", tc.user, user)
+			}
+		})
+	}
+
+	t.Run("groups", func(t *testing.T) {
+		for _, g := range []any{[]string{"ci", "qa"}, "ci qa"} {
+			token := signTestJWT(t, rsaKey, "RS256", "rsa", claims(func(c map[string]any) { c["groups"] = g }))
+			_, groups, err := a.Verify(context.Background(), token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(groups) != 2 || groups[0] != "ci" || groups[1] != "qa" {
+				t.Fatalf("expected groups [ci qa], got %v", groups)
+			}
+		}
+	})
+
+	if fetches != 1 {
+		t.Fatalf("expected JWKS to be fetched once, got %d", fetches)
+	}
+}
+
+func TestJWTAuthKeyConcurrentFetch(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		json.NewEncoder(w).Encode(map[string]any{ //nolint:errcheck // test
+			"keys": []map[string]string{
+				{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+			},
+		})
+	}))
+	defer s.Close()
+
+	cfg := DefaultJWTAuthConfig()
+	cfg.JWKSURL, _ = url.Parse(s.URL)
+	a, err := NewJWTAuth(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A canceled request does not wait for the fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.key(ctx, "rsa"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := a.key(context.Background(), "rsa"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected JWKS to be fetched once, got %d", n)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ServerState is the lifecycle state of HTTPProxy and HTTPServer.
+type ServerState int32
+
+const (
+	ServerNew ServerState = iota
+	ServerRunning
+	ServerStopping
+	ServerStopped
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case ServerNew:
+		return "new"
+	case ServerRunning:
+		return "running"
+	case ServerStopping:
+		return "stopping"
+	case ServerStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	ErrServerStarted    = errors.New("server already started")
+	ErrServerNotStarted = errors.New("server not started")
+)
+
+// lifecycle runs a server in the background and tracks its state.
+// A server can be started once, after it stops it cannot be started again.
+type lifecycle struct {
+	mu     sync.Mutex
+	state  ServerState
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// start calls serve in a goroutine with a context that is canceled when shutdown is requested,
+// either by canceling ctx or by calling shutdown.
+// When that happens, stop is called to gracefully stop serve, and the lifecycle waits for both to return.
+// Errors returned by serve are reported by wait, serve must return nil when stopped by stop.
+func (l *lifecycle) start(ctx context.Context, serve func(ctx context.Context) error, stop func()) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.state != ServerNew {
+		return ErrServerStarted
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	l.state = ServerRunning
+	l.cancel = cancel
+	l.done = make(chan struct{})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx)
+	}()
+
+	go func() {
+		var err error
+		select {
+		case <-ctx.Done():
+			l.setStopping()
+			stop()
+			err = <-served
+		case err = <-served:
+			cancel()
+		}
+
+		l.mu.Lock()
+		l.state = ServerStopped
+		l.err = err
+		l.mu.Unlock()
+		close(l.done)
+	}()
+
+	return nil
+}
+
+func (l *lifecycle) setStopping() {
+	l.mu.Lock()
+	if l.state == ServerRunning {
+		l.state = ServerStopping
+	}
+	l.mu.Unlock()
+}
+
+// shutdown requests the server to stop and waits until it is stopped or ctx is done.
+// If ctx is done first, force is called if not nil, and ctx error is returned.
+func (l *lifecycle) shutdown(ctx context.Context, force func()) error {
+	l.mu.Lock()
+	if l.state == ServerNew {
+		l.mu.Unlock()
+		return ErrServerNotStarted
+	}
+	done := l.done
+	l.mu.Unlock()
+
+	l.setStopping()
+	l.cancel()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		if force != nil {
+			force()
+		}
+		return ctx.Err()
+	}
+}
+
+// wait blocks until the server is stopped, and returns the error returned by serve.
+func (l *lifecycle) wait() error {
+	l.mu.Lock()
+	if l.state == ServerNew {
+		l.mu.Unlock()
+		return ErrServerNotStarted
+	}
+	done := l.done
+	l.mu.Unlock()
+
+	<-done
+	return l.err
+}
+
+func (l *lifecycle) current() ServerState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
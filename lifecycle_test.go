@@ -0,0 +1,140 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func newTestHTTPServer(t *testing.T, h http.Handler) *HTTPServer {
+	t.Helper()
+
+	cfg := DefaultHTTPServerConfig()
+	cfg.Addr = "localhost:0"
+	s, err := NewHTTPServer(cfg, h, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestHTTPServerLifecycle(t *testing.T) {
+	t.Run("shutdown", func(t *testing.T) {
+		s := newTestHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		if err := s.Wait(); !errors.Is(err, ErrServerNotStarted) {
+			t.Fatalf("Wait() = %v, want %v", err, ErrServerNotStarted)
+		}
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Start(context.Background()); !errors.Is(err, ErrServerStarted) {
+			t.Fatalf("Start() = %v, want %v", err, ErrServerStarted)
+		}
+		if s.State() != ServerRunning {
+			t.Fatalf("State() = %s, want %s", s.State(), ServerRunning)
+		}
+
+		res, err := http.Get("http://" + s.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if s.State() != ServerStopped {
+			t.Fatalf("State() = %s, want %s", s.State(), ServerStopped)
+		}
+		if err := s.Wait(); err != nil {
+			t.Fatalf("Wait() = %v, want nil", err)
+		}
+	})
+
+	t.Run("shutdown deadline", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		started := make(chan struct{})
+
+		s := newTestHTTPServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		go http.Get("http://" + s.Addr()) //nolint:errcheck,bodyclose // the connection is closed by Shutdown
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+		}
+		if err := s.Wait(); err != nil {
+			t.Fatalf("Wait() = %v, want nil", err)
+		}
+	})
+
+	t.Run("serve error", func(t *testing.T) {
+		s := newTestHTTPServer(t, http.NotFoundHandler())
+		s.listener.Close()
+
+		if err := s.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Wait(); err == nil {
+			t.Fatal("Wait() = nil, want error")
+		}
+		if s.State() != ServerStopped {
+			t.Fatalf("State() = %s, want %s", s.State(), ServerStopped)
+		}
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown() = %v, want nil", err)
+		}
+	})
+}
+
+func TestHTTPProxyLifecycle(t *testing.T) {
+	p, err := NewInMemoryHTTPProxy(DefaultHTTPProxyConfig(), nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err := p.Shutdown(context.Background()); !errors.Is(err, ErrServerNotStarted) {
+		t.Fatalf("Shutdown() = %v, want %v", err, ErrServerNotStarted)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if p.State() != ServerRunning {
+		t.Fatalf("State() = %s, want %s", p.State(), ServerRunning)
+	}
+
+	cancel()
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() = %v, want nil", err)
+	}
+	if p.State() != ServerStopped {
+		t.Fatalf("State() = %s, want %s", p.State(), ServerStopped)
+	}
+	if err := p.Start(context.Background()); !errors.Is(err, ErrServerStarted) {
+		t.Fatalf("Start() = %v, want %v", err, ErrServerStarted)
+	}
+}
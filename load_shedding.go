@@ -0,0 +1,263 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+)
+
+// LoadSheddingConfig enables progressive load shedding when the proxy runs out of resources.
+// The utilization of CPU, memory and file descriptors is sampled periodically,
+// and the highest utilization selects the shedding level:
+// disable HTTP body logging, reject CONNECT requests, reject all new requests.
+// Rejected requests get 503 Service Unavailable response.
+type LoadSheddingConfig struct {
+	// Interval is the time between utilization samples.
+	Interval time.Duration
+
+	// MemoryLimit is the memory used by the process that counts as full utilization.
+	// If zero, the Go runtime soft memory limit (GOMEMLIMIT) is used if set.
+	MemoryLimit SizeSuffix
+
+	// MaxOpenFiles is the number of open file descriptors that counts as full utilization.
+	// If zero, the soft limit of open files of the process is used if available.
+	MaxOpenFiles int
+
+	// Thresholds are the utilization ratios, between 0 and 1, that enable the consecutive shedding levels.
+	Thresholds [3]float64
+}
+
+func DefaultLoadSheddingConfig() *LoadSheddingConfig {
+	return &LoadSheddingConfig{
+		Interval:   time.Second,
+		Thresholds: [3]float64{0.8, 0.9, 0.95},
+	}
+}
+
+func (c *LoadSheddingConfig) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if c.MemoryLimit < 0 {
+		return fmt.Errorf("memory limit must not be negative")
+	}
+	if c.MaxOpenFiles < 0 {
+		return fmt.Errorf("max open files must not be negative")
+	}
+	prev := 0.0
+	for _, t := range c.Thresholds {
+		if t <= prev || t > 1 {
+			return fmt.Errorf("thresholds must be increasing values in range (0, 1]")
+		}
+		prev = t
+	}
+	return nil
+}
+
+type loadSheddingLevel int32
+
+const (
+	loadSheddingNone loadSheddingLevel = iota
+	loadSheddingNoBodyLogging
+	loadSheddingRejectConnect
+	loadSheddingRejectRequests
+)
+
+func (l loadSheddingLevel) String() string {
+	switch l {
+	case loadSheddingNone:
+		return "none"
+	case loadSheddingNoBodyLogging:
+		return "no-body-logging"
+	case loadSheddingRejectConnect:
+		return "reject-connect"
+	case loadSheddingRejectRequests:
+		return "reject-requests"
+	default:
+		return fmt.Sprintf("level-%d", l)
+	}
+}
+
+// loadSheddingHysteresis is the utilization drop below the threshold required to leave a level,
+// so that the level does not flap when the utilization is close to the threshold.
+const loadSheddingHysteresis = 0.05
+
+// loadSample holds utilization ratios of resources, negative values mean the resource is not measured.
+type loadSample struct {
+	CPU    float64
+	Memory float64
+	Files  float64
+}
+
+func (s loadSample) max() float64 {
+	return math.Max(s.CPU, math.Max(s.Memory, s.Files))
+}
+
+func (s loadSample) String() string {
+	return fmt.Sprintf("cpu=%.2f memory=%.2f files=%.2f", s.CPU, s.Memory, s.Files)
+}
+
+type loadShedder struct {
+	cfg    *LoadSheddingConfig
+	sample func() loadSample
+	level  atomic.Int32
+}
+
+func (s *loadShedder) Level() loadSheddingLevel {
+	return loadSheddingLevel(s.level.Load())
+}
+
+// update sets the level for the utilization sample, it returns the previous level.
+func (s *loadShedder) update(ls loadSample) loadSheddingLevel {
+	u := ls.max()
+	prev := s.Level()
+
+	level := loadSheddingNone
+	for i, t := range s.cfg.Thresholds {
+		l := loadSheddingLevel(i + 1)
+		if u >= t || (l <= prev && u >= t-loadSheddingHysteresis) {
+			level = l
+		}
+	}
+	s.level.Store(int32(level))
+
+	return prev
+}
+
+// systemLoad samples the process resource utilization.
+type systemLoad struct {
+	memoryLimit  int64
+	maxOpenFiles int
+
+	lastCPU  time.Duration
+	lastTime time.Time
+	samples  []metrics.Sample
+}
+
+func newSystemLoad(cfg *LoadSheddingConfig) *systemLoad {
+	l := &systemLoad{
+		memoryLimit:  int64(cfg.MemoryLimit),
+		maxOpenFiles: cfg.MaxOpenFiles,
+		samples: []metrics.Sample{
+			{Name: "/memory/classes/total:bytes"},
+			{Name: "/memory/classes/heap/released:bytes"},
+		},
+	}
+	if l.memoryLimit == 0 {
+		if v := debug.SetMemoryLimit(-1); v != math.MaxInt64 {
+			l.memoryLimit = v
+		}
+	}
+	if l.maxOpenFiles == 0 {
+		l.maxOpenFiles = openFilesLimit()
+	}
+	l.lastCPU, l.lastTime = processCPUTime(), time.Now()
+
+	return l
+}
+
+func (l *systemLoad) sample() loadSample {
+	s := loadSample{CPU: -1, Memory: -1, Files: -1}
+
+	if cpu := processCPUTime(); cpu >= 0 {
+		now := time.Now()
+		if wall := now.Sub(l.lastTime); wall > 0 {
+			// CPU time is accounted in scheduler ticks, over short intervals it may exceed the wall time.
+			s.CPU = math.Min(float64(cpu-l.lastCPU)/float64(wall)/float64(runtime.NumCPU()), 1)
+		}
+		l.lastCPU, l.lastTime = cpu, now
+	}
+
+	if l.memoryLimit > 0 {
+		metrics.Read(l.samples)
+		used := l.samples[0].Value.Uint64() - l.samples[1].Value.Uint64()
+		s.Memory = float64(used) / float64(l.memoryLimit)
+	}
+
+	if l.maxOpenFiles > 0 {
+		if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+			s.Files = float64(len(fds)) / float64(l.maxOpenFiles)
+		}
+	}
+
+	return s
+}
+
+func (hp *HTTPProxy) runLoadShedding(ctx context.Context) {
+	t := time.NewTicker(hp.config.LoadShedding.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			hp.updateLoadShedding(hp.shedder.sample())
+		}
+	}
+}
+
+func (hp *HTTPProxy) updateLoadShedding(ls loadSample) {
+	prev := hp.shedder.update(ls)
+	level := hp.shedder.Level()
+
+	hp.metrics.loadSample(ls, level)
+	if level == prev {
+		return
+	}
+
+	if level > prev {
+		hp.log.Errorf("load shedding: level changed from %s to %s %s", prev, level, ls)
+	} else {
+		hp.log.Infof("load shedding: level changed from %s to %s %s", prev, level, ls)
+	}
+
+	// Rebuild the middleware stack to apply the HTTP log mode.
+	if (prev < loadSheddingNoBodyLogging) != (level < loadSheddingNoBodyLogging) && hp.runtime.Load().LogHTTPMode == httplog.Body {
+		hp.reloadMu.Lock()
+		hp.mw.store(hp.middlewareStack())
+		hp.reloadMu.Unlock()
+	}
+}
+
+// loadShedding rejects requests depending on the load shedding level.
+func (hp *HTTPProxy) loadShedding() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		level := hp.shedder.Level()
+
+		var action string
+		switch {
+		case level >= loadSheddingRejectRequests:
+			action = "reject-request"
+		case level >= loadSheddingRejectConnect && req.Method == http.MethodConnect:
+			action = "reject-connect"
+		default:
+			return nil
+		}
+		hp.metrics.loadShed(action)
+
+		res := proxyutil.NewResponse(http.StatusServiceUnavailable, http.NoBody, req)
+		res.Header.Set("Retry-After", "1")
+		res.Close = true
+		hp.abort(req, res)
+
+		return fmt.Errorf("load shedding: %s", level)
+	})
+}
@@ -0,0 +1,23 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build !unix
+
+package forwarder
+
+import (
+	"time"
+)
+
+// processCPUTime returns -1 as the CPU time of the process is not available.
+func processCPUTime() time.Duration {
+	return -1
+}
+
+// openFilesLimit returns zero as the limit of open files is not available.
+func openFilesLimit() int {
+	return 0
+}
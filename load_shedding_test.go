@@ -0,0 +1,138 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestLoadSheddingConfigValidate(t *testing.T) {
+	cfg := DefaultLoadSheddingConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Thresholds = [3]float64{0.9, 0.8, 0.95}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for decreasing thresholds")
+	}
+	cfg.Thresholds = [3]float64{0.8, 0.9, 1.5}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected error for threshold above 1")
+	}
+}
+
+func TestLoadShedderUpdate(t *testing.T) {
+	s := &loadShedder{cfg: DefaultLoadSheddingConfig()}
+
+	tests := []struct {
+		u     float64
+		level loadSheddingLevel
+	}{
+		{0.5, loadSheddingNone},
+		{0.85, loadSheddingNoBodyLogging},
+		{0.96, loadSheddingRejectRequests},
+		// Hysteresis keeps the levels until the utilization drops below the threshold.
+		{0.93, loadSheddingRejectRequests},
+		{0.89, loadSheddingRejectConnect},
+		{0.84, loadSheddingNoBodyLogging},
+		{0.74, loadSheddingNone},
+		{0.78, loadSheddingNone},
+	}
+	for _, tc := range tests {
+		s.update(loadSample{CPU: tc.u, Memory: -1, Files: -1})
+		if l := s.Level(); l != tc.level {
+			t.Fatalf("utilization %.2f: expected level %s, got %s", tc.u, tc.level, l)
+		}
+	}
+}
+
+func TestSystemLoadSample(t *testing.T) {
+	cfg := DefaultLoadSheddingConfig()
+	cfg.MemoryLimit = 64 * Gibi
+	l := newSystemLoad(cfg)
+
+	s := l.sample()
+	if s.Memory <= 0 || s.Memory >= 1 {
+		t.Fatalf("expected memory utilization in range (0, 1), got %f", s.Memory)
+	}
+	if s.CPU > 1 {
+		t.Fatalf("expected CPU utilization at most 1, got %f", s.CPU)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.LoadShedding = DefaultLoadSheddingConfig()
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	status := func(t *testing.T, method string) int {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(method, "http://example.com:443", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method == http.MethodConnect {
+			req.URL = &url.URL{Host: "example.com:443"}
+			err = req.Write(conn)
+		} else {
+			err = req.WriteProxy(conn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	expect := func(t *testing.T, method string, code int) {
+		t.Helper()
+		if s := status(t, method); s != code {
+			t.Fatalf("%s: expected status %d, got %d", method, code, s)
+		}
+	}
+
+	p.updateLoadShedding(loadSample{CPU: 0.92, Memory: -1, Files: -1})
+	expect(t, http.MethodConnect, http.StatusServiceUnavailable)
+	expect(t, http.MethodGet, http.StatusOK)
+
+	p.updateLoadShedding(loadSample{CPU: 0.97, Memory: -1, Files: -1})
+	expect(t, http.MethodGet, http.StatusServiceUnavailable)
+
+	p.updateLoadShedding(loadSample{CPU: 0.1, Memory: -1, Files: -1})
+	expect(t, http.MethodGet, http.StatusOK)
+}
@@ -0,0 +1,33 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// Annotation is a key value pair attached to a request for diagnostics.
+type Annotation = martian.Annotation
+
+// Annotate attaches the key value pair to the request for diagnostics, it replaces the previous value of the key.
+// Unlike metadata, annotations apply to a single request and are not used as metric labels.
+// Annotations are included in logs, journal entries and optionally in a response header.
+func Annotate(req *http.Request, key, value string) {
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Annotate(key, value)
+	}
+}
+
+// Annotations returns the annotations of the request in the order they were added.
+func Annotations(req *http.Request) []Annotation {
+	if ctx := martian.NewContext(req); ctx != nil {
+		return ctx.Annotations()
+	}
+	return nil
+}
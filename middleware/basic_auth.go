@@ -85,8 +85,16 @@ func parseBasicAuth(auth string) (username, password string, ok bool) {
 // Otherwise, if the request is not authenticated, the handler is not called and a 401 Unauthorized is returned.
 // The provided username and password are used to authenticate the request.
 func (ba *BasicAuth) Wrap(h http.Handler, expectedUser, expectedPass string) http.Handler {
+	return ba.WrapFunc(h, func(r *http.Request) bool {
+		return ba.AuthenticatedRequest(r, expectedUser, expectedPass)
+	})
+}
+
+// WrapFunc is like Wrap but the request is authenticated by the provided function,
+// e.g. to check the credentials against multiple users.
+func (ba *BasicAuth) WrapFunc(h http.Handler, authenticated func(r *http.Request) bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !ba.AuthenticatedRequest(r, expectedUser, expectedPass) {
+		if !authenticated(r) {
 			if ba.header == ProxyAuthorizationHeader {
 				w.Header().Set("Proxy-Authenticate", "Basic realm=\"Sauce Labs Forwarder\"")
 				w.Header().Set("Proxy-Connection", "close")
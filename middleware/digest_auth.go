@@ -0,0 +1,256 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/md5" //nolint:gosec // MD5 is required by RFC 7616 for compatibility
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DigestAuth implements Digest Access Authentication as specified in RFC 7616 with qop=auth.
+// SHA-256 and MD5 algorithms are supported, clients are challenged with both.
+//
+// Nonces are stateless, they carry the issue time and are signed with a random per-instance key.
+// Replay protection is implemented by tracking the highest nonce count used with each nonce,
+// a request with a nonce count that is not greater than the previous one is rejected.
+// Expired nonces are reported to the client as stale, so that it can retry without asking the user for credentials.
+//
+// See https://datatracker.ietf.org/doc/html/rfc7616
+type DigestAuth struct {
+	header          string
+	challengeHeader string
+	realm           string
+	key             []byte
+	opaque          string
+
+	// NonceTTL is the time after which a nonce becomes stale.
+	NonceTTL time.Duration
+
+	mu        sync.Mutex
+	nc        map[string]uint64
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewDigestAuth(realm string) *DigestAuth {
+	return newDigestAuth(AuthorizationHeader, "WWW-Authenticate", realm)
+}
+
+func NewProxyDigestAuth(realm string) *DigestAuth {
+	return newDigestAuth(ProxyAuthorizationHeader, "Proxy-Authenticate", realm)
+}
+
+func newDigestAuth(header, challengeHeader, realm string) *DigestAuth {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("digest auth: generate key: %s", err))
+	}
+
+	return &DigestAuth{
+		header:          header,
+		challengeHeader: challengeHeader,
+		realm:           realm,
+		key:             key,
+		opaque:          hex.EncodeToString(key[:8]),
+		NonceTTL:        5 * time.Minute,
+		nc:              make(map[string]uint64),
+		now:             time.Now,
+	}
+}
+
+func (da *DigestAuth) newNonce() string {
+	var b [8 + sha256.Size]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(da.now().UnixNano()))
+	m := hmac.New(sha256.New, da.key)
+	m.Write(b[:8])
+	m.Sum(b[:8])
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+// checkNonce returns true if the nonce was issued by this instance, and whether it is stale.
+func (da *DigestAuth) checkNonce(nonce string) (valid, stale bool) {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size {
+		return false, false
+	}
+	m := hmac.New(sha256.New, da.key)
+	m.Write(b[:8])
+	if !hmac.Equal(m.Sum(nil), b[8:]) {
+		return false, false
+	}
+
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+	return true, da.now().Sub(issued) > da.NonceTTL
+}
+
+// useNonceCount records the nonce count and returns false if it was already used.
+func (da *DigestAuth) useNonceCount(nonce string, nc uint64) bool {
+	da.mu.Lock()
+	defer da.mu.Unlock()
+
+	if now := da.now(); now.Sub(da.lastPrune) > da.NonceTTL {
+		// Nonces are stale after TTL, there is no need to track them any longer.
+		for n := range da.nc {
+			if _, stale := da.checkNonce(n); stale {
+				delete(da.nc, n)
+			}
+		}
+		da.lastPrune = now
+	}
+
+	if nc <= da.nc[nonce] {
+		return false
+	}
+	da.nc[nonce] = nc
+	return true
+}
+
+// Challenges returns the values of the authenticate header for the request.
+// The request is used to determine if the nonce it carries is stale.
+func (da *DigestAuth) Challenges(r *http.Request) []string {
+	stale := false
+	if p, ok := da.params(r); ok {
+		_, stale = da.checkNonce(p["nonce"])
+	}
+
+	nonce := da.newNonce()
+	c := make([]string, 0, 2)
+	for _, alg := range []string{"SHA-256", "MD5"} {
+		s := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=%s, nonce=%q, opaque=%q`, da.realm, alg, nonce, da.opaque)
+		if stale {
+			s += ", stale=true"
+		}
+		c = append(c, s)
+	}
+	return c
+}
+
+// SetChallenges sets the authenticate headers for the request on the response header.
+func (da *DigestAuth) SetChallenges(h http.Header, r *http.Request) {
+	h.Del(da.challengeHeader)
+	for _, c := range da.Challenges(r) {
+		h.Add(da.challengeHeader, c)
+	}
+}
+
+func (da *DigestAuth) params(r *http.Request) (map[string]string, bool) {
+	auth := r.Header.Get(da.header)
+	const prefix = "Digest "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, false
+	}
+	return parseAuthParams(auth[len(prefix):]), true
+}
+
+// AuthenticatedRequest returns true if the request carries valid Digest credentials
+// for the expected username and password and the nonce is fresh and not replayed.
+func (da *DigestAuth) AuthenticatedRequest(r *http.Request, expectedUser, expectedPass string) bool {
+	p, ok := da.params(r)
+	if !ok {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(p["username"]), []byte(expectedUser)) != 1 || p["realm"] != da.realm {
+		return false
+	}
+	if p["qop"] != "auth" || p["cnonce"] == "" {
+		return false
+	}
+	if p["opaque"] != "" && p["opaque"] != da.opaque {
+		return false
+	}
+	if r.RequestURI != "" && p["uri"] != r.RequestURI {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch strings.ToUpper(p["algorithm"]) {
+	case "", "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return false
+	}
+
+	nonce := p["nonce"]
+	if valid, stale := da.checkNonce(nonce); !valid || stale {
+		return false
+	}
+	nc, err := strconv.ParseUint(p["nc"], 16, 64)
+	if err != nil {
+		return false
+	}
+
+	hs := func(s string) string {
+		x := h()
+		x.Write([]byte(s))
+		return hex.EncodeToString(x.Sum(nil))
+	}
+	ha1 := hs(expectedUser + ":" + da.realm + ":" + expectedPass)
+	ha2 := hs(r.Method + ":" + p["uri"])
+	expected := hs(ha1 + ":" + nonce + ":" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(p["response"])), []byte(expected)) != 1 {
+		return false
+	}
+
+	// Record the nonce count only after the response is verified, so that it cannot be poisoned.
+	return da.useNonceCount(nonce, nc)
+}
+
+// parseAuthParams parses a comma separated list of key=value or key="value" pairs.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params
+		}
+
+		k, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return params
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				sb.WriteByte(rest[i])
+			}
+			v = sb.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			v, s, _ = strings.Cut(rest, ",")
+			v = strings.TrimSpace(v)
+		}
+		params[k] = v
+	}
+}
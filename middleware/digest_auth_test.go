@@ -0,0 +1,119 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"crypto/md5" //nolint:gosec // test
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func digestAuthorization(challenge, method, uri, user, pass string, nc int) string {
+	p := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+
+	var h func() hash.Hash = md5.New
+	if p["algorithm"] == "SHA-256" {
+		h = sha256.New
+	}
+	hs := func(s string) string {
+		x := h()
+		x.Write([]byte(s))
+		return hex.EncodeToString(x.Sum(nil))
+	}
+
+	const cnonce = "0a4f113b"
+	ncs := fmt.Sprintf("%08x", nc)
+	ha1 := hs(user + ":" + p["realm"] + ":" + pass)
+	ha2 := hs(method + ":" + uri)
+	resp := hs(ha1 + ":" + p["nonce"] + ":" + ncs + ":" + cnonce + ":auth:" + ha2)
+
+	return fmt.Sprintf(`Digest username=%q, realm=%q, nonce=%q, uri=%q, algorithm=%s, qop=auth, nc=%s, cnonce=%q, response=%q, opaque=%q`,
+		user, p["realm"], p["nonce"], uri, p["algorithm"], ncs, cnonce, resp, p["opaque"])
+}
+
+func TestDigestAuth(t *testing.T) {
+	da := NewDigestAuth("test")
+
+	for i, alg := range []string{"SHA-256", "MD5"} {
+		t.Run(alg, func(t *testing.T) {
+			c := da.Challenges(httptest.NewRequest(http.MethodGet, "/", http.NoBody))[i]
+			if !strings.Contains(c, "algorithm="+alg) {
+				t.Fatalf("expected %s challenge, got %s", alg, c)
+			}
+
+			newRequest := func(user, pass string, nc int) *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "/foo?bar=baz", http.NoBody)
+				r.Header.Set(AuthorizationHeader, digestAuthorization(c, http.MethodGet, "/foo?bar=baz", user, pass, nc))
+				return r
+			}
+
+			if !da.AuthenticatedRequest(newRequest("user", "pass", 1), "user", "pass") {
+				t.Fatal("expected authenticated request")
+			}
+			if da.AuthenticatedRequest(newRequest("user", "pass", 1), "user", "pass") {
+				t.Fatal("expected replayed request to be rejected")
+			}
+			if !da.AuthenticatedRequest(newRequest("user", "pass", 2), "user", "pass") {
+				t.Fatal("expected authenticated request with next nonce count")
+			}
+			if da.AuthenticatedRequest(newRequest("user", "wrong", 3), "user", "pass") {
+				t.Fatal("expected request with wrong password to be rejected")
+			}
+			if da.AuthenticatedRequest(newRequest("other", "pass", 4), "user", "pass") {
+				t.Fatal("expected request with wrong user to be rejected")
+			}
+		})
+	}
+}
+
+func TestDigestAuthStaleNonce(t *testing.T) {
+	da := NewProxyDigestAuth("test")
+	now := time.Now()
+	da.now = func() time.Time { return now }
+
+	c := da.Challenges(httptest.NewRequest(http.MethodGet, "/", http.NoBody))[0]
+	r := httptest.NewRequest(http.MethodGet, "/", http.NoBody)
+	r.Header.Set(ProxyAuthorizationHeader, digestAuthorization(c, http.MethodGet, "/", "user", "pass", 1))
+
+	now = now.Add(da.NonceTTL + time.Second)
+	if da.AuthenticatedRequest(r, "user", "pass") {
+		t.Fatal("expected stale nonce to be rejected")
+	}
+
+	h := make(http.Header)
+	da.SetChallenges(h, r)
+	for _, v := range h.Values("Proxy-Authenticate") {
+		if !strings.HasSuffix(v, "stale=true") {
+			t.Fatalf("expected stale challenge, got %s", v)
+		}
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	p := parseAuthParams(`username="Mufasa", realm="http-auth@example.org", uri="/dir/index.html", nc=00000001, qop=auth, cnonce="f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", opaque="a\"b"`)
+	expected := map[string]string{
+		"username": "Mufasa",
+		"realm":    "http-auth@example.org",
+		"uri":      "/dir/index.html",
+		"nc":       "00000001",
+		"qop":      "auth",
+		"cnonce":   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		"opaque":   `a"b`,
+	}
+	for k, v := range expected {
+		if p[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, p[k])
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+const metadataKey = "metadata"
+
+// MetadataItem is a key value pair attached to a request for traffic attribution, e.g. tunnel or job ID.
+type MetadataItem struct {
+	Key   string
+	Value string
+}
+
+// SetMetadata attaches the key value pair to the request, it replaces the previous value of the key.
+// Metadata is included in logs, error responses and metrics.
+// For CONNECT requests metadata is also stored in the session,
+// so that it applies to the requests sent over the tunnel.
+func SetMetadata(req *http.Request, key, value string) {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return
+	}
+
+	set := func(get func(string) (any, bool), put func(string, any)) {
+		v, _ := get(metadataKey)
+		old, _ := v.(map[string]string)
+
+		// Copy on write, the session map may be read by concurrent requests.
+		m := make(map[string]string, len(old)+1)
+		for k, v := range old {
+			m[k] = v
+		}
+		m[key] = value
+		put(metadataKey, m)
+	}
+
+	set(ctx.Get, ctx.Set)
+	if req.Method == http.MethodConnect {
+		s := ctx.Session()
+		set(s.Get, s.Set)
+	}
+}
+
+// Metadata returns the metadata attached to the request or the session, sorted by key.
+// Request values take precedence over session values.
+func Metadata(req *http.Request) []MetadataItem {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	sv, _ := ctx.Session().Get(metadataKey)
+	sm, _ := sv.(map[string]string)
+	rv, _ := ctx.Get(metadataKey)
+	rm, _ := rv.(map[string]string)
+	if len(sm) == 0 && len(rm) == 0 {
+		return nil
+	}
+
+	m := make(map[string]string, len(sm)+len(rm))
+	for k, v := range sm {
+		m[k] = v
+	}
+	for k, v := range rm {
+		m[k] = v
+	}
+
+	items := make([]MetadataItem, 0, len(m))
+	for k, v := range m {
+		items = append(items, MetadataItem{Key: k, Value: v})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	return items
+}
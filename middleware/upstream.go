@@ -0,0 +1,45 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+const upstreamKey = "upstream"
+
+// DirectUpstream is the upstream of requests sent directly to the origin server, see Upstream.
+const DirectUpstream = "direct"
+
+// SetUpstream associates the upstream proxy the request is sent to with the request,
+// nil means the request is sent directly to the origin server. The user info of the URL is not stored.
+func SetUpstream(req *http.Request, u *url.URL) {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return
+	}
+	v := DirectUpstream
+	if u != nil {
+		v = u.Scheme + "://" + u.Host
+	}
+	ctx.Set(upstreamKey, v)
+}
+
+// Upstream returns the upstream proxy URL associated with the request, DirectUpstream,
+// or an empty string if the request has not been sent upstream.
+func Upstream(req *http.Request) string {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return ""
+	}
+	v, _ := ctx.Get(upstreamKey)
+	s, _ := v.(string)
+	return s
+}
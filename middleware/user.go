@@ -0,0 +1,65 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+const userKey = "user"
+
+type identity struct {
+	user   string
+	groups []string
+}
+
+// SetUser associates the authenticated user identity and the groups the user belongs to with the request.
+// For CONNECT requests the identity is also stored in the session,
+// so that it applies to the requests sent over the tunnel.
+func SetUser(req *http.Request, user string, groups ...string) {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return
+	}
+	id := &identity{user: user, groups: groups}
+	ctx.Set(userKey, id)
+	if req.Method == http.MethodConnect {
+		ctx.Session().Set(userKey, id)
+	}
+}
+
+func getIdentity(req *http.Request) *identity {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(userKey)
+	if !ok {
+		v, _ = ctx.Session().Get(userKey)
+	}
+	id, _ := v.(*identity)
+	return id
+}
+
+// User returns the authenticated user identity associated with the request,
+// or an empty string if the request is not authenticated.
+func User(req *http.Request) string {
+	if id := getIdentity(req); id != nil {
+		return id.user
+	}
+	return ""
+}
+
+// Groups returns the groups of the authenticated user associated with the request.
+func Groups(req *http.Request) []string {
+	if id := getIdentity(req); id != nil {
+		return id.groups
+	}
+	return nil
+}
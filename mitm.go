@@ -7,28 +7,172 @@
 package forwarder
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/saucelabs/forwarder/internal/martian/mitm"
 	"github.com/saucelabs/forwarder/utils/certutil"
 )
 
+// MITMKeyType is the key type of the generated MITM certificates.
+type MITMKeyType string
+
+const (
+	RSAKeyType   MITMKeyType = "rsa"
+	ECDSAKeyType MITMKeyType = "ecdsa"
+)
+
+func (t MITMKeyType) String() string {
+	return string(t)
+}
+
+func (t MITMKeyType) isValid() bool {
+	switch t {
+	case RSAKeyType, ECDSAKeyType:
+		return true
+	default:
+		return false
+	}
+}
+
 type MITMConfig struct {
 	CACertFile string
 	CAKeyFile  string
 
+	// CASigner signs the generated certificates instead of the key loaded from CAKeyFile,
+	// it allows keeping the CA private key in an HSM, a PKCS#11 module or a cloud KMS.
+	// The public key of the signer must match the CA certificate loaded from CACertFile.
+	CASigner crypto.Signer
+
+	// SecondaryCACertFile is a CA certificate published together with the CA certificate, but not used for signing.
+	// It allows rotating the CA: clients are provisioned with both certificates before the signing CA is switched.
+	SecondaryCACertFile string
+
 	Organization string
 	Validity     time.Duration
+	KeyType      MITMKeyType
+
+	// NameConstraints limit the generated CA certificate to the domains.
+	// Hosts outside of the name constraints of the CA are not MITMed, as clients would reject the certificates.
+	NameConstraints []string
+
+	// SkipEV disables MITM of hosts presenting Extended Validation certificates.
+	SkipEV bool
+
+	// SkipPins disables MITM of hosts presenting a certificate chain with a public key pin,
+	// pins are base64 encoded SHA-256 hashes of the Subject Public Key Info, with an optional sha256/ prefix.
+	SkipPins []string
+
+	// HandshakeFailureBypass is the time a host is not MITMed after a client rejected the MITM certificate for it,
+	// e.g. because the application pins the certificate of the host. Zero disables the bypass.
+	HandshakeFailureBypass time.Duration
+
+	// Clock returns the current time used for the generated certificates and TLS validation of MITMed connections,
+	// it allows simulating expired or not yet valid certificates deterministically. If nil, time.Now is used.
+	Clock func() time.Time
+
+	// ClockOffset is added to the Clock time.
+	ClockOffset time.Duration
+
+	// MaxInspectedRequestBody and MaxResponseSnapshot limit the number of body bytes of MITMed requests and responses
+	// read into memory for inspection e.g. body logging, the rest of the body is streamed.
+	// They are independent of the transfer limits, zero means the HTTP log body limit applies.
+	MaxInspectedRequestBody SizeSuffix
+	MaxResponseSnapshot     SizeSuffix
+
+	// CacheSize limits the number of generated certificates kept in memory, the least recently used are evicted.
+	// Zero means no limit.
+	CacheSize int
+
+	// CacheDir is a directory where generated certificates are persisted, so that they are reused after a restart.
+	// Certificates are keyed by host and CA fingerprint.
+	CacheDir string
+
+	// HTTP2 enables HTTP/2 for clients of MITMed connections, if negotiated with ALPN.
+	// Requests are passed through the modifiers as HTTP/1 requests, bodies are streamed in both directions,
+	// which allows gRPC bidirectional streaming.
+	HTTP2 bool
+
+	// CAHost is a host name intercepted by the proxy to serve the CA certificates to clients e.g. forwarder.mitm,
+	// at http://<CAHost>/ca.crt in PEM, and http://<CAHost>/ca.der in DER format.
+	// The PEM file includes the secondary CA certificate, the DER file contains the signing CA certificate only.
+	CAHost string
+}
+
+// hasClock returns true if the MITM time differs from the system time.
+func (c *MITMConfig) hasClock() bool {
+	return c.Clock != nil || c.ClockOffset != 0
+}
+
+func (c *MITMConfig) now() time.Time {
+	t := time.Now()
+	if c.Clock != nil {
+		t = c.Clock()
+	}
+	return t.Add(c.ClockOffset)
 }
 
 func DefaultMITMConfig() *MITMConfig {
 	return &MITMConfig{
 		Organization: "Sauce Labs Inc.",
 		Validity:     24 * time.Hour, //nolint:gomnd // 24 hours is a reasonable default
+		KeyType:      RSAKeyType,
+	}
+}
+
+func (c *MITMConfig) Validate() error {
+	if c.KeyType != "" && !c.KeyType.isValid() {
+		return fmt.Errorf("unsupported key type: %s", c.KeyType)
+	}
+	if len(c.NameConstraints) > 0 && c.CACertFile != "" {
+		return fmt.Errorf("name constraints can only be set for the generated CA certificate")
+	}
+	if c.CASigner != nil {
+		if c.CACertFile == "" {
+			return fmt.Errorf("CA signer requires CA certificate file")
+		}
+		if c.CAKeyFile != "" {
+			return fmt.Errorf("CA signer cannot be used with CA key file")
+		}
+	}
+	if c.SecondaryCACertFile != "" && c.CACertFile == "" {
+		return fmt.Errorf("secondary CA certificate requires CA certificate file")
+	}
+	if _, err := parseSPKIPins(c.SkipPins); err != nil {
+		return err
+	}
+	if c.MaxInspectedRequestBody < 0 {
+		return fmt.Errorf("max inspected request body must be non-negative")
+	}
+	if c.MaxResponseSnapshot < 0 {
+		return fmt.Errorf("max response snapshot must be non-negative")
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("cache size must be non-negative")
+	}
+	if c.HandshakeFailureBypass < 0 {
+		return fmt.Errorf("handshake failure bypass must be non-negative")
+	}
+	if c.CAHost != "" && (strings.ContainsAny(c.CAHost, ":/") || net.ParseIP(c.CAHost) != nil) {
+		return fmt.Errorf("CA host must be a host name without port, got %q", c.CAHost)
 	}
+	return nil
+}
+
+func (c *MITMConfig) hasInspectionLimits() bool {
+	return c.MaxInspectedRequestBody > 0 || c.MaxResponseSnapshot > 0
 }
 
 func (c *MITMConfig) loadCACertificate() (cert tls.Certificate, err error) {
@@ -36,12 +180,98 @@ func (c *MITMConfig) loadCACertificate() (cert tls.Certificate, err error) {
 		tmpl := certutil.ECDSASelfSignedCert()
 		tmpl.Hosts = nil
 		tmpl.IsCA = true
+		tmpl.PermittedDNSDomains = c.NameConstraints
+		if c.hasClock() {
+			// The CA certificate must be valid both at the system time and the MITM time.
+			now := c.now()
+			if now.Before(tmpl.ValidFrom) {
+				tmpl.ValidFor += tmpl.ValidFrom.Sub(now)
+				tmpl.ValidFrom = now
+			} else {
+				tmpl.ValidFor += now.Sub(tmpl.ValidFrom)
+			}
+		}
 		return tmpl.Gen()
 	}
 
+	if c.CASigner != nil {
+		return loadX509CertificateWithSigner(c.CACertFile, c.CASigner)
+	}
+
 	return loadX509KeyPair(c.CACertFile, c.CAKeyFile)
 }
 
+// loadX509CertificateWithSigner is like loadX509KeyPair, but the private key is held by the signer.
+func loadX509CertificateWithSigner(certFile string, signer crypto.Signer) (cert tls.Certificate, err error) {
+	b, err := ReadFileOrBase64(certFile)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("no PEM certificate found")
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return cert, err
+	}
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(signer.Public()) {
+		return cert, fmt.Errorf("public key of the signer does not match the certificate")
+	}
+	cert.PrivateKey = signer
+	cert.Leaf = leaf
+
+	return cert, nil
+}
+
+func (c *MITMConfig) loadSecondaryCACertificate() (*x509.Certificate, error) {
+	if c.SecondaryCACertFile == "" {
+		return nil, nil //nolint:nilnil // no secondary CA
+	}
+
+	b, err := ReadFileOrBase64(c.SecondaryCACertFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("secondary CA certificate: no PEM certificate found")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("secondary CA certificate: %w", err)
+	}
+	if !ca.IsCA {
+		return nil, fmt.Errorf("secondary CA certificate: certificate is not a CA")
+	}
+
+	return ca, nil
+}
+
+// caFingerprint returns a short identifier of the CA certificate used in metrics and logs.
+func caFingerprint(ca *x509.Certificate) string {
+	sum := sha256.Sum256(ca.Raw)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (c *MITMConfig) leafKey() (crypto.Signer, error) {
+	if c.KeyType == ECDSAKeyType {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, 2048) //nolint:gomnd // 2048 bits is the default RSA key size
+}
+
 func newMartianMITMConfig(c *MITMConfig) (*mitm.Config, error) {
 	cert, err := c.loadCACertificate()
 	if err != nil {
@@ -62,6 +292,28 @@ func newMartianMITMConfig(c *MITMConfig) (*mitm.Config, error) {
 	}
 	cfg.SetOrganization(c.Organization)
 	cfg.SetValidity(c.Validity)
+	cfg.SetCacheSize(c.CacheSize)
+	cfg.SetHTTP2(c.HTTP2)
+	if c.CacheDir != "" {
+		s, err := newMITMCertDir(c.CacheDir, ca)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SetCertStorage(s)
+	}
+	if c.hasClock() {
+		cfg.SetClock(c.now)
+	}
+
+	if c.KeyType == ECDSAKeyType {
+		priv, err := c.leafKey()
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.SetLeafKey(priv); err != nil {
+			return nil, err
+		}
+	}
 
 	return cfg, nil
 }
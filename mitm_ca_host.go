@@ -0,0 +1,98 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+const mitmCAHostKey = "mitm-ca-host"
+
+// mitmCAHost serves the MITM CA certificates to requests to the MITMConfig.CAHost without contacting the server,
+// so that devices can install the CA certificate from a browser configured to use the proxy.
+type mitmCAHost struct {
+	host string
+	pem  []byte
+	der  []byte
+}
+
+func (hp *HTTPProxy) mitmCAHost() *mitmCAHost {
+	var b []byte
+	for _, c := range hp.mitmCACerts {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return &mitmCAHost{
+		host: hp.config.MITM.CAHost,
+		pem:  b,
+		der:  hp.mitmCACert.Raw,
+	}
+}
+
+func (m *mitmCAHost) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || !strings.EqualFold(req.URL.Hostname(), m.host) {
+		return nil
+	}
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+	ctx.SkipRoundTrip()
+	ctx.Set(mitmCAHostKey, true)
+	return nil
+}
+
+// isMITMCAHostRequest returns true if the request is served by mitmCAHost.
+func isMITMCAHostRequest(req *http.Request) bool {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return false
+	}
+	_, ok := ctx.Get(mitmCAHostKey)
+	return ok
+}
+
+func (m *mitmCAHost) ModifyResponse(res *http.Response) error {
+	if res.Request == nil || !isMITMCAHostRequest(res.Request) {
+		return nil
+	}
+
+	code := http.StatusOK
+	var (
+		contentType string
+		body        []byte
+	)
+	switch res.Request.URL.Path {
+	case "/ca.crt", "/ca.pem":
+		contentType, body = "application/x-x509-ca-cert", m.pem
+	case "/ca.der", "/ca.cer":
+		contentType, body = "application/x-x509-ca-cert", m.der
+	default:
+		code = http.StatusNotFound
+		contentType, body = "text/plain; charset=utf-8", []byte("not found, get /ca.crt or /ca.der\n")
+	}
+
+	res.StatusCode = code
+	res.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+	res.Header = make(http.Header)
+	res.Header.Set("Content-Type", contentType)
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestMITMCAHost(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MITM = DefaultMITMConfig()
+	cfg.MITM.CAHost = "forwarder.mitm"
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected round trip to %s", req.URL)
+			return nil, io.EOF
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	get := func(path string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://forwarder.mitm"+path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, b
+	}
+
+	res, b := get("/ca.crt")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || !bytes.Equal(block.Bytes, p.MITMCACert().Raw) {
+		t.Fatal("expected PEM encoded CA certificate")
+	}
+
+	res, b = get("/ca.der")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+	if _, err := x509.ParseCertificate(b); err != nil {
+		t.Fatalf("expected DER encoded CA certificate: %v", err)
+	}
+
+	if res, _ := get("/other"); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestMITMConfigValidateCAHost(t *testing.T) {
+	for _, h := range []string{"forwarder.mitm:80", "127.0.0.1", "forwarder.mitm/ca.crt"} {
+		cfg := DefaultMITMConfig()
+		cfg.CAHost = h
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("%s: expected error", h)
+		}
+	}
+}
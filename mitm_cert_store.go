@@ -0,0 +1,89 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// mitmCertDir stores generated MITM certificates in PEM files with the certificate chain and the private key.
+// Certificates are kept in a subdirectory named after the CA fingerprint,
+// so that certificates signed by a different CA are never loaded.
+type mitmCertDir struct {
+	dir string
+}
+
+func newMITMCertDir(dir string, ca *x509.Certificate) (*mitmCertDir, error) {
+	d := filepath.Join(dir, caFingerprint(ca))
+	if err := os.MkdirAll(d, 0o700); err != nil {
+		return nil, fmt.Errorf("MITM cache dir: %w", err)
+	}
+	return &mitmCertDir{dir: d}, nil
+}
+
+func (d *mitmCertDir) path(hostname string) string {
+	return filepath.Join(d.dir, url.PathEscape(hostname)+".pem")
+}
+
+func (d *mitmCertDir) Load(hostname string) (*tls.Certificate, error) {
+	b, err := os.ReadFile(d.path(hostname))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil //nolint:nilnil // no certificate stored
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(b, b)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cert, nil
+}
+
+func (d *mitmCertDir) Store(hostname string, cert *tls.Certificate) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var b []byte
+	for _, c := range cert.Certificate {
+		b = append(b, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c})...)
+	}
+	b = append(b, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})...)
+
+	// Write to a temporary file and rename it, so that a partially written file is never loaded.
+	f, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), d.path(hostname))
+}
@@ -0,0 +1,277 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+// MITMAction is the decision of the MITM decision service for a CONNECT request.
+type MITMAction string
+
+const (
+	MITMActionMITM   MITMAction = "mitm"
+	MITMActionTunnel MITMAction = "tunnel"
+	MITMActionBlock  MITMAction = "block"
+)
+
+func (a MITMAction) String() string {
+	return string(a)
+}
+
+func (a MITMAction) isValid() bool {
+	switch a {
+	case MITMActionMITM, MITMActionTunnel, MITMActionBlock:
+		return true
+	default:
+		return false
+	}
+}
+
+// MITMDecisionRequest describes the CONNECT request sent to the MITM decision service.
+type MITMDecisionRequest struct {
+	Host     string   `json:"host"`
+	Port     string   `json:"port"`
+	ClientIP string   `json:"client_ip"`
+	User     string   `json:"user,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+}
+
+func (r *MITMDecisionRequest) cacheKey() string {
+	return strings.Join([]string{r.Host, r.Port, r.ClientIP, r.User, strings.Join(r.Groups, ",")}, "\x00")
+}
+
+// MITMDecision is the response of the MITM decision service.
+type MITMDecision struct {
+	Action MITMAction `json:"action"`
+
+	// TTL is the time in seconds the decision can be cached, if zero the configured cache TTL is used.
+	TTL int `json:"ttl,omitempty"`
+}
+
+// MITMDecider is a client of the MITM decision service.
+type MITMDecider interface {
+	DecideMITM(ctx context.Context, req *MITMDecisionRequest) (*MITMDecision, error)
+}
+
+type MITMDecisionConfig struct {
+	// Decider is the client of the decision service, see NewHTTPMITMDecider.
+	Decider MITMDecider
+
+	// Timeout is the maximum time to wait for a decision.
+	Timeout time.Duration
+
+	// CacheTTL is the time decisions are cached for, zero disables caching.
+	CacheTTL time.Duration
+
+	// OnError is the action taken if the decision service fails or times out.
+	OnError MITMAction
+}
+
+func DefaultMITMDecisionConfig() *MITMDecisionConfig {
+	return &MITMDecisionConfig{
+		Timeout:  1 * time.Second,
+		CacheTTL: 1 * time.Minute,
+		OnError:  MITMActionTunnel,
+	}
+}
+
+func (c *MITMDecisionConfig) Validate() error {
+	if c.Decider == nil {
+		return fmt.Errorf("decider is required")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("cache TTL must not be negative")
+	}
+	if !c.OnError.isValid() {
+		return fmt.Errorf("unsupported on error action: %s", c.OnError)
+	}
+	return nil
+}
+
+// HTTPMITMDecider asks the decision service over HTTP.
+// The MITMDecisionRequest is sent as JSON in a POST request, the response body must be a JSON MITMDecision.
+type HTTPMITMDecider struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPMITMDecider returns a decider for the service at u, if tr is nil http.DefaultTransport is used.
+func NewHTTPMITMDecider(u *url.URL, tr http.RoundTripper) *HTTPMITMDecider {
+	if tr == nil {
+		tr = http.DefaultTransport
+	}
+	return &HTTPMITMDecider{
+		url:    u.String(),
+		client: &http.Client{Transport: tr},
+	}
+}
+
+func (d *HTTPMITMDecider) DecideMITM(ctx context.Context, dr *MITMDecisionRequest) (*MITMDecision, error) {
+	b, err := json.Marshal(dr)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+
+	var v MITMDecision
+	if err := json.NewDecoder(io.LimitReader(res.Body, int64(Mebi))).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decode decision: %w", err)
+	}
+	return &v, nil
+}
+
+var ErrProxyDeniedByMITMDecision = denyError{errors.New("proxying denied by MITM decision service"), "mitm-decision"}
+
+const (
+	mitmDecisionKey       = "mitm-decision"
+	mitmDecisionMaxCached = 10000
+)
+
+type mitmDecisionResult struct {
+	action  MITMAction
+	expires time.Time
+}
+
+// mitmDecisions asks the decision service how to handle CONNECT requests.
+// The results are cached per destination and client identity.
+type mitmDecisions struct {
+	cfg *MITMDecisionConfig
+	now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]mitmDecisionResult
+}
+
+// decide returns the action for the request and the source of the decision: cache, service or error.
+func (d *mitmDecisions) decide(ctx context.Context, dr *MITMDecisionRequest) (action MITMAction, source string, err error) {
+	key := dr.cacheKey()
+	now := d.now()
+
+	d.mu.Lock()
+	r, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.action, "cache", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+
+	v, err := d.cfg.Decider.DecideMITM(ctx, dr)
+	if err == nil && !v.Action.isValid() {
+		err = fmt.Errorf("unsupported action %q", v.Action)
+	}
+	if err != nil {
+		return d.cfg.OnError, "error", err
+	}
+
+	ttl := d.cfg.CacheTTL
+	if v.TTL > 0 {
+		ttl = time.Duration(v.TTL) * time.Second
+	}
+	if ttl > 0 && d.cfg.CacheTTL > 0 {
+		d.mu.Lock()
+		if len(d.cache) >= mitmDecisionMaxCached {
+			d.cache = make(map[string]mitmDecisionResult)
+		}
+		d.cache[key] = mitmDecisionResult{action: v.Action, expires: now.Add(ttl)}
+		d.mu.Unlock()
+	}
+
+	return v.Action, "service", nil
+}
+
+func (hp *HTTPProxy) configureMITMDecisions() {
+	hp.mitmDecisions = &mitmDecisions{
+		cfg:   hp.config.MITMDecision,
+		now:   hp.now,
+		cache: make(map[string]mitmDecisionResult),
+	}
+}
+
+func newMITMDecisionRequest(req *http.Request) *MITMDecisionRequest {
+	dr := &MITMDecisionRequest{
+		Host:   req.URL.Hostname(),
+		Port:   req.URL.Port(),
+		User:   middleware.User(req),
+		Groups: middleware.Groups(req),
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		dr.ClientIP = ip
+	} else {
+		dr.ClientIP = req.RemoteAddr
+	}
+	return dr
+}
+
+// mitmDecision asks the decision service about CONNECT requests.
+// Blocked requests are denied, other decisions are stored in the context and applied by mitmFilter.
+func (hp *HTTPProxy) mitmDecision() martian.RequestModifier {
+	return hp.abortIf(func(req *http.Request) bool {
+		if req.Method != http.MethodConnect {
+			return false
+		}
+
+		action, source, err := hp.mitmDecisions.decide(req.Context(), newMITMDecisionRequest(req))
+		if err != nil {
+			hp.log.Errorf("MITM decision for %s failed, using %s: %s", req.URL.Host, action, err)
+		}
+		hp.metrics.mitmDecision(action.String(), source)
+
+		if ctx := martian.NewContext(req); ctx != nil {
+			ctx.Set(mitmDecisionKey, action)
+		}
+		return action == MITMActionBlock
+	}, func(req *http.Request) *http.Response {
+		return hp.errorResponse(req, ErrProxyDeniedByMITMDecision)
+	}, errors.New("blocked by MITM decision service"))
+}
+
+// mitmDecisionAction returns the action stored by mitmDecision, or empty string.
+func mitmDecisionAction(req *http.Request) MITMAction {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return ""
+	}
+	v, ok := ctx.Get(mitmDecisionKey)
+	if !ok {
+		return ""
+	}
+	return v.(MITMAction) //nolint:forcetypeassert // we know the type
+}
@@ -0,0 +1,168 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+type testMITMDecider struct {
+	mu    sync.Mutex
+	calls []*MITMDecisionRequest
+	fn    func(req *MITMDecisionRequest) (*MITMDecision, error)
+}
+
+func (d *testMITMDecider) DecideMITM(_ context.Context, req *MITMDecisionRequest) (*MITMDecision, error) {
+	d.mu.Lock()
+	d.calls = append(d.calls, req)
+	d.mu.Unlock()
+	return d.fn(req)
+}
+
+func TestMITMDecisionsDecide(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := &testMITMDecider{fn: func(req *MITMDecisionRequest) (*MITMDecision, error) {
+		switch req.Host {
+		case "block.com":
+			return &MITMDecision{Action: MITMActionBlock, TTL: 10}, nil
+		case "invalid.com":
+			return &MITMDecision{Action: "foo"}, nil
+		case "error.com":
+			return nil, errors.New("service unavailable")
+		default:
+			return &MITMDecision{Action: MITMActionMITM}, nil
+		}
+	}}
+	cfg := DefaultMITMDecisionConfig()
+	cfg.Decider = d
+	md := &mitmDecisions{
+		cfg:   cfg,
+		now:   func() time.Time { return now },
+		cache: make(map[string]mitmDecisionResult),
+	}
+
+	decide := func(host, user string) (MITMAction, string) {
+		t.Helper()
+		action, source, _ := md.decide(context.Background(), &MITMDecisionRequest{Host: host, Port: "443", ClientIP: "10.0.0.1", User: user})
+		return action, source
+	}
+	expect := func(host, user string, action MITMAction, source string) {
+		t.Helper()
+		if a, s := decide(host, user); a != action || s != source {
+			t.Fatalf("%s %s: expected %s from %s, got %s from %s", host, user, action, source, a, s)
+		}
+	}
+
+	expect("example.com", "", MITMActionMITM, "service")
+	expect("example.com", "", MITMActionMITM, "cache")
+	expect("example.com", "user", MITMActionMITM, "service")
+	expect("block.com", "", MITMActionBlock, "service")
+	expect("error.com", "", MITMActionTunnel, "error")
+	expect("error.com", "", MITMActionTunnel, "error")
+	expect("invalid.com", "", MITMActionTunnel, "error")
+
+	// The decision TTL overrides the cache TTL.
+	now = now.Add(30 * time.Second)
+	expect("block.com", "", MITMActionBlock, "service")
+	expect("example.com", "", MITMActionMITM, "cache")
+	now = now.Add(cfg.CacheTTL)
+	expect("example.com", "", MITMActionMITM, "service")
+
+	if len(d.calls) != 8 {
+		t.Fatalf("expected 8 calls, got %d", len(d.calls))
+	}
+}
+
+func TestHTTPMITMDecider(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req MITMDecisionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Host != "example.com" {
+			http.Error(w, "unexpected host", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(MITMDecision{Action: MITMActionTunnel, TTL: 5}) //nolint:errcheck // test
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewHTTPMITMDecider(u, nil)
+
+	v, err := d.DecideMITM(context.Background(), &MITMDecisionRequest{Host: "example.com", Port: "443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Action != MITMActionTunnel || v.TTL != 5 {
+		t.Fatalf("unexpected decision %+v", v)
+	}
+
+	if _, err := d.DecideMITM(context.Background(), &MITMDecisionRequest{Host: "other.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMITMDecisionBlock(t *testing.T) {
+	d := &testMITMDecider{fn: func(req *MITMDecisionRequest) (*MITMDecision, error) {
+		return &MITMDecision{Action: MITMActionBlock}, nil
+	}}
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MITMDecision = DefaultMITMDecisionConfig()
+	cfg.MITMDecision.Decider = d
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodConnect, "http://blocked.com:443", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "blocked.com:443"
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, res.StatusCode)
+	}
+	if v := res.Header.Get(DeniedByHeader); v != "mitm-decision" {
+		t.Fatalf("expected %s header mitm-decision, got %q", DeniedByHeader, v)
+	}
+	if len(d.calls) != 1 || d.calls[0].Host != "blocked.com" || d.calls[0].Port != "443" {
+		t.Fatalf("unexpected decision requests %+v", d.calls)
+	}
+}
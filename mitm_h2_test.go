@@ -0,0 +1,152 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	ht "github.com/saucelabs/forwarder/internal/martian/h2/testing"
+	tspb "github.com/saucelabs/forwarder/internal/martian/h2/testservice"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func TestMITMHTTP2GRPCStreaming(t *testing.T) {
+	gs := grpc.NewServer()
+	tspb.RegisterTestServiceServer(gs, &ht.Server{})
+	origin := httptest.NewUnstartedServer(gs)
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	var (
+		mu        sync.Mutex
+		requests  []string
+		responses []string
+	)
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.MITM = DefaultMITMConfig()
+	cfg.MITM.HTTP2 = true
+	cfg.RequestModifiers = []RequestModifier{
+		RequestModifierFunc(func(req *http.Request) error {
+			if req.Method == http.MethodConnect {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			requests = append(requests, fmt.Sprintf("%s %s", req.Header.Get("Content-Type"), req.URL.Path))
+			return nil
+		}),
+	}
+	cfg.ResponseModifiers = []ResponseModifier{
+		ResponseModifierFunc(func(res *http.Response) error {
+			if res.Request.Method == http.MethodConnect {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			responses = append(responses, res.Header.Get("Content-Type"))
+			return nil
+		}),
+	}
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, origin.Client().Transport, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		conn, err := p.DialContext(ctx, "tcp", "in-memory")
+		if err != nil {
+			return nil, err
+		}
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Host: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("CONNECT: unexpected status %s", res.Status)
+		}
+		return conn, nil
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.MITMCACert())
+	cc, err := grpc.Dial(origin.Listener.Addr().String(),
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})),
+		grpc.WithContextDialer(dial),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := tspb.NewTestServiceClient(cc).DoubleEcho(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Responses must be received before the request stream is closed.
+	for _, payload := range []string{"foo", "bar"} {
+		if err := stream.Send(&tspb.EchoRequest{Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			res, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.GetPayload() != payload {
+				t.Fatalf("expected payload %q, got %q", payload, res.GetPayload())
+			}
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 1 || requests[0] != "application/grpc /test_service.TestService/DoubleEcho" {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+	if len(responses) != 1 || responses[0] != "application/grpc" {
+		t.Fatalf("unexpected responses %v", responses)
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// evPolicyOID is the CA/Browser Forum Extended Validation certificate policy.
+var evPolicyOID = asn1.ObjectIdentifier{2, 23, 140, 1, 1}
+
+// parseSPKIPins parses base64 encoded SHA-256 hashes of Subject Public Key Info with an optional sha256/ prefix.
+func parseSPKIPins(pins []string) (map[[sha256.Size]byte]struct{}, error) {
+	m := make(map[[sha256.Size]byte]struct{}, len(pins))
+	for _, p := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, "sha256/"))
+		if err != nil {
+			return nil, fmt.Errorf("pin %q: %w", p, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("pin %q: expected SHA-256 hash", p)
+		}
+		m[[sha256.Size]byte(b)] = struct{}{}
+	}
+	return m, nil
+}
+
+// nameConstraintsPermit returns true if the CA name constraints permit certificates for the host.
+func nameConstraintsPermit(ca *x509.Certificate, host string) bool {
+	if net.ParseIP(host) != nil {
+		return len(ca.PermittedIPRanges) == 0 || ipInRanges(net.ParseIP(host), ca.PermittedIPRanges)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range ca.ExcludedDNSDomains {
+		if domainMatchesConstraint(host, d) {
+			return false
+		}
+	}
+	if len(ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, d := range ca.PermittedDNSDomains {
+		if domainMatchesConstraint(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainMatchesConstraint implements RFC 5280 DNS name constraint matching,
+// a leading period matches subdomains only, otherwise the domain and its subdomains match.
+func domainMatchesConstraint(host, constraint string) bool {
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint || strings.HasSuffix(host, "."+constraint)
+}
+
+const (
+	mitmProbeTTL      = time.Hour
+	mitmProbeMaxHosts = 10000
+	mitmProbeTimeout  = 10 * time.Second
+)
+
+type mitmProbeResult struct {
+	reason  string
+	expires time.Time
+}
+
+// mitmProbe connects to origin servers to check the certificates they present,
+// hosts presenting EV certificates or pinned keys are not MITMed.
+// The results are cached per host, concurrent probes of the same host share a single connection.
+type mitmProbe struct {
+	now       func() time.Time
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	tlsConfig *tls.Config
+	skipEV    bool
+	pins      map[[sha256.Size]byte]struct{}
+	metrics   *httpProxyMetrics
+
+	probes singleflight.Group
+	mu     sync.Mutex
+	cache  map[string]mitmProbeResult
+}
+
+const (
+	mitmProbeMITM  = "mitm"
+	mitmProbeSkip  = "skip"
+	mitmProbeError = "error"
+)
+
+// skipReason returns the reason not to MITM the connection to addr, or empty string.
+func (p *mitmProbe) skipReason(ctx context.Context, addr string) (string, error) {
+	p.mu.Lock()
+	r, ok := p.cache[addr]
+	p.mu.Unlock()
+	if ok && p.now().Before(r.expires) {
+		return r.reason, nil
+	}
+
+	select {
+	case res := <-p.probes.DoChan(addr, func() (any, error) {
+		return p.probe(ctx, addr)
+	}):
+		if res.Err != nil {
+			return "", res.Err
+		}
+		return res.Val.(string), nil //nolint:forcetypeassert // It's string.
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// probe checks the certificates of addr and caches the result.
+// The probe is not canceled with ctx, as other requests may wait for it.
+func (p *mitmProbe) probe(ctx context.Context, addr string) (string, error) {
+	certs, err := p.peerCertificates(context.WithoutCancel(ctx), addr)
+	if err != nil {
+		p.metrics.mitmProbe(mitmProbeError)
+		return "", err
+	}
+
+	r := mitmProbeResult{
+		reason:  p.check(certs),
+		expires: p.now().Add(mitmProbeTTL),
+	}
+	if r.reason != "" {
+		p.metrics.mitmProbe(mitmProbeSkip)
+	} else {
+		p.metrics.mitmProbe(mitmProbeMITM)
+	}
+
+	p.mu.Lock()
+	p.store(addr, r)
+	p.mu.Unlock()
+
+	return r.reason, nil
+}
+
+// store adds the result to the cache, if the cache is full expired results are removed,
+// and if none expired, the result that expires first.
+func (p *mitmProbe) store(addr string, r mitmProbeResult) {
+	if _, ok := p.cache[addr]; !ok && len(p.cache) >= mitmProbeMaxHosts {
+		now := p.now()
+		var (
+			oldest    string
+			oldestExp time.Time
+		)
+		for k, v := range p.cache {
+			if !now.Before(v.expires) {
+				delete(p.cache, k)
+				continue
+			}
+			if oldest == "" || v.expires.Before(oldestExp) {
+				oldest, oldestExp = k, v.expires
+			}
+		}
+		if len(p.cache) >= mitmProbeMaxHosts {
+			delete(p.cache, oldest)
+		}
+	}
+	p.cache[addr] = r
+}
+
+func (p *mitmProbe) check(certs []*x509.Certificate) string {
+	if len(certs) == 0 {
+		return ""
+	}
+	if p.skipEV {
+		for _, oid := range certs[0].PolicyIdentifiers {
+			if oid.Equal(evPolicyOID) {
+				return "extended validation certificate"
+			}
+		}
+	}
+	for _, c := range certs {
+		if _, ok := p.pins[sha256.Sum256(c.RawSubjectPublicKeyInfo)]; ok {
+			return "pinned public key of " + c.Subject.CommonName
+		}
+	}
+	return ""
+}
+
+func (p *mitmProbe) peerCertificates(ctx context.Context, addr string) ([]*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, mitmProbeTimeout)
+	defer cancel()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	cfg := p.tlsConfig.Clone()
+	cfg.ServerName = host
+	cfg.NextProtos = nil
+	tc := tls.Client(conn, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	// Pins may match the root certificate, which is not sent by the server.
+	cs := tc.ConnectionState()
+	certs := cs.PeerCertificates
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+
+	return certs, nil
+}
+
+func (hp *HTTPProxy) configureMITMProbe() error {
+	tr, ok := hp.transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("certificate probing requires *http.Transport, got %T", hp.transport)
+	}
+	pins, err := parseSPKIPins(hp.config.MITM.SkipPins)
+	if err != nil {
+		return err
+	}
+
+	tlsCfg := tr.TLSClientConfig
+	if tlsCfg == nil {
+		tlsCfg = new(tls.Config)
+	}
+	if hp.config.MITM.hasClock() {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.Time = hp.config.MITM.now
+	}
+	hp.mitmProbe = &mitmProbe{
+		now:       hp.now,
+		dial:      tr.DialContext,
+		tlsConfig: tlsCfg,
+		skipEV:    hp.config.MITM.SkipEV,
+		pins:      pins,
+		metrics:   hp.metrics,
+		cache:     make(map[string]mitmProbeResult),
+	}
+
+	return nil
+}
+
+// mitmBypass keeps hosts for which a client rejected the MITM certificate, e.g. because of certificate pinning.
+// Connections to the hosts are tunneled until the entries expire.
+type mitmBypass struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]time.Time
+}
+
+func newMITMBypass(ttl time.Duration, now func() time.Time) *mitmBypass {
+	return &mitmBypass{
+		ttl:   ttl,
+		now:   now,
+		hosts: make(map[string]time.Time),
+	}
+}
+
+func (b *mitmBypass) add(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.hosts) >= mitmProbeMaxHosts {
+		b.hosts = make(map[string]time.Time)
+	}
+	b.hosts[host] = b.now().Add(b.ttl)
+}
+
+func (b *mitmBypass) contains(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	expires, ok := b.hosts[host]
+	if ok && !b.now().Before(expires) {
+		delete(b.hosts, host)
+		return false
+	}
+	return ok
+}
+
+// mitmFilter decides if the CONNECT request is MITMed.
+// The decision service, if configured, takes precedence over MITM domains.
+// MITM exclude domains and hosts bypassed after handshake failures are never MITMed.
+func (hp *HTTPProxy) mitmFilter(req *http.Request) bool {
+	host := req.URL.Hostname()
+
+	if hasBypass(req, BypassMITM) {
+		hp.log.Debugf("MITM disabled for %s: bypass header", host)
+		return false
+	}
+
+	switch mitmDecisionAction(req) {
+	case MITMActionTunnel:
+		return false
+	case MITMActionMITM:
+	default:
+		if md := hp.runtime.Load().MITMDomains; md != nil && !md.Match(host) {
+			return false
+		}
+	}
+
+	if me := hp.runtime.Load().MITMExcludeDomains; me != nil && me.Match(host) {
+		hp.log.Debugf("MITM disabled for %s: excluded domain", host)
+		return false
+	}
+
+	if hp.mitmBypass != nil && hp.mitmBypass.contains(host) {
+		hp.log.Debugf("MITM disabled for %s: client rejected MITM certificate", host)
+		return false
+	}
+
+	if !nameConstraintsPermit(hp.mitmCACert, host) {
+		hp.log.Debugf("MITM disabled for %s: not permitted by CA name constraints", host)
+		return false
+	}
+
+	if hp.mitmProbe != nil {
+		// Certificates are probed only for direct connections.
+		if u, err := hp.proxyFunc(req); err != nil || u != nil {
+			return true
+		}
+		reason, err := hp.mitmProbe.skipReason(req.Context(), req.URL.Host)
+		if err != nil {
+			hp.log.Debugf("MITM certificate probe of %s failed: %s", req.URL.Host, err)
+			return true
+		}
+		if reason != "" {
+			hp.log.Debugf("MITM disabled for %s: %s", req.URL.Host, reason)
+			return false
+		}
+	}
+
+	return true
+}
+
+const (
+	mitmHandshakeOK        = "ok"
+	mitmHandshakeUntrusted = "untrusted"
+	mitmHandshakeFailed    = "error"
+)
+
+// mitmHandshakeError is called when the MITM handshake with the client fails, req is the CONNECT request.
+// Failures are counted by the signing CA, so that during CA rotation it is visible how many clients do not trust it.
+// If handshake failure bypass is enabled, hosts for which the certificate was rejected are tunneled for a while.
+func (hp *HTTPProxy) mitmHandshakeError(req *http.Request, err error) {
+	result := mitmHandshakeResult(err)
+	hp.metrics.mitmHandshake(caFingerprint(hp.mitmCACert), result)
+	if result == mitmHandshakeUntrusted {
+		hp.log.Debugf("MITM certificate rejected by client %s host=%s: %v", req.RemoteAddr, req.Host, err)
+		if hp.mitmBypass != nil {
+			hp.mitmBypass.add(req.URL.Hostname())
+			hp.log.Infof("MITM disabled for %s for %s: client rejected MITM certificate", req.URL.Hostname(), hp.mitmBypass.ttl)
+		}
+	}
+}
+
+// mitmHandshakeResult classifies the MITM handshake error.
+// Clients that do not trust the CA abort the handshake with a certificate alert.
+func mitmHandshakeResult(err error) string {
+	s := err.Error()
+	for _, alert := range []string{
+		"unknown certificate authority",
+		"bad certificate",
+		"certificate unknown",
+	} {
+		if strings.Contains(s, "remote error: tls: "+alert) {
+			return mitmHandshakeUntrusted
+		}
+	}
+	return mitmHandshakeFailed
+}
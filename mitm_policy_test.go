@@ -0,0 +1,441 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/utils/certutil"
+)
+
+func TestNameConstraintsPermit(t *testing.T) {
+	ca := &x509.Certificate{
+		PermittedDNSDomains: []string{"example.com", ".internal"},
+		ExcludedDNSDomains:  []string{"secret.example.com"},
+	}
+
+	tests := []struct {
+		host   string
+		permit bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"WWW.Example.com.", true},
+		{"badexample.com", false},
+		{"secret.example.com", false},
+		{"a.secret.example.com", false},
+		{"internal", false},
+		{"host.internal", true},
+		{"example.org", false},
+	}
+	for _, tc := range tests {
+		if permit := nameConstraintsPermit(ca, tc.host); permit != tc.permit {
+			t.Errorf("%s: expected %v, got %v", tc.host, tc.permit, permit)
+		}
+	}
+
+	if !nameConstraintsPermit(&x509.Certificate{}, "example.org") {
+		t.Error("expected CA without constraints to permit all hosts")
+	}
+}
+
+func TestParseSPKIPins(t *testing.T) {
+	sum := sha256.Sum256([]byte("spki"))
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	pins, err := parseSPKIPins([]string{pin, "sha256/" + pin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pins[sum]; !ok || len(pins) != 1 {
+		t.Fatalf("unexpected pins %v", pins)
+	}
+
+	for _, p := range []string{"not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseSPKIPins([]string{p}); err == nil {
+			t.Errorf("%q: expected error", p)
+		}
+	}
+}
+
+func TestMITMProbeCheck(t *testing.T) {
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf")}
+	ev := &x509.Certificate{
+		RawSubjectPublicKeyInfo: []byte("ev"),
+		PolicyIdentifiers:       []asn1.ObjectIdentifier{{2, 23, 140, 1, 2, 1}, evPolicyOID},
+	}
+	root := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("root")}
+
+	pins, err := parseSPKIPins([]string{base64.StdEncoding.EncodeToString(func() []byte {
+		s := sha256.Sum256(root.RawSubjectPublicKeyInfo)
+		return s[:]
+	}())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		probe mitmProbe
+		certs []*x509.Certificate
+		skip  bool
+	}{
+		{"ev", mitmProbe{skipEV: true}, []*x509.Certificate{ev}, true},
+		{"ev disabled", mitmProbe{}, []*x509.Certificate{ev}, false},
+		{"no ev", mitmProbe{skipEV: true}, []*x509.Certificate{leaf}, false},
+		{"pinned root", mitmProbe{pins: pins}, []*x509.Certificate{leaf, root}, true},
+		{"not pinned", mitmProbe{pins: pins}, []*x509.Certificate{leaf}, false},
+	}
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if reason := tc.probe.check(tc.certs); (reason != "") != tc.skip {
+				t.Fatalf("expected skip=%v, got reason %q", tc.skip, reason)
+			}
+		})
+	}
+}
+
+func TestMITMProbeSkipReason(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	var (
+		dials   atomic.Int32
+		release = make(chan struct{})
+		d       net.Dialer
+	)
+	cfg := &tls.Config{RootCAs: x509.NewCertPool()} //nolint:gosec // test
+	cfg.RootCAs.AddCert(s.Certificate())
+	p := &mitmProbe{
+		now: time.Now,
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			<-release
+			return d.DialContext(ctx, network, addr)
+		},
+		tlsConfig: cfg,
+		metrics:   newMetrics(nil, "", 0),
+		cache:     make(map[string]mitmProbeResult),
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := p.skipReason(context.Background(), addr); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		// Wait for the callers to join the probe.
+		for dials.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if n := dials.Load(); n != 1 {
+			t.Fatalf("expected 1 probe, got %d", n)
+		}
+		if v := testutil.ToFloat64(p.metrics.probes.WithLabelValues(mitmProbeMITM)); v != 1 {
+			t.Fatalf("expected 1 probe metric, got %v", v)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		if _, err := p.skipReason(context.Background(), "127.0.0.1:1"); err == nil {
+			t.Fatal("expected error")
+		}
+		if v := testutil.ToFloat64(p.metrics.probes.WithLabelValues(mitmProbeError)); v != 1 {
+			t.Fatalf("expected 1 probe error metric, got %v", v)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := p.skipReason(ctx, "127.0.0.1:2"); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled, got %v", err)
+		}
+	})
+}
+
+func TestMITMProbeCacheEviction(t *testing.T) {
+	now := time.Now()
+	p := &mitmProbe{
+		now:   func() time.Time { return now },
+		cache: make(map[string]mitmProbeResult),
+	}
+	for i := range mitmProbeMaxHosts {
+		p.store(fmt.Sprintf("host%d:443", i), mitmProbeResult{expires: now.Add(time.Duration(i+1) * time.Second)})
+	}
+
+	p.store("new:443", mitmProbeResult{expires: now.Add(mitmProbeTTL)})
+	if len(p.cache) != mitmProbeMaxHosts {
+		t.Fatalf("expected %d entries, got %d", mitmProbeMaxHosts, len(p.cache))
+	}
+	if _, ok := p.cache["host0:443"]; ok {
+		t.Fatal("expected the entry that expires first to be evicted")
+	}
+	if _, ok := p.cache["host1:443"]; !ok {
+		t.Fatal("expected other entries to be kept")
+	}
+
+	// host1 to host9 expire, host0 was evicted.
+	now = now.Add(10 * time.Second)
+	p.store("other:443", mitmProbeResult{expires: now.Add(mitmProbeTTL)})
+	if n := len(p.cache); n != mitmProbeMaxHosts-8 {
+		t.Fatalf("expected expired entries to be removed, got %d entries", n)
+	}
+}
+
+func TestMITMConfigLeafKeyAndNameConstraints(t *testing.T) {
+	cfg := DefaultMITMConfig()
+	cfg.KeyType = ECDSAKeyType
+	cfg.NameConstraints = []string{"example.com"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	mc, err := newMartianMITMConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mc.CACert().PermittedDNSDomains; len(got) != 1 || got[0] != "example.com" {
+		t.Fatalf("unexpected name constraints %v", got)
+	}
+
+	c, err := mc.TLS().GetCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("expected ECDSA key, got %T", c.PrivateKey)
+	}
+	if c.Leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Fatal("unexpected key encipherment key usage")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(mc.CACert())
+	if _, err := c.Leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMITMConfigClockOffset(t *testing.T) {
+	cfg := DefaultMITMConfig()
+	cfg.ClockOffset = -2 * cfg.Validity
+
+	mc, err := newMartianMITMConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := mc.TLS().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(mc.CACert())
+	_, err = c.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	var cerr x509.CertificateInvalidError
+	if !errors.As(err, &cerr) || cerr.Reason != x509.Expired {
+		t.Fatalf("expected expired certificate, got %v", err)
+	}
+	if !c.Leaf.NotAfter.Before(time.Now()) {
+		t.Fatalf("expected leaf certificate to be expired, got NotAfter %v", c.Leaf.NotAfter)
+	}
+	if mc.CACert().NotBefore.After(cfg.now()) {
+		t.Fatalf("expected CA certificate to be valid at the MITM time, got NotBefore %v", mc.CACert().NotBefore)
+	}
+}
+
+func TestMITMSecondaryCACert(t *testing.T) {
+	dir := t.TempDir()
+	writeCA := func(name string) (certFile, keyFile string) {
+		tmpl := certutil.ECDSASelfSignedCert()
+		tmpl.Hosts = nil
+		tmpl.IsCA = true
+		cert, err := tmpl.Gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certFile = filepath.Join(dir, name+".crt")
+		keyFile = filepath.Join(dir, name+".key")
+		if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	newCert, newKey := writeCA("new")
+	oldCert, _ := writeCA("old")
+
+	t.Run("requires CA cert file", func(t *testing.T) {
+		cfg := DefaultMITMConfig()
+		cfg.SecondaryCACertFile = oldCert
+		if err := cfg.Validate(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MITM = DefaultMITMConfig()
+	cfg.MITM.CACertFile = newCert
+	cfg.MITM.CAKeyFile = newKey
+	cfg.MITM.SecondaryCACertFile = oldCert
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	cas := p.MITMCACerts()
+	if len(cas) != 2 {
+		t.Fatalf("expected 2 CA certificates, got %d", len(cas))
+	}
+	if cas[0] != p.MITMCACert() {
+		t.Fatal("expected the signing CA certificate first")
+	}
+	for i, name := range []string{newCert, oldCert} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(b)
+		if !cas[i].Equal(&x509.Certificate{Raw: block.Bytes}) {
+			t.Fatalf("unexpected CA certificate %d", i)
+		}
+	}
+}
+
+func TestMITMHandshakeResult(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.New("remote error: tls: unknown certificate authority"), mitmHandshakeUntrusted},
+		{errors.New("remote error: tls: bad certificate"), mitmHandshakeUntrusted},
+		{fmt.Errorf("read: %w", errors.New("remote error: tls: certificate unknown")), mitmHandshakeUntrusted},
+		{errors.New("remote error: tls: protocol version not supported"), mitmHandshakeFailed},
+		{io.EOF, mitmHandshakeFailed},
+	}
+
+	for _, tc := range tests {
+		if got := mitmHandshakeResult(tc.err); got != tc.want {
+			t.Errorf("mitmHandshakeResult(%q) = %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestMITMFilterExcludeDomainsAndBypass(t *testing.T) {
+	now := time.Now()
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MITM = DefaultMITMConfig()
+	cfg.MITM.HandshakeFailureBypass = time.Minute
+	cfg.TestHooks = &TestHooks{Clock: func() time.Time { return now }}
+
+	var err error
+	if cfg.MITMDomains, err = parseRegexpMatcherLines(`\.com$`, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MITMExcludeDomains, err = parseRegexpMatcherLines(`(^|\.)bank\.com$`, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	connect := func(host string) *http.Request {
+		return &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: host + ":443"},
+			Host:       host + ":443",
+			Header:     make(http.Header),
+			RemoteAddr: "127.0.0.1:12345",
+		}
+	}
+
+	tests := []struct {
+		host string
+		mitm bool
+	}{
+		{"example.com", true},
+		{"example.org", false},
+		{"bank.com", false},
+		{"www.bank.com", false},
+		{"notbank.com", true},
+	}
+	for _, tc := range tests {
+		if got := p.mitmFilter(connect(tc.host)); got != tc.mitm {
+			t.Errorf("%s: got MITM %v, want %v", tc.host, got, tc.mitm)
+		}
+	}
+
+	t.Run("handshake failure bypass", func(t *testing.T) {
+		req := connect("pinned.com")
+		if !p.mitmFilter(req) {
+			t.Fatal("expected MITM before handshake failure")
+		}
+
+		p.mitmHandshakeError(req, errors.New("remote error: tls: protocol version not supported"))
+		if !p.mitmFilter(req) {
+			t.Fatal("expected MITM after handshake failure unrelated to the certificate")
+		}
+
+		p.mitmHandshakeError(req, errors.New("remote error: tls: bad certificate"))
+		if p.mitmFilter(req) {
+			t.Fatal("expected bypass after the certificate was rejected")
+		}
+
+		now = now.Add(time.Minute)
+		if !p.mitmFilter(req) {
+			t.Fatal("expected MITM after bypass expired")
+		}
+	})
+}
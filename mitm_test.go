@@ -0,0 +1,177 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/utils/certutil"
+)
+
+func TestMITMBodyLimits(t *testing.T) {
+	hp := &HTTPProxy{config: HTTPProxyConfig{
+		HTTPServerConfig: HTTPServerConfig{LogHTTPBodyLimit: Mebi},
+		MITM: &MITMConfig{
+			MaxInspectedRequestBody: 4 * Kibi,
+		},
+	}}
+
+	newRequest := func(mitm bool) *http.Request {
+		req, err := http.NewRequest(http.MethodGet, "https://example.com", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := martian.TestContext(req, nil, nil)
+		if mitm {
+			ctx.Session().Set(mitmClientHelloKey, mitmClientHello{})
+		}
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		mitm     bool
+		req, res int64
+	}{
+		{"mitm", true, int64(4 * Kibi), int64(Mebi)},
+		{"not mitm", false, int64(Mebi), int64(Mebi)},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			req, res := hp.mitmBodyLimits(newRequest(tc.mitm))
+			if req != tc.req || res != tc.res {
+				t.Fatalf("expected limits %d/%d, got %d/%d", tc.req, tc.res, req, res)
+			}
+		})
+	}
+}
+
+func TestMITMCacheDir(t *testing.T) {
+	dir := t.TempDir()
+	writeCA := func(name string) (certFile, keyFile string) {
+		tmpl := certutil.ECDSASelfSignedCert()
+		tmpl.Hosts = nil
+		tmpl.IsCA = true
+		cert, err := tmpl.Gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		certFile = filepath.Join(dir, name+".crt")
+		keyFile = filepath.Join(dir, name+".key")
+		if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	cfg := DefaultMITMConfig()
+	cfg.CacheDir = filepath.Join(dir, "cache")
+	cert := func() *x509.Certificate {
+		t.Helper()
+		mc, err := newMartianMITMConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := mc.TLS().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Leaf
+	}
+
+	cfg.CACertFile, cfg.CAKeyFile = writeCA("a")
+	c1 := cert()
+	if c2 := cert(); !c1.Equal(c2) {
+		t.Fatal("expected certificate loaded from the cache dir")
+	}
+
+	cfg.CACertFile, cfg.CAKeyFile = writeCA("b")
+	if c3 := cert(); c1.Equal(c3) {
+		t.Fatal("expected new certificate for a different CA")
+	}
+}
+
+// opaqueSigner hides the private key type like an HSM or KMS backed signer.
+type opaqueSigner struct {
+	crypto.Signer
+}
+
+func TestMITMCASigner(t *testing.T) {
+	genCA := func() tls.Certificate {
+		tmpl := certutil.ECDSASelfSignedCert()
+		tmpl.Hosts = nil
+		tmpl.IsCA = true
+		cert, err := tmpl.Gen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	ca, other := genCA(), genCA()
+
+	certFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("requires CA cert file", func(t *testing.T) {
+		cfg := DefaultMITMConfig()
+		cfg.CASigner = opaqueSigner{ca.PrivateKey.(crypto.Signer)}
+		if err := cfg.Validate(); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("signs certificates", func(t *testing.T) {
+		cfg := DefaultMITMConfig()
+		cfg.CACertFile = certFile
+		cfg.CASigner = opaqueSigner{ca.PrivateKey.(crypto.Signer)}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		mc, err := newMartianMITMConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := mc.TLS().GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(mc.CACert())
+		if _, err := c.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("key mismatch", func(t *testing.T) {
+		cfg := DefaultMITMConfig()
+		cfg.CACertFile = certFile
+		cfg.CASigner = opaqueSigner{other.PrivateKey.(crypto.Signer)}
+		if _, err := newMartianMITMConfig(cfg); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
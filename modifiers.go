@@ -0,0 +1,434 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"golang.org/x/net/html/charset"
+)
+
+// Modifier is a ready-made request or response modifier configured with a typed option struct,
+// see SetHeaderModifier, DeleteHeaderModifier, QueryParamModifier, URLRewriteModifier,
+// StaticResponseModifier, BodyReplaceModifier and CharsetNormalizeModifier.
+// Modifiers are applied in order after HTTPProxyConfig.RequestModifiers and HTTPProxyConfig.ResponseModifiers.
+type Modifier interface {
+	Validate() error
+	modifiers() (RequestModifier, ResponseModifier)
+}
+
+// ModifierScope limits a modifier to requests with host matching Domain and path matching Path.
+// If a field is nil, it matches all requests.
+type ModifierScope struct {
+	Domain *regexp.Regexp
+	Path   *regexp.Regexp
+}
+
+func (s ModifierScope) match(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	if s.Domain != nil && !s.Domain.MatchString(req.URL.Hostname()) {
+		return false
+	}
+	if s.Path != nil && !s.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	return true
+}
+
+func validateHeaderName(name string) error {
+	if name == "" {
+		return errors.New("header name is required")
+	}
+	if !headerNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	return nil
+}
+
+var headerNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// SetHeaderModifier sets a request or response header, replacing the existing values.
+type SetHeaderModifier struct {
+	ModifierScope
+	Response bool
+	Name     string
+	Value    string
+}
+
+func (m *SetHeaderModifier) Validate() error {
+	return validateHeaderName(m.Name)
+}
+
+func (m *SetHeaderModifier) modifiers() (RequestModifier, ResponseModifier) {
+	if m.Response {
+		return nil, martian.ResponseModifierFunc(func(res *http.Response) error {
+			if m.match(res.Request) {
+				res.Header.Set(m.Name, m.Value)
+			}
+			return nil
+		})
+	}
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if m.match(req) {
+			req.Header.Set(m.Name, m.Value)
+		}
+		return nil
+	}), nil
+}
+
+// DeleteHeaderModifier removes a request or response header.
+type DeleteHeaderModifier struct {
+	ModifierScope
+	Response bool
+	Name     string
+}
+
+func (m *DeleteHeaderModifier) Validate() error {
+	return validateHeaderName(m.Name)
+}
+
+func (m *DeleteHeaderModifier) modifiers() (RequestModifier, ResponseModifier) {
+	if m.Response {
+		return nil, martian.ResponseModifierFunc(func(res *http.Response) error {
+			if m.match(res.Request) {
+				res.Header.Del(m.Name)
+			}
+			return nil
+		})
+	}
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if m.match(req) {
+			req.Header.Del(m.Name)
+		}
+		return nil
+	}), nil
+}
+
+// QueryParamModifier sets a request query parameter, replacing the existing values.
+type QueryParamModifier struct {
+	ModifierScope
+	Name  string
+	Value string
+}
+
+func (m *QueryParamModifier) Validate() error {
+	if m.Name == "" {
+		return errors.New("query parameter name is required")
+	}
+	return nil
+}
+
+func (m *QueryParamModifier) modifiers() (RequestModifier, ResponseModifier) {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || !m.match(req) {
+			return nil
+		}
+		q := req.URL.Query()
+		q.Set(m.Name, m.Value)
+		req.URL.RawQuery = q.Encode()
+		return nil
+	}), nil
+}
+
+// URLRewriteModifier rewrites request URLs matching Pattern to Replacement,
+// the replacement can reference capture groups of the pattern e.g. ${1}, see regexp.Regexp.Expand.
+// If the host is rewritten, the request is sent to the new host.
+type URLRewriteModifier struct {
+	ModifierScope
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+func (m *URLRewriteModifier) Validate() error {
+	if m.Pattern == nil {
+		return errors.New("pattern is required")
+	}
+	return nil
+}
+
+func (m *URLRewriteModifier) modifiers() (RequestModifier, ResponseModifier) {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || !m.match(req) {
+			return nil
+		}
+		s := req.URL.String()
+		if !m.Pattern.MatchString(s) {
+			return nil
+		}
+		u, err := url.Parse(m.Pattern.ReplaceAllString(s, m.Replacement))
+		if err != nil {
+			return fmt.Errorf("rewrite URL %s: %w", s, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("rewrite URL %s: not an absolute URL: %s", s, u)
+		}
+		req.URL = u
+		req.Host = u.Host
+		return nil
+	}), nil
+}
+
+const staticResponseKey = "static-response"
+
+// StaticResponseModifier responds to matching requests without contacting the server.
+type StaticResponseModifier struct {
+	ModifierScope
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+func (m *StaticResponseModifier) Validate() error {
+	if m.StatusCode < 100 || m.StatusCode > 999 {
+		return fmt.Errorf("invalid status code %d", m.StatusCode)
+	}
+	return nil
+}
+
+func (m *StaticResponseModifier) modifiers() (RequestModifier, ResponseModifier) {
+	reqmod := martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || !m.match(req) {
+			return nil
+		}
+		ctx := martian.NewContext(req)
+		if ctx == nil {
+			return nil
+		}
+		ctx.SkipRoundTrip()
+		ctx.Set(staticResponseKey, m)
+		return nil
+	})
+
+	resmod := martian.ResponseModifierFunc(func(res *http.Response) error {
+		if res.Request == nil {
+			return nil
+		}
+		ctx := martian.NewContext(res.Request)
+		if ctx == nil {
+			return nil
+		}
+		if v, ok := ctx.Get(staticResponseKey); !ok || v != m {
+			return nil
+		}
+
+		res.StatusCode = m.StatusCode
+		res.Status = strconv.Itoa(m.StatusCode) + " " + http.StatusText(m.StatusCode)
+		res.Header = m.Header.Clone()
+		if res.Header == nil {
+			res.Header = make(http.Header)
+		}
+		if res.Body != nil {
+			res.Body.Close()
+		}
+		res.Body = io.NopCloser(bytes.NewReader(m.Body))
+		res.ContentLength = int64(len(m.Body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(m.Body)))
+		res.TransferEncoding = nil
+		return nil
+	})
+
+	return reqmod, resmod
+}
+
+// BodyReplaceModifier replaces matches of Pattern in request or response bodies with Replacement,
+// the replacement can reference capture groups of the pattern e.g. ${1}, see regexp.Regexp.Expand.
+// Bodies larger than MaxBodySize and encoded bodies e.g. gzip are not modified.
+type BodyReplaceModifier struct {
+	ModifierScope
+	Response    bool
+	Pattern     *regexp.Regexp
+	Replacement []byte
+	MaxBodySize SizeSuffix
+}
+
+func (m *BodyReplaceModifier) Validate() error {
+	if m.Pattern == nil {
+		return errors.New("pattern is required")
+	}
+	if m.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+func (m *BodyReplaceModifier) modifiers() (RequestModifier, ResponseModifier) {
+	if m.Response {
+		return nil, martian.ResponseModifierFunc(func(res *http.Response) error {
+			if !m.match(res.Request) || res.Request.Method == http.MethodHead {
+				return nil
+			}
+			n, err := m.replace(res.Header, &res.Body)
+			if n >= 0 {
+				res.ContentLength = n
+				res.TransferEncoding = nil
+			}
+			return err
+		})
+	}
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.Method == http.MethodConnect || !m.match(req) {
+			return nil
+		}
+		n, err := m.replace(req.Header, &req.Body)
+		if n >= 0 {
+			req.ContentLength = n
+			req.TransferEncoding = nil
+		}
+		return err
+	}), nil
+}
+
+// replace replaces the body, it returns the new body length or -1 if the body is not modified.
+func (m *BodyReplaceModifier) replace(h http.Header, body *io.ReadCloser) (int64, error) {
+	if *body == nil || *body == http.NoBody {
+		return -1, nil
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return -1, nil
+	}
+
+	b, err := readBodyLimit(body, m.MaxBodySize)
+	if b == nil || err != nil {
+		return -1, err
+	}
+
+	b = m.Pattern.ReplaceAll(b, m.Replacement)
+	*body = io.NopCloser(bytes.NewReader(b))
+	h.Set("Content-Length", strconv.Itoa(len(b)))
+	h.Del("Transfer-Encoding")
+
+	return int64(len(b)), nil
+}
+
+// readBodyLimit reads and closes the body if it is not larger than limit.
+// Otherwise, the body is restored to be read again and nil is returned.
+func readBodyLimit(body *io.ReadCloser, limit SizeSuffix) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(*body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > int64(limit) {
+		*body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b), *body), *body}
+		return nil, nil
+	}
+	(*body).Close()
+
+	return b, nil
+}
+
+// CharsetNormalizeModifier transcodes text response bodies in legacy charsets e.g. ISO-8859-1 or Shift_JIS to UTF-8,
+// and sets the charset parameter of the Content-Type header to utf-8.
+// The charset is taken from the Content-Type header, the byte order mark or the HTML meta tag.
+// Bodies larger than MaxBodySize, encoded bodies e.g. gzip, and bodies with unknown charset are not modified.
+type CharsetNormalizeModifier struct {
+	ModifierScope
+	MaxBodySize SizeSuffix
+}
+
+func (m *CharsetNormalizeModifier) Validate() error {
+	if m.MaxBodySize <= 0 {
+		return errors.New("max body size must be positive")
+	}
+	return nil
+}
+
+func (m *CharsetNormalizeModifier) modifiers() (RequestModifier, ResponseModifier) {
+	return nil, martian.ResponseModifierFunc(func(res *http.Response) error {
+		if !m.match(res.Request) || res.Request.Method == http.MethodHead {
+			return nil
+		}
+		n, err := m.normalize(res.Header, &res.Body)
+		if n >= 0 {
+			res.ContentLength = n
+			res.TransferEncoding = nil
+		}
+		return err
+	})
+}
+
+// normalize transcodes the body to UTF-8, it returns the new body length or -1 if the body is not modified.
+func (m *CharsetNormalizeModifier) normalize(h http.Header, body *io.ReadCloser) (int64, error) {
+	if *body == nil || *body == http.NoBody {
+		return -1, nil
+	}
+	if ce := h.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return -1, nil
+	}
+	ct := h.Get("Content-Type")
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil || !isTextMediaType(mt) {
+		return -1, nil //nolint:nilerr // not a text body
+	}
+
+	b, err := readBodyLimit(body, m.MaxBodySize)
+	if b == nil || err != nil {
+		return -1, err
+	}
+	restore := func() {
+		*body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	enc, name, certain := charset.DetermineEncoding(b, ct)
+	// The charset of an HTML meta tag is not reported as certain, windows-1252 is the default if there is none.
+	if !certain && mt == "text/html" && (name != "windows-1252" || declaresCharset(b)) {
+		certain = true
+	}
+	if !certain || name == "utf-8" || name == "replacement" {
+		restore()
+		return -1, nil
+	}
+	u, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		restore()
+		return -1, fmt.Errorf("transcode %s body to UTF-8: %w", name, err)
+	}
+	u = bytes.TrimPrefix(u, []byte("\uFEFF"))
+
+	params["charset"] = "utf-8"
+	*body = io.NopCloser(bytes.NewReader(u))
+	h.Set("Content-Type", mime.FormatMediaType(mt, params))
+	h.Set("Content-Length", strconv.Itoa(len(u)))
+	h.Del("Transfer-Encoding")
+
+	return int64(len(u)), nil
+}
+
+// declaresCharset returns true if the beginning of the HTML document, that is scanned for a meta tag, has a charset declaration.
+func declaresCharset(b []byte) bool {
+	const maxPrescan = 1024
+	if len(b) > maxPrescan {
+		b = b[:maxPrescan]
+	}
+	return bytes.Contains(bytes.ToLower(b), []byte("charset="))
+}
+
+func isTextMediaType(mt string) bool {
+	if strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+xml") || strings.HasSuffix(mt, "+json") {
+		return true
+	}
+	switch mt {
+	case "application/xml", "application/json", "application/javascript", "application/x-javascript", "application/ecmascript":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestModifiersValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Modifier
+		err  string
+	}{
+		{"set header", &SetHeaderModifier{Name: "X-Foo"}, ""},
+		{"set header no name", &SetHeaderModifier{}, "header name is required"},
+		{"delete header invalid name", &DeleteHeaderModifier{Name: "X Foo"}, "invalid header name"},
+		{"query param no name", &QueryParamModifier{Value: "1"}, "query parameter name is required"},
+		{"url rewrite no pattern", &URLRewriteModifier{}, "pattern is required"},
+		{"static response invalid status", &StaticResponseModifier{StatusCode: 42}, "invalid status code"},
+		{"body replace no limit", &BodyReplaceModifier{Pattern: regexp.MustCompile("a")}, "max body size must be positive"},
+		{"charset normalize no limit", &CharsetNormalizeModifier{}, "max body size must be positive"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultHTTPProxyConfig()
+			cfg.Modifiers = []Modifier{tc.m}
+			err := cfg.Validate()
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+			if !strings.HasPrefix(err.Error(), "modifiers[0]: ") {
+				t.Fatalf("expected modifiers[0] prefix, got %v", err)
+			}
+		})
+	}
+}
+
+func TestModifiers(t *testing.T) {
+	var upstream []*http.Request
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			req.Body = io.NopCloser(strings.NewReader(string(b)))
+			upstream = append(upstream, req)
+
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"X-Server": {"upstream"}, "Content-Type": {"text/plain"}},
+				Body:          io.NopCloser(strings.NewReader("hello world")),
+				ContentLength: int64(len("hello world")),
+				Request:       req,
+			}, nil
+		},
+	}
+	cfg.Modifiers = []Modifier{
+		&SetHeaderModifier{Name: "X-Added", Value: "1"},
+		&DeleteHeaderModifier{Name: "X-Secret"},
+		&SetHeaderModifier{Response: true, Name: "X-Proxy", Value: "forwarder"},
+		&DeleteHeaderModifier{Response: true, Name: "X-Server"},
+		&QueryParamModifier{
+			ModifierScope: ModifierScope{Domain: regexp.MustCompile(`^example\.com$`)},
+			Name:          "token",
+			Value:         "abc",
+		},
+		&URLRewriteModifier{
+			Pattern:     regexp.MustCompile(`^http://old\.example\.com/(.*)$`),
+			Replacement: "http://new.example.com/v2/${1}",
+		},
+		&StaticResponseModifier{
+			ModifierScope: ModifierScope{Path: regexp.MustCompile(`^/static$`)},
+			StatusCode:    http.StatusTeapot,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			Body:          []byte("static"),
+		},
+		&BodyReplaceModifier{
+			Pattern:     regexp.MustCompile(`secret`),
+			Replacement: []byte("xxx"),
+			MaxBodySize: Kibi,
+		},
+		&BodyReplaceModifier{
+			ModifierScope: ModifierScope{Path: regexp.MustCompile(`^/replace$`)},
+			Response:      true,
+			Pattern:       regexp.MustCompile(`world`),
+			Replacement:   []byte("forwarder"),
+			MaxBodySize:   Kibi,
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	do := func(t *testing.T, method, u, body string) (*http.Response, string) {
+		t.Helper()
+		upstream = nil
+		req, err := http.NewRequest(method, u, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Secret", "s3cr3t")
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(b)
+	}
+
+	t.Run("headers", func(t *testing.T) {
+		res, _ := do(t, http.MethodGet, "http://other.com/", "")
+		if len(upstream) != 1 {
+			t.Fatalf("expected 1 upstream request, got %d", len(upstream))
+		}
+		req := upstream[0]
+		if v := req.Header.Get("X-Added"); v != "1" {
+			t.Fatalf("expected X-Added header 1, got %q", v)
+		}
+		if v := req.Header.Get("X-Secret"); v != "" {
+			t.Fatalf("expected X-Secret header to be removed, got %q", v)
+		}
+		if req.URL.RawQuery != "" {
+			t.Fatalf("expected no query, got %q", req.URL.RawQuery)
+		}
+		if v := res.Header.Get("X-Proxy"); v != "forwarder" {
+			t.Fatalf("expected X-Proxy header forwarder, got %q", v)
+		}
+		if v := res.Header.Get("X-Server"); v != "" {
+			t.Fatalf("expected X-Server header to be removed, got %q", v)
+		}
+	})
+
+	t.Run("query param", func(t *testing.T) {
+		do(t, http.MethodGet, "http://example.com/?token=old&a=1", "")
+		if q := upstream[0].URL.Query(); q.Get("token") != "abc" || q.Get("a") != "1" {
+			t.Fatalf("unexpected query %q", upstream[0].URL.RawQuery)
+		}
+	})
+
+	t.Run("url rewrite", func(t *testing.T) {
+		do(t, http.MethodGet, "http://old.example.com/path?q=1", "")
+		if u := upstream[0].URL.String(); u != "http://new.example.com/v2/path?q=1" {
+			t.Fatalf("expected rewritten URL, got %s", u)
+		}
+		if h := upstream[0].Host; h != "new.example.com" {
+			t.Fatalf("expected host new.example.com, got %s", h)
+		}
+	})
+
+	t.Run("static response", func(t *testing.T) {
+		res, body := do(t, http.MethodGet, "http://other.com/static", "")
+		if len(upstream) != 0 {
+			t.Fatalf("expected no upstream request, got %d", len(upstream))
+		}
+		if res.StatusCode != http.StatusTeapot {
+			t.Fatalf("expected status %d, got %d", http.StatusTeapot, res.StatusCode)
+		}
+		if body != "static" {
+			t.Fatalf("expected body %q, got %q", "static", body)
+		}
+	})
+
+	t.Run("body replace", func(t *testing.T) {
+		_, body := do(t, http.MethodPost, "http://other.com/replace", "my secret password")
+		b, err := io.ReadAll(upstream[0].Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "my xxx password" {
+			t.Fatalf("expected request body %q, got %q", "my xxx password", b)
+		}
+		if body != "hello forwarder" {
+			t.Fatalf("expected response body %q, got %q", "hello forwarder", body)
+		}
+	})
+}
+
+func TestBodyReplaceModifierLimit(t *testing.T) {
+	m := &BodyReplaceModifier{
+		Pattern:     regexp.MustCompile(`a`),
+		Replacement: []byte("b"),
+		MaxBodySize: 4,
+	}
+
+	for _, tc := range []struct {
+		body, encoding, expected string
+		modified                 bool
+	}{
+		{"aaaa", "", "bbbb", true},
+		{"aaaaa", "", "aaaaa", false},
+		{"aaaa", "gzip", "aaaa", false},
+	} {
+		h := http.Header{}
+		if tc.encoding != "" {
+			h.Set("Content-Encoding", tc.encoding)
+		}
+		body := io.NopCloser(strings.NewReader(tc.body))
+		n, err := m.replace(h, &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (n >= 0) != tc.modified {
+			t.Fatalf("%q: expected modified %v, got %d", tc.body, tc.modified, n)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.expected {
+			t.Fatalf("expected %q, got %q", tc.expected, b)
+		}
+	}
+}
+
+func TestCharsetNormalizeModifier(t *testing.T) {
+	m := &CharsetNormalizeModifier{
+		MaxBodySize: Kibi,
+	}
+
+	for _, tc := range []struct {
+		name, contentType, body string
+		expectedContentType     string
+		expected                string
+	}{
+		{"latin1", "text/plain; charset=ISO-8859-1", "caf\xe9", "text/plain; charset=utf-8", "café"},
+		{"shift_jis", "text/html; charset=Shift_JIS", "\x93\xfa\x96\x7b", "text/html; charset=utf-8", "日本"},
+		{"meta", "text/html", "<meta charset=windows-1250>\x9a", "text/html; charset=utf-8", "<meta charset=windows-1250>š"},
+		{"utf-16 bom", "application/json", "\xff\xfe{\x00}\x00", "application/json; charset=utf-8", "{}"},
+		{"utf-8", "text/plain; charset=utf-8", "café", "text/plain; charset=utf-8", "café"},
+		{"no charset", "text/plain", "caf\xe9", "text/plain", "caf\xe9"},
+		{"unknown charset", "text/plain; charset=foo", "caf\xe9", "text/plain; charset=foo", "caf\xe9"},
+		{"binary", "image/png; charset=ISO-8859-1", "caf\xe9", "image/png; charset=ISO-8859-1", "caf\xe9"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			h.Set("Content-Type", tc.contentType)
+			body := io.NopCloser(strings.NewReader(tc.body))
+			if _, err := m.normalize(h, &body); err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected body %q, got %q", tc.expected, b)
+			}
+			if ct := h.Get("Content-Type"); ct != tc.expectedContentType {
+				t.Errorf("expected Content-Type %q, got %q", tc.expectedContentType, ct)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// originAuthMaxHosts limits the number of hosts remembered to use connection-oriented authentication.
+const originAuthMaxHosts = 10000
+
+const originAuthTransportsKey = "origin-auth-transports"
+
+// isConnAuthScheme reports whether the Authorization or WWW-Authenticate header value uses a connection-oriented
+// authentication scheme, i.e. NTLM or Negotiate, that authenticates the connection instead of the request.
+func isConnAuthScheme(v string) bool {
+	scheme, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+	return strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate")
+}
+
+// originAuthAffinity pins client connections to dedicated upstream connections for origin servers
+// using connection-oriented authentication, so that the handshake and the authenticated connection
+// are not shared with other clients by the transport connection pool.
+type originAuthAffinity struct {
+	hp *HTTPProxy
+
+	mu    sync.Mutex
+	hosts map[string]struct{}
+}
+
+// sessionTransports are the dedicated transports of a client connection, by the transport they are cloned from.
+type sessionTransports struct {
+	mu  sync.Mutex
+	trs map[*http.Transport]*http.Transport
+}
+
+func (a *originAuthAffinity) isPinned(req *http.Request) bool {
+	if isConnAuthScheme(req.Header.Get("Authorization")) {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.hosts[req.URL.Host]
+	return ok
+}
+
+func (a *originAuthAffinity) learn(res *http.Response) {
+	if res.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	conn := false
+	for _, v := range res.Header.Values("WWW-Authenticate") {
+		if isConnAuthScheme(v) {
+			conn = true
+			break
+		}
+	}
+	if !conn {
+		return
+	}
+
+	host := res.Request.URL.Host
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.hosts[host]; ok || len(a.hosts) >= originAuthMaxHosts {
+		return
+	}
+	a.hosts[host] = struct{}{}
+	a.hp.log.Infof("origin %s uses connection-oriented authentication, pinning client connections", host)
+}
+
+// transport returns the dedicated transport of the client connection cloned from tr.
+func (a *originAuthAffinity) transport(s *martian.Session, tr *http.Transport) *http.Transport {
+	a.mu.Lock()
+	v, ok := s.Get(originAuthTransportsKey)
+	if !ok {
+		v = &sessionTransports{trs: make(map[*http.Transport]*http.Transport)}
+		s.Set(originAuthTransportsKey, v)
+		st := v.(*sessionTransports) //nolint:forcetypeassert // it's *sessionTransports
+		s.OnClose(func() {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			for _, c := range st.trs {
+				c.CloseIdleConnections()
+			}
+		})
+	}
+	a.mu.Unlock()
+
+	st := v.(*sessionTransports) //nolint:forcetypeassert // it's *sessionTransports
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	c, ok := st.trs[tr]
+	if !ok {
+		c = pinnedTransport(tr)
+		st.trs[tr] = c
+	}
+	return c
+}
+
+// pinnedTransport returns a copy of tr that uses a single HTTP/1.1 connection per host,
+// connection-oriented authentication is not supported over HTTP/2.
+func pinnedTransport(tr *http.Transport) *http.Transport {
+	c := tr.Clone()
+	c.MaxConnsPerHost = 1
+	c.MaxIdleConnsPerHost = 1
+	c.ForceAttemptHTTP2 = false
+	c.TLSNextProto = make(map[string]func(authority string, c *tls.Conn) http.RoundTripper)
+	if c.TLSClientConfig != nil {
+		c.TLSClientConfig.NextProtos = nil
+	}
+	return c
+}
+
+func (hp *HTTPProxy) configureOriginAuthAffinity() {
+	a := &originAuthAffinity{
+		hp:    hp,
+		hosts: make(map[string]struct{}),
+	}
+
+	next := hp.proxy.RoundTripFunc
+	hp.proxy.RoundTripFunc = func(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+		if tr, ok := rt.(*http.Transport); ok && a.isPinned(req) {
+			if ctx := martian.NewContext(req); ctx != nil {
+				rt = a.transport(ctx.Session(), tr)
+			}
+		}
+
+		var (
+			res *http.Response
+			err error
+		)
+		if next != nil {
+			res, err = next(rt, req)
+		} else {
+			res, err = rt.RoundTrip(req)
+		}
+		if err == nil {
+			a.learn(res)
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestIsConnAuthScheme(t *testing.T) {
+	tests := map[string]bool{
+		"NTLM":                        true,
+		"NTLM TlRMTVNTUAABAAAAB4IIog": true,
+		"negotiate YIIFHwYGKwYBBQUC":  true,
+		"Basic realm=\"test\"":        false,
+		"Bearer token":                false,
+		"":                            false,
+	}
+	for v, want := range tests {
+		if got := isConnAuthScheme(v); got != want {
+			t.Errorf("isConnAuthScheme(%q) = %t, want %t", v, got, want)
+		}
+	}
+}
+
+// ntlmOrigin emulates connection-oriented authentication, it authenticates connections after a two step handshake.
+func ntlmOrigin() *httptest.Server {
+	var (
+		mu    sync.Mutex
+		state = make(map[string]string)
+	)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch auth := r.Header.Get("Authorization"); {
+		case state[r.RemoteAddr] == "authenticated":
+			return
+		case auth == "NTLM negotiate":
+			state[r.RemoteAddr] = "challenged"
+			w.Header().Set("WWW-Authenticate", "NTLM challenge")
+		case auth == "NTLM authenticate" && state[r.RemoteAddr] == "challenged":
+			state[r.RemoteAddr] = "authenticated"
+			return
+		default:
+			w.Header().Set("WWW-Authenticate", "NTLM")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+}
+
+func TestOriginAuthAffinity(t *testing.T) {
+	origin := ntlmOrigin()
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	type client struct {
+		conn net.Conn
+		br   *bufio.Reader
+	}
+	newClient := func() *client {
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &client{conn: conn, br: bufio.NewReader(conn)}
+	}
+	do := func(c *client, auth string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		go req.WriteProxy(c.conn) //nolint:errcheck // the response is checked
+		res, err := http.ReadResponse(c.br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	a, b := newClient(), newClient()
+
+	for _, step := range []struct {
+		c    *client
+		auth string
+		code int
+	}{
+		{a, "", http.StatusUnauthorized},
+		{a, "NTLM negotiate", http.StatusUnauthorized},
+		{a, "NTLM authenticate", http.StatusOK},
+		{a, "", http.StatusOK},
+		{b, "", http.StatusUnauthorized},
+		{a, "", http.StatusOK},
+	} {
+		name := "a"
+		if step.c == b {
+			name = "b"
+		}
+		if code := do(step.c, step.auth); code != step.code {
+			t.Fatalf("client %s auth %q: expected status %d, got %d", name, step.auth, step.code, code)
+		}
+	}
+}
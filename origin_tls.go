@@ -0,0 +1,256 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// OriginTLSRule overrides the TLS configuration of HTTPS connections to origin servers with host matching the regexp,
+// i.e. connections of MITMed requests. It allows connecting to legacy origins requiring e.g. TLS 1.0 or specific SNI.
+type OriginTLSRule struct {
+	Host *regexp.Regexp
+
+	// MinVersion and MaxVersion are TLS versions e.g. tls.VersionTLS10, zero means the default.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CipherSuites are the enabled TLS 1.0-1.2 cipher suites, if empty the default suites are used.
+	CipherSuites []uint16
+
+	// ServerName is the name sent in SNI and verified in the server certificate instead of the request host.
+	ServerName string
+
+	// CertFile and KeyFile are the client certificate and key presented to the origin server,
+	// so that MITMed requests to backends requiring mutual TLS keep working.
+	CertFile string
+	KeyFile  string
+
+	// Fingerprint is the name of a browser whose TLS ClientHello is mimicked, see tlsFingerprints for the supported names.
+	// It is used for origins blocking the Go TLS fingerprint, and applies only to connections that are not sent via an upstream proxy.
+	// It cannot be combined with TLS versions and cipher suites, as they are defined by the fingerprint.
+	Fingerprint string
+}
+
+// ParseOriginTLSRule parses a <pattern>;<option>;... string into OriginTLSRule,
+// options are min=<version>, max=<version>, ciphers=<name>:<name>..., sni=<name>, cert=<path>, key=<path> and fingerprint=<name>.
+// The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains.
+func ParseOriginTLSRule(val string) (*OriginTLSRule, error) {
+	pattern, opts, ok := strings.Cut(val, ";")
+	if !ok || pattern == "" || opts == "" {
+		return nil, errors.New("expected <pattern>;<option>;... with options min=<version>, max=<version>, ciphers=<name>:<name>..., sni=<name>, cert=<path>, key=<path>, fingerprint=<name>")
+	}
+
+	re, err := compileDomainPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	r := &OriginTLSRule{Host: re}
+
+	for _, o := range strings.Split(opts, ";") {
+		k, v, ok := strings.Cut(o, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid option %q", o)
+		}
+		switch k {
+		case "min":
+			r.MinVersion, err = parseTLSVersion(v)
+		case "max":
+			r.MaxVersion, err = parseTLSVersion(v)
+		case "ciphers":
+			r.CipherSuites, err = parseCipherSuites(strings.Split(v, ":"))
+		case "sni":
+			r.ServerName = v
+		case "cert":
+			r.CertFile = v
+		case "key":
+			r.KeyFile = v
+		case "fingerprint":
+			r.Fingerprint, err = parseTLSFingerprint(v)
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *OriginTLSRule) Validate() error {
+	if r.Host == nil {
+		return errors.New("host pattern is required")
+	}
+	if r.MinVersion != 0 && r.MaxVersion != 0 && r.MinVersion > r.MaxVersion {
+		return errors.New("min version is greater than max version")
+	}
+	if (r.CertFile == "") != (r.KeyFile == "") {
+		return errors.New("client certificate requires both cert and key")
+	}
+	if r.Fingerprint != "" && (r.MinVersion != 0 || r.MaxVersion != 0 || len(r.CipherSuites) > 0) {
+		return errors.New("fingerprint cannot be combined with min, max or ciphers")
+	}
+	return nil
+}
+
+func (r *OriginTLSRule) String() string {
+	s := r.Host.String()
+	if r.MinVersion != 0 {
+		s += ";min=" + formatTLSVersion(r.MinVersion)
+	}
+	if r.MaxVersion != 0 {
+		s += ";max=" + formatTLSVersion(r.MaxVersion)
+	}
+	if len(r.CipherSuites) > 0 {
+		names := make([]string, len(r.CipherSuites))
+		for i, id := range r.CipherSuites {
+			names[i] = tls.CipherSuiteName(id)
+		}
+		s += ";ciphers=" + strings.Join(names, ":")
+	}
+	if r.ServerName != "" {
+		s += ";sni=" + r.ServerName
+	}
+	if r.CertFile != "" {
+		s += ";cert=" + redactData(r.CertFile) + ";key=" + redactData(r.KeyFile)
+	}
+	if r.Fingerprint != "" {
+		s += ";fingerprint=" + r.Fingerprint
+	}
+	return s
+}
+
+func redactData(name string) string {
+	if strings.HasPrefix(name, "data:") {
+		return "data:xxxxx"
+	}
+	return name
+}
+
+func (r *OriginTLSRule) configureTLSConfig(tlsCfg *tls.Config) error {
+	if r.MinVersion != 0 {
+		tlsCfg.MinVersion = r.MinVersion
+	}
+	if r.MaxVersion != 0 {
+		tlsCfg.MaxVersion = r.MaxVersion
+	}
+	if len(r.CipherSuites) > 0 {
+		tlsCfg.CipherSuites = r.CipherSuites
+	}
+	if r.ServerName != "" {
+		tlsCfg.ServerName = r.ServerName
+	}
+	if r.CertFile != "" {
+		cert, err := loadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	if id, ok := tlsVersions[v]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, supported versions are: 1.0, 1.1, 1.2, 1.3", v)
+}
+
+func formatTLSVersion(id uint16) string {
+	for k, v := range tlsVersions {
+		if v == id {
+			return k
+		}
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
+
+// parseCipherSuites returns the IDs of the cipher suites with the names as in tls.CipherSuiteName,
+// insecure cipher suites are allowed, as legacy servers may not support others.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	byName := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		byName[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, len(names))
+	for i, n := range names {
+		id, ok := byName[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// configureOriginTLSRules sends HTTPS requests to hosts matching a rule with a copy of the transport
+// using the rule TLS configuration, the first matching rule is used.
+func (hp *HTTPProxy) configureOriginTLSRules() error {
+	tr, ok := hp.transport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("origin TLS rules require *http.Transport, got %T", hp.transport)
+	}
+
+	// The transport is cloned after Martian configured it, so that the copies use the same dialer and proxy function.
+	trs := make([]*http.Transport, len(hp.config.OriginTLSRules))
+	for i, r := range hp.config.OriginTLSRules {
+		hp.log.Infof("using origin TLS rule: %s", r)
+		c := tr.Clone()
+		if c.TLSClientConfig == nil {
+			c.TLSClientConfig = new(tls.Config)
+		}
+		if err := r.configureTLSConfig(c.TLSClientConfig); err != nil {
+			return fmt.Errorf("origin TLS rule %s: %w", r, err)
+		}
+		if r.Fingerprint != "" {
+			d, err := tlsFingerprintDialer(r.Fingerprint, c.TLSClientConfig, c.DialContext)
+			if err != nil {
+				return fmt.Errorf("origin TLS rule %s: %w", r, err)
+			}
+			c.DialTLSContext = d
+		}
+		trs[i] = c
+	}
+
+	next := hp.proxy.RoundTripFunc
+	hp.proxy.RoundTripFunc = func(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+		if req.URL.Scheme == "https" {
+			h := req.URL.Hostname()
+			for i, r := range hp.config.OriginTLSRules {
+				if r.Host.MatchString(h) {
+					rt = trs[i]
+					break
+				}
+			}
+		}
+		if next != nil {
+			return next(rt, req)
+		}
+		return rt.RoundTrip(req)
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/utils/certutil"
+)
+
+func TestParseOriginTLSRule(t *testing.T) {
+	tests := []struct {
+		val string
+		str string
+		err bool
+	}{
+		{val: "legacy.example.com;min=1.0;max=1.1", str: "legacy.example.com;min=1.0;max=1.1"},
+		{val: "*.example.com;sni=example.com", str: `(^|\.)example\.com$;sni=example.com`},
+		{val: "foo;ciphers=TLS_RSA_WITH_AES_128_CBC_SHA:TLS_RSA_WITH_RC4_128_SHA", str: "foo;ciphers=TLS_RSA_WITH_AES_128_CBC_SHA:TLS_RSA_WITH_RC4_128_SHA"},
+		{val: "foo", err: true},
+		{val: "foo;", err: true},
+		{val: "foo;min=0.9", err: true},
+		{val: "foo;min=1.2;max=1.0", err: true},
+		{val: "foo;ciphers=TLS_FOO", err: true},
+		{val: "foo;cert=a.crt;key=data:abc=", str: "foo;cert=a.crt;key=data:xxxxx"},
+		{val: "foo;cert=a.crt", err: true},
+		{val: "foo;fingerprint=chrome;sni=bar", str: "foo;sni=bar;fingerprint=chrome"},
+		{val: "foo;fingerprint=opera", err: true},
+		{val: "foo;fingerprint=firefox;max=1.2", err: true},
+		{val: "foo;bar=baz", err: true},
+		{val: "(;sni=foo", err: true},
+	}
+
+	for _, tc := range tests {
+		r, err := ParseOriginTLSRule(tc.val)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.val, err)
+			continue
+		}
+		if got := r.String(); got != tc.str {
+			t.Errorf("%q: got %q, want %q", tc.val, got, tc.str)
+		}
+	}
+}
+
+func TestOriginTLSRules(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-TLS-Version", strconv.Itoa(int(r.TLS.Version)))
+		w.Header().Set("X-Client-Certs", strconv.Itoa(len(r.TLS.PeerCertificates)))
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+
+	_, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server certificate is valid for example.com and 127.0.0.1, but not localhost.
+	newRule := func(val string) *OriginTLSRule {
+		r, err := ParseOriginTLSRule(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	certFile, keyFile := writeClientCert(t)
+	cfg.OriginTLSRules = []*OriginTLSRule{
+		newRule("^localhost$;sni=example.com;max=1.2;cert=" + certFile + ";key=" + keyFile),
+	}
+
+	rt, err := NewHTTPTransport(DefaultHTTPTransportConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.TLSClientConfig.RootCAs = x509.NewCertPool()
+	rt.TLSClientConfig.RootCAs.AddCert(s.Certificate())
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, rt, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(t *testing.T, host string) *http.Response {
+		t.Helper()
+
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Send the https URL to the proxy instead of tunneling it with CONNECT.
+		req, err := http.NewRequest(http.MethodGet, "https://"+net.JoinHostPort(host, port)+"/", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go req.WriteProxy(conn) //nolint:errcheck // the response is checked
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	t.Run("rule", func(t *testing.T) {
+		res := get(t, "localhost")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if v := res.Header.Get("X-TLS-Version"); v != strconv.Itoa(tls.VersionTLS12) {
+			t.Fatalf("expected TLS 1.2, got %q", v)
+		}
+		if v := res.Header.Get("X-Client-Certs"); v != "1" {
+			t.Fatalf("expected client certificate, got %q certificates", v)
+		}
+	})
+
+	t.Run("no rule", func(t *testing.T) {
+		res := get(t, "127.0.0.1")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		if v := res.Header.Get("X-TLS-Version"); v != strconv.Itoa(tls.VersionTLS13) {
+			t.Fatalf("expected TLS 1.3, got %q", v)
+		}
+		if v := res.Header.Get("X-Client-Certs"); v != "0" {
+			t.Fatalf("expected no client certificate, got %q certificates", v)
+		}
+	})
+}
+
+func TestOriginTLSFingerprint(t *testing.T) {
+	var grease atomic.Bool
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-GREASE", strconv.FormatBool(grease.Load()))
+	}))
+	s.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			// GREASE cipher suites are sent by browsers, but not by crypto/tls.
+			g := false
+			for _, cs := range hello.CipherSuites {
+				if cs&0x0f0f == 0x0a0a {
+					g = true
+				}
+			}
+			grease.Store(g)
+			return nil, nil
+		},
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	r, err := ParseOriginTLSRule(`^127\.0\.0\.1$;fingerprint=chrome`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.OriginTLSRules = []*OriginTLSRule{r}
+
+	rt, err := NewHTTPTransport(DefaultHTTPTransportConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.TLSClientConfig.RootCAs = x509.NewCertPool()
+	rt.TLSClientConfig.RootCAs.AddCert(s.Certificate())
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, rt, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go req.WriteProxy(conn) //nolint:errcheck // the response is checked
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if v := res.Header.Get("X-GREASE"); v != "true" {
+		t.Fatalf("expected GREASE cipher suites in ClientHello, got %q", v)
+	}
+	if v := res.Header.Get("X-Proto"); v != "HTTP/1.1" {
+		t.Fatalf("expected HTTP/1.1, got %q", v)
+	}
+}
+
+func writeClientCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	cert, err := certutil.ECDSASelfSignedCert().Gen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.crt")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
@@ -0,0 +1,270 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"golang.org/x/time/rate"
+)
+
+// PriorityClass is the priority of requests when the proxy is saturated.
+type PriorityClass string
+
+const (
+	PriorityInteractive PriorityClass = "interactive"
+	PriorityDefault     PriorityClass = "default"
+	PriorityBulk        PriorityClass = "bulk"
+)
+
+var priorityClasses = []PriorityClass{PriorityInteractive, PriorityDefault, PriorityBulk}
+
+func (c PriorityClass) rank() int {
+	for i, v := range priorityClasses {
+		if v == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// PriorityRule assigns the priority class to requests to hosts matching the regexp.
+type PriorityRule struct {
+	Class PriorityClass
+	Host  *regexp.Regexp
+}
+
+// ParsePriorityRule parses a <class>:<regexp> string into PriorityRule.
+func ParsePriorityRule(val string) (*PriorityRule, error) {
+	c, expr, ok := strings.Cut(val, ":")
+	if !ok || expr == "" {
+		return nil, errors.New("expected <class>:<regexp>")
+	}
+	class := PriorityClass(c)
+	if class.rank() < 0 {
+		return nil, fmt.Errorf("unsupported class %q, supported classes are: %s, %s, %s", c, PriorityInteractive, PriorityDefault, PriorityBulk)
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &PriorityRule{Class: class, Host: re}, nil
+}
+
+// PriorityConfig limits the number of concurrent requests, so that when the proxy is saturated
+// waiting requests are admitted in the order of their priority class, and bulk traffic is throttled.
+type PriorityConfig struct {
+	// Rules assign priority classes to requests, the first matching rule is used.
+	// Requests not matching any rule are in the default class.
+	Rules []*PriorityRule
+
+	// MaxConcurrent is the maximal number of requests proxied at the same time.
+	// HTTP requests are active until the response body is read, CONNECT requests until the tunnel is established.
+	MaxConcurrent int
+
+	// BulkBandwidth is the bandwidth in bytes per second shared by response bodies of bulk requests
+	// while the proxy is saturated, zero means no limit.
+	BulkBandwidth SizeSuffix
+}
+
+func DefaultPriorityConfig() *PriorityConfig {
+	return &PriorityConfig{}
+}
+
+func (c *PriorityConfig) Validate() error {
+	if c.MaxConcurrent <= 0 {
+		return errors.New("max_concurrent must be positive")
+	}
+	return nil
+}
+
+func (c *PriorityConfig) class(req *http.Request) PriorityClass {
+	h := req.URL.Hostname()
+	for _, r := range c.Rules {
+		if r.Host.MatchString(h) {
+			return r.Class
+		}
+	}
+	return PriorityDefault
+}
+
+// priorityScheduler admits up to max requests, waiting requests are admitted by class and then in FIFO order.
+type priorityScheduler struct {
+	mu       sync.Mutex
+	max      int
+	inflight int
+	queues   [3][]chan struct{}
+}
+
+func (s *priorityScheduler) waiting() int {
+	var n int
+	for _, q := range s.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// saturated returns true if all slots are taken.
+func (s *priorityScheduler) saturated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflight >= s.max
+}
+
+func (s *priorityScheduler) acquire(ctx context.Context, class PriorityClass) error {
+	s.mu.Lock()
+	if s.inflight < s.max && s.waiting() == 0 {
+		s.inflight++
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	r := class.rank()
+	s.queues[r] = append(s.queues[r], ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for i, v := range s.queues[r] {
+			if v == ch {
+				s.queues[r] = append(s.queues[r][:i], s.queues[r][i+1:]...)
+				s.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		s.mu.Unlock()
+
+		// The slot was granted concurrently.
+		s.release()
+		return ctx.Err()
+	}
+}
+
+// release passes the slot to the first waiting request of the highest class.
+func (s *priorityScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, q := range s.queues {
+		if len(q) > 0 {
+			close(q[0])
+			s.queues[i] = q[1:]
+			return
+		}
+	}
+	s.inflight--
+}
+
+const prioritySlotKey = "priority-slot"
+
+type prioritySlot struct {
+	class PriorityClass
+	once  sync.Once
+	s     *priorityScheduler
+}
+
+func (p *prioritySlot) release() {
+	p.once.Do(p.s.release)
+}
+
+// priorityLimiter is a request and response modifier that admits requests according to their priority.
+type priorityLimiter struct {
+	cfg  *PriorityConfig
+	s    *priorityScheduler
+	bulk *rate.Limiter
+}
+
+func newPriorityLimiter(cfg *PriorityConfig) *priorityLimiter {
+	l := &priorityLimiter{
+		cfg: cfg,
+		s:   &priorityScheduler{max: cfg.MaxConcurrent},
+	}
+	if cfg.BulkBandwidth > 0 {
+		l.bulk = rate.NewLimiter(rate.Limit(cfg.BulkBandwidth), int(cfg.BulkBandwidth))
+	}
+	return l
+}
+
+func (l *priorityLimiter) ModifyRequest(req *http.Request) error {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	class := l.cfg.class(req)
+	if err := l.s.acquire(req.Context(), class); err != nil {
+		return fmt.Errorf("priority %s: %w", class, err)
+	}
+	ctx.Set(prioritySlotKey, &prioritySlot{class: class, s: l.s})
+
+	return nil
+}
+
+func (l *priorityLimiter) ModifyResponse(res *http.Response) error {
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(prioritySlotKey)
+	if !ok {
+		return nil
+	}
+	slot := v.(*prioritySlot) //nolint:forcetypeassert // we know the type
+
+	if res.Request.Method == http.MethodConnect || res.Body == nil || res.Body == http.NoBody {
+		slot.release()
+		return nil
+	}
+	// Upgraded connections need the body to be io.ReadWriteCloser.
+	if _, ok := res.Body.(io.ReadWriteCloser); ok {
+		slot.release()
+		return nil
+	}
+
+	pb := &priorityBody{ReadCloser: res.Body, slot: slot}
+	if slot.class == PriorityBulk && l.bulk != nil {
+		pb.limiter = l.bulk
+	}
+	res.Body = pb
+
+	return nil
+}
+
+// priorityBody releases the slot when the body is closed,
+// if limiter is set reading is throttled while the proxy is saturated.
+type priorityBody struct {
+	io.ReadCloser
+	slot    *prioritySlot
+	limiter *rate.Limiter
+}
+
+func (b *priorityBody) Read(p []byte) (int, error) {
+	if b.limiter != nil && len(p) > b.limiter.Burst() {
+		p = p[:b.limiter.Burst()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.limiter != nil && b.slot.s.saturated() {
+		b.limiter.WaitN(context.Background(), n) //nolint:errcheck // n does not exceed burst
+	}
+	return n, err
+}
+
+func (b *priorityBody) Close() error {
+	b.slot.release()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,205 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+func TestParsePriorityRule(t *testing.T) {
+	tests := []struct {
+		input string
+		class PriorityClass
+		err   string
+	}{
+		{input: `interactive:^app\.example\.com$`, class: PriorityInteractive},
+		{input: "bulk:.*", class: PriorityBulk},
+		{input: "default:a:b", class: PriorityDefault},
+		{input: "bulk", err: "expected"},
+		{input: "bulk:", err: "expected"},
+		{input: "urgent:.*", err: "unsupported class"},
+		{input: "bulk:(", err: "missing closing"},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			r, err := ParsePriorityRule(tc.input)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Class != tc.class {
+				t.Fatalf("expected class %s, got %s", tc.class, r.Class)
+			}
+		})
+	}
+}
+
+func TestPriorityConfigClass(t *testing.T) {
+	var cfg PriorityConfig
+	for _, v := range []string{`interactive:^app\.`, "bulk:example", "interactive:.*"} {
+		r, err := ParsePriorityRule(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Rules = append(cfg.Rules, r)
+	}
+
+	tests := []struct {
+		url   string
+		class PriorityClass
+	}{
+		{url: "http://app.example.com/", class: PriorityInteractive},
+		{url: "http://cdn.example.com:8080/", class: PriorityBulk},
+		{url: "http://foo.com/", class: PriorityInteractive},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.url, http.NoBody)
+		if c := cfg.class(req); c != tc.class {
+			t.Errorf("%s: expected class %s, got %s", tc.url, tc.class, c)
+		}
+	}
+
+	if c := (&PriorityConfig{}).class(httptest.NewRequest(http.MethodGet, "http://foo.com/", http.NoBody)); c != PriorityDefault {
+		t.Errorf("expected class %s, got %s", PriorityDefault, c)
+	}
+}
+
+func TestPrioritySchedulerOrder(t *testing.T) {
+	s := &priorityScheduler{max: 1}
+	ctx := context.Background()
+
+	if err := s.acquire(ctx, PriorityBulk); err != nil {
+		t.Fatal(err)
+	}
+	if !s.saturated() {
+		t.Fatal("expected saturated")
+	}
+
+	order := make(chan PriorityClass, 3)
+	wait := func(c PriorityClass) {
+		go func() {
+			if err := s.acquire(ctx, c); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- c
+			s.release()
+		}()
+	}
+	waitQueued := func(n int) {
+		for {
+			s.mu.Lock()
+			w := s.waiting()
+			s.mu.Unlock()
+			if w == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	wait(PriorityBulk)
+	waitQueued(1)
+	wait(PriorityDefault)
+	waitQueued(2)
+	wait(PriorityInteractive)
+	waitQueued(3)
+
+	s.release()
+
+	expected := []PriorityClass{PriorityInteractive, PriorityDefault, PriorityBulk}
+	for _, e := range expected {
+		if c := <-order; c != e {
+			t.Fatalf("expected %s, got %s", e, c)
+		}
+	}
+
+	if s.saturated() {
+		t.Fatal("expected not saturated")
+	}
+	if s.inflight != 0 {
+		t.Fatalf("expected no inflight requests, got %d", s.inflight)
+	}
+}
+
+func TestPrioritySchedulerCancel(t *testing.T) {
+	s := &priorityScheduler{max: 1}
+
+	if err := s.acquire(context.Background(), PriorityDefault); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, PriorityInteractive); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if s.waiting() != 0 {
+		t.Fatal("expected canceled request to be removed from the queue")
+	}
+
+	s.release()
+	if s.inflight != 0 {
+		t.Fatalf("expected no inflight requests, got %d", s.inflight)
+	}
+}
+
+func TestPriorityLimiterReleaseOnBodyClose(t *testing.T) {
+	l := newPriorityLimiter(&PriorityConfig{MaxConcurrent: 1, BulkBandwidth: 1024})
+
+	req := httptest.NewRequest(http.MethodGet, "http://foo.com/", http.NoBody)
+	martian.TestContext(req, nil, nil)
+
+	if err := l.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if !l.s.saturated() {
+		t.Fatal("expected saturated")
+	}
+
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("body")),
+		Request:    req,
+	}
+	if err := l.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if !l.s.saturated() {
+		t.Fatal("expected slot to be held until the body is closed")
+	}
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "body" {
+		t.Fatalf("unexpected body %q", b)
+	}
+	res.Body.Close()
+	res.Body.Close()
+
+	if l.s.saturated() || l.s.inflight != 0 {
+		t.Fatalf("expected slot to be released, inflight=%d", l.s.inflight)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// PrivacyConfig configures removal of tracking information from requests to and responses from matched hosts.
+// HTTPS requests are filtered only if they are MITMed.
+type PrivacyConfig struct {
+	// Domains matches host names of requests that are filtered.
+	Domains *ruleset.RegexpMatcher
+
+	// Cookies are names of tracking cookies removed from Cookie and Set-Cookie headers.
+	// A name ending with "*" matches cookies by prefix.
+	Cookies []string
+
+	// QueryParams are names of tracking query parameters removed from request URLs.
+	// A name ending with "*" matches parameters by prefix.
+	QueryParams []string
+
+	// StripReferer removes the Referer header if it points to a different origin than the request.
+	StripReferer bool
+
+	// StripETag removes ETag and If-None-Match headers, so that entity tags cannot be used to track clients.
+	StripETag bool
+}
+
+func DefaultPrivacyConfig() *PrivacyConfig {
+	return &PrivacyConfig{
+		Cookies: []string{
+			"_ga*",
+			"_gid",
+			"_gcl_*",
+			"_fbp",
+			"_fbc",
+			"__utm*",
+		},
+		QueryParams: []string{
+			"utm_*",
+			"gclid",
+			"dclid",
+			"fbclid",
+			"msclkid",
+			"mc_eid",
+			"yclid",
+		},
+		StripReferer: true,
+	}
+}
+
+func (c *PrivacyConfig) Validate() error {
+	if c.Domains == nil {
+		return errors.New("domains must be set")
+	}
+	for _, n := range c.Cookies {
+		if n == "" || n == "*" {
+			return errors.New("invalid cookie name")
+		}
+	}
+	for _, n := range c.QueryParams {
+		if n == "" || n == "*" {
+			return errors.New("invalid query parameter name")
+		}
+	}
+	return nil
+}
+
+// matchName returns true if the name is in the list, names ending with "*" match by prefix.
+func matchName(list []string, name string) bool {
+	for _, n := range list {
+		if p, ok := strings.CutSuffix(n, "*"); ok {
+			if strings.HasPrefix(name, p) {
+				return true
+			}
+		} else if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type privacyFilter struct {
+	hp  *HTTPProxy
+	cfg *PrivacyConfig
+}
+
+func (hp *HTTPProxy) privacyFilter() privacyFilter {
+	return privacyFilter{
+		hp:  hp,
+		cfg: hp.config.Privacy,
+	}
+}
+
+func (p privacyFilter) match(req *http.Request) bool {
+	return req.Method != http.MethodConnect && p.cfg.Domains.Match(req.URL.Hostname())
+}
+
+func (p privacyFilter) ModifyRequest(req *http.Request) error {
+	if !p.match(req) {
+		return nil
+	}
+
+	if len(p.cfg.QueryParams) > 0 && req.URL.RawQuery != "" {
+		p.stripQueryParams(req.URL)
+	}
+	if len(p.cfg.Cookies) > 0 {
+		p.stripCookies(req.Header)
+	}
+	if p.cfg.StripReferer {
+		if ref := req.Header.Get("Referer"); ref != "" && !sameOrigin(ref, req.URL) {
+			req.Header.Del("Referer")
+			p.hp.log.Debugf("removed cross-origin Referer of request to %s", req.URL.Host)
+		}
+	}
+	if p.cfg.StripETag {
+		req.Header.Del("If-None-Match")
+	}
+
+	return nil
+}
+
+func (p privacyFilter) stripQueryParams(u *url.URL) {
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return
+	}
+
+	var removed bool
+	for k := range q {
+		if matchName(p.cfg.QueryParams, k) {
+			q.Del(k)
+			removed = true
+		}
+	}
+	if removed {
+		u.RawQuery = q.Encode()
+		p.hp.log.Debugf("removed tracking query parameters of request to %s", u.Host)
+	}
+}
+
+func (p privacyFilter) stripCookies(h http.Header) {
+	vv := h.Values("Cookie")
+	if len(vv) == 0 {
+		return
+	}
+
+	var kept []string
+	for _, v := range vv {
+		for _, c := range strings.Split(v, ";") {
+			c = strings.TrimSpace(c)
+			name, _, _ := strings.Cut(c, "=")
+			if c == "" || matchName(p.cfg.Cookies, name) {
+				continue
+			}
+			kept = append(kept, c)
+		}
+	}
+
+	if len(kept) == 0 {
+		h.Del("Cookie")
+	} else {
+		h.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
+
+func (p privacyFilter) ModifyResponse(res *http.Response) error {
+	if res.Request == nil || !p.match(res.Request) {
+		return nil
+	}
+
+	if len(p.cfg.Cookies) > 0 {
+		vv := res.Header.Values("Set-Cookie")
+		n := len(vv)
+		res.Header.Del("Set-Cookie")
+		for _, v := range vv {
+			name, _, _ := strings.Cut(v, "=")
+			if matchName(p.cfg.Cookies, strings.TrimSpace(name)) {
+				n--
+				continue
+			}
+			res.Header.Add("Set-Cookie", v)
+		}
+		if n != len(vv) {
+			p.hp.log.Debugf("removed %d tracking cookies of response from %s", len(vv)-n, res.Request.URL.Host)
+		}
+	}
+	if p.cfg.StripETag {
+		res.Header.Del("ETag")
+	}
+
+	return nil
+}
+
+// sameOrigin returns true if the referer URL has the same scheme, host and port as the URL.
+func sameOrigin(referer string, u *url.URL) bool {
+	r, err := url.Parse(referer)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(r.Scheme, u.Scheme) &&
+		strings.EqualFold(r.Hostname(), u.Hostname()) &&
+		originPort(r) == originPort(u)
+}
+
+func originPort(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
@@ -0,0 +1,121 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func testPrivacyFilter(t *testing.T) privacyFilter {
+	t.Helper()
+
+	cfg := DefaultPrivacyConfig()
+	dd, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`example\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Domains = dd
+	cfg.StripETag = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	return privacyFilter{
+		hp:  &HTTPProxy{log: log.NopLogger},
+		cfg: cfg,
+	}
+}
+
+func TestPrivacyFilterModifyRequest(t *testing.T) {
+	p := testPrivacyFilter(t)
+
+	req := httptest.NewRequest(http.MethodGet, "http://www.example.com/page?id=1&utm_source=mail&utm_medium=x&fbclid=abc", http.NoBody)
+	req.Header.Add("Cookie", "session=1; _ga=GA1.2; _gid=GA1")
+	req.Header.Add("Cookie", "_gcl_au=1.1")
+	req.Header.Set("Referer", "https://search.example.org/?q=example")
+	req.Header.Set("If-None-Match", `"tracking-id"`)
+
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.URL.RawQuery; got != "id=1" {
+		t.Errorf("unexpected query %q", got)
+	}
+	if got := req.Header.Values("Cookie"); len(got) != 1 || got[0] != "session=1" {
+		t.Errorf("unexpected cookies %q", got)
+	}
+	if req.Header.Get("Referer") != "" {
+		t.Error("expected cross-origin Referer to be removed")
+	}
+	if req.Header.Get("If-None-Match") != "" {
+		t.Error("expected If-None-Match to be removed")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://www.example.com/", http.NoBody)
+	req.Header.Set("Cookie", "_ga=1")
+	req.Header.Set("Referer", "http://www.example.com:80/index.html")
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Cookie") != "" {
+		t.Error("expected empty Cookie header to be removed")
+	}
+	if req.Header.Get("Referer") == "" {
+		t.Error("expected same-origin Referer to be kept")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.org/?utm_source=mail", http.NoBody)
+	req.Header.Set("Cookie", "_ga=1")
+	if err := p.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.RawQuery == "" || req.Header.Get("Cookie") == "" {
+		t.Error("expected request to not matched domain to be unchanged")
+	}
+}
+
+func TestPrivacyFilterModifyResponse(t *testing.T) {
+	p := testPrivacyFilter(t)
+
+	res := &http.Response{
+		Header: http.Header{
+			"Set-Cookie": {"session=1; Path=/", "_ga=GA1.2; Domain=.example.com", "_fbp=fb.1"},
+			"Etag":       {`"tracking-id"`},
+		},
+		Request: httptest.NewRequest(http.MethodGet, "http://www.example.com/", http.NoBody),
+	}
+	if err := p.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Header.Values("Set-Cookie"); len(got) != 1 || got[0] != "session=1; Path=/" {
+		t.Errorf("unexpected Set-Cookie %q", got)
+	}
+	if res.Header.Get("ETag") != "" {
+		t.Error("expected ETag to be removed")
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	list := []string{"utm_*", "gclid"}
+	for name, match := range map[string]bool{
+		"utm_source": true,
+		"utm_":       true,
+		"gclid":      true,
+		"gclid2":     false,
+		"utm":        false,
+	} {
+		if matchName(list, name) != match {
+			t.Errorf("%s: expected %v", name, match)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/saucelabs/forwarder/log"
+)
+
+// promInstanceLabel is the label added to all metrics of a server or proxy with PromInstance set.
+const promInstanceLabel = "forwarder_instance"
+
+// promRegisterer returns the registerer for metrics of a server or proxy, it returns nil if r is nil.
+// If instance is set, all metrics are labelled with it, so that multiple instances can share a registry.
+// Metrics that fail to register e.g. because they are already registered by another instance are logged and not exported,
+// instead of panicking.
+func promRegisterer(r prometheus.Registerer, instance string, log log.Logger) prometheus.Registerer {
+	if r == nil {
+		return nil
+	}
+	if instance != "" {
+		r = prometheus.WrapRegistererWith(prometheus.Labels{promInstanceLabel: instance}, r)
+	}
+	return tolerantRegisterer{Registerer: r, log: log}
+}
+
+type tolerantRegisterer struct {
+	prometheus.Registerer
+	log log.Logger
+}
+
+func (r tolerantRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			r.log.Errorf("failed to register metrics, set a distinct Prometheus instance for every proxy sharing a registry: %s", err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+func TestPromRegistererInstances(t *testing.T) {
+	r := prometheus.NewRegistry()
+	for _, instance := range []string{"a", "b"} {
+		reg := promRegisterer(r, instance, log.NopLogger)
+		newMetrics(reg, "test", 1).errors.WithLabelValues("reason").Inc()
+		middleware.NewPrometheus(reg, "test")
+	}
+
+	if n := testutil.CollectAndCount(r, "test_proxy_errors_total"); n != 2 {
+		t.Fatalf("expected 2 series, got %d", n)
+	}
+}
+
+func TestPromRegistererDuplicate(t *testing.T) {
+	r := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		reg := promRegisterer(r, "", log.NopLogger)
+		newMetrics(reg, "test", 1).errors.WithLabelValues("reason").Inc()
+		middleware.NewPrometheus(reg, "test")
+	}
+
+	if n := testutil.CollectAndCount(r, "test_proxy_errors_total"); n != 1 {
+		t.Fatalf("expected 1 series, got %d", n)
+	}
+}
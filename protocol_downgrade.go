@@ -0,0 +1,138 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// protocolDowngrade is a protocol version the client supports and would use with a direct connection,
+// but that was not used because of the proxy.
+type protocolDowngrade struct {
+	// leg is "client" for the MITM connection between the client and the proxy,
+	// and "upstream" for the connection between the proxy and the origin server.
+	leg string
+
+	// kind is "alpn" for application protocol or "tls" for TLS version downgrades.
+	kind string
+
+	from, to string
+}
+
+// mitmClientHello is the part of the ClientHello that the client sent in a MITM session.
+type mitmClientHello struct {
+	maxVersion uint16
+	h2         bool
+}
+
+func newMITMClientHello(hello *tls.ClientHelloInfo) mitmClientHello {
+	var ch mitmClientHello
+	for _, v := range hello.SupportedVersions {
+		if v > ch.maxVersion {
+			ch.maxVersion = v
+		}
+	}
+	for _, p := range hello.SupportedProtos {
+		if p == "h2" {
+			ch.h2 = true
+		}
+	}
+	return ch
+}
+
+// clientLegDowngrades compares the ClientHello with the state of the MITM connection.
+func clientLegDowngrades(ch mitmClientHello, cs tls.ConnectionState) []protocolDowngrade {
+	var d []protocolDowngrade
+	if ch.h2 && cs.NegotiatedProtocol != "h2" {
+		to := cs.NegotiatedProtocol
+		if to == "" {
+			to = "http/1.1"
+		}
+		d = append(d, protocolDowngrade{leg: "client", kind: "alpn", from: "h2", to: to})
+	}
+	if ch.maxVersion > cs.Version {
+		d = append(d, protocolDowngrade{leg: "client", kind: "tls", from: tlsVersionName(ch.maxVersion), to: tlsVersionName(cs.Version)})
+	}
+	return d
+}
+
+// upstreamLegDowngrades compares the ClientHello with the TLS state of the connection to the origin server.
+// The TLS version is reported only if it is capped by the transport maxVersion,
+// otherwise the origin server does not support a newer version and a direct connection would use the same one.
+func upstreamLegDowngrades(ch mitmClientHello, res *http.Response, maxVersion uint16) []protocolDowngrade {
+	if res.TLS == nil || maxVersion == 0 {
+		return nil
+	}
+	if v := res.TLS.Version; v == maxVersion && ch.maxVersion > v {
+		return []protocolDowngrade{{leg: "upstream", kind: "tls", from: tlsVersionName(ch.maxVersion), to: tlsVersionName(v)}}
+	}
+	return nil
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return "unknown"
+	}
+}
+
+const mitmClientHelloKey = "mitm-client-hello"
+
+func (hp *HTTPProxy) reportDowngrades(req *http.Request, d []protocolDowngrade) {
+	for _, v := range d {
+		hp.metrics.downgrade(v.leg, v.kind, v.from, v.to)
+		hp.log.Debugf("protocol downgrade host=%s leg=%s %s %s -> %s", req.Host, v.leg, v.kind, v.from, v.to)
+	}
+}
+
+// mitmHandshake is called after the MITM handshake with the client, req is the CONNECT request.
+func (hp *HTTPProxy) mitmHandshake(req *http.Request, hello *tls.ClientHelloInfo, cs tls.ConnectionState) {
+	ch := newMITMClientHello(hello)
+	tch := newClientHello(hello)
+	hp.log.Debugf("MITM TLS client hello from %s: %s", req.RemoteAddr, clientHelloString(tch))
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Session().Set(mitmClientHelloKey, ch)
+		ctx.Session().Set(tlsClientHelloKey, tch)
+	}
+	hp.reportDowngrades(req, clientLegDowngrades(ch, cs))
+	hp.metrics.mitmHandshake(caFingerprint(hp.mitmCACert), mitmHandshakeOK)
+}
+
+// upstreamDowngrades returns a response modifier that reports downgrades of the connections to origin servers
+// caused by the transport TLS configuration.
+// It returns nil if the transport does not limit the TLS version.
+func (hp *HTTPProxy) upstreamDowngrades() martian.ResponseModifier {
+	tr, ok := hp.transport.(*http.Transport)
+	if !ok || tr.TLSClientConfig == nil || tr.TLSClientConfig.MaxVersion == 0 {
+		return nil
+	}
+	maxVersion := tr.TLSClientConfig.MaxVersion
+
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		ctx := martian.NewContext(res.Request)
+		if ctx == nil {
+			return nil
+		}
+		v, ok := ctx.Session().Get(mitmClientHelloKey)
+		if !ok {
+			return nil
+		}
+		hp.reportDowngrades(res.Request, upstreamLegDowngrades(v.(mitmClientHello), res, maxVersion)) //nolint:forcetypeassert // we know the type
+		return nil
+	})
+}
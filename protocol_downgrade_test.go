@@ -0,0 +1,75 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestClientLegDowngrades(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+	}
+
+	tests := []struct {
+		name     string
+		cs       tls.ConnectionState
+		expected []protocolDowngrade
+	}{
+		{
+			name: "none",
+			cs:   tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"},
+		},
+		{
+			name: "alpn",
+			cs:   tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "http/1.1"},
+			expected: []protocolDowngrade{
+				{leg: "client", kind: "alpn", from: "h2", to: "http/1.1"},
+			},
+		},
+		{
+			name: "alpn and tls",
+			cs:   tls.ConnectionState{Version: tls.VersionTLS12},
+			expected: []protocolDowngrade{
+				{leg: "client", kind: "alpn", from: "h2", to: "http/1.1"},
+				{leg: "client", kind: "tls", from: "TLS1.3", to: "TLS1.2"},
+			},
+		},
+	}
+
+	ch := newMITMClientHello(hello)
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			d := clientLegDowngrades(ch, tc.cs)
+			if !reflect.DeepEqual(d, tc.expected) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, d)
+			}
+		})
+	}
+}
+
+func TestUpstreamLegDowngrades(t *testing.T) {
+	ch := mitmClientHello{maxVersion: tls.VersionTLS13}
+	res := func(v uint16) *http.Response {
+		return &http.Response{TLS: &tls.ConnectionState{Version: v}}
+	}
+
+	if d := upstreamLegDowngrades(ch, res(tls.VersionTLS12), tls.VersionTLS12); len(d) != 1 || d[0].from != "TLS1.3" || d[0].to != "TLS1.2" {
+		t.Fatalf("expected TLS1.3 -> TLS1.2 downgrade, got %+v", d)
+	}
+	if d := upstreamLegDowngrades(ch, res(tls.VersionTLS12), tls.VersionTLS13); d != nil {
+		t.Fatalf("expected no downgrade when the origin does not support TLS1.3, got %+v", d)
+	}
+	if d := upstreamLegDowngrades(ch, &http.Response{}, tls.VersionTLS12); d != nil {
+		t.Fatalf("expected no downgrade for plain HTTP, got %+v", d)
+	}
+}
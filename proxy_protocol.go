@@ -0,0 +1,77 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/proxyproto"
+)
+
+const proxyProtocolSourceKey = "proxy-protocol-source"
+
+// recordProxyProtocolSource stores the client address in the request context,
+// so that it is available when dialing the origin server or upstream proxy for the request.
+func (hp *HTTPProxy) recordProxyProtocolSource() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		ctx := martian.NewContext(req)
+		if ctx == nil {
+			return nil
+		}
+		if ap, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+			ctx.Set(proxyProtocolSourceKey, net.TCPAddrFromAddrPort(ap))
+		}
+		return nil
+	})
+}
+
+type noProxyProtocolKey struct{}
+
+// withoutProxyProtocol returns a context for dialing connections that must not start with the PROXY protocol header.
+func withoutProxyProtocol(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noProxyProtocolKey{}, true)
+}
+
+// proxyProtocolDial returns a dial function that sends the PROXY protocol header on dialed TCP connections,
+// i.e. connections to origin servers and upstream proxies, other networks and contexts from withoutProxyProtocol are skipped.
+// The source address is the client address, and the destination address is the address of the dialed server.
+// If the client address is not known, e.g. for in-memory connections, the header has no addresses.
+func (hp *HTTPProxy) proxyProtocolDial(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	version := hp.config.SendProxyProtocol
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(network, "tcp") || ctx.Value(noProxyProtocolKey{}) != nil {
+			return conn, nil
+		}
+
+		h := new(proxyproto.Header)
+		if mctx := martian.FromContext(ctx); mctx != nil {
+			if v, ok := mctx.Get(proxyProtocolSourceKey); ok {
+				if dst, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+					h.Source, h.Destination = v.(*net.TCPAddr), dst //nolint:forcetypeassert // we know the type
+				}
+			}
+		}
+
+		if err := proxyproto.WriteHeader(conn, version, h); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("send PROXY protocol header to %s: %w", addr, err)
+		}
+
+		return conn, nil
+	}
+}
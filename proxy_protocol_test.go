@@ -0,0 +1,131 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/proxyproto"
+)
+
+func TestProxyProtocolDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	headers := make(chan *proxyproto.Header, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			h, err := proxyproto.ReadHeader(bufio.NewReader(c))
+			if err != nil {
+				t.Error(err)
+			}
+			headers <- h
+			c.Close()
+		}
+	}()
+
+	for _, version := range []int{1, 2} {
+		hp := &HTTPProxy{config: HTTPProxyConfig{SendProxyProtocol: version}}
+		dial := hp.proxyProtocolDial(new(net.Dialer).DialContext)
+
+		// Known client address.
+		req, err := http.NewRequest(http.MethodGet, "http://example.com", http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:12345"
+		martian.TestContext(req, nil, nil)
+		if err := hp.recordProxyProtocolSource().ModifyRequest(req); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err := dial(req.Context(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		h := <-headers
+		if h.Source == nil || h.Source.String() != req.RemoteAddr {
+			t.Fatalf("v%d: expected source %s, got %v", version, req.RemoteAddr, h.Source)
+		}
+		if h.Destination == nil || h.Destination.String() != ln.Addr().String() {
+			t.Fatalf("v%d: expected destination %s, got %v", version, ln.Addr(), h.Destination)
+		}
+
+		// Unknown client address.
+		c, err = dial(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+
+		h = <-headers
+		if h.Source != nil || h.Destination != nil {
+			t.Fatalf("v%d: expected header without addresses, got %+v", version, h)
+		}
+	}
+}
+
+func TestProxyProtocolDialSkipped(t *testing.T) {
+	hp := &HTTPProxy{config: HTTPProxyConfig{SendProxyProtocol: 2}}
+	dial := hp.proxyProtocolDial(func(context.Context, string, string) (net.Conn, error) {
+		c, s := net.Pipe()
+		t.Cleanup(func() { s.Close() })
+		// Writes block on net.Pipe until read, so a written header fails the dial after the deadline.
+		c.SetWriteDeadline(time.Now().Add(50 * time.Millisecond)) //nolint:errcheck // net.Pipe supports deadlines
+		return c, nil
+	})
+
+	for _, tc := range []struct {
+		name    string
+		ctx     context.Context
+		network string
+	}{
+		{"udp", context.Background(), "udp"},
+		{"without proxy protocol", withoutProxyProtocol(context.Background()), "tcp"},
+	} {
+		c, err := dial(tc.ctx, tc.network, "example.com:21")
+		if err != nil {
+			t.Fatalf("%s: expected no header, got %v", tc.name, err)
+		}
+		c.Close()
+	}
+
+	if _, err := dial(context.Background(), "tcp", "example.com:80"); err == nil {
+		t.Fatal("expected header write to fail")
+	}
+}
+
+func TestSendProxyProtocolTransportNotModified(t *testing.T) {
+	tr := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // it's *http.Transport
+	cfg := DefaultHTTPProxyConfig()
+	cfg.SendProxyProtocol = 1
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, tr, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if tr.DisableKeepAlives {
+		t.Fatal("expected keep-alives of the transport to be kept")
+	}
+}
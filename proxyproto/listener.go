@@ -0,0 +1,104 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package proxyproto
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener accepts connections that start with the PROXY protocol header.
+// Connections without a valid header fail on the first read.
+type Listener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// NewListener returns a listener that reads the PROXY protocol header within the timeout after accepting a connection.
+// Zero timeout means no timeout.
+func NewListener(l net.Listener, timeout time.Duration) *Listener {
+	return &Listener{
+		Listener: l,
+		timeout:  timeout,
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:    c,
+		br:      bufio.NewReader(c),
+		timeout: l.timeout,
+	}, nil
+}
+
+// Conn reports the addresses from the PROXY protocol header.
+// The header is read lazily on the first call to Read, RemoteAddr or LocalAddr,
+// so that a slow client does not block accepting other connections.
+type Conn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once sync.Once
+	hdr  *Header
+	err  error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout)) //nolint:errcheck // read fails if the deadline cannot be set
+			defer c.Conn.SetReadDeadline(time.Time{})         //nolint:errcheck // best effort
+		}
+		c.hdr, c.err = ReadHeader(c.br)
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol from %s: %w", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+// Header returns the PROXY protocol header, it blocks until the header is read.
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.hdr, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// RemoteAddr returns the source address from the header,
+// or the remote address of the connection if the header has no addresses or is invalid.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.hdr != nil && c.hdr.Source != nil {
+		return c.hdr.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header,
+// or the local address of the connection if the header has no addresses or is invalid.
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.hdr != nil && c.hdr.Destination != nil {
+		return c.hdr.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,224 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package proxyproto implements the HAProxy PROXY protocol versions 1 and 2,
+// see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Header is the PROXY protocol header.
+// If Source and Destination are nil, the connection is not proxied e.g. health checks,
+// and the addresses of the connection should be used.
+type Header struct {
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// v1MaxLen is the maximal length of the v1 header including CRLF.
+	v1MaxLen = 107
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+
+	v2FamTCP4 = 0x11
+	v2FamTCP6 = 0x21
+)
+
+var ErrNoHeader = errors.New("PROXY protocol header not found")
+
+// ReadHeader reads the PROXY protocol header of version 1 or 2 from the reader.
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(len(v1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(b, v1Prefix) {
+		return readV1(r)
+	}
+
+	b, err = r.Peek(len(v2Signature))
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = ErrNoHeader
+		}
+		return nil, err
+	}
+	if bytes.Equal(b, v2Signature) {
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("invalid v1 header: missing CRLF")
+	}
+
+	f := strings.Split(s, " ")
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return &Header{}, nil
+	}
+	if len(f) != 6 {
+		return nil, fmt.Errorf("invalid v1 header: %q", s)
+	}
+	if f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid v1 header: unsupported protocol %q", f[1])
+	}
+
+	src, err := parseV1Addr(f[1], f[2], f[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 header: source: %w", err)
+	}
+	dst, err := parseV1Addr(f[1], f[3], f[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 header: destination: %w", err)
+	}
+
+	return &Header{Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	if a == nil || (proto == "TCP4") != (a.To4() != nil) {
+		return nil, fmt.Errorf("invalid %s address %q", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if ver := hdr[12] >> 4; ver != 2 {
+		return nil, fmt.Errorf("invalid v2 header: unsupported version %d", ver)
+	}
+	cmd := hdr[12] & 0x0f
+	fam := hdr[13]
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case v2CmdLocal:
+		return &Header{}, nil
+	case v2CmdProxy:
+	default:
+		return nil, fmt.Errorf("invalid v2 header: unsupported command %d", cmd)
+	}
+
+	var n int
+	switch fam {
+	case v2FamTCP4:
+		n = net.IPv4len
+	case v2FamTCP6:
+		n = net.IPv6len
+	default:
+		// Other families e.g. UDP or UNIX sockets are accepted, but the addresses are not used.
+		return &Header{}, nil
+	}
+	if len(data) < 2*n+4 {
+		return nil, errors.New("invalid v2 header: address block too short")
+	}
+
+	// Additional TLVs after the addresses are ignored.
+	src := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:n]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*n:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[n:2*n]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*n+2:])),
+	}
+
+	return &Header{Source: src, Destination: dst}, nil
+}
+
+// WriteHeader writes the PROXY protocol header of the given version, 1 or 2, to the writer.
+func WriteHeader(w io.Writer, version int, h *Header) error {
+	var b []byte
+	switch version {
+	case 1:
+		b = h.appendV1(nil)
+	case 2:
+		b = h.appendV2(nil)
+	default:
+		return fmt.Errorf("unsupported version %d", version)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func (h *Header) isIPv4() bool {
+	return h.Source.IP.To4() != nil && h.Destination.IP.To4() != nil
+}
+
+func (h *Header) appendV1(b []byte) []byte {
+	if h.Source == nil || h.Destination == nil {
+		return append(b, "PROXY UNKNOWN\r\n"...)
+	}
+
+	proto, src, dst := "TCP6", h.Source.IP.To16(), h.Destination.IP.To16()
+	if h.isIPv4() {
+		proto, src, dst = "TCP4", h.Source.IP.To4(), h.Destination.IP.To4()
+	}
+	return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, src, dst, h.Source.Port, h.Destination.Port)
+}
+
+func (h *Header) appendV2(b []byte) []byte {
+	b = append(b, v2Signature...)
+	if h.Source == nil || h.Destination == nil {
+		return append(b, 2<<4|v2CmdLocal, 0, 0, 0)
+	}
+
+	fam, src, dst := byte(v2FamTCP6), h.Source.IP.To16(), h.Destination.IP.To16()
+	if h.isIPv4() {
+		fam, src, dst = v2FamTCP4, h.Source.IP.To4(), h.Destination.IP.To4()
+	}
+	b = append(b, 2<<4|v2CmdProxy, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*len(src)+4))
+	b = append(b, src...)
+	b = append(b, dst...)
+	b = binary.BigEndian.AppendUint16(b, uint16(h.Source.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(h.Destination.Port))
+	return b
+}
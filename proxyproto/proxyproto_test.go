@@ -0,0 +1,180 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadWriteHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		hdr  *Header
+	}{
+		{
+			name: "tcp4",
+			hdr: &Header{
+				Source:      &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443},
+			},
+		},
+		{
+			name: "tcp6",
+			hdr: &Header{
+				Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+		},
+		{
+			name: "unknown",
+			hdr:  &Header{},
+		},
+	}
+
+	for _, tc := range tests {
+		for _, version := range []int{1, 2} {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, tc.hdr); err != nil {
+				t.Fatalf("%s v%d: %v", tc.name, version, err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+
+			br := bufio.NewReader(&buf)
+			h, err := ReadHeader(br)
+			if err != nil {
+				t.Fatalf("%s v%d: %v", tc.name, version, err)
+			}
+			if !equalAddr(h.Source, tc.hdr.Source) || !equalAddr(h.Destination, tc.hdr.Destination) {
+				t.Fatalf("%s v%d: expected %+v, got %+v", tc.name, version, tc.hdr, h)
+			}
+
+			rest, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("%s v%d: expected payload after header, got %q", tc.name, version, rest)
+			}
+		}
+	}
+}
+
+func equalAddr(a, b *net.TCPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+func TestReadHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"no header", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", ErrNoHeader},
+		{"short input", "GET /\r\n", ErrNoHeader},
+		{"v1 missing CRLF", "PROXY TCP4 1.1.1.1 2.2.2.2 1 2\n", nil},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", nil},
+		{"v1 bad address", "PROXY TCP4 ::1 2.2.2.2 1 2\r\n", nil},
+		{"v1 bad port", "PROXY TCP4 1.1.1.1 2.2.2.2 1 65536\r\n", nil},
+		{"v1 bad protocol", "PROXY UDP4 1.1.1.1 2.2.2.2 1 2\r\n", nil},
+		{"v2 bad version", string(v2Signature) + "\x11\x11\x00\x00", nil},
+		{"v2 short address", string(v2Signature) + "\x21\x11\x00\x04\x01\x02\x03\x04", nil},
+	}
+
+	for _, tc := range tests {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(tc.input)))
+		if err == nil {
+			t.Fatalf("%s: expected error", tc.name)
+		}
+		if tc.err != nil && !errors.Is(err, tc.err) {
+			t.Fatalf("%s: expected error %v, got %v", tc.name, tc.err, err)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, time.Second)
+	defer l.Close()
+
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 80}
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		WriteHeader(c, 2, &Header{Source: src, Destination: dst}) //nolint:errcheck // checked by the reader
+		c.Write([]byte("hello"))                                  //nolint:errcheck // checked by the reader
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if a := c.RemoteAddr().String(); a != src.String() {
+		t.Fatalf("expected remote address %s, got %s", src, a)
+	}
+	if a := c.LocalAddr().String(); a != dst.String() {
+		t.Fatalf("expected local address %s, got %s", dst, a)
+	}
+
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("expected payload %q, got %q", "hello", b)
+	}
+}
+
+func TestListenerNoHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ln, time.Second)
+	defer l.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("GET / HTTP/1.1\r\n\r\n")) //nolint:errcheck // checked by the reader
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrNoHeader) {
+		t.Fatalf("expected error %v, got %v", ErrNoHeader, err)
+	}
+	if c.RemoteAddr().String() != c.(*Conn).Conn.RemoteAddr().String() {
+		t.Fatal("expected connection remote address when header is missing")
+	}
+}
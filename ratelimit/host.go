@@ -0,0 +1,99 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"regexp"
+
+	"golang.org/x/time/rate"
+)
+
+// HostRule limits the bandwidth of traffic to hosts matching the regexp.
+// Zero bandwidth means no limit in that direction.
+type HostRule struct {
+	Host *regexp.Regexp
+
+	// RxBandwidth is the number of bytes per second received from the hosts.
+	RxBandwidth int64
+	// TxBandwidth is the number of bytes per second sent to the hosts.
+	TxBandwidth int64
+}
+
+// HostLimiter applies per host bandwidth limits.
+// The limits of a rule are shared by all connections to the hosts matching the rule.
+type HostLimiter struct {
+	rules []hostLimiter
+}
+
+type hostLimiter struct {
+	host      *regexp.Regexp
+	rxLimiter *rate.Limiter
+	txLimiter *rate.Limiter
+}
+
+func NewHostLimiter(rules []HostRule) *HostLimiter {
+	l := &HostLimiter{
+		rules: make([]hostLimiter, 0, len(rules)),
+	}
+	for _, r := range rules {
+		hl := hostLimiter{host: r.Host}
+		if r.RxBandwidth > 0 {
+			hl.rxLimiter = newRateLimiter(r.RxBandwidth)
+		}
+		if r.TxBandwidth > 0 {
+			hl.txLimiter = newRateLimiter(r.TxBandwidth)
+		}
+		l.rules = append(l.rules, hl)
+	}
+	return l
+}
+
+// Limiters returns the limiters of the first rule matching the host, the limiters are nil if no rule matches.
+func (l *HostLimiter) Limiters(host string) (rxLimiter, txLimiter *rate.Limiter) {
+	for i := range l.rules {
+		if l.rules[i].host.MatchString(host) {
+			return l.rules[i].rxLimiter, l.rules[i].txLimiter
+		}
+	}
+	return nil, nil
+}
+
+// Conn returns c limited by the first rule matching the host, or c if no rule matches.
+func (l *HostLimiter) Conn(host string, c net.Conn) net.Conn {
+	rx, tx := l.Limiters(host)
+	if rx == nil && tx == nil {
+		return c
+	}
+	return &Conn{
+		Conn:      c,
+		rxLimiter: rx,
+		txLimiter: tx,
+	}
+}
+
+// ReadCloser limits the rate of reading from the underlying reader.
+type ReadCloser struct {
+	io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func NewReadCloser(r io.ReadCloser, limiter *rate.Limiter) *ReadCloser {
+	return &ReadCloser{
+		ReadCloser: r,
+		limiter:    limiter,
+	}
+}
+
+func (r *ReadCloser) Read(b []byte) (n int, err error) {
+	n, err = r.ReadCloser.Read(b)
+	if n > 0 {
+		r.limiter.WaitN(waitContext, n)
+	}
+	return
+}
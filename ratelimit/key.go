@@ -0,0 +1,66 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ratelimit
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// KeyLimiter applies bandwidth limits per key, e.g. per user.
+// The limits of a key are shared by all connections with the key,
+// the limiters are recreated if the bandwidth of the key changes.
+type KeyLimiter struct {
+	mu   sync.Mutex
+	keys map[string]*keyLimiter
+}
+
+type keyLimiter struct {
+	bandwidth int64
+	rxLimiter *rate.Limiter
+	txLimiter *rate.Limiter
+}
+
+// Limiters returns the limiters of the key, the limiters are nil if bandwidth is not positive.
+func (l *KeyLimiter) Limiters(key string, bandwidth int64) (rxLimiter, txLimiter *rate.Limiter) {
+	if bandwidth <= 0 {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kl, ok := l.keys[key]
+	if !ok || kl.bandwidth != bandwidth {
+		kl = &keyLimiter{
+			bandwidth: bandwidth,
+			rxLimiter: newRateLimiter(bandwidth),
+			txLimiter: newRateLimiter(bandwidth),
+		}
+		if l.keys == nil {
+			l.keys = make(map[string]*keyLimiter)
+		}
+		l.keys[key] = kl
+	}
+
+	return kl.rxLimiter, kl.txLimiter
+}
+
+// Conn returns c limited by the limiters of the key, or c if bandwidth is not positive.
+func (l *KeyLimiter) Conn(key string, bandwidth int64, c net.Conn) net.Conn {
+	rx, tx := l.Limiters(key, bandwidth)
+	if rx == nil && tx == nil {
+		return c
+	}
+	return &Conn{
+		Conn:      c,
+		rxLimiter: rx,
+		txLimiter: tx,
+	}
+}
@@ -19,18 +19,33 @@ type Listener struct {
 }
 
 func NewListener(l net.Listener, rxBandwidth, txBandwidth int64) *Listener {
-	var rxLimiter, txLimiter *rate.Limiter
+	return NewLimiters(rxBandwidth, txBandwidth).Listener(l)
+}
+
+// Limiters limit the total bandwidth of connections accepted by one or more listeners.
+type Limiters struct {
+	rxLimiter *rate.Limiter
+	txLimiter *rate.Limiter
+}
+
+// NewLimiters returns limiters for the bandwidth in bytes per second, zero means no limit.
+func NewLimiters(rxBandwidth, txBandwidth int64) *Limiters {
+	var l Limiters
 	if rxBandwidth > 0 {
-		rxLimiter = newRateLimiter(rxBandwidth)
+		l.rxLimiter = newRateLimiter(rxBandwidth)
 	}
 	if txBandwidth > 0 {
-		txLimiter = newRateLimiter(txBandwidth)
+		l.txLimiter = newRateLimiter(txBandwidth)
 	}
+	return &l
+}
 
+// Listener returns a listener limited by the limiters, the bandwidth is shared with other listeners of the limiters.
+func (l *Limiters) Listener(ln net.Listener) *Listener {
 	return &Listener{
-		Listener:  l,
-		rxLimiter: rxLimiter,
-		txLimiter: txLimiter,
+		Listener:  ln,
+		rxLimiter: l.rxLimiter,
+		txLimiter: l.txLimiter,
 	}
 }
 
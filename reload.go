@@ -0,0 +1,91 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// Reload applies the part of cfg that can be changed without restarting the proxy:
+// upstream proxy, deny, direct and MITM domains, and HTTP log mode, other fields are ignored.
+// Credentials are not part of HTTPProxyConfig, use SetRuntimeConfig to change them.
+//
+// The middleware stack is rebuilt and swapped atomically.
+// Requests in progress finish with the previous stack, and established CONNECT tunnels are not affected.
+func (hp *HTTPProxy) Reload(cfg *HTTPProxyConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	hp.reloadMu.Lock()
+	defer hp.reloadMu.Unlock()
+
+	rc := *hp.runtime.Load()
+	rc.UpstreamProxy = cfg.UpstreamProxy
+	rc.DenyDomains = cfg.DenyDomains
+	rc.DirectDomains = cfg.DirectDomains
+	rc.MITMDomains = cfg.MITMDomains
+	rc.MITMExcludeDomains = cfg.MITMExcludeDomains
+	rc.LogHTTPMode = cfg.LogHTTPMode
+	if err := hp.validateRuntimeConfig(&rc); err != nil {
+		return err
+	}
+
+	hp.runtime.Store(&rc)
+	hp.mw.store(hp.middlewareStack())
+
+	if rc.UpstreamProxy != nil {
+		hp.log.Infof("configuration reloaded upstream_proxy=%s log_http=%s", rc.UpstreamProxy.Redacted(), rc.LogHTTPMode)
+	} else {
+		hp.log.Infof("configuration reloaded log_http=%s", rc.LogHTTPMode)
+	}
+
+	return nil
+}
+
+const middlewareStackKey = "middleware-stack"
+
+// middlewareSwitch passes requests and responses to the current middleware stack.
+// The stack that handled a request is stored in the request context,
+// so that the response is handled by the same stack even if the stack was swapped in the meantime.
+type middlewareSwitch struct {
+	v atomic.Pointer[middlewareStack]
+}
+
+type middlewareStack struct {
+	martian.RequestResponseModifier
+}
+
+func (s *middlewareSwitch) store(mw martian.RequestResponseModifier) {
+	s.v.Store(&middlewareStack{mw})
+}
+
+func (s *middlewareSwitch) load(req *http.Request) *middlewareStack {
+	if req != nil {
+		if ctx := martian.NewContext(req); ctx != nil {
+			if v, ok := ctx.Get(middlewareStackKey); ok {
+				return v.(*middlewareStack) //nolint:forcetypeassert // we know the type
+			}
+		}
+	}
+	return s.v.Load()
+}
+
+func (s *middlewareSwitch) ModifyRequest(req *http.Request) error {
+	mw := s.v.Load()
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Set(middlewareStackKey, mw)
+	}
+	return mw.ModifyRequest(req)
+}
+
+func (s *middlewareSwitch) ModifyResponse(res *http.Response) error {
+	return s.load(res.Request).ModifyResponse(res)
+}
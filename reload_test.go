@@ -0,0 +1,150 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+func TestHTTPProxyReload(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	get := func(t *testing.T, u string) int {
+		t.Helper()
+		res, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get(t, "http://denied.com/"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+
+	deny, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`^denied\.com$`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcfg := *cfg
+	rcfg.DenyDomains = deny
+	rcfg.LogHTTPMode = httplog.None
+	if err := p.Reload(&rcfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := get(t, "http://denied.com/"); code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, code)
+	}
+	if code := get(t, "http://allowed.com/"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if m := p.RuntimeConfig().LogHTTPMode; m != httplog.None {
+		t.Fatalf("expected log mode %s, got %s", httplog.None, m)
+	}
+}
+
+func TestHTTPProxyReloadValidation(t *testing.T) {
+	p, err := NewInMemoryHTTPProxy(DefaultHTTPProxyConfig(), nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	mitm, err := ruleset.NewRegexpMatcher([]*regexp.Regexp{regexp.MustCompile(`.*`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultHTTPProxyConfig()
+	cfg.MITMDomains = mitm
+	if err := p.Reload(cfg); err == nil {
+		t.Fatal("expected error")
+	}
+	if p.RuntimeConfig().MITMDomains != nil {
+		t.Fatal("expected configuration not to change")
+	}
+}
+
+func TestMiddlewareSwitchPinsStack(t *testing.T) {
+	var calls []string
+	stack := func(name string) martian.RequestResponseModifier {
+		return recordingModifier{name: name, calls: &calls}
+	}
+
+	var s middlewareSwitch
+	s.store(stack("a"))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	martian.TestContext(req, nil, nil)
+
+	if err := s.ModifyRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	s.store(stack("b"))
+	if err := s.ModifyResponse(&http.Response{Request: req}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ModifyResponse(&http.Response{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a:request", "a:response", "b:response"}
+	if len(calls) != len(want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("expected calls %v, got %v", want, calls)
+		}
+	}
+}
+
+type recordingModifier struct {
+	name  string
+	calls *[]string
+}
+
+func (m recordingModifier) ModifyRequest(*http.Request) error {
+	*m.calls = append(*m.calls, m.name+":request")
+	return nil
+}
+
+func (m recordingModifier) ModifyResponse(*http.Response) error {
+	*m.calls = append(*m.calls, m.name+":response")
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package remoteconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// Consul watches keys in Consul KV store using blocking queries.
+// The ACL token is read from the CONSUL_HTTP_TOKEN environment variable.
+type Consul struct {
+	watcher
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+
+	index uint64
+}
+
+type consulKV struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"`
+}
+
+func (c *Consul) Watch(ctx context.Context, fn func(kv map[string]string)) error {
+	return c.loop(ctx, c.read, 0, fn)
+}
+
+func (c *Consul) read(ctx context.Context) (map[string]string, bool, error) {
+	q := url.Values{}
+	q.Set("recurse", "true")
+	if c.index > 0 {
+		q.Set("index", strconv.FormatUint(c.index, 10))
+		q.Set("wait", fmt.Sprintf("%ds", int(c.config.PollInterval.Seconds())))
+	}
+	u := c.endpoint.JoinPath("/v1/kv/", c.prefix)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), http.NoBody)
+	if err != nil {
+		return nil, false, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	var kvs []consulKV
+	switch res.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(res.Body).Decode(&kvs); err != nil {
+			return nil, false, fmt.Errorf("decode consul response: %w", err)
+		}
+	case http.StatusNotFound:
+		// No keys under the prefix.
+	default:
+		return nil, false, fmt.Errorf("consul: unexpected status %s", res.Status)
+	}
+
+	index, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, false, fmt.Errorf("consul: invalid X-Consul-Index header: %w", err)
+	}
+	// Consul may return the same index on wait timeout, and a lower one after a store reset.
+	changed := c.index == 0 || index != c.index
+	if index < c.index {
+		index = 0
+	}
+	c.index = index
+
+	kv := make(map[string]string, len(kvs))
+	for _, e := range kvs {
+		if k := relativeKey(c.prefix, e.Key); k != "" {
+			kv[k] = string(e.Value)
+		}
+	}
+
+	return kv, changed, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package remoteconfig
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestConsulWatch(t *testing.T) {
+	responses := []struct {
+		index string
+		body  string
+	}{
+		{"1", `[{"Key":"forwarder/","Value":null},{"Key":"forwarder/proxy","Value":"aHR0cDovL3Byb3h5OjMxMjg="}]`},
+		{"1", `[{"Key":"forwarder/proxy","Value":"aHR0cDovL3Byb3h5OjMxMjg="}]`},
+		{"2", `[{"Key":"forwarder/deny-domains","Value":"ZXhhbXBsZS5jb20="}]`},
+	}
+
+	var n int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/forwarder/" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if n > 0 && r.URL.Query().Get("index") != responses[n-1].index {
+			t.Errorf("expected index %s, got %s", responses[n-1].index, r.URL.Query().Get("index"))
+		}
+		if n >= len(responses) {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", responses[n].index)
+		w.Write([]byte(responses[n].body))
+		n++
+	}))
+	defer s.Close()
+
+	u, err := url.Parse("consul://" + s.Listener.Addr().String() + "/forwarder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.URL = u
+	cfg.RetryInterval = time.Millisecond
+
+	p, err := New(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var got []map[string]string
+	p.Watch(ctx, func(kv map[string]string) { //nolint:errcheck // always nil
+		got = append(got, kv)
+		if len(got) == 2 {
+			cancel()
+		}
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 updates, got %d", len(got))
+	}
+	if v := got[0]["proxy"]; v != "http://proxy:3128" {
+		t.Fatalf("expected proxy http://proxy:3128, got %q", v)
+	}
+	if v := got[1]["deny-domains"]; v != "example.com" {
+		t.Fatalf("expected deny-domains example.com, got %q", v)
+	}
+	if _, ok := got[1]["proxy"]; ok {
+		t.Fatal("expected proxy to be removed")
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		expected string
+	}{
+		{"forwarder/", "forwarder0"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		if got := string(prefixRangeEnd([]byte(tc.prefix))); got != tc.expected {
+			t.Fatalf("prefix %q: expected %q, got %q", tc.prefix, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package remoteconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Etcd polls keys in etcd v3 using the JSON gRPC gateway.
+type Etcd struct {
+	watcher
+	endpoint *url.URL
+	prefix   string
+	client   *http.Client
+
+	revision string
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Kvs []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+func (e *Etcd) Watch(ctx context.Context, fn func(kv map[string]string)) error {
+	return e.loop(ctx, e.read, e.config.PollInterval, fn)
+}
+
+func (e *Etcd) read(ctx context.Context) (map[string]string, bool, error) {
+	key := []byte(e.prefix)
+	if len(key) == 0 {
+		key = []byte{0}
+	}
+	b, err := json.Marshal(etcdRangeRequest{
+		Key:      key,
+		RangeEnd: prefixRangeEnd(key),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint.JoinPath("/v3/kv/range").String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("etcd: unexpected status %s", res.Status)
+	}
+
+	var r etcdRangeResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return nil, false, fmt.Errorf("decode etcd response: %w", err)
+	}
+
+	changed := e.revision == "" || r.Header.Revision != e.revision
+	e.revision = r.Header.Revision
+
+	kv := make(map[string]string, len(r.Kvs))
+	for _, v := range r.Kvs {
+		if k := relativeKey(e.prefix, string(v.Key)); k != "" {
+			kv[k] = string(v.Value)
+		}
+	}
+
+	return kv, changed, nil
+}
+
+// prefixRangeEnd returns the end of the range of keys with the given prefix, see etcd clientv3.GetPrefixRangeEnd.
+func prefixRangeEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// No upper bound.
+	return []byte{0}
+}
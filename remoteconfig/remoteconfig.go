@@ -0,0 +1,159 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package remoteconfig provides configuration values stored in a remote key-value store.
+package remoteconfig
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+// Provider watches a set of keys in a key-value store.
+type Provider interface {
+	// Watch calls fn with all the keys and values whenever any of them changes, until the context is canceled.
+	// Keys are relative to the configured prefix.
+	// Errors are retried, if the store is unavailable fn is not called.
+	Watch(ctx context.Context, fn func(kv map[string]string)) error
+}
+
+type Config struct {
+	// URL is the key-value store address and key prefix in the format <scheme>://<host:port>/<prefix>.
+	// Supported schemes are consul, consul+https, etcd and etcd+https.
+	URL *url.URL
+
+	// PollInterval is the time between reads for stores that do not support blocking queries,
+	// and the maximal time a blocking query waits for changes.
+	PollInterval time.Duration
+
+	// RetryInterval is the time to wait after a failed read.
+	RetryInterval time.Duration
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		PollInterval:  30 * time.Second,
+		RetryInterval: 5 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.URL == nil {
+		return fmt.Errorf("url is required")
+	}
+	if _, _, err := splitScheme(c.URL.Scheme); err != nil {
+		return err
+	}
+	if c.URL.Host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if c.PollInterval <= 0 {
+		return fmt.Errorf("poll interval must be positive")
+	}
+	if c.RetryInterval <= 0 {
+		return fmt.Errorf("retry interval must be positive")
+	}
+	return nil
+}
+
+func splitScheme(scheme string) (kind, transport string, err error) {
+	kind, transport, ok := strings.Cut(scheme, "+")
+	if !ok {
+		transport = "http"
+	}
+	if kind != "consul" && kind != "etcd" {
+		return "", "", fmt.Errorf("unsupported scheme %q, supported schemes are: consul, consul+https, etcd, etcd+https", scheme)
+	}
+	if transport != "http" && transport != "https" {
+		return "", "", fmt.Errorf("unsupported scheme %q, supported schemes are: consul, consul+https, etcd, etcd+https", scheme)
+	}
+	return kind, transport, nil
+}
+
+// New returns a Provider for the store specified in the config URL.
+func New(cfg *Config, log log.Logger) (Provider, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	kind, transport, _ := splitScheme(cfg.URL.Scheme)
+	endpoint := &url.URL{Scheme: transport, Host: cfg.URL.Host}
+	prefix := strings.Trim(cfg.URL.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // it's *http.Transport
+	tr.Proxy = nil
+	client := &http.Client{Transport: tr}
+
+	w := watcher{
+		config: *cfg,
+		log:    log,
+	}
+
+	switch kind {
+	case "consul":
+		return &Consul{
+			watcher:  w,
+			endpoint: endpoint,
+			prefix:   prefix,
+			client:   client,
+		}, nil
+	case "etcd":
+		return &Etcd{
+			watcher:  w,
+			endpoint: endpoint,
+			prefix:   prefix,
+			client:   client,
+		}, nil
+	default:
+		panic("unreachable")
+	}
+}
+
+// watcher implements the retry loop shared by providers.
+type watcher struct {
+	config Config
+	log    log.Logger
+}
+
+// loop calls read until the context is canceled.
+// The read function returns true if the values changed since the last call.
+func (w *watcher) loop(ctx context.Context, read func(ctx context.Context) (map[string]string, bool, error),
+	wait time.Duration, fn func(kv map[string]string),
+) error {
+	for {
+		kv, changed, err := read(ctx)
+
+		delay := wait
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			w.log.Errorf("failed to read remote configuration: %s", err)
+			delay = w.config.RetryInterval
+		} else if changed {
+			fn(kv)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+func relativeKey(prefix, key string) string {
+	return strings.TrimPrefix(key, prefix)
+}
@@ -0,0 +1,311 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ResponseValidationRule validates responses to requests matching the URL regexp,
+// violations are logged or, if Reject is set, responses are replaced with 502 Bad Gateway.
+type ResponseValidationRule struct {
+	// URL matches the host and path of requests e.g. "api.example.com/v1/users", the query is not matched.
+	URL *regexp.Regexp
+
+	// ContentTypes are the allowed media types, "type/*" matches any subtype.
+	ContentTypes []string
+
+	// MaxSize is the maximal size of the response body, zero means no limit.
+	// Responses with unknown length are aborted when the limit is exceeded.
+	MaxSize SizeSuffix
+
+	// Statuses are the allowed status codes, "2xx" matches any status code of the class.
+	Statuses []string
+
+	// Reject replaces responses that fail validation with 502 Bad Gateway, otherwise violations are only logged.
+	Reject bool
+}
+
+func (r *ResponseValidationRule) match(req *http.Request) bool {
+	return r.URL.MatchString(req.URL.Host + req.URL.Path)
+}
+
+// Supported response validation keys.
+const (
+	ResponseValidationContentType = "content-type"
+	ResponseValidationMaxSize     = "max-size"
+	ResponseValidationStatus      = "status"
+	ResponseValidationAction      = "action"
+)
+
+// Response validation actions.
+const (
+	ResponseValidationLog    = "log"
+	ResponseValidationReject = "reject"
+)
+
+// ResponseValidationItem sets a single response validation key.
+type ResponseValidationItem struct {
+	URL   string
+	Key   string
+	Value string
+}
+
+var responseValidationItemRegex = regexp.MustCompile(`^(.+):(content-type|max-size|status|action)=(.+)$`)
+
+// ParseResponseValidationItem parses a <regexp>:<key>=<value> string into ResponseValidationItem.
+func ParseResponseValidationItem(val string) (ResponseValidationItem, error) {
+	m := responseValidationItemRegex.FindStringSubmatch(val)
+	if m == nil {
+		return ResponseValidationItem{}, errors.New("expected <regexp>:<content-type|max-size|status|action>=<value>")
+	}
+	item := ResponseValidationItem{URL: m[1], Key: m[2], Value: m[3]}
+
+	if _, err := regexp.Compile(item.URL); err != nil {
+		return item, err
+	}
+	switch item.Key {
+	case ResponseValidationContentType:
+		if _, _, err := mime.ParseMediaType(item.Value); err != nil {
+			return item, fmt.Errorf("content type: %w", err)
+		}
+	case ResponseValidationMaxSize:
+		var s SizeSuffix
+		if err := s.Set(item.Value); err != nil {
+			return item, fmt.Errorf("max size: %w", err)
+		}
+	case ResponseValidationStatus:
+		if !isValidStatusPattern(item.Value) {
+			return item, fmt.Errorf("status: expected status code or class e.g. 200 or 2xx, got %q", item.Value)
+		}
+	case ResponseValidationAction:
+		if item.Value != ResponseValidationLog && item.Value != ResponseValidationReject {
+			return item, fmt.Errorf("action: expected %s or %s, got %q", ResponseValidationLog, ResponseValidationReject, item.Value)
+		}
+	}
+
+	return item, nil
+}
+
+func isValidStatusPattern(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	return s[1] >= '0' && s[1] <= '9' && s[2] >= '0' && s[2] <= '9'
+}
+
+// NewResponseValidationRules builds rules from items, rules are returned in order of the first item for the URL.
+func NewResponseValidationRules(items []ResponseValidationItem) ([]*ResponseValidationRule, error) {
+	var (
+		rules []*ResponseValidationRule
+		byURL = make(map[string]*ResponseValidationRule)
+	)
+
+	for _, item := range items {
+		r, ok := byURL[item.URL]
+		if !ok {
+			re, err := regexp.Compile(item.URL)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.URL, err)
+			}
+			r = &ResponseValidationRule{URL: re}
+			byURL[item.URL] = r
+			rules = append(rules, r)
+		}
+
+		switch item.Key {
+		case ResponseValidationContentType:
+			mt, _, err := mime.ParseMediaType(item.Value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.URL, err)
+			}
+			r.ContentTypes = append(r.ContentTypes, mt)
+		case ResponseValidationMaxSize:
+			if err := r.MaxSize.Set(item.Value); err != nil {
+				return nil, fmt.Errorf("%s: %w", item.URL, err)
+			}
+		case ResponseValidationStatus:
+			r.Statuses = append(r.Statuses, item.Value)
+		case ResponseValidationAction:
+			r.Reject = item.Value == ResponseValidationReject
+		default:
+			return nil, fmt.Errorf("%s: unsupported key %q", item.URL, item.Key)
+		}
+	}
+
+	return rules, nil
+}
+
+// Response validation checks, they are used as metric labels.
+const (
+	statusCheck      = "status"
+	contentTypeCheck = "content_type"
+	sizeCheck        = "size"
+)
+
+// responseValidationError is returned when the upstream response fails validation.
+type responseValidationError struct {
+	check  string
+	reason string
+}
+
+func (e responseValidationError) Error() string {
+	return "upstream response validation failed: " + e.reason
+}
+
+// validate checks the response status, content type and length, the body length is checked when it is read.
+func (r *ResponseValidationRule) validate(res *http.Response) error {
+	if len(r.Statuses) > 0 && !matchStatus(r.Statuses, res.StatusCode) {
+		return responseValidationError{statusCheck, fmt.Sprintf("status %d is not allowed", res.StatusCode)}
+	}
+
+	if len(r.ContentTypes) > 0 && hasResponseBody(res) {
+		ct := res.Header.Get("Content-Type")
+		if ct == "" {
+			return responseValidationError{contentTypeCheck, "missing content type"}
+		}
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return responseValidationError{contentTypeCheck, fmt.Sprintf("invalid content type %q", ct)}
+		}
+		if !matchMediaType(r.ContentTypes, mt) {
+			return responseValidationError{contentTypeCheck, fmt.Sprintf("content type %q is not allowed", mt)}
+		}
+	}
+
+	if r.MaxSize > 0 && res.ContentLength > int64(r.MaxSize) {
+		return responseValidationError{sizeCheck, fmt.Sprintf("content length %d exceeds %s", res.ContentLength, r.MaxSize)}
+	}
+
+	return nil
+}
+
+func matchStatus(statuses []string, code int) bool {
+	s := strconv.Itoa(code)
+	for _, p := range statuses {
+		if p == s || (strings.HasSuffix(p, "xx") && p[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMediaType(types []string, mt string) bool {
+	for _, t := range types {
+		if prefix, ok := strings.CutSuffix(t, "/*"); ok {
+			if strings.HasPrefix(mt, prefix+"/") {
+				return true
+			}
+		} else if t == mt {
+			return true
+		}
+	}
+	return false
+}
+
+func hasResponseBody(res *http.Response) bool {
+	if res.StatusCode < 200 || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if res.Request != nil && res.Request.Method == http.MethodHead {
+		return false
+	}
+	return res.ContentLength != 0
+}
+
+// sizeLimitBody calls exceeded once when more than limit bytes are read,
+// if abort is set reading fails with the error returned by exceeded.
+type sizeLimitBody struct {
+	io.ReadCloser
+	n        int64
+	limit    int64
+	abort    bool
+	err      error
+	exceeded func() error
+}
+
+func (b *sizeLimitBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.n > b.limit {
+		if b.err == nil {
+			b.err = b.exceeded()
+		}
+		if b.abort {
+			return n, b.err
+		}
+	}
+	return n, err
+}
+
+type responseValidator struct {
+	hp    *HTTPProxy
+	rules []*ResponseValidationRule
+}
+
+func (v responseValidator) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil || req.Method == http.MethodConnect {
+		return nil
+	}
+
+	var rule *ResponseValidationRule
+	for _, r := range v.rules {
+		if r.match(req) {
+			rule = r
+			break
+		}
+	}
+	if rule == nil {
+		return nil
+	}
+
+	if err := rule.validate(res); err != nil {
+		v.violation(req, err)
+		if rule.Reject {
+			res.Body.Close()
+			*res = *v.hp.errorResponse(req, err)
+		}
+		return nil
+	}
+
+	if rule.MaxSize > 0 && res.ContentLength < 0 {
+		if _, ok := res.Body.(io.ReadWriteCloser); ok {
+			return nil
+		}
+		res.Body = &sizeLimitBody{
+			ReadCloser: res.Body,
+			limit:      int64(rule.MaxSize),
+			abort:      rule.Reject,
+			exceeded: func() error {
+				err := responseValidationError{sizeCheck, fmt.Sprintf("body size exceeds %s", rule.MaxSize)}
+				v.violation(req, err)
+				return err
+			},
+		}
+	}
+
+	return nil
+}
+
+func (v responseValidator) violation(req *http.Request, err error) {
+	var verr responseValidationError
+	if errors.As(err, &verr) {
+		v.hp.metrics.responseValidation(verr.check)
+	}
+	v.hp.log.Errorf("response from %s: %s", req.URL.Redacted(), err)
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func testResponseValidationRules(t *testing.T, vals ...string) []*ResponseValidationRule {
+	t.Helper()
+
+	var items []ResponseValidationItem
+	for _, val := range vals {
+		item, err := ParseResponseValidationItem(val)
+		if err != nil {
+			t.Fatalf("%s: %v", val, err)
+		}
+		items = append(items, item)
+	}
+	rules, err := NewResponseValidationRules(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseResponseValidationItem(t *testing.T) {
+	item, err := ParseResponseValidationItem(`api\.example\.com:8080/v1/:content-type=application/json; charset=utf-8`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.URL != `api\.example\.com:8080/v1/` || item.Key != ResponseValidationContentType {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	for _, val := range []string{
+		"example.com:status=200",
+		"example.com:status=2xx",
+		"example.com:max-size=10Mi",
+		"example.com:action=reject",
+	} {
+		if _, err := ParseResponseValidationItem(val); err != nil {
+			t.Errorf("%s: %v", val, err)
+		}
+	}
+
+	for _, val := range []string{
+		"example.com",
+		"example.com:foo=bar",
+		"example.com:status=600",
+		"example.com:status=2x",
+		"example.com:max-size=big",
+		"example.com:action=drop",
+		"(:status=200",
+	} {
+		if _, err := ParseResponseValidationItem(val); err == nil {
+			t.Errorf("%s: expected error", val)
+		}
+	}
+}
+
+func TestResponseValidationRuleValidate(t *testing.T) {
+	rules := testResponseValidationRules(t,
+		"example.com/api/:status=2xx",
+		"example.com/api/:status=404",
+		"example.com/api/:content-type=application/json",
+		"example.com/api/:content-type=text/*",
+		"example.com/api/:max-size=1Ki",
+	)
+	r := rules[0]
+
+	tests := []struct {
+		name   string
+		status int
+		ct     string
+		length int64
+		check  string
+	}{
+		{"ok", http.StatusOK, "application/json; charset=utf-8", 10, ""},
+		{"text", http.StatusOK, "text/plain", 10, ""},
+		{"not found", http.StatusNotFound, "application/json", 10, ""},
+		{"no content", http.StatusNoContent, "", 0, ""},
+		{"status", http.StatusInternalServerError, "application/json", 10, statusCheck},
+		{"content type", http.StatusOK, "text/html", 10, ""},
+		{"wrong content type", http.StatusOK, "image/png", 10, contentTypeCheck},
+		{"missing content type", http.StatusOK, "", 10, contentTypeCheck},
+		{"size", http.StatusOK, "application/json", 2048, sizeCheck},
+		{"unknown size", http.StatusOK, "application/json", -1, ""},
+	}
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode:    tc.status,
+				Header:        http.Header{},
+				ContentLength: tc.length,
+				Request:       httptest.NewRequest(http.MethodGet, "http://example.com/api/users", http.NoBody),
+			}
+			if tc.ct != "" {
+				res.Header.Set("Content-Type", tc.ct)
+			}
+
+			err := r.validate(res)
+			var verr responseValidationError
+			if tc.check == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else if !errors.As(err, &verr) || verr.check != tc.check {
+				t.Fatalf("expected %s check to fail, got %v", tc.check, err)
+			}
+		})
+	}
+}
+
+func TestResponseValidatorBodySize(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		action := ResponseValidationLog
+		if reject {
+			action = ResponseValidationReject
+		}
+		v := responseValidator{
+			hp:    &HTTPProxy{log: log.NopLogger, metrics: newMetrics(nil, "", 100)},
+			rules: testResponseValidationRules(t, "example.com:max-size=4B", "example.com:action="+action),
+		}
+
+		res := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			ContentLength: -1,
+			Body:          io.NopCloser(strings.NewReader("0123456789")),
+			Request:       httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+		}
+		if err := v.ModifyResponse(res); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := io.ReadAll(res.Body)
+		if reject {
+			var verr responseValidationError
+			if !errors.As(err, &verr) || verr.check != sizeCheck {
+				t.Fatalf("expected size check error, got %v", err)
+			}
+		} else if err != nil || len(b) != 10 {
+			t.Fatalf("expected full body, got %q %v", b, err)
+		}
+	}
+}
+
+func TestResponseValidatorReject(t *testing.T) {
+	v := responseValidator{
+		hp:    &HTTPProxy{log: log.NopLogger, metrics: newMetrics(nil, "", 100)},
+		rules: testResponseValidationRules(t, "example.com:status=2xx", "example.com:action=reject"),
+	}
+
+	res := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       io.NopCloser(strings.NewReader("<html>error</html>")),
+		Request:    httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody),
+	}
+	if err := v.ModifyResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, res.StatusCode)
+	}
+	if h := res.Header.Get(ErrorHeader); !strings.Contains(h, "status 500 is not allowed") {
+		t.Fatalf("unexpected %s header %q", ErrorHeader, h)
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AdblockMatcher matches URLs against filter lists in Adblock Plus syntax, e.g. EasyList.
+//
+// A subset of the syntax is supported:
+//   - "||example.com^" domain rules,
+//   - URL rules with "*" wildcards, "^" separators and "|" anchors,
+//   - "@@" exception rules, exceptions take precedence over blocking rules.
+//
+// Element hiding rules, regular expression rules and rules with options (after "$") are skipped,
+// as they depend on the page context that is not known to the proxy.
+//
+// Rules are indexed by a keyword, so that only rules sharing a keyword with the URL are evaluated.
+type AdblockMatcher struct {
+	block   adblockRules
+	allow   adblockRules
+	rules   int
+	skipped int
+
+	name     string
+	observer Observer
+}
+
+type adblockRules struct {
+	domains   map[string]struct{}
+	byKeyword map[string][]*regexp.Regexp
+	generic   []*regexp.Regexp
+}
+
+func newAdblockRules() adblockRules {
+	return adblockRules{
+		domains:   make(map[string]struct{}),
+		byKeyword: make(map[string][]*regexp.Regexp),
+	}
+}
+
+// NewAdblockMatcher returns the AdblockMatcher with rules read from the lists.
+func NewAdblockMatcher(lists ...io.Reader) (*AdblockMatcher, error) {
+	m := &AdblockMatcher{
+		block: newAdblockRules(),
+		allow: newAdblockRules(),
+	}
+	for i, r := range lists {
+		if err := m.read(r); err != nil {
+			return nil, fmt.Errorf("list %d: %w", i, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *AdblockMatcher) read(r io.Reader) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		if m.addRule(line) {
+			m.rules++
+		} else {
+			m.skipped++
+		}
+	}
+	return s.Err()
+}
+
+// Rules returns the number of rules added and skipped.
+func (m *AdblockMatcher) Rules() (added, skipped int) {
+	return m.rules, m.skipped
+}
+
+func (m *AdblockMatcher) addRule(line string) bool {
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") ||
+		strings.Contains(line, "#$#") || strings.Contains(line, "$") {
+		return false
+	}
+
+	rules := &m.block
+	if p, ok := strings.CutPrefix(line, "@@"); ok {
+		rules = &m.allow
+		line = p
+	}
+	if line == "" || (len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/")) {
+		return false
+	}
+	line = strings.ToLower(line)
+
+	if d, ok := adblockDomain(line); ok {
+		rules.domains[d] = struct{}{}
+		return true
+	}
+
+	re, err := regexp.Compile(adblockRegexp(line))
+	if err != nil {
+		return false
+	}
+	if k := adblockKeyword(line); k != "" {
+		rules.byKeyword[k] = append(rules.byKeyword[k], re)
+	} else {
+		rules.generic = append(rules.generic, re)
+	}
+
+	return true
+}
+
+// adblockDomain returns the domain of "||example.com^" rules.
+func adblockDomain(rule string) (string, bool) {
+	d, ok := strings.CutPrefix(rule, "||")
+	if !ok {
+		return "", false
+	}
+	d, ok = strings.CutSuffix(d, "^")
+	if !ok || d == "" {
+		return "", false
+	}
+	for i := 0; i < len(d); i++ {
+		if c := d[i]; !isAdblockKeywordChar(c) && c != '.' && c != '-' {
+			return "", false
+		}
+	}
+	return d, true
+}
+
+// adblockSeparator matches the "^" separator, any character but a letter, digit or one of _-.%, or the end of URL.
+const adblockSeparator = `(?:[^a-z0-9_\-.%]|$)`
+
+func adblockRegexp(rule string) string {
+	var sb strings.Builder
+
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		// Matches the beginning of the host name or any subdomain.
+		sb.WriteString(`^[a-z][a-z0-9+.\-]*://(?:[^/?#]*\.)?`)
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		sb.WriteString("^")
+		rule = rule[1:]
+	}
+
+	end := false
+	if strings.HasSuffix(rule, "|") {
+		end = true
+		rule = rule[:len(rule)-1]
+	}
+
+	for _, c := range rule {
+		switch c {
+		case '*':
+			sb.WriteString(".*")
+		case '^':
+			sb.WriteString(adblockSeparator)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if end {
+		sb.WriteString("$")
+	}
+
+	return sb.String()
+}
+
+func isAdblockKeywordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// adblockKeyword returns the longest token of the rule that must appear as a whole token in matching URLs,
+// or empty string if there is no such token.
+func adblockKeyword(rule string) string {
+	startAnchored := strings.HasPrefix(rule, "|")
+	rule = strings.TrimLeft(rule, "|")
+	endAnchored := strings.HasSuffix(rule, "|")
+	rule = strings.TrimRight(rule, "|")
+
+	var best string
+	for i := 0; i < len(rule); {
+		if !isAdblockKeywordChar(rule[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(rule) && isAdblockKeywordChar(rule[j]) {
+			j++
+		}
+
+		// The token must be delimited by literal separators or anchors, not wildcards.
+		before := (i == 0 && startAnchored) || (i > 0 && rule[i-1] != '*')
+		after := (j == len(rule) && endAnchored) || (j < len(rule) && rule[j] != '*')
+		if before && after && j-i >= 3 && j-i > len(best) {
+			best = rule[i:j]
+		}
+		i = j
+	}
+
+	return best
+}
+
+func (r *adblockRules) match(host, u string, tokens []string) bool {
+	for d := host; d != ""; {
+		if _, ok := r.domains[d]; ok {
+			return true
+		}
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+
+	for _, t := range tokens {
+		for _, re := range r.byKeyword[t] {
+			if re.MatchString(u) {
+				return true
+			}
+		}
+	}
+	for _, re := range r.generic {
+		if re.MatchString(u) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func adblockTokens(u string) []string {
+	var tokens []string
+	for i := 0; i < len(u); {
+		if !isAdblockKeywordChar(u[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(u) && isAdblockKeywordChar(u[j]) {
+			j++
+		}
+		if j-i >= 3 {
+			tokens = append(tokens, u[i:j])
+		}
+		i = j
+	}
+	return tokens
+}
+
+// WithObserver returns a new AdblockMatcher that reports lookups to the observer under the rule set name.
+// Filter lists have too many rules to report them individually,
+// the rule IDs are "block" for blocked URLs and "exception" for URLs allowed by exception rules.
+func (m *AdblockMatcher) WithObserver(name string, o Observer) *AdblockMatcher {
+	mm := *m
+	mm.name = name
+	mm.observer = o
+	return &mm
+}
+
+// Match returns true if the URL is blocked by the rules, host is the host name of the URL.
+func (m *AdblockMatcher) Match(host, u string) bool {
+	var start time.Time
+	if m.observer != nil {
+		start = time.Now()
+	}
+
+	host = strings.ToLower(host)
+	u = strings.ToLower(u)
+	tokens := adblockTokens(u)
+
+	blocked := m.block.match(host, u, tokens)
+	allowed := blocked && m.allow.match(host, u, tokens)
+
+	if m.observer != nil {
+		var rule string
+		switch {
+		case allowed:
+			rule = "exception"
+		case blocked:
+			rule = "block"
+		}
+		m.observer.ObserveMatch(m.name, rule, time.Since(start))
+	}
+
+	return blocked && !allowed
+}
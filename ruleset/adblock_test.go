@@ -0,0 +1,89 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testAdblockList = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+||tracker.net^
+|https://cdn.example.org/ads/
+/banner/*/img^
+-ad-300x250.
+.com/pixel.gif|
+@@||tracker.net/consent^
+||social.example.com^$third-party
+example.com##.ad-banner
+/ad[0-9]+\.js/
+`
+
+func TestAdblockMatcher(t *testing.T) {
+	m, err := NewAdblockMatcher(strings.NewReader(testAdblockList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, skipped := m.Rules(); added != 7 || skipped != 3 {
+		t.Fatalf("expected 7 added and 3 skipped rules, got %d and %d", added, skipped)
+	}
+
+	tests := []struct {
+		url   string
+		match bool
+	}{
+		{"http://ads.example.com/", true},
+		{"https://static.ads.example.com:443/x.js", true},
+		{"https://badads.example.com/", false},
+		{"https://ads.example.com.evil.org/", false},
+		{"https://www.example.com/", false},
+		{"https://tracker.net/collect", true},
+		{"https://tracker.net/consent/accept", false},
+		{"https://cdn.example.org/ads/1.png", true},
+		{"https://www.cdn.example.org/ads/1.png", false},
+		{"https://example.net/banner/top/img?x=1", true},
+		{"https://example.net/banner/top/imgs", false},
+		{"https://example.net/static/-ad-300x250.png", true},
+		{"https://shop.com/pixel.gif", true},
+		{"https://shop.com/pixel.gif?id=1", false},
+		{"https://social.example.com/", false},
+		{"https://example.net/ad1.js", false},
+		{"HTTPS://ADS.EXAMPLE.COM/", true},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Match(u.Hostname(), tc.url); got != tc.match {
+			t.Errorf("%s: expected %v, got %v", tc.url, tc.match, got)
+		}
+	}
+}
+
+func TestAdblockKeyword(t *testing.T) {
+	tests := []struct {
+		rule    string
+		keyword string
+	}{
+		{"||ads.example.com/", "example"},
+		{"/banner/*/img^", "banner"},
+		{"ads", ""},
+		{"*tracking*", ""},
+		{"|https://cdn", "https"},
+		{"/track|", "track"},
+		{"/track", ""},
+	}
+	for _, tc := range tests {
+		if got := adblockKeyword(tc.rule); got != tc.keyword {
+			t.Errorf("%s: expected %q, got %q", tc.rule, tc.keyword, got)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import "time"
+
+// Observer is notified of rule set lookups, it is used to collect metrics e.g. to find dead rules and expensive rule sets.
+type Observer interface {
+	// ObserveMatch is called after a lookup in the named rule set with the ID of the rule that decided the result,
+	// and the time spent evaluating the rules.
+	// The rule is empty for negative lookups, i.e. if no rule matched.
+	ObserveMatch(set, rule string, d time.Duration)
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	rules []string
+}
+
+func (o *recordingObserver) ObserveMatch(set, rule string, _ time.Duration) {
+	o.rules = append(o.rules, set+":"+rule)
+}
+
+func TestRegexpMatcherObserver(t *testing.T) {
+	items := make([]RegexpListItem, 0, 3)
+	for _, v := range []string{`\.example\.com$`, `^foo\.`, `-^ads\.`} {
+		item, err := ParseRegexpListItem(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	m, err := NewRegexpMatcherFromList(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var o recordingObserver
+	om := m.WithObserver("test", &o)
+	for _, s := range []string{"www.example.com", "foo.org", "ads.example.com", "bar.org"} {
+		if om.Match(s) != m.Match(s) {
+			t.Fatalf("%s: observed matcher result differs", s)
+		}
+	}
+	if !om.Inverse().Match("bar.org") {
+		t.Fatal("expected inverse match")
+	}
+
+	want := []string{
+		`test:\.example\.com$`,
+		`test:^foo\.`,
+		`test:-^ads\.`,
+		`test:`,
+		`test:`,
+	}
+	if strings.Join(o.rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected observed rules %q, got %q", want, o.rules)
+	}
+}
+
+func TestAdblockMatcherObserver(t *testing.T) {
+	m, err := NewAdblockMatcher(strings.NewReader(testAdblockList))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var o recordingObserver
+	om := m.WithObserver("list", &o)
+	om.Match("ads.example.com", "https://ads.example.com/")
+	om.Match("tracker.net", "https://tracker.net/consent")
+	om.Match("example.org", "https://example.org/")
+
+	want := []string{"list:block", "list:exception", "list:"}
+	if strings.Join(o.rules, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expected observed rules %q, got %q", want, o.rules)
+	}
+}
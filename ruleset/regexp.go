@@ -10,12 +10,20 @@ import (
 	"errors"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type RegexpMatcher struct {
 	include *regexp.Regexp
 	exclude *regexp.Regexp
 	inverse bool
+
+	// includeRules and excludeRules are used to find the rule that matched if an observer is set.
+	includeRules []*regexp.Regexp
+	excludeRules []*regexp.Regexp
+
+	name     string
+	observer Observer
 }
 
 var ErrNoIncludeRules = errors.New("no include rules specified")
@@ -41,30 +49,100 @@ func NewRegexpMatcher(include, exclude []*regexp.Regexp) (*RegexpMatcher, error)
 	}
 
 	return &RegexpMatcher{
-		include: build(include),
-		exclude: build(exclude),
+		include:      build(include),
+		exclude:      build(exclude),
+		includeRules: include,
+		excludeRules: exclude,
 	}, nil
 }
 
 // Inverse returns a new RegexpMatcher that inverts the match result.
 func (r *RegexpMatcher) Inverse() *RegexpMatcher {
-	return &RegexpMatcher{
-		include: r.include,
-		exclude: r.exclude,
-		inverse: !r.inverse,
-	}
+	m := *r
+	m.inverse = !r.inverse
+	return &m
+}
+
+// WithObserver returns a new RegexpMatcher that reports lookups to the observer under the rule set name.
+// The rule IDs are the rules in the format accepted by ParseRegexpListItem.
+func (r *RegexpMatcher) WithObserver(name string, o Observer) *RegexpMatcher {
+	m := *r
+	m.name = name
+	m.observer = o
+	return &m
 }
 
 // Match returns true if the given string matches at least one of the include rules
 // and does not match the exclude rules.
 func (r *RegexpMatcher) Match(s string) bool {
-	m := r.match(s)
+	var m bool
+	if r.observer == nil {
+		m = r.match(s)
+	} else {
+		m = r.observedMatch(s)
+	}
 	if r.inverse {
 		m = !m
 	}
 	return m
 }
 
+func (r *RegexpMatcher) observedMatch(s string) bool {
+	start := time.Now()
+	excluded := r.exclude != nil && r.exclude.MatchString(s)
+	m := !excluded && r.include != nil && r.include.MatchString(s)
+	d := time.Since(start)
+
+	// The matching rule is searched for after the evaluation, so that it is not included in the evaluation time.
+	var rule string
+	switch {
+	case excluded:
+		rule = "-" + firstMatch(r.excludeRules, s)
+	case m:
+		rule = firstMatch(r.includeRules, s)
+	}
+	r.observer.ObserveMatch(r.name, rule, d)
+
+	return m
+}
+
+func firstMatch(rules []*regexp.Regexp, s string) string {
+	for _, re := range rules {
+		if re.MatchString(s) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+// String returns the rules one per line in the format accepted by ParseRegexpListItem,
+// the include rules are followed by the exclude rules prefixed with '-'.
+// Note that the rules are combined into a single regexp for each kind, and the inverse flag is not included.
+func (r *RegexpMatcher) String() string {
+	var sb strings.Builder
+	if r.include != nil {
+		sb.WriteString(r.include.String())
+	}
+	if r.exclude != nil {
+		sb.WriteString("\n-")
+		sb.WriteString(r.exclude.String())
+	}
+	return sb.String()
+}
+
+// Rules returns the individual rules in the format accepted by ParseRegexpListItem,
+// the include rules are followed by the exclude rules.
+func (r *RegexpMatcher) Rules() []string {
+	rules := make([]string, 0, len(r.includeRules)+len(r.excludeRules))
+	for _, re := range r.includeRules {
+		rules = append(rules, re.String())
+	}
+	for _, re := range r.excludeRules {
+		rules = append(rules, "-"+re.String())
+	}
+	return rules
+}
+
 func (r *RegexpMatcher) match(s string) bool {
 	if r.exclude != nil && r.exclude.MatchString(s) {
 		return false
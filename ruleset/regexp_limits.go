@@ -0,0 +1,152 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"time"
+)
+
+// RegexpLimits limit the complexity of regexp rules, rules exceeding the limits are rejected when loaded.
+// Go regexps run in linear time, but long rules with deeply nested groups and repetitions compile to large programs,
+// that are evaluated for every request.
+type RegexpLimits struct {
+	// MaxLength is the maximal length of a rule, zero means no limit.
+	MaxLength int
+
+	// MaxNesting is the maximal nesting depth of groups and repetitions in a rule, zero means no limit.
+	MaxNesting int
+
+	// Anchor wraps rules in ^(?:...)$, so that they match the whole string instead of any substring.
+	Anchor bool
+}
+
+func DefaultRegexpLimits() *RegexpLimits {
+	return &RegexpLimits{
+		MaxLength:  1024,
+		MaxNesting: 8,
+	}
+}
+
+func (l *RegexpLimits) Validate() error {
+	if l.MaxLength < 0 {
+		return fmt.Errorf("max length must be non-negative")
+	}
+	if l.MaxNesting < 0 {
+		return fmt.Errorf("max nesting must be non-negative")
+	}
+	return nil
+}
+
+// Check returns an error if the rule exceeds the limits.
+func (l *RegexpLimits) Check(re *regexp.Regexp) error {
+	s := re.String()
+	if l.MaxLength > 0 && len(s) > l.MaxLength {
+		return fmt.Errorf("rule %q: length %d exceeds limit %d", s, len(s), l.MaxLength)
+	}
+	if l.MaxNesting > 0 {
+		r, err := syntax.Parse(s, syntax.Perl)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", s, err)
+		}
+		if d := nesting(r); d > l.MaxNesting {
+			return fmt.Errorf("rule %q: nesting depth %d exceeds limit %d", s, d, l.MaxNesting)
+		}
+	}
+	return nil
+}
+
+func nesting(r *syntax.Regexp) int {
+	var d int
+	for _, sub := range r.Sub {
+		if n := nesting(sub); n > d {
+			d = n
+		}
+	}
+	switch r.Op { //nolint:exhaustive // other ops do not nest
+	case syntax.OpCapture, syntax.OpStar, syntax.OpPlus, syntax.OpQuest, syntax.OpRepeat:
+		d++
+	}
+	return d
+}
+
+// Apply checks the rules against the limits and returns the rules anchored if Anchor is set.
+func (l *RegexpLimits) Apply(items []RegexpListItem) ([]RegexpListItem, error) {
+	res := make([]RegexpListItem, len(items))
+	for i := range items {
+		if err := l.Check(items[i].Regexp); err != nil {
+			return nil, err
+		}
+		res[i] = items[i]
+		if l.Anchor {
+			re, err := regexp.Compile("^(?:" + items[i].String() + ")$")
+			if err != nil {
+				return nil, err
+			}
+			res[i].Regexp = re
+		}
+	}
+	return res, nil
+}
+
+// NewRegexpMatcherFromList applies the limits to the rules, and returns the RegexpMatcher for them.
+// If l is nil, the rules are used as is.
+func (l *RegexpLimits) NewRegexpMatcherFromList(items []RegexpListItem) (*RegexpMatcher, error) {
+	if l == nil {
+		return NewRegexpMatcherFromList(items)
+	}
+	items, err := l.Apply(items)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegexpMatcherFromList(items)
+}
+
+// RegexpCost is the average time of matching a rule against the inputs.
+type RegexpCost struct {
+	Rule string
+	Cost time.Duration
+}
+
+// BenchmarkRegexpList matches every rule against the inputs n times,
+// and returns the rules sorted by the average match time, the most expensive first.
+func BenchmarkRegexpList(items []RegexpListItem, inputs []string, n int) []RegexpCost {
+	if n <= 0 || len(inputs) == 0 {
+		return nil
+	}
+
+	res := make([]RegexpCost, len(items))
+	for i := range items {
+		re := items[i].Regexp
+		start := time.Now()
+		for j := 0; j < n; j++ {
+			for _, s := range inputs {
+				re.MatchString(s)
+			}
+		}
+		res[i] = RegexpCost{
+			Rule: items[i].rule(),
+			Cost: time.Since(start) / time.Duration(n*len(inputs)),
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Cost > res[j].Cost
+	})
+
+	return res
+}
+
+// rule returns the item in the format accepted by ParseRegexpListItem.
+func (i RegexpListItem) rule() string {
+	if i.exclude {
+		return "-" + i.String()
+	}
+	return i.String()
+}
@@ -0,0 +1,93 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package ruleset
+
+import (
+	"strings"
+	"testing"
+)
+
+func parseRegexpList(t *testing.T, rules ...string) []RegexpListItem {
+	t.Helper()
+	items := make([]RegexpListItem, len(rules))
+	for i, r := range rules {
+		var err error
+		if items[i], err = ParseRegexpListItem(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return items
+}
+
+func TestRegexpLimitsCheck(t *testing.T) {
+	l := RegexpLimits{
+		MaxLength:  32,
+		MaxNesting: 3,
+	}
+
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{rule: `.*\.example\.com$`},
+		{rule: `(a+)+`},
+		{rule: `(?:(?:a))`},
+		{rule: strings.Repeat("a", 33), err: "length 33 exceeds limit 32"},
+		{rule: `((a+)+)`, err: "nesting depth 4 exceeds limit 3"},
+		{rule: `(a*)*b?`},
+		{rule: `((a*)?)*`, err: "nesting depth 5 exceeds limit 3"},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.rule, func(t *testing.T) {
+			err := l.Check(parseRegexpList(t, tc.rule)[0].Regexp)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestRegexpLimitsAnchor(t *testing.T) {
+	l := RegexpLimits{Anchor: true}
+	m, err := l.NewRegexpMatcherFromList(parseRegexpList(t, `example\.com|foo\.org`, `-^bar\.`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"example.com", "foo.org"} {
+		if !m.Match(s) {
+			t.Errorf("expected %q to match", s)
+		}
+	}
+	for _, s := range []string{"www.example.com", "example.com.evil.net", "bar.foo.org"} {
+		if m.Match(s) {
+			t.Errorf("expected %q not to match", s)
+		}
+	}
+}
+
+func TestBenchmarkRegexpList(t *testing.T) {
+	res := BenchmarkRegexpList(parseRegexpList(t, `foo`, `-bar`), []string{"foo", "bar"}, 10)
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res))
+	}
+	rules := []string{res[0].Rule, res[1].Rule}
+	if !(rules[0] == "foo" && rules[1] == "-bar" || rules[0] == "-bar" && rules[1] == "foo") {
+		t.Fatalf("unexpected rules %q", rules)
+	}
+	if res[0].Cost < res[1].Cost {
+		t.Fatal("expected results sorted by cost")
+	}
+}
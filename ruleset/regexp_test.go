@@ -9,6 +9,7 @@ package ruleset
 import (
 	"errors"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -166,3 +167,25 @@ func TestParseRegexpListItem(t *testing.T) {
 		})
 	}
 }
+
+func TestRegexpMatcherString(t *testing.T) {
+	var l []RegexpListItem
+	for _, v := range []string{"foo", "bar", "-baz"} {
+		item, err := ParseRegexpListItem(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l = append(l, item)
+	}
+	m, err := NewRegexpMatcherFromList(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := m.String(), "foo|bar\n-baz"; got != want {
+		t.Fatalf("String(): got %q, want %q", got, want)
+	}
+	if got, want := strings.Join(m.Rules(), "\n"), "foo\nbar\n-baz"; got != want {
+		t.Fatalf("Rules(): got %q, want %q", got, want)
+	}
+}
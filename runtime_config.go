@@ -0,0 +1,183 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// RuntimeConfig is the part of HTTPProxy configuration that can be changed without restarting the proxy.
+// Requests in progress are not affected by the change.
+type RuntimeConfig struct {
+	UpstreamProxy      *url.URL
+	DenyDomains        *ruleset.RegexpMatcher
+	DirectDomains      *ruleset.RegexpMatcher
+	MITMDomains        *ruleset.RegexpMatcher
+	MITMExcludeDomains *ruleset.RegexpMatcher
+	Credentials        *CredentialsMatcher
+	LogHTTPMode        httplog.Mode
+}
+
+// RuntimeConfig returns a copy of the current runtime configuration.
+func (hp *HTTPProxy) RuntimeConfig() RuntimeConfig {
+	return *hp.runtime.Load()
+}
+
+// SetRuntimeConfig atomically replaces the runtime configuration.
+// If the HTTP log mode changes, the middleware stack is rebuilt.
+func (hp *HTTPProxy) SetRuntimeConfig(rc RuntimeConfig) error {
+	hp.reloadMu.Lock()
+	defer hp.reloadMu.Unlock()
+
+	return hp.setRuntimeConfigLocked(rc)
+}
+
+// UpdateRuntimeConfig atomically applies fn to a copy of the current runtime configuration, and replaces it.
+func (hp *HTTPProxy) UpdateRuntimeConfig(fn func(rc *RuntimeConfig)) error {
+	hp.reloadMu.Lock()
+	defer hp.reloadMu.Unlock()
+
+	rc := *hp.runtime.Load()
+	fn(&rc)
+	return hp.setRuntimeConfigLocked(rc)
+}
+
+func (hp *HTTPProxy) setRuntimeConfigLocked(rc RuntimeConfig) error {
+	if err := hp.validateRuntimeConfig(&rc); err != nil {
+		return err
+	}
+	hp.observeRuntimeConfig(&rc)
+
+	prev := hp.runtime.Swap(&rc)
+	if prev.LogHTTPMode != rc.LogHTTPMode {
+		hp.mw.store(hp.middlewareStack())
+	}
+	hp.log.Infof("runtime configuration updated")
+
+	return nil
+}
+
+func (hp *HTTPProxy) validateRuntimeConfig(rc *RuntimeConfig) error {
+	if rc.UpstreamProxy != nil {
+		if hp.config.UpstreamProxyFunc != nil || hp.pac != nil {
+			return fmt.Errorf("cannot set upstream proxy when using PAC or upstream proxy function")
+		}
+		if err := validateProxyURL(rc.UpstreamProxy); err != nil {
+			return fmt.Errorf("upstream_proxy_uri: %w", err)
+		}
+	}
+	if rc.MITMDomains != nil && hp.config.MITM == nil {
+		return fmt.Errorf("cannot set MITM domains when MITM is disabled")
+	}
+	if rc.MITMExcludeDomains != nil && hp.config.MITM == nil {
+		return fmt.Errorf("cannot set MITM exclude domains when MITM is disabled")
+	}
+
+	return nil
+}
+
+// Runtime configuration keys, they match the corresponding command line flags.
+const (
+	RuntimeConfigUpstreamProxy      = "proxy"
+	RuntimeConfigDenyDomains        = "deny-domains"
+	RuntimeConfigDirectDomains      = "direct-domains"
+	RuntimeConfigMITMDomains        = "mitm-domains"
+	RuntimeConfigMITMExcludeDomains = "mitm-exclude-domains"
+	RuntimeConfigCredentials        = "credentials"
+)
+
+// ParseRuntimeConfigValues returns a copy of base with values set from key-value pairs.
+// List values hold one item per line using the same syntax as the corresponding flags.
+// Keys that are not present in kv are reset to their values in base, unknown keys are ignored.
+// Regexp rules are checked against the limits, if not nil.
+func ParseRuntimeConfigValues(base RuntimeConfig, kv map[string]string, limits *ruleset.RegexpLimits, log log.Logger) (RuntimeConfig, error) {
+	rc := base
+
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := strings.TrimSpace(kv[k])
+
+		var err error
+		switch k {
+		case RuntimeConfigUpstreamProxy:
+			rc.UpstreamProxy = nil
+			if v != "" {
+				rc.UpstreamProxy, err = ParseProxyURL(v)
+			}
+		case RuntimeConfigDenyDomains:
+			rc.DenyDomains, err = parseRegexpMatcherLines(v, limits)
+		case RuntimeConfigDirectDomains:
+			rc.DirectDomains, err = parseRegexpMatcherLines(v, limits)
+		case RuntimeConfigMITMDomains:
+			rc.MITMDomains, err = parseRegexpMatcherLines(v, limits)
+		case RuntimeConfigMITMExcludeDomains:
+			rc.MITMExcludeDomains, err = parseRegexpMatcherLines(v, limits)
+		case RuntimeConfigCredentials:
+			rc.Credentials, err = parseCredentialsLines(v, log)
+		default:
+			log.Debugf("ignoring unknown runtime configuration key %q", k)
+		}
+		if err != nil {
+			return base, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	return rc, nil
+}
+
+func splitLines(v string) []string {
+	var lines []string
+	for _, l := range strings.Split(v, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "#") {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+func parseRegexpMatcherLines(v string, limits *ruleset.RegexpLimits) (*ruleset.RegexpMatcher, error) {
+	lines := splitLines(v)
+	if len(lines) == 0 {
+		return nil, nil
+	}
+
+	items := make([]ruleset.RegexpListItem, len(lines))
+	for i, l := range lines {
+		var err error
+		if items[i], err = ruleset.ParseRegexpListItem(l); err != nil {
+			return nil, err
+		}
+	}
+
+	return limits.NewRegexpMatcherFromList(items)
+}
+
+func parseCredentialsLines(v string, log log.Logger) (*CredentialsMatcher, error) {
+	lines := splitLines(v)
+
+	credentials := make([]*HostPortUser, len(lines))
+	for i, l := range lines {
+		var err error
+		if credentials[i], err = ParseHostPortUser(l); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewCredentialsMatcher(credentials, log)
+}
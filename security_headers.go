@@ -0,0 +1,108 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/saucelabs/forwarder/header"
+)
+
+// SecurityHeaderRule injects or strips security headers of MITMed responses from hosts matching the domain,
+// e.g. to experiment with Content-Security-Policy-Report-Only, X-Frame-Options or Referrer-Policy.
+type SecurityHeaderRule struct {
+	// Domain matches host names of requests the rule applies to.
+	Domain *regexp.Regexp
+
+	// Headers are applied in order, added headers replace the headers sent by the server.
+	Headers []header.Header
+}
+
+func (r *SecurityHeaderRule) apply(h http.Header) {
+	for i := range r.Headers {
+		if sh := &r.Headers[i]; sh.Action == header.Add {
+			h.Set(sh.Name, *sh.Value)
+		} else {
+			sh.Apply(h)
+		}
+	}
+}
+
+// SecurityHeaderItem adds a header to the security header rule for the domain.
+type SecurityHeaderItem struct {
+	Domain string
+	Header header.Header
+}
+
+// ParseSecurityHeaderItem parses a <regexp>=<header> string into SecurityHeaderItem,
+// see header.ParseHeader for the header syntax.
+func ParseSecurityHeaderItem(val string) (SecurityHeaderItem, error) {
+	domain, h, ok := strings.Cut(val, "=")
+	if !ok || domain == "" || h == "" {
+		return SecurityHeaderItem{}, errors.New("expected <regexp>=<header>")
+	}
+	if _, err := regexp.Compile(domain); err != nil {
+		return SecurityHeaderItem{}, err
+	}
+	hh, err := header.ParseHeader(h)
+	if err != nil {
+		return SecurityHeaderItem{}, err
+	}
+
+	return SecurityHeaderItem{Domain: domain, Header: hh}, nil
+}
+
+// NewSecurityHeaderRules builds rules from items, rules are returned in order of the first item for the domain.
+func NewSecurityHeaderRules(items []SecurityHeaderItem) ([]*SecurityHeaderRule, error) {
+	var (
+		rules    []*SecurityHeaderRule
+		byDomain = make(map[string]*SecurityHeaderRule)
+	)
+
+	for _, item := range items {
+		r, ok := byDomain[item.Domain]
+		if !ok {
+			re, err := regexp.Compile(item.Domain)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", item.Domain, err)
+			}
+			r = &SecurityHeaderRule{Domain: re}
+			byDomain[item.Domain] = r
+			rules = append(rules, r)
+		}
+		r.Headers = append(r.Headers, item.Header)
+	}
+
+	return rules, nil
+}
+
+// securityHeaders applies all rules matching the host to responses of MITMed requests.
+type securityHeaders struct {
+	hp    *HTTPProxy
+	rules []*SecurityHeaderRule
+}
+
+func (s securityHeaders) ModifyResponse(res *http.Response) error {
+	req := res.Request
+	if req == nil || req.TLS == nil || req.URL.Scheme != "https" {
+		return nil
+	}
+
+	host := req.URL.Hostname()
+	for _, r := range s.rules {
+		if r.Domain.MatchString(host) {
+			r.apply(res.Header)
+			s.hp.log.Debugf("applied security headers of rule %s to response from %s", r.Domain, host)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+func TestParseSecurityHeaderItem(t *testing.T) {
+	for _, val := range []string{
+		`example\.com$=X-Frame-Options: DENY`,
+		".*=-Server",
+		".*=Content-Security-Policy-Report-Only: default-src 'self'; report-uri https://csp.example.com/?a=b",
+	} {
+		if _, err := ParseSecurityHeaderItem(val); err != nil {
+			t.Errorf("%s: %v", val, err)
+		}
+	}
+
+	for _, val := range []string{
+		"X-Frame-Options: DENY",
+		"=X-Frame-Options: DENY",
+		"(=X-Frame-Options: DENY",
+		".*=X Frame Options",
+	} {
+		if _, err := ParseSecurityHeaderItem(val); err == nil {
+			t.Errorf("%s: expected error", val)
+		}
+	}
+}
+
+func TestSecurityHeadersModifyResponse(t *testing.T) {
+	var items []SecurityHeaderItem
+	for _, val := range []string{
+		`example\.com$=X-Frame-Options: DENY`,
+		`.*=Referrer-Policy: no-referrer`,
+		`example\.com$=-Server`,
+	} {
+		item, err := ParseSecurityHeaderItem(val)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	rules, err := NewSecurityHeaderRules(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+
+	s := securityHeaders{
+		hp:    &HTTPProxy{log: log.NopLogger},
+		rules: rules,
+	}
+
+	response := func(rawURL string, tlsState *tls.ConnectionState) *http.Response {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &http.Response{
+			Header: http.Header{
+				"X-Frame-Options": {"SAMEORIGIN"},
+				"Server":          {"origin"},
+			},
+			Request: &http.Request{URL: u, TLS: tlsState},
+		}
+		if err := s.ModifyResponse(res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := response("https://www.example.com/", &tls.ConnectionState{})
+	if got := res.Header.Values("X-Frame-Options"); len(got) != 1 || got[0] != "DENY" {
+		t.Errorf("unexpected X-Frame-Options %v", got)
+	}
+	if res.Header.Get("Server") != "" {
+		t.Error("expected Server header to be removed")
+	}
+	if res.Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Error("expected Referrer-Policy header")
+	}
+
+	res = response("https://example.org/", &tls.ConnectionState{})
+	if res.Header.Get("X-Frame-Options") != "SAMEORIGIN" || res.Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("unexpected headers %v", res.Header)
+	}
+
+	res = response("http://www.example.com/", nil)
+	if res.Header.Get("X-Frame-Options") != "SAMEORIGIN" || res.Header.Get("Referrer-Policy") != "" {
+		t.Errorf("expected headers of not MITMed response to be unchanged, got %v", res.Header)
+	}
+}
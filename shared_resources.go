@@ -0,0 +1,100 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian/mitm"
+	"github.com/saucelabs/forwarder/ratelimit"
+)
+
+type SharedResourcesConfig struct {
+	// HTTPTransportConfig configures the transports of the proxies, the dialer and its DNS cache are shared.
+	HTTPTransportConfig
+
+	// MITMCacheSize limits the number of generated MITM certificates kept in memory for all proxies,
+	// zero means no limit. Certificates are cached per CA, proxies using the same CA share the certificates.
+	MITMCacheSize int
+
+	// ReadLimit and WriteLimit are the total bandwidth limits of all proxies in bytes per second, zero means no limit.
+	// They apply in addition to the limits of the proxies.
+	ReadLimit  SizeSuffix
+	WriteLimit SizeSuffix
+}
+
+func DefaultSharedResourcesConfig() *SharedResourcesConfig {
+	cfg := &SharedResourcesConfig{
+		HTTPTransportConfig: *DefaultHTTPTransportConfig(),
+	}
+	cfg.DNSCacheTTL = time.Minute
+	return cfg
+}
+
+func (c *SharedResourcesConfig) Validate() error {
+	if c.MITMCacheSize < 0 {
+		return fmt.Errorf("mitm_cache_size must be non-negative")
+	}
+	if c.ReadLimit < 0 {
+		return fmt.Errorf("read_limit must be non-negative")
+	}
+	if c.WriteLimit < 0 {
+		return fmt.Errorf("write_limit must be non-negative")
+	}
+	return nil
+}
+
+// SharedResources are resources shared explicitly by multiple HTTPProxy and SOCKS5Server instances in one process,
+// instead of every instance creating its own, see HTTPProxyConfig.Shared.
+// It holds the HTTP transport dialer with its DNS cache, the MITM certificate cache, and the total bandwidth limiters.
+//
+// Every proxy gets a copy of the transport, as the transport is configured with the upstream proxy of the proxy,
+// connection pools are per proxy.
+type SharedResources struct {
+	transport *http.Transport
+	mitmCerts *mitm.CertCache
+	limiters  *ratelimit.Limiters
+}
+
+func NewSharedResources(cfg *SharedResourcesConfig) (*SharedResources, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	tr, err := NewHTTPTransport(&cfg.HTTPTransportConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SharedResources{
+		transport: tr,
+		mitmCerts: mitm.NewCertCache(cfg.MITMCacheSize),
+	}
+	if cfg.ReadLimit > 0 || cfg.WriteLimit > 0 {
+		// See HTTPProxy.listen for the meaning of the read and write limits.
+		s.limiters = ratelimit.NewLimiters(int64(cfg.WriteLimit), int64(cfg.ReadLimit))
+	}
+
+	return s, nil
+}
+
+// Transport returns a copy of the transport sharing the dialer and its DNS cache,
+// proxies created with a nil round tripper use it.
+func (s *SharedResources) Transport() *http.Transport {
+	return s.transport.Clone()
+}
+
+// listener returns the listener limited by the shared bandwidth limiters.
+func (s *SharedResources) listener(l net.Listener) net.Listener {
+	if s.limiters == nil {
+		return l
+	}
+	return s.limiters.Listener(l)
+}
@@ -0,0 +1,56 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/ratelimit"
+)
+
+func TestSharedResources(t *testing.T) {
+	cfg := DefaultSharedResourcesConfig()
+	cfg.ReadLimit = Mebi
+	s, err := NewSharedResources(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newProxy := func() *HTTPProxy {
+		pc := DefaultHTTPProxyConfig()
+		pc.Addr = "localhost:0"
+		pc.MITM = DefaultMITMConfig()
+		pc.Shared = s
+		hp, err := NewHTTPProxy(pc, nil, nil, nil, log.NopLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { hp.Close() })
+		return hp
+	}
+	hp1, hp2 := newProxy(), newProxy()
+
+	if hp1.transport == hp2.transport {
+		t.Fatal("expected a copy of the shared transport per proxy")
+	}
+	if _, ok := hp1.transport.(*http.Transport); !ok {
+		t.Fatalf("expected *http.Transport, got %T", hp1.transport)
+	}
+	if _, ok := hp1.listener.(*ratelimit.Listener); !ok {
+		t.Fatalf("expected shared bandwidth limits, got %T", hp1.listener)
+	}
+}
+
+func TestSharedResourcesConfigValidate(t *testing.T) {
+	cfg := DefaultSharedResourcesConfig()
+	cfg.MITMCacheSize = -1
+	if _, err := NewSharedResources(cfg); err == nil {
+		t.Fatal("expected error")
+	}
+}
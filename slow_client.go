@@ -0,0 +1,137 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// SlowClientConfig aborts writing responses to clients that read slower than MinRate.
+// The rate is checked after the response has been written for at least Grace,
+// a single write that takes longer than Grace aborts the response as well.
+type SlowClientConfig struct {
+	// MinRate is the minimal average number of bytes per second written to the client.
+	MinRate SizeSuffix
+
+	// Grace is the time spent writing to the client before the rate is enforced.
+	Grace time.Duration
+}
+
+func DefaultSlowClientConfig() *SlowClientConfig {
+	return &SlowClientConfig{
+		Grace: 30 * time.Second,
+	}
+}
+
+func (c *SlowClientConfig) Validate() error {
+	if c.MinRate <= 0 {
+		return fmt.Errorf("min rate must be positive")
+	}
+	if c.Grace <= 0 {
+		return fmt.Errorf("grace must be positive")
+	}
+	return nil
+}
+
+var errSlowClient = errors.New("slow client")
+
+// responseStreamTimer measures the time spent reading response bodies from upstream
+// and writing them to clients, and aborts responses to slow clients if configured.
+// It must be the last response modifier, so that it wraps the body written to the client.
+func (hp *HTTPProxy) responseStreamTimer() martian.ResponseModifier {
+	return martian.ResponseModifierFunc(func(res *http.Response) error {
+		if res.Body == nil || res.Body == http.NoBody || res.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+
+		b := &timedBody{
+			body:    res.Body,
+			cfg:     hp.config.SlowClient,
+			observe: hp.metrics.responseStream,
+			abort:   hp.metrics.slowClientAbort,
+		}
+		if b.cfg != nil {
+			if ctx := martian.NewContext(res.Request); ctx != nil {
+				b.session = ctx.Session()
+			}
+		}
+		res.Body = b
+		return nil
+	})
+}
+
+// timedBody splits the time of writing a response into the time spent in Read, waiting for upstream,
+// and the time between reads, writing the previously read bytes to the client.
+type timedBody struct {
+	body    io.ReadCloser
+	cfg     *SlowClientConfig
+	session *martian.Session
+	observe func(leg string, d time.Duration)
+	abort   func()
+
+	last     time.Time
+	upstream time.Duration
+	client   time.Duration
+	written  int64
+	closed   bool
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	if !b.last.IsZero() {
+		b.client += start.Sub(b.last)
+	}
+
+	if err := b.checkRate(); err != nil {
+		b.last = time.Now()
+		b.abort()
+		return 0, err
+	}
+
+	n, err := b.body.Read(p)
+	b.last = time.Now()
+	b.upstream += b.last.Sub(start)
+	b.written += int64(n)
+
+	if b.session != nil && n > 0 {
+		b.session.SetWriteDeadline(b.last.Add(b.cfg.Grace)) //nolint:errcheck // best effort
+	}
+
+	return n, err
+}
+
+func (b *timedBody) checkRate() error {
+	if b.cfg == nil || b.client < b.cfg.Grace {
+		return nil
+	}
+	if rate := float64(b.written) / b.client.Seconds(); rate < float64(b.cfg.MinRate) {
+		return fmt.Errorf("%w: %.0f bytes/s, minimum is %s/s", errSlowClient, rate, b.cfg.MinRate)
+	}
+	return nil
+}
+
+func (b *timedBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		if !b.last.IsZero() {
+			b.client += time.Since(b.last)
+		}
+		b.observe("upstream", b.upstream)
+		b.observe("client", b.client)
+
+		if b.session != nil {
+			b.session.SetWriteDeadline(time.Time{}) //nolint:errcheck // best effort
+		}
+	}
+	return b.body.Close()
+}
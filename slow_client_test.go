@@ -0,0 +1,79 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+type slowReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.r.Read(p)
+}
+
+func TestTimedBody(t *testing.T) {
+	d := make(map[string]time.Duration)
+	b := &timedBody{
+		body:    io.NopCloser(slowReader{strings.NewReader("hello world"), 10 * time.Millisecond}),
+		observe: func(leg string, v time.Duration) { d[leg] = v },
+	}
+
+	// Simulate a client that takes longer to write than the upstream to read.
+	buf := make([]byte, 4)
+	for {
+		_, err := b.Read(buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d["upstream"] < 40*time.Millisecond {
+		t.Fatalf("expected upstream time at least 40ms, got %s", d["upstream"])
+	}
+	if d["client"] < 60*time.Millisecond {
+		t.Fatalf("expected client time at least 60ms, got %s", d["client"])
+	}
+}
+
+func TestTimedBodySlowClient(t *testing.T) {
+	var aborted int
+	b := &timedBody{
+		body:    io.NopCloser(strings.NewReader(strings.Repeat("x", 100))),
+		cfg:     &SlowClientConfig{MinRate: 1000, Grace: 20 * time.Millisecond},
+		observe: func(string, time.Duration) {},
+		abort:   func() { aborted++ },
+	}
+
+	buf := make([]byte, 10)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = b.Read(buf)
+		time.Sleep(20 * time.Millisecond) // 500 bytes/s
+	}
+	if !errors.Is(err, errSlowClient) {
+		t.Fatalf("expected %v, got %v", errSlowClient, err)
+	}
+	if aborted != 1 {
+		t.Fatalf("expected 1 abort, got %d", aborted)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+// SNIRoute selects the certificate and the policy for connections to the TLS proxy listener
+// by the server name the client presents in the TLS handshake.
+type SNIRoute struct {
+	// ServerName is the TLS server name, "*.example.com" matches any subdomain of example.com.
+	ServerName string
+
+	// TLSServerConfig is the certificate presented to clients, if not set the proxy certificate is used.
+	TLSServerConfig
+
+	// Policy overlays proxy settings for requests received over the connection.
+	// The policy of the authenticated user takes precedence.
+	Policy *UserPolicy
+}
+
+func (r *SNIRoute) isWildcard() bool {
+	return strings.HasPrefix(r.ServerName, "*.")
+}
+
+func (r *SNIRoute) match(name string) bool {
+	if r.isWildcard() {
+		return len(name) > len(r.ServerName)-1 && strings.HasSuffix(strings.ToLower(name), strings.ToLower(r.ServerName[1:]))
+	}
+	return strings.EqualFold(name, r.ServerName)
+}
+
+// Supported SNI route keys in addition to the user policy keys.
+const (
+	SNIRouteCertFile = "cert-file"
+	SNIRouteKeyFile  = "key-file"
+)
+
+// SNIRouteItem sets a single SNI route key.
+type SNIRouteItem struct {
+	ServerName string
+	Key        string
+	Value      string
+}
+
+// ParseSNIRouteItem parses a <server-name>:<key>=<value> string into SNIRouteItem.
+func ParseSNIRouteItem(val string) (SNIRouteItem, error) {
+	var item SNIRouteItem
+
+	name, kv, ok := strings.Cut(val, ":")
+	if !ok || name == "" {
+		return item, errors.New("expected <server-name>:<key>=<value>")
+	}
+	item.ServerName = name
+
+	item.Key, item.Value, ok = strings.Cut(kv, "=")
+	if !ok {
+		return item, errors.New("expected <server-name>:<key>=<value>")
+	}
+	if item.Key != SNIRouteCertFile && item.Key != SNIRouteKeyFile && !isUserPolicyKey(item.Key) {
+		return item, fmt.Errorf("unsupported key %q", item.Key)
+	}
+
+	return item, nil
+}
+
+// NewSNIRoutes builds routes from items, routes are returned in order of the first item for the server name.
+// Domain rules are checked against the limits, if not nil.
+func NewSNIRoutes(items []SNIRouteItem, limits *ruleset.RegexpLimits) ([]*SNIRoute, error) {
+	var (
+		routes   []*SNIRoute
+		builders = make(map[string]*policyBuilder)
+		byName   = make(map[string]*SNIRoute)
+	)
+
+	for _, item := range items {
+		r, ok := byName[item.ServerName]
+		if !ok {
+			r = &SNIRoute{ServerName: item.ServerName}
+			byName[item.ServerName] = r
+			routes = append(routes, r)
+		}
+
+		var err error
+		switch item.Key {
+		case SNIRouteCertFile:
+			r.CertFile = item.Value
+		case SNIRouteKeyFile:
+			r.KeyFile = item.Value
+		default:
+			b, ok := builders[item.ServerName]
+			if !ok {
+				b = new(policyBuilder)
+				builders[item.ServerName] = b
+			}
+			err = b.set(item.Key, item.Value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", item.ServerName, item.Key, err)
+		}
+	}
+
+	for name, b := range builders {
+		p, err := b.build(limits)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		byName[name].Policy = p
+	}
+
+	return routes, nil
+}
+
+func validateSNIRoutes(routes []*SNIRoute) error {
+	for _, r := range routes {
+		if r.ServerName == "" {
+			return errors.New("server name cannot be empty")
+		}
+		if (r.CertFile == "") != (r.KeyFile == "") {
+			return fmt.Errorf("%s: both cert-file and key-file must be set", r.ServerName)
+		}
+	}
+	return nil
+}
+
+// configureSNIRoutes loads the certificates of SNI routes and selects them by the client server name.
+// If the route does not have a certificate, the proxy certificate is used.
+func (hp *HTTPProxy) configureSNIRoutes() error {
+	certs := make(map[*SNIRoute]*tls.Certificate)
+	for _, r := range hp.config.SNIRoutes {
+		if r.CertFile == "" {
+			continue
+		}
+		cert, err := loadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return fmt.Errorf("sni route %s: %w", r.ServerName, err)
+		}
+		certs[r] = &cert
+		hp.log.Infof("using certificate from %s for server name %s", r.CertFile, r.ServerName)
+	}
+	if len(certs) == 0 {
+		return nil
+	}
+
+	hp.TLSConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if r := hp.sniRoute(hello.ServerName); r != nil {
+			return certs[r], nil
+		}
+		return nil, nil //nolint:nilnil // fallback to the proxy certificate
+	}
+
+	return nil
+}
+
+func (hp *HTTPProxy) sniRoute(name string) *SNIRoute {
+	return matchSNIRoute(hp.config.SNIRoutes, name)
+}
+
+// matchSNIRoute returns the route for the server name, exact matches take precedence over wildcards.
+func matchSNIRoute(routes []*SNIRoute, name string) *SNIRoute {
+	if name == "" {
+		return nil
+	}
+
+	var wildcard *SNIRoute
+	for _, r := range routes {
+		if !r.match(name) {
+			continue
+		}
+		if !r.isWildcard() {
+			return r
+		}
+		if wildcard == nil {
+			wildcard = r
+		}
+	}
+	return wildcard
+}
+
+const serverNameKey = "listener-server-name"
+
+// listenerServerName returns the TLS server name the client sent when connecting to the proxy.
+// For CONNECT requests the name is stored in the session,
+// so that requests in MITM tunnels are not matched with the TLS server name of the origin.
+func (hp *HTTPProxy) listenerServerName(req *http.Request) string {
+	ctx := martian.NewContext(req)
+	if ctx != nil {
+		if v, ok := ctx.Session().Get(serverNameKey); ok {
+			return v.(string) //nolint:forcetypeassert // we know the type
+		}
+	}
+
+	var name string
+	if req.TLS != nil {
+		name = req.TLS.ServerName
+	}
+	if ctx != nil && req.Method == http.MethodConnect {
+		ctx.Session().Set(serverNameKey, name)
+	}
+	return name
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"testing"
+)
+
+func TestNewSNIRoutes(t *testing.T) {
+	var items []SNIRouteItem
+	for _, s := range []string{
+		"*.tenant.example.com:proxy=upstream-wildcard:3128",
+		"a.tenant.example.com:cert-file=a.crt",
+		"a.tenant.example.com:key-file=a.key",
+		"a.tenant.example.com:deny-domains=^ads\\.",
+		"b.example.com:rate-limit=10",
+	} {
+		item, err := ParseSNIRouteItem(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+
+	routes, err := NewSNIRoutes(items, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateSNIRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 3 {
+		t.Fatalf("expected 3 routes, got %d", len(routes))
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "a.tenant.example.com", expected: "a.tenant.example.com"},
+		{name: "A.Tenant.Example.com", expected: "a.tenant.example.com"},
+		{name: "c.tenant.example.com", expected: "*.tenant.example.com"},
+		{name: "tenant.example.com", expected: ""},
+		{name: "b.example.com", expected: "b.example.com"},
+		{name: "", expected: ""},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			var got string
+			if r := matchSNIRoute(routes, tc.name); r != nil {
+				got = r.ServerName
+			}
+			if got != tc.expected {
+				t.Fatalf("expected route %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	a := matchSNIRoute(routes, "a.tenant.example.com")
+	if a.CertFile != "a.crt" || a.KeyFile != "a.key" {
+		t.Fatalf("unexpected certificate %+v", a.TLSServerConfig)
+	}
+	if a.Policy == nil || !a.Policy.DenyDomains.Match("ads.example.com") {
+		t.Fatal("expected deny domains policy")
+	}
+}
+
+func TestParseSNIRouteItemErrors(t *testing.T) {
+	for _, s := range []string{"", "example.com", ":cert-file=a", "example.com:foo=bar"} {
+		if _, err := ParseSNIRouteItem(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
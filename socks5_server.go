@@ -0,0 +1,425 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+type SOCKS5ServerConfig struct {
+	Addr             string
+	HandshakeTimeout time.Duration
+}
+
+func DefaultSOCKS5ServerConfig() *SOCKS5ServerConfig {
+	return &SOCKS5ServerConfig{
+		HandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func (c *SOCKS5ServerConfig) Validate() error {
+	if c.Addr == "" {
+		return errors.New("address is required")
+	}
+	if c.HandshakeTimeout <= 0 {
+		return errors.New("handshake_timeout must be positive")
+	}
+	return nil
+}
+
+// SOCKS5Server serves SOCKS5 clients by bridging CONNECT commands to CONNECT requests handled by the HTTP proxy.
+// The same credentials, rules and upstream proxies apply to both protocols,
+// the egress may go through an HTTP or SOCKS5 upstream proxy.
+//
+// Clients authenticate with username and password, they are checked by the HTTP proxy as basic auth credentials.
+// Failed authentication is reported to the client as connection not allowed by ruleset.
+type SOCKS5Server struct {
+	config   SOCKS5ServerConfig
+	hp       *HTTPProxy
+	log      log.Logger
+	listener net.Listener
+}
+
+// NewSOCKS5Server creates a new SOCKS5 server that forwards connections via the HTTP proxy.
+// It is the caller's responsibility to call Close on the returned server.
+func NewSOCKS5Server(cfg *SOCKS5ServerConfig, hp *HTTPProxy, log log.Logger) (*SOCKS5Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if hp.config.BasicAuth != nil && hp.config.AuthScheme == DigestAuthScheme {
+		return nil, fmt.Errorf("%s auth scheme is not supported", DigestAuthScheme)
+	}
+
+	l, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open listener on address %s: %w", cfg.Addr, err)
+	}
+	l = hp.filterClients(l)
+	if hp.config.Shared != nil {
+		l = hp.config.Shared.listener(l)
+	}
+
+	s := &SOCKS5Server{
+		config:   *cfg,
+		hp:       hp,
+		log:      log,
+		listener: l,
+	}
+	s.log.Infof("SOCKS5 server listen address=%s", l.Addr())
+
+	return s, nil
+}
+
+func (s *SOCKS5Server) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, conn)
+		}()
+	}
+}
+
+// Addr returns the address the server is listening on.
+func (s *SOCKS5Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *SOCKS5Server) Close() error {
+	return s.listener.Close()
+}
+
+const socks5Version = 0x05
+
+// SOCKS5 authentication methods, see RFC 1928 and RFC 1929.
+const (
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+)
+
+// SOCKS5 commands and address types.
+const (
+	socks5CmdConnect  = 0x01
+	socks5AddrIPv4    = 0x01
+	socks5AddrDomain  = 0x03
+	socks5AddrIPv6    = 0x04
+	socks5PasswordVer = 0x01
+)
+
+// SOCKS5 reply codes.
+const (
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+type socks5Error struct {
+	reply byte
+	err   error
+}
+
+func (e socks5Error) Error() string {
+	return e.err.Error()
+}
+
+func (s *SOCKS5Server) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	br := bufio.NewReader(conn)
+
+	user, err := s.negotiate(br, conn)
+	if err != nil {
+		s.log.Debugf("SOCKS5 handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	target, err := readSOCKS5Request(br)
+	if err == nil {
+		var upstream net.Conn
+		upstream, err = s.connect(conn.RemoteAddr(), target, user)
+		if err == nil {
+			defer upstream.Close()
+			if err = writeSOCKS5Reply(conn, socks5Succeeded); err != nil {
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			s.tunnel(br, conn, upstream)
+			return
+		}
+	}
+
+	s.log.Infof("SOCKS5 request from %s failed: %s", conn.RemoteAddr(), err)
+	reply := byte(socks5GeneralFailure)
+	var serr socks5Error
+	if errors.As(err, &serr) {
+		reply = serr.reply
+	}
+	writeSOCKS5Reply(conn, reply)
+}
+
+// negotiate selects the authentication method and returns the user credentials if provided.
+// Username and password are required if the HTTP proxy requires authentication.
+func (s *SOCKS5Server) negotiate(br *bufio.Reader, w io.Writer) (*url.Userinfo, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return nil, err
+	}
+
+	authRequired := s.hp.authRequired()
+	method := byte(socks5AuthNoAcceptable)
+	switch {
+	case bytes.IndexByte(methods, socks5AuthPassword) >= 0:
+		method = socks5AuthPassword
+	case !authRequired && bytes.IndexByte(methods, socks5AuthNone) >= 0:
+		method = socks5AuthNone
+	}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case socks5AuthNone:
+		return nil, nil
+	case socks5AuthPassword:
+		return readSOCKS5Password(br, w)
+	default:
+		return nil, errors.New("no acceptable authentication method")
+	}
+}
+
+// readSOCKS5Password reads the username and password as specified in RFC 1929.
+// The credentials are checked by the HTTP proxy, the sub-negotiation always succeeds.
+func readSOCKS5Password(br *bufio.Reader, w io.Writer) (*url.Userinfo, error) {
+	ver, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if ver != socks5PasswordVer {
+		return nil, fmt.Errorf("unsupported auth version %d", ver)
+	}
+	user, err := readSOCKS5String(br)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := readSOCKS5String(br)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte{socks5PasswordVer, 0x00}); err != nil {
+		return nil, err
+	}
+
+	return url.UserPassword(user, pass), nil
+}
+
+func readSOCKS5String(br *bufio.Reader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// readSOCKS5Request reads the request and returns the target address in host:port format.
+func readSOCKS5Request(br *bufio.Reader) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socks5Version {
+		return "", fmt.Errorf("unsupported version %d", hdr[0])
+	}
+	if hdr[1] != socks5CmdConnect {
+		return "", socks5Error{socks5CmdNotSupported, fmt.Errorf("unsupported command %d", hdr[1])}
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AddrDomain:
+		var err error
+		if host, err = readSOCKS5String(br); err != nil {
+			return "", err
+		}
+	default:
+		return "", socks5Error{socks5AddrTypeUnsupported, fmt.Errorf("unsupported address type %d", hdr[3])}
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func writeSOCKS5Reply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socks5Version, reply, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// connect sends a CONNECT request to the HTTP proxy over an in-memory connection and returns the tunnel.
+func (s *SOCKS5Server) connect(remote net.Addr, target string, user *url.Userinfo) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		pass, _ := user.Password()
+		req.Header.Set(middleware.ProxyAuthorizationHeader,
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+
+	c, res, err := s.hp.connectInMemory(remote, req, s.config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 != 2 {
+		return nil, socks5Error{socks5ReplyForStatus(res.StatusCode), fmt.Errorf("proxy returned %s", res.Status)}
+	}
+
+	return c, nil
+}
+
+// connectInMemory sends the CONNECT request to the proxy over an in-memory connection on behalf of the remote client.
+// If the proxy accepts the request, it returns the tunnel, otherwise only the response is returned.
+func (hp *HTTPProxy) connectInMemory(remote net.Addr, req *http.Request, timeout time.Duration) (net.Conn, *http.Response, error) {
+	c, sc := net.Pipe()
+	go hp.proxy.ServeConn(remoteAddrConn{Conn: sc, remote: remote})
+
+	c.SetDeadline(time.Now().Add(timeout))
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	res.Body.Close()
+	c.SetDeadline(time.Time{})
+
+	if res.StatusCode/100 != 2 {
+		c.Close()
+		return nil, res, nil
+	}
+
+	return bufferedConn{Conn: c, r: br}, res, nil
+}
+
+func socks5ReplyForStatus(code int) byte {
+	switch code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socks5NotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return socks5HostUnreachable
+	default:
+		return socks5GeneralFailure
+	}
+}
+
+func (s *SOCKS5Server) tunnel(br *bufio.Reader, conn, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, br)
+		upstream.Close()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	<-done
+}
+
+// remoteAddrConn reports the address of the client connection bridged over an in-memory connection.
+type remoteAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// bufferedConn reads from the buffered reader, so that data read ahead is not lost.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
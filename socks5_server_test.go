@@ -0,0 +1,110 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestReadSOCKS5Request(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    []byte
+		target string
+		reply  byte
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}, "127.0.0.1:80", 0},
+		{"ipv6", append(append([]byte{5, 1, 0, 4}, make([]byte, 15)...), 1, 1, 187), "[::1]:443", 0},
+		{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0x1f, 0x90), "example.com:8080", 0},
+		{"bind", []byte{5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, "", socks5CmdNotSupported},
+		{"address type", []byte{5, 1, 0, 5, 127, 0, 0, 1, 0, 80}, "", socks5AddrTypeUnsupported},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			target, err := readSOCKS5Request(bufio.NewReader(bytes.NewReader(tc.req)))
+			if tc.reply != 0 {
+				var serr socks5Error
+				if !errors.As(err, &serr) || serr.reply != tc.reply {
+					t.Fatalf("expected reply %d, got %v", tc.reply, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target != tc.target {
+				t.Fatalf("expected target %q, got %q", tc.target, target)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Negotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    *url.Userinfo
+		in      []byte
+		method  byte
+		user    string
+		wantErr bool
+	}{
+		{"no auth", nil, []byte{5, 1, 0}, socks5AuthNone, "", false},
+		{"password", nil, append([]byte{5, 2, 0, 2, 1, 4}, "user\x04pass"...), socks5AuthPassword, "user", false},
+		{"auth required", url.UserPassword("user", "pass"), []byte{5, 1, 0}, socks5AuthNoAcceptable, "", true},
+		{"auth required password", url.UserPassword("user", "pass"), append([]byte{5, 1, 2, 1, 4}, "user\x04pass"...), socks5AuthPassword, "user", false},
+		{"version", nil, []byte{4, 1, 0}, 0, "", true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			s := &SOCKS5Server{hp: &HTTPProxy{}}
+			s.hp.config.BasicAuth = tc.auth
+
+			var out bytes.Buffer
+			u, err := s.negotiate(bufio.NewReader(bytes.NewReader(tc.in)), &out)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.method != 0 || !tc.wantErr {
+				if b := out.Bytes(); len(b) < 2 || b[1] != tc.method {
+					t.Fatalf("expected method %d, got %v", tc.method, b)
+				}
+			}
+			if tc.user != "" && (u == nil || u.Username() != tc.user) {
+				t.Fatalf("expected user %q, got %v", tc.user, u)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ReplyForStatus(t *testing.T) {
+	tests := map[int]byte{
+		http.StatusForbidden:           socks5NotAllowed,
+		http.StatusProxyAuthRequired:   socks5NotAllowed,
+		http.StatusBadGateway:          socks5HostUnreachable,
+		http.StatusGatewayTimeout:      socks5HostUnreachable,
+		http.StatusInternalServerError: socks5GeneralFailure,
+	}
+	for code, want := range tests {
+		if got := socks5ReplyForStatus(code); got != want {
+			t.Errorf("%d: expected reply %d, got %d", code, want, got)
+		}
+	}
+}
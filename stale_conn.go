@@ -0,0 +1,99 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"syscall"
+)
+
+// staleConnRetrier retries requests that failed on a reused upstream connection,
+// which was likely closed by the server after an idle timeout.
+// The standard library transport retries replayable requests if reading the response fails,
+// the retrier counts these retries and retries requests once more if the transport returns such an error,
+// for example when writing the request fails.
+type staleConnRetrier struct {
+	rt     http.RoundTripper
+	report func(outcome string)
+}
+
+func (r staleConnRetrier) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isReplayable(req) {
+		return r.rt.RoundTrip(req)
+	}
+
+	res, reused, err := r.roundTrip(req)
+	if err == nil || !reused || !isStaleConnError(err) || req.Context().Err() != nil {
+		return res, err
+	}
+
+	if req.GetBody != nil {
+		body, berr := req.GetBody()
+		if berr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	res, _, err = r.roundTrip(req)
+	r.report(retryOutcome(err))
+	return res, err
+}
+
+// roundTrip sends the request and reports the retries made by the transport.
+// It returns true if the last connection used was reused.
+func (r staleConnRetrier) roundTrip(req *http.Request) (*http.Response, bool, error) {
+	var (
+		conns  atomic.Int32
+		reused atomic.Bool
+	)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conns.Add(1)
+			reused.Store(info.Reused)
+		},
+	}
+	res, err := r.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+
+	for i := int32(1); i < conns.Load(); i++ {
+		r.report(retryOutcome(err))
+	}
+
+	return res, reused.Load(), err
+}
+
+func retryOutcome(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// isReplayable returns true if the request can be sent again, see http.Request.isReplayable.
+func isReplayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	return ok
+}
+
+func isStaleConnError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// serveResetSecondRequest answers the first request on each connection,
+// and resets the connection after reading the second one.
+func serveResetSecondRequest(t *testing.T, l net.Listener) {
+	t.Helper()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			br := bufio.NewReader(c)
+			for i := 0; ; i++ {
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, req.Body)
+				if i == 1 {
+					c.(*net.TCPConn).SetLinger(0)
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+			}
+		}()
+	}
+}
+
+func TestStaleConnRetrier(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveResetSecondRequest(t, l)
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		retried bool
+	}{
+		{
+			name:    "get",
+			method:  http.MethodGet,
+			retried: true,
+		},
+		{
+			name:   "post",
+			method: http.MethodPost,
+			body:   "body",
+		},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &http.Transport{}
+			defer tr.CloseIdleConnections()
+
+			var outcomes []string
+			rt := staleConnRetrier{rt: tr, report: func(outcome string) {
+				outcomes = append(outcomes, outcome)
+			}}
+
+			send := func() (*http.Response, error) {
+				var body io.Reader
+				if tc.body != "" {
+					body = strings.NewReader(tc.body)
+				}
+				req, err := http.NewRequest(tc.method, "http://"+l.Addr().String()+"/", body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Do not use GetBody, proxied requests cannot be rewound.
+				req.GetBody = nil
+				return rt.RoundTrip(req)
+			}
+
+			res, err := send()
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+
+			res, err = send()
+			if !tc.retried {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if len(outcomes) != 0 {
+					t.Fatalf("expected no retries, got %v", outcomes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if len(outcomes) != 1 || outcomes[0] != "success" {
+				t.Fatalf("expected successful retry, got %v", outcomes)
+			}
+		})
+	}
+}
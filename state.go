@@ -0,0 +1,115 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/saucelabs/forwarder/hsts"
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/ruleset"
+)
+
+const proxyStateVersion = 1
+
+// ProxyState is the runtime-mutable state of HTTPProxy.
+// It can be exported from a running proxy and imported into a restarted or replacement instance,
+// so that it starts with the rules set at runtime and warm caches.
+//
+// Credentials and the upstream proxy are not part of the state, as they may contain secrets.
+type ProxyState struct {
+	Version            int            `json:"version"`
+	DenyDomains        []string       `json:"deny_domains,omitempty"`
+	DirectDomains      []string       `json:"direct_domains,omitempty"`
+	MITMDomains        []string       `json:"mitm_domains,omitempty"`
+	MITMExcludeDomains []string       `json:"mitm_exclude_domains,omitempty"`
+	LogHTTPMode        httplog.Mode   `json:"log_http,omitempty"`
+	HSTS               []hsts.Policy  `json:"hsts,omitempty"`
+	Upstreams          []LatencyScore `json:"upstreams,omitempty"`
+}
+
+// ExportState returns a snapshot of the runtime state.
+func (hp *HTTPProxy) ExportState() *ProxyState {
+	rc := hp.RuntimeConfig()
+
+	s := &ProxyState{
+		Version:            proxyStateVersion,
+		DenyDomains:        matcherRules(rc.DenyDomains),
+		DirectDomains:      matcherRules(rc.DirectDomains),
+		MITMDomains:        matcherRules(rc.MITMDomains),
+		MITMExcludeDomains: matcherRules(rc.MITMExcludeDomains),
+		LogHTTPMode:        rc.LogHTTPMode,
+	}
+	if c := hp.config.HSTS; c != nil {
+		s.HSTS = c.Policies()
+	}
+	if ls := hp.config.LatencySelector; ls != nil {
+		s.Upstreams = ls.State()
+	}
+
+	return s
+}
+
+// ImportState restores the runtime state from a snapshot returned by ExportState.
+// The rules replace the current rules, cached entries are merged with the current ones.
+// Caches that are not enabled in this proxy are ignored.
+func (hp *HTTPProxy) ImportState(s *ProxyState) error {
+	if s.Version != proxyStateVersion {
+		return fmt.Errorf("unsupported state version %d", s.Version)
+	}
+	if s.LogHTTPMode != "" && !isHTTPLogMode(s.LogHTTPMode) {
+		return fmt.Errorf("log_http: invalid mode %q", s.LogHTTPMode)
+	}
+
+	dd, err := parseRegexpMatcherLines(strings.Join(s.DenyDomains, "\n"), hp.config.RegexpLimits)
+	if err != nil {
+		return fmt.Errorf("deny_domains: %w", err)
+	}
+	dr, err := parseRegexpMatcherLines(strings.Join(s.DirectDomains, "\n"), hp.config.RegexpLimits)
+	if err != nil {
+		return fmt.Errorf("direct_domains: %w", err)
+	}
+	md, err := parseRegexpMatcherLines(strings.Join(s.MITMDomains, "\n"), hp.config.RegexpLimits)
+	if err != nil {
+		return fmt.Errorf("mitm_domains: %w", err)
+	}
+	me, err := parseRegexpMatcherLines(strings.Join(s.MITMExcludeDomains, "\n"), hp.config.RegexpLimits)
+	if err != nil {
+		return fmt.Errorf("mitm_exclude_domains: %w", err)
+	}
+
+	if err := hp.UpdateRuntimeConfig(func(rc *RuntimeConfig) {
+		rc.DenyDomains = dd
+		rc.DirectDomains = dr
+		rc.MITMDomains = md
+		rc.MITMExcludeDomains = me
+		if s.LogHTTPMode != "" {
+			rc.LogHTTPMode = s.LogHTTPMode
+		}
+	}); err != nil {
+		return err
+	}
+
+	if c := hp.config.HSTS; c != nil {
+		c.Import(s.HSTS)
+	}
+	if ls := hp.config.LatencySelector; ls != nil {
+		ls.Restore(s.Upstreams)
+	}
+
+	hp.log.Infof("state imported")
+
+	return nil
+}
+
+func matcherRules(m *ruleset.RegexpMatcher) []string {
+	if m == nil {
+		return nil
+	}
+	return m.Rules()
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/saucelabs/forwarder/hsts"
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestProxyStateExportImport(t *testing.T) {
+	newProxy := func(t *testing.T) *HTTPProxy {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		var err error
+		if cfg.HSTS, err = hsts.New(hsts.DefaultConfig(), stdlog.Default()); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.LatencySelector, err = NewLatencySelector(DefaultLatencySelectorConfig()); err != nil {
+			t.Fatal(err)
+		}
+
+		p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+
+	src := newProxy(t)
+	dd, err := parseRegexpMatcherLines("denied\\.com\n-allowed\\.denied\\.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.UpdateRuntimeConfig(func(rc *RuntimeConfig) {
+		rc.DenyDomains = dd
+		rc.LogHTTPMode = httplog.None
+	}); err != nil {
+		t.Fatal(err)
+	}
+	src.config.HSTS.Observe("example.com", "max-age=3600; includeSubDomains")
+	src.config.LatencySelector.observe(upstreamKey(&url.URL{Scheme: "http", Host: "a:3128"}), time.Second, nil)
+	src.config.LatencySelector.observe(upstreamKey(&url.URL{Scheme: "http", Host: "b:3128"}), 0, errors.New("dial error"))
+
+	b, err := json.Marshal(src.ExportState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s ProxyState
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newProxy(t)
+	if err := dst.ImportState(&s); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(src.ExportState(), dst.ExportState()); diff != "" {
+		t.Fatalf("state mismatch (-want +got):\n%s", diff)
+	}
+	if !dst.config.HSTS.Match("www.example.com") {
+		t.Fatal("expected HSTS policy to be imported")
+	}
+	if dst.RuntimeConfig().DenyDomains.Match("allowed.denied.com") {
+		t.Fatal("expected exclude rule to be imported")
+	}
+}
+
+func TestProxyStateImportErrors(t *testing.T) {
+	p, err := NewInMemoryHTTPProxy(DefaultHTTPProxyConfig(), nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name  string
+		state ProxyState
+	}{
+		{"version", ProxyState{Version: proxyStateVersion + 1}},
+		{"invalid rule", ProxyState{Version: proxyStateVersion, DenyDomains: []string{"("}}},
+		{"invalid log mode", ProxyState{Version: proxyStateVersion, LogHTTPMode: "foo"}},
+		{"MITM disabled", ProxyState{Version: proxyStateVersion, MITMDomains: []string{"example\\.com"}}},
+	}
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if err := p.ImportState(&tc.state); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
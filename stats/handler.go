@@ -0,0 +1,35 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const defaultTop = 10
+
+// Handler returns a handler that serves the Snapshot as JSON.
+// The number of top hosts and clients is set with the n query parameter, it defaults to 10.
+func (s *Stats) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := defaultTop
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+				http.Error(w, "n: invalid value "+strconv.Quote(v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(s.Snapshot(n)) //nolint:errcheck // best effort
+	})
+}
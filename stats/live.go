@@ -0,0 +1,156 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Session is an active request, CONNECT requests are active until the tunnel is established.
+type Session struct {
+	ID     string       `json:"id"`
+	Method string       `json:"method"`
+	Host   string       `json:"host"`
+	Client string       `json:"client"`
+	Start  time.Time    `json:"start"`
+	TLS    *ClientHello `json:"tls,omitempty"`
+}
+
+// ClientHello is the TLS parameters offered by the client of a TLS or MITM connection.
+type ClientHello struct {
+	ServerName   string   `json:"server_name,omitempty"`
+	Versions     []string `json:"versions"`
+	CipherSuites []string `json:"cipher_suites"`
+	ALPN         []string `json:"alpn,omitempty"`
+}
+
+// Begin marks the session as active.
+func (s *Stats) Begin(sess Session) {
+	s.mu.Lock()
+	s.active[sess.ID] = sess
+	s.mu.Unlock()
+}
+
+// End removes the session with the given ID from active sessions.
+func (s *Stats) End(id string) {
+	s.mu.Lock()
+	delete(s.active, id)
+	s.mu.Unlock()
+}
+
+// Active returns the number of active sessions and up to n longest running sessions.
+func (s *Stats) Active(n int) (int, []Session) {
+	s.mu.Lock()
+	res := make([]Session, 0, len(s.active))
+	for _, v := range s.active {
+		res = append(res, v)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Start.Equal(res[j].Start) {
+			return res[i].Start.Before(res[j].Start)
+		}
+		return res[i].ID < res[j].ID
+	})
+	total := len(res)
+	if len(res) > n {
+		res = res[:n]
+	}
+	return total, res
+}
+
+// Totals returns the counts since the start.
+func (s *Stats) Totals() Counter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Tick is the traffic in a feed interval.
+type Tick struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	Bytes    int64     `json:"bytes"`
+
+	// Active is the number of active sessions, Sessions lists the longest running of them.
+	Active   int       `json:"active"`
+	Sessions []Session `json:"sessions"`
+}
+
+const defaultFeedSessions = 20
+
+// FeedHandler returns a handler that streams a Tick every second as server-sent events.
+// The interval and the number of listed sessions can be changed with the interval and sessions query parameters.
+func (s *Stats) FeedHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		interval := time.Second
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 100*time.Millisecond {
+				http.Error(w, "interval: invalid value "+strconv.Quote(v)+", must be at least 100ms", http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+		n := defaultFeedSessions
+		if v := r.URL.Query().Get("sessions"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				http.Error(w, "sessions: invalid value "+strconv.Quote(v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+		prev := s.Totals()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		f.Flush()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case now := <-t.C:
+				cur := s.Totals()
+				tick := Tick{
+					Time:     now,
+					Requests: cur.Requests - prev.Requests,
+					Errors:   cur.Errors - prev.Errors,
+					Bytes:    cur.Bytes - prev.Bytes,
+				}
+				tick.Active, tick.Sessions = s.Active(n)
+				prev = cur
+
+				b, err := json.Marshal(tick)
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: tick\ndata: %s\n\n", b); err != nil {
+					return
+				}
+				f.Flush()
+			}
+		}
+	})
+}
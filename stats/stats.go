@@ -0,0 +1,253 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Package stats provides rolling window aggregates of proxy traffic.
+package stats
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Other is the name that aggregates hosts and clients above the MaxKeys limit.
+const Other = "other"
+
+type Config struct {
+	// Window is the time span of the aggregates.
+	Window time.Duration
+
+	// Resolution is the granularity of the window, the window is divided into buckets of this size.
+	Resolution time.Duration
+
+	// MaxKeys is the maximal number of hosts and clients tracked in a bucket,
+	// traffic of other hosts and clients is aggregated under Other.
+	MaxKeys int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Window:     5 * time.Minute,
+		Resolution: 10 * time.Second,
+		MaxKeys:    1000,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.Window <= 0 {
+		return errors.New("window must be positive")
+	}
+	if c.Resolution <= 0 || c.Resolution > c.Window {
+		return errors.New("resolution must be positive and not greater than window")
+	}
+	if c.MaxKeys <= 0 {
+		return errors.New("max keys must be positive")
+	}
+	return nil
+}
+
+// Counter holds traffic counts of a host or client.
+type Counter struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (c *Counter) add(o *Counter) {
+	c.Requests += o.Requests
+	c.Errors += o.Errors
+	c.Bytes += o.Bytes
+}
+
+type bucket struct {
+	slot    int64
+	total   Counter
+	hosts   map[string]*Counter
+	clients map[string]*Counter
+}
+
+func (b *bucket) reset(slot int64) {
+	b.slot = slot
+	b.total = Counter{}
+	b.hosts = make(map[string]*Counter)
+	b.clients = make(map[string]*Counter)
+}
+
+// Stats aggregates requests and bytes per host and client in a rolling window.
+// Memory is bounded by the number of buckets times MaxKeys.
+type Stats struct {
+	config  Config
+	nowFunc func() time.Time
+
+	mu      sync.Mutex
+	buckets []bucket
+	total   Counter
+	active  map[string]Session
+}
+
+func New(cfg *Config) (*Stats, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	n := int((cfg.Window + cfg.Resolution - 1) / cfg.Resolution)
+	return &Stats{
+		config:  *cfg,
+		nowFunc: time.Now,
+		buckets: make([]bucket, n),
+		active:  make(map[string]Session),
+	}, nil
+}
+
+func (s *Stats) slot(t time.Time) int64 {
+	return t.UnixNano() / int64(s.config.Resolution)
+}
+
+// bucketLocked returns the bucket for the current time, resetting it if it holds data from a previous window.
+func (s *Stats) bucketLocked() *bucket {
+	slot := s.slot(s.nowFunc())
+	b := &s.buckets[slot%int64(len(s.buckets))]
+	if b.slot != slot || b.hosts == nil {
+		b.reset(slot)
+	}
+	return b
+}
+
+func (s *Stats) counterLocked(m map[string]*Counter, name string) *Counter {
+	c, ok := m[name]
+	if !ok {
+		if len(m) >= s.config.MaxKeys {
+			name = Other
+			if c, ok = m[name]; ok {
+				return c
+			}
+		}
+		c = &Counter{Name: name}
+		m[name] = c
+	}
+	return c
+}
+
+func (s *Stats) addLocked(host, client string, d *Counter) {
+	s.total.add(d)
+	b := s.bucketLocked()
+	b.total.add(d)
+	s.counterLocked(b.hosts, host).add(d)
+	s.counterLocked(b.clients, client).add(d)
+}
+
+// Request records a request to host from client, failed marks the request as an error.
+func (s *Stats) Request(host, client string, failed bool) {
+	d := Counter{Requests: 1}
+	if failed {
+		d.Errors = 1
+	}
+
+	s.mu.Lock()
+	s.addLocked(host, client, &d)
+	s.mu.Unlock()
+}
+
+// Bytes records bytes transferred between host and client.
+func (s *Stats) Bytes(host, client string, n int64) {
+	if n <= 0 {
+		return
+	}
+	d := Counter{Bytes: n}
+
+	s.mu.Lock()
+	s.addLocked(host, client, &d)
+	s.mu.Unlock()
+}
+
+// Snapshot is the aggregated traffic in the window.
+type Snapshot struct {
+	Window time.Duration `json:"window"`
+
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+	Bytes    int64 `json:"bytes"`
+
+	// RequestRate and ByteRate are per second averages in the window.
+	RequestRate float64 `json:"request_rate"`
+	ByteRate    float64 `json:"byte_rate"`
+
+	// ErrorRate is the fraction of requests that failed.
+	ErrorRate float64 `json:"error_rate"`
+
+	TopHosts   []Counter `json:"top_hosts"`
+	TopClients []Counter `json:"top_clients"`
+}
+
+// Snapshot returns the aggregates in the window with n top hosts and clients by number of requests.
+func (s *Stats) Snapshot(n int) *Snapshot {
+	hosts := make(map[string]*Counter)
+	clients := make(map[string]*Counter)
+	var total Counter
+
+	s.mu.Lock()
+	cur := s.slot(s.nowFunc())
+	for i := range s.buckets {
+		b := &s.buckets[i]
+		if b.hosts == nil || cur-b.slot >= int64(len(s.buckets)) {
+			continue
+		}
+		total.add(&b.total)
+		mergeCounters(hosts, b.hosts)
+		mergeCounters(clients, b.clients)
+	}
+	s.mu.Unlock()
+
+	secs := s.config.Window.Seconds()
+	snap := &Snapshot{
+		Window:      s.config.Window,
+		Requests:    total.Requests,
+		Errors:      total.Errors,
+		Bytes:       total.Bytes,
+		RequestRate: float64(total.Requests) / secs,
+		ByteRate:    float64(total.Bytes) / secs,
+		TopHosts:    top(hosts, n),
+		TopClients:  top(clients, n),
+	}
+	if total.Requests > 0 {
+		snap.ErrorRate = float64(total.Errors) / float64(total.Requests)
+	}
+
+	return snap
+}
+
+func mergeCounters(dst, src map[string]*Counter) {
+	for k, v := range src {
+		c, ok := dst[k]
+		if !ok {
+			c = &Counter{Name: k}
+			dst[k] = c
+		}
+		c.add(v)
+	}
+}
+
+func top(m map[string]*Counter, n int) []Counter {
+	res := make([]Counter, 0, len(m))
+	for _, c := range m {
+		res = append(res, *c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Requests != res[j].Requests {
+			return res[i].Requests > res[j].Requests
+		}
+		if res[i].Bytes != res[j].Bytes {
+			return res[i].Bytes > res[j].Bytes
+		}
+		return res[i].Name < res[j].Name
+	})
+	if n > 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -0,0 +1,124 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package stats
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsSnapshot(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Window = time.Minute
+	cfg.MaxKeys = 2
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	s.nowFunc = func() time.Time { return now }
+
+	s.Request("example.com", "10.0.0.1", false)
+	s.Request("example.com", "10.0.0.2", true)
+	s.Bytes("example.com", "10.0.0.2", 600)
+	now = now.Add(30 * time.Second)
+	s.Request("saucelabs.com", "10.0.0.1", false)
+	s.Request("google.com", "10.0.0.1", false)
+	s.Request("github.com", "10.0.0.1", false)
+
+	snap := s.Snapshot(10)
+	if snap.Requests != 5 || snap.Errors != 1 || snap.Bytes != 600 {
+		t.Fatalf("unexpected totals %+v", snap)
+	}
+	if snap.ErrorRate != 0.2 || snap.ByteRate != 10 {
+		t.Fatalf("unexpected rates %+v", snap)
+	}
+	if len(snap.TopHosts) != 4 {
+		t.Fatalf("expected 4 hosts, got %+v", snap.TopHosts)
+	}
+	if h := snap.TopHosts[0]; h.Name != "example.com" || h.Requests != 2 || h.Errors != 1 || h.Bytes != 600 {
+		t.Fatalf("unexpected top host %+v", h)
+	}
+	// The second bucket holds only MaxKeys hosts, github.com is aggregated.
+	for _, h := range snap.TopHosts {
+		if h.Name == "github.com" {
+			t.Fatalf("expected github.com to be aggregated under %s, got %+v", Other, snap.TopHosts)
+		}
+	}
+	if c := snap.TopClients[0]; c.Name != "10.0.0.1" || c.Requests != 4 {
+		t.Fatalf("unexpected top client %+v", c)
+	}
+	if len(s.Snapshot(1).TopClients) != 1 {
+		t.Fatal("expected 1 client")
+	}
+
+	// The first bucket leaves the window.
+	now = now.Add(45 * time.Second)
+	snap = s.Snapshot(10)
+	if snap.Requests != 3 || snap.Errors != 0 {
+		t.Fatalf("unexpected totals after window %+v", snap)
+	}
+
+	now = now.Add(time.Hour)
+	if snap = s.Snapshot(10); snap.Requests != 0 || len(snap.TopHosts) != 0 {
+		t.Fatalf("expected empty snapshot, got %+v", snap)
+	}
+}
+
+func TestStatsFeed(t *testing.T) {
+	s, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Begin(Session{ID: "2", Host: "example.com", Start: time.Unix(2, 0)})
+	s.Begin(Session{ID: "1", Host: "saucelabs.com", Start: time.Unix(1, 0)})
+	s.Begin(Session{ID: "3", Host: "google.com", Start: time.Unix(3, 0)})
+	s.End("3")
+
+	srv := httptest.NewServer(s.FeedHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "?interval=100ms&sessions=1") //nolint:noctx // test
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	s.Request("example.com", "10.0.0.1", true)
+
+	r := bufio.NewReader(res.Body)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var tick Tick
+		if err := json.Unmarshal([]byte(data), &tick); err != nil {
+			t.Fatal(err)
+		}
+		if tick.Active != 2 || len(tick.Sessions) != 1 || tick.Sessions[0].ID != "1" {
+			t.Fatalf("unexpected sessions %+v", tick)
+		}
+		if tick.Requests != 1 || tick.Errors != 1 {
+			t.Fatalf("unexpected counts %+v", tick)
+		}
+		return
+	}
+}
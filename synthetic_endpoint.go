@@ -0,0 +1,261 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/middleware"
+)
+
+const syntheticEndpointKey = "synthetic-endpoint"
+
+// SyntheticEndpoint is an endpoint served by the proxy to requests to a pseudo-host without contacting a server,
+// e.g. http://forwarder.internal/whoami, so that clients behind the proxy can be debugged.
+// The response body is rendered from the Template executed with SyntheticRequest.
+type SyntheticEndpoint struct {
+	// Host is the pseudo-host name, it is matched case-insensitively, the port is ignored.
+	Host string
+
+	// Path is the URL path of the endpoint, requests to other paths of the Host get 404 Not Found.
+	Path string
+
+	// StatusCode is the response status code, zero means 200 OK.
+	StatusCode int
+
+	// ContentType is the response Content-Type, if empty text/plain; charset=utf-8 is used.
+	ContentType string
+
+	Template *template.Template
+}
+
+// SyntheticRequest is the data the SyntheticEndpoint template is executed with.
+type SyntheticRequest struct {
+	ClientIP string      `json:"client_ip"`
+	User     string      `json:"user,omitempty"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Proto    string      `json:"proto"`
+	Header   http.Header `json:"headers"`
+}
+
+var syntheticEndpointFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// syntheticEndpointPresets are the predefined endpoint templates.
+var syntheticEndpointPresets = map[string]struct {
+	contentType string
+	body        string
+}{
+	"healthz": {"text/plain; charset=utf-8", "ok\n"},
+	"whoami":  {"application/json", "{{json .}}\n"},
+}
+
+// ParseSyntheticEndpoint parses a <host><path>;<option>;... string into SyntheticEndpoint,
+// options are status=<code>, type=<content-type>, preset=<healthz|whoami> and body=<template>.
+// The body option must be the last option, as the template may contain semicolons.
+func ParseSyntheticEndpoint(val string) (*SyntheticEndpoint, error) {
+	hostPath, opts, _ := strings.Cut(val, ";")
+	host, path, ok := strings.Cut(hostPath, "/")
+	if !ok || host == "" {
+		return nil, errors.New("expected <host><path>;<option>;... with options status=<code>, type=<content-type>, preset=<name>, body=<template>")
+	}
+	e := &SyntheticEndpoint{
+		Host: host,
+		Path: "/" + path,
+	}
+
+	var body string
+	for opts != "" {
+		var o string
+		if strings.HasPrefix(opts, "body=") {
+			o, opts = opts, ""
+		} else {
+			o, opts, _ = strings.Cut(opts, ";")
+		}
+		k, v, ok := strings.Cut(o, "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("invalid option %q", o)
+		}
+		var err error
+		switch k {
+		case "status":
+			e.StatusCode, err = strconv.Atoi(v)
+		case "type":
+			e.ContentType = v
+		case "preset":
+			p, ok := syntheticEndpointPresets[v]
+			if !ok {
+				err = errors.New("unknown preset")
+			}
+			if e.ContentType == "" {
+				e.ContentType = p.contentType
+			}
+			body = p.body
+		case "body":
+			body = v
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	t, err := template.New(hostPath).Funcs(syntheticEndpointFuncs).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("body: %w", err)
+	}
+	e.Template = t
+
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *SyntheticEndpoint) Validate() error {
+	if e.Host == "" {
+		return errors.New("host is required")
+	}
+	if !strings.HasPrefix(e.Path, "/") {
+		return errors.New("path must start with /")
+	}
+	if e.StatusCode != 0 && (e.StatusCode < 200 || e.StatusCode > 599) {
+		return fmt.Errorf("invalid status code %d", e.StatusCode)
+	}
+	if e.Template == nil {
+		return errors.New("template is required")
+	}
+	return nil
+}
+
+// syntheticEndpoints serves the HTTPProxyConfig.SyntheticEndpoints without contacting the server.
+type syntheticEndpoints struct {
+	hosts map[string][]*SyntheticEndpoint
+}
+
+func (hp *HTTPProxy) syntheticEndpoints() *syntheticEndpoints {
+	s := &syntheticEndpoints{
+		hosts: make(map[string][]*SyntheticEndpoint),
+	}
+	for _, e := range hp.config.SyntheticEndpoints {
+		h := strings.ToLower(e.Host)
+		s.hosts[h] = append(s.hosts[h], e)
+	}
+	return s
+}
+
+func (s *syntheticEndpoints) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect {
+		return nil
+	}
+	eps, ok := s.hosts[strings.ToLower(req.URL.Hostname())]
+	if !ok {
+		return nil
+	}
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+
+	var ep *SyntheticEndpoint
+	for _, e := range eps {
+		if e.Path == req.URL.Path {
+			ep = e
+			break
+		}
+	}
+	ctx.SkipRoundTrip()
+	ctx.Set(syntheticEndpointKey, ep)
+	return nil
+}
+
+func (s *syntheticEndpoints) ModifyResponse(res *http.Response) error {
+	if res.Request == nil {
+		return nil
+	}
+	ctx := martian.NewContext(res.Request)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(syntheticEndpointKey)
+	if !ok {
+		return nil
+	}
+
+	code := http.StatusNotFound
+	contentType := "text/plain; charset=utf-8"
+	body := []byte("not found\n")
+	if ep, _ := v.(*SyntheticEndpoint); ep != nil {
+		var b bytes.Buffer
+		if err := ep.Template.Execute(&b, newSyntheticRequest(res.Request)); err != nil {
+			return fmt.Errorf("synthetic endpoint %s%s: %w", ep.Host, ep.Path, err)
+		}
+		code = http.StatusOK
+		if ep.StatusCode != 0 {
+			code = ep.StatusCode
+		}
+		if ep.ContentType != "" {
+			contentType = ep.ContentType
+		}
+		body = b.Bytes()
+	}
+
+	setLocalResponse(res, code, contentType, body)
+
+	return nil
+}
+
+// setLocalResponse replaces the response status, headers and body with a response generated by the proxy.
+func setLocalResponse(res *http.Response, code int, contentType string, body []byte) {
+	res.StatusCode = code
+	res.Status = strconv.Itoa(code) + " " + http.StatusText(code)
+	res.Header = make(http.Header)
+	res.Header.Set("Content-Type", contentType)
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	if res.Body != nil {
+		res.Body.Close()
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.TransferEncoding = nil
+}
+
+// newSyntheticRequest returns the request as seen by the proxy, credentials sent to the proxy are removed.
+func newSyntheticRequest(req *http.Request) SyntheticRequest {
+	clientIP := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		clientIP = h
+	}
+	h := req.Header.Clone()
+	h.Del("Proxy-Authorization")
+
+	return SyntheticRequest{
+		ClientIP: clientIP,
+		User:     middleware.User(req),
+		Method:   req.Method,
+		URL:      req.URL.Redacted(),
+		Proto:    req.Proto,
+		Header:   h,
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestParseSyntheticEndpoint(t *testing.T) {
+	e, err := ParseSyntheticEndpoint("forwarder.internal/hello;status=201;type=text/html;body=<b>{{.Method}};{{.User}}</b>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Host != "forwarder.internal" || e.Path != "/hello" || e.StatusCode != 201 || e.ContentType != "text/html" {
+		t.Fatalf("unexpected endpoint %+v", e)
+	}
+
+	for _, v := range []string{
+		"",
+		"forwarder.internal",
+		"/healthz;preset=healthz",
+		"forwarder.internal/healthz;preset=foo",
+		"forwarder.internal/healthz;status=99;preset=healthz",
+		"forwarder.internal/healthz;foo=bar",
+		"forwarder.internal/healthz;body={{.Foo",
+	} {
+		if _, err := ParseSyntheticEndpoint(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestSyntheticEndpoints(t *testing.T) {
+	cfg := DefaultHTTPProxyConfig()
+	cfg.BasicAuth = url.UserPassword("user", "pass")
+	for _, v := range []string{
+		"forwarder.internal/healthz;preset=healthz",
+		"forwarder.internal/whoami;preset=whoami",
+	} {
+		e, err := ParseSyntheticEndpoint(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.SyntheticEndpoints = append(cfg.SyntheticEndpoints, e)
+	}
+	cfg.ProxyLocalhost = DenyProxyLocalhost
+	dd, err := parseRegexpMatcherLines(`\.internal$`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DenyDomains = dd
+	cfg.TestHooks = &TestHooks{
+		RoundTrip: func(req *http.Request) (*http.Response, error) {
+			t.Errorf("unexpected round trip to %s", req.URL)
+			return nil, io.EOF
+		},
+		LookupHost: func(_ context.Context, host string) ([]string, error) {
+			t.Errorf("unexpected lookup of %s", host)
+			return nil, io.EOF
+		},
+	}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(path string, auth bool) (*http.Response, []byte) {
+		t.Helper()
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		req, err := http.NewRequest(http.MethodGet, "http://forwarder.internal"+path, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Test", "foo")
+		if auth {
+			req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+		}
+		if err := req.WriteProxy(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, b
+	}
+
+	if res, _ := get("/healthz", false); res.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("expected status 407, got %d", res.StatusCode)
+	}
+
+	res, b := get("/healthz", true)
+	if res.StatusCode != http.StatusOK || string(b) != "ok\n" {
+		t.Fatalf("unexpected response %d %q", res.StatusCode, b)
+	}
+
+	res, b = get("/whoami", true)
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected response %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	var who SyntheticRequest
+	if err := json.Unmarshal(b, &who); err != nil {
+		t.Fatal(err)
+	}
+	if who.User != "user" || who.Method != http.MethodGet || who.URL != "http://forwarder.internal/whoami" {
+		t.Fatalf("unexpected whoami %s", b)
+	}
+	if who.Header.Get("X-Test") != "foo" || who.Header.Get("Proxy-Authorization") != "" {
+		t.Fatalf("unexpected whoami headers %v", who.Header)
+	}
+
+	if res, _ := get("/other", true); res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", res.StatusCode)
+	}
+}
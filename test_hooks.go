@@ -0,0 +1,79 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/saucelabs/forwarder/utils/httpx"
+)
+
+// TestHooks replace the external dependencies of the proxy,
+// so that embedders can test proxy policies hermetically.
+// They must not be used in production.
+type TestHooks struct {
+	// Seed makes the random values deterministic, e.g. the boundary in the Via header.
+	Seed int64
+
+	// LookupHost resolves host names when checking if requests are sent to localhost.
+	LookupHost func(ctx context.Context, host string) ([]string, error)
+
+	// DialContext replaces the dialer of the HTTP transport, the transport must be *http.Transport.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Clock returns the current time used for the generated MITM certificates and cached certificate probes,
+	// it is used if MITMConfig.Clock is not set.
+	Clock func() time.Time
+
+	// RoundTrip scripts upstream behavior, it replaces the HTTP transport.
+	// It takes precedence over DialContext.
+	RoundTrip func(req *http.Request) (*http.Response, error)
+}
+
+// transport returns the transport with the hooks applied.
+func (h *TestHooks) transport(rt http.RoundTripper) (http.RoundTripper, error) {
+	if h.RoundTrip != nil {
+		return httpx.RoundTripperFunc(h.RoundTrip), nil
+	}
+	if h.DialContext != nil {
+		tr, ok := rt.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("dial hook requires *http.Transport, got %T", rt)
+		}
+		tr = tr.Clone()
+		tr.DialContext = h.DialContext
+		rt = tr
+	}
+	return rt, nil
+}
+
+// viaBoundary returns the Via header boundary derived from the seed.
+func (h *TestHooks) viaBoundary() string {
+	var buf [10]byte
+	rand.New(rand.NewSource(h.Seed)).Read(buf[:]) //nolint:gosec // deterministic by design
+	return hex.EncodeToString(buf[:])
+}
+
+func (hp *HTTPProxy) lookupHost(ctx context.Context, host string) ([]string, error) {
+	if h := hp.config.TestHooks; h != nil && h.LookupHost != nil {
+		return h.LookupHost(ctx, host)
+	}
+	return localhostResolver.LookupHost(ctx, host)
+}
+
+func (hp *HTTPProxy) now() time.Time {
+	if h := hp.config.TestHooks; h != nil && h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTestHooksTransport(t *testing.T) {
+	errDial := errors.New("dial hook")
+	h := &TestHooks{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errDial
+		},
+	}
+
+	tr := &http.Transport{}
+	rt, err := h.transport(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt == tr {
+		t.Fatal("expected transport to be cloned")
+	}
+	if tr.DialContext != nil {
+		t.Fatal("original transport modified")
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+	req.RequestURI = ""
+	if _, err := rt.RoundTrip(req); !errors.Is(err, errDial) {
+		t.Fatalf("expected dial hook error, got %v", err)
+	}
+
+	if _, err := h.transport(http.DefaultClient.Transport); err == nil {
+		t.Fatal("expected error for non *http.Transport")
+	}
+
+	h.RoundTrip = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusTeapot, Request: req}, nil
+	}
+	rt, err = h.transport(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected scripted response, got %d", res.StatusCode)
+	}
+}
+
+func TestTestHooksViaBoundary(t *testing.T) {
+	a := (&TestHooks{Seed: 1}).viaBoundary()
+	if b := (&TestHooks{Seed: 1}).viaBoundary(); a != b {
+		t.Fatalf("expected deterministic boundary, got %q and %q", a, b)
+	}
+	if b := (&TestHooks{Seed: 2}).viaBoundary(); a == b {
+		t.Fatal("expected different boundary for different seed")
+	}
+	if len(a) != 20 {
+		t.Fatalf("unexpected boundary %q", a)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+)
+
+// TimeoutHeader is sent by trusted clients to set the deadline of a single request,
+// e.g. to enforce per-request SLAs in tests.
+// The value is a duration e.g. "1.5s", or a number of seconds.
+// The deadline covers sending the request upstream and reading the response, it is bounded by TimeoutHeaderConfig.MaxTimeout.
+// The header is removed from the request before it is forwarded.
+const TimeoutHeader = "X-Forwarder-Timeout"
+
+type TimeoutHeaderConfig struct {
+	// TrustedNetworks are the client networks allowed to set the timeout,
+	// the header sent by other clients is ignored.
+	TrustedNetworks []netip.Prefix
+
+	// MaxTimeout bounds the timeout set by clients.
+	MaxTimeout time.Duration
+}
+
+func DefaultTimeoutHeaderConfig() *TimeoutHeaderConfig {
+	return &TimeoutHeaderConfig{
+		MaxTimeout: 5 * time.Minute,
+	}
+}
+
+func (c *TimeoutHeaderConfig) Validate() error {
+	if len(c.TrustedNetworks) == 0 {
+		return errors.New("trusted networks are required")
+	}
+	if c.MaxTimeout <= 0 {
+		return errors.New("max timeout must be positive")
+	}
+	return nil
+}
+
+func (c *TimeoutHeaderConfig) trusted(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, n := range c.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeoutHeader(val string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		s, ferr := strconv.ParseFloat(val, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid duration %q", val)
+		}
+		d = time.Duration(s * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive %q", val)
+	}
+	return d, nil
+}
+
+const timeoutHeaderKey = "forwarder.timeout"
+
+// timeoutHeader reads TimeoutHeader and stores the timeout in the request context, see requestTimeout.
+func (hp *HTTPProxy) timeoutHeader() martian.RequestModifier {
+	cfg := hp.config.TimeoutHeader
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		val := req.Header.Get(TimeoutHeader)
+		if val == "" {
+			return nil
+		}
+		req.Header.Del(TimeoutHeader)
+
+		if req.Method == http.MethodConnect || !cfg.trusted(req) {
+			return nil
+		}
+
+		d, err := parseTimeoutHeader(val)
+		if err != nil {
+			hp.log.Debugf("ignoring %s header: %s client=%s", TimeoutHeader, err, req.RemoteAddr)
+			return nil
+		}
+		if d > cfg.MaxTimeout {
+			d = cfg.MaxTimeout
+		}
+
+		if ctx := martian.NewContext(req); ctx != nil {
+			ctx.Set(timeoutHeaderKey, d)
+		}
+		return nil
+	})
+}
+
+// requestTimeout returns the timeout set with TimeoutHeader, or zero.
+func requestTimeout(req *http.Request) time.Duration {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return 0
+	}
+	v, ok := ctx.Get(timeoutHeaderKey)
+	if !ok {
+		return 0
+	}
+	return v.(time.Duration) //nolint:forcetypeassert // we know the type
+}
+
+func handleRequestTimeout(req *http.Request, err error) (code int, msg, label string) {
+	if errors.Is(err, context.DeadlineExceeded) && requestTimeout(req) > 0 {
+		code = http.StatusGatewayTimeout
+		msg = fmt.Sprintf("Request timed out after %s set in %s header", requestTimeout(req), TimeoutHeader)
+		label = "request_timeout"
+	}
+
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseTimeoutHeader(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+		err   bool
+	}{
+		{input: "1.5s", want: 1500 * time.Millisecond},
+		{input: "2m", want: 2 * time.Minute},
+		{input: "3", want: 3 * time.Second},
+		{input: "0.25", want: 250 * time.Millisecond},
+		{input: "0", err: true},
+		{input: "-1s", err: true},
+		{input: "soon", err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			d, err := parseTimeoutHeader(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s", d)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != tc.want {
+				t.Fatalf("expected %s, got %s", tc.want, d)
+			}
+		})
+	}
+}
+
+func TestTimeoutHeaderConfigTrusted(t *testing.T) {
+	cfg := &TimeoutHeaderConfig{
+		TrustedNetworks: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("::1/128"),
+		},
+		MaxTimeout: time.Minute,
+	}
+
+	tests := []struct {
+		remoteAddr string
+		want       bool
+	}{
+		{remoteAddr: "10.1.2.3:1234", want: true},
+		{remoteAddr: "[::ffff:10.1.2.3]:1234", want: true},
+		{remoteAddr: "[::1]:1234", want: true},
+		{remoteAddr: "192.168.1.1:1234", want: false},
+		{remoteAddr: "invalid", want: false},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.remoteAddr, func(t *testing.T) {
+			req := &http.Request{RemoteAddr: tc.remoteAddr}
+			if got := cfg.trusted(req); got != tc.want {
+				t.Fatalf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
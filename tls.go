@@ -121,3 +121,43 @@ func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
 	}
 	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 }
+
+// TLSClientAuthConfig configures verification of client certificates by TLS servers.
+type TLSClientAuthConfig struct {
+	// CACertFiles is a list of paths to CA certificate files used to verify client certificates.
+	// If set, clients must present a certificate signed by one of the CAs.
+	CACertFiles []string
+
+	// Optional allows clients without a certificate, certificates that are presented are still verified.
+	Optional bool
+}
+
+func (c *TLSClientAuthConfig) enabled() bool {
+	return len(c.CACertFiles) > 0
+}
+
+func (c *TLSClientAuthConfig) configureTLSConfig(tlsCfg *tls.Config) error {
+	if !c.enabled() {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	for _, name := range c.CACertFiles {
+		b, err := ReadFileOrBase64(name)
+		if err != nil {
+			return fmt.Errorf("load client CAs: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("load client CAs: append certificate %q", name)
+		}
+	}
+
+	tlsCfg.ClientCAs = pool
+	if c.Optional {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
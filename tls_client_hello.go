@@ -0,0 +1,143 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/stats"
+)
+
+const tlsClientHelloKey = "tls-client-hello"
+
+// newClientHello returns the TLS parameters offered by the client, GREASE values are omitted.
+func newClientHello(hello *tls.ClientHelloInfo) *stats.ClientHello {
+	ch := &stats.ClientHello{
+		ServerName: hello.ServerName,
+		ALPN:       hello.SupportedProtos,
+	}
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) {
+			ch.Versions = append(ch.Versions, tlsVersionString(v))
+		}
+	}
+	for _, c := range hello.CipherSuites {
+		if !isGREASE(c) {
+			ch.CipherSuites = append(ch.CipherSuites, tls.CipherSuiteName(c))
+		}
+	}
+	return ch
+}
+
+// isGREASE returns true for values reserved by RFC 8701 to prevent extensibility failures.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func tlsVersionString(v uint16) string {
+	if s := tlsVersionName(v); s != "unknown" {
+		return s
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+func clientHelloString(ch *stats.ClientHello) string {
+	return fmt.Sprintf("sni=%s versions=%s alpn=%s ciphers=%s",
+		ch.ServerName, strings.Join(ch.Versions, ","), strings.Join(ch.ALPN, ","), strings.Join(ch.CipherSuites, ","))
+}
+
+// sessionClientHello returns the ClientHello of the connection the request was received on.
+func sessionClientHello(req *http.Request) *stats.ClientHello {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+	v, _ := ctx.Session().Get(tlsClientHelloKey)
+	ch, _ := v.(*stats.ClientHello)
+	return ch
+}
+
+// clientHelloRecorder records ClientHellos received by the TLS listener until the first request on the connection.
+// The connection is identified by the client address.
+// Entries of connections without requests e.g. due to handshake failures are removed after maxAge.
+type clientHelloRecorder struct {
+	mu     sync.Mutex
+	hellos map[string]clientHelloEntry
+}
+
+type clientHelloEntry struct {
+	hello *stats.ClientHello
+	added time.Time
+}
+
+const (
+	clientHelloMaxAge     = time.Minute
+	clientHelloPruneAfter = 1024
+)
+
+func (r *clientHelloRecorder) add(addr string, ch *stats.ClientHello) {
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hellos == nil {
+		r.hellos = make(map[string]clientHelloEntry)
+	}
+	if len(r.hellos) >= clientHelloPruneAfter {
+		for k, v := range r.hellos {
+			if now.Sub(v.added) > clientHelloMaxAge {
+				delete(r.hellos, k)
+			}
+		}
+	}
+	r.hellos[addr] = clientHelloEntry{hello: ch, added: now}
+}
+
+func (r *clientHelloRecorder) pop(addr string) *stats.ClientHello {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.hellos[addr]
+	if !ok {
+		return nil
+	}
+	delete(r.hellos, addr)
+	return e.hello
+}
+
+// configureClientHelloCapture records ClientHellos received by the TLS listener, and logs them in debug mode.
+func (hp *HTTPProxy) configureClientHelloCapture() {
+	hp.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		ch := newClientHello(hello)
+		addr := hello.Conn.RemoteAddr().String()
+		hp.log.Debugf("TLS client hello from %s: %s", addr, clientHelloString(ch))
+		hp.clientHellos.add(addr, ch)
+		return nil, nil //nolint:nilnil // use the listener config
+	}
+}
+
+// tlsClientHello attaches the ClientHello recorded by the TLS listener to the session of the request.
+func (hp *HTTPProxy) tlsClientHello() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if req.TLS == nil {
+			return nil
+		}
+		if ch := hp.clientHellos.pop(req.RemoteAddr); ch != nil {
+			if ctx := martian.NewContext(req); ctx != nil {
+				ctx.Session().Set(tlsClientHelloKey, ch)
+			}
+		}
+		return nil
+	})
+}
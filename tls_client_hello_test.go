@@ -0,0 +1,71 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/stats"
+)
+
+func TestNewClientHello(t *testing.T) {
+	ch := newClientHello(&tls.ClientHelloInfo{
+		ServerName:        "example.com",
+		SupportedVersions: []uint16{0x3a3a, tls.VersionTLS13, tls.VersionTLS12, 0x0300},
+		CipherSuites:      []uint16{0x1a1a, tls.TLS_AES_128_GCM_SHA256},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+	})
+
+	want := &stats.ClientHello{
+		ServerName:   "example.com",
+		Versions:     []string{"TLS1.3", "TLS1.2", "0x0300"},
+		CipherSuites: []string{"TLS_AES_128_GCM_SHA256"},
+		ALPN:         []string{"h2", "http/1.1"},
+	}
+	if !reflect.DeepEqual(ch, want) {
+		t.Fatalf("expected %+v, got %+v", want, ch)
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Errorf("0x%04x: expected GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, tls.VersionTLS13, tls.TLS_AES_128_GCM_SHA256} {
+		if isGREASE(v) {
+			t.Errorf("0x%04x: unexpected GREASE", v)
+		}
+	}
+}
+
+func TestClientHelloRecorder(t *testing.T) {
+	var r clientHelloRecorder
+
+	ch := &stats.ClientHello{ServerName: "example.com"}
+	r.add("127.0.0.1:1234", ch)
+	if got := r.pop("127.0.0.1:1234"); got != ch {
+		t.Fatalf("expected recorded hello, got %v", got)
+	}
+	if got := r.pop("127.0.0.1:1234"); got != nil {
+		t.Fatalf("expected hello to be removed, got %v", got)
+	}
+
+	r.add("old", ch)
+	r.hellos["old"] = clientHelloEntry{hello: ch, added: time.Now().Add(-2 * clientHelloMaxAge)}
+	for i := 0; i < clientHelloPruneAfter; i++ {
+		r.add(strconv.Itoa(i), ch)
+	}
+	if r.pop("old") != nil {
+		t.Fatal("expected old entry to be pruned")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints are the supported TLS ClientHello fingerprints.
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"safari":     utls.HelloSafari_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"android":    utls.HelloAndroid_11_OkHttp,
+	"randomized": utls.HelloRandomized,
+}
+
+func tlsFingerprintNames() string {
+	names := make([]string, 0, len(tlsFingerprints))
+	for k := range tlsFingerprints {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseTLSFingerprint(v string) (string, error) {
+	if _, ok := tlsFingerprints[v]; !ok {
+		return "", fmt.Errorf("unsupported fingerprint %q, supported fingerprints are: %s", v, tlsFingerprintNames())
+	}
+	return v, nil
+}
+
+// tlsFingerprintDialer returns a DialTLSContext function that sends the ClientHello of the fingerprint,
+// so that the JA3/JA4 fingerprint of the connection matches the browser.
+// The connection is dialed with dial, and the TLS config is used for server name, root CAs and client certificates.
+//
+// ALPN is limited to HTTP/1.1, as the transport can only use HTTP/2 over crypto/tls connections.
+func tlsFingerprintDialer(fingerprint string, tlsCfg *tls.Config,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error),
+) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	id, ok := tlsFingerprints[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("unsupported fingerprint %q", fingerprint)
+	}
+	if id != utls.HelloRandomized {
+		if _, err := utls.UTLSIdToSpec(id); err != nil {
+			return nil, err
+		}
+	}
+
+	certs := make([]utls.Certificate, len(tlsCfg.Certificates))
+	for i, c := range tlsCfg.Certificates {
+		certs[i] = utls.Certificate{
+			Certificate: c.Certificate,
+			PrivateKey:  c.PrivateKey,
+			Leaf:        c.Leaf,
+		}
+	}
+
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		serverName := tlsCfg.ServerName
+		if serverName == "" {
+			h, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			serverName = h
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := &utls.Config{
+			ServerName:         serverName,
+			RootCAs:            tlsCfg.RootCAs,
+			InsecureSkipVerify: tlsCfg.InsecureSkipVerify, //nolint:gosec // as configured by the user
+			Certificates:       certs,
+			NextProtos:         []string{"http/1.1"},
+		}
+
+		var uc *utls.UConn
+		if id == utls.HelloRandomized {
+			uc = utls.UClient(conn, cfg, utls.HelloRandomizedNoALPN)
+		} else {
+			// The spec holds per connection state, it must not be shared between connections.
+			spec, err := utls.UTLSIdToSpec(id)
+			if err == nil {
+				spec.Extensions = withHTTP1ALPN(spec.Extensions)
+				uc = utls.UClient(conn, cfg, utls.HelloCustom)
+				err = uc.ApplyPreset(&spec)
+			}
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		if err := uc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return uc, nil
+	}, nil
+}
+
+// withHTTP1ALPN returns the extensions with ALPN limited to HTTP/1.1.
+func withHTTP1ALPN(exts []utls.TLSExtension) []utls.TLSExtension {
+	for i, e := range exts {
+		if _, ok := e.(*utls.ALPNExtension); ok {
+			exts[i] = &utls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}}
+		}
+	}
+	return exts
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h and linux/netfilter_ipv6/ip6_tables.h.
+const soOriginalDst = 80
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	var lc net.ListenConfig
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			if serr != nil {
+				return fmt.Errorf("set IP_TRANSPARENT: %w", serr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// originalDst returns the destination address of a connection redirected with iptables REDIRECT target.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6 := false
+	if la, ok := conn.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	var (
+		dst  *net.TCPAddr
+		serr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			var mi *syscall.IPv6MTUInfo
+			mi, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if serr != nil {
+				return
+			}
+			// The option value is struct sockaddr_in6, the port is in network byte order.
+			port := (*[2]byte)(unsafe.Pointer(&mi.Addr.Port))
+			dst = &net.TCPAddr{
+				IP:   append(net.IP(nil), mi.Addr.Addr[:]...),
+				Port: int(binary.BigEndian.Uint16(port[:])),
+			}
+			return
+		}
+
+		var mr *syscall.IPv6Mreq
+		mr, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if serr != nil {
+			return
+		}
+		// The option value is struct sockaddr_in.
+		sa := mr.Multiaddr
+		dst = &net.TCPAddr{
+			IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+			Port: int(binary.BigEndian.Uint16(sa[2:4])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		return nil, fmt.Errorf("get SO_ORIGINAL_DST: %w", serr)
+	}
+
+	return dst, nil
+}
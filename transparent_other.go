@@ -0,0 +1,24 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:build !linux
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy is supported only on Linux")
+
+func listenTransparent(_ string, _ bool) (net.Listener, error) {
+	return nil, errTransparentNotSupported
+}
+
+func originalDst(_ net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotSupported
+}
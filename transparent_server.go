@@ -0,0 +1,268 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+type TransparentServerConfig struct {
+	Addr string
+
+	// TPROXY accepts connections redirected with the iptables TPROXY target,
+	// the original destination is the local address of the connection.
+	// Otherwise, connections are redirected with the iptables REDIRECT target,
+	// and the original destination is read with the SO_ORIGINAL_DST socket option.
+	TPROXY bool
+
+	HandshakeTimeout time.Duration
+}
+
+func DefaultTransparentServerConfig() *TransparentServerConfig {
+	return &TransparentServerConfig{
+		HandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func (c *TransparentServerConfig) Validate() error {
+	if c.Addr == "" {
+		return errors.New("address is required")
+	}
+	if c.HandshakeTimeout <= 0 {
+		return errors.New("handshake_timeout must be positive")
+	}
+	return nil
+}
+
+// TransparentServer accepts TCP connections redirected to the proxy by iptables, and bridges them
+// to CONNECT requests to the original destination handled by the HTTP proxy.
+// This allows to proxy applications that cannot be configured to use a proxy.
+//
+// The CONNECT request host is the TLS server name or the HTTP Host header sent by the client if available,
+// so that domain rules apply, and the original destination address otherwise.
+// If MITM is enabled, the HTTP requests in the tunnel are handled by the proxy as well.
+// Proxy authentication is not supported, as clients are not aware of the proxy.
+type TransparentServer struct {
+	config   TransparentServerConfig
+	hp       *HTTPProxy
+	log      log.Logger
+	listener net.Listener
+}
+
+// NewTransparentServer creates a new transparent proxy server that forwards connections via the HTTP proxy.
+// It is the caller's responsibility to call Close on the returned server.
+func NewTransparentServer(cfg *TransparentServerConfig, hp *HTTPProxy, log log.Logger) (*TransparentServer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if hp.authRequired() {
+		return nil, errors.New("proxy authentication is not supported")
+	}
+
+	l, err := listenTransparent(cfg.Addr, cfg.TPROXY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open listener on address %s: %w", cfg.Addr, err)
+	}
+	l = hp.filterClients(l)
+
+	s := &TransparentServer{
+		config:   *cfg,
+		hp:       hp,
+		log:      log,
+		listener: l,
+	}
+	s.log.Infof("transparent proxy server listen address=%s tproxy=%t", l.Addr(), cfg.TPROXY)
+
+	return s, nil
+}
+
+func (s *TransparentServer) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		s.listener.Close()
+	}()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serve(ctx, conn)
+		}()
+	}
+}
+
+// Addr returns the address the server is listening on.
+func (s *TransparentServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *TransparentServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *TransparentServer) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	dst, err := s.originalDst(conn)
+	if err != nil {
+		s.log.Infof("transparent connection from %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout))
+	r, target := transparentTarget(conn, dst)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	upstream, res, err := s.hp.connectInMemory(conn.RemoteAddr(), req, s.config.HandshakeTimeout)
+	if err == nil && upstream == nil {
+		err = fmt.Errorf("proxy returned %s", res.Status)
+	}
+	if err != nil {
+		s.log.Infof("transparent connection from %s to %s failed: %s", conn.RemoteAddr(), target, err)
+		return
+	}
+	defer upstream.Close()
+	conn.SetDeadline(time.Time{})
+
+	s.log.Debugf("transparent connection from %s to %s (%s) established", conn.RemoteAddr(), target, dst)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, r)
+		upstream.Close()
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+	<-done
+}
+
+// originalDst returns the destination address of the redirected connection.
+// Connections to the listener address are rejected, as they would loop back to the server.
+func (s *TransparentServer) originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	var (
+		dst *net.TCPAddr
+		err error
+	)
+	if s.config.TPROXY {
+		dst, _ = conn.LocalAddr().(*net.TCPAddr)
+		if dst == nil {
+			err = fmt.Errorf("unexpected local address %s", conn.LocalAddr())
+		}
+	} else {
+		dst, err = originalDst(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if la, ok := s.listener.Addr().(*net.TCPAddr); ok && la.Port == dst.Port && (dst.IP.IsLoopback() || la.IP.Equal(dst.IP)) {
+		return nil, fmt.Errorf("connection to the server address %s is not redirected", dst)
+	}
+
+	return dst, nil
+}
+
+// transparentTarget returns the reader of the client data and the target of the CONNECT request.
+// The host name is read from the TLS ClientHello or the HTTP request sent by the client,
+// the data read is replayed by the returned reader.
+func transparentTarget(conn net.Conn, dst *net.TCPAddr) (io.Reader, string) {
+	var buf bytes.Buffer
+	br := bufio.NewReader(io.TeeReader(conn, &buf))
+	replay := func() io.Reader {
+		return io.MultiReader(&buf, conn)
+	}
+	port := strconv.Itoa(dst.Port)
+
+	b, err := br.Peek(1)
+	if err != nil {
+		return replay(), dst.String()
+	}
+
+	var host string
+	if b[0] == 22 { // TLS handshake record.
+		host = peekServerName(br)
+	} else if req, err := http.ReadRequest(br); err == nil {
+		host = req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+	if host == "" {
+		return replay(), dst.String()
+	}
+
+	return replay(), net.JoinHostPort(host, port)
+}
+
+var errServerName = errors.New("server name captured")
+
+// peekServerName reads the TLS ClientHello and returns the server name.
+func peekServerName(r io.Reader) string {
+	var name string
+	cfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errServerName
+		},
+	}
+	tls.Server(readOnlyConn{r}, cfg).Handshake() //nolint:errcheck // the handshake is aborted on purpose
+	return name
+}
+
+// readOnlyConn reads from the reader and discards writes.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(_ time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
@@ -0,0 +1,83 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTransparentTarget(t *testing.T) {
+	dst := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8443}
+
+	read := func(t *testing.T, write func(c net.Conn)) (string, []byte, []byte) {
+		t.Helper()
+		c, sc := net.Pipe()
+		defer c.Close()
+		defer sc.Close()
+
+		var sent bytes.Buffer
+		go write(writeRecorder{c, &sent})
+
+		r, target := transparentTarget(sc, dst)
+		sc.Close()
+		got, _ := io.ReadAll(r)
+		return target, got, sent.Bytes()
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		target, got, sent := read(t, func(c net.Conn) {
+			tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake() //nolint:errcheck // test
+		})
+		if target != "example.com:8443" {
+			t.Fatalf("expected target example.com:8443, got %s", target)
+		}
+		if !bytes.HasPrefix(sent, got) || len(got) == 0 {
+			t.Fatalf("expected the ClientHello to be replayed")
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		const req = "GET /foo HTTP/1.1\r\nHost: example.com:80\r\n\r\n"
+		target, got, _ := read(t, func(c net.Conn) {
+			io.WriteString(c, req) //nolint:errcheck // test
+			c.Close()
+		})
+		if target != "example.com:8443" {
+			t.Fatalf("expected target example.com:8443, got %s", target)
+		}
+		if string(got) != req {
+			t.Fatalf("expected %q, got %q", req, got)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		target, got, _ := read(t, func(c net.Conn) {
+			io.WriteString(c, "\x00\x01binary") //nolint:errcheck // test
+			c.Close()
+		})
+		if target != dst.String() {
+			t.Fatalf("expected target %s, got %s", dst, target)
+		}
+		if string(got) != "\x00\x01binary" {
+			t.Fatalf("expected data to be replayed, got %q", got)
+		}
+	})
+}
+
+type writeRecorder struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c writeRecorder) Write(p []byte) (int, error) {
+	c.w.Write(p) //nolint:errcheck // test
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UpstreamAuthMode specifies when credentials are sent to an upstream proxy.
+type UpstreamAuthMode string
+
+const (
+	// PreemptiveUpstreamAuth sends credentials with every request, it is the default.
+	PreemptiveUpstreamAuth UpstreamAuthMode = "preemptive"
+	// ChallengeUpstreamAuth sends credentials only after the upstream proxy responds with 407 Proxy Authentication Required,
+	// the request is then retried once with credentials.
+	ChallengeUpstreamAuth UpstreamAuthMode = "challenge"
+)
+
+// UpstreamAuthRule sets the authentication mode of upstream proxies with host matching the regexp.
+type UpstreamAuthRule struct {
+	Proxy *regexp.Regexp
+	Mode  UpstreamAuthMode
+}
+
+// ParseUpstreamAuthRule parses a <pattern>=<preemptive|challenge> string into UpstreamAuthRule.
+// The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains.
+func ParseUpstreamAuthRule(val string) (*UpstreamAuthRule, error) {
+	pattern, mode, ok := strings.Cut(val, "=")
+	if !ok || pattern == "" || mode == "" {
+		return nil, errors.New("expected <pattern>=<preemptive|challenge>")
+	}
+
+	re, err := compileDomainPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &UpstreamAuthRule{Proxy: re, Mode: UpstreamAuthMode(mode)}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *UpstreamAuthRule) Validate() error {
+	if r.Proxy == nil {
+		return errors.New("proxy pattern is required")
+	}
+	switch r.Mode {
+	case PreemptiveUpstreamAuth, ChallengeUpstreamAuth:
+		return nil
+	default:
+		return fmt.Errorf("unsupported mode: %s", r.Mode)
+	}
+}
+
+func (r *UpstreamAuthRule) String() string {
+	return r.Proxy.String() + "=" + string(r.Mode)
+}
+
+// upstreamAuthChallenge returns true if the first rule matching the proxy host uses ChallengeUpstreamAuth.
+func (hp *HTTPProxy) upstreamAuthChallenge(proxyURL *url.URL) bool {
+	h := proxyURL.Hostname()
+	for _, r := range hp.config.UpstreamAuthRules {
+		if r.Proxy.MatchString(h) {
+			return r.Mode == ChallengeUpstreamAuth
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseUpstreamAuthRule(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{input: "*.corp.example.com=challenge"},
+		{input: `^proxy\.example\.com$=preemptive`},
+		{input: "proxy.example.com", err: "expected"},
+		{input: "=challenge", err: "expected"},
+		{input: "proxy.example.com=never", err: "unsupported mode"},
+		{input: "(=challenge", err: "missing closing"},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			_, err := ParseUpstreamAuthRule(tc.input)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthChallenge(t *testing.T) {
+	var rules []*UpstreamAuthRule
+	for _, s := range []string{`^a\.corp\.example\.com$=preemptive`, "*.corp.example.com=challenge"} {
+		r, err := ParseUpstreamAuthRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	hp := &HTTPProxy{config: HTTPProxyConfig{UpstreamAuthRules: rules}}
+
+	tests := []struct {
+		proxy     string
+		challenge bool
+	}{
+		{"http://a.corp.example.com:3128", false},
+		{"http://b.corp.example.com:3128", true},
+		{"http://corp.example.com:3128", true},
+		{"http://proxy.example.com:3128", false},
+	}
+	for _, tc := range tests {
+		u, err := url.Parse(tc.proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hp.upstreamAuthChallenge(u); got != tc.challenge {
+			t.Errorf("%s: expected challenge=%t, got %t", tc.proxy, tc.challenge, got)
+		}
+	}
+}
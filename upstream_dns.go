@@ -0,0 +1,376 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type DNSDiscoveryMode string
+
+const (
+	// SRVDiscovery resolves SRV records, the targets with the lowest priority become pool members,
+	// requests are distributed over them in proportion to their weights.
+	SRVDiscovery DNSDiscoveryMode = "srv"
+	// TXTDiscovery resolves TXT records, each record holds an upstream proxy URL.
+	TXTDiscovery DNSDiscoveryMode = "txt"
+)
+
+// DNSDiscoveryRecord is a DNS record listing upstream proxies.
+type DNSDiscoveryRecord struct {
+	Mode DNSDiscoveryMode
+
+	// Name is the DNS name to resolve.
+	// For SRV records it is the full service name e.g. _proxy._tcp.example.com.
+	Name string
+}
+
+// ParseDNSDiscoveryRecord parses a <srv|txt>:<name> string.
+func ParseDNSDiscoveryRecord(val string) (DNSDiscoveryRecord, error) {
+	var r DNSDiscoveryRecord
+
+	mode, name, ok := strings.Cut(val, ":")
+	if !ok {
+		return r, fmt.Errorf("expected <srv|txt>:<name>")
+	}
+
+	switch m := DNSDiscoveryMode(mode); m {
+	case SRVDiscovery, TXTDiscovery:
+		r.Mode = m
+	default:
+		return r, fmt.Errorf("unsupported mode %q, supported modes are: srv, txt", mode)
+	}
+
+	if !isDomainName(strings.TrimSuffix(name, ".")) {
+		return r, fmt.Errorf("invalid name %q", name)
+	}
+	r.Name = name
+
+	return r, nil
+}
+
+func (r DNSDiscoveryRecord) String() string {
+	if r.Mode == "" {
+		return ""
+	}
+	return string(r.Mode) + ":" + r.Name
+}
+
+type DNSDiscoveryConfig struct {
+	Record DNSDiscoveryRecord
+
+	// Scheme is the upstream proxy scheme used for SRV targets.
+	Scheme string
+
+	// RefreshInterval is the maximal time between lookups.
+	// Records are re-resolved when the shortest TTL of the answers expires, but not later than RefreshInterval.
+	// If the TTL is not known or a lookup fails, the lookup is repeated after RefreshInterval.
+	RefreshInterval time.Duration
+}
+
+func DefaultDNSDiscoveryConfig() *DNSDiscoveryConfig {
+	return &DNSDiscoveryConfig{
+		Scheme:          "http",
+		RefreshInterval: 30 * time.Second,
+	}
+}
+
+func (c *DNSDiscoveryConfig) Validate() error {
+	switch c.Record.Mode {
+	case SRVDiscovery, TXTDiscovery:
+	default:
+		return fmt.Errorf("unsupported mode %q", c.Record.Mode)
+	}
+	if c.Record.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateProxyURL(&url.URL{Scheme: c.Scheme, Host: "localhost:1"}); err != nil {
+		return fmt.Errorf("scheme: %w", err)
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+	return nil
+}
+
+// minDNSDiscoveryRefresh is the minimal time between lookups, it applies to records with very short or zero TTLs.
+const minDNSDiscoveryRefresh = time.Second
+
+// noTTL is returned by DNS lookups if the TTL of the answers is not known.
+const noTTL time.Duration = -1
+
+// DNSDiscovery keeps UpstreamPool in sync with DNS records.
+// If a lookup fails the pool members are not changed.
+type DNSDiscovery struct {
+	config DNSDiscoveryConfig
+	pool   *UpstreamPool
+	log    log.Logger
+
+	// next is the time until the next lookup, it is set by Refresh.
+	next atomic.Int64
+
+	lookupSRV func(ctx context.Context, name string) ([]*net.SRV, time.Duration, error)
+	lookupTXT func(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+func NewDNSDiscovery(cfg *DNSDiscoveryConfig, pool *UpstreamPool, log log.Logger) (*DNSDiscovery, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	d := &DNSDiscovery{
+		config:    *cfg,
+		pool:      pool,
+		log:       log,
+		lookupSRV: lookupSRVWithTTL,
+		lookupTXT: lookupTXTWithTTL,
+	}
+	d.next.Store(int64(cfg.RefreshInterval))
+
+	return d, nil
+}
+
+// Refresh resolves the DNS record and updates the pool.
+func (d *DNSDiscovery) Refresh(ctx context.Context) error {
+	d.next.Store(int64(d.config.RefreshInterval))
+
+	var (
+		members []*url.URL
+		weights []int
+		ttl     time.Duration
+		err     error
+	)
+	switch d.config.Record.Mode {
+	case SRVDiscovery:
+		members, weights, ttl, err = d.resolveSRV(ctx)
+	case TXTDiscovery:
+		members, ttl, err = d.resolveTXT(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("%s lookup %s: %w", d.config.Record.Mode, d.config.Record.Name, err)
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("%s lookup %s: no upstream proxies found", d.config.Record.Mode, d.config.Record.Name)
+	}
+
+	if d.pool.updateWeighted(members, weights) {
+		d.log.Infof("upstream proxies updated %s", redactURLs(members))
+	}
+	d.next.Store(int64(d.refreshAfter(ttl)))
+
+	return nil
+}
+
+// refreshAfter returns the time until the next lookup for records with the TTL.
+func (d *DNSDiscovery) refreshAfter(ttl time.Duration) time.Duration {
+	if ttl == noTTL || ttl > d.config.RefreshInterval {
+		return d.config.RefreshInterval
+	}
+	return max(ttl, minDNSDiscoveryRefresh)
+}
+
+func (d *DNSDiscovery) resolveSRV(ctx context.Context) (members []*url.URL, weights []int, ttl time.Duration, err error) {
+	addrs, ttl, err := d.lookupSRV(ctx, d.config.Record.Name)
+	if err != nil {
+		return nil, nil, ttl, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, ttl, nil
+	}
+
+	// Clients must contact the target with the lowest-numbered priority they can reach, see RFC 2782.
+	minPriority := addrs[0].Priority
+	for _, a := range addrs {
+		if a.Priority < minPriority {
+			minPriority = a.Priority
+		}
+	}
+
+	for _, a := range addrs {
+		if a.Priority != minPriority || a.Target == "." {
+			continue
+		}
+		members = append(members, &url.URL{
+			Scheme: d.config.Scheme,
+			Host:   net.JoinHostPort(strings.TrimSuffix(a.Target, "."), strconv.Itoa(int(a.Port))),
+		})
+		weights = append(weights, int(a.Weight))
+	}
+
+	return members, weights, ttl, nil
+}
+
+func (d *DNSDiscovery) resolveTXT(ctx context.Context) ([]*url.URL, time.Duration, error) {
+	txt, ttl, err := d.lookupTXT(ctx, d.config.Record.Name)
+	if err != nil {
+		return nil, ttl, err
+	}
+
+	var members []*url.URL
+	for _, s := range txt {
+		u, err := ParseProxyURL(strings.TrimSpace(s))
+		if err != nil {
+			d.log.Errorf("ignoring invalid upstream proxy %q in TXT record: %s", s, err)
+			continue
+		}
+		members = append(members, u)
+	}
+
+	return members, ttl, nil
+}
+
+// Run refreshes the pool when the records expire until the context is canceled.
+func (d *DNSDiscovery) Run(ctx context.Context) error {
+	t := time.NewTimer(time.Duration(d.next.Load()))
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := d.Refresh(ctx); err != nil {
+				d.log.Errorf("failed to refresh upstream proxies, keeping %d previous: %s", d.pool.Len(), err)
+			}
+			t.Reset(time.Duration(d.next.Load()))
+		}
+	}
+}
+
+func lookupSRVWithTTL(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	var r dnsTTLRecorder
+	_, addrs, err := r.resolver().LookupSRV(ctx, "", "", name)
+	return addrs, r.ttl(), err
+}
+
+func lookupTXTWithTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	var r dnsTTLRecorder
+	txt, err := r.resolver().LookupTXT(ctx, name)
+	return txt, r.ttl(), err
+}
+
+// dnsTTLRecorder records the shortest TTL of the answers in DNS responses received by the Go resolver,
+// net.Resolver does not expose TTLs.
+type dnsTTLRecorder struct {
+	mu    sync.Mutex
+	min   uint32
+	found bool
+}
+
+// resolver returns a resolver using the system configuration that records the TTLs.
+func (r *dnsTTLRecorder) resolver() *net.Resolver {
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			c, err := d.DialContext(ctx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			// The resolver frames messages depending on whether the connection is a net.PacketConn.
+			if uc, ok := c.(*net.UDPConn); ok {
+				return &dnsTTLPacketConn{UDPConn: uc, r: r}, nil
+			}
+			return &dnsTTLStreamConn{Conn: c, r: r}, nil
+		},
+	}
+}
+
+// ttl returns the recorded TTL or noTTL if no answers were received.
+func (r *dnsTTLRecorder) ttl() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.found {
+		return noTTL
+	}
+	return time.Duration(r.min) * time.Second
+}
+
+func (r *dnsTTLRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if !r.found || h.TTL < r.min {
+			r.min, r.found = h.TTL, true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+type dnsTTLPacketConn struct {
+	*net.UDPConn
+	r *dnsTTLRecorder
+}
+
+func (c *dnsTTLPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		c.r.record(b[:n])
+	}
+	return n, err
+}
+
+// dnsTTLStreamConn records TTLs of DNS messages sent over TCP, each prefixed with a two byte length.
+type dnsTTLStreamConn struct {
+	net.Conn
+	r   *dnsTTLRecorder
+	buf []byte
+}
+
+func (c *dnsTTLStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		l := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+l {
+			break
+		}
+		c.r.record(c.buf[2 : 2+l])
+		c.buf = c.buf[2+l:]
+	}
+	return n, err
+}
+
+func redactURLs(urls []*url.URL) string {
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, u := range urls {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(u.Redacted())
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
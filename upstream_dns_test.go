@@ -0,0 +1,208 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSDiscoveryRefresh(t *testing.T) {
+	cfg := DefaultDNSDiscoveryConfig()
+	cfg.Record = DNSDiscoveryRecord{Mode: SRVDiscovery, Name: "_proxy._tcp.example.com"}
+
+	pool := new(UpstreamPool)
+	d, err := NewDNSDiscovery(cfg, pool, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookupErr error
+	d.lookupSRV = func(_ context.Context, _ string) ([]*net.SRV, time.Duration, error) {
+		if lookupErr != nil {
+			return nil, noTTL, lookupErr
+		}
+		return []*net.SRV{
+			{Target: "b.example.com.", Port: 3128, Priority: 10, Weight: 0},
+			{Target: "a.example.com.", Port: 3128, Priority: 10, Weight: 5},
+			{Target: "backup.example.com.", Port: 3128, Priority: 20, Weight: 5},
+		}, 5 * time.Second, nil
+	}
+
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[http://a.example.com:3128, http://b.example.com:3128]"
+	if s := redactURLs(pool.Members()); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+	if next := time.Duration(d.next.Load()); next != 5*time.Second {
+		t.Fatalf("expected next refresh in 5s, got %s", next)
+	}
+
+	// Members with weight 0 are not selected.
+	fn := pool.ProxyFunc()
+	for range 10 {
+		u, err := fn(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Host != "a.example.com:3128" {
+			t.Fatalf("unexpected upstream %s", u.Host)
+		}
+	}
+
+	lookupErr = errors.New("lookup failed")
+	if err := d.Refresh(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if s := redactURLs(pool.Members()); s != expected {
+		t.Fatalf("expected members to be kept after failed lookup, got %s", s)
+	}
+	if next := time.Duration(d.next.Load()); next != cfg.RefreshInterval {
+		t.Fatalf("expected retry after %s, got %s", cfg.RefreshInterval, next)
+	}
+}
+
+func TestDNSDiscoveryRefreshAfter(t *testing.T) {
+	cfg := DefaultDNSDiscoveryConfig()
+	cfg.Record = DNSDiscoveryRecord{Mode: TXTDiscovery, Name: "proxies.example.com"}
+	cfg.RefreshInterval = time.Minute
+
+	d, err := NewDNSDiscovery(cfg, new(UpstreamPool), stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ttl, expected time.Duration
+	}{
+		{noTTL, time.Minute},
+		{0, minDNSDiscoveryRefresh},
+		{10 * time.Second, 10 * time.Second},
+		{time.Hour, time.Minute},
+	}
+	for _, tc := range tests {
+		if got := d.refreshAfter(tc.ttl); got != tc.expected {
+			t.Errorf("ttl %s: expected %s, got %s", tc.ttl, tc.expected, got)
+		}
+	}
+}
+
+func TestDNSTTLRecorder(t *testing.T) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.EnableCompression()
+	name := dnsmessage.MustNewName("proxies.example.com.")
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ttl := range []uint32{300, 60, 120} {
+		h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl}
+		if err := b.TXTResource(h, dnsmessage.TXTResource{TXT: []string{"http://proxy:3128"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r dnsTTLRecorder
+	if ttl := r.ttl(); ttl != noTTL {
+		t.Fatalf("expected no TTL, got %s", ttl)
+	}
+
+	// Messages over TCP are length-prefixed and may be split across reads.
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+	framed = append(framed, msg...)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go func() {
+		defer c2.Close()
+		for i := 0; i < len(framed); i += 7 {
+			c2.Write(framed[i:min(i+7, len(framed))]) //nolint:errcheck // pipe is read until closed
+		}
+	}()
+	sc := &dnsTTLStreamConn{Conn: c1, r: &r}
+	buf := make([]byte, 5)
+	for {
+		if _, err := sc.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if ttl := r.ttl(); ttl != time.Minute {
+		t.Fatalf("expected TTL 1m, got %s", ttl)
+	}
+}
+
+func TestDNSDiscoveryRefreshTXT(t *testing.T) {
+	cfg := DefaultDNSDiscoveryConfig()
+	cfg.Record = DNSDiscoveryRecord{Mode: TXTDiscovery, Name: "proxies.example.com"}
+
+	pool := new(UpstreamPool)
+	d, err := NewDNSDiscovery(cfg, pool, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.lookupTXT = func(_ context.Context, _ string) ([]string, time.Duration, error) {
+		return []string{"socks5://10.0.0.1:1080", "not a proxy", "https://proxy.example.com:443"}, noTTL, nil
+	}
+
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[https://proxy.example.com:443, socks5://10.0.0.1:1080]"
+	if s := redactURLs(pool.Members()); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+}
+
+func TestParseDNSDiscoveryRecord(t *testing.T) {
+	tests := []struct {
+		input string
+		err   bool
+	}{
+		{input: "srv:_proxy._tcp.example.com"},
+		{input: "txt:proxies.example.com."},
+		{input: "a:example.com", err: true},
+		{input: "srv", err: true},
+		{input: "srv:", err: true},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.input, func(t *testing.T) {
+			r, err := ParseDNSDiscoveryRecord(tc.input)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %s", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.String() != tc.input {
+				t.Fatalf("expected %s, got %s", tc.input, r)
+			}
+		})
+	}
+}
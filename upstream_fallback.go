@@ -0,0 +1,174 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+const upstreamFallbackKey = "upstream-fallback"
+
+// upstreamFallback is the ordered list of upstream proxies for a request, nil entry means DIRECT.
+type upstreamFallback struct {
+	mu      sync.Mutex
+	proxies []*url.URL
+	i       int
+}
+
+func (f *upstreamFallback) current() *url.URL {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.proxies[f.i]
+}
+
+// next switches to the next proxy, it returns false if there are no more proxies.
+func (f *upstreamFallback) next() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.i+1 >= len(f.proxies) {
+		return false
+	}
+	f.i++
+	return true
+}
+
+// upstreamFallbackFrom returns the fallback list selected for the request, or nil if there is none.
+func upstreamFallbackFrom(req *http.Request) *upstreamFallback {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return nil
+	}
+	v, ok := ctx.Get(upstreamFallbackKey)
+	if !ok {
+		return nil
+	}
+	f, _ := v.(*upstreamFallback)
+	return f
+}
+
+// selectUpstreamFallback records the proxies in the request and returns the first one.
+// The list is recorded only if there is more than one proxy.
+func selectUpstreamFallback(req *http.Request, proxies []*url.URL) *url.URL {
+	if len(proxies) == 0 {
+		return nil
+	}
+	if len(proxies) > 1 {
+		if ctx := martian.NewContext(req); ctx != nil {
+			ctx.Set(upstreamFallbackKey, &upstreamFallback{proxies: proxies})
+		}
+	}
+	return proxies[0]
+}
+
+// pacFallbackProxies returns the URLs of all proxies from the PAC result in order.
+func pacFallbackProxies(s pac.Proxies) ([]*url.URL, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	proxies := make([]*url.URL, len(all))
+	for i, p := range all {
+		proxies[i] = p.URL()
+	}
+	return proxies, nil
+}
+
+// isDialError returns true if the connection to the upstream proxy or the target could not be established.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	for errors.As(err, &opErr) {
+		if opErr.Op == "dial" || opErr.Op == "proxyconnect" {
+			return true
+		}
+		err = opErr.Err
+	}
+	return false
+}
+
+// nextUpstream switches the request to the next upstream proxy if the current one could not be dialed.
+// Requests with a body that cannot be replayed are not retried.
+func (hp *HTTPProxy) nextUpstream(req *http.Request, err error) bool {
+	if !isDialError(err) || req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	f := upstreamFallbackFrom(req)
+	if f == nil {
+		return false
+	}
+
+	failed := f.current()
+	if !f.next() {
+		return false
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return false
+		}
+		req.Body = body
+	}
+
+	hp.log.Infof("upstream proxy %s failed: %s, trying %s", proxyString(failed), err, proxyString(f.current()))
+	return true
+}
+
+func proxyString(u *url.URL) string {
+	if u == nil {
+		return "DIRECT"
+	}
+	return u.Redacted()
+}
+
+// configureUpstreamFallback retries requests via the next upstream proxy from the fallback list on dial errors.
+func (hp *HTTPProxy) configureUpstreamFallback() {
+	next := hp.proxy.RoundTripFunc
+	hp.proxy.RoundTripFunc = func(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+		for {
+			var (
+				res *http.Response
+				err error
+			)
+			if next != nil {
+				res, err = next(rt, req)
+			} else {
+				res, err = rt.RoundTrip(req)
+			}
+			if err == nil || !hp.nextUpstream(req, err) {
+				return res, err
+			}
+		}
+	}
+
+	nextConnect := hp.proxy.ConnectFunc
+	hp.proxy.ConnectFunc = func(connect func(*http.Request) (*http.Response, net.Conn, error), req *http.Request) (*http.Response, net.Conn, error) {
+		for {
+			var (
+				res  *http.Response
+				conn net.Conn
+				err  error
+			)
+			if nextConnect != nil {
+				res, conn, err = nextConnect(connect, req)
+			} else {
+				res, conn, err = connect(req)
+			}
+			if err == nil || !hp.nextUpstream(req, err) {
+				return res, conn, err
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/log"
+	"github.com/saucelabs/forwarder/pac"
+	"github.com/saucelabs/forwarder/utils/httpx"
+)
+
+func TestIsDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, dialErr := net.Dial("tcp", addr)
+	if dialErr == nil {
+		t.Fatal("expected dial error")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial", err: dialErr, want: true},
+		{name: "wrapped dial", err: fmt.Errorf("connect: %w", dialErr), want: true},
+		{name: "proxyconnect", err: &net.OpError{Op: "proxyconnect", Net: "tcp", Err: errors.New("tls: handshake failure")}, want: true},
+		{name: "read", err: &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, want: false},
+		{name: "other", err: errors.New("other"), want: false},
+	}
+
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isDialError(tc.err); got != tc.want {
+				t.Fatalf("isDialError(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPACFallbackProxies(t *testing.T) {
+	proxies, err := pacFallbackProxies(pac.Proxies("PROXY a:1; SOCKS5 b:2; DIRECT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, u := range proxies {
+		got = append(got, proxyString(u))
+	}
+	if s := strings.Join(got, " "); s != "http://a:1 socks5://b:2 DIRECT" {
+		t.Fatalf("unexpected proxies: %s", s)
+	}
+}
+
+func TestUpstreamFallback(t *testing.T) {
+	proxies := []*url.URL{
+		{Scheme: "http", Host: "a:1"},
+		{Scheme: "http", Host: "b:2"},
+		nil,
+	}
+
+	newRequest := func(t *testing.T, method string, body string) *http.Request {
+		t.Helper()
+		req := httptest.NewRequest(method, "http://foo.com/", strings.NewReader(body))
+		if body == "" {
+			req.Body = http.NoBody
+		}
+		req.GetBody = nil
+		martian.TestContext(req, nil, nil)
+		if u := selectUpstreamFallback(req, proxies); u != proxies[0] {
+			t.Fatalf("expected first proxy, got %s", proxyString(u))
+		}
+		return req
+	}
+
+	var attempts []string
+	failUntilDirect := func(req *http.Request) error {
+		u := upstreamFallbackFrom(req).current()
+		attempts = append(attempts, proxyString(u))
+		if u != nil {
+			return &net.OpError{Op: "proxyconnect", Net: "tcp", Err: errors.New("connection refused")}
+		}
+		return nil
+	}
+
+	hp := &HTTPProxy{log: log.NopLogger, proxy: martian.NewProxy()}
+	defer hp.proxy.Close()
+	hp.configureUpstreamFallback()
+
+	t.Run("round trip", func(t *testing.T) {
+		attempts = nil
+		req := newRequest(t, http.MethodGet, "")
+		rt := httpx.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := failUntilDirect(req); err != nil {
+				return nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+		})
+
+		res, err := hp.proxy.RoundTripFunc(rt, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if s := strings.Join(attempts, " "); s != "http://a:1 http://b:2 DIRECT" {
+			t.Fatalf("unexpected attempts: %s", s)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		attempts = nil
+		req := newRequest(t, http.MethodConnect, "")
+		connect := func(req *http.Request) (*http.Response, net.Conn, error) {
+			if err := failUntilDirect(req); err != nil {
+				return nil, nil, err
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil, nil
+		}
+
+		if _, _, err := hp.proxy.ConnectFunc(connect, req); err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(attempts, " "); s != "http://a:1 http://b:2 DIRECT" {
+			t.Fatalf("unexpected attempts: %s", s)
+		}
+	})
+
+	t.Run("body", func(t *testing.T) {
+		attempts = nil
+		req := newRequest(t, http.MethodPost, "body")
+		rt := httpx.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, failUntilDirect(req)
+		})
+
+		if _, err := hp.proxy.RoundTripFunc(rt, req); err == nil {
+			t.Fatal("expected error")
+		}
+		if s := strings.Join(attempts, " "); s != "http://a:1" {
+			t.Fatalf("unexpected attempts: %s", s)
+		}
+	})
+}
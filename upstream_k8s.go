@@ -0,0 +1,316 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesDiscoveryConfig specifies a Kubernetes Service whose endpoints are upstream proxies.
+type KubernetesDiscoveryConfig struct {
+	// Service is the service name in the [namespace/]name format.
+	// If namespace is not specified, the namespace of the pod is used.
+	Service string
+
+	// PortName is the name of the service port to use.
+	// If empty, the first port is used.
+	PortName string
+
+	// Scheme is the upstream proxy scheme.
+	Scheme string
+
+	// ResyncInterval is the time between full resyncs of the endpoints.
+	ResyncInterval time.Duration
+}
+
+func DefaultKubernetesDiscoveryConfig() *KubernetesDiscoveryConfig {
+	return &KubernetesDiscoveryConfig{
+		Scheme:         "http",
+		ResyncInterval: 5 * time.Minute,
+	}
+}
+
+func (c *KubernetesDiscoveryConfig) Validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("service is required")
+	}
+	if strings.Count(c.Service, "/") > 1 {
+		return fmt.Errorf("invalid service %q, expected [namespace/]name", c.Service)
+	}
+	if err := validateProxyURL(&url.URL{Scheme: c.Scheme, Host: "localhost:1"}); err != nil {
+		return fmt.Errorf("scheme: %w", err)
+	}
+	if c.ResyncInterval <= 0 {
+		return fmt.Errorf("resync interval must be positive")
+	}
+	return nil
+}
+
+// KubernetesDiscovery keeps UpstreamPool in sync with the ready endpoints of a Kubernetes Service.
+// It watches EndpointSlices using the in-cluster service account,
+// the account needs permissions to list and watch endpointslices in the service namespace.
+// If the API server is unavailable the pool members are not changed.
+type KubernetesDiscovery struct {
+	config    KubernetesDiscoveryConfig
+	pool      *UpstreamPool
+	log       log.Logger
+	namespace string
+	name      string
+
+	apiURL string
+	client *http.Client
+	token  func() (string, error)
+}
+
+func NewKubernetesDiscovery(cfg *KubernetesDiscoveryConfig, pool *UpstreamPool, log log.Logger) (*KubernetesDiscovery, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	ca, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read service account CA: %w", err)
+	}
+	pool509 := x509.NewCertPool()
+	if !pool509.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("append service account CA")
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // it's *http.Transport
+	tr.Proxy = nil
+	tr.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool509,
+	}
+
+	d := &KubernetesDiscovery{
+		config: *cfg,
+		pool:   pool,
+		log:    log,
+		apiURL: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{Transport: tr},
+		token: func() (string, error) {
+			// Tokens are rotated, always read the current one.
+			b, err := os.ReadFile(k8sServiceAccountDir + "/token")
+			return strings.TrimSpace(string(b)), err
+		},
+	}
+
+	ns, name, ok := strings.Cut(cfg.Service, "/")
+	if ok {
+		d.namespace, d.name = ns, name
+	} else {
+		b, err := os.ReadFile(k8sServiceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read pod namespace: %w", err)
+		}
+		d.namespace, d.name = strings.TrimSpace(string(b)), cfg.Service
+	}
+
+	return d, nil
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []k8sEndpointSlice `json:"items"`
+}
+
+type k8sEndpointSlice struct {
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+}
+
+type k8sWatchEvent struct {
+	Type string `json:"type"`
+}
+
+func (d *KubernetesDiscovery) endpointSlicesURL(watch bool, resourceVersion string) string {
+	q := url.Values{}
+	q.Set("labelSelector", "kubernetes.io/service-name="+d.name)
+	if watch {
+		q.Set("watch", "true")
+		q.Set("resourceVersion", resourceVersion)
+		q.Set("allowWatchBookmarks", "false")
+	}
+	return fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		d.apiURL, url.PathEscape(d.namespace), q.Encode())
+}
+
+func (d *KubernetesDiscovery) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	token, err := d.token()
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+// Refresh lists the service endpoints and updates the pool.
+// It returns the resource version of the list.
+func (d *KubernetesDiscovery) Refresh(ctx context.Context) (string, error) {
+	res, err := d.get(ctx, d.endpointSlicesURL(false, ""))
+	if err != nil {
+		return "", fmt.Errorf("list endpointslices %s/%s: %w", d.namespace, d.name, err)
+	}
+	defer res.Body.Close()
+
+	var l k8sEndpointSliceList
+	if err := json.NewDecoder(res.Body).Decode(&l); err != nil {
+		return "", fmt.Errorf("decode endpointslices: %w", err)
+	}
+
+	members := d.members(l.Items)
+	if len(members) == 0 {
+		d.log.Infof("service %s/%s has no ready endpoints", d.namespace, d.name)
+	}
+	if d.pool.Update(members) {
+		d.log.Infof("upstream proxies updated %s", redactURLs(members))
+	}
+
+	return l.Metadata.ResourceVersion, nil
+}
+
+func (d *KubernetesDiscovery) members(slices []k8sEndpointSlice) []*url.URL {
+	var members []*url.URL
+	for _, s := range slices {
+		if s.AddressType != "IPv4" && s.AddressType != "IPv6" {
+			continue
+		}
+
+		port := -1
+		for _, p := range s.Ports {
+			if p.Port == nil {
+				continue
+			}
+			if d.config.PortName == "" || (p.Name != nil && *p.Name == d.config.PortName) {
+				port = int(*p.Port)
+				break
+			}
+		}
+		if port == -1 {
+			continue
+		}
+
+		for _, e := range s.Endpoints {
+			// Nil ready condition should be interpreted as ready.
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
+			for _, a := range e.Addresses {
+				members = append(members, &url.URL{
+					Scheme: d.config.Scheme,
+					Host:   net.JoinHostPort(a, strconv.Itoa(port)),
+				})
+			}
+		}
+	}
+
+	return members
+}
+
+// watch blocks until the watch stream ends, the pool is refreshed on every change.
+func (d *KubernetesDiscovery) watch(ctx context.Context, resourceVersion string) error {
+	res, err := d.get(ctx, d.endpointSlicesURL(true, resourceVersion))
+	if err != nil {
+		return fmt.Errorf("watch endpointslices %s/%s: %w", d.namespace, d.name, err)
+	}
+	defer res.Body.Close()
+
+	s := bufio.NewScanner(res.Body)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e k8sWatchEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return fmt.Errorf("decode watch event: %w", err)
+		}
+		if e.Type == "ERROR" {
+			return fmt.Errorf("watch error event: %s", s.Bytes())
+		}
+		// Relist to get a consistent view across all slices of the service.
+		if _, err := d.Refresh(ctx); err != nil {
+			return err
+		}
+	}
+
+	return s.Err()
+}
+
+// Run watches the service endpoints until the context is canceled.
+// The endpoints are relisted every resync interval and after watch failures.
+func (d *KubernetesDiscovery) Run(ctx context.Context) error {
+	const retryDelay = 5 * time.Second
+
+	for {
+		rv, err := d.Refresh(ctx)
+		if err == nil {
+			wctx, cancel := context.WithTimeout(ctx, d.config.ResyncInterval)
+			err = d.watch(wctx, rv)
+			cancel()
+			if wctx.Err() != nil {
+				err = nil
+			}
+		}
+
+		delay := time.Duration(0)
+		if err != nil && ctx.Err() == nil {
+			d.log.Errorf("failed to sync upstream proxies, keeping %d previous: %s", d.pool.Len(), err)
+			delay = retryDelay
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+const testEndpointSliceList = `{
+  "kind": "EndpointSliceList",
+  "metadata": {"resourceVersion": "42"},
+  "items": [
+    {
+      "addressType": "IPv4",
+      "endpoints": [
+        {"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+        {"addresses": ["10.0.0.2"], "conditions": {"ready": false}},
+        {"addresses": ["10.0.0.3"], "conditions": {}}
+      ],
+      "ports": [
+        {"name": "metrics", "port": 10000},
+        {"name": "proxy", "port": 3128}
+      ]
+    },
+    {
+      "addressType": "FQDN",
+      "endpoints": [{"addresses": ["proxy.example.com"]}],
+      "ports": [{"name": "proxy", "port": 3128}]
+    }
+  ]
+}`
+
+func TestKubernetesDiscoveryRefresh(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/egress/endpointslices" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if ls := r.URL.Query().Get("labelSelector"); ls != "kubernetes.io/service-name=proxy" {
+			t.Errorf("unexpected label selector %s", ls)
+		}
+		if a := r.Header.Get("Authorization"); a != "Bearer token" {
+			t.Errorf("unexpected authorization %s", a)
+		}
+		w.Write([]byte(testEndpointSliceList))
+	}))
+	defer s.Close()
+
+	cfg := DefaultKubernetesDiscoveryConfig()
+	cfg.Service = "egress/proxy"
+	cfg.PortName = "proxy"
+
+	pool := new(UpstreamPool)
+	d := &KubernetesDiscovery{
+		config:    *cfg,
+		pool:      pool,
+		log:       stdlog.Default(),
+		namespace: "egress",
+		name:      "proxy",
+		apiURL:    s.URL,
+		client:    s.Client(),
+		token: func() (string, error) {
+			return "token", nil
+		},
+	}
+
+	rv, err := d.Refresh(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv != "42" {
+		t.Fatalf("expected resource version 42, got %s", rv)
+	}
+
+	expected := "[http://10.0.0.1:3128, http://10.0.0.3:3128]"
+	if s := redactURLs(pool.Members()); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/pac"
+)
+
+type LatencySelectorConfig struct {
+	// HalfLife is the time after which the score of an upstream proxy that is not used is halved,
+	// so that proxies that were slow or failing get traffic back and are measured again.
+	HalfLife time.Duration
+
+	// ErrorPenalty is added to the latency of an upstream proxy proportionally to its error rate.
+	ErrorPenalty time.Duration
+}
+
+func DefaultLatencySelectorConfig() *LatencySelectorConfig {
+	return &LatencySelectorConfig{
+		HalfLife:     time.Minute,
+		ErrorPenalty: 5 * time.Second,
+	}
+}
+
+func (c *LatencySelectorConfig) Validate() error {
+	if c.HalfLife <= 0 {
+		return errors.New("half_life must be positive")
+	}
+	if c.ErrorPenalty < 0 {
+		return errors.New("error_penalty must not be negative")
+	}
+	return nil
+}
+
+// latencyAlpha is the weight of a new sample in the moving averages.
+const latencyAlpha = 0.3
+
+type latencyScore struct {
+	latency float64 // seconds
+	errors  float64 // rate in range [0, 1]
+	updated time.Time
+}
+
+// LatencySelector selects the upstream proxy with the lowest latency from a list of candidates.
+// The latency and error rate of upstream proxies are measured by the HTTP proxy,
+// for HTTP requests it is the time to response headers, and for CONNECT requests the time to establish the tunnel.
+// Proxies that were not measured yet are preferred, so that all candidates are measured.
+type LatencySelector struct {
+	config  LatencySelectorConfig
+	mu      sync.Mutex
+	scores  map[string]*latencyScore
+	nowFunc func() time.Time
+}
+
+func NewLatencySelector(cfg *LatencySelectorConfig) (*LatencySelector, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &LatencySelector{
+		config:  *cfg,
+		scores:  make(map[string]*latencyScore),
+		nowFunc: time.Now,
+	}, nil
+}
+
+const upstreamProxyKey = "upstream-proxy"
+
+func upstreamKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// Select returns the candidate with the lowest score, ties are resolved in favour of the first candidate.
+// The selection is recorded in the request, so that the proxy can measure the upstream.
+func (s *LatencySelector) Select(req *http.Request, candidates []*url.URL) *url.URL {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	now := s.nowFunc()
+	best, bestScore := 0, math.Inf(1)
+
+	s.mu.Lock()
+	for i, u := range candidates {
+		if v := s.score(upstreamKey(u), now); v < bestScore {
+			best, bestScore = i, v
+		}
+	}
+	s.mu.Unlock()
+
+	u := candidates[best]
+	if ctx := martian.NewContext(req); ctx != nil {
+		ctx.Set(upstreamProxyKey, upstreamKey(u))
+	}
+	return u
+}
+
+func (s *LatencySelector) score(key string, now time.Time) float64 {
+	v, ok := s.scores[key]
+	if !ok {
+		return 0
+	}
+	score := v.latency + v.errors*s.config.ErrorPenalty.Seconds()
+	idle := now.Sub(v.updated).Seconds()
+	return score * math.Exp2(-idle/s.config.HalfLife.Seconds())
+}
+
+func (s *LatencySelector) observe(key string, d time.Duration, err error) {
+	var e float64
+	if err != nil {
+		e = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.scores[key]
+	if !ok {
+		v = &latencyScore{errors: e}
+		if err == nil {
+			v.latency = d.Seconds()
+		}
+		s.scores[key] = v
+	} else {
+		if err == nil {
+			v.latency = latencyAlpha*d.Seconds() + (1-latencyAlpha)*v.latency
+		}
+		v.errors = latencyAlpha*e + (1-latencyAlpha)*v.errors
+	}
+	v.updated = s.nowFunc()
+}
+
+// Scores returns the current scores of measured upstream proxies.
+func (s *LatencySelector) Scores() map[string]time.Duration {
+	now := s.nowFunc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := make(map[string]time.Duration, len(s.scores))
+	for k := range s.scores {
+		m[k] = time.Duration(s.score(k, now) * float64(time.Second))
+	}
+	return m
+}
+
+// LatencyScore is the measured state of an upstream proxy, it is used to transfer the selector state between instances.
+type LatencyScore struct {
+	Upstream  string        `json:"upstream"`
+	Latency   time.Duration `json:"latency"`
+	ErrorRate float64       `json:"error_rate"`
+	Updated   time.Time     `json:"updated"`
+}
+
+// State returns the measurements of upstream proxies sorted by upstream.
+func (s *LatencySelector) State() []LatencyScore {
+	s.mu.Lock()
+	res := make([]LatencyScore, 0, len(s.scores))
+	for k, v := range s.scores {
+		res = append(res, LatencyScore{
+			Upstream:  k,
+			Latency:   time.Duration(v.latency * float64(time.Second)),
+			ErrorRate: v.errors,
+			Updated:   v.updated,
+		})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Upstream < res[j].Upstream })
+	return res
+}
+
+// Restore replaces the measurements of the upstream proxies present in state,
+// unless the selector has a more recent measurement.
+func (s *LatencySelector) Restore(state []LatencyScore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range state {
+		if v.Upstream == "" || v.ErrorRate < 0 || v.ErrorRate > 1 || v.Latency < 0 {
+			continue
+		}
+		if cur, ok := s.scores[v.Upstream]; ok && !v.Updated.After(cur.updated) {
+			continue
+		}
+		s.scores[v.Upstream] = &latencyScore{
+			latency: v.Latency.Seconds(),
+			errors:  v.ErrorRate,
+			updated: v.Updated,
+		}
+	}
+}
+
+// observeRoundTrip measures requests sent via upstream proxies selected by the selector.
+func (s *LatencySelector) observeRoundTrip(req *http.Request, start time.Time, err error) {
+	ctx := martian.NewContext(req)
+	if ctx == nil {
+		return
+	}
+	v, ok := ctx.Get(upstreamProxyKey)
+	if !ok {
+		return
+	}
+	key, _ := v.(string)
+	s.observe(key, s.nowFunc().Sub(start), err)
+}
+
+// selectPACProxy selects the proxy from the PAC result with the selector.
+// DIRECT is used only if it is the first entry.
+func selectPACProxy(req *http.Request, s pac.Proxies, ls *LatencySelector) (*url.URL, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	if len(all) == 0 || all[0].Mode == pac.DIRECT {
+		return nil, nil //nolint:nilnil // direct
+	}
+
+	var candidates []*url.URL
+	for _, p := range all {
+		if p.Mode != pac.DIRECT {
+			candidates = append(candidates, p.URL())
+		}
+	}
+	return ls.Select(req, candidates), nil
+}
+
+func (hp *HTTPProxy) configureLatencySelector() {
+	s := hp.config.LatencySelector
+
+	next := hp.proxy.RoundTripFunc
+	hp.proxy.RoundTripFunc = func(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+		start := s.nowFunc()
+		var (
+			res *http.Response
+			err error
+		)
+		if next != nil {
+			res, err = next(rt, req)
+		} else {
+			res, err = rt.RoundTrip(req)
+		}
+		s.observeRoundTrip(req, start, err)
+		return res, err
+	}
+
+	hp.proxy.ConnectFunc = func(connect func(*http.Request) (*http.Response, net.Conn, error), req *http.Request) (*http.Response, net.Conn, error) {
+		start := s.nowFunc()
+		res, conn, err := connect(req)
+		s.observeRoundTrip(req, start, err)
+		return res, conn, err
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/saucelabs/forwarder/pac"
+)
+
+func testLatencySelector(t *testing.T) (*LatencySelector, *time.Time) {
+	t.Helper()
+
+	s, err := NewLatencySelector(DefaultLatencySelectorConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(0, 0)
+	s.nowFunc = func() time.Time { return now }
+	return s, &now
+}
+
+func TestLatencySelectorSelect(t *testing.T) {
+	s, now := testLatencySelector(t)
+
+	a := &url.URL{Scheme: "http", Host: "a:3128"}
+	b := &url.URL{Scheme: "http", Host: "b:3128"}
+	candidates := []*url.URL{a, b}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+
+	if u := s.Select(req, candidates); u != a {
+		t.Fatalf("expected first candidate, got %s", u)
+	}
+
+	s.observe(upstreamKey(a), 500*time.Millisecond, nil)
+	if u := s.Select(req, candidates); u != b {
+		t.Fatalf("expected unmeasured candidate, got %s", u)
+	}
+
+	s.observe(upstreamKey(b), 100*time.Millisecond, nil)
+	if u := s.Select(req, candidates); u != b {
+		t.Fatalf("expected fastest candidate, got %s", u)
+	}
+
+	s.observe(upstreamKey(b), 0, errors.New("dial failed"))
+	if u := s.Select(req, candidates); u != a {
+		t.Fatalf("expected candidate without errors, got %s", u)
+	}
+
+	// Keep b measured while a is idle, its score decays until it gets traffic back.
+	for i := 0; i < 10; i++ {
+		*now = now.Add(time.Minute)
+		s.observe(upstreamKey(b), 100*time.Millisecond, nil)
+	}
+	if u := s.Select(req, candidates); u != a {
+		t.Fatalf("expected idle candidate to get traffic back, got %s", u)
+	}
+}
+
+func TestLatencySelectorScores(t *testing.T) {
+	s, now := testLatencySelector(t)
+
+	u := &url.URL{Scheme: "http", Host: "a:3128"}
+	s.observe(upstreamKey(u), time.Second, nil)
+	if got := s.Scores()[upstreamKey(u)]; got != time.Second {
+		t.Fatalf("expected score 1s, got %s", got)
+	}
+
+	*now = now.Add(s.config.HalfLife)
+	if got := s.Scores()[upstreamKey(u)]; got != 500*time.Millisecond {
+		t.Fatalf("expected score to be halved, got %s", got)
+	}
+}
+
+func TestLatencySelectorStateRestore(t *testing.T) {
+	s, now := testLatencySelector(t)
+
+	a := &url.URL{Scheme: "http", Host: "a:3128"}
+	b := &url.URL{Scheme: "http", Host: "b:3128"}
+	s.observe(upstreamKey(a), time.Second, nil)
+	s.observe(upstreamKey(b), 0, errors.New("dial error"))
+
+	s2, now2 := testLatencySelector(t)
+	*now2 = *now
+	s2.Restore(s.State())
+
+	for k, v := range s.Scores() {
+		if got := s2.Scores()[k]; got != v {
+			t.Errorf("%s: expected score %s, got %s", k, v, got)
+		}
+	}
+
+	// More recent measurements are kept.
+	*now2 = now2.Add(time.Minute)
+	s2.observe(upstreamKey(a), 10*time.Millisecond, nil)
+	want := s2.State()[0]
+	s2.Restore(s.State())
+	if got := s2.State()[0]; got != want {
+		t.Fatalf("expected recent measurement to be kept, got %+v, want %+v", got, want)
+	}
+}
+
+func TestSelectPACProxy(t *testing.T) {
+	s, _ := testLatencySelector(t)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+
+	s.observe("http://a:3128", time.Second, nil)
+	u, err := selectPACProxy(req, pac.Proxies("PROXY a:3128; DIRECT; PROXY b:3128"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Host != "b:3128" {
+		t.Fatalf("expected b:3128, got %v", u)
+	}
+
+	u, err = selectPACProxy(req, pac.Proxies("DIRECT; PROXY b:3128"), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != nil {
+		t.Fatalf("expected direct, got %s", u)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNoUpstreamProxy is returned by the UpstreamPool proxy function when the pool is empty.
+var ErrNoUpstreamProxy = errors.New("no upstream proxy available")
+
+// UpstreamPool is a set of upstream proxies that can be updated at runtime.
+// Requests are distributed over the members in a round-robin fashion,
+// or randomly in proportion to the member weights if the members are weighted.
+// Updating the pool does not affect requests that are in progress,
+// connections to removed members are not reused and are closed by the transport idle timeout.
+type UpstreamPool struct {
+	mu          sync.RWMutex
+	members     []*url.URL
+	weights     []int
+	totalWeight int
+	next        atomic.Uint64
+
+	// OnUpdate is called after the members of the pool change.
+	OnUpdate func(members []*url.URL)
+}
+
+// Update replaces the pool members, it returns true if the members changed.
+func (p *UpstreamPool) Update(members []*url.URL) bool {
+	return p.updateWeighted(members, nil)
+}
+
+// updateWeighted replaces the pool members and their weights, weights are either nil or have the length of members.
+// Members with weight 0 are not selected, unless all the weights are 0.
+func (p *UpstreamPool) updateWeighted(members []*url.URL, weights []int) bool {
+	idx := make([]int, len(members))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return members[idx[i]].String() < members[idx[j]].String()
+	})
+
+	m := make([]*url.URL, len(members))
+	for i, j := range idx {
+		m[i] = members[j]
+	}
+	var (
+		w     []int
+		total int
+	)
+	if weights != nil {
+		w = make([]int, len(weights))
+		for i, j := range idx {
+			w[i] = weights[j]
+			total += weights[j]
+		}
+		if total == 0 {
+			w = nil
+		}
+	}
+
+	p.mu.Lock()
+	changed := !equalURLs(p.members, m) || !slices.Equal(p.weights, w)
+	if changed {
+		p.members = m
+		p.weights = w
+		p.totalWeight = total
+	}
+	p.mu.Unlock()
+
+	if changed && p.OnUpdate != nil {
+		p.OnUpdate(m)
+	}
+
+	return changed
+}
+
+func equalURLs(a, b []*url.URL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// Members returns a copy of the current pool members.
+func (p *UpstreamPool) Members() []*url.URL {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	m := make([]*url.URL, len(p.members))
+	copy(m, p.members)
+	return m
+}
+
+// Len returns the number of pool members.
+func (p *UpstreamPool) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.members)
+}
+
+// ProxyFunc returns a ProxyFunc that selects pool members in a round-robin fashion,
+// or randomly in proportion to the member weights if the members are weighted.
+func (p *UpstreamPool) ProxyFunc() ProxyFunc {
+	return func(_ *http.Request) (*url.URL, error) {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+
+		if len(p.members) == 0 {
+			return nil, ErrNoUpstreamProxy
+		}
+
+		if p.weights != nil {
+			u := *p.members[p.weightedIndex(rand.IntN(p.totalWeight))] //nolint:gosec // load balancing does not need a secure random number
+			return &u, nil
+		}
+
+		n := p.next.Add(1) - 1
+		u := *p.members[n%uint64(len(p.members))]
+		return &u, nil
+	}
+}
+
+// weightedIndex returns the index of the member the r-th unit of the total weight belongs to.
+func (p *UpstreamPool) weightedIndex(r int) int {
+	for i, w := range p.weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(p.weights) - 1
+}
+
+// LatencyProxyFunc returns a ProxyFunc that selects the pool member with the lowest latency.
+func (p *UpstreamPool) LatencyProxyFunc(s *LatencySelector) ProxyFunc {
+	return func(req *http.Request) (*url.URL, error) {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+
+		if len(p.members) == 0 {
+			return nil, ErrNoUpstreamProxy
+		}
+
+		u := *s.Select(req, p.members)
+		return &u, nil
+	}
+}
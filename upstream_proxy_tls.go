@@ -0,0 +1,102 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// UpstreamProxyTLSConfig overrides the TLS configuration of connections to https:// upstream proxies.
+// The root CAs and insecure skip verify settings of the HTTP transport are used.
+type UpstreamProxyTLSConfig struct {
+	// ServerName is sent in SNI instead of the upstream proxy host.
+	// Unless VerifyName is set, the upstream proxy certificate is verified for this name.
+	ServerName string
+
+	// NextProtos are the ALPN protocols sent to the upstream proxy, the default is http/1.1.
+	// The connection uses HTTP/1.1 regardless of the negotiated protocol.
+	NextProtos []string
+
+	// VerifyName is the name the upstream proxy certificate is verified for instead of the server name,
+	// e.g. for upstream proxies addressed by IP with certificates issued for a DNS name.
+	VerifyName string
+}
+
+func DefaultUpstreamProxyTLSConfig() *UpstreamProxyTLSConfig {
+	return &UpstreamProxyTLSConfig{}
+}
+
+// IsZero returns true if no overrides are set.
+func (c *UpstreamProxyTLSConfig) IsZero() bool {
+	return c.ServerName == "" && len(c.NextProtos) == 0 && c.VerifyName == ""
+}
+
+func (c *UpstreamProxyTLSConfig) Validate() error {
+	for _, p := range c.NextProtos {
+		if p == "" {
+			return errors.New("next_protos: empty protocol")
+		}
+	}
+	return nil
+}
+
+func (c *UpstreamProxyTLSConfig) String() string {
+	var s []string
+	if c.ServerName != "" {
+		s = append(s, "server_name="+c.ServerName)
+	}
+	if len(c.NextProtos) > 0 {
+		s = append(s, "alpn="+strings.Join(c.NextProtos, ","))
+	}
+	if c.VerifyName != "" {
+		s = append(s, "verify_name="+c.VerifyName)
+	}
+	return strings.Join(s, " ")
+}
+
+// tlsConfig returns a copy of the base config with the overrides applied.
+func (c *UpstreamProxyTLSConfig) tlsConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.ServerName = c.ServerName
+	cfg.NextProtos = c.NextProtos
+
+	if c.VerifyName != "" && !cfg.InsecureSkipVerify {
+		roots := cfg.RootCAs
+		name := c.VerifyName
+		// The default verification checks the server name, it is replaced with verification of the name.
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				DNSName:       name,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+
+	return cfg
+}
+
+// transportTLSConfig returns the TLS client config of the transport, or an empty config if not available.
+func (hp *HTTPProxy) transportTLSConfig() *tls.Config {
+	if tr, ok := hp.transport.(*http.Transport); ok && tr.TLSClientConfig != nil {
+		return tr.TLSClientConfig
+	}
+	return new(tls.Config)
+}
@@ -0,0 +1,171 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func TestUpstreamProxyTLS(t *testing.T) {
+	var serverName atomic.Value
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName.Store(r.TLS.ServerName)
+	}))
+	defer upstream.Close()
+
+	// The test server certificate is valid for example.com and 127.0.0.1, but not localhost.
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Host = "localhost:" + u.Port()
+
+	newProxy := func(t *testing.T, c *UpstreamProxyTLSConfig) *HTTPProxy {
+		t.Helper()
+
+		cfg := DefaultHTTPProxyConfig()
+		cfg.UpstreamProxy = u
+		cfg.UpstreamProxyTLS = c
+
+		rt, err := NewHTTPTransport(DefaultHTTPTransportConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt.TLSClientConfig.RootCAs = x509.NewCertPool()
+		rt.TLSClientConfig.RootCAs.AddCert(upstream.Certificate())
+
+		p, err := NewInMemoryHTTPProxy(cfg, nil, nil, rt, stdlog.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Close() })
+		return p
+	}
+
+	do := func(t *testing.T, p *HTTPProxy, req *http.Request) int {
+		t.Helper()
+
+		conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		go req.WriteProxy(conn) //nolint:errcheck // the response is checked
+		res, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	requests := map[string]func() *http.Request{
+		"http": func() *http.Request {
+			req, err := http.NewRequest(http.MethodGet, "http://example.com/", http.NoBody)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return req
+		},
+		"connect": func() *http.Request {
+			return &http.Request{
+				Method: http.MethodConnect,
+				URL:    &url.URL{Host: "example.com:443"},
+				Host:   "example.com:443",
+				Header: make(http.Header),
+			}
+		},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		p := newProxy(t, nil)
+		for name, req := range requests {
+			if code := do(t, p, req()); code != http.StatusBadGateway {
+				t.Errorf("%s: expected status %d, got %d", name, http.StatusBadGateway, code)
+			}
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		p := newProxy(t, &UpstreamProxyTLSConfig{
+			ServerName: "proxy.test",
+			VerifyName: "example.com",
+		})
+		for name, req := range requests {
+			serverName.Store("")
+			if code := do(t, p, req()); code != http.StatusOK {
+				t.Errorf("%s: expected status %d, got %d", name, http.StatusOK, code)
+			}
+			if v := serverName.Load(); v != "proxy.test" {
+				t.Errorf("%s: expected SNI proxy.test, got %q", name, v)
+			}
+		}
+	})
+}
+
+func TestUpstreamProxyTLSDirect(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+
+	// The origin is used as https upstream proxy for /proxy requests, those fail as it does not speak TLS.
+	// Direct requests to the same address must not be wrapped in TLS.
+	u, err := url.Parse(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyURL := &url.URL{Scheme: "https", Host: u.Host}
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.UpstreamProxyFunc = func(req *http.Request) (*url.URL, error) {
+		if req.URL.Path == "/proxy" {
+			return proxyURL, nil
+		}
+		return nil, nil //nolint:nilnil // nil means no proxy
+	}
+	cfg.UpstreamProxyTLS = &UpstreamProxyTLSConfig{ServerName: "proxy.test"}
+
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	c := &http.Client{
+		Transport: &http.Transport{
+			Proxy:       http.ProxyURL(&url.URL{Scheme: "http", Host: "in-memory"}),
+			DialContext: p.DialContext,
+		},
+	}
+	defer c.CloseIdleConnections()
+	get := func(path string) int {
+		t.Helper()
+		res, err := c.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := get("/proxy"); code != http.StatusBadGateway {
+		t.Fatalf("expected status %d, got %d", http.StatusBadGateway, code)
+	}
+	if code := get("/direct"); code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// UpstreamProxyRule routes requests to hosts matching the domain via the proxy.
+type UpstreamProxyRule struct {
+	Domain *regexp.Regexp
+	// Proxy is the upstream proxy, nil means DIRECT.
+	Proxy *url.URL
+}
+
+// ParseUpstreamProxyRule parses a <pattern>=<proxy> string into UpstreamProxyRule.
+// The pattern is a regexp, or a wildcard *.<domain> that matches the domain and all its subdomains.
+// The proxy has the same format as ParseProxyURL, or is DIRECT to connect directly.
+func ParseUpstreamProxyRule(val string) (*UpstreamProxyRule, error) {
+	pattern, proxy, ok := strings.Cut(val, "=")
+	if !ok || pattern == "" || proxy == "" {
+		return nil, errors.New("expected <pattern>=<proxy> or <pattern>=DIRECT")
+	}
+
+	re, err := compileDomainPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &UpstreamProxyRule{Domain: re}
+	if proxy != "DIRECT" {
+		if r.Proxy, err = ParseProxyURL(proxy); err != nil {
+			return nil, err
+		}
+		if err := validateProxyURL(r.Proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// compileDomainPattern compiles a regexp, or a wildcard *.<domain> to a regexp matching the domain and its subdomains.
+func compileDomainPattern(pattern string) (*regexp.Regexp, error) {
+	if d, ok := strings.CutPrefix(pattern, "*."); ok {
+		if d == "" || strings.Contains(d, "*") {
+			return nil, fmt.Errorf("invalid wildcard %q", pattern)
+		}
+		return regexp.Compile(`(^|\.)` + regexp.QuoteMeta(d) + `$`)
+	}
+	return regexp.Compile(pattern)
+}
+
+// upstreamProxyRules routes requests according to the first matching rule,
+// requests not matching any rule are routed with fn.
+func (hp *HTTPProxy) upstreamProxyRules(fn ProxyFunc) ProxyFunc {
+	if fn == nil || len(hp.config.UpstreamProxyRules) == 0 {
+		return fn
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		h := req.URL.Hostname()
+		for _, r := range hp.config.UpstreamProxyRules {
+			if !r.Domain.MatchString(h) {
+				continue
+			}
+			if r.Proxy == nil {
+				return nil, nil
+			}
+			return proxyURLWithCredentials(r.Proxy, hp.runtime.Load().Credentials), nil
+		}
+		return fn(req)
+	}
+}
+
+// RedactUpstreamProxyRule returns the rule in the <pattern>=<proxy> format with the proxy password redacted.
+func RedactUpstreamProxyRule(r *UpstreamProxyRule) string {
+	if r == nil {
+		return ""
+	}
+	return r.Domain.String() + "=" + proxyString(r.Proxy)
+}
@@ -0,0 +1,442 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/saucelabs/forwarder/log"
+)
+
+const (
+	xdsClusterType = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	xdsRouteType   = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+)
+
+// XDSConfig specifies an xDS management server providing upstream proxies.
+type XDSConfig struct {
+	// Server is the management server URL, the REST-JSON transport is used.
+	Server *url.URL
+
+	// NodeID and NodeCluster identify this instance to the management server.
+	NodeID      string
+	NodeCluster string
+
+	// RouteConfigName is the name of the RouteConfiguration resource to use.
+	RouteConfigName string
+
+	// RefreshInterval is the time between discovery requests.
+	RefreshInterval time.Duration
+}
+
+func DefaultXDSConfig() *XDSConfig {
+	return &XDSConfig{
+		NodeCluster:     "forwarder",
+		RefreshInterval: 30 * time.Second,
+	}
+}
+
+func (c *XDSConfig) Validate() error {
+	if c.Server == nil {
+		return fmt.Errorf("server is required")
+	}
+	if c.Server.Scheme != "http" && c.Server.Scheme != "https" {
+		return fmt.Errorf("unsupported server scheme %q, supported schemes are: http, https", c.Server.Scheme)
+	}
+	if c.NodeID == "" {
+		return fmt.Errorf("node id is required")
+	}
+	if c.RouteConfigName == "" {
+		return fmt.Errorf("route config name is required")
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh interval must be positive")
+	}
+	return nil
+}
+
+// XDSDiscovery consumes a subset of CDS and RDS from an xDS management server.
+// Clusters are mapped to upstream proxy pools, the endpoints must be specified inline in the cluster load assignment.
+// Clusters with a transport socket use https, other clusters use http.
+// Virtual hosts of the route configuration select the cluster by request host,
+// only the first route with a cluster action is used, path matching is not supported.
+// Requests to hosts that do not match any virtual host are sent directly.
+//
+// This is experimental, the supported subset may change.
+type XDSDiscovery struct {
+	config XDSConfig
+	log    log.Logger
+	client *http.Client
+
+	mu       sync.RWMutex
+	clusters map[string]*UpstreamPool
+	routes   *xdsRouteTable
+}
+
+func NewXDSDiscovery(cfg *XDSConfig, log log.Logger) (*XDSDiscovery, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // it's *http.Transport
+	tr.Proxy = nil
+
+	return &XDSDiscovery{
+		config:   *cfg,
+		log:      log,
+		client:   &http.Client{Transport: tr},
+		clusters: make(map[string]*UpstreamPool),
+		routes:   new(xdsRouteTable),
+	}, nil
+}
+
+type xdsNode struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+}
+
+type xdsDiscoveryRequest struct {
+	Node          xdsNode  `json:"node"`
+	ResourceNames []string `json:"resource_names,omitempty"`
+	TypeURL       string   `json:"type_url"`
+}
+
+type xdsDiscoveryResponse struct {
+	VersionInfo string            `json:"version_info"`
+	Resources   []json.RawMessage `json:"resources"`
+}
+
+type xdsCluster struct {
+	Name            string          `json:"name"`
+	TransportSocket json.RawMessage `json:"transport_socket"`
+	LoadAssignment  *struct {
+		Endpoints []struct {
+			LbEndpoints []struct {
+				HealthStatus string `json:"health_status"`
+				Endpoint     struct {
+					Address struct {
+						SocketAddress struct {
+							Address   string `json:"address"`
+							PortValue uint32 `json:"port_value"`
+						} `json:"socket_address"`
+					} `json:"address"`
+				} `json:"endpoint"`
+			} `json:"lb_endpoints"`
+		} `json:"endpoints"`
+	} `json:"load_assignment"`
+}
+
+type xdsRouteConfiguration struct {
+	Name         string `json:"name"`
+	VirtualHosts []struct {
+		Name    string   `json:"name"`
+		Domains []string `json:"domains"`
+		Routes  []struct {
+			Route *struct {
+				Cluster string `json:"cluster"`
+			} `json:"route"`
+		} `json:"routes"`
+	} `json:"virtual_hosts"`
+}
+
+func (d *XDSDiscovery) fetch(ctx context.Context, endpoint, typeURL string, names []string) ([]json.RawMessage, error) {
+	b, err := json.Marshal(xdsDiscoveryRequest{
+		Node:          xdsNode{ID: d.config.NodeID, Cluster: d.config.NodeCluster},
+		ResourceNames: names,
+		TypeURL:       typeURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.config.Server.JoinPath(endpoint).String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", endpoint, res.Status)
+	}
+
+	var dr xdsDiscoveryResponse
+	if err := json.NewDecoder(res.Body).Decode(&dr); err != nil {
+		return nil, fmt.Errorf("%s: decode response: %w", endpoint, err)
+	}
+
+	resources := make([]json.RawMessage, len(dr.Resources))
+	for i, r := range dr.Resources {
+		// Management servers may use the default proto3 JSON mapping with lowerCamelCase names.
+		if resources[i], err = xdsSnakeCaseKeys(r); err != nil {
+			return nil, fmt.Errorf("%s: decode resource: %w", endpoint, err)
+		}
+	}
+
+	return resources, nil
+}
+
+// Refresh fetches clusters and routes and updates the routing state.
+func (d *XDSDiscovery) Refresh(ctx context.Context) error {
+	cr, err := d.fetch(ctx, "/v3/discovery:clusters", xdsClusterType, nil)
+	if err != nil {
+		return err
+	}
+	rr, err := d.fetch(ctx, "/v3/discovery:routes", xdsRouteType, []string{d.config.RouteConfigName})
+	if err != nil {
+		return err
+	}
+
+	members := make(map[string][]*url.URL, len(cr))
+	for _, r := range cr {
+		var c xdsCluster
+		if err := json.Unmarshal(r, &c); err != nil {
+			return fmt.Errorf("decode cluster: %w", err)
+		}
+		members[c.Name] = d.clusterMembers(&c)
+	}
+
+	var routes *xdsRouteTable
+	for _, r := range rr {
+		var rc xdsRouteConfiguration
+		if err := json.Unmarshal(r, &rc); err != nil {
+			return fmt.Errorf("decode route configuration: %w", err)
+		}
+		if rc.Name == d.config.RouteConfigName {
+			routes = newXDSRouteTable(&rc)
+		}
+	}
+	if routes == nil {
+		return fmt.Errorf("route configuration %q not found", d.config.RouteConfigName)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	clusters := make(map[string]*UpstreamPool, len(members))
+	for name, m := range members {
+		p, ok := d.clusters[name]
+		if !ok {
+			p = new(UpstreamPool)
+		}
+		if p.Update(m) {
+			d.log.Infof("cluster %s upstream proxies updated %s", name, redactURLs(m))
+		}
+		clusters[name] = p
+	}
+	d.clusters = clusters
+	d.routes = routes
+
+	return nil
+}
+
+func (d *XDSDiscovery) clusterMembers(c *xdsCluster) []*url.URL {
+	if c.LoadAssignment == nil {
+		d.log.Infof("cluster %s has no inline load assignment, skipping", c.Name)
+		return nil
+	}
+
+	scheme := "http"
+	if len(c.TransportSocket) > 0 && string(c.TransportSocket) != "null" {
+		scheme = "https"
+	}
+
+	var members []*url.URL
+	for _, e := range c.LoadAssignment.Endpoints {
+		for _, lb := range e.LbEndpoints {
+			switch lb.HealthStatus {
+			case "UNHEALTHY", "DRAINING", "TIMEOUT":
+				continue
+			}
+			sa := lb.Endpoint.Address.SocketAddress
+			if sa.Address == "" || sa.PortValue == 0 {
+				continue
+			}
+			members = append(members, &url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(sa.Address, strconv.FormatUint(uint64(sa.PortValue), 10)),
+			})
+		}
+	}
+
+	return members
+}
+
+// ProxyFunc returns a ProxyFunc that routes requests to clusters.
+func (d *XDSDiscovery) ProxyFunc() ProxyFunc {
+	return func(req *http.Request) (*url.URL, error) {
+		d.mu.RLock()
+		cluster, ok := d.routes.match(req.URL.Hostname())
+		p := d.clusters[cluster]
+		d.mu.RUnlock()
+
+		if !ok {
+			return nil, nil
+		}
+		if p == nil {
+			return nil, ErrNoUpstreamProxy
+		}
+		return p.ProxyFunc()(req)
+	}
+}
+
+// Run refreshes the routing state every refresh interval until the context is canceled.
+func (d *XDSDiscovery) Run(ctx context.Context) error {
+	t := time.NewTicker(d.config.RefreshInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := d.Refresh(ctx); err != nil {
+				d.log.Errorf("failed to refresh xDS configuration, keeping previous: %s", err)
+			}
+		}
+	}
+}
+
+type xdsDomain struct {
+	pattern string
+	cluster string
+}
+
+// xdsRouteTable implements Envoy virtual host domain matching:
+// exact match, then the longest suffix wildcard, then the longest prefix wildcard, then the default "*".
+type xdsRouteTable struct {
+	exact  map[string]string
+	suffix []xdsDomain
+	prefix []xdsDomain
+	any    string
+}
+
+func newXDSRouteTable(rc *xdsRouteConfiguration) *xdsRouteTable {
+	t := &xdsRouteTable{
+		exact: make(map[string]string),
+	}
+
+	for _, vh := range rc.VirtualHosts {
+		var cluster string
+		for _, r := range vh.Routes {
+			if r.Route != nil && r.Route.Cluster != "" {
+				cluster = r.Route.Cluster
+				break
+			}
+		}
+		if cluster == "" {
+			continue
+		}
+
+		for _, d := range vh.Domains {
+			d = strings.ToLower(d)
+			switch {
+			case d == "*":
+				t.any = cluster
+			case strings.HasPrefix(d, "*"):
+				t.suffix = append(t.suffix, xdsDomain{d[1:], cluster})
+			case strings.HasSuffix(d, "*"):
+				t.prefix = append(t.prefix, xdsDomain{d[:len(d)-1], cluster})
+			default:
+				t.exact[d] = cluster
+			}
+		}
+	}
+
+	byLen := func(s []xdsDomain) {
+		sort.SliceStable(s, func(i, j int) bool {
+			return len(s[i].pattern) > len(s[j].pattern)
+		})
+	}
+	byLen(t.suffix)
+	byLen(t.prefix)
+
+	return t
+}
+
+func (t *xdsRouteTable) match(host string) (string, bool) {
+	host = strings.ToLower(host)
+
+	if c, ok := t.exact[host]; ok {
+		return c, true
+	}
+	for _, d := range t.suffix {
+		if len(host) > len(d.pattern) && strings.HasSuffix(host, d.pattern) {
+			return d.cluster, true
+		}
+	}
+	for _, d := range t.prefix {
+		if len(host) > len(d.pattern) && strings.HasPrefix(host, d.pattern) {
+			return d.cluster, true
+		}
+	}
+	if t.any != "" {
+		return t.any, true
+	}
+
+	return "", false
+}
+
+// xdsSnakeCaseKeys converts lowerCamelCase object keys to snake_case recursively.
+func xdsSnakeCaseKeys(r json.RawMessage) (json.RawMessage, error) {
+	var v any
+	if err := json.Unmarshal(r, &v); err != nil {
+		return nil, err
+	}
+
+	var conv func(v any) any
+	conv = func(v any) any {
+		switch x := v.(type) {
+		case map[string]any:
+			m := make(map[string]any, len(x))
+			for k, e := range x {
+				m[snakeCase(k)] = conv(e)
+			}
+			return m
+		case []any:
+			for i := range x {
+				x[i] = conv(x[i])
+			}
+			return x
+		default:
+			return v
+		}
+	}
+
+	return json.Marshal(conv(v))
+}
+
+func snakeCase(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
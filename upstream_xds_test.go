@@ -0,0 +1,123 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+const testXDSClusters = `{
+  "version_info": "1",
+  "resources": [
+    {
+      "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+      "name": "eu",
+      "loadAssignment": {
+        "clusterName": "eu",
+        "endpoints": [{"lbEndpoints": [
+          {"endpoint": {"address": {"socketAddress": {"address": "10.0.0.1", "portValue": 3128}}}},
+          {"endpoint": {"address": {"socketAddress": {"address": "10.0.0.2", "portValue": 3128}}}, "healthStatus": "DRAINING"}
+        ]}]
+      }
+    },
+    {
+      "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+      "name": "us",
+      "transport_socket": {"name": "envoy.transport_sockets.tls"},
+      "load_assignment": {
+        "endpoints": [{"lb_endpoints": [
+          {"endpoint": {"address": {"socket_address": {"address": "10.1.0.1", "port_value": 3129}}}}
+        ]}]
+      }
+    }
+  ]
+}`
+
+const testXDSRoutes = `{
+  "version_info": "1",
+  "resources": [
+    {
+      "@type": "type.googleapis.com/envoy.config.route.v3.RouteConfiguration",
+      "name": "egress",
+      "virtualHosts": [
+        {"name": "eu", "domains": ["example.eu", "*.example.eu"], "routes": [{"match": {"prefix": "/"}, "route": {"cluster": "eu"}}]},
+        {"name": "us", "domains": ["*.example.com", "api.*"], "routes": [{"match": {"prefix": "/"}, "route": {"cluster": "us"}}]}
+      ]
+    }
+  ]
+}`
+
+func TestXDSDiscovery(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req xdsDiscoveryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %s", err)
+		}
+		if req.Node.ID != "node-1" {
+			t.Errorf("expected node id node-1, got %s", req.Node.ID)
+		}
+
+		switch r.URL.Path {
+		case "/v3/discovery:clusters":
+			w.Write([]byte(testXDSClusters))
+		case "/v3/discovery:routes":
+			w.Write([]byte(testXDSRoutes))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer s.Close()
+
+	cfg := DefaultXDSConfig()
+	cfg.Server, _ = url.Parse(s.URL)
+	cfg.NodeID = "node-1"
+	cfg.RouteConfigName = "egress"
+
+	d, err := NewXDSDiscovery(cfg, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "example.eu", expected: "http://10.0.0.1:3128"},
+		{host: "www.example.eu", expected: "http://10.0.0.1:3128"},
+		{host: "www.example.com", expected: "https://10.1.0.1:3129"},
+		{host: "api.example.org", expected: "https://10.1.0.1:3129"},
+		{host: "example.org", expected: ""},
+	}
+
+	pf := d.ProxyFunc()
+	for i := range tests {
+		tc := tests[i]
+		t.Run(tc.host, func(t *testing.T) {
+			u, err := pf(&http.Request{URL: &url.URL{Scheme: "https", Host: tc.host + ":443"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if u != nil {
+				got = u.String()
+			}
+			if got != tc.expected {
+				t.Fatalf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
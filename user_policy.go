@@ -0,0 +1,532 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/proxyutil"
+	"github.com/saucelabs/forwarder/middleware"
+	"github.com/saucelabs/forwarder/ratelimit"
+	"github.com/saucelabs/forwarder/ruleset"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+// UserPolicy overlays proxy settings for requests of an authenticated user or group.
+// Unset fields fall back to the next matching policy, and then to the proxy configuration.
+type UserPolicy struct {
+	// DenyDomains denies requests to the matching hosts in addition to the proxy deny domains.
+	DenyDomains *ruleset.RegexpMatcher
+
+	// AllowDomains denies requests to hosts not matching, in addition to the proxy deny domains.
+	AllowDomains *ruleset.RegexpMatcher
+
+	// DirectDomains sends requests to the matching hosts directly in addition to the proxy direct domains.
+	DirectDomains *ruleset.RegexpMatcher
+
+	// UpstreamProxy replaces the upstream proxy.
+	UpstreamProxy *url.URL
+
+	// RateLimit is the maximum number of requests per second of a user, zero means no limit.
+	RateLimit float64
+
+	// Bandwidth is the bandwidth limit in bytes per second of a user, zero means no limit.
+	// The limit applies to each direction, and is shared by all requests and tunnels of the user.
+	Bandwidth SizeSuffix
+}
+
+func (p *UserPolicy) overlay(o *UserPolicy) {
+	if p.DenyDomains == nil {
+		p.DenyDomains = o.DenyDomains
+	}
+	if p.AllowDomains == nil {
+		p.AllowDomains = o.AllowDomains
+	}
+	if p.DirectDomains == nil {
+		p.DirectDomains = o.DirectDomains
+	}
+	if p.UpstreamProxy == nil {
+		p.UpstreamProxy = o.UpstreamProxy
+	}
+	if p.RateLimit == 0 {
+		p.RateLimit = o.RateLimit
+	}
+	if p.Bandwidth == 0 {
+		p.Bandwidth = o.Bandwidth
+	}
+}
+
+// UserPolicies maps users and groups to policies.
+type UserPolicies struct {
+	Users  map[string]*UserPolicy
+	Groups map[string]*UserPolicy
+}
+
+// Resolve returns the effective policy for the user that belongs to the groups, or nil if no policy matches.
+// The user policy takes precedence over group policies, group policies are applied in the order of groups.
+func (p *UserPolicies) Resolve(user string, groups []string) *UserPolicy {
+	var (
+		res   UserPolicy
+		found bool
+	)
+	if up, ok := p.Users[user]; ok {
+		res.overlay(up)
+		found = true
+	}
+	for _, g := range groups {
+		if gp, ok := p.Groups[g]; ok {
+			res.overlay(gp)
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &res
+}
+
+// Supported user policy keys.
+const (
+	UserPolicyDenyDomains   = "deny-domains"
+	UserPolicyAllowDomains  = "allow-domains"
+	UserPolicyDirectDomains = "direct-domains"
+	UserPolicyUpstreamProxy = "proxy"
+	UserPolicyRateLimit     = "rate-limit"
+	UserPolicyBandwidth     = "bandwidth"
+)
+
+func isUserPolicyKey(key string) bool {
+	switch key {
+	case UserPolicyDenyDomains, UserPolicyAllowDomains, UserPolicyDirectDomains,
+		UserPolicyUpstreamProxy, UserPolicyRateLimit, UserPolicyBandwidth:
+		return true
+	default:
+		return false
+	}
+}
+
+// UserPolicyItem sets a single user policy key.
+type UserPolicyItem struct {
+	Name  string
+	Group bool
+	Key   string
+	Value string
+}
+
+// ParseUserPolicyItem parses a [@]<name>:<key>=<value> string into UserPolicyItem.
+// The @ prefix denotes a group.
+func ParseUserPolicyItem(val string) (UserPolicyItem, error) {
+	var item UserPolicyItem
+
+	name, kv, ok := strings.Cut(val, ":")
+	if !ok {
+		return item, errors.New("expected [@]<name>:<key>=<value>")
+	}
+	if strings.HasPrefix(name, "@") {
+		item.Group = true
+		name = name[1:]
+	}
+	if name == "" {
+		return item, errors.New("name cannot be empty")
+	}
+	item.Name = name
+
+	item.Key, item.Value, ok = strings.Cut(kv, "=")
+	if !ok {
+		return item, errors.New("expected [@]<name>:<key>=<value>")
+	}
+	if !isUserPolicyKey(item.Key) {
+		return item, fmt.Errorf("unsupported key %q", item.Key)
+	}
+
+	return item, nil
+}
+
+// NewUserPolicies builds policies from items.
+// Domain values are [-]<regexp> items in the --deny-domains flag format, items for the same policy are merged.
+// Domain rules are checked against the limits, if not nil.
+func NewUserPolicies(items []UserPolicyItem, limits *ruleset.RegexpLimits) (*UserPolicies, error) {
+	users := make(map[string]*policyBuilder)
+	groups := make(map[string]*policyBuilder)
+
+	for _, item := range items {
+		m := users
+		if item.Group {
+			m = groups
+		}
+		b, ok := m[item.Name]
+		if !ok {
+			b = new(policyBuilder)
+			m[item.Name] = b
+		}
+		if err := b.set(item.Key, item.Value); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", item.Name, item.Key, err)
+		}
+	}
+
+	p := &UserPolicies{
+		Users:  make(map[string]*UserPolicy, len(users)),
+		Groups: make(map[string]*UserPolicy, len(groups)),
+	}
+	for name, b := range users {
+		up, err := b.build(limits)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		p.Users[name] = up
+	}
+	for name, b := range groups {
+		up, err := b.build(limits)
+		if err != nil {
+			return nil, fmt.Errorf("@%s: %w", name, err)
+		}
+		p.Groups[name] = up
+	}
+
+	return p, nil
+}
+
+// policyBuilder accumulates key value pairs of a single policy.
+type policyBuilder struct {
+	p                   UserPolicy
+	deny, allow, direct []ruleset.RegexpListItem
+}
+
+func (b *policyBuilder) set(key, value string) error {
+	var err error
+	switch key {
+	case UserPolicyDenyDomains:
+		b.deny, err = appendRegexpListItem(b.deny, value)
+	case UserPolicyAllowDomains:
+		b.allow, err = appendRegexpListItem(b.allow, value)
+	case UserPolicyDirectDomains:
+		b.direct, err = appendRegexpListItem(b.direct, value)
+	case UserPolicyUpstreamProxy:
+		b.p.UpstreamProxy, err = ParseProxyURL(value)
+	case UserPolicyRateLimit:
+		b.p.RateLimit, err = strconv.ParseFloat(value, 64)
+		if err == nil && (b.p.RateLimit < 0 || math.IsInf(b.p.RateLimit, 0) || math.IsNaN(b.p.RateLimit)) {
+			err = errors.New("must be a non-negative number")
+		}
+	case UserPolicyBandwidth:
+		err = b.p.Bandwidth.Set(value)
+		if err == nil && b.p.Bandwidth < 0 {
+			err = errors.New("must be a non-negative number")
+		}
+	default:
+		err = errors.New("unsupported key")
+	}
+	return err
+}
+
+func (b *policyBuilder) build(limits *ruleset.RegexpLimits) (*UserPolicy, error) {
+	p := b.p
+	var err error
+	if len(b.deny) > 0 {
+		if p.DenyDomains, err = limits.NewRegexpMatcherFromList(b.deny); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.allow) > 0 {
+		if p.AllowDomains, err = limits.NewRegexpMatcherFromList(b.allow); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.direct) > 0 {
+		if p.DirectDomains, err = limits.NewRegexpMatcherFromList(b.direct); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+func appendRegexpListItem(l []ruleset.RegexpListItem, v string) ([]ruleset.RegexpListItem, error) {
+	item, err := ruleset.ParseRegexpListItem(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(l, item), nil
+}
+
+// ErrProxyDeniedByUserPolicy is returned when a request is denied by the deny domains of the user policy.
+var ErrProxyDeniedByUserPolicy = denyError{errors.New("proxying denied by user policy"), "user-policy"}
+
+func (hp *HTTPProxy) hasPolicies() bool {
+	return hp.config.UserPolicies != nil || len(hp.config.SNIRoutes) > 0
+}
+
+// userPolicy returns the policy for the request, or nil.
+// The policy of the authenticated user and groups takes precedence over the policy of the SNI route.
+func (hp *HTTPProxy) userPolicy(req *http.Request) *UserPolicy {
+	var up *UserPolicy
+	if hp.config.UserPolicies != nil {
+		if user := middleware.User(req); user != "" {
+			up = hp.config.UserPolicies.Resolve(user, middleware.Groups(req))
+		}
+	}
+	if len(hp.config.SNIRoutes) > 0 {
+		if r := hp.sniRoute(hp.listenerServerName(req)); r != nil && r.Policy != nil {
+			if up == nil {
+				up = new(UserPolicy)
+			}
+			up.overlay(r.Policy)
+		}
+	}
+	return up
+}
+
+// deniedDomain returns true if the host is denied by the deny or allow domains of the policy.
+func (p *UserPolicy) deniedDomain(host string) bool {
+	if p == nil {
+		return false
+	}
+	if p.DenyDomains != nil && p.DenyDomains.Match(host) {
+		return true
+	}
+	return p.AllowDomains != nil && !p.AllowDomains.Match(host)
+}
+
+func (hp *HTTPProxy) denyUserPolicyDomains() martian.RequestModifier {
+	return hp.abortIf(func(req *http.Request) bool {
+		return hp.userPolicy(req).deniedDomain(req.URL.Hostname())
+	}, func(req *http.Request) *http.Response {
+		return hp.errorResponse(req, ErrProxyDeniedByUserPolicy)
+	}, errors.New("domain access denied by user policy"))
+}
+
+// userRateLimiter limits requests per second of every user.
+type userRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+func (l *userRateLimiter) allow(user string, limit float64) bool {
+	l.mu.Lock()
+	lim, ok := l.limiters[user]
+	if !ok || float64(lim.Limit()) != limit {
+		lim = rate.NewLimiter(rate.Limit(limit), int(math.Max(1, math.Ceil(limit))))
+		if l.limiters == nil {
+			l.limiters = make(map[string]*rate.Limiter)
+		}
+		l.limiters[user] = lim
+	}
+	l.mu.Unlock()
+
+	return lim.Allow()
+}
+
+// userPolicyKey returns the key of the limits of the user policy of the request.
+func (hp *HTTPProxy) userPolicyKey(req *http.Request) string {
+	key := middleware.User(req)
+	if key == "" {
+		// Not authenticated, the policy comes from the SNI route.
+		key = "@sni/" + hp.listenerServerName(req)
+	}
+	return key
+}
+
+func (hp *HTTPProxy) userRateLimit() martian.RequestModifier {
+	return hp.abortIf(func(req *http.Request) bool {
+		up := hp.userPolicy(req)
+		if up == nil || up.RateLimit == 0 {
+			return false
+		}
+		return !hp.rateLimiter.allow(hp.userPolicyKey(req), up.RateLimit)
+	}, func(req *http.Request) *http.Response {
+		return proxyutil.NewResponse(http.StatusTooManyRequests, http.NoBody, req)
+	}, errors.New("user rate limit exceeded"))
+}
+
+// userPolicyProxy applies the direct domains and upstream proxy of the user policy.
+func (hp *HTTPProxy) userPolicyProxy(fn ProxyFunc) ProxyFunc {
+	if fn == nil || !hp.hasPolicies() {
+		return fn
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		up := hp.userPolicy(req)
+		if up == nil {
+			return fn(req)
+		}
+		if up.DirectDomains != nil && up.DirectDomains.Match(req.URL.Hostname()) {
+			return nil, nil
+		}
+		if up.UpstreamProxy != nil {
+			proxyURL := new(url.URL)
+			*proxyURL = *up.UpstreamProxy
+			if proxyURL.User == nil {
+				if u := hp.runtime.Load().Credentials.MatchURLScope(proxyURL, ProxyCredentialsScope); u != nil {
+					proxyURL.User = u
+				}
+			}
+			return proxyURL, nil
+		}
+		return fn(req)
+	}
+}
+
+// userBandwidthLimiter throttles request and response bodies of users with a bandwidth limit.
+// CONNECT tunnels are limited in configureUserBandwidthLimits.
+type userBandwidthLimiter struct {
+	hp *HTTPProxy
+}
+
+func (u userBandwidthLimiter) limiters(req *http.Request) (rx, tx *rate.Limiter) {
+	up := u.hp.userPolicy(req)
+	if up == nil || up.Bandwidth == 0 {
+		return nil, nil
+	}
+	return u.hp.userLimiter.Limiters(u.hp.userPolicyKey(req), int64(up.Bandwidth))
+}
+
+func (u userBandwidthLimiter) ModifyRequest(req *http.Request) error {
+	if req.Method == http.MethodConnect || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	if _, tx := u.limiters(req); tx != nil {
+		req.Body = ratelimit.NewReadCloser(req.Body, tx)
+	}
+	return nil
+}
+
+func (u userBandwidthLimiter) ModifyResponse(res *http.Response) error {
+	if res.Request.Method == http.MethodConnect || res.Body == nil || res.Body == http.NoBody {
+		return nil
+	}
+	// Upgraded connections need the body to be io.ReadWriteCloser.
+	if _, ok := res.Body.(io.ReadWriteCloser); ok {
+		return nil
+	}
+	if rx, _ := u.limiters(res.Request); rx != nil {
+		res.Body = ratelimit.NewReadCloser(res.Body, rx)
+	}
+	return nil
+}
+
+// configureUserBandwidthLimits limits CONNECT tunnels of users with a bandwidth limit.
+func (hp *HTTPProxy) configureUserBandwidthLimits() {
+	nextConnect := hp.proxy.ConnectFunc
+	hp.proxy.ConnectFunc = func(connect func(*http.Request) (*http.Response, net.Conn, error), req *http.Request) (*http.Response, net.Conn, error) {
+		var (
+			res  *http.Response
+			conn net.Conn
+			err  error
+		)
+		if nextConnect != nil {
+			res, conn, err = nextConnect(connect, req)
+		} else {
+			res, conn, err = connect(req)
+		}
+		if conn != nil {
+			if up := hp.userPolicy(req); up != nil && up.Bandwidth > 0 {
+				conn = hp.userLimiter.Conn(hp.userPolicyKey(req), int64(up.Bandwidth), conn)
+			}
+		}
+		return res, conn, err
+	}
+}
+
+// userPolicyFile is the YAML user policy file format.
+// The values are the user policy keys, domain keys accept a list of values.
+type userPolicyFile struct {
+	Users  map[string]map[string]yamlStringList `yaml:"users"`
+	Groups map[string]map[string]yamlStringList `yaml:"groups"`
+}
+
+// yamlStringList unmarshals a scalar or a sequence of scalars.
+type yamlStringList []string
+
+func (l *yamlStringList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = []string{n.Value}
+		return nil
+	}
+	var v []string
+	if err := n.Decode(&v); err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// ParseUserPolicyFile parses a YAML user policy file into items, the items can be passed to NewUserPolicies.
+// Example:
+//
+//	users:
+//	  alice:
+//	    allow-domains: ['\.example\.com$']
+//	    bandwidth: 1Mi
+//	groups:
+//	  ci:
+//	    deny-domains: ['^ads\.', '^tracker\.']
+//	    rate-limit: 10
+func ParseUserPolicyFile(b []byte) ([]UserPolicyItem, error) {
+	var f userPolicyFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var items []UserPolicyItem
+	add := func(m map[string]map[string]yamlStringList, group bool) error {
+		for _, name := range sortedKeys(m) {
+			if name == "" {
+				return errors.New("name cannot be empty")
+			}
+			for _, key := range sortedKeys(m[name]) {
+				if !isUserPolicyKey(key) {
+					return fmt.Errorf("%s: unsupported key %q", name, key)
+				}
+				for _, v := range m[name][key] {
+					items = append(items, UserPolicyItem{Name: name, Group: group, Key: key, Value: v})
+				}
+			}
+		}
+		return nil
+	}
+	if err := add(f.Users, false); err != nil {
+		return nil, err
+	}
+	if err := add(f.Groups, true); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// ReadUserPolicyFile reads and parses a YAML user policy file, see ParseUserPolicyFile.
+func ReadUserPolicyFile(name string) ([]UserPolicyItem, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return ParseUserPolicyFile(b)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -31,6 +31,9 @@ type SelfSignedCert struct {
 	RsaBits      int
 	EcdsaCurve   string
 	Ed25519Key   bool
+
+	// PermittedDNSDomains are the name constraints of a CA certificate.
+	PermittedDNSDomains []string
 }
 
 func RSASelfSignedCert() *SelfSignedCert {
@@ -101,6 +104,8 @@ func (c *SelfSignedCert) Gen() (tls.Certificate, error) {
 	if c.IsCA {
 		template.IsCA = true
 		template.KeyUsage |= x509.KeyUsageCertSign
+		template.PermittedDNSDomains = c.PermittedDNSDomains
+		template.PermittedDNSDomainsCritical = len(c.PermittedDNSDomains) > 0
 	}
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
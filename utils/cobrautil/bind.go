@@ -18,6 +18,12 @@ import (
 
 var envReplacer = strings.NewReplacer(".", "_", "-", "_") //nolint:gochecknoglobals // false positive
 
+const (
+	envPrefixAnnotation      = "cobrautil_env_prefix"
+	configFileFlagAnnotation = "cobrautil_config_file_flag"
+	viperAnnotation          = "cobrautil_viper"
+)
+
 // BindAll updates the given command flags with values from the environment variables and config file.
 // The supported formats are: JSON, YAML, TOML, HCL, and Java properties.
 // The file format is determined by the file extension, if not specified the default format is YAML.
@@ -34,64 +40,122 @@ func BindAll(cmd *cobra.Command, envPrefix, configFileFlagName string) error {
 	}
 
 	// Environment variables
-	v.SetEnvKeyReplacer(envReplacer)
-	envPrefix = strings.ToUpper(envPrefix)
-	envPrefix = envReplacer.Replace(envPrefix)
-	v.SetEnvPrefix(envPrefix)
-	v.AutomaticEnv()
+	setEnvPrefix(v, envPrefix)
 
 	// Config file
 	if configFileFlagName != "" {
-		if f := v.GetString(configFileFlagName); f != "" {
-			v.SetConfigFile(f)
-			if err := v.ReadInConfig(); err != nil {
-				return err
-			}
+		if err := readConfigFile(v, v.GetString(configFileFlagName)); err != nil {
+			return err
 		}
 	}
 
+	if cmd.Annotations == nil {
+		cmd.Annotations = make(map[string]string)
+	}
+	cmd.Annotations[envPrefixAnnotation] = envPrefix
+	cmd.Annotations[configFileFlagAnnotation] = configFileFlagName
+
 	return BindFromViper(cmd, v)
 }
 
-// BindFromViper updates the given command flags with values from preconditioned Viper instance.
-func BindFromViper(cmd *cobra.Command, v *viper.Viper) error {
-	// Update cobra flags with values from viper
-	updateFs := func(fs *pflag.FlagSet) (ok bool) {
-		ok = true
-		fs.VisitAll(func(f *pflag.Flag) {
-			if !f.Changed && v.IsSet(f.Name) {
-				value := v.Get(f.Name)
-				if err := setFlagFromViper(f, value); err != nil {
-					var flagName string
-					if f.Shorthand != "" && f.ShorthandDeprecated == "" {
-						flagName = fmt.Sprintf("-%s, --%s", f.Shorthand, f.Name)
-					} else {
-						flagName = fmt.Sprintf("--%s", f.Name)
-					}
-					fmt.Fprintf(cmd.ErrOrStderr(), "invalid argument %q for %q flag: %v", value, flagName, err)
-					ok = false
-				} else {
-					if f.Deprecated != "" {
-						fmt.Fprintf(cmd.ErrOrStderr(), "Flag --%s has been deprecated, %s\n", f.Name, f.Deprecated)
-					}
-					f.Changed = true
-				}
+// ReloadFlags updates flags in fs with values from the environment variables and config file
+// that were used by BindAll to update cmd, the config file is read again.
+// The flags in fs shall be bound to default values, and have the same names as the corresponding cmd flags.
+// Flags that were set in cmd from the command line are not updated, see FromCommandLine.
+func ReloadFlags(cmd *cobra.Command, fs *pflag.FlagSet) error {
+	v := viper.New()
+	setEnvPrefix(v, cmd.Annotations[envPrefixAnnotation])
+
+	if name := cmd.Annotations[configFileFlagAnnotation]; name != "" {
+		if f := cmd.Flag(name); f != nil {
+			if err := readConfigFile(v, f.Value.String()); err != nil {
+				return err
 			}
-		})
-		return
+		}
 	}
 
-	if !updateFs(cmd.PersistentFlags()) {
+	fs.VisitAll(func(f *pflag.Flag) {
+		if FromCommandLine(cmd.Flag(f.Name)) {
+			f.Changed = true
+		}
+	})
+
+	if !updateFlagSet(cmd, fs, v) {
+		return fmt.Errorf("failed to update flags")
+	}
+
+	return nil
+}
+
+// FromCommandLine returns true if the flag was set from the command line,
+// and not from the environment variables or config file.
+func FromCommandLine(f *pflag.Flag) bool {
+	if f == nil || !f.Changed {
+		return false
+	}
+	_, ok := f.Annotations[viperAnnotation]
+	return !ok
+}
+
+func setEnvPrefix(v *viper.Viper, envPrefix string) {
+	v.SetEnvKeyReplacer(envReplacer)
+	envPrefix = strings.ToUpper(envPrefix)
+	envPrefix = envReplacer.Replace(envPrefix)
+	v.SetEnvPrefix(envPrefix)
+	v.AutomaticEnv()
+}
+
+func readConfigFile(v *viper.Viper, f string) error {
+	if f == "" {
+		return nil
+	}
+	v.SetConfigFile(f)
+	return v.ReadInConfig()
+}
+
+// BindFromViper updates the given command flags with values from preconditioned Viper instance.
+func BindFromViper(cmd *cobra.Command, v *viper.Viper) error {
+	if !updateFlagSet(cmd, cmd.PersistentFlags(), v) {
 		return fmt.Errorf("failed to update persistent flags")
 	}
 
-	if !updateFs(cmd.Flags()) {
+	if !updateFlagSet(cmd, cmd.Flags(), v) {
 		return fmt.Errorf("failed to update flags")
 	}
 
 	return nil
 }
 
+// updateFlagSet updates flags that are not changed with values from viper.
+func updateFlagSet(cmd *cobra.Command, fs *pflag.FlagSet, v *viper.Viper) (ok bool) {
+	ok = true
+	fs.VisitAll(func(f *pflag.Flag) {
+		if !f.Changed && v.IsSet(f.Name) {
+			value := v.Get(f.Name)
+			if err := setFlagFromViper(f, value); err != nil {
+				var flagName string
+				if f.Shorthand != "" && f.ShorthandDeprecated == "" {
+					flagName = fmt.Sprintf("-%s, --%s", f.Shorthand, f.Name)
+				} else {
+					flagName = fmt.Sprintf("--%s", f.Name)
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "invalid argument %q for %q flag: %v", value, flagName, err)
+				ok = false
+			} else {
+				if f.Deprecated != "" {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Flag --%s has been deprecated, %s\n", f.Name, f.Deprecated)
+				}
+				f.Changed = true
+				if f.Annotations == nil {
+					f.Annotations = make(map[string][]string)
+				}
+				f.Annotations[viperAnnotation] = nil
+			}
+		}
+	})
+	return
+}
+
 func setFlagFromViper(f *pflag.Flag, v any) error {
 	if vs, ok := v.([]any); ok {
 		sr, ok := f.Value.(sliceReplacer)
@@ -8,11 +8,14 @@ package cobrautil
 
 import (
 	"net/netip"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/mmatczuk/anyflag"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type testSliceStruct struct {
@@ -64,3 +67,52 @@ func TestBindSlice(t *testing.T) {
 		})
 	}
 }
+
+func TestReloadFlags(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(t *testing.T, s string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(s), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(t, "a: file\nb: file\n")
+
+	cmd := &cobra.Command{}
+	fs := cmd.Flags()
+	var a, b, c string
+	fs.String("config-file", configFile, "")
+	fs.StringVar(&a, "a", "", "")
+	fs.StringVar(&b, "b", "", "")
+	fs.StringVar(&c, "c", "", "")
+	if err := fs.Parse([]string{"--b", "cli"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BindAll(cmd, "TEST", "config-file"); err != nil {
+		t.Fatal(err)
+	}
+	if a != "file" || b != "cli" {
+		t.Fatalf("unexpected values a=%q b=%q", a, b)
+	}
+	if FromCommandLine(fs.Lookup("a")) || !FromCommandLine(fs.Lookup("b")) {
+		t.Fatal("unexpected command line flags")
+	}
+
+	writeConfig(t, "a: reloaded\nb: reloaded\nc: reloaded\n")
+
+	rfs := pflag.NewFlagSet("reload", pflag.ContinueOnError)
+	var ra, rb, rc string
+	rfs.StringVar(&ra, "a", "", "")
+	rfs.StringVar(&rb, "b", "", "")
+	rfs.StringVar(&rc, "c", "", "")
+	if err := ReloadFlags(cmd, rfs); err != nil {
+		t.Fatal(err)
+	}
+	if ra != "reloaded" || rb != "" || rc != "reloaded" {
+		t.Fatalf("unexpected values a=%q b=%q c=%q", ra, rb, rc)
+	}
+	if a != "file" || b != "cli" || c != "" {
+		t.Fatal("command flags changed")
+	}
+}
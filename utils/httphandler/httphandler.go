@@ -14,14 +14,23 @@ import (
 	"runtime"
 )
 
-func SendCACert(ca *x509.Certificate) http.Handler {
-	b := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: ca.Raw,
-	})
+// SendCACert sends the CA certificates PEM encoded in a single file.
+func SendCACert(ca ...*x509.Certificate) http.Handler {
+	var b []byte
+	for _, c := range ca {
+		b = append(b, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: c.Raw,
+		})...)
+	}
 	return SendFile("application/x-x509-ca-cert", b)
 }
 
+// SendCACertDER sends the CA certificate in DER format.
+func SendCACertDER(ca *x509.Certificate) http.Handler {
+	return SendFile("application/x-x509-ca-cert", ca.Raw)
+}
+
 func SendFile(contentType string, content []byte) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", contentType)
@@ -0,0 +1,353 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/saucelabs/forwarder/httplog"
+	"github.com/saucelabs/forwarder/internal/martian"
+	"github.com/saucelabs/forwarder/internal/martian/log"
+	"golang.org/x/net/http/httpguts"
+)
+
+// WebSocket frame opcodes, see RFC 6455 section 5.2.
+const (
+	WebSocketContinuationFrame byte = 0x0
+	WebSocketTextFrame         byte = 0x1
+	WebSocketBinaryFrame       byte = 0x2
+	WebSocketCloseFrame        byte = 0x8
+	WebSocketPingFrame         byte = 0x9
+	WebSocketPongFrame         byte = 0xa
+)
+
+// WebSocketFrame is a WebSocket frame with unmasked payload.
+type WebSocketFrame struct {
+	Fin bool
+	// Rsv holds the RSV1, RSV2 and RSV3 bits in the lowest 3 bits.
+	Rsv     byte
+	Opcode  byte
+	Payload []byte
+}
+
+func (f *WebSocketFrame) opcodeName() string {
+	switch f.Opcode {
+	case WebSocketContinuationFrame:
+		return "continuation"
+	case WebSocketTextFrame:
+		return "text"
+	case WebSocketBinaryFrame:
+		return "binary"
+	case WebSocketCloseFrame:
+		return "close"
+	case WebSocketPingFrame:
+		return "ping"
+	case WebSocketPongFrame:
+		return "pong"
+	default:
+		return fmt.Sprintf("opcode=%#x", f.Opcode)
+	}
+}
+
+func (f *WebSocketFrame) isControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// WebSocketModifier inspects and modifies frames of WebSocket connections proxied as HTTP,
+// i.e. ws:// connections and wss:// connections in MITM mode.
+// Outbound frames are sent by the client, inbound frames are sent by the server.
+//
+// The frame can be modified in place, the modified frame is sent to the peer.
+// Returning an error stops forwarding frames in that direction.
+//
+// Frames with payload larger than 1MiB are forwarded without being passed to modifiers.
+// Compression extensions are removed from upgrade requests, so that payloads are not compressed.
+type WebSocketModifier interface {
+	ModifyWebSocketFrame(req *http.Request, outbound bool, f *WebSocketFrame) error
+}
+
+type WebSocketModifierFunc func(req *http.Request, outbound bool, f *WebSocketFrame) error
+
+func (f WebSocketModifierFunc) ModifyWebSocketFrame(req *http.Request, outbound bool, frame *WebSocketFrame) error {
+	return f(req, outbound, frame)
+}
+
+const (
+	wsMaxInspectedPayload = 1 << 20
+	wsLogPayloadLimit     = 128
+)
+
+func isWebSocketUpgrade(h http.Header) bool {
+	return httpguts.HeaderValuesContainsToken(h["Connection"], "Upgrade") &&
+		strings.EqualFold(h.Get("Upgrade"), "websocket")
+}
+
+// interceptWebSocket reports whether WebSocket frames are passed to modifiers or logged.
+func (hp *HTTPProxy) interceptWebSocket() bool {
+	return len(hp.config.WebSocketModifiers) > 0 || hp.runtime.Load().LogHTTPMode == httplog.WebSocket
+}
+
+// stripWebSocketExtensions removes extensions e.g. permessage-deflate from WebSocket upgrade requests,
+// so that intercepted frames are not compressed.
+func stripWebSocketExtensions() martian.RequestModifier {
+	return martian.RequestModifierFunc(func(req *http.Request) error {
+		if isWebSocketUpgrade(req.Header) {
+			req.Header.Del("Sec-WebSocket-Extensions")
+		}
+		return nil
+	})
+}
+
+// webSocketFilter is the martian.Proxy.UpgradeFilter, it intercepts frames of WebSocket tunnels.
+func (hp *HTTPProxy) webSocketFilter(res *http.Response, outbound, inbound io.Reader) (io.Reader, io.Reader) {
+	if !isWebSocketUpgrade(res.Header) || !hp.interceptWebSocket() {
+		return outbound, inbound
+	}
+
+	req := res.Request
+	logFrames := hp.runtime.Load().LogHTTPMode == httplog.WebSocket
+	reader := func(r io.Reader, outbound bool) io.Reader {
+		fr := newWebSocketFrameReader(r, outbound)
+		fr.process = func(f *WebSocketFrame) error {
+			for _, m := range hp.config.WebSocketModifiers {
+				if err := m.ModifyWebSocketFrame(req, outbound, f); err != nil {
+					return err
+				}
+			}
+			if logFrames {
+				hp.logWebSocketFrame(req, outbound, f, uint64(len(f.Payload)))
+			}
+			return nil
+		}
+		fr.skip = func(f *WebSocketFrame, n uint64) {
+			if logFrames {
+				hp.logWebSocketFrame(req, outbound, f, n)
+			}
+		}
+		return fr
+	}
+
+	return reader(outbound, true), reader(inbound, false)
+}
+
+func (hp *HTTPProxy) logWebSocketFrame(req *http.Request, outbound bool, f *WebSocketFrame, n uint64) {
+	var b strings.Builder
+	if trace := req.Context().Value(log.TraceContextKey); trace != nil {
+		fmt.Fprintf(&b, "[%s] ", trace)
+	}
+	dir := "inbound"
+	if outbound {
+		dir = "outbound"
+	}
+	fmt.Fprintf(&b, "websocket %s %s %s fin=%t len=%d", dir, req.Host, f.opcodeName(), f.Fin, n)
+	if f.Opcode == WebSocketTextFrame && len(f.Payload) > 0 {
+		p := f.Payload
+		if len(p) > wsLogPayloadLimit {
+			p = p[:wsLogPayloadLimit]
+		}
+		fmt.Fprintf(&b, " payload=%q", p)
+	}
+	hp.log.Infof("%s", b.String())
+}
+
+// webSocketFrameReader reads frames from r, and returns the frames processed by process.
+// Frames with payload larger than wsMaxInspectedPayload are streamed unmodified,
+// skip is called for them with the frame header and the payload length.
+type webSocketFrameReader struct {
+	r        *bufio.Reader
+	outbound bool
+	process  func(f *WebSocketFrame) error
+	skip     func(f *WebSocketFrame, n uint64)
+
+	buf         bytes.Buffer
+	passthrough uint64
+}
+
+func newWebSocketFrameReader(r io.Reader, outbound bool) *webSocketFrameReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &webSocketFrameReader{
+		r:        br,
+		outbound: outbound,
+		process:  func(f *WebSocketFrame) error { return nil },
+		skip:     func(f *WebSocketFrame, n uint64) {},
+	}
+}
+
+func (r *webSocketFrameReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.passthrough > 0 {
+			if uint64(len(p)) > r.passthrough {
+				p = p[:r.passthrough]
+			}
+			n, err := r.r.Read(p)
+			r.passthrough -= uint64(n)
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// next reads the next frame and writes the processed frame to the buffer.
+func (r *webSocketFrameReader) next() error {
+	h, err := readWebSocketFrameHeader(r.r)
+	if err != nil {
+		return err
+	}
+	if h.masked != r.outbound {
+		return fmt.Errorf("websocket: unexpected masked=%t frame", h.masked)
+	}
+
+	f := WebSocketFrame{
+		Fin:    h.fin,
+		Rsv:    h.rsv,
+		Opcode: h.opcode,
+	}
+
+	if h.length > wsMaxInspectedPayload {
+		r.skip(&f, h.length)
+		r.buf.Write(h.encode())
+		r.passthrough = h.length
+		return nil
+	}
+
+	f.Payload = make([]byte, h.length)
+	if _, err := io.ReadFull(r.r, f.Payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if h.masked {
+		maskWebSocketPayload(h.mask, f.Payload)
+	}
+
+	if err := r.process(&f); err != nil {
+		return err
+	}
+	if f.isControl() && (len(f.Payload) > 125 || !f.Fin) {
+		return errors.New("websocket: invalid control frame")
+	}
+
+	h.fin, h.rsv, h.opcode, h.length = f.Fin, f.Rsv&0x7, f.Opcode&0xf, uint64(len(f.Payload))
+	r.buf.Write(h.encode())
+	if h.masked {
+		maskWebSocketPayload(h.mask, f.Payload)
+	}
+	r.buf.Write(f.Payload)
+
+	return nil
+}
+
+type webSocketFrameHeader struct {
+	fin    bool
+	rsv    byte
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+}
+
+// readWebSocketFrameHeader reads a frame header, it returns io.EOF only if there is no data before the frame.
+func readWebSocketFrameHeader(r *bufio.Reader) (webSocketFrameHeader, error) {
+	var (
+		h webSocketFrameHeader
+		b [8]byte
+	)
+
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv = (b[0] >> 4) & 0x7
+	h.opcode = b[0] & 0xf
+	h.masked = b[1]&0x80 != 0
+
+	readFull := func(p []byte) error {
+		_, err := io.ReadFull(r, p)
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	switch l := b[1] & 0x7f; l {
+	case 126:
+		if err := readFull(b[:2]); err != nil {
+			return h, err
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if err := readFull(b[:8]); err != nil {
+			return h, err
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+		if h.length>>63 != 0 {
+			return h, errors.New("websocket: invalid payload length")
+		}
+	default:
+		h.length = uint64(l)
+	}
+
+	if h.masked {
+		if err := readFull(h.mask[:]); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+func (h *webSocketFrameHeader) encode() []byte {
+	b := make([]byte, 2, 14)
+	if h.fin {
+		b[0] |= 0x80
+	}
+	b[0] |= h.rsv<<4 | h.opcode
+	if h.masked {
+		b[1] |= 0x80
+	}
+
+	switch {
+	case h.length < 126:
+		b[1] |= byte(h.length)
+	case h.length <= 0xffff:
+		b[1] |= 126
+		b = binary.BigEndian.AppendUint16(b, uint16(h.length))
+	default:
+		b[1] |= 127
+		b = binary.BigEndian.AppendUint64(b, h.length)
+	}
+
+	if h.masked {
+		b = append(b, h.mask[:]...)
+	}
+
+	return b
+}
+
+// maskWebSocketPayload masks or unmasks the payload in place.
+func maskWebSocketPayload(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2023 Sauce Labs Inc. All rights reserved.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/saucelabs/forwarder/log/stdlog"
+)
+
+func writeTestWebSocketFrame(w io.Writer, masked bool, opcode byte, payload []byte) {
+	h := webSocketFrameHeader{
+		fin:    true,
+		opcode: opcode,
+		masked: masked,
+		mask:   [4]byte{1, 2, 3, 4},
+		length: uint64(len(payload)),
+	}
+	p := bytes.Clone(payload)
+	if masked {
+		maskWebSocketPayload(h.mask, p)
+	}
+	w.Write(h.encode())
+	w.Write(p)
+}
+
+func readTestWebSocketFrame(t *testing.T, r *bufio.Reader) (webSocketFrameHeader, []byte) {
+	t.Helper()
+
+	h, err := readWebSocketFrameHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, h.length)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatal(err)
+	}
+	if h.masked {
+		maskWebSocketPayload(h.mask, p)
+	}
+	return h, p
+}
+
+func TestWebSocketFrameReader(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), wsMaxInspectedPayload+1)
+
+	var in bytes.Buffer
+	writeTestWebSocketFrame(&in, true, WebSocketTextFrame, []byte("hello"))
+	writeTestWebSocketFrame(&in, true, WebSocketBinaryFrame, make([]byte, 125))
+	writeTestWebSocketFrame(&in, true, WebSocketBinaryFrame, large)
+	writeTestWebSocketFrame(&in, true, WebSocketPingFrame, nil)
+
+	var skipped []uint64
+	r := newWebSocketFrameReader(&in, true)
+	r.process = func(f *WebSocketFrame) error {
+		if f.Opcode == WebSocketTextFrame {
+			f.Payload = bytes.ToUpper(f.Payload)
+		}
+		if f.Opcode == WebSocketBinaryFrame {
+			// Changes the length encoding from 7 to 16 bits.
+			f.Payload = append(f.Payload, 0)
+		}
+		return nil
+	}
+	r.skip = func(f *WebSocketFrame, n uint64) {
+		skipped = append(skipped, n)
+	}
+
+	out := bufio.NewReader(r)
+
+	expected := []struct {
+		opcode  byte
+		payload []byte
+	}{
+		{WebSocketTextFrame, []byte("HELLO")},
+		{WebSocketBinaryFrame, make([]byte, 126)},
+		{WebSocketBinaryFrame, large},
+		{WebSocketPingFrame, []byte{}},
+	}
+	for i, e := range expected {
+		h, p := readTestWebSocketFrame(t, out)
+		if !h.masked || h.opcode != e.opcode || !bytes.Equal(p, e.payload) {
+			t.Errorf("frame %d: unexpected masked=%t opcode=%d len=%d", i, h.masked, h.opcode, len(p))
+		}
+	}
+	if _, err := out.ReadByte(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if len(skipped) != 1 || skipped[0] != uint64(len(large)) {
+		t.Errorf("unexpected skipped frames %v", skipped)
+	}
+}
+
+func TestWebSocketFrameReaderUnmaskedOutbound(t *testing.T) {
+	var in bytes.Buffer
+	writeTestWebSocketFrame(&in, false, WebSocketTextFrame, []byte("hello"))
+
+	if _, err := io.ReadAll(newWebSocketFrameReader(&in, true)); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestWebSocketModifier(t *testing.T) {
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Sec-WebSocket-Extensions"); v != "" {
+			t.Errorf("unexpected extensions %q", v)
+		}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, p, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, append([]byte("echo "), p...)); err != nil {
+				return
+			}
+		}
+	}))
+	defer origin.Close()
+
+	cfg := DefaultHTTPProxyConfig()
+	cfg.ProxyLocalhost = AllowProxyLocalhost
+	cfg.WebSocketModifiers = []WebSocketModifier{
+		WebSocketModifierFunc(func(req *http.Request, outbound bool, f *WebSocketFrame) error {
+			if f.Opcode != WebSocketTextFrame {
+				return nil
+			}
+			if outbound {
+				f.Payload = bytes.ToUpper(f.Payload)
+			} else {
+				f.Payload = append(f.Payload, '!')
+			}
+			return nil
+		}),
+	}
+	p, err := NewInMemoryHTTPProxy(cfg, nil, nil, nil, stdlog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	conn, err := p.DialContext(context.Background(), "tcp", "in-memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, err := http.NewRequest(http.MethodGet, origin.URL, http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	if err := req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status %d, got %d", http.StatusSwitchingProtocols, res.StatusCode)
+	}
+
+	writeTestWebSocketFrame(conn, true, WebSocketTextFrame, []byte("hello"))
+	h, payload := readTestWebSocketFrame(t, br)
+	if h.rsv != 0 || h.opcode != WebSocketTextFrame {
+		t.Fatalf("unexpected frame rsv=%d opcode=%d", h.rsv, h.opcode)
+	}
+	if got := string(payload); got != "echo HELLO!" {
+		t.Fatalf("expected %q, got %q", "echo HELLO!", got)
+	}
+	if strings.Contains(res.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatal("unexpected compression")
+	}
+}